@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/Michaelhobo/nrfbazel/nrfbazelify"
+)
+
+var cleanCommand = &command{
+  summary: "Remove all generated BUILD files, remap.bzl, hints and .bazelify-out.",
+  usage: `clean --workspace=<absolute dir> --sdk=<absolute dir> [--sdk=<absolute dir>...]
+
+Only files recorded in the manifest written by generate are removed, and files
+that were edited after they were generated are kept.`,
+  setFlags: func(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+    var sdk sdkFlags
+    sdk.register(fs)
+    return func(ctx context.Context, args []string) error {
+      if err := sdk.check(); err != nil {
+        return err
+      }
+      if err := nrfbazelify.CleanGeneratedFiles(sdk.workspaceDir, sdk.sdkDirs); err != nil {
+        return err
+      }
+      log.Printf("Removed generated files from %s", sdk.sdkDirs.String())
+      return nil
+    }
+  },
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/Michaelhobo/nrfbazel/nrfbazelify"
+)
+
+var diffCommand = &command{
+  summary: "Compare a saved GraphML graph against another one, or against the current SDK.",
+  usage: `diff --old=<graphml file> (--new=<graphml file> | --workspace=<absolute dir> --sdk=<absolute dir>)
+
+Reports added and removed targets, dependencies, and group membership changes.
+Save a graph with "generate --full_graph --full_graph_formats=graphml", e.g.
+before bumping the SDK version, and diff against it afterwards.`,
+  setFlags: func(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+    var sdk sdkFlags
+    sdk.register(fs)
+    oldPath := fs.String("old", "", "The GraphML file from the previous run.")
+    newPath := fs.String("new", "", "The GraphML file from the current run. If unset, the graph is resolved from --workspace and --sdk.")
+    return func(ctx context.Context, args []string) error {
+      if *oldPath == "" {
+        return fmt.Errorf("--old is required")
+      }
+      before, err := nrfbazelify.ReadGraphSnapshot(*oldPath)
+      if err != nil {
+        return fmt.Errorf("ReadGraphSnapshot(%q): %v", *oldPath, err)
+      }
+      var after *nrfbazelify.GraphSnapshot
+      if *newPath != "" {
+        if after, err = nrfbazelify.ReadGraphSnapshot(*newPath); err != nil {
+          return fmt.Errorf("ReadGraphSnapshot(%q): %v", *newPath, err)
+        }
+      } else {
+        if err := sdk.check(); err != nil {
+          return err
+        }
+        graph, err := nrfbazelify.LoadGraph(ctx, sdk.workspaceDir, sdk.sdkDirs, nrfbazelify.Verbosity(sdk.verbosity))
+        if err != nil {
+          return err
+        }
+        after = graph.Snapshot()
+      }
+      fmt.Print(nrfbazelify.DiffGraphs(before, after))
+      return nil
+    }
+  },
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/Michaelhobo/nrfbazel/nrfbazelify"
+)
+
+var generateCommand = &command{
+  summary: "Generate BUILD files for the SDK (the default command).",
+  usage: `generate --workspace=<absolute dir> --sdk=<absolute dir> [--sdk=<absolute dir>...] [--verbose[=<level>]] [--force]
+
+generate replaces the BUILD files it generated in the directories specified by
+--sdk. It stops if it finds any other BUILD files there, unless --force is
+passed, which deletes them too.`,
+  setFlags: func(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+    var sdk sdkFlags
+    sdk.register(fs)
+    return func(ctx context.Context, args []string) error {
+      if err := sdk.check(); err != nil {
+        return err
+      }
+      log.Printf("Generating BUILD files for %s", sdk.sdkDirs.String())
+      if err := nrfbazelify.GenerateBuildFiles(ctx, sdk.workspaceDir, sdk.sdkDirs, nrfbazelify.Verbosity(sdk.verbosity)); err != nil {
+        return err
+      }
+      log.Printf("Successfully generated BUILD files for %s", sdk.sdkDirs.String())
+      return nil
+    }
+  },
+}
+
+var checkCommand = &command{
+  summary: "Check that all dependencies resolve, without writing any files.",
+  usage: "check --workspace=<absolute dir> --sdk=<absolute dir> [--sdk=<absolute dir>...] [--verbose[=<level>]]",
+  setFlags: func(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+    var sdk sdkFlags
+    sdk.register(fs)
+    return func(ctx context.Context, args []string) error {
+      if err := sdk.check(); err != nil {
+        return err
+      }
+      if err := nrfbazelify.CheckBuildFiles(ctx, sdk.workspaceDir, sdk.sdkDirs, nrfbazelify.Verbosity(sdk.verbosity)); err != nil {
+        return err
+      }
+      log.Printf("All dependencies in %s resolved", sdk.sdkDirs.String())
+      return nil
+    }
+  },
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/Michaelhobo/nrfbazel/nrfbazelify"
+)
+
+var importCommand = &command{
+  summary: "Seed a .bazelifyrc from an IDE project, like a Segger Embedded Studio .emProject, Keil .uvprojx or IAR .ewp.",
+  usage: `import --sdk=<absolute dir> --project=<project file> [--out=<file>]
+
+The project's own files become a source set, its include dirs become
+include_dirs, and its preprocessor definitions become nrf_cc_library defines.
+The result is written to <sdk>/.bazelifyrc, or --out. Existing files are never
+overwritten.`,
+  setFlags: func(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+    sdkDir := fs.String("sdk", "", "The path to the SDK's root directory. Absolute path required.")
+    project := fs.String("project", "", "The IDE project file to import.")
+    out := fs.String("out", "", "Where to write the .bazelifyrc. Defaults to <sdk>/.bazelifyrc.")
+    return func(ctx context.Context, args []string) error {
+      if *sdkDir == "" || *project == "" {
+        return fmt.Errorf("--sdk and --project are required")
+      }
+      if *out == "" {
+        *out = filepath.Join(*sdkDir, ".bazelifyrc")
+      }
+      rc, err := nrfbazelify.ImportProject(*sdkDir, *project)
+      if err != nil {
+        return err
+      }
+      file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+      if err != nil {
+        return fmt.Errorf("%v; choose another file with --out", err)
+      }
+      defer file.Close()
+      if _, err := file.Write(rc); err != nil {
+        return fmt.Errorf("writing %s: %v", *out, err)
+      }
+      log.Printf("Imported %s into %s", *project, *out)
+      return nil
+    }
+  },
+}
@@ -1,28 +1,27 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/Michaelhobo/nrfbazel/nrfbazelify"
 )
 
-var (
-  workspaceDir = flag.String("workspace", "", "The Bazel WORKSPACE directory. Absolute path required.")
-  sdkDir       = flag.String("sdk", "", "The path to the nrf52 SDK's root directory. Absolute path required.")
-  verbose = flag.Bool("verbose", false, "Show verbose logs")
-)
-
-func init() {
-  flag.Usage = func() {
-    log.Print(`
+const usageHeader = `
 nrfbazelify converts an nrf5 SDK to Bazel (https://bazel.build).
 
-Usage: nrfbazelify --workspace=<absolute dir> --sdk=<absolute dir> [--verbose]
+Usage: nrfbazelify <command> [flags]
 
-WARNING: nrfbazelify will delete all existing BUILD files in the directory
-specified by --sdk
+Running nrfbazelify without a command is the same as running
+"nrfbazelify generate".
 
 nrfbazelify reads options from the .bazelifyrc file at the root of the SDK.
 You may be prompted to supply target overrides if nrfbazelify cannot resolve
@@ -31,21 +30,155 @@ all the dependencies.
 Original program written by Michael Ho. For questions and issues, please
 file issues at https://github.com/Michaelhobo/nrfbazel
 
-Flags:
-`)
-    flag.PrintDefaults()
+Commands:
+`
+
+// command is a single nrfbazelify subcommand.
+type command struct {
+  // One-line description of the command, shown in the command list.
+  summary string
+  // Usage line shown before the command's flags.
+  usage string
+  // setFlags registers the command's flags, and returns the function to run
+  // after the flags have been parsed.
+  setFlags func(fs *flag.FlagSet) func(ctx context.Context, args []string) error
+}
+
+var commands = map[string]*command{
+  "clean": cleanCommand,
+  "diff": diffCommand,
+  "generate": generateCommand,
+  "import": importCommand,
+  "query": queryCommand,
+  "check": checkCommand,
+  "serve": serveCommand,
+  "validate": validateCommand,
+}
+
+func init() {
+  flag.Usage = func() {
+    var out strings.Builder
+    out.WriteString(usageHeader)
+    var names []string
+    for name := range commands {
+      names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+      fmt.Fprintf(&out, "  %-10s %s\n", name, commands[name].summary)
+    }
+    out.WriteString("\nRun \"nrfbazelify <command> --help\" for a command's flags.\n")
+    log.Print(out.String())
   }
 }
 
 func main() {
-  flag.Parse()
-  if *workspaceDir == "" || *sdkDir == "" {
+  args := os.Args[1:]
+  name := "generate"
+  // Keep the bare invocation (nrfbazelify --workspace=... --sdk=...) working.
+  if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+    name = args[0]
+    args = args[1:]
+  }
+  if name == "help" {
+    flag.Usage()
+    return
+  }
+  cmd := commands[name]
+  if cmd == nil {
+    log.Printf("unknown command %q", name)
     flag.Usage()
     os.Exit(1)
   }
-  log.Printf("Generating BUILD files for %s", *sdkDir)
-  if err := nrfbazelify.GenerateBuildFiles(*workspaceDir, *sdkDir, *verbose); err != nil {
-    log.Fatalf("Failed to generate BUILD files: %v", err)
+
+  fs := flag.NewFlagSet(name, flag.ExitOnError)
+  fs.Usage = func() {
+    log.Printf("\nUsage: nrfbazelify %s\n\nFlags:\n", cmd.usage)
+    fs.PrintDefaults()
+  }
+  run := cmd.setFlags(fs)
+  addLibraryFlags(fs)
+  fs.Parse(args)
+
+  // Stop cleanly on Ctrl-C or when a CI runner times out.
+  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  defer stop()
+  if err := run(ctx, fs.Args()); err != nil {
+    log.Fatalf("nrfbazelify %s: %v", name, err)
+  }
+}
+
+// addLibraryFlags makes the flags registered by the nrfbazelify package
+// available to every command.
+func addLibraryFlags(fs *flag.FlagSet) {
+  flag.CommandLine.VisitAll(func(f *flag.Flag) {
+    if fs.Lookup(f.Name) == nil {
+      fs.Var(f.Value, f.Name, f.Usage)
+    }
+  })
+}
+
+// sdkFlags are the flags shared by every command that operates on an SDK.
+type sdkFlags struct {
+  workspaceDir string
+  sdkDirs stringList
+  verbosity verbosityFlag
+}
+
+func (s *sdkFlags) register(fs *flag.FlagSet) {
+  fs.StringVar(&s.workspaceDir, "workspace", "", "The Bazel WORKSPACE directory. Absolute path required.")
+  fs.Var(&s.sdkDirs, "sdk", "The path to the nrf52 SDK's root directory. Absolute path required. Repeat to resolve multiple SDKs together; the first is the primary SDK.")
+  fs.Var(&s.verbosity, "verbose", "How much to log: 1 for a summary of each phase, 2 for how every include is resolved, 3 for the candidates of every include. --verbose alone is 1.")
+}
+
+// check makes sure the required flags were set.
+func (s *sdkFlags) check() error {
+  if s.workspaceDir == "" || len(s.sdkDirs) == 0 {
+    return fmt.Errorf("--workspace and --sdk are required")
+  }
+  return nil
+}
+
+// stringList is a flag that can be repeated.
+type stringList []string
+
+func (s *stringList) String() string {
+  return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+  *s = append(*s, value)
+  return nil
+}
+
+// verbosityFlag is a verbosity level that can also be set like a bool flag,
+// so --verbose is level 1.
+type verbosityFlag nrfbazelify.Verbosity
+
+func (v *verbosityFlag) String() string {
+  return strconv.Itoa(int(*v))
+}
+
+func (v *verbosityFlag) Set(value string) error {
+  level, err := strconv.Atoi(value)
+  if err != nil {
+    // --verbose and --verbose=false
+    b, err := strconv.ParseBool(value)
+    if err != nil {
+      return fmt.Errorf("must be a bool, or a level from %d to %d", nrfbazelify.VerbosityQuiet, nrfbazelify.VerbosityCandidates)
+    }
+    level = int(nrfbazelify.VerbosityQuiet)
+    if b {
+      level = int(nrfbazelify.VerbosityPhases)
+    }
+  }
+  if level < int(nrfbazelify.VerbosityQuiet) || level > int(nrfbazelify.VerbosityCandidates) {
+    return fmt.Errorf("level must be from %d to %d", nrfbazelify.VerbosityQuiet, nrfbazelify.VerbosityCandidates)
   }
-  log.Printf("Successfully generated BUILD files for %s", *sdkDir)
+  *v = verbosityFlag(level)
+  return nil
+}
+
+func (v *verbosityFlag) IsBoolFlag() bool {
+  return true
 }
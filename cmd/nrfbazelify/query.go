@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/nrfbazelify"
+)
+
+var queryCommand = &command{
+  summary: "Query the resolved dependency graph, e.g. rdeps(nrf_sdh.h) or somepath(//a:b, c.h).",
+  usage: `query --workspace=<absolute dir> --sdk=<absolute dir> [--sdk=<absolute dir>...] <expression>
+
+Expressions:
+  deps(<target>[, <depth>])   the target and everything it depends on
+  rdeps(<target>[, <depth>])  the target and everything that depends on it
+  somepath(<from>, <to>)      a shortest dependency chain from one target to another
+  allpaths(<from>, <to>)      every dependency chain from one target to another
+
+A target is a label (//components/libraries/fifo:app_fifo) or a file name
+(app_fifo.h). No files are written.`,
+  setFlags: func(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+    var sdk sdkFlags
+    sdk.register(fs)
+    return func(ctx context.Context, args []string) error {
+      if err := sdk.check(); err != nil {
+        return err
+      }
+      if len(args) == 0 {
+        return fmt.Errorf("a query expression is required")
+      }
+      graph, err := nrfbazelify.LoadGraph(ctx, sdk.workspaceDir, sdk.sdkDirs, nrfbazelify.Verbosity(sdk.verbosity))
+      if err != nil {
+        return err
+      }
+      result, err := graph.Query(strings.Join(args, " "))
+      if err != nil {
+        return err
+      }
+      fmt.Print(result)
+      return nil
+    }
+  },
+}
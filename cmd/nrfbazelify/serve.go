@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Michaelhobo/nrfbazel/nrfbazelify"
+)
+
+var serveCommand = &command{
+  summary: "Serve an interactive view of the resolved dependency graph.",
+  usage: `serve --workspace=<absolute dir> --sdk=<absolute dir> [--sdk=<absolute dir>...] [--addr=localhost:8080]
+
+Resolves the graph once, then serves a web page to search targets by label or
+header name, browse deps and rdeps, and see group membership. No files are
+written.`,
+  setFlags: func(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+    var sdk sdkFlags
+    sdk.register(fs)
+    addr := fs.String("addr", "localhost:8080", "The address to serve on.")
+    return func(ctx context.Context, args []string) error {
+      if err := sdk.check(); err != nil {
+        return err
+      }
+      graph, err := nrfbazelify.LoadGraph(ctx, sdk.workspaceDir, sdk.sdkDirs, nrfbazelify.Verbosity(sdk.verbosity))
+      if err != nil {
+        return err
+      }
+      server := &http.Server{
+        Addr: *addr,
+        Handler: nrfbazelify.NewGraphHandler(graph),
+      }
+      go func() {
+        <-ctx.Done()
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        server.Shutdown(shutdownCtx)
+      }()
+      log.Printf("Serving the dependency graph at http://%s", *addr)
+      if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+        return err
+      }
+      return nil
+    }
+  },
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/Michaelhobo/nrfbazel/nrfbazelify"
+)
+
+var validateCommand = &command{
+  summary: "Validate the .bazelifyrc files without walking the SDK.",
+  usage: "validate --workspace=<absolute dir> --sdk=<absolute dir> [--sdk=<absolute dir>...]",
+  setFlags: func(fs *flag.FlagSet) func(ctx context.Context, args []string) error {
+    var sdk sdkFlags
+    sdk.register(fs)
+    return func(ctx context.Context, args []string) error {
+      if err := sdk.check(); err != nil {
+        return err
+      }
+      if err := nrfbazelify.ValidateConfig(sdk.workspaceDir, sdk.sdkDirs); err != nil {
+        return err
+      }
+      log.Printf(".bazelifyrc is valid for %s", sdk.sdkDirs.String())
+      return nil
+    }
+  },
+}
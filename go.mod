@@ -3,6 +3,7 @@ module github.com/Michaelhobo/nrfbazel
 go 1.16
 
 require (
+	github.com/bazelbuild/buildtools v0.0.0-20211007154642-8dd79e56e98e
 	github.com/golang/protobuf v1.5.2
 	github.com/google/go-cmp v0.5.5
 	github.com/google/uuid v1.2.0
@@ -2,15 +2,20 @@ package bazel
 
 import (
 	"fmt"
+	"os"
+	"path"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
 )
 
-var (
-  labelRegexp = regexp.MustCompile(`^//([\w_#-\./]*)(?::(\w+))?$`)
-  relativeLabelRegexp = regexp.MustCompile(`^:(\w+)$`)
-)
+// Characters that Bazel allows in package and target names, besides letters
+// and digits. "/" separates their parts. See
+// https://bazel.build/concepts/labels#lexical-specification.
+const labelPunct = "!\"#$%&'()*+,-.;<=>?@[]^_{|}~"
+
+// Names of the files that make a directory a package.
+var buildFileNames = []string{"BUILD", "BUILD.bazel"}
 
 func JoinLabelStrings(labels []*Label, separator string) string {
   var out string
@@ -35,26 +40,100 @@ func NewLabel(absDir, name, workspaceDir string) (*Label, error) {
   if err != nil {
     return nil, fmt.Errorf("filepath.Rel(%q, %q): %v", workspaceDir, absDir, err)
   }
+  dir = filepath.ToSlash(dir)
+  if err := validatePackage(dir); err != nil {
+    return nil, err
+  }
+  if err := validateName(name); err != nil {
+    return nil, err
+  }
   return &Label{
     dir: dir,
     name: name,
   }, nil
 }
 
+// NewFileLabel creates the label of the file at absPath, in the package in
+// pkgDir, like "//pkg:sub/dir/file.h". The file can be in a subdirectory of
+// pkgDir, as long as no directory in between is a package of its own, since
+// Bazel labels can't cross package boundaries.
+func NewFileLabel(pkgDir, absPath, workspaceDir string) (*Label, error) {
+  name, err := filepath.Rel(pkgDir, absPath)
+  if err != nil {
+    return nil, fmt.Errorf("filepath.Rel(%q, %q): %v", pkgDir, absPath, err)
+  }
+  if name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+    return nil, fmt.Errorf("%q isn't in %q", absPath, pkgDir)
+  }
+  label, err := NewLabel(pkgDir, filepath.ToSlash(name), workspaceDir)
+  if err != nil {
+    return nil, err
+  }
+  if err := label.CheckPackageBoundary(workspaceDir); err != nil {
+    return nil, err
+  }
+  return label, nil
+}
+
+// NewRepoLabel creates a label in an external repository, like
+// "@repo//dir:name". dir is relative to the repository's root. An empty repo
+// is the main repository.
+func NewRepoLabel(repo, dir, name string) (*Label, error) {
+  if err := validateRepo(repo); err != nil {
+    return nil, err
+  }
+  if err := validatePackage(dir); err != nil {
+    return nil, err
+  }
+  if err := validateName(name); err != nil {
+    return nil, err
+  }
+  return &Label{
+    repo: repo,
+    dir: dir,
+    name: name,
+  }, nil
+}
+
+// ParseLabel parses an absolute label, like "//dir:name", or
+// "@repo//dir:name" for a label in an external repository. "@repo" is short
+// for "@repo//:repo", and "@//dir:name" is in the main repository.
 func ParseLabel(label string) (*Label, error) {
-  capture := labelRegexp.FindStringSubmatch(label)
-  if capture == nil {
-    return nil, fmt.Errorf("%q does not match %q", label, labelRegexp)
+  var repo string
+  rest := label
+  if strings.HasPrefix(rest, "@") {
+    repo = strings.TrimLeft(rest, "@")
+    rest = ""
+    if i := strings.Index(repo, "//"); i >= 0 {
+      repo, rest = repo[:i], repo[i:]
+    } else {
+      rest = "//:" + repo
+    }
+    if err := validateRepo(repo); err != nil {
+      return nil, fmt.Errorf("%q: %v", label, err)
+    }
   }
-  dir := capture[1]
-  name := capture[2]
-  if name == "" {
+  if !strings.HasPrefix(rest, "//") {
+    return nil, fmt.Errorf("%q must start with // or @", label)
+  }
+  dir := strings.TrimPrefix(rest, "//")
+  var name string
+  if i := strings.Index(dir, ":"); i >= 0 {
+    dir, name = dir[:i], dir[i+1:]
+  } else {
     if dir == "" {
-      return nil, fmt.Errorf("%q returned an empty regexp capture", label)
+      return nil, fmt.Errorf("%q has no package or name", label)
     }
-    name = filepath.Base(dir)
+    name = path.Base(dir)
+  }
+  if err := validatePackage(dir); err != nil {
+    return nil, fmt.Errorf("%q: %v", label, err)
+  }
+  if err := validateName(name); err != nil {
+    return nil, fmt.Errorf("%q: %v", label, err)
   }
   return &Label{
+    repo: repo,
     dir: dir,
     name: name,
   }, nil
@@ -64,23 +143,82 @@ func ParseRelativeLabel(other *Label, label string) (*Label, error) {
   if other == nil {
     return nil, fmt.Errorf("other label is nil")
   }
-  capture := relativeLabelRegexp.FindStringSubmatch(label)
-  if len(capture) == 0 {
+  if !strings.HasPrefix(label, ":") {
     return ParseLabel(label)
   }
-  name := capture[1]
-  if name == "" {
-    return nil, fmt.Errorf("%q returned an empty regexp capture", label)
-  }	
+  name := strings.TrimPrefix(label, ":")
+  if err := validateName(name); err != nil {
+    return nil, fmt.Errorf("%q: %v", label, err)
+  }
   return &Label{
+    repo: other.repo,
     dir: other.dir,
     name: name,
   }, nil
 }
 
+// validateRepo checks that the repository name is empty, for the main
+// repository, or starts with a letter, followed by letters, digits, "-", "."
+// and "_".
+func validateRepo(repo string) error {
+  for i, c := range repo {
+    letter := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+    if i == 0 && !letter || !letter && !(c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+      return fmt.Errorf("repository name %q: %q isn't allowed", repo, c)
+    }
+  }
+  return nil
+}
+
+// validatePackage checks that the package name follows Bazel's lexical
+// specification. The root package is empty, or "." for labels from NewLabel.
+func validatePackage(pkg string) error {
+  if pkg == "" || pkg == "." {
+    return nil
+  }
+  if err := validateParts(pkg); err != nil {
+    return fmt.Errorf("package %q: %v", pkg, err)
+  }
+  return nil
+}
+
+// validateName checks that the target name follows Bazel's lexical
+// specification. Names of files in subdirectories, like "include/a.h", are
+// allowed.
+func validateName(name string) error {
+  if name == "" {
+    return fmt.Errorf("target name is empty")
+  }
+  if err := validateParts(name); err != nil {
+    return fmt.Errorf("target name %q: %v", name, err)
+  }
+  return nil
+}
+
+// validateParts checks the characters of a package or target name, and its
+// parts between slashes.
+func validateParts(s string) error {
+  for _, c := range s {
+    if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '/' || strings.ContainsRune(labelPunct, c)) {
+      return fmt.Errorf("%q isn't allowed", c)
+    }
+  }
+  for _, part := range strings.Split(s, "/") {
+    switch part {
+    case "":
+      return fmt.Errorf("can't start or end with /, or contain //")
+    case ".", "..":
+      return fmt.Errorf("can't contain %q", part)
+    }
+  }
+  return nil
+}
+
 // Label is a Bazel BUILD label.
 type Label struct {
-  // Relative dir from 
+  // External repository, or empty for the main repository.
+  repo string
+  // Relative dir from the repository's root.
   dir string
   name string
 }
@@ -90,33 +228,105 @@ func (l *Label) Name() string {
   return l.name
 }
 
+// Repo returns the label's external repository, or "" if it's in the main
+// repository.
+func (l *Label) Repo() string {
+  return l.repo
+}
+
 // Dir returns the directory the label belongs in.
 func (l *Label) Dir() string {
   return l.dir
 }
 
 func (l *Label) String() string {
+  l = l.Canonicalize()
   out := fmt.Sprintf("//%s", l.dir)
-  if filepath.Base(l.dir) != l.name {
+  if l.repo != "" {
+    out = "@" + l.repo + out
+  }
+  if l.dir == "" || path.Base(l.dir) != l.name {
     out = fmt.Sprintf("%s:%s", out, l.name)
   }
   return out
 }
 
+// File returns the path of the file the label refers to, relative to the
+// repository's root, like "pkg/sub/dir/file.h" for "//pkg:sub/dir/file.h".
+func (l *Label) File() string {
+  return path.Join(l.dir, l.name)
+}
+
+// CheckPackageBoundary checks that the label doesn't cross into another
+// package, which is the case if a directory in the name, like "sub" of
+// "//pkg:sub/file.h", has a BUILD file. Labels in external repositories
+// aren't checked.
+func (l *Label) CheckPackageBoundary(workspaceDir string) error {
+  if l.repo != "" {
+    return nil
+  }
+  dir := l.dir
+  parts := strings.Split(l.name, "/")
+  for _, part := range parts[:len(parts)-1] {
+    dir = path.Join(dir, part)
+    for _, buildFile := range buildFileNames {
+      if _, err := os.Stat(filepath.Join(workspaceDir, filepath.FromSlash(dir), buildFile)); err == nil {
+        return fmt.Errorf("%s crosses the boundary of package //%s", l, dir)
+      }
+    }
+  }
+  return nil
+}
+
+// Canonicalize returns the label in canonical form, where the root package is
+// "", not ".". String formats canonical labels like Bazel does, leaving out
+// ":name" when the name is the last part of the package.
+func (l *Label) Canonicalize() *Label {
+  dir := l.dir
+  if dir == "." {
+    dir = ""
+  }
+  return &Label{
+    repo: l.repo,
+    dir: dir,
+    name: l.name,
+  }
+}
+
+// Equal checks whether the labels refer to the same target.
+func (l *Label) Equal(other *Label) bool {
+  a, b := l.Canonicalize(), other.Canonicalize()
+  return a.repo == b.repo && a.dir == b.dir && a.name == b.name
+}
+
+// Less orders labels like their strings, so sorted labels read in order:
+// labels in the main repository come first, and "//a/b" comes before "//a:c".
+func (l *Label) Less(other *Label) bool {
+  return l.String() < other.String()
+}
+
+// SortLabels sorts the labels with Less.
+func SortLabels(labels []*Label) {
+  sort.SliceStable(labels, func(i, j int) bool {
+    return labels[i].Less(labels[j])
+  })
+}
+
 // RelativeTo generates the label string relative to another label.
 func (l *Label) RelativeTo(other *Label) string {
-  if l.dir != other.dir {
+  if l.repo != other.repo || l.Canonicalize().dir != other.Canonicalize().dir {
     return l.String()
   }
   return fmt.Sprintf(":%s", l.name)
 }
 
 // FileRelativeTo generates the label string as if it's a file.
-// Files in the same dir just have the name, like "some_file.h".
+// Files in the same dir just have the name, like "some_file.h", or
+// "sub/dir/some_file.h" for files in subdirectories of the package.
 // Files in different directories should look like a regular label,
 // like "//some/path:some_file.h".
 func (l *Label) FileRelativeTo(dir string) string {
-  if l.dir != dir {
+  if l.repo != "" || l.dir != dir {
     return l.String()
   }
   return l.name
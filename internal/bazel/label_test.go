@@ -1,6 +1,10 @@
 package bazel
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestLabel_String(t *testing.T) {
   tests := map[string]struct{
@@ -33,6 +37,13 @@ func TestLabel_String(t *testing.T) {
         name: "aliens",
       },
       want: "//:aliens",
+    },    "external repository": {
+      label: &Label{
+        repo: "cmsis",
+        dir: "CMSIS/Core",
+        name: "core",
+      },
+      want: "@cmsis//CMSIS/Core:core",
     },
   }
   for name, test := range tests {
@@ -80,6 +91,30 @@ func TestLabel_RelativeTo(t *testing.T) {
         name: "humans",
       },
       want: ":aliens",
+    },    "different repository": {
+      label: &Label{
+        repo: "cmsis",
+        dir: "something/out/there",
+        name: "aliens",
+      },
+      other: &Label{
+        dir: "something/out/there",
+        name: "humans",
+      },
+      want: "@cmsis//something/out/there:aliens",
+    },
+    "same repository": {
+      label: &Label{
+        repo: "cmsis",
+        dir: "something/out/there",
+        name: "aliens",
+      },
+      other: &Label{
+        repo: "cmsis",
+        dir: "something/out/there",
+        name: "humans",
+      },
+      want: ":aliens",
     },
   }
   for name, test := range tests {
@@ -123,6 +158,56 @@ func TestLabel_ParseLabel(t *testing.T) {
         name: "aliens",
       },
     },
+    "dots, dashes and plus signs": {
+      label: "//external/nrf_cc310-3.0.1:crys+rsa.h",
+      want: &Label{
+        dir: "external/nrf_cc310-3.0.1",
+        name: "crys+rsa.h",
+      },
+    },
+    "directory with dots": {
+      label: "//components/libraries/v1.2",
+      want: &Label{
+        dir: "components/libraries/v1.2",
+        name: "v1.2",
+      },
+    },
+    "file in a subdirectory": {
+      label: "//lib:include/a.h",
+      want: &Label{
+        dir: "lib",
+        name: "include/a.h",
+      },
+    },    "external repository": {
+      label: "@cmsis//CMSIS/Core:core",
+      want: &Label{
+        repo: "cmsis",
+        dir: "CMSIS/Core",
+        name: "core",
+      },
+    },
+    "external repository name matches directory": {
+      label: "@nrf_cc310-3.0.1//crys",
+      want: &Label{
+        repo: "nrf_cc310-3.0.1",
+        dir: "crys",
+        name: "crys",
+      },
+    },
+    "external repository root": {
+      label: "@cmsis",
+      want: &Label{
+        repo: "cmsis",
+        name: "cmsis",
+      },
+    },
+    "main repository": {
+      label: "@//something:aliens",
+      want: &Label{
+        dir: "something",
+        name: "aliens",
+      },
+    },
   }
   for name, test := range tests {
     t.Run(name, func(t *testing.T) {
@@ -175,6 +260,18 @@ func TestLabel_ParseRelativeLabel(t *testing.T) {
       want: &Label{
         name: "aliens",
       },
+    },    "external repository": {
+      label: ":aliens",
+      other: &Label{
+        repo: "cmsis",
+        dir: "something/out/there",
+        name: "stars",
+      },
+      want: &Label{
+        repo: "cmsis",
+        dir: "something/out/there",
+        name: "aliens",
+      },
     },
   }
   for name, test := range tests {
@@ -189,4 +286,273 @@ func TestLabel_ParseRelativeLabel(t *testing.T) {
       }
     })
   }
-}
\ No newline at end of file
+}
+
+func TestLabel_ParseLabelErrors(t *testing.T) {
+  tests := map[string]string{
+    "empty": "",
+    "not absolute": "something:aliens",
+    "no package or name": "//",
+    "empty name": "//something:",
+    "space": "//something:ali ens",
+    "colon in name": "//something:ali:ens",
+    "backslash": "//some\\thing:aliens",
+    "double slash": "//something//out:aliens",
+    "trailing slash": "//something/:aliens",
+    "dot dot": "//something/../out:aliens",
+    "dot name": "//something:.",
+    "name starts with slash": "//something:/aliens",
+    "repository starts with a digit": "@1cmsis//core",
+    "repository with a slash": "@cm/sis//core",
+    "repository without a package": "@cmsis:core",
+  }
+  for name, label := range tests {
+    t.Run(name, func(t *testing.T) {
+      if got, err := ParseLabel(label); err == nil {
+        t.Errorf("ParseLabel(%q)=%q, want an error", label, got)
+      }
+    })
+  }
+}
+
+func TestLabel_NewLabel(t *testing.T) {
+  tests := map[string]struct{
+    absDir string
+    name string
+    want string
+    wantErr bool
+  }{
+    "nominal": {
+      absDir: "/ws/sdk/nrf_cc310-3.0.1",
+      name: "crys+rsa.h",
+      want: "//sdk/nrf_cc310-3.0.1:crys+rsa.h",
+    },
+    "file in a subdirectory": {
+      absDir: "/ws/sdk",
+      name: "include/c.h",
+      want: "//sdk:include/c.h",
+    },
+    "invalid name": {
+      absDir: "/ws/sdk",
+      name: "a b.h",
+      wantErr: true,
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      got, err := NewLabel(test.absDir, test.name, "/ws")
+      if test.wantErr {
+        if err == nil {
+          t.Errorf("NewLabel(%q, %q)=%q, want an error", test.absDir, test.name, got)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatalf("NewLabel(%q, %q): %v", test.absDir, test.name, err)
+      }
+      if got.String() != test.want {
+        t.Errorf("NewLabel(%q, %q)=%q, want %q", test.absDir, test.name, got, test.want)
+      }
+    })
+  }
+}
+
+func TestLabel_NewRepoLabel(t *testing.T) {
+  got, err := NewRepoLabel("cmsis", "CMSIS/Core", "core")
+  if err != nil {
+    t.Fatalf("NewRepoLabel: %v", err)
+  }
+  if want := "@cmsis//CMSIS/Core:core"; got.String() != want {
+    t.Errorf("NewRepoLabel()=%q, want %q", got, want)
+  }
+  if got.Repo() != "cmsis" {
+    t.Errorf("Repo()=%q, want %q", got.Repo(), "cmsis")
+  }
+  if want := "@cmsis//CMSIS/Core:core"; got.FileRelativeTo("CMSIS/Core") != want {
+    t.Errorf("FileRelativeTo(%q)=%q, want %q", "CMSIS/Core", got.FileRelativeTo("CMSIS/Core"), want)
+  }
+  if _, err := NewRepoLabel("cm/sis", "CMSIS/Core", "core"); err == nil {
+    t.Errorf("NewRepoLabel(%q) succeeded, want an error", "cm/sis")
+  }
+}
+
+func TestLabel_NewFileLabel(t *testing.T) {
+  workspaceDir := t.TempDir()
+  for _, dir := range []string{"pkg/sub/dir", "pkg/subpkg"} {
+    if err := os.MkdirAll(filepath.Join(workspaceDir, dir), 0755); err != nil {
+      t.Fatalf("os.MkdirAll: %v", err)
+    }
+  }
+  if err := os.WriteFile(filepath.Join(workspaceDir, "pkg/subpkg/BUILD.bazel"), nil, 0644); err != nil {
+    t.Fatalf("os.WriteFile: %v", err)
+  }
+  pkgDir := filepath.Join(workspaceDir, "pkg")
+  tests := map[string]struct{
+    path string
+    want string
+    wantFileRelative string
+    wantErr bool
+  }{
+    "same directory": {
+      path: "pkg/a.h",
+      want: "//pkg:a.h",
+      wantFileRelative: "a.h",
+    },
+    "subdirectory": {
+      path: "pkg/sub/dir/a.h",
+      want: "//pkg:sub/dir/a.h",
+      wantFileRelative: "sub/dir/a.h",
+    },
+    "subpackage": {
+      path: "pkg/subpkg/a.h",
+      wantErr: true,
+    },
+    "outside the package": {
+      path: "other/a.h",
+      wantErr: true,
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      absPath := filepath.Join(workspaceDir, test.path)
+      got, err := NewFileLabel(pkgDir, absPath, workspaceDir)
+      if test.wantErr {
+        if err == nil {
+          t.Errorf("NewFileLabel(%q)=%q, want an error", test.path, got)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatalf("NewFileLabel(%q): %v", test.path, err)
+      }
+      if got.String() != test.want {
+        t.Errorf("NewFileLabel(%q)=%q, want %q", test.path, got, test.want)
+      }
+      if got.File() != test.path {
+        t.Errorf("%v File()=%q, want %q", got, got.File(), test.path)
+      }
+      if got := got.FileRelativeTo("pkg"); got != test.wantFileRelative {
+        t.Errorf("FileRelativeTo(%q)=%q, want %q", "pkg", got, test.wantFileRelative)
+      }
+      if got := got.FileRelativeTo("pkg/sub"); got != test.want {
+        t.Errorf("FileRelativeTo(%q)=%q, want %q", "pkg/sub", got, test.want)
+      }
+    })
+  }
+}
+
+func TestLabel_CheckPackageBoundary(t *testing.T) {
+  workspaceDir := t.TempDir()
+  if err := os.MkdirAll(filepath.Join(workspaceDir, "pkg/subpkg"), 0755); err != nil {
+    t.Fatalf("os.MkdirAll: %v", err)
+  }
+  if err := os.WriteFile(filepath.Join(workspaceDir, "pkg/subpkg/BUILD"), nil, 0644); err != nil {
+    t.Fatalf("os.WriteFile: %v", err)
+  }
+  tests := map[string]bool{
+    "//pkg:a.h": false,
+    "//pkg:sub/a.h": false,
+    "//pkg:subpkg/a.h": true,
+    "//:pkg/subpkg/a.h": true,
+    "//pkg/subpkg:a.h": false,
+    "@cmsis//pkg:subpkg/a.h": false,
+  }
+  for label, wantErr := range tests {
+    t.Run(label, func(t *testing.T) {
+      l, err := ParseLabel(label)
+      if err != nil {
+        t.Fatalf("ParseLabel(%q): %v", label, err)
+      }
+      if err := l.CheckPackageBoundary(workspaceDir); (err != nil) != wantErr {
+        t.Errorf("%v CheckPackageBoundary()=%v, want error %v", l, err, wantErr)
+      }
+    })
+  }
+}
+
+func TestLabel_Canonicalize(t *testing.T) {
+  tests := map[string]struct{
+    label *Label
+    want string
+  }{
+    "root package": {
+      label: &Label{
+        dir: ".",
+        name: "aliens",
+      },
+      want: "//:aliens",
+    },
+    "name matches directory": {
+      label: &Label{
+        dir: "something/out/there",
+        name: "there",
+      },
+      want: "//something/out/there",
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      got := test.label.Canonicalize()
+      if got.String() != test.want {
+        t.Errorf("%v Canonicalize()=%q, want %q", test.label, got, test.want)
+      }
+      if !got.Equal(test.label) {
+        t.Errorf("%v Canonicalize()=%q isn't Equal to it", test.label, got)
+      }
+    })
+  }
+}
+
+func TestLabel_Equal(t *testing.T) {
+  tests := map[string]struct{
+    a, b string
+    want bool
+  }{
+    "same": {a: "//something:aliens", b: "//something:aliens", want: true},
+    "short form": {a: "//something/there", b: "//something/there:there", want: true},
+    "main repository": {a: "@//something:aliens", b: "//something:aliens", want: true},
+    "different name": {a: "//something:aliens", b: "//something:stars"},
+    "different package": {a: "//something:aliens", b: "//other:aliens"},
+    "different repository": {a: "@cmsis//something:aliens", b: "//something:aliens"},
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      a, err := ParseLabel(test.a)
+      if err != nil {
+        t.Fatalf("ParseLabel(%q): %v", test.a, err)
+      }
+      b, err := ParseLabel(test.b)
+      if err != nil {
+        t.Fatalf("ParseLabel(%q): %v", test.b, err)
+      }
+      if got := a.Equal(b); got != test.want {
+        t.Errorf("%v Equal(%v)=%v, want %v", a, b, got, test.want)
+      }
+    })
+  }
+  root := &Label{dir: ".", name: "aliens"}
+  if other := (&Label{name: "aliens"}); !root.Equal(other) {
+    t.Errorf("%v Equal(%v)=false, want true", root, other)
+  }
+}
+
+func TestSortLabels(t *testing.T) {
+  var labels []*Label
+  for _, s := range []string{"@cmsis//core", "//a:c", "//b", "//a/b", "//:z", "//a:b"} {
+    label, err := ParseLabel(s)
+    if err != nil {
+      t.Fatalf("ParseLabel(%q): %v", s, err)
+    }
+    labels = append(labels, label)
+  }
+  SortLabels(labels)
+  want := "//:z //a/b //a:b //a:c //b @cmsis//core"
+  if got := JoinLabelStrings(labels, " "); got != want {
+    t.Errorf("SortLabels()=%q, want %q", got, want)
+  }
+  for i := 1; i < len(labels); i++ {
+    if labels[i].Less(labels[i-1]) {
+      t.Errorf("%v Less(%v)=true, want false", labels[i], labels[i-1])
+    }
+  }
+}
@@ -1,11 +1,18 @@
 package buildfile
 
 import (
-	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+
+	"github.com/bazelbuild/buildtools/build"
+)
+
+const (
+  // The select() condition used when no other condition matches.
+  DefaultCondition = "//conditions:default"
 )
 
 // New creates a new File.
@@ -15,8 +22,9 @@ func New(dir string) *File {
   }
   return &File{
     Path: filepath.Join(dir, "BUILD"),
-    packageVisibility: "//visibility:public",
-    exportFiles: make(map[string]bool),
+    packageVisibility: []string{"//visibility:public"},
+    exportFiles: make(map[string][]string),
+    kept: &Kept{},
   }
 }
 
@@ -25,9 +33,22 @@ type File struct {
   Path string
   loads []*Load
   libs []*Library
+  binaries []*Binary
+  filegroups []*Filegroup
   labelSettings []*LabelSetting
-  packageVisibility string
-  exportFiles map[string]bool
+  constraintSettings []*ConstraintSetting
+  constraintValues []*ConstraintValue
+  configSettings []*ConfigSetting
+  platforms []*Platform
+  rules []*Rule
+  flags []*Flag
+  packageGroups []*PackageGroup
+  packageVisibility []string
+  packageLicenses []string
+  exportFiles map[string][]string // file -> visibility, nil for public
+  tags []string
+  comments []string
+  kept *Kept
 }
 
 // Write writes the file's generated contents to a file.
@@ -37,27 +58,69 @@ func (f *File) Write() error {
 
 // Generate generates the output contents of the file.
 func (f *File) Generate() string {
-  var out string
+  var stmts []build.Expr
+
+  // Generate the header comment
+  if len(f.comments) > 0 {
+    block := &build.CommentBlock{}
+    for _, comment := range f.comments {
+      block.After = append(block.After, build.Comment{Token: strings.TrimRight("# "+comment, " ")})
+    }
+    stmts = append(stmts, block)
+  }
 
-  // Generate load statements
-  sort.Slice(f.loads, func(i, j int) bool{
-    return f.loads[i].Source < f.loads[j].Source
+  // Generate load statements, including the flags' rules
+  loads := append([]*Load{}, f.loads...)
+  if load := flagsLoad(f.flags); load != nil {
+    loads = mergeLoad(loads, load)
+  }
+  sort.Slice(loads, func(i, j int) bool{
+    return loads[i].Source < loads[j].Source
   })
-  for _, load := range f.loads {
-    out += load.Generate() + "\n"
+  for _, load := range loads {
+    stmts = append(stmts, load.stmt())
   }
 
-  // Add default visibility
-  out += fmt.Sprintf("package(default_visibility=[%q])\n", f.packageVisibility)
+  // Add default visibility, and default licenses if there are any
+  if len(f.packageLicenses) == 0 {
+    stmts = append(stmts, callStmt("package", listAttr("default_visibility", f.packageVisibility)))
+  } else {
+    stmts = append(stmts, ruleCall("package", []*attr{
+      listAttr("default_applicable_licenses", f.packageLicenses),
+      listAttr("default_visibility", f.packageVisibility),
+    }))
+  }
 
   // Generate exports_files statement.
-  if len(f.exportFiles) > 0 {
-    var exportFiles []string
-    for f := range f.exportFiles {
-      exportFiles = append(exportFiles, f)
-    }
+  // Files with the same visibility are exported together, public ones first.
+  byVisibility := make(map[string][]string)
+  for file, visibility := range f.exportFiles {
+    key := strings.Join(visibility, " ")
+    byVisibility[key] = append(byVisibility[key], file)
+  }
+  var visibilities []string
+  for key := range byVisibility {
+    visibilities = append(visibilities, key)
+  }
+  sort.Strings(visibilities)
+  for _, key := range visibilities {
+    exportFiles := byVisibility[key]
     sort.Strings(exportFiles)
-    out += fmt.Sprintf("exports_files([%s])\n", joinQuoted(exportFiles, ","))
+    call := callStmt("exports_files", listAttr("", exportFiles))
+    if key != "" {
+      visibility := listAttr("visibility", f.exportFiles[exportFiles[0]])
+      visibility.sortable = sortable("exports_files", "visibility")
+      call.List = append(call.List, visibility.arg())
+    }
+    stmts = append(stmts, call)
+  }
+
+  // Generate all package_groups
+  sort.Slice(f.packageGroups, func(i, j int) bool {
+    return f.packageGroups[i].Name < f.packageGroups[j].Name
+  })
+  for _, packageGroup := range f.packageGroups {
+    stmts = append(stmts, ruleCall(packageGroup.kind(), packageGroup.attrs()))
   }
 
   // Generate all libraries
@@ -65,7 +128,23 @@ func (f *File) Generate() string {
     return f.libs[i].Name < f.libs[j].Name
   })
   for _, lib := range f.libs {
-    out += lib.Generate() + "\n"
+    stmts = f.appendRule(stmts, lib.Name, lib)
+  }
+
+  // Generate all binaries
+  sort.Slice(f.binaries, func(i, j int) bool {
+    return f.binaries[i].Name < f.binaries[j].Name
+  })
+  for _, binary := range f.binaries {
+    stmts = f.appendRule(stmts, binary.Name, binary)
+  }
+
+  // Generate all filegroups
+  sort.Slice(f.filegroups, func(i, j int) bool {
+    return f.filegroups[i].Name < f.filegroups[j].Name
+  })
+  for _, filegroup := range f.filegroups {
+    stmts = f.appendRule(stmts, filegroup.Name, filegroup)
   }
 
   // Generate all label_settings
@@ -73,21 +152,121 @@ func (f *File) Generate() string {
     return f.labelSettings[i].Name < f.labelSettings[j].Name
   })
   for _, labelSetting := range f.labelSettings {
-    out += labelSetting.Generate() + "\n"
+    stmts = f.appendRule(stmts, labelSetting.Name, labelSetting)
   }
 
-  return out
+  // Generate all flags
+  sort.Slice(f.flags, func(i, j int) bool {
+    return f.flags[i].Name < f.flags[j].Name
+  })
+  for _, flag := range f.flags {
+    stmts = f.appendRule(stmts, flag.Name, flag)
+  }
+
+  // Generate all constraint_settings, constraint_values and config_settings
+  sort.Slice(f.constraintSettings, func(i, j int) bool {
+    return f.constraintSettings[i].Name < f.constraintSettings[j].Name
+  })
+  for _, constraintSetting := range f.constraintSettings {
+    stmts = f.appendRule(stmts, constraintSetting.Name, constraintSetting)
+  }
+  sort.Slice(f.constraintValues, func(i, j int) bool {
+    return f.constraintValues[i].Name < f.constraintValues[j].Name
+  })
+  for _, constraintValue := range f.constraintValues {
+    stmts = f.appendRule(stmts, constraintValue.Name, constraintValue)
+  }
+  sort.Slice(f.configSettings, func(i, j int) bool {
+    return f.configSettings[i].Name < f.configSettings[j].Name
+  })
+  for _, configSetting := range f.configSettings {
+    stmts = f.appendRule(stmts, configSetting.Name, configSetting)
+  }
+
+  // Generate all platforms
+  sort.Slice(f.platforms, func(i, j int) bool {
+    return f.platforms[i].Name < f.platforms[j].Name
+  })
+  for _, platform := range f.platforms {
+    stmts = f.appendRule(stmts, platform.Name, platform)
+  }
+
+  // Generate all other rules
+  sort.Slice(f.rules, func(i, j int) bool {
+    return f.rules[i].Name < f.rules[j].Name
+  })
+  for _, r := range f.rules {
+    stmts = f.appendRule(stmts, r.Name, r)
+  }
+
+  // Add the rules that are kept with # keep, formatted like the others.
+  for _, name := range f.kept.keptRuleNames() {
+    stmts = append(stmts, f.kept.Rules[name])
+  }
+
+  // Statements are separated by empty lines, like buildifier formats them.
+  return formatStmts(stmts)
 }
 
-func joinQuoted(all []string, sep string) string {
-  var out string
-  for i, val := range all {
-    if i > 0 {
-      out += sep
+// appendRule appends the generated rule to stmts, with the file's tags and
+// what is kept of it with # keep. Rules that are kept as a whole are skipped,
+// since they're added as they were.
+func (f *File) appendRule(stmts []build.Expr, name string, r rule) []build.Expr {
+  if f.kept.Rules[name] != nil {
+    return stmts
+  }
+  attrs := r.attrs()
+  if len(f.tags) > 0 {
+    attrs = append(attrs, listAttr("tags", f.tags))
+  }
+  keptValues := f.kept.Values[name]
+  var names []string
+  for attrName := range keptValues {
+    names = append(names, attrName)
+  }
+  sort.Strings(names)
+  for _, attrName := range names {
+    a := findAttr(attrs, attrName)
+    if a == nil {
+      a = listAttr(attrName, nil)
+      attrs = append(attrs, a)
+    }
+    if a.expr != nil {
+      // Not a list of strings, so there's nothing to add the strings to.
+      continue
+    }
+    if a.list == nil {
+      a.list = []string{}
+    }
+    a.keptStrings = make(map[string]bool)
+    for _, value := range keptValues[attrName] {
+      a.keptStrings[value] = true
+      if !contains(a.list, value) {
+        a.list = append(a.list, value)
+      }
     }
-    out += fmt.Sprintf("%q", val)
   }
-  return out
+  keptAttrs := f.kept.Attrs[name]
+  names = nil
+  for attrName := range keptAttrs {
+    names = append(names, attrName)
+  }
+  sort.Strings(names)
+  for _, attrName := range names {
+    a := findAttr(attrs, attrName)
+    if a == nil {
+      a = &attr{name: attrName}
+      attrs = append(attrs, a)
+    }
+    a.expr = keptAttrs[attrName].RHS
+    a.comments = keptAttrs[attrName].Comments
+    a.kept = true
+  }
+  call := ruleCall(r.kind(), attrs)
+  if generic, ok := r.(*Rule); ok {
+    call.Comments = generic.Comments
+  }
+  return append(stmts, call)
 }
 
 // AddLoad adds a load statement to this file.
@@ -95,9 +274,52 @@ func (f *File) AddLoad(load *Load) {
   f.loads = append(f.loads, load)
 }
 
+// SetPackageVisibility sets the default_visibility of the package, which is
+// //visibility:public by default.
+func (f *File) SetPackageVisibility(visibility []string) {
+  f.packageVisibility = visibility
+}
+
+// SetPackageLicenses sets the default_applicable_licenses of the package,
+// which is omitted by default.
+func (f *File) SetPackageLicenses(licenses []string) {
+  f.packageLicenses = licenses
+}
+
+// AddComment adds a line to the comment at the top of this file.
+func (f *File) AddComment(comment string) {
+  f.comments = append(f.comments, comment)
+}
+
+// SetTags sets the tags of every rule in this file.
+func (f *File) SetTags(tags []string) {
+  f.tags = tags
+}
+
+// Keep keeps what the # keep comments of the existing BUILD file protect,
+// instead of generating it.
+func (f *File) Keep(kept *Kept) {
+  f.kept = kept
+}
+
 // ExportFile adds the file to the exports_files rule for this file.
 func (f *File) ExportFile(file string) {
-  f.exportFiles[file] = true
+  if _, ok := f.exportFiles[file]; !ok {
+    f.exportFiles[file] = nil
+  }
+}
+
+// ExportFileWithVisibility adds the file to an exports_files rule with the
+// visibility, instead of the public one.
+func (f *File) ExportFileWithVisibility(file string, visibility []string) {
+  f.exportFiles[file] = visibility
+}
+
+// Exported reports whether the file is in an exports_files rule of this
+// file, with any visibility.
+func (f *File) Exported(file string) bool {
+  _, ok := f.exportFiles[file]
+  return ok
 }
 
 // AddLibrary adds a library to this file.
@@ -105,53 +327,479 @@ func (f *File) AddLibrary(lib *Library) {
   f.libs = append(f.libs, lib)
 }
 
+// EachLibrary calls fn with every library in this file.
+func (f *File) EachLibrary(fn func(lib *Library)) {
+  for _, lib := range f.libs {
+    fn(lib)
+  }
+}
+
+// AddBinary adds a binary to this file.
+func (f *File) AddBinary(binary *Binary) {
+  f.binaries = append(f.binaries, binary)
+}
+
+// AddFilegroup adds a filegroup to this file.
+func (f *File) AddFilegroup(filegroup *Filegroup) {
+  f.filegroups = append(f.filegroups, filegroup)
+}
+
 // AddLabelSetting adds a label_setting to this file.
 func (f *File) AddLabelSetting(labelSetting *LabelSetting) {
   f.labelSettings = append(f.labelSettings, labelSetting)
 }
 
+// AddConstraintSetting adds a constraint_setting to this file.
+func (f *File) AddConstraintSetting(constraintSetting *ConstraintSetting) {
+  f.constraintSettings = append(f.constraintSettings, constraintSetting)
+}
+
+// AddConstraintValue adds a constraint_value to this file.
+func (f *File) AddConstraintValue(constraintValue *ConstraintValue) {
+  f.constraintValues = append(f.constraintValues, constraintValue)
+}
+
+// AddConfigSetting adds a config_setting to this file.
+func (f *File) AddConfigSetting(configSetting *ConfigSetting) {
+  f.configSettings = append(f.configSettings, configSetting)
+}
+
+// AddFlag adds a flag or setting from bazel_skylib to this file.
+func (f *File) AddFlag(flag *Flag) {
+  f.flags = append(f.flags, flag)
+}
+
+// AddPackageGroup adds a package_group to this file.
+func (f *File) AddPackageGroup(packageGroup *PackageGroup) {
+  f.packageGroups = append(f.packageGroups, packageGroup)
+}
+
+// AddPlatform adds a platform to this file.
+func (f *File) AddPlatform(platform *Platform) {
+  f.platforms = append(f.platforms, platform)
+}
+
+// AddRule adds a rule of any kind to this file.
+func (f *File) AddRule(r *Rule) {
+  f.rules = append(f.rules, r)
+}
+
+// Rules returns the rules of any kind added with AddRule, like the ones of a
+// parsed file, in the order they were added.
+func (f *File) Rules() []*Rule {
+  return f.rules
+}
+
+// Rule returns the rule added with AddRule with the name, or nil if there
+// isn't one.
+func (f *File) Rule(name string) *Rule {
+  for _, r := range f.rules {
+    if r.Name == name {
+      return r
+    }
+  }
+  return nil
+}
+
+// HasRule checks whether this file has a rule with the name, of any kind.
+func (f *File) HasRule(name string) bool {
+  var names []string
+  for _, lib := range f.libs {
+    names = append(names, lib.Name)
+  }
+  for _, binary := range f.binaries {
+    names = append(names, binary.Name)
+  }
+  for _, filegroup := range f.filegroups {
+    names = append(names, filegroup.Name)
+  }
+  for _, labelSetting := range f.labelSettings {
+    names = append(names, labelSetting.Name)
+  }
+  for _, constraintSetting := range f.constraintSettings {
+    names = append(names, constraintSetting.Name)
+  }
+  for _, constraintValue := range f.constraintValues {
+    names = append(names, constraintValue.Name)
+  }
+  for _, configSetting := range f.configSettings {
+    names = append(names, configSetting.Name)
+  }
+  for _, platform := range f.platforms {
+    names = append(names, platform.Name)
+  }
+  for _, packageGroup := range f.packageGroups {
+    names = append(names, packageGroup.Name)
+  }
+  for _, r := range f.rules {
+    names = append(names, r.Name)
+  }
+  for _, flag := range f.flags {
+    names = append(names, flag.Name)
+  }
+  return contains(names, name) || f.kept.Rules[name] != nil
+}
+
 // Library contains the information needed to generate a cc_library rule.
 type Library struct {
   // name of the library rule
   Name     string
   Srcs     []string
   Hdrs     []string
+  // Headers that are only included by srcs and hdrs, and aren't compiled on their own.
+  TextualHdrs []string
   Deps     []string
   Includes []string
   Copts 	 []string
+  // The paths that dependents include hdrs with. Empty if not set.
+  StripIncludePrefix, IncludePrefix string
+  // config_setting label -> srcs, generated as a select() added to Srcs.
+  SrcsSelect map[string][]string
+  // Files matched by glob() are added to Srcs and Hdrs, if not nil.
+  SrcsGlob, HdrsGlob *Glob
+  // config_setting label -> hdrs, generated as a select() added to Hdrs.
+  HdrsSelect map[string][]string
+  // Defines propagate to dependents, LocalDefines don't.
+  Defines []string
+  LocalDefines []string
+  // config_setting label -> defines, generated as a select() added to Defines.
+  DefinesSelect map[string][]string
+  // Alwayslink links all srcs, even if nothing references them.
+  Alwayslink bool
+  // Each is a select() added to deps, as config_setting label -> deps.
+  DepsSelects []map[string][]string
+  // Deps that aren't propagated to dependents of this library.
+  ImplementationDeps []string
+  // The rule or macro to call, cc_library if empty.
+  Kind string
+  // NoSDKConfig sets sdk_config = False, for the nrf_cc_library macro.
+  NoSDKConfig bool
+  // Testonly libraries can only be depended on by testonly targets.
+  Testonly bool
+  // Warns dependents when they're built, if not empty.
+  Deprecation string
+  // Overrides the package's default_visibility if not nil.
+  Visibility []string
 }
 
 // Generate generates the output format of this library.
 func (l *Library) Generate() string {
-  contents := fmt.Sprintf("cc_library(name=%q", l.Name)
-  if l.Srcs != nil {
-    contents += fmt.Sprintf(", srcs = %s", bazelStringList(l.Srcs))
+  return formatRule(l.kind(), l.attrs())
+}
+
+func (l *Library) kind() string {
+  if l.Kind == "" {
+    return "cc_library"
+  }
+  return l.Kind
+}
+
+func (l *Library) attrs() []*attr {
+  out := []*attr{stringAttr("name", l.Name)}
+  // Header-only libraries have no srcs attribute, even if Srcs is empty.
+  if len(l.Srcs) > 0 || l.SrcsSelect != nil || l.SrcsGlob != nil {
+    out = append(out, &attr{name: "srcs", list: l.Srcs, glob: l.SrcsGlob, selects: selects(l.SrcsSelect)})
   }
-  if l.Hdrs != nil {
-    contents += fmt.Sprintf(", hdrs = %s", bazelStringList(l.Hdrs))
+  if l.Hdrs != nil || l.HdrsSelect != nil || l.HdrsGlob != nil {
+    out = append(out, &attr{name: "hdrs", list: l.Hdrs, glob: l.HdrsGlob, selects: selects(l.HdrsSelect)})
+  }
+  if l.TextualHdrs != nil {
+    out = append(out, listAttr("textual_hdrs", l.TextualHdrs))
   }
   if l.Copts != nil {
-    contents += fmt.Sprintf(", copts = %s", bazelStringList(l.Copts))
+    out = append(out, listAttr("copts", l.Copts))
   }
   if l.Includes != nil {
-    contents += fmt.Sprintf(", includes = %s", bazelStringList(l.Includes))
+    out = append(out, listAttr("includes", l.Includes))
+  }
+  if l.StripIncludePrefix != "" {
+    out = append(out, stringAttr("strip_include_prefix", l.StripIncludePrefix))
+  }
+  if l.IncludePrefix != "" {
+    out = append(out, stringAttr("include_prefix", l.IncludePrefix))
+  }
+  if l.Defines != nil || l.DefinesSelect != nil {
+    out = append(out, &attr{name: "defines", list: l.Defines, selects: selects(l.DefinesSelect)})
+  }
+  if l.LocalDefines != nil {
+    out = append(out, listAttr("local_defines", l.LocalDefines))
+  }
+  if l.Alwayslink {
+    out = append(out, &attr{name: "alwayslink", expr: Bool(true)})
+  }
+  if l.NoSDKConfig {
+    out = append(out, &attr{name: "sdk_config", expr: Bool(false)})
+  }
+  if l.Deps != nil || l.DepsSelects != nil {
+    out = append(out, &attr{name: "deps", list: l.Deps, selects: l.DepsSelects})
   }
-  if l.Deps != nil {
-    contents += fmt.Sprintf(", deps = %s", bazelStringList(l.Deps))
+  if l.ImplementationDeps != nil {
+    out = append(out, listAttr("implementation_deps", l.ImplementationDeps))
   }
-  contents += ")\n"
-  return contents
+  if l.Testonly {
+    out = append(out, &attr{name: "testonly", expr: Bool(true)})
+  }
+  if l.Deprecation != "" {
+    out = append(out, stringAttr("deprecation", l.Deprecation))
+  }
+  if l.Visibility != nil {
+    out = append(out, listAttr("visibility", l.Visibility))
+  }
+  // Copy the lists, so adding kept strings doesn't change the library.
+  for _, a := range out {
+    if a.list != nil {
+      a.list = append([]string{}, a.list...)
+    }
+  }
+  return out
+}
+
+// selects returns the select() of the cases, if there are any.
+func selects(cases map[string][]string) []map[string][]string {
+  if cases == nil {
+    return nil
+  }
+  return []map[string][]string{cases}
+}
+
+// Binary contains the information needed to generate a cc_binary rule, or a
+// macro that wraps it, like nrf_cc_binary.
+type Binary struct {
+  Name string
+  Srcs []string
+  Deps []string
+  Copts []string
+  Defines []string
+  // Label of the linker script, for nrf_cc_binary.
+  LinkerScript string
+  // The rule or macro to call, cc_binary if empty.
+  Kind string
+}
+
+// Generate generates the output format of this binary.
+func (b *Binary) Generate() string {
+  return formatRule(b.kind(), b.attrs())
+}
+
+func (b *Binary) kind() string {
+  if b.Kind == "" {
+    return "cc_binary"
+  }
+  return b.Kind
+}
+
+func (b *Binary) attrs() []*attr {
+  out := []*attr{stringAttr("name", b.Name)}
+  if b.Srcs != nil {
+    out = append(out, listAttr("srcs", b.Srcs))
+  }
+  if b.Copts != nil {
+    out = append(out, listAttr("copts", b.Copts))
+  }
+  if b.Defines != nil {
+    out = append(out, listAttr("defines", b.Defines))
+  }
+  if b.LinkerScript != "" {
+    out = append(out, stringAttr("linker_script", b.LinkerScript))
+  }
+  if b.Deps != nil {
+    out = append(out, listAttr("deps", b.Deps))
+  }
+  return out
+}
+
+// Filegroup represents a filegroup rule.
+type Filegroup struct {
+  Name string
+  Srcs []string
+}
+
+// Generate generates the output format of this filegroup.
+func (f *Filegroup) Generate() string {
+  return formatRule(f.kind(), f.attrs())
+}
+
+func (f *Filegroup) kind() string {
+  return "filegroup"
+}
+
+func (f *Filegroup) attrs() []*attr {
+  return []*attr{stringAttr("name", f.Name), listAttr("srcs", f.Srcs)}
+}
+
+// PackageGroup represents a package_group rule.
+type PackageGroup struct {
+  Name string
+  Packages []string
+  // Labels of other package_groups.
+  Includes []string
+}
+
+// Generate generates the output format of this package_group.
+func (p *PackageGroup) Generate() string {
+  return formatRule(p.kind(), p.attrs())
+}
+
+func (p *PackageGroup) kind() string {
+  return "package_group"
+}
+
+func (p *PackageGroup) attrs() []*attr {
+  out := []*attr{stringAttr("name", p.Name)}
+  if p.Packages != nil {
+    out = append(out, listAttr("packages", p.Packages))
+  }
+  if p.Includes != nil {
+    out = append(out, listAttr("includes", p.Includes))
+  }
+  return out
 }
 
 // LabelSetting represents a label_setting rule.
 type LabelSetting struct {
   Name string
   BuildSettingDefault string
+  // Flag generates a label_flag instead, which can be set on the command line.
+  Flag bool
 }
 
 // Generate generates the output format of this label_setting.
 func (l *LabelSetting) Generate() string {
-  return fmt.Sprintf("label_setting(name=%q, build_setting_default=%q)", l.Name, l.BuildSettingDefault)
+  return formatRule(l.kind(), l.attrs())
+}
+
+func (l *LabelSetting) kind() string {
+  if l.Flag {
+    return "label_flag"
+  }
+  return "label_setting"
+}
+
+func (l *LabelSetting) attrs() []*attr {
+  return []*attr{stringAttr("name", l.Name), stringAttr("build_setting_default", l.BuildSettingDefault)}
+}
+
+// ConstraintSetting represents a constraint_setting rule.
+type ConstraintSetting struct {
+  Name string
+}
+
+// Generate generates the output format of this constraint_setting.
+func (c *ConstraintSetting) Generate() string {
+  return formatRule(c.kind(), c.attrs())
+}
+
+func (c *ConstraintSetting) kind() string {
+  return "constraint_setting"
+}
+
+func (c *ConstraintSetting) attrs() []*attr {
+  return []*attr{stringAttr("name", c.Name)}
+}
+
+// ConstraintValue represents a constraint_value rule.
+type ConstraintValue struct {
+  Name string
+  ConstraintSetting string
+}
+
+// Generate generates the output format of this constraint_value.
+func (c *ConstraintValue) Generate() string {
+  return formatRule(c.kind(), c.attrs())
+}
+
+func (c *ConstraintValue) kind() string {
+  return "constraint_value"
+}
+
+func (c *ConstraintValue) attrs() []*attr {
+  return []*attr{stringAttr("name", c.Name), stringAttr("constraint_setting", c.ConstraintSetting)}
+}
+
+// ConfigSetting represents a config_setting rule. It matches when all of its
+// conditions do.
+type ConfigSetting struct {
+  Name string
+  ConstraintValues []string
+  // Flag label -> value, for flags like string_flag.
+  FlagValues map[string]string
+  // Native option -> value, like "compilation_mode" -> "opt".
+  Values map[string]string
+  // --define name -> value.
+  DefineValues map[string]string
+}
+
+// Generate generates the output format of this config_setting.
+func (c *ConfigSetting) Generate() string {
+  return formatRule(c.kind(), c.attrs())
+}
+
+func (c *ConfigSetting) kind() string {
+  return "config_setting"
+}
+
+func (c *ConfigSetting) attrs() []*attr {
+  out := []*attr{stringAttr("name", c.Name)}
+  if c.ConstraintValues != nil {
+    out = append(out, listAttr("constraint_values", c.ConstraintValues))
+  }
+  if c.FlagValues != nil {
+    out = append(out, &attr{name: "flag_values", expr: stringDict(c.FlagValues)})
+  }
+  if c.Values != nil {
+    out = append(out, &attr{name: "values", expr: stringDict(c.Values)})
+  }
+  if c.DefineValues != nil {
+    out = append(out, &attr{name: "define_values", expr: stringDict(c.DefineValues)})
+  }
+  return out
+}
+
+// stringDict is a dict of strings, sorted by key.
+func stringDict(in map[string]string) build.Expr {
+  entries := make(map[string]build.Expr)
+  for key, value := range in {
+    entries[key] = String(value)
+  }
+  return Dict(entries)
+}
+
+// Platform represents a platform rule.
+type Platform struct {
+  Name string
+  ConstraintValues []string
+}
+
+// Generate generates the output format of this platform.
+func (p *Platform) Generate() string {
+  return formatRule(p.kind(), p.attrs())
+}
+
+func (p *Platform) kind() string {
+  return "platform"
+}
+
+func (p *Platform) attrs() []*attr {
+  return []*attr{stringAttr("name", p.Name), listAttr("constraint_values", p.ConstraintValues)}
+}
+
+// mergeLoad adds the load to loads, or its symbols to the load from the same
+// source.
+func mergeLoad(loads []*Load, load *Load) []*Load {
+  for i, existing := range loads {
+    if existing.Source != load.Source {
+      continue
+    }
+    merged := &Load{Source: load.Source, Symbols: append([]string{}, existing.Symbols...)}
+    for _, symbol := range load.Symbols {
+      if !contains(merged.Symbols, symbol) {
+        merged.Symbols = append(merged.Symbols, symbol)
+      }
+    }
+    loads[i] = merged
+    return loads
+  }
+  return append(loads, load)
 }
 
 // Load represents a load() statement.
@@ -162,27 +810,18 @@ type Load struct {
 
 // Generate generates the output format of this load statement.
 func (l *Load) Generate() string {
-  contents := fmt.Sprintf("load(%q", l.Source)
-  for _, symbol := range l.Symbols {
-    contents += fmt.Sprintf(", %q", symbol)
-  }
-  contents += ")"
-  return contents
-}
-
-// bazelStringList converts the input slice of strings into a Bazel list
-// that can be used like this: fmt.Sprintf("srcs = %s", bazelStringList(in))
-func bazelStringList(in []string) string {
-  first := true
-  var out string
-  for _, val := range in {
-    if first {
-      out = fmt.Sprintf("[%q", val)
-      first = false
-      continue
-    }
-    out += fmt.Sprintf(", %q", val)
+  return formatStmt(l.stmt())
+}
+
+// stmt returns the load statement, with the symbols sorted like buildifier
+// sorts them.
+func (l *Load) stmt() *build.LoadStmt {
+  symbols := append([]string{}, l.Symbols...)
+  sort.Strings(symbols)
+  out := &build.LoadStmt{Module: &build.StringExpr{Value: l.Source}, ForceCompact: true}
+  for _, symbol := range symbols {
+    out.From = append(out.From, &build.Ident{Name: symbol})
+    out.To = append(out.To, &build.Ident{Name: symbol})
   }
-  out += "]"
   return out
 }
@@ -0,0 +1,90 @@
+package buildfile
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFile_GenerateExportsFiles(t *testing.T) {
+  f := New("/sdk/mdk")
+  f.ExportFile("nrf52.svd")
+  f.ExportFile("nrf52840.svd")
+  f.ExportFileWithVisibility("nrf52_common.ld", []string{"//sdk:__subpackages__"})
+  f.ExportFileWithVisibility("nrf52840_xxaa.ld", []string{"//sdk:__subpackages__"})
+  f.ExportFileWithVisibility("startup.S", []string{"//app:__pkg__", "//sdk:__subpackages__"})
+  want := `package(default_visibility = ["//visibility:public"])
+
+exports_files([
+    "nrf52.svd",
+    "nrf52840.svd",
+])
+
+exports_files(["startup.S"], visibility = [
+    "//app:__pkg__",
+    "//sdk:__subpackages__",
+])
+
+exports_files([
+    "nrf52840_xxaa.ld",
+    "nrf52_common.ld",
+], visibility = ["//sdk:__subpackages__"])
+`
+  if diff := cmp.Diff(want, f.Generate()); diff != "" {
+    t.Errorf("Generate() diff (-want +got):\n%s", diff)
+  }
+}
+
+func TestLibrary_GenerateGlobs(t *testing.T) {
+  tests := map[string]struct{
+    lib *Library
+    want string
+  }{
+    "glob only": {
+      lib: &Library{
+        Name: "libraries",
+        HdrsGlob: &Glob{Include: []string{"*.h"}},
+      },
+      want: `cc_library(
+    name = "libraries",
+    hdrs = glob(["*.h"]),
+)`,
+    },
+    "list, glob and select": {
+      lib: &Library{
+        Name: "drivers",
+        Srcs: []string{"nrfx.c"},
+        SrcsGlob: &Glob{Include: []string{"src/*.c", "src/prs/*.c"}, Exclude: []string{"src/nrfx_twi_twim.c"}},
+        SrcsSelect: map[string][]string{":is_nrf52840": []string{"nrfx_usbd.c"}},
+      },
+      want: `cc_library(
+    name = "drivers",
+    srcs = ["nrfx.c"] + glob([
+        "src/*.c",
+        "src/prs/*.c",
+    ], exclude = ["src/nrfx_twi_twim.c"]) + select({
+        ":is_nrf52840": ["nrfx_usbd.c"],
+        "//conditions:default": [],
+    }),
+)`,
+    },
+    "empty srcs": {
+      lib: &Library{
+        Name: "nrf_section",
+        Srcs: []string{},
+        Hdrs: []string{"nrf_section.h"},
+      },
+      want: `cc_library(
+    name = "nrf_section",
+    hdrs = ["nrf_section.h"],
+)`,
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      if diff := cmp.Diff(test.want, test.lib.Generate()); diff != "" {
+        t.Errorf("Generate() diff (-want +got):\n%s", diff)
+      }
+    })
+  }
+}
@@ -0,0 +1,72 @@
+package buildfile
+
+import (
+	"sort"
+
+	"github.com/bazelbuild/buildtools/build"
+)
+
+const (
+  // Where the flag and setting rules are loaded from.
+  commonSettingsBzl = "@bazel_skylib//rules:common_settings.bzl"
+)
+
+// FlagKind is a kind of build setting from bazel_skylib's common_settings.bzl.
+// Flags can be set on the command line, settings can't.
+type FlagKind string
+
+const (
+  BoolFlag FlagKind = "bool_flag"
+  StringFlag FlagKind = "string_flag"
+  IntFlag FlagKind = "int_flag"
+  StringListFlag FlagKind = "string_list_flag"
+  BoolSetting FlagKind = "bool_setting"
+  StringSetting FlagKind = "string_setting"
+  IntSetting FlagKind = "int_setting"
+  StringListSetting FlagKind = "string_list_setting"
+)
+
+// Flag represents a build setting rule from bazel_skylib, like a string_flag.
+// Files with flags load their rules from common_settings.bzl.
+type Flag struct {
+  Kind FlagKind
+  Name string
+  // A Bool, Int, String or StringList, matching the kind.
+  BuildSettingDefault build.Expr
+  // The values a string_flag or string_setting can have, or nil for any.
+  Values []string
+}
+
+// Generate generates the output format of this flag.
+func (f *Flag) Generate() string {
+  return formatRule(f.kind(), f.attrs())
+}
+
+func (f *Flag) kind() string {
+  return string(f.Kind)
+}
+
+func (f *Flag) attrs() []*attr {
+  out := []*attr{stringAttr("name", f.Name), {name: "build_setting_default", expr: f.BuildSettingDefault}}
+  if f.Values != nil {
+    out = append(out, listAttr("values", f.Values))
+  }
+  return out
+}
+
+// flagsLoad returns the load of the kinds of flags, or nil if there are none.
+func flagsLoad(flags []*Flag) *Load {
+  kinds := make(map[string]bool)
+  for _, flag := range flags {
+    kinds[flag.kind()] = true
+  }
+  if len(kinds) == 0 {
+    return nil
+  }
+  out := &Load{Source: commonSettingsBzl}
+  for kind := range kinds {
+    out.Symbols = append(out.Symbols, kind)
+  }
+  sort.Strings(out.Symbols)
+  return out
+}
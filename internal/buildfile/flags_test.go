@@ -0,0 +1,76 @@
+package buildfile
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFile_GenerateFlags(t *testing.T) {
+  f := New("/sdk/config")
+  f.AddLoad(&Load{Source: commonSettingsBzl, Symbols: []string{"bool_flag"}})
+  f.AddFlag(&Flag{
+    Kind: StringFlag,
+    Name: "log_backend",
+    BuildSettingDefault: String("rtt"),
+    Values: []string{"rtt", "uart"},
+  })
+  f.AddFlag(&Flag{Kind: BoolFlag, Name: "debug", BuildSettingDefault: Bool(false)})
+  f.AddFlag(&Flag{Kind: IntSetting, Name: "log_level", BuildSettingDefault: Int(3)})
+  f.AddConfigSetting(&ConfigSetting{
+    Name: "uart_debug",
+    FlagValues: map[string]string{
+      ":log_backend": "uart",
+      ":debug": "True",
+    },
+    Values: map[string]string{"compilation_mode": "dbg"},
+  })
+  f.AddConfigSetting(&ConfigSetting{
+    Name: "softdevice",
+    DefineValues: map[string]string{"softdevice": "s140"},
+  })
+  want := `load("@bazel_skylib//rules:common_settings.bzl", "bool_flag", "int_setting", "string_flag")
+
+package(default_visibility = ["//visibility:public"])
+
+bool_flag(
+    name = "debug",
+    build_setting_default = False,
+)
+
+string_flag(
+    name = "log_backend",
+    build_setting_default = "rtt",
+    values = [
+        "rtt",
+        "uart",
+    ],
+)
+
+int_setting(
+    name = "log_level",
+    build_setting_default = 3,
+)
+
+config_setting(
+    name = "softdevice",
+    define_values = {
+        "softdevice": "s140",
+    },
+)
+
+config_setting(
+    name = "uart_debug",
+    flag_values = {
+        ":debug": "True",
+        ":log_backend": "uart",
+    },
+    values = {
+        "compilation_mode": "dbg",
+    },
+)
+`
+  if diff := cmp.Diff(want, f.Generate()); diff != "" {
+    t.Errorf("Generate() diff (-want +got):\n%s", diff)
+  }
+}
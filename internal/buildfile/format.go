@@ -0,0 +1,278 @@
+package buildfile
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/buildtools/tables"
+)
+
+// The formatting here is buildifier's canonical style for BUILD files, so
+// generated files pass buildifier checks: attributes and lists are sorted
+// with buildifier's tables, and printed by its printer, with one attribute per
+// line and one string per line in lists with more than one. Labels aren't
+// rewritten, unlike buildifier does, so they stay the way they're generated.
+
+// rule is a rule that can be generated, like a cc_library.
+type rule interface {
+  kind() string
+  // attrs returns the rule's attributes, starting with its name.
+  attrs() []*attr
+}
+
+// attr is an attribute of a generated rule. Its value is either a list of
+// strings followed by selects, or any other value.
+type attr struct {
+  name string
+  list []string // nil if there's no list, or if the value isn't one
+  glob *Glob // added to the list, if not nil
+  selects []map[string][]string
+  expr build.Expr // any other value
+  // Whether buildifier sorts the lists of strings of the value.
+  sortable bool
+  // Strings of the list that are kept with # keep.
+  keptStrings map[string]bool
+  // Whether the value is kept with # keep, so it's left as it is.
+  kept bool
+  comments build.Comments
+}
+
+// stringAttr is an attribute with a string value.
+func stringAttr(name, value string) *attr {
+  return &attr{name: name, expr: String(value)}
+}
+
+// listAttr is an attribute with a list of strings, which is empty if list is
+// nil.
+func listAttr(name string, list []string) *attr {
+  if list == nil {
+    list = []string{}
+  }
+  return &attr{name: name, list: list}
+}
+
+// formatRule formats a rule with one attribute per line.
+func formatRule(kind string, attrs []*attr) string {
+  return formatStmt(ruleCall(kind, attrs))
+}
+
+// ruleCall returns the call of a rule, with its attributes sorted like
+// buildifier sorts them.
+func ruleCall(kind string, attrs []*attr) *build.CallExpr {
+  sort.SliceStable(attrs, func(i, j int) bool {
+    return tables.NamePriority[attrs[i].name] < tables.NamePriority[attrs[j].name]
+  })
+  call := &build.CallExpr{X: &build.Ident{Name: kind}, ForceMultiLine: true}
+  for _, a := range attrs {
+    a.sortable = sortable(kind, a.name)
+    call.List = append(call.List, a.arg())
+  }
+  return call
+}
+
+// callStmt returns a call with a single argument, like package() or
+// exports_files(), on one line. Positional arguments have no name.
+func callStmt(fn string, a *attr) *build.CallExpr {
+  a.sortable = sortable(fn, a.name)
+  arg := a.arg()
+  if a.name == "" {
+    arg = a.value()
+  }
+  return &build.CallExpr{X: &build.Ident{Name: fn}, List: []build.Expr{arg}, ForceCompact: true}
+}
+
+// sortable checks whether buildifier sorts the lists of strings of the
+// attribute of a rule of kind.
+func sortable(kind, name string) bool {
+  key := kind + "." + name
+  return (tables.IsSortableListArg[name] || tables.SortableAllowlist[key]) && !tables.SortableDenylist[key]
+}
+
+// formatStmt formats a top level statement, like a rule.
+func formatStmt(x build.Expr) string {
+  return strings.TrimSuffix(formatStmts([]build.Expr{x}), "\n")
+}
+
+// formatStmts formats the statements of a BUILD file, separated by empty
+// lines.
+func formatStmts(stmts []build.Expr) string {
+  return string(build.FormatWithoutRewriting(&build.File{Type: build.TypeBuild, Stmt: stmts}))
+}
+
+// arg returns the attribute as an argument of its rule.
+func (a *attr) arg() build.Expr {
+  out := &build.AssignExpr{LHS: &build.Ident{Name: a.name}, Op: "=", RHS: a.value()}
+  out.Comments = a.comments
+  return out
+}
+
+// value returns the attribute's value.
+func (a *attr) value() build.Expr {
+  if a.expr != nil {
+    if a.kept {
+      return a.expr
+    }
+    return a.sortedExpr(a.expr)
+  }
+  var parts []build.Expr
+  if a.list != nil {
+    parts = append(parts, stringList(a.sorted(a.list), a.keptStrings))
+  }
+  if a.glob != nil {
+    parts = append(parts, a.glob.Value())
+  }
+  for _, cases := range a.selects {
+    parts = append(parts, a.selectExpr(cases))
+  }
+  return Concat(parts...)
+}
+
+// sorted returns a sorted copy of the list if buildifier sorts the attribute.
+func (a *attr) sorted(list []string) []string {
+  if !a.sortable {
+    return list
+  }
+  out := append([]string{}, list...)
+  sort.SliceStable(out, func(i, j int) bool {
+    return lessString(out[i], out[j])
+  })
+  return out
+}
+
+// sortedExpr sorts the lists of strings in the value if buildifier sorts the
+// attribute, including the ones in selects.
+func (a *attr) sortedExpr(x build.Expr) build.Expr {
+  if !a.sortable {
+    return x
+  }
+  switch x := x.(type) {
+  case *build.ListExpr:
+    // Strings keep their comments, like # keep, when they're sorted.
+    for _, elem := range x.List {
+      if _, ok := elem.(*build.StringExpr); !ok {
+        return x
+      }
+    }
+    out := *x
+    out.List = append([]build.Expr{}, x.List...)
+    sort.SliceStable(out.List, func(i, j int) bool {
+      return lessString(out.List[i].(*build.StringExpr).Value, out.List[j].(*build.StringExpr).Value)
+    })
+    return &out
+  case *build.BinaryExpr:
+    out := *x
+    out.X, out.Y = a.sortedExpr(x.X), a.sortedExpr(x.Y)
+    return &out
+  case *build.CallExpr:
+    if callName(x) != "select" || len(x.List) != 1 {
+      return x
+    }
+    dict, ok := x.List[0].(*build.DictExpr)
+    if !ok {
+      return x
+    }
+    outDict := *dict
+    outDict.List = nil
+    for _, kv := range dict.List {
+      outKV := *kv
+      outKV.Value = a.sortedExpr(kv.Value)
+      outDict.List = append(outDict.List, &outKV)
+    }
+    out := *x
+    out.List = []build.Expr{&outDict}
+    return &out
+  }
+  return x
+}
+
+// callName returns the name of the function that x calls, or "" if it isn't
+// a plain name.
+func callName(x *build.CallExpr) string {
+  if ident, ok := x.X.(*build.Ident); ok {
+    return ident.Name
+  }
+  return ""
+}
+
+// keepComment is the comment of what # keep protects.
+var keepComment = build.Comment{Token: "# keep"}
+
+// stringList returns a list of the strings, with # keep comments after the
+// kept ones.
+func stringList(list []string, kept map[string]bool) *build.ListExpr {
+  out := &build.ListExpr{}
+  for _, val := range list {
+    s := &build.StringExpr{Value: val}
+    if kept[val] {
+      s.Suffix = []build.Comment{keepComment}
+    }
+    out.List = append(out.List, s)
+  }
+  return out
+}
+
+// selectExpr returns a select() of the cases, sorted by condition, with
+// //conditions:default last. An empty one is added if there isn't one.
+func (a *attr) selectExpr(cases map[string][]string) build.Expr {
+  entries := make(map[string]build.Expr)
+  for condition, list := range cases {
+    entries[condition] = stringList(a.sorted(list), nil)
+  }
+  if _, ok := entries[DefaultCondition]; !ok {
+    entries[DefaultCondition] = stringList(nil, nil)
+  }
+  return Select(entries)
+}
+
+// lessString orders strings like buildifier sorts lists: file names first,
+// then local labels, then labels in the workspace, then external labels. The
+// parts between ":" and "." are compared one at a time.
+func lessString(a, b string) bool {
+  phaseA, phaseB := stringPhase(a), stringPhase(b)
+  if phaseA != phaseB {
+    return phaseA < phaseB
+  }
+  splitA := strings.Split(strings.ReplaceAll(a, ":", "."), ".")
+  splitB := strings.Split(strings.ReplaceAll(b, ":", "."), ".")
+  for i := 0; i < len(splitA) && i < len(splitB); i++ {
+    if splitA[i] != splitB[i] {
+      return splitA[i] < splitB[i]
+    }
+  }
+  if len(splitA) != len(splitB) {
+    return len(splitA) < len(splitB)
+  }
+  return a < b
+}
+
+func stringPhase(s string) int {
+  switch {
+  case strings.HasPrefix(s, ":"):
+    return 1
+  case strings.HasPrefix(s, "//"):
+    return 2
+  case strings.HasPrefix(s, "@"):
+    return 3
+  }
+  return 0
+}
+
+// findAttr returns the attribute with the name, or nil if there isn't one.
+func findAttr(attrs []*attr, name string) *attr {
+  for _, a := range attrs {
+    if a.name == name {
+      return a
+    }
+  }
+  return nil
+}
+
+func contains(all []string, val string) bool {
+  for _, v := range all {
+    if v == val {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,129 @@
+package buildfile
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// Kept is what the "# keep" comments of an existing BUILD file protect from
+// being regenerated, like gazelle's. A # keep comment at the end of a rule's
+// first line, or on the line before it, keeps the whole rule. One at the end
+// of an attribute keeps its value, and one after a string in a list keeps the
+// string in the list.
+type Kept struct {
+  // Each kept rule, by name. They replace generated rules with the same name.
+  Rules map[string]*build.CallExpr
+  // Each kept attribute, with its comments, by rule name and attribute name.
+  Attrs map[string]map[string]*build.AssignExpr
+  // Kept strings, by rule name and attribute name. They're added to the
+  // generated list.
+  Values map[string]map[string][]string
+}
+
+// Empty checks whether nothing is kept.
+func (k *Kept) Empty() bool {
+  return len(k.Rules) == 0 && len(k.Attrs) == 0 && len(k.Values) == 0
+}
+
+// ReadKept reads what the # keep comments of the BUILD file at path protect.
+// It parses the file like Parse does, but any statements are allowed, and
+// only the rules' calls are read.
+func ReadKept(path string) (*Kept, error) {
+  f, err := readBuild(path)
+  if err != nil {
+    return nil, err
+  }
+  kept := &Kept{
+    Rules: make(map[string]*build.CallExpr),
+    Attrs: make(map[string]map[string]*build.AssignExpr),
+    Values: make(map[string]map[string][]string),
+  }
+  for _, stmt := range f.Stmt {
+    if call, ok := stmt.(*build.CallExpr); ok {
+      kept.addCall(call)
+    }
+  }
+  return kept, nil
+}
+
+// isKeepComment checks whether the comment is "# keep", optionally with a
+// reason, like "# keep: used by the bootloader".
+func isKeepComment(c build.Comment) bool {
+  text := strings.TrimSpace(commentText(c))
+  return text == "keep" || strings.HasPrefix(text, "keep:")
+}
+
+func hasKeepComment(comments []build.Comment) bool {
+  for _, c := range comments {
+    if isKeepComment(c) {
+      return true
+    }
+  }
+  return false
+}
+
+// addCall adds what is kept of a rule's call.
+func (k *Kept) addCall(call *build.CallExpr) {
+  var name string
+  for _, arg := range call.List {
+    if key, value := assignment(arg); key == "name" {
+      if s, ok := value.(*build.StringExpr); ok {
+        name = s.Value
+      }
+    }
+  }
+  if name == "" {
+    return
+  }
+  liftFirstLineComments(call)
+  if call.End.Pos.Line == call.ListStart.Line {
+    // The end of a rule on one line is the end of its first line too, but it
+    // isn't once the rule is formatted, so the comment goes before it.
+    call.Before = append(call.Before, call.Suffix...)
+    call.Suffix = nil
+  }
+  if n := len(call.Before); n > 0 && isKeepComment(call.Before[n-1]) {
+    k.Rules[name] = call
+    return
+  }
+  for _, arg := range call.List {
+    key, value := assignment(arg)
+    if key == "" || key == "name" {
+      continue
+    }
+    if hasKeepComment(arg.Comment().Suffix) || hasKeepComment(value.Comment().Suffix) {
+      if k.Attrs[name] == nil {
+        k.Attrs[name] = make(map[string]*build.AssignExpr)
+      }
+      k.Attrs[name][key] = arg.(*build.AssignExpr)
+      continue
+    }
+    // Strings directly in a list, like deps = [":a", "//b"].
+    list, ok := value.(*build.ListExpr)
+    if !ok {
+      continue
+    }
+    for _, elem := range list.List {
+      s, ok := elem.(*build.StringExpr)
+      if !ok || !hasKeepComment(s.Suffix) {
+        continue
+      }
+      if k.Values[name] == nil {
+        k.Values[name] = make(map[string][]string)
+      }
+      k.Values[name][key] = append(k.Values[name][key], s.Value)
+    }
+  }
+}
+
+// keptRuleNames returns the names of the kept rules, sorted.
+func (k *Kept) keptRuleNames() []string {
+  var out []string
+  for name := range k.Rules {
+    out = append(out, name)
+  }
+  sort.Strings(out)
+  return out
+}
@@ -0,0 +1,217 @@
+package buildfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// Parse reads the BUILD file at path into a File. Loads, package's
+// default_visibility, exports_files and the comment at the top go where
+// generated ones would, and every rule becomes a Rule, with its comments, so
+// generating the file again gives the same file in canonical format. Only
+// calls are supported, not other statements like assignments or defs.
+func Parse(path string) (*File, error) {
+  f, err := readBuild(path)
+  if err != nil {
+    return nil, err
+  }
+  return newFile(filepath.Dir(path), f)
+}
+
+// readBuild parses the BUILD file at path with buildtools' parser, which
+// Parse and ReadKept share.
+func readBuild(path string) (*build.File, error) {
+  src, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  return build.ParseBuild(path, src)
+}
+
+// parseFile parses the contents of the BUILD file in dir, which is absolute.
+func parseFile(dir, src string) (*File, error) {
+  f, err := build.ParseBuild(filepath.Join(dir, "BUILD"), []byte(src))
+  if err != nil {
+    return nil, err
+  }
+  return newFile(dir, f)
+}
+
+// newFile converts the parsed BUILD file in dir into a File.
+func newFile(dir string, f *build.File) (*File, error) {
+  out := New(dir)
+  var pending []build.Comment
+  for i, stmt := range f.Stmt {
+    if block, ok := stmt.(*build.CommentBlock); ok {
+      // The comment at the top is separated from the first statement by an
+      // empty line. Other comments on their own are about the next one.
+      if i == 0 {
+        for _, c := range block.After {
+          out.AddComment(commentText(c))
+        }
+        continue
+      }
+      pending = append(pending, block.After...)
+      continue
+    }
+    stmt.Comment().Before = append(pending, stmt.Comment().Before...)
+    pending = nil
+    if err := out.addStmt(stmt); err != nil {
+      start, _ := stmt.Span()
+      return nil, fmt.Errorf("%s:%d: %v", f.Path, start.Line, err)
+    }
+  }
+  return out, nil
+}
+
+// commentText returns the text of a comment, without the "#".
+func commentText(c build.Comment) string {
+  return strings.TrimPrefix(strings.TrimPrefix(c.Token, "#"), " ")
+}
+
+// addStmt adds a parsed top level statement to the file.
+func (f *File) addStmt(stmt build.Expr) error {
+  switch x := stmt.(type) {
+  case *build.LoadStmt:
+    load := &Load{Source: x.Module.Value}
+    for i, from := range x.From {
+      if x.To[i].Name != from.Name {
+        return fmt.Errorf("load() aliases aren't supported")
+      }
+      load.Symbols = append(load.Symbols, from.Name)
+    }
+    f.AddLoad(load)
+    return nil
+  case *build.CallExpr:
+    return f.addCall(x)
+  }
+  return fmt.Errorf("only calls are supported at the top level")
+}
+
+// addCall adds a parsed top level call to the file.
+func (f *File) addCall(call *build.CallExpr) error {
+  kind := callName(call)
+  switch kind {
+  case "package":
+    for _, arg := range call.List {
+      key, value := assignment(arg)
+      if key != "default_visibility" && key != "default_applicable_licenses" {
+        return fmt.Errorf("only package(default_visibility = [...], default_applicable_licenses = [...]) is supported")
+      }
+      values, err := stringValues(value)
+      if err != nil {
+        return fmt.Errorf("%s: %v", key, err)
+      }
+      if key == "default_visibility" {
+        f.SetPackageVisibility(values)
+      } else {
+        f.SetPackageLicenses(values)
+      }
+    }
+    return nil
+  case "exports_files":
+    if len(call.List) == 0 {
+      return fmt.Errorf("exports_files() needs files")
+    }
+    files, err := stringValues(call.List[0])
+    if err != nil {
+      return fmt.Errorf("exports_files: %v", err)
+    }
+    var visibility []string
+    for _, arg := range call.List[1:] {
+      key, value := assignment(arg)
+      if key != "visibility" {
+        return fmt.Errorf("only exports_files([...], visibility = [...]) is supported")
+      }
+      if visibility, err = stringValues(value); err != nil {
+        return fmt.Errorf("exports_files visibility: %v", err)
+      }
+    }
+    for _, file := range files {
+      if visibility == nil {
+        f.ExportFile(file)
+      } else {
+        f.ExportFileWithVisibility(file, visibility)
+      }
+    }
+    return nil
+  case "":
+    return fmt.Errorf("only calls of names are supported")
+  }
+  liftFirstLineComments(call)
+  r := &Rule{Kind: kind, Comments: call.Comments}
+  for _, arg := range call.List {
+    key, value := assignment(arg)
+    if key == "" {
+      return fmt.Errorf("%s() arguments have to be named", kind)
+    }
+    if key == "name" {
+      name, ok := value.(*build.StringExpr)
+      if !ok {
+        return fmt.Errorf("%s() name has to be a string", kind)
+      }
+      r.Name = name.Value
+      continue
+    }
+    r.attributes = append(r.attributes, &Attr{Comments: *arg.Comment(), Name: key, Value: value})
+  }
+  if r.Name == "" {
+    return fmt.Errorf("%s() has no name", kind)
+  }
+  f.AddRule(r)
+  return nil
+}
+
+// assignment returns the name and value of a named argument, or "" if the
+// argument isn't named.
+func assignment(arg build.Expr) (string, build.Expr) {
+  assign, ok := arg.(*build.AssignExpr)
+  if !ok {
+    return "", nil
+  }
+  key, ok := assign.LHS.(*build.Ident)
+  if !ok || assign.Op != "=" {
+    return "", nil
+  }
+  return key.Name, assign.RHS
+}
+
+// liftFirstLineComments moves the comments at the end of the first line of a
+// call, like "cc_library(  # keep", before the call, since they're about the
+// whole call. The parser attaches them to the first argument.
+func liftFirstLineComments(call *build.CallExpr) {
+  if len(call.List) == 0 {
+    return
+  }
+  first := call.List[0].Comment()
+  var rest []build.Comment
+  for _, c := range first.Before {
+    if c.Start.Line == call.ListStart.Line {
+      call.Before = append(call.Before, c)
+    } else {
+      rest = append(rest, c)
+    }
+  }
+  first.Before = rest
+}
+
+// stringValues returns the strings of a list of strings.
+func stringValues(x build.Expr) ([]string, error) {
+  list, ok := x.(*build.ListExpr)
+  if !ok {
+    return nil, fmt.Errorf("not a list")
+  }
+  out := []string{}
+  for _, elem := range list.List {
+    s, ok := elem.(*build.StringExpr)
+    if !ok {
+      return nil, fmt.Errorf("not a list of strings")
+    }
+    out = append(out, s.Value)
+  }
+  return out, nil
+}
@@ -0,0 +1,132 @@
+package buildfile
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse_RoundTrip(t *testing.T) {
+  src := `# Generated by hand.
+# Edit freely.
+
+load("@rules_cc//cc:defs.bzl", "cc_binary", "cc_library")
+
+package(default_visibility = ["//visibility:public"])
+
+exports_files(["a.ld"])
+
+# The board support library.
+cc_library(
+    name = "bsp",
+    srcs = ["bsp.c"],
+    hdrs = [
+        "bsp.h",
+        "boards.h",  # keep
+    ],
+    copts = ["-O3"] + select({
+        ":debug": ["-g"],
+        "//conditions:default": [],
+    }),
+    # Needed by the linker.
+    alwayslink = True,
+)
+
+genrule(
+    name = "version",
+    outs = ["version.h"],
+    cmd = 'echo "#define VERSION 1" > $@',
+)
+`
+  want := `# Generated by hand.
+# Edit freely.
+
+load("@rules_cc//cc:defs.bzl", "cc_binary", "cc_library")
+
+package(default_visibility = ["//visibility:public"])
+
+exports_files(["a.ld"])
+
+# The board support library.
+cc_library(
+    name = "bsp",
+    srcs = ["bsp.c"],
+    hdrs = [
+        "boards.h",  # keep
+        "bsp.h",
+    ],
+    copts = ["-O3"] + select({
+        ":debug": ["-g"],
+        "//conditions:default": [],
+    }),
+    # Needed by the linker.
+    alwayslink = True,
+)
+
+genrule(
+    name = "version",
+    outs = ["version.h"],
+    cmd = 'echo "#define VERSION 1" > $@',
+)
+`
+  f, err := parseFile("/sdk/bsp", src)
+  if err != nil {
+    t.Fatalf("parseFile: %v", err)
+  }
+  if diff := cmp.Diff(want, f.Generate()); diff != "" {
+    t.Errorf("Generate() diff (-want +got):\n%s", diff)
+  }
+  if !f.Exported("a.ld") || f.Exported("bsp.c") {
+    t.Errorf("Exported(a.ld), Exported(bsp.c) = %v, %v, want true, false", f.Exported("a.ld"), f.Exported("bsp.c"))
+  }
+  if got := len(f.Rules()); got != 2 {
+    t.Errorf("len(Rules()) = %d, want 2", got)
+  }
+  bsp := f.Rule("bsp")
+  if bsp == nil || bsp.Kind != "cc_library" {
+    t.Fatalf("Rule(%q) = %v, want a cc_library", "bsp", bsp)
+  }
+  if len(bsp.Before) != 1 || bsp.Before[0].Token != "# The board support library." {
+    t.Errorf("Before = %v, want the comment about bsp", bsp.Before)
+  }
+  // Generating it again gives the same file.
+  again, err := parseFile("/sdk/bsp", f.Generate())
+  if err != nil {
+    t.Fatalf("parseFile(Generate()): %v", err)
+  }
+  if diff := cmp.Diff(want, again.Generate()); diff != "" {
+    t.Errorf("second Generate() diff (-want +got):\n%s", diff)
+  }
+}
+
+func TestParse_PackageLicenses(t *testing.T) {
+  src := `package(
+    default_applicable_licenses = ["//sdk/external/freertos:license"],
+    default_visibility = ["//visibility:public"],
+)
+`
+  f, err := parseFile("/sdk/external/freertos/src", src)
+  if err != nil {
+    t.Fatalf("parseFile: %v", err)
+  }
+  if diff := cmp.Diff(src, f.Generate()); diff != "" {
+    t.Errorf("Generate() diff (-want +got):\n%s", diff)
+  }
+}
+
+func TestParse_Errors(t *testing.T) {
+  tests := map[string]string{
+    "assignment": "COPTS = [\"-O3\"]\n",
+    "no name": "cc_library(srcs = [\"a.c\"])\n",
+    "positional argument": "cc_library(\"a\")\n",
+    "unclosed call": "cc_library(\n    name = \"a\",\n",
+    "unterminated string": "cc_library(name = \"a)\n",
+  }
+  for name, src := range tests {
+    t.Run(name, func(t *testing.T) {
+      if f, err := parseFile("/sdk", src); err == nil {
+        t.Errorf("parseFile(%q) = %v, want an error", src, f.Generate())
+      }
+    })
+  }
+}
@@ -0,0 +1,177 @@
+package buildfile
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// Rule is a rule of any kind, for rules that don't have their own type, like
+// genrule. Attributes are generated in the order they're set, after sorting
+// them like buildifier does.
+type Rule struct {
+  build.Comments
+  Kind string
+  Name string
+  attributes []*Attr
+}
+
+// Attr is an attribute of a Rule.
+type Attr struct {
+  build.Comments
+  Name string
+  Value build.Expr
+}
+
+// NewRule creates a rule with no attributes.
+func NewRule(kind, name string) *Rule {
+  return &Rule{Kind: kind, Name: name}
+}
+
+// NewAlias creates an alias rule, which points to the actual label. If
+// deprecation isn't empty, Bazel warns targets that use the alias.
+func NewAlias(name, actual, deprecation string) *Rule {
+  out := NewRule("alias", name).SetAttr("actual", String(actual))
+  if deprecation != "" {
+    out.SetAttr("deprecation", String(deprecation))
+  }
+  return out
+}
+
+// SetAttr sets the value of an attribute, replacing any value it had.
+func (r *Rule) SetAttr(name string, value build.Expr) *Rule {
+  for _, a := range r.attributes {
+    if a.Name == name {
+      a.Value = value
+      return r
+    }
+  }
+  r.attributes = append(r.attributes, &Attr{Name: name, Value: value})
+  return r
+}
+
+// Attr returns the value of an attribute, or nil if it isn't set.
+func (r *Rule) Attr(name string) build.Expr {
+  for _, a := range r.attributes {
+    if a.Name == name {
+      return a.Value
+    }
+  }
+  return nil
+}
+
+// Generate generates the output format of this rule.
+func (r *Rule) Generate() string {
+  call := ruleCall(r.kind(), r.attrs())
+  call.Comments = r.Comments
+  return formatStmt(call)
+}
+
+func (r *Rule) kind() string {
+  return r.Kind
+}
+
+func (r *Rule) attrs() []*attr {
+  out := []*attr{stringAttr("name", r.Name)}
+  for _, a := range r.attributes {
+    out = append(out, &attr{name: a.Name, expr: a.Value, comments: a.Comments})
+  }
+  return out
+}
+
+// String is a string value.
+func String(s string) build.Expr {
+  return &build.StringExpr{Value: s}
+}
+
+// Label is a label value, like a *bazel.Label.
+func Label(label fmt.Stringer) build.Expr {
+  return String(label.String())
+}
+
+// Bool is a True or False value.
+func Bool(b bool) build.Expr {
+  if b {
+    return &build.Ident{Name: "True"}
+  }
+  return &build.Ident{Name: "False"}
+}
+
+// Int is an integer value.
+func Int(i int) build.Expr {
+  return &build.LiteralExpr{Token: fmt.Sprint(i)}
+}
+
+// List is a list of any values.
+func List(values ...build.Expr) build.Expr {
+  return &build.ListExpr{List: values}
+}
+
+// StringList is a list of strings.
+func StringList(values []string) build.Expr {
+  return stringList(values, nil)
+}
+
+// Dict is a dict with string keys, sorted by key, with one entry per line.
+func Dict(entries map[string]build.Expr) build.Expr {
+  var keys []string
+  for key := range entries {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  out := &build.DictExpr{ForceMultiLine: len(keys) > 0}
+  for _, key := range keys {
+    out.List = append(out.List, &build.KeyValueExpr{Key: String(key), Value: entries[key]})
+  }
+  return out
+}
+
+// Select is a select() of the cases, by condition label, sorted by condition
+// with //conditions:default last. Without a //conditions:default case, no
+// condition matching is an error, like in Bazel.
+func Select(cases map[string]build.Expr) build.Expr {
+  var conditions []string
+  for condition := range cases {
+    if condition != DefaultCondition {
+      conditions = append(conditions, condition)
+    }
+  }
+  sort.Strings(conditions)
+  if _, ok := cases[DefaultCondition]; ok {
+    conditions = append(conditions, DefaultCondition)
+  }
+  dict := &build.DictExpr{ForceMultiLine: len(conditions) > 0}
+  for _, condition := range conditions {
+    dict.List = append(dict.List, &build.KeyValueExpr{Key: String(condition), Value: cases[condition]})
+  }
+  return &build.CallExpr{X: &build.Ident{Name: "select"}, List: []build.Expr{dict}}
+}
+
+// Glob matches files in the package by pattern, like "**/*.c", so libraries
+// of whole directories don't have to list every file.
+type Glob struct {
+  Include []string
+  Exclude []string
+}
+
+// Value is the glob() of the patterns.
+func (g *Glob) Value() build.Expr {
+  out := &build.CallExpr{X: &build.Ident{Name: "glob"}, List: []build.Expr{StringList(g.Include)}, ForceCompact: true}
+  if g.Exclude != nil {
+    out.List = append(out.List, &build.AssignExpr{LHS: &build.Ident{Name: "exclude"}, Op: "=", RHS: StringList(g.Exclude)})
+  }
+  return out
+}
+
+// Concat is the values added together, like a list plus a select().
+func Concat(values ...build.Expr) build.Expr {
+  if len(values) == 0 {
+    return List()
+  }
+  out := values[0]
+  for _, value := range values[1:] {
+    out = &build.BinaryExpr{X: out, Op: "+", Y: value}
+  }
+  return out
+}
@@ -0,0 +1,91 @@
+package buildfile
+
+import (
+	"testing"
+
+	"github.com/bazelbuild/buildtools/build"
+	"github.com/google/go-cmp/cmp"
+)
+
+type testLabel string
+
+func (l testLabel) String() string {
+  return string(l)
+}
+
+func TestRule_Generate(t *testing.T) {
+  tests := map[string]struct{
+    rule *Rule
+    want string
+  }{
+    "name only": {
+      rule: NewRule("constraint_setting", "chip"),
+      want: `constraint_setting(
+    name = "chip",
+)`,
+    },
+    // buildifier doesn't sort genrule's srcs and outs, since their order
+    // matters to cmd.
+    "attributes sorted like buildifier": {
+      rule: NewRule("genrule", "gen").
+        SetAttr("cmd", String("cp $< $@")).
+        SetAttr("outs", StringList([]string{"b.h", "a.h"})).
+        SetAttr("srcs", StringList([]string{"//x:y", ":z", "in.h"})).
+        SetAttr("testonly", Bool(true)),
+      want: `genrule(
+    name = "gen",
+    testonly = True,
+    srcs = [
+        "//x:y",
+        ":z",
+        "in.h",
+    ],
+    outs = [
+        "b.h",
+        "a.h",
+    ],
+    cmd = "cp $< $@",
+)`,
+    },
+    "select and dict": {
+      rule: NewRule("string_flag", "log").
+        SetAttr("deps", Concat(StringList([]string{":b", ":a"}), Select(map[string]build.Expr{
+          DefaultCondition: StringList(nil),
+          ":is_debug": List(Label(testLabel("//log:rtt"))),
+        }))).
+        SetAttr("env", Dict(map[string]build.Expr{"b": Int(2), "a": Int(1)})).
+        SetAttr("build_setting_default", String("rtt")),
+      want: `string_flag(
+    name = "log",
+    env = {
+        "a": 1,
+        "b": 2,
+    },
+    build_setting_default = "rtt",
+    deps = [
+        ":a",
+        ":b",
+    ] + select({
+        ":is_debug": ["//log:rtt"],
+        "//conditions:default": [],
+    }),
+)`,
+    },
+    "set replaces the value": {
+      rule: NewRule("filegroup", "files").
+        SetAttr("srcs", StringList([]string{"a.ld"})).
+        SetAttr("srcs", StringList([]string{"b.ld"})),
+      want: `filegroup(
+    name = "files",
+    srcs = ["b.ld"],
+)`,
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      if diff := cmp.Diff(test.want, test.rule.Generate()); diff != "" {
+        t.Errorf("Generate() diff (-want +got):\n%s", diff)
+      }
+    })
+  }
+}
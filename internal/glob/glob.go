@@ -0,0 +1,185 @@
+// Package glob matches paths against patterns that extend filepath.Match
+// with "**" and brace expansion. "**" as a whole path element matches zero or
+// more elements, so "sdk/**/iar" matches "sdk/iar" and "sdk/a/b/iar".
+// "{a,b}" matches either alternative, and can be nested.
+package glob
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// HasMeta reports whether pattern has any special characters, so it can't be
+// compared to paths as-is.
+func HasMeta(pattern string) bool {
+  return strings.ContainsAny(pattern, `*?[{\`)
+}
+
+// Validate checks that pattern is well-formed.
+func Validate(pattern string) error {
+  alts, err := Expand(pattern)
+  if err != nil {
+    return err
+  }
+  for _, alt := range alts {
+    for _, elem := range strings.Split(alt, "/") {
+      if _, err := path.Match(elem, ""); err != nil {
+        return err
+      }
+    }
+  }
+  return nil
+}
+
+// Match reports whether name matches pattern. Both are split on "/" and
+// matched element by element, like filepath.Match.
+func Match(pattern, name string) (bool, error) {
+  alts, err := Expand(pattern)
+  if err != nil {
+    return false, err
+  }
+  nameElems := strings.Split(filepath.ToSlash(name), "/")
+  for _, alt := range alts {
+    matched, err := matchElems(strings.Split(filepath.ToSlash(alt), "/"), nameElems)
+    if err != nil {
+      return false, err
+    }
+    if matched {
+      return true, nil
+    }
+  }
+  return false, nil
+}
+
+func matchElems(pattern, name []string) (bool, error) {
+  for len(pattern) > 0 {
+    if pattern[0] != "**" {
+      if len(name) == 0 {
+        return false, nil
+      }
+      matched, err := path.Match(pattern[0], name[0])
+      if err != nil || !matched {
+        return false, err
+      }
+      pattern, name = pattern[1:], name[1:]
+      continue
+    }
+    for len(pattern) > 1 && pattern[1] == "**" {
+      pattern = pattern[1:]
+    }
+    if len(pattern) == 1 {
+      return true, nil
+    }
+    for i := 0; i <= len(name); i++ {
+      matched, err := matchElems(pattern[1:], name[i:])
+      if err != nil || matched {
+        return matched, err
+      }
+    }
+    return false, nil
+  }
+  return len(name) == 0, nil
+}
+
+// Expand expands the braces in pattern, returning every alternative in order.
+// A pattern without braces expands to itself.
+func Expand(pattern string) ([]string, error) {
+  start := -1
+  depth := 0
+  var commas []int
+  for i := 0; i < len(pattern); i++ {
+    switch pattern[i] {
+    case '\\':
+      i++
+    case '{':
+      if depth == 0 {
+        start = i
+      }
+      depth++
+    case ',':
+      if depth == 1 {
+        commas = append(commas, i)
+      }
+    case '}':
+      if depth == 0 {
+        return nil, fmt.Errorf("%q: unmatched }", pattern)
+      }
+      depth--
+      if depth > 0 {
+        continue
+      }
+      prefix, suffix := pattern[:start], pattern[i+1:]
+      bounds := append(append([]int{start}, commas...), i)
+      var out []string
+      for j := 0; j+1 < len(bounds); j++ {
+        alts, err := Expand(prefix + pattern[bounds[j]+1:bounds[j+1]] + suffix)
+        if err != nil {
+          return nil, err
+        }
+        out = append(out, alts...)
+      }
+      return out, nil
+    }
+  }
+  if depth > 0 {
+    return nil, fmt.Errorf("%q: unmatched {", pattern)
+  }
+  return []string{pattern}, nil
+}
+
+// Glob returns the files and directories that match pattern. Matches are in
+// lexical order for each brace alternative. The walk starts at the longest
+// leading part of pattern without special characters, and only goes past the
+// pattern's depth for "**". Directories that match skip are not walked.
+func Glob(pattern string, skip func(path string) bool) ([]string, error) {
+  alts, err := Expand(pattern)
+  if err != nil {
+    return nil, err
+  }
+  seen := make(map[string]bool)
+  var out []string
+  for _, alt := range alts {
+    root := filepath.Clean(alt)
+    for HasMeta(root) {
+      root = filepath.Dir(root)
+    }
+    maxDepth := -1
+    if !strings.Contains(alt, "**") {
+      maxDepth = strings.Count(filepath.ToSlash(filepath.Clean(alt)), "/")
+    }
+    err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+      if err != nil {
+        if name == root && errors.Is(err, os.ErrNotExist) {
+          return nil
+        }
+        return err
+      }
+      if skip != nil && skip(name) {
+        if info.IsDir() {
+          return filepath.SkipDir
+        }
+        return nil
+      }
+      matched, err := Match(alt, name)
+      if err != nil {
+        return err
+      }
+      if matched && !seen[name] {
+        seen[name] = true
+        out = append(out, name)
+      }
+      if info.IsDir() && maxDepth >= 0 && strings.Count(filepath.ToSlash(name), "/") >= maxDepth {
+        return filepath.SkipDir
+      }
+      return nil
+    })
+    if err != nil {
+      return nil, err
+    }
+  }
+  return out, nil
+}
@@ -0,0 +1,146 @@
+package glob
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMatch(t *testing.T) {
+  tests := map[string]struct{
+    pattern string
+    name string
+    want bool
+  }{
+    "literal": {
+      pattern: "/sdk/a/b",
+      name: "/sdk/a/b",
+      want: true,
+    },
+    "star stays in one element": {
+      pattern: "/sdk/*/iar",
+      name: "/sdk/a/b/iar",
+      want: false,
+    },
+    "double star matches no elements": {
+      pattern: "/sdk/**/iar",
+      name: "/sdk/iar",
+      want: true,
+    },
+    "double star matches many elements": {
+      pattern: "/sdk/**/iar",
+      name: "/sdk/a/b/iar",
+      want: true,
+    },
+    "double star needs the rest to match": {
+      pattern: "/sdk/**/iar",
+      name: "/sdk/a/b/iar/x",
+      want: false,
+    },
+    "trailing double star": {
+      pattern: "/sdk/docs/**",
+      name: "/sdk/docs/a/b.html",
+      want: true,
+    },
+    "repeated double star": {
+      pattern: "/sdk/**/**/*.svd",
+      name: "/sdk/a/nrf52.svd",
+      want: true,
+    },
+    "double star inside an element is a star": {
+      pattern: "/sdk/a**",
+      name: "/sdk/ab/c",
+      want: false,
+    },
+    "brace": {
+      pattern: "/sdk/**/{iar,keil}",
+      name: "/sdk/a/keil",
+      want: true,
+    },
+    "nested braces": {
+      pattern: "/sdk/{a,b{c,d}}/x",
+      name: "/sdk/bd/x",
+      want: true,
+    },
+    "brace miss": {
+      pattern: "/sdk/{a,b}/x",
+      name: "/sdk/c/x",
+      want: false,
+    },
+    "escaped brace": {
+      pattern: `/sdk/\{a\}`,
+      name: "/sdk/{a}",
+      want: true,
+    },
+    "relative": {
+      pattern: "**/*_iar.h",
+      name: "cmsis/core_iar.h",
+      want: true,
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      got, err := Match(test.pattern, test.name)
+      if err != nil {
+        t.Fatalf("Match(%q, %q): %v", test.pattern, test.name, err)
+      }
+      if got != test.want {
+        t.Errorf("Match(%q, %q) = %v, want %v", test.pattern, test.name, got, test.want)
+      }
+    })
+  }
+}
+
+func TestExpand(t *testing.T) {
+  got, err := Expand("a/{b,c{d,e},}/f")
+  if err != nil {
+    t.Fatalf("Expand: %v", err)
+  }
+  want := []string{"a/b/f", "a/cd/f", "a/ce/f", "a//f"}
+  if diff := cmp.Diff(want, got); diff != "" {
+    t.Errorf("Expand: (-want +got)\n%s", diff)
+  }
+}
+
+func TestValidate(t *testing.T) {
+  for _, pattern := range []string{"a/{b", "a/b}", "a/[b", "**/[/"} {
+    if err := Validate(pattern); err == nil {
+      t.Errorf("Validate(%q) succeeded, want error", pattern)
+    }
+  }
+  for _, pattern := range []string{"a/**/b", "{a,b}/*.c", "a/[bc]"} {
+    if err := Validate(pattern); err != nil {
+      t.Errorf("Validate(%q): %v", pattern, err)
+    }
+  }
+}
+
+func TestGlob(t *testing.T) {
+  dir := t.TempDir()
+  for _, d := range []string{"a/include", "a/iar/include", "b/x/include", "c/include"} {
+    if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+      t.Fatal(err)
+    }
+  }
+  skip := func(path string) bool {
+    return filepath.Base(path) == "iar"
+  }
+  got, err := Glob(filepath.Join(dir, "{a,b}/**/include"), skip)
+  if err != nil {
+    t.Fatalf("Glob: %v", err)
+  }
+  for i := range got {
+    got[i] = strings.TrimPrefix(got[i], dir)
+  }
+  want := []string{"/a/include", "/b/x/include"}
+  if diff := cmp.Diff(want, got); diff != "" {
+    t.Errorf("Glob: (-want +got)\n%s", diff)
+  }
+  got, err = Glob(filepath.Join(dir, "missing/*"), nil)
+  if err != nil || len(got) != 0 {
+    t.Errorf("Glob(missing) = %v, %v, want no matches", got, err)
+  }
+}
@@ -5,6 +5,9 @@ import (
 	"bytes"
 	"fmt"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 
@@ -17,17 +20,47 @@ const (
 )
 
 var (
-	remapBzlContents = template.Must(template.New("remapBzlContents").Parse(`
-""" This allows performing remapping of library dependencies based on the
+  identRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+  // Attributes of nrf_cc_binary and its rule, which string lists can't use.
+  reservedAttrs = map[string]bool{
+    "name": true,
+    "remap": true,
+    "linker_script": true,
+    "actual_binary": true,
+    "kwargs": true,
+  }
+)
+
+var (
+	remapBzlContents = template.Must(template.New("remapBzlContents").Funcs(template.FuncMap{"quote": strconv.Quote}).Parse(`
+{{block "header" .}}""" This allows performing remapping of library dependencies based on the
 nrf_cc_binary that includes the library.
 """
 load("@rules_cc//cc:defs.bzl", "cc_binary")
+{{- if .StringLists}}
+load("@bazel_skylib//rules:common_settings.bzl", "BuildSettingInfo")
+{{- end}}{{end}}
 
-def _remap_transition_impl(settings, attr):
+{{if .LabelFlags}}{{block "label_flags" .}}# Remaps are label_flags here, instead of transitions of nrf_cc_binary, so
+# Bazel's function transition allowlist isn't needed. The tradeoff is that a
+# remap is the same for every binary in a build: set it on the command line or
+# in .bazelrc, like --<flag>=//app:lib, and build binaries that need different
+# remaps separately.
+#
+# The flag of each remap:
+{{- range .Data}}
+#   {{.Header}}: {{.Label}}
+{{- end}}
+{{- range .StringLists}}
+#   {{.Name}}: {{.Label}}
+{{- end}}{{end}}{{else}}{{block "transition" .}}def _remap_transition_impl(settings, attr):
   return {
 {{range .Data}}
 		"{{.Label}}": attr.{{.ShortName}},
 {{end}}
+{{- range .StringLists}}
+    "{{.Label}}": attr.{{.Name}},
+{{- end}}
   }
 
 _remap_transition = transition(
@@ -37,6 +70,9 @@ _remap_transition = transition(
 {{range .Data}}
     "{{.Label}}",
 {{end}}
+{{- range .StringLists}}
+    "{{.Label}}",
+{{- end}}
   ],
 )
 
@@ -66,26 +102,70 @@ _remap_rule = rule(
 {{range .Data}}
     "{{.ShortName}}": attr.label(),
 {{end}}
+{{- range .StringLists}}
+    "{{.Name}}": attr.string_list(),
+{{- end}}
     "actual_binary": attr.label(cfg = _remap_transition),
     "_whitelist_function_transition": attr.label(
-      default = "@bazel_tools//tools/whitelists/function_transition_whitelist",
+      default = "{{block "allowlist" .}}@bazel_tools//tools/whitelists/function_transition_whitelist{{end}}",
     ),
   },
   # Making this executable means it works with "$ bazel run".
   executable = True,
-)
+){{end}}{{end}}
 
-# Convenience macro: this instantiates a transition_rule with the given
+{{block "nrf_cc_binary" .}}
+{{- if .LabelFlags}}# Convenience macro: a cc_binary that links with the SDK's linker scripts.
+# Remaps come from their label_flags.
+{{else}}# Convenience macro: this instantiates a transition_rule with the given
 # desired features, instantiates a cc_binary as a dependency of that rule,
 # and fills out the cc_binary with all other parameters passed to this macro.
-def nrf_cc_binary(name, remap = None, **kwargs):
+{{end -}}
+def nrf_cc_binary(name, remap = None, linker_script = None, **kwargs):
   """A cc_binary with configurable targets.
 
   Args:
     name: string name of the binary.
     remap: dict of target names to rules.
+{{- if .LabelFlags}} Not supported with label_flags.{{end}}
+    linker_script: label of the .ld file to link with, passed with -T.
+      The SDK's linker scripts that it includes, like nrf_common.ld, are
+      added to the linker inputs and search path.
+{{- if not .LabelFlags}}
+{{- range .StringLists}}
+    {{.Name}}: the value of {{.Label}} for everything the binary builds.
+{{- end}}
+{{- end}}
     **kwargs: args passed to the underlying cc_binary rule
   """
+  remap = remap or {}
+{{- if .LabelFlags}}
+  if remap{{range .StringLists}} or "{{.Name}}" in kwargs{{end}}:
+    fail("nrf_cc_binary can't remap with remap_backend LABEL_FLAG, set the remaps' label_flags instead")
+{{- else}}
+{{- range .StringLists}}
+  {{.Name}} = kwargs.pop("{{.Name}}", {{.Default}})
+{{- end}}
+{{- end}}
+  if linker_script:
+    kwargs["additional_linker_inputs"] = kwargs.get("additional_linker_inputs", []) + [
+      linker_script,
+{{- if .LinkerScripts }}
+      "{{ .LinkerScripts }}",
+{{- end }}
+    ]
+    kwargs["linkopts"] = kwargs.get("linkopts", []) + [
+      "-T$(location {})".format(linker_script),
+{{- range .LinkerSearchDirs }}
+      "-L{{ . }}",
+{{- end }}
+    ]
+{{- if .LabelFlags}}
+  cc_binary(
+    name = name,
+    **kwargs
+  )
+{{- else}}
   cc_binary_name = name + "_native_binary"
   _remap_rule(
     name = name,
@@ -93,11 +173,219 @@ def nrf_cc_binary(name, remap = None, **kwargs):
 {{range .Data}}
 		{{.ShortName}} = remap.get("{{.Header}}", "{{.BuildSettingDefault}}"),
 {{end}}
+{{- range .StringLists}}
+    {{.Name}} = {{.Name}},
+{{- end}}
   )
   cc_binary(
     name = cc_binary_name,
     **kwargs
   )
+{{- end}}{{end}}
+
+{{block "nrf_flash" .}}def _nrf_flash_impl(ctx):
+  args = ["--family", ctx.attr.family]
+  if ctx.attr.snr:
+    args += ["--snr", ctx.attr.snr]
+  nrfjprog = " ".join([ctx.attr.nrfjprog] + args)
+  script = ctx.actions.declare_file(ctx.label.name + ".sh")
+  ctx.actions.write(
+    output = script,
+    content = "\n".join([
+      "#!/bin/sh",
+      "set -e",
+      "{} --program {} --sectorerase --verify".format(nrfjprog, ctx.file.hex.short_path),
+      "{} --reset".format(nrfjprog),
+      "",
+    ]),
+    is_executable = True,
+  )
+  return [DefaultInfo(
+    executable = script,
+    runfiles = ctx.runfiles(files = [ctx.file.hex]),
+  )]
+
+_nrf_flash = rule(
+  implementation = _nrf_flash_impl,
+  attrs = {
+    "hex": attr.label(allow_single_file = [".hex"], mandatory = True),
+    "family": attr.string(default = "NRF52"),
+    "snr": attr.string(),
+    "nrfjprog": attr.string(default = "nrfjprog"),
+  },
+  executable = True,
+)
+
+# Flashes a hex with nrfjprog from the nRF Command Line Tools, with
+# "bazel run". An ELF, like the output of nrf_cc_binary, is converted to a
+# hex first.
+def nrf_flash(name, hex = None, elf = None, family = "NRF52", snr = None, objcopy = "arm-none-eabi-objcopy", **kwargs):
+  """Flashes a hex or ELF with nrfjprog.
+
+  Args:
+    name: string name of the runnable target.
+    hex: label of the hex to flash.
+    elf: label of the ELF to flash, if there is no hex.
+    family: the nrfjprog --family, like NRF52.
+    snr: serial number of the J-Link to flash with, if more than one is connected.
+    objcopy: the objcopy command that converts elf to a hex.
+    **kwargs: args passed to the underlying rule, like nrfjprog
+  """
+  if (hex == None) == (elf == None):
+    fail("nrf_flash needs exactly one of hex and elf")
+  if elf != None:
+    hex = name + "_hex"
+    native.genrule(
+      name = hex,
+      srcs = [elf],
+      outs = [name + ".hex"],
+      cmd = "{} -O ihex $< $@".format(objcopy),
+    )
+  _nrf_flash(
+    name = name,
+    hex = hex,
+    family = family,
+    snr = snr or "",
+    **kwargs
+  ){{end}}
+
+{{block "nrf_dfu_package" .}}# Builds a DFU zip package for over the air updates with nrfutil. An ELF, like
+# the output of nrf_cc_binary, is converted to a hex first.
+def nrf_dfu_package(
+    name,
+    hex = None,
+    elf = None,
+    key_file = {{ if .DFU.KeyFile }}{{ quote .DFU.KeyFile }}{{ else }}None{{ end }},
+    hw_version = {{ .DFU.HWVersion }},
+    sd_req = [{{ range $i, $id := .DFU.SDReq }}{{ if $i }}, {{ end }}{{ quote $id }}{{ end }}],
+    application_version = {{ .DFU.ApplicationVersion }},
+    nrfutil = {{ quote .DFU.Nrfutil }},
+    objcopy = "arm-none-eabi-objcopy",
+    **kwargs):
+  """Packages a hex or ELF as <name>.zip with nrfutil pkg generate.
+
+  Args:
+    name: string name of the package target.
+    hex: label of the application hex.
+    elf: label of the application ELF, if there is no hex.
+    key_file: label of the private key that signs the package.
+    hw_version: the --hw-version.
+    sd_req: firmware IDs of the SoftDevices the application runs on, like "0x0100".
+    application_version: the --application-version.
+    nrfutil: the nrfutil command.
+    objcopy: the objcopy command that converts elf to a hex.
+    **kwargs: args passed to the underlying genrule
+  """
+  if (hex == None) == (elf == None):
+    fail("nrf_dfu_package needs exactly one of hex and elf")
+  if key_file == None:
+    fail("nrf_dfu_package needs a key_file, or dfu { key_file } in .bazelifyrc")
+  if not sd_req:
+    fail("nrf_dfu_package needs sd_req, or dfu { sd_req } in .bazelifyrc")
+  if elf != None:
+    hex = name + "_hex"
+    native.genrule(
+      name = hex,
+      srcs = [elf],
+      outs = [name + ".hex"],
+      cmd = "{} -O ihex $< $@".format(objcopy),
+    )
+  native.genrule(
+    name = name,
+    srcs = [hex, key_file],
+    outs = [name + ".zip"],
+    cmd = " ".join([
+      nrfutil, "pkg", "generate",
+      "--hw-version", str(hw_version),
+      "--application-version", str(application_version),
+      "--sd-req", ",".join(sd_req),
+      "--application", "$(location {})".format(hex),
+      "--key-file", "$(location {})".format(key_file),
+      "$@",
+    ]),
+    **kwargs
+  ){{end}}
+
+{{block "nrf_debug" .}}def _nrf_debug_impl(ctx):
+  args = ["-device", ctx.attr.device, "-if", "SWD", "-speed", str(ctx.attr.speed), "-port", str(ctx.attr.port)]
+  if ctx.attr.snr:
+    args += ["-select", "USB=" + ctx.attr.snr]
+  script = ctx.actions.declare_file(ctx.label.name + ".sh")
+  ctx.actions.write(
+    output = script,
+    content = "\n".join([
+      "#!/bin/sh",
+      "echo 'Connect with: arm-none-eabi-gdb -ex \"target remote :{}\" {}'".format(ctx.attr.port, ctx.file.elf.short_path),
+      "exec {} {} \"$@\"".format(ctx.attr.jlink_gdb_server, " ".join(args)),
+      "",
+    ]),
+    is_executable = True,
+  )
+  return [DefaultInfo(
+    executable = script,
+    runfiles = ctx.runfiles(files = [ctx.file.elf]),
+  )]
+
+_nrf_debug = rule(
+  implementation = _nrf_debug_impl,
+  attrs = {
+    "elf": attr.label(allow_single_file = True, mandatory = True),
+    "device": attr.string(mandatory = True),
+    "snr": attr.string(),
+    "speed": attr.int(default = 4000),
+    "port": attr.int(default = 2331),
+    "jlink_gdb_server": attr.string(default = "JLinkGDBServer"),
+  },
+  executable = True,
+)
+
+# Starts JLinkGDBServer for the chip that the binary was built for, with
+# "bazel run", so gdb can connect to it.
+def nrf_debug(name, elf, device = None, snr = None, **kwargs):
+  """Starts a J-Link GDB server to debug elf.
+
+  Args:
+    name: string name of the runnable target.
+    elf: label of the ELF to debug, like an nrf_cc_binary.
+    device: the J-Link device name, like nRF52840_xxAA. Picked from the
+      platform's chip constraint by default.
+    snr: serial number of the J-Link to use, if more than one is connected.
+    **kwargs: args passed to the underlying rule, like speed and port
+  """
+  if device == None:
+{{- if .JLinkDevices }}
+    device = select({
+{{- range .JLinkDevices }}
+      "{{ .ConfigSetting }}": "{{ .Name }}",
+{{- end }}
+    }, no_match_error = "nrf_debug needs a device, or a platform with a chip constraint")
+{{- else }}
+    fail("nrf_debug needs a device")
+{{- end }}
+  _nrf_debug(
+    name = name,
+    elf = elf,
+    device = device,
+    snr = snr or "",
+    **kwargs
+  ){{end}}
+{{- if .StringLists}}
+
+def _string_list_defines_impl(ctx):
+  return [CcInfo(compilation_context = cc_common.create_compilation_context(
+    defines = depset(ctx.attr.setting[BuildSettingInfo].value),
+  ))]
+
+# Adds the value of a string_list_setting, which nrf_cc_binary sets, to the
+# defines of the libraries that depend on it, and their dependents.
+string_list_defines = rule(
+  implementation = _string_list_defines_impl,
+  attrs = {
+    "setting": attr.label(providers = [BuildSettingInfo], mandatory = True),
+  },
+)
+{{- end}}
+{{- block "extra" .}}{{end}}
 `))
 )
 
@@ -134,20 +422,71 @@ func New(headers []string, sdkFromWorkspace string) (*Remaps, error) {
       BuildSettingDefault: buildSettingDefault,
     })
   }
-	var bzlContents bytes.Buffer
-  if err := remapBzlContents.Execute(&bzlContents, remaps); err != nil {
-		return nil, fmt.Errorf("template execution failed: %v", err)
-	}
-
-  return &Remaps{
+  out := &Remaps{
+    sdkFromWorkspace: sdkFromWorkspace,
     libs: libs,
     labelSettings: labelSettings,
-    bzlContents: bzlContents.Bytes(),
-  }, nil
+    data: remaps,
+    tmpl: remapBzlContents,
+  }
+  if err := out.SetDFU(DFU{}); err != nil {
+    return nil, err
+  }
+  return out, nil
 }
 
 type RemapsData struct {
 	Data []*Processed
+  // Label of the SDK's linker scripts, added to nrf_cc_binary's linker inputs.
+  LinkerScripts string
+  // Dirs of the SDK's linker scripts relative to the workspace, passed with -L.
+  LinkerSearchDirs []string
+
+  // Settings with lists of strings that nrf_cc_binary sets, like defines.
+  StringLists []*StringList
+  // Whether remaps are label_flags, set on the command line, instead of
+  // transitions of nrf_cc_binary.
+  LabelFlags bool
+
+  // J-Link device names of the chips, for nrf_debug.
+  JLinkDevices []*JLinkDevice
+  // Defaults of nrf_dfu_package.
+  DFU *DFU
+}
+
+// StringList is a string_list_setting that nrf_cc_binary sets for everything
+// it builds, with an attribute of the same name.
+type StringList struct {
+  Name string
+  // The label of the setting, which is //sdk_dir:name.
+  Label string
+  // The value when nrf_cc_binary doesn't set it, as a Starlark list.
+  Default string
+  Defaults []string
+  // Whether the values are added to the defines of every library.
+  Defines bool
+}
+
+// DefinesName is the name of the string_list_defines rule that adds the
+// values to the defines of its dependents.
+func (s *StringList) DefinesName() string {
+  return s.Name + "_defines"
+}
+
+// DFU holds the defaults of nrf_dfu_package.
+type DFU struct {
+  KeyFile string // "" if there is no default
+  HWVersion int
+  SDReq []string
+  ApplicationVersion int
+  Nrfutil string
+}
+
+// JLinkDevice is the J-Link device name of a chip.
+type JLinkDevice struct {
+  // The config_setting label that matches the chip.
+  ConfigSetting string
+  Name string
 }
 
 type Processed struct {
@@ -163,11 +502,158 @@ type Processed struct {
 
 // Remaps holds data for remapping header files dynamically.
 type Remaps struct {
+  sdkFromWorkspace string
   libs []*buildfile.Library
   labelSettings map[string]*buildfile.LabelSetting // header file -> label setting
+  data *RemapsData
+  tmpl *template.Template
   bzlContents []byte
 }
 
+// SetTemplate overrides the remap.bzl template with a Go text/template, which
+// gets the RemapsData. It can replace the whole template, or only some of its
+// blocks with {{define}}, like {{define "allowlist"}}//my:allowlist{{end}}.
+// The blocks are header, transition, allowlist, label_flags, nrf_cc_binary,
+// nrf_flash, nrf_dfu_package, nrf_debug, and extra, which is empty, for
+// adding macros.
+func (r *Remaps) SetTemplate(text string) error {
+  tmpl, err := remapBzlContents.Clone()
+  if err != nil {
+    return fmt.Errorf("Clone: %v", err)
+  }
+  if r.tmpl, err = tmpl.Parse(text); err != nil {
+    return fmt.Errorf("template parsing failed: %v", err)
+  }
+  return r.render()
+}
+
+// AddStringList adds a string_list_setting that nrf_cc_binary sets with the
+// attribute of the same name, like "nrf_defines". If defines is true,
+// libraries that depend on the setting's string_list_defines get its values as
+// defines.
+func (r *Remaps) AddStringList(name string, defaults []string, defines bool) error {
+  if !identRegexp.MatchString(name) {
+    return fmt.Errorf("%q isn't a valid attribute name", name)
+  }
+  if reservedAttrs[name] {
+    return fmt.Errorf("%q is an attribute of nrf_cc_binary already", name)
+  }
+  for _, processed := range r.data.Data {
+    if processed.ShortName == name || processed.Label == r.label(name) {
+      return fmt.Errorf("%q is the name of the remap of %q", name, processed.Header)
+    }
+  }
+  for _, list := range r.data.StringLists {
+    if list.Name == name {
+      return fmt.Errorf("duplicate string list %q", name)
+    }
+  }
+  var quoted []string
+  for _, value := range defaults {
+    quoted = append(quoted, fmt.Sprintf("%q", value))
+  }
+  r.data.StringLists = append(r.data.StringLists, &StringList{
+    Name: name,
+    Label: r.label(name),
+    Default: "[" + strings.Join(quoted, ", ") + "]",
+    Defaults: defaults,
+    Defines: defines,
+  })
+  return r.render()
+}
+
+// SetDefault makes the remap of header default to label, instead of the empty
+// library, for binaries that don't set it.
+func (r *Remaps) SetDefault(header, label string) error {
+  labelSetting := r.labelSettings[header]
+  if labelSetting == nil {
+    return fmt.Errorf("%q isn't remapped", header)
+  }
+  labelSetting.BuildSettingDefault = label
+  for _, processed := range r.data.Data {
+    if processed.Header == header {
+      processed.BuildSettingDefault = label
+    }
+  }
+  return r.render()
+}
+
+// UseLabelFlags makes remaps label_flags, which are set on the command line
+// or in .bazelrc, instead of label_settings that nrf_cc_binary sets with a
+// transition.
+func (r *Remaps) UseLabelFlags() error {
+  for _, labelSetting := range r.labelSettings {
+    labelSetting.Flag = true
+  }
+  r.data.LabelFlags = true
+  return r.render()
+}
+
+// LabelFlags checks whether remaps are label_flags.
+func (r *Remaps) LabelFlags() bool {
+  return r.data.LabelFlags
+}
+
+// StringLists returns the string lists added with AddStringList.
+func (r *Remaps) StringLists() []*StringList {
+  return r.data.StringLists
+}
+
+// label returns the label of a target in the SDK's root.
+func (r *Remaps) label(name string) string {
+  label := fmt.Sprintf("//%s", r.sdkFromWorkspace)
+  if filepath.Base(r.sdkFromWorkspace) != name {
+    label += fmt.Sprintf(":%s", name)
+  }
+  return label
+}
+
+// SetLinkerScripts makes nrf_cc_binary link with the SDK's linker scripts
+// in the filegroup with the given label, found in searchDirs.
+func (r *Remaps) SetLinkerScripts(label string, searchDirs []string) error {
+  r.data.LinkerScripts = label
+  r.data.LinkerSearchDirs = searchDirs
+  return r.render()
+}
+
+// SetJLinkDevices makes nrf_debug pick the J-Link device name of the chip,
+// by the config_setting labels in devices.
+func (r *Remaps) SetJLinkDevices(devices map[string]string) error {
+  r.data.JLinkDevices = nil
+  for configSetting, name := range devices {
+    r.data.JLinkDevices = append(r.data.JLinkDevices, &JLinkDevice{ConfigSetting: configSetting, Name: name})
+  }
+  sort.Slice(r.data.JLinkDevices, func(i, j int) bool {
+    return r.data.JLinkDevices[i].ConfigSetting < r.data.JLinkDevices[j].ConfigSetting
+  })
+  return r.render()
+}
+
+// SetDFU sets the defaults of nrf_dfu_package. Unset fields get the defaults
+// of nrfutil pkg generate for nRF52 applications.
+func (r *Remaps) SetDFU(dfu DFU) error {
+  if dfu.HWVersion == 0 {
+    dfu.HWVersion = 52
+  }
+  if dfu.ApplicationVersion == 0 {
+    dfu.ApplicationVersion = 1
+  }
+  if dfu.Nrfutil == "" {
+    dfu.Nrfutil = "nrfutil"
+  }
+  r.data.DFU = &dfu
+  return r.render()
+}
+
+func (r *Remaps) render() error {
+	var bzlContents bytes.Buffer
+  if err := r.tmpl.Execute(&bzlContents, r.data); err != nil {
+		return fmt.Errorf("template execution failed: %v", err)
+	}
+  r.bzlContents = bzlContents.Bytes()
+  return nil
+}
+
 // Libraries returns the libraries that need to be created.
 func (r *Remaps) Libraries() []*buildfile.Library {
   return r.libs
@@ -0,0 +1,136 @@
+package nrfbazelify
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+)
+
+const (
+  // With stable_labels, the label of every header's library is tracked in
+  // this file, at the root of the primary SDK. It is meant to be checked in.
+  labelsFilename = "bazelify.labels.json"
+)
+
+// LabelsFile records which library every header was in, and the aliases that
+// keep old labels working after their headers moved to another library.
+type LabelsFile struct {
+  // Header path, relative to the workspace -> label of its library.
+  Headers map[string]string `json:"headers"`
+  // Alias label -> header path that it follows.
+  Aliases map[string]string `json:"aliases,omitempty"`
+}
+
+func labelsPath(sdkDir string) string {
+  return filepath.Join(sdkDir, labelsFilename)
+}
+
+// ReadLabelsFile reads the labels file in sdkDir.
+// A missing labels file is treated as an empty one.
+func ReadLabelsFile(sdkDir string) (*LabelsFile, error) {
+  out := &LabelsFile{}
+  data, err := os.ReadFile(labelsPath(sdkDir))
+  if os.IsNotExist(err) {
+    return out, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  if err := json.Unmarshal(data, out); err != nil {
+    return nil, fmt.Errorf("json.Unmarshal(%q): %v", labelsPath(sdkDir), err)
+  }
+  return out, nil
+}
+
+// Write writes the labels file to sdkDir.
+func (l *LabelsFile) Write(sdkDir string) error {
+  data, err := json.MarshalIndent(l, "", "  ")
+  if err != nil {
+    return fmt.Errorf("json.Marshal: %v", err)
+  }
+  return writeFileAtomic(labelsPath(sdkDir), append(data, '\n'), 0644)
+}
+
+// addAliases adds an alias for every label of the last run whose headers are
+// now in another library, like when a library is absorbed into a group, so
+// BUILD files that use the old label keep working. Aliases are kept until the
+// label is a real target again, or the header is gone. It returns the labels
+// file to write once the BUILD files are written.
+func addAliases(conf *Config, files map[string]*buildfile.File) (*LabelsFile, error) {
+  last, err := ReadLabelsFile(conf.SDKDir)
+  if err != nil {
+    return nil, fmt.Errorf("ReadLabelsFile: %v", err)
+  }
+  out := &LabelsFile{
+    Headers: make(map[string]string),
+    Aliases: make(map[string]string),
+  }
+  for dir, file := range files {
+    var err error
+    file.EachLibrary(func(lib *buildfile.Library) {
+      label, labelErr := bazel.NewLabel(filepath.Join(conf.WorkspaceDir, dir), lib.Name, conf.WorkspaceDir)
+      if labelErr != nil {
+        err = labelErr
+        return
+      }
+      for _, hdr := range lib.Hdrs {
+        out.Headers[path.Join(filepath.ToSlash(dir), hdr)] = label.String()
+      }
+    })
+    if err != nil {
+      return nil, fmt.Errorf("bazel.NewLabel: %v", err)
+    }
+  }
+
+  // Old label -> the header it follows. If the library was split, the first
+  // header is followed.
+  candidates := make(map[string]string)
+  var headers []string
+  for header := range last.Headers {
+    headers = append(headers, header)
+  }
+  sort.Strings(headers)
+  for _, header := range headers {
+    oldLabel := last.Headers[header]
+    if _, ok := candidates[oldLabel]; !ok && out.Headers[header] != "" && out.Headers[header] != oldLabel {
+      candidates[oldLabel] = header
+    }
+  }
+  for alias, header := range last.Aliases {
+    if _, ok := candidates[alias]; !ok {
+      candidates[alias] = header
+    }
+  }
+
+  for alias, header := range candidates {
+    actual := out.Headers[header]
+    if actual == "" || actual == alias {
+      continue
+    }
+    label, err := bazel.ParseLabel(alias)
+    if err != nil {
+      return nil, fmt.Errorf("%s: alias %q: %v", labelsFilename, alias, err)
+    }
+    if files[label.Dir()] == nil {
+      // The package may be gone entirely.
+      dir := filepath.Join(conf.WorkspaceDir, label.Dir())
+      if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, fmt.Errorf("os.MkdirAll(%q): %v", dir, err)
+      }
+      files[label.Dir()] = buildfile.New(dir)
+    }
+    file := files[label.Dir()]
+    if file.HasRule(label.Name()) {
+      continue
+    }
+    file.AddRule(buildfile.NewAlias(label.Name(), actual, fmt.Sprintf("%s moved to %s", alias, actual)))
+    out.Aliases[alias] = header
+  }
+  return out, nil
+}
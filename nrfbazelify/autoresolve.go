@@ -0,0 +1,280 @@
+package nrfbazelify
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+)
+
+// AutoResolution records an ambiguous include that was resolved automatically,
+// so the decision can be reviewed.
+type AutoResolution struct {
+  Include string
+  IncludedBy []*bazel.Label
+  Chosen *bazel.Label
+  Candidates []*bazel.Label
+  Reason string
+}
+
+func (a *AutoResolution) String() string {
+  var others []*bazel.Label
+  for _, c := range a.Candidates {
+    if !c.Equal(a.Chosen) {
+      others = append(others, c)
+    }
+  }
+  return fmt.Sprintf("%s -> %s over [%s]: %s", a.Include, a.Chosen, bazel.JoinLabelStrings(others, ", "), a.Reason)
+}
+
+// autoResolutions collects AutoResolutions, merging repeated decisions for
+// the same include and choice.
+type autoResolutions map[string]*AutoResolution // include + chosen label -> resolution
+
+func (a autoResolutions) add(res *AutoResolution) {
+  key := res.Include + " " + res.Chosen.String()
+  if existing := a[key]; existing != nil {
+    existing.IncludedBy = append(existing.IncludedBy, res.IncludedBy...)
+    return
+  }
+  a[key] = res
+}
+
+// sorted returns all resolutions sorted by include, then chosen label.
+func (a autoResolutions) sorted() []*AutoResolution {
+  var out []*AutoResolution
+  for _, res := range a {
+    out = append(out, res)
+  }
+  sort.Slice(out, func(i, j int) bool {
+    if out[i].Include != out[j].Include {
+      return out[i].Include < out[j].Include
+    }
+    return out[i].Chosen.Less(out[j].Chosen)
+  })
+  return out
+}
+
+// autoResolve tries to pick one of the nodes containing the include, using the
+// lock file, then the heuristics enabled in .bazelifyrc. Decisions are
+// recorded, so they can be reported and locked. Returns nil if the include is
+// still ambiguous.
+func (s *SDKWalker) autoResolve(includedBy *LibraryNode, include string, nodes []Node) (Node, error) {
+  var chosen Node
+  var reason string
+  if s.lock != nil {
+    if locked := s.lock.lookup(include, includedBy.Label().Dir()); locked != "" {
+      for _, n := range nodes {
+        if n.Label().String() == locked {
+          chosen, reason = n, "locked in "+lockFilename
+        }
+      }
+      if chosen == nil {
+        if err := staleLock(includedBy.Label(), include, locked); err != nil {
+          return nil, err
+        }
+      }
+    }
+  }
+  if chosen == nil && s.conf.DuplicateHeaders.ResolveIdentical {
+    node, err := s.resolveIdentical(include, nodes)
+    if err != nil {
+      return nil, fmt.Errorf("resolveIdentical: %v", err)
+    }
+    chosen, reason = node, "identical headers"
+  }
+  if chosen == nil {
+    chosen, reason = s.resolveOwnSDK(includedBy, include, nodes)
+  }
+  if chosen == nil && len(s.conf.PreferredDirs) > 0 {
+    chosen, reason = s.resolvePreferredDir(include, nodes)
+  }
+  if chosen == nil && *resolveByProximity {
+    chosen, reason = s.resolveByProximity(includedBy, include, nodes)
+    if chosen != nil {
+      log.Printf("Resolved %s included by %s to %s: %s", include, includedBy.Label(), chosen.Label(), reason)
+    }
+  }
+  if chosen == nil {
+    return nil, nil
+  }
+  var candidates []*bazel.Label
+  for _, n := range nodes {
+    candidates = append(candidates, n.Label())
+  }
+  bazel.SortLabels(candidates)
+  s.autoResolved.add(&AutoResolution{
+    Include: include,
+    IncludedBy: []*bazel.Label{includedBy.Label()},
+    Chosen: chosen.Label(),
+    Candidates: candidates,
+    Reason: reason,
+  })
+  return chosen, nil
+}
+
+// resolvePreferredDir picks the only node whose header is under the
+// highest-priority preferred_dirs entry that contains any of the nodes.
+// Returns nil if no node is in a preferred dir, or if several nodes are in the
+// same highest-priority dir.
+func (s *SDKWalker) resolvePreferredDir(include string, nodes []Node) (Node, string) {
+  for _, dir := range s.conf.PreferredDirs {
+    var matches []Node
+    for _, node := range nodes {
+      path := s.headerPath(node, include)
+      if path != "" && strings.HasPrefix(path, dir+string(filepath.Separator)) {
+        matches = append(matches, node)
+      }
+    }
+    switch len(matches) {
+    case 0:
+      continue
+    case 1:
+      return matches[0], fmt.Sprintf("in preferred dir %s", s.prettySDKPath(dir))
+    default:
+      return nil, ""
+    }
+  }
+  return nil, ""
+}
+
+// resolveOwnSDK picks the only node in the including library's SDK root, if
+// that root has prefer_own_sdk set. Returns nil if none or several nodes are
+// in that root.
+func (s *SDKWalker) resolveOwnSDK(includedBy *LibraryNode, include string, nodes []Node) (Node, string) {
+  sdkDir := s.sdkDirOf(filepath.Join(s.conf.WorkspaceDir, includedBy.Label().Dir()))
+  if !s.conf.PreferOwnSDK[sdkDir] {
+    return nil, ""
+  }
+  var matches []Node
+  for _, node := range nodes {
+    if s.sdkDirOf(s.headerPath(node, include)) == sdkDir {
+      matches = append(matches, node)
+    }
+  }
+  if len(matches) != 1 {
+    return nil, ""
+  }
+  return matches[0], fmt.Sprintf("in the including library's SDK %s", s.prettySDKPath(sdkDir))
+}
+
+// sdkDirOf finds the SDK root that contains path.
+// Returns "" if path is in none of them.
+func (s *SDKWalker) sdkDirOf(path string) string {
+  for _, sdkDir := range s.conf.SDKDirs {
+    if path == sdkDir || strings.HasPrefix(path, sdkDir+string(filepath.Separator)) {
+      return sdkDir
+    }
+  }
+  return ""
+}
+
+// resolveByProximity picks the node whose header shares the longest directory
+// prefix with the including library, i.e. the one under the nearest common
+// ancestor. Returns nil if several nodes are equally near.
+func (s *SDKWalker) resolveByProximity(includedBy *LibraryNode, include string, nodes []Node) (Node, string) {
+  from := strings.Split(includedBy.Label().Dir(), "/")
+  best, bestDepth, tied := Node(nil), -1, false
+  for _, node := range nodes {
+    path := s.headerPath(node, include)
+    if path == "" {
+      return nil, ""
+    }
+    rel, err := filepath.Rel(s.conf.WorkspaceDir, filepath.Dir(path))
+    if err != nil {
+      return nil, ""
+    }
+    depth := commonPrefixLen(from, strings.Split(filepath.ToSlash(rel), "/"))
+    switch {
+    case depth > bestDepth:
+      best, bestDepth, tied = node, depth, false
+    case depth == bestDepth:
+      tied = true
+    }
+  }
+  if tied || best == nil {
+    return nil, ""
+  }
+  return best, fmt.Sprintf("nearest to the including library, sharing //%s", strings.Join(from[:bestDepth], "/"))
+}
+
+// commonPrefixLen returns how many leading elements a and b share.
+func commonPrefixLen(a, b []string) int {
+  var i int
+  for i < len(a) && i < len(b) && a[i] == b[i] {
+    i++
+  }
+  return i
+}
+
+// resolveIdentical picks one of the nodes containing include, if the include's
+// file is identical in all of them. Returns nil if the files differ.
+func (s *SDKWalker) resolveIdentical(include string, nodes []Node) (Node, error) {
+  paths := make(map[int64]string) // node ID -> path of include in node
+  var first []byte
+  for _, node := range nodes {
+    path := s.headerPath(node, include)
+    if path == "" {
+      return nil, nil
+    }
+    contents, err := os.ReadFile(path)
+    if err != nil {
+      return nil, fmt.Errorf("ReadFile(%q): %v", path, err)
+    }
+    if s.conf.DuplicateHeaders.IgnoreWhitespace {
+      contents = []byte(strings.Join(strings.Fields(string(contents)), " "))
+    }
+    if first == nil {
+      first = contents
+    } else if !bytes.Equal(first, contents) {
+      return nil, nil
+    }
+    paths[node.ID()] = path
+  }
+
+  // Prefer nodes by preferred_dirs, then by shortest path.
+  rank := func(node Node) int {
+    path := paths[node.ID()]
+    for i, dir := range s.conf.DuplicateHeaders.PreferredDirs {
+      if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+        return i
+      }
+    }
+    return len(s.conf.DuplicateHeaders.PreferredDirs)
+  }
+  sorted := append([]Node{}, nodes...)
+  sort.Slice(sorted, func(i, j int) bool {
+    a, b := sorted[i], sorted[j]
+    if rank(a) != rank(b) {
+      return rank(a) < rank(b)
+    }
+    if len(paths[a.ID()]) != len(paths[b.ID()]) {
+      return len(paths[a.ID()]) < len(paths[b.ID()])
+    }
+    return paths[a.ID()] < paths[b.ID()]
+  })
+  return sorted[0], nil
+}
+
+// headerPath finds the path of the header named include in node.
+// Returns "" if node doesn't have a matching header.
+func (s *SDKWalker) headerPath(node Node, include string) string {
+  var hdrs []*bazel.Label
+  switch n := node.(type) {
+  case *LibraryNode:
+    hdrs = n.Hdrs
+  case *GroupNode:
+    hdrs = n.Hdrs
+  }
+  for _, hdr := range hdrs {
+    if hdr.Name() == filepath.Base(include) {
+      return filepath.Join(s.conf.WorkspaceDir, hdr.Dir(), hdr.Name())
+    }
+  }
+  return ""
+}
@@ -0,0 +1,276 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+)
+
+const (
+  // chips/BUILD is generated in the primary SDK root.
+  chipsDir = "chips"
+  // The constraint_setting that every chip is a value of.
+  chipConstraintSetting = "chip"
+  // The cc_library that defines the chip's macro, like NRF52840_XXAA.
+  chipLibraryName = "chip"
+  // nrf.h selects the chip's headers using the chip's macro, so the library
+  // with nrf.h depends on the chip library.
+  chipHeader = "nrf.h"
+  // The constraint_setting that every board is a value of.
+  boardConstraintSetting = "board"
+  // The cc_library that defines the board's macro, like BOARD_PCA10056.
+  boardLibraryName = "board"
+  // boards.h selects the board's header using the board's macro, so the
+  // library with boards.h depends on the board library.
+  boardHeader = "boards.h"
+)
+
+// Chip is an nRF52 SoC variant.
+type Chip struct {
+  // Name is used for the constraint_value, like nrf52840.
+  Name string
+  // Define is the macro that nrf.h uses to pick the chip's headers.
+  Define string
+  // MDK is the name the MDK uses for the chip's system and startup files,
+  // like nrf52 in system_nrf52.c.
+  MDK string
+  // JLinkDevice is the chip's J-Link device name, like nRF52840_xxAA.
+  JLinkDevice string
+  // NoFPU is whether the chip's Cortex-M4 has no FPU, so the toolchain uses
+  // -mfloat-abi=soft for it.
+  NoFPU bool
+}
+
+// ConfigSetting is the name of the config_setting that matches the chip.
+func (c *Chip) ConfigSetting() string {
+  return "is_" + c.Name
+}
+
+// Board is a board with an nRF52 chip, like a Nordic development kit.
+type Board struct {
+  // Name is used for the constraint_value, like pca10056.
+  Name string
+  // Chip is the name of the board's chip, like nrf52840.
+  Chip string
+  // Define is the macro that boards.h uses to pick the board's header.
+  Define string
+}
+
+// ConfigSetting is the name of the config_setting that matches the board.
+func (b *Board) ConfigSetting() string {
+  return "is_" + b.Name
+}
+
+// Platform is the name of the platform with the board's constraints.
+func (b *Board) Platform() string {
+  return b.Name + "_platform"
+}
+
+var (
+  // knownChips are the chips in chips/BUILD, sorted by name.
+  knownChips = []*Chip{
+    {Name: "nrf52810", Define: "NRF52810_XXAA", MDK: "nrf52810", JLinkDevice: "nRF52810_xxAA", NoFPU: true},
+    {Name: "nrf52832", Define: "NRF52832_XXAA", MDK: "nrf52", JLinkDevice: "nRF52832_xxAA"},
+    {Name: "nrf52833", Define: "NRF52833_XXAA", MDK: "nrf52833", JLinkDevice: "nRF52833_xxAA"},
+    {Name: "nrf52840", Define: "NRF52840_XXAA", MDK: "nrf52840", JLinkDevice: "nRF52840_xxAA"},
+  }
+  // knownBoards are Nordic's development kits, sorted by name.
+  knownBoards = []*Board{
+    {Name: "pca10040", Chip: "nrf52832", Define: "BOARD_PCA10040"},
+    // The nRF52832 DK, emulating an nRF52810.
+    {Name: "pca10040e", Chip: "nrf52810", Define: "BOARD_PCA10040"},
+    {Name: "pca10056", Chip: "nrf52840", Define: "BOARD_PCA10056"},
+    // The nRF52840 Dongle.
+    {Name: "pca10059", Chip: "nrf52840", Define: "BOARD_PCA10059"},
+    {Name: "pca10100", Chip: "nrf52833", Define: "BOARD_PCA10100"},
+  }
+  // Constraints of every nRF52 platform.
+  nrf52PlatformConstraints = []string{
+    "@platforms//cpu:armv7e-m",
+    "@platforms//os:none",
+  }
+)
+
+// newBoards validates the boards in the rc, and adds them to the known boards.
+func newBoards(boards []*bazelifyrc.Board) ([]*Board, error) {
+  out := append([]*Board{}, knownBoards...)
+  names := make(map[string]bool)
+  for _, chip := range knownChips {
+    names[chip.Name] = true
+  }
+  for _, board := range knownBoards {
+    names[board.Name] = true
+  }
+  for _, board := range boards {
+    if board.GetName() == "" {
+      return nil, fmt.Errorf("board with no name")
+    }
+    if names[board.GetName()] {
+      return nil, fmt.Errorf("board %q: name is already used by a chip or board", board.GetName())
+    }
+    names[board.GetName()] = true
+    if findChip(board.GetChip()) == nil {
+      return nil, fmt.Errorf("board %q: unknown chip %q", board.GetName(), board.GetChip())
+    }
+    define := board.GetDefine()
+    if define == "" {
+      define = "BOARD_" + strings.ToUpper(board.GetName())
+    }
+    out = append(out, &Board{Name: board.GetName(), Chip: board.GetChip(), Define: define})
+  }
+  sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+  return out, nil
+}
+
+// findChip returns the known chip with the given name, or nil.
+func findChip(name string) *Chip {
+  for _, chip := range knownChips {
+    if chip.Name == name {
+      return chip
+    }
+  }
+  return nil
+}
+
+// jlinkDevices maps the config_setting of every chip to its J-Link device name.
+func jlinkDevices(conf *Config) (map[string]string, error) {
+  out := make(map[string]string)
+  for _, chip := range knownChips {
+    label, err := chipsLabel(conf, chip.ConfigSetting())
+    if err != nil {
+      return nil, err
+    }
+    out[label.String()] = chip.JLinkDevice
+  }
+  return out, nil
+}
+
+// chipsLabel returns the label of a rule in chips/BUILD.
+func chipsLabel(conf *Config, name string) (*bazel.Label, error) {
+  dir := filepath.Join(conf.SDKDir, chipsDir)
+  label, err := bazel.NewLabel(dir, name, conf.WorkspaceDir)
+  if err != nil {
+    return nil, fmt.Errorf("bazel.NewLabel(%q, %q): %v", dir, name, err)
+  }
+  return label, nil
+}
+
+// chipsContents generates chips/BUILD, which has a constraint_value and a
+// config_setting for every known chip and board, a platform for every board,
+// and libraries that define the chip's and board's macros for the target
+// platform.
+func chipsContents(conf *Config) ([]*buildContents, error) {
+  settingLabel, err := chipsLabel(conf, chipConstraintSetting)
+  if err != nil {
+    return nil, err
+  }
+  dir := settingLabel.Dir()
+  out := []*buildContents{{
+    dir: dir,
+    constraintSetting: &buildfile.ConstraintSetting{Name: chipConstraintSetting},
+  }}
+  defines := make(map[string][]string)
+  for _, chip := range knownChips {
+    out = append(out, &buildContents{
+      dir: dir,
+      constraintValue: &buildfile.ConstraintValue{
+        Name: chip.Name,
+        ConstraintSetting: ":" + chipConstraintSetting,
+      },
+      configSetting: &buildfile.ConfigSetting{
+        Name: chip.ConfigSetting(),
+        ConstraintValues: []string{":" + chip.Name},
+      },
+    })
+    defines[":"+chip.ConfigSetting()] = []string{chip.Define}
+  }
+  out = append(out, &buildContents{
+    dir: dir,
+    library: &buildfile.Library{
+      Name: chipLibraryName,
+      DefinesSelect: defines,
+    },
+  }, &buildContents{
+    dir: dir,
+    constraintSetting: &buildfile.ConstraintSetting{Name: boardConstraintSetting},
+  })
+  boardDefines := make(map[string][]string)
+  for _, board := range conf.Boards {
+    out = append(out, &buildContents{
+      dir: dir,
+      constraintValue: &buildfile.ConstraintValue{
+        Name: board.Name,
+        ConstraintSetting: ":" + boardConstraintSetting,
+      },
+      configSetting: &buildfile.ConfigSetting{
+        Name: board.ConfigSetting(),
+        ConstraintValues: []string{":" + board.Name},
+      },
+      platform: &buildfile.Platform{
+        Name: board.Platform(),
+        ConstraintValues: append(append([]string{}, nrf52PlatformConstraints...), ":"+board.Chip, ":"+board.Name),
+      },
+    })
+    boardDefines[":"+board.ConfigSetting()] = []string{board.Define}
+  }
+  out = append(out, &buildContents{
+    dir: dir,
+    library: &buildfile.Library{
+      Name: boardLibraryName,
+      DefinesSelect: boardDefines,
+    },
+  })
+  return out, nil
+}
+
+// wantsChips reports whether chips/BUILD is generated: the libraries have
+// nrf.h or boards.h or select on the chips, or the toolchain or the rc use
+// them.
+func wantsChips(conf *Config, files map[string]*buildfile.File) (bool, error) {
+  if conf.Toolchain.Enabled || conf.UsesChips {
+    return true, nil
+  }
+  pkg, err := chipsLabel(conf, chipLibraryName)
+  if err != nil {
+    return false, err
+  }
+  prefix := "//" + pkg.Dir() + ":"
+  var found bool
+  for _, file := range files {
+    file.EachLibrary(func(lib *buildfile.Library) {
+      if hasHeader(lib, chipHeader) || hasHeader(lib, boardHeader) || selectsOn(lib, prefix) {
+        found = true
+      }
+    })
+  }
+  return found, nil
+}
+
+// selectsOn checks whether any select() of the library has a condition that
+// starts with prefix.
+func selectsOn(lib *buildfile.Library, prefix string) bool {
+  selects := append([]map[string][]string{lib.SrcsSelect, lib.HdrsSelect, lib.DefinesSelect}, lib.DepsSelects...)
+  for _, cases := range selects {
+    for condition := range cases {
+      if strings.HasPrefix(condition, prefix) {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+// hasHeader checks whether the library has a header with the given file name.
+func hasHeader(lib *buildfile.Library, name string) bool {
+  for _, hdr := range lib.Hdrs {
+    if hdr == name || strings.HasSuffix(hdr, ":"+name) || strings.HasSuffix(hdr, "/"+name) {
+      return true
+    }
+  }
+  return false
+}
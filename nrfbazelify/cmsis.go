@@ -0,0 +1,83 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+)
+
+const (
+  // The library with the CMSIS core headers, in their dir.
+  cmsisLibraryName = "cmsis"
+)
+
+var (
+  // Matches the CMSIS core headers, like core_cm4.h, cmsis_gcc.h and
+  // mpu_armv7.h. The CMSIS-RTOS cmsis_os.h isn't one.
+  cmsisHeaderMatcher = regexp.MustCompile(`^(cmsis_(armcc|armclang\w*|compiler|gcc|iccarm|version)|core_(cm|sc|armv8m)\w*|mpu_armv\d+|tz_context)\.h$`)
+)
+
+// addCMSISHeader records hdr, a header without srcs in dir, for the cmsis
+// library of dir, if it is a CMSIS core header. Returns false if it isn't.
+func (s *SDKWalker) addCMSISHeader(dir string, hdr *bazel.Label) bool {
+  if s.conf.Layout != bazelifyrc.Layout_NRF5_SDK || s.conf.CMSIS.Disabled {
+    return false
+  }
+  if !cmsisHeaderMatcher.MatchString(hdr.Name()) || s.conf.isConfigured(hdr.Name()) {
+    return false
+  }
+  s.cmsisHeaders[dir] = append(s.cmsisHeaders[dir], hdr)
+  return true
+}
+
+// addCMSISNodes adds a cmsis library with the CMSIS core headers to every dir
+// that has them, which exports the dir as includes. Includes of CMSIS core
+// headers resolve to the primary SDK's cmsis library, or the first one if it
+// has none, so the headers of other copies can't be mixed in.
+func (s *SDKWalker) addCMSISNodes() error {
+  if len(s.cmsisHeaders) == 0 {
+    return nil
+  }
+  var dirs []string
+  for dir := range s.cmsisHeaders {
+    dirs = append(dirs, dir)
+  }
+  sort.Strings(dirs)
+  primary := dirs[0]
+  for _, dir := range dirs {
+    if strings.HasPrefix(dir, s.conf.SDKDir + string(filepath.Separator)) {
+      primary = dir
+      break
+    }
+  }
+  var primaryLabel *bazel.Label
+  for _, dir := range dirs {
+    label, err := bazel.NewLabel(dir, cmsisLibraryName, s.conf.WorkspaceDir)
+    if err != nil {
+      return fmt.Errorf("bazel.NewLabel(%q, %q): %v", dir, cmsisLibraryName, err)
+    }
+    hdrs := s.cmsisHeaders[dir]
+    bazel.SortLabels(hdrs)
+    if err := s.graph.AddLibraryNode(label, nil, hdrs, []string{label.Dir()}); err != nil {
+      return fmt.Errorf("AddLibraryNode(%q): %v", label, err)
+    }
+    // CMSIS headers are included through the chip headers everywhere, so
+    // their dir is exported to every transitive dependent.
+    s.graph.Node(label).(*LibraryNode).ExportIncludes = true
+    if dir == primary {
+      primaryLabel = label
+    }
+  }
+  for _, hdr := range s.cmsisHeaders[primary] {
+    if err := s.graph.AddRemapFile(hdr.Name(), primaryLabel); err != nil {
+      return err
+    }
+  }
+  s.conf.logf(VerbosityPhases, "Added %d cmsis libraries, CMSIS core headers resolve to %s", len(dirs), primaryLabel)
+  return nil
+}
@@ -0,0 +1,190 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+)
+
+const (
+  // The compilation database, in .bazelify-out.
+  compileCommandsFilename = "compile_commands.json"
+)
+
+// compileCommand is an entry of a JSON compilation database, which is what
+// clangd and most IDEs index C code with.
+type compileCommand struct {
+  Directory string `json:"directory"`
+  File string `json:"file"`
+  Arguments []string `json:"arguments"`
+}
+
+// generatedLibrary is a library in the generated BUILD files.
+type generatedLibrary struct {
+  label *bazel.Label
+  lib *buildfile.Library
+}
+
+// compileCommands generates a compilation database with every src of every
+// library in files, so code can be indexed without building with Bazel.
+// Commands run in the workspace dir, like Bazel's execroot. Include dirs are
+// the library's -I copts and includes, plus the includes and header dirs of
+// all its dependencies, so headers included by dependencies' headers resolve
+// too. Defines are the library's own, and the ones its dependencies propagate.
+// Selected srcs are included, but selected defines and deps aren't.
+func compileCommands(conf *Config, files map[string]*buildfile.File) ([]*compileCommand, error) {
+  libs := make(map[string]*generatedLibrary)
+  for dir, file := range files {
+    var err error
+    file.EachLibrary(func(lib *buildfile.Library) {
+      label, labelErr := bazel.NewLabel(filepath.Join(conf.WorkspaceDir, dir), lib.Name, conf.WorkspaceDir)
+      if labelErr != nil {
+        err = labelErr
+        return
+      }
+      libs[label.String()] = &generatedLibrary{label: label, lib: lib}
+    })
+    if err != nil {
+      return nil, fmt.Errorf("bazel.NewLabel: %v", err)
+    }
+  }
+
+  baseArgs := append([]string{compilerPath(conf)}, conf.Toolchain.withDefaults().Copts...)
+  if conf.NrfCcLibrary.Enabled {
+    baseArgs = append(baseArgs, conf.NrfCcLibrary.Copts...)
+    for _, define := range conf.NrfCcLibrary.Defines {
+      baseArgs = append(baseArgs, "-D"+define)
+    }
+  }
+
+  var out []*compileCommand
+  for _, gen := range libs {
+    srcs := append([]string{}, gen.lib.Srcs...)
+    for _, selected := range gen.lib.SrcsSelect {
+      srcs = append(srcs, selected...)
+    }
+    if len(srcs) == 0 {
+      continue
+    }
+    args := append(append([]string{}, baseArgs...), libraryArgs(gen, libs)...)
+    for _, src := range srcs {
+      path := filepath.Join(conf.WorkspaceDir, fileLabelPath(gen.label.Dir(), src))
+      switch filepath.Ext(path) {
+      case ".c", ".s", ".S":
+      default:
+        continue
+      }
+      out = append(out, &compileCommand{
+        Directory: conf.WorkspaceDir,
+        File: path,
+        Arguments: append(append([]string{}, args...), "-c", path),
+      })
+    }
+  }
+  sort.Slice(out, func(i, j int) bool { return out[i].File < out[j].File })
+  return out, nil
+}
+
+// compilerPath is the gcc of the generated toolchain if it's enabled, or
+// arm-none-eabi-gcc on the PATH.
+func compilerPath(conf *Config) string {
+  tc := conf.Toolchain.withDefaults()
+  if conf.Toolchain.Enabled {
+    return filepath.Join(tc.GCCDir, "bin", tc.Prefix+"gcc")
+  }
+  return tc.Prefix + "gcc"
+}
+
+// libraryArgs returns the compiler args that gen adds to its srcs.
+func libraryArgs(gen *generatedLibrary, libs map[string]*generatedLibrary) []string {
+  var copts, includes []string
+  seen := make(map[string]bool)
+  addInclude := func(dir string) {
+    if dir == "" {
+      dir = "."
+    }
+    if !seen[dir] {
+      seen[dir] = true
+      includes = append(includes, "-I"+dir)
+    }
+  }
+  for _, copt := range gen.lib.Copts {
+    if strings.HasPrefix(copt, "-I") {
+      addInclude(strings.TrimPrefix(copt, "-I"))
+      continue
+    }
+    copts = append(copts, copt)
+  }
+  var defines []string
+  for _, define := range append(append([]string{}, gen.lib.Defines...), gen.lib.LocalDefines...) {
+    defines = append(defines, "-D"+define)
+  }
+  for _, include := range gen.lib.Includes {
+    addInclude(filepath.Join(gen.label.Dir(), include))
+  }
+
+  // Walk the dependencies breadth first, so closer ones come first.
+  var depIncludes []string
+  visited := map[string]bool{gen.label.String(): true}
+  queue := []*generatedLibrary{gen}
+  for len(queue) > 0 {
+    current := queue[0]
+    queue = queue[1:]
+    deps := current.lib.Deps
+    if current == gen {
+      // implementation_deps only apply to the library itself.
+      deps = append(append([]string{}, deps...), gen.lib.ImplementationDeps...)
+    }
+    for _, dep := range deps {
+      label, err := bazel.ParseRelativeLabel(current.label, dep)
+      if err != nil || visited[label.String()] {
+        continue
+      }
+      visited[label.String()] = true
+      depGen := libs[label.String()]
+      if depGen == nil {
+        // Label settings and rules outside the generated BUILD files.
+        continue
+      }
+      queue = append(queue, depGen)
+      for _, define := range depGen.lib.Defines {
+        defines = appendMissing(defines, "-D"+define)
+      }
+      for _, include := range depGen.lib.Includes {
+        depIncludes = append(depIncludes, filepath.Join(depGen.label.Dir(), include))
+      }
+      // Without an include_prefix, the stripped prefix is a real dir.
+      if strip := depGen.lib.StripIncludePrefix; strip != "" && depGen.lib.IncludePrefix == "" {
+        if strings.HasPrefix(strip, "/") {
+          depIncludes = append(depIncludes, strings.TrimPrefix(strip, "/"))
+        } else {
+          depIncludes = append(depIncludes, filepath.Join(depGen.label.Dir(), strip))
+        }
+      }
+      for _, hdr := range depGen.lib.Hdrs {
+        depIncludes = append(depIncludes, filepath.Dir(fileLabelPath(depGen.label.Dir(), hdr)))
+      }
+    }
+  }
+  for _, dir := range depIncludes {
+    addInclude(dir)
+  }
+  return append(append(copts, defines...), includes...)
+}
+
+// fileLabelPath returns the path relative to the workspace of a file in a
+// rule of the package in dir, like "a.c" or "//some/path:a.c".
+func fileLabelPath(dir, file string) string {
+  if !strings.HasPrefix(file, "//") {
+    return filepath.Join(dir, file)
+  }
+  file = strings.TrimPrefix(file, "//")
+  if i := strings.LastIndex(file, ":"); i >= 0 {
+    return filepath.Join(file[:i], file[i+1:])
+  }
+  return file
+}
@@ -0,0 +1,137 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+)
+
+// ConditionalSources are files and defines that only apply when a
+// config_setting matches.
+type ConditionalSources struct {
+  Condition string // config_setting label
+  Files []string // absolute paths
+  Defines []string
+  Libraries []*bazel.Label
+}
+
+// newConditionalSources validates a conditional_sources entry of the rc in sdkDir.
+func (conf *Config) newConditionalSources(sdkDir string, c *bazelifyrc.ConditionalSources) (*ConditionalSources, error) {
+  condition, err := conf.conditionLabel(c.GetConfigSetting())
+  if err != nil {
+    return nil, err
+  }
+  if len(c.GetFiles()) == 0 && len(c.GetDefines()) == 0 {
+    return nil, fmt.Errorf("no files or defines")
+  }
+  if len(c.GetLibraries()) > 0 && len(c.GetDefines()) == 0 {
+    return nil, fmt.Errorf("libraries without defines")
+  }
+  out := &ConditionalSources{
+    Condition: condition,
+    Files: makeAbs(sdkDir, c.GetFiles()),
+    Defines: c.GetDefines(),
+  }
+  for _, file := range out.Files {
+    if info, err := os.Stat(file); err != nil {
+      return nil, fmt.Errorf("os.Stat(%v): %v", file, err)
+    } else if info.IsDir() {
+      return nil, fmt.Errorf("%q is a directory", file)
+    }
+  }
+  for _, lib := range c.GetLibraries() {
+    label, err := bazel.ParseLabel(lib)
+    if err != nil {
+      return nil, fmt.Errorf("libraries %q: %v", lib, err)
+    }
+    out.Libraries = append(out.Libraries, label)
+  }
+  return out, nil
+}
+
+// applyConditionalSources moves the files of every conditional_sources entry
+// from the srcs and hdrs of their libraries into a select(), and adds the
+// entry's defines to those libraries and its libraries as a select().
+func applyConditionalSources(conf *Config, files map[string]*buildfile.File) error {
+  for _, c := range conf.ConditionalSources {
+    withDefines := make(map[*buildfile.Library]bool)
+    for _, path := range c.Files {
+      found := false
+      for _, file := range files {
+        rel, err := filepath.Rel(filepath.Dir(file.Path), path)
+        if err != nil {
+          continue
+        }
+        file.EachLibrary(func(lib *buildfile.Library) {
+          var ok bool
+          if lib.Srcs, ok = removeString(lib.Srcs, rel); ok {
+            if lib.SrcsSelect == nil {
+              lib.SrcsSelect = make(map[string][]string)
+            }
+            lib.SrcsSelect[c.Condition] = append(lib.SrcsSelect[c.Condition], rel)
+            sort.Strings(lib.SrcsSelect[c.Condition])
+          } else if lib.Hdrs, ok = removeString(lib.Hdrs, rel); ok {
+            if lib.HdrsSelect == nil {
+              lib.HdrsSelect = make(map[string][]string)
+            }
+            lib.HdrsSelect[c.Condition] = append(lib.HdrsSelect[c.Condition], rel)
+            sort.Strings(lib.HdrsSelect[c.Condition])
+          }
+          if ok {
+            found = true
+            withDefines[lib] = true
+          }
+        })
+      }
+      if !found {
+        return fmt.Errorf("%q of %q is not in any library", path, c.Condition)
+      }
+    }
+    for _, label := range c.Libraries {
+      file := files[label.Dir()]
+      found := false
+      if file != nil {
+        file.EachLibrary(func(lib *buildfile.Library) {
+          if lib.Name == label.Name() {
+            found = true
+            withDefines[lib] = true
+          }
+        })
+      }
+      if !found {
+        return fmt.Errorf("library %q of %q is not generated", label, c.Condition)
+      }
+    }
+    if len(c.Defines) == 0 {
+      continue
+    }
+    for lib := range withDefines {
+      if lib.DefinesSelect == nil {
+        lib.DefinesSelect = make(map[string][]string)
+      }
+      lib.DefinesSelect[c.Condition] = append(lib.DefinesSelect[c.Condition], c.Defines...)
+    }
+  }
+  return nil
+}
+
+// removeString removes s from list, and reports whether it was there.
+// The list becomes nil if it's empty.
+func removeString(list []string, s string) ([]string, bool) {
+  for i, v := range list {
+    if v != s {
+      continue
+    }
+    out := append(append([]string{}, list[:i]...), list[i+1:]...)
+    if len(out) == 0 {
+      out = nil
+    }
+    return out, true
+  }
+  return list, false
+}
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+	"github.com/Michaelhobo/nrfbazel/internal/glob"
 	"github.com/Michaelhobo/nrfbazel/internal/remap"
 	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
 	"google.golang.org/protobuf/encoding/prototext"
@@ -28,59 +31,363 @@ type IncludeOverride struct {
 	IncludeDirs []string
 }
 
-func ReadConfig(sdkDir, workspaceDir string, verbose bool) (*Config, error) {
+// ReadConfig reads the .bazelifyrc of every SDK root in sdkDirs.
+// The first SDK is the primary SDK: its .bazelifyrc is required, and it
+// may list more SDK roots in sdk_dirs. The .bazelifyrc in any other SDK root
+// is optional, and its entries are merged with the primary SDK's.
+// The built-in preset for the primary SDK's version, if any, is merged too.
+func ReadConfig(sdkDirs []string, workspaceDir string, verbosity Verbosity) (*Config, error) {
+  if len(sdkDirs) == 0 {
+    return nil, fmt.Errorf("at least one SDK directory is required")
+  }
   conf := &Config{
-    SDKDir: sdkDir,
+    SDKDir: sdkDirs[0],
     WorkspaceDir: workspaceDir,
-    Verbose: verbose,
+    Verbosity: verbosity,
     IgnoreHeaders: make(map[string]bool),
+    FilegroupExtensions: make(map[string]bool),
     IncludeOverrides: make(map[string]*IncludeOverride),
+    MacroIncludes: make(map[string]string),
+    SelectOverrides: make(map[string]*SelectOverride),
+    IncludePrefixes: make(map[string]*IncludePrefix),
     SourceSetsByFile: make(map[string]*bazel.Label),
     SourceSets: make(map[string]*CCFiles),
     NamedGroups: make(map[string]map[string]string),
+    SplitHeaderDirs: make(map[string]bool),
+    PreferOwnSDK: make(map[string]bool),
+  }
+  rc, err := readBazelifyRC(conf.SDKDir, true)
+  if err != nil {
+    return nil, err
+  }
+  conf.BazelifyRCProto = rc
+  conf.Roots = rc.GetRoots()
+
+  // Add the built-in preset for the SDK version, if there is one.
+  preset, version, err := sdkPreset(conf.SDKDir)
+  if err != nil {
+    return nil, err
+  }
+  primaryRC := rc
+  if preset != nil {
+    conf.logf(VerbosityPhases, "Using built-in preset for nRF5 SDK %s", version)
+    conf.SDKVersion = version
+    primaryRC = withPreset(preset, rc)
   }
-  if err := readBazelifyRC(conf); err != nil {
+  if primaryRC, err = withMeshPreset(conf, conf.SDKDir, primaryRC); err != nil {
+    return nil, err
+  }
+  if primaryRC, err = withNonGCCPreset(conf, conf.SDKDir, primaryRC); err != nil {
+    return nil, err
+  }
+  if primaryRC, err = withDriverModePreset(conf, conf.SDKDir, primaryRC); err != nil {
+    return nil, err
+  }
+  if err := conf.addSDK(conf.SDKDir, primaryRC); err != nil {
+    return nil, err
+  }
+
+  // Collect the remaining SDK roots from the command line and the primary .bazelifyrc.
+  var extraDirs []string
+  extraDirs = append(extraDirs, sdkDirs[1:]...)
+  extraDirs = append(extraDirs, makeAbs(workspaceDir, rc.GetSdkDirs())...)
+  for _, dir := range extraDirs {
+    dir = filepath.Clean(dir)
+    if conf.hasSDKDir(dir) {
+      continue
+    }
+    extraRC, err := readBazelifyRC(dir, false)
+    if err != nil {
+      return nil, err
+    }
+    if len(extraRC.GetRemaps()) > 0 {
+      return nil, fmt.Errorf("%s: remaps are only allowed in the primary SDK's %s", dir, rcFilename)
+    }
+    if len(extraRC.GetStringListRemaps()) > 0 {
+      return nil, fmt.Errorf("%s: string_list_remaps are only allowed in the primary SDK's %s", dir, rcFilename)
+    }
+    if len(extraRC.GetRoots()) > 0 {
+      return nil, fmt.Errorf("%s: roots are only allowed in the primary SDK's %s", dir, rcFilename)
+    }
+    if extraRC, err = withMeshPreset(conf, dir, extraRC); err != nil {
+      return nil, err
+    }
+    if extraRC, err = withNonGCCPreset(conf, dir, extraRC); err != nil {
+      return nil, err
+    }
+    if extraRC, err = withDriverModePreset(conf, dir, extraRC); err != nil {
+      return nil, err
+    }
+    if err := conf.addSDK(dir, extraRC); err != nil {
+      return nil, err
+    }
+  }
+  if err := conf.sortIncludeDirs(); err != nil {
     return nil, err
   }
   return conf, nil
 }
 
-func readBazelifyRC(conf *Config) error {
+// readBazelifyRC reads the .bazelifyrc file at the root of sdkDir.
+// If required is false, a missing file is treated as an empty configuration.
+func readBazelifyRC(sdkDir string, required bool) (*bazelifyrc.Configuration, error) {
   // We read this file from the root of the SDK, so that we can have
   // per-SDK overrides in the same workspace.
-  rcPath := filepath.Join(conf.SDKDir, rcFilename)
+  rcPath := filepath.Join(sdkDir, rcFilename)
   if _, err := os.Stat(rcPath); err != nil {
-    return fmt.Errorf(".bazelifyrc not found: %v\nMake sure this is the right SDK path, or create an empty .bazelifyrc file at the root of the nrf52 SDK", err)
+    if !required && os.IsNotExist(err) {
+      return &bazelifyrc.Configuration{}, nil
+    }
+    return nil, fmt.Errorf(".bazelifyrc not found: %v\nMake sure this is the right SDK path, or create an empty .bazelifyrc file at the root of the nrf52 SDK", err)
   }
   rcData, err := os.ReadFile(rcPath)
   if err != nil {
-    return fmt.Errorf("could not read %s: %v", rcFilename, err)
+    return nil, fmt.Errorf("could not read %s: %v", rcFilename, err)
   }
   var rc bazelifyrc.Configuration
   if err := prototext.Unmarshal(rcData, &rc); err != nil {
-    return err
+    return nil, err
+  }
+  return &rc, nil
+}
+
+// hasSDKDir checks whether dir is already one of the SDK roots.
+func (conf *Config) hasSDKDir(dir string) bool {
+  for _, sdkDir := range conf.SDKDirs {
+    if sdkDir == dir {
+      return true
+    }
   }
+  return false
+}
 
-  conf.BazelifyRCProto = &rc
+// addSDK validates the SDK root and merges its .bazelifyrc into conf.
+// All paths in rc are relative to sdkDir.
+func (conf *Config) addSDK(sdkDir string, rc *bazelifyrc.Configuration) error {
+  if !filepath.IsAbs(sdkDir) {
+    return fmt.Errorf("sdk dir %q must be an absolute path", sdkDir)
+  }
+  if !strings.HasPrefix(sdkDir, conf.WorkspaceDir) {
+    return fmt.Errorf("sdk dir is not inside workspace_dir:\nsdk_dir=%s\nworkspace_dir=%s", sdkDir, conf.WorkspaceDir)
+  }
+  // Nested SDK roots would be walked twice.
+  for _, other := range conf.SDKDirs {
+    if strings.HasPrefix(sdkDir+string(filepath.Separator), other+string(filepath.Separator)) ||
+      strings.HasPrefix(other+string(filepath.Separator), sdkDir+string(filepath.Separator)) {
+      return fmt.Errorf("sdk dirs %q and %q overlap", other, sdkDir)
+    }
+  }
+  conf.SDKDirs = append(conf.SDKDirs, sdkDir)
 
   // Validate and turn proto data into a friendlier format.
-  sdkFromWorkspace, err := filepath.Rel(conf.WorkspaceDir, conf.SDKDir)
-  if err != nil {
-    return fmt.Errorf("filepath.Rel: %v", err)
+  // Remaps always live in the primary SDK.
+  if sdkDir == conf.SDKDir {
+    sdkFromWorkspace, err := filepath.Rel(conf.WorkspaceDir, conf.SDKDir)
+    if err != nil {
+      return fmt.Errorf("filepath.Rel: %v", err)
+    }
+    remaps, err := remap.New(rc.GetRemaps(), sdkFromWorkspace)
+    if err != nil {
+      return fmt.Errorf("remap.New: %v", err)
+    }
+    dfu := rc.GetDfu()
+    if err := remaps.SetDFU(remap.DFU{
+      KeyFile: dfu.GetKeyFile(),
+      HWVersion: int(dfu.GetHwVersion()),
+      SDReq: dfu.GetSdReq(),
+      ApplicationVersion: int(dfu.GetApplicationVersion()),
+      Nrfutil: dfu.GetNrfutil(),
+    }); err != nil {
+      return fmt.Errorf("SetDFU: %v", err)
+    }
+    for _, list := range rc.GetStringListRemaps() {
+      if err := remaps.AddStringList(list.GetName(), list.GetDefault(), list.GetDefines()); err != nil {
+        return fmt.Errorf("string_list_remaps: %v", err)
+      }
+    }
+    for _, d := range rc.GetRemapDefaults() {
+      label, err := bazel.ParseLabel(d.GetLabel())
+      if err != nil {
+        return fmt.Errorf("remap_defaults %q: %v", d.GetHeader(), err)
+      }
+      if err := remaps.SetDefault(d.GetHeader(), label.String()); err != nil {
+        return fmt.Errorf("remap_defaults: %v", err)
+      }
+    }
+    if rc.GetRemapBackend() == bazelifyrc.RemapBackend_LABEL_FLAG {
+      if err := remaps.UseLabelFlags(); err != nil {
+        return fmt.Errorf("UseLabelFlags: %v", err)
+      }
+    }
+    if path := rc.GetRemapTemplate(); path != "" {
+      text, err := os.ReadFile(filepath.Join(sdkDir, path))
+      if err != nil {
+        return fmt.Errorf("remap_template: %v", err)
+      }
+      if err := remaps.SetTemplate(string(text)); err != nil {
+        return fmt.Errorf("remap_template %q: %v", path, err)
+      }
+    }
+    conf.Remaps = remaps
+    conf.DuplicateHeaders.ResolveIdentical = rc.GetDuplicateHeaders().GetResolveIdentical()
+    conf.DuplicateHeaders.IgnoreWhitespace = rc.GetDuplicateHeaders().GetIgnoreWhitespace()
+    conf.Layout = rc.GetLayout()
+    conf.IncludePaths = rc.GetIncludePaths()
+    conf.Defines = rc.GetDefines()
+    if err := validateVisibility(rc.GetDefaultVisibility()); err != nil {
+      return fmt.Errorf("default_visibility: %v", err)
+    }
+    conf.DefaultVisibility = rc.GetDefaultVisibility()
+    if !rc.GetTags().GetDisabled() {
+      conf.Tags = rc.GetTags().GetTags()
+      if len(conf.Tags) == 0 {
+        conf.Tags = []string{defaultTag}
+      }
+    }
+    conf.Merge = rc.GetMerge()
+    conf.StableLabels = rc.GetStableLabels()
+    packageGroups, err := newPackageGroups(rc.GetPackageGroups())
+    if err != nil {
+      return fmt.Errorf("package_groups: %v", err)
+    }
+    conf.PackageGroups = packageGroups
+    conf.SoftDevice = rc.GetSoftdevice()
+    conf.SDKConfig.Disabled = rc.GetSdkConfig().GetDisabled()
+    conf.SDKConfig.DisableAppConfig = rc.GetSdkConfig().GetDisableAppConfig()
+    conf.TextualHeaders = rc.GetTextualHeaders().GetHeaders()
+    if conf.Layout == bazelifyrc.Layout_NRF5_SDK && !rc.GetTextualHeaders().GetDisableBuiltin() {
+      conf.TextualHeaders = append([]string{builtinTextualHeaders}, conf.TextualHeaders...)
+    }
+    conf.LogBackend = LogBackend{
+      Disabled: rc.GetLogBackend().GetDisabled(),
+      Default: rc.GetLogBackend().GetDefaultBackend(),
+    }
+    conf.CMSIS.Disabled = rc.GetCmsis().GetDisabled()
+    conf.Granularity.Mode = rc.GetGranularity().GetMode()
+    conf.MergeMacroHeaders = rc.GetMergeMacroHeaders()
+    conf.AttachOrphanSources = rc.GetAttachOrphanSources()
+    conf.DisableAutoGroupNames = rc.GetDisableAutoGroupNames()
+    conf.NrfCcLibrary = NrfCcLibrary{
+      Enabled: rc.GetNrfCcLibrary().GetEnabled(),
+      Copts: rc.GetNrfCcLibrary().GetCopts(),
+      Defines: rc.GetNrfCcLibrary().GetDefines(),
+    }
+    if makefile := rc.GetNrfCcLibrary().GetDefinesFromMakefile(); makefile != "" {
+      path := filepath.Join(sdkDir, makefile)
+      defines, err := makefileDefines(path)
+      if err != nil {
+        return fmt.Errorf("nrf_cc_library defines_from_makefile: %v", err)
+      }
+      conf.NrfCcLibrary.Defines = appendMissing(conf.NrfCcLibrary.Defines, defines...)
+    }
+    definePruning, err := conf.newDefinePruning(sdkDir, rc.GetDefinePruning())
+    if err != nil {
+      return fmt.Errorf("define_pruning: %v", err)
+    }
+    conf.DefinePruning = definePruning
+    boards, err := newBoards(rc.GetBoards())
+    if err != nil {
+      return fmt.Errorf("boards: %v", err)
+    }
+    conf.Boards = boards
+    conf.UsesChips = conf.UsesChips || len(rc.GetBoards()) > 0
+    conf.Examples.Enabled = rc.GetExamples().GetEnabled()
+    conf.Examples.Dirs = makeAbs(sdkDir, rc.GetExamples().GetDirs())
+    if len(conf.Examples.Dirs) == 0 {
+      conf.Examples.Dirs = []string{filepath.Join(sdkDir, defaultExamplesDir)}
+    }
+    thirdParty, err := newThirdParty(sdkDir, rc.GetThirdParty())
+    if err != nil {
+      return fmt.Errorf("third_party: %v", err)
+    }
+    conf.ThirdParty = thirdParty
+    conf.SBOM = rc.GetSbom()
+    conf.ImplementationDeps = rc.GetImplementationDeps()
+    conf.TransitiveReduction = rc.GetTransitiveReduction()
+    if conf.TransitiveReduction && conf.ImplementationDeps {
+      // A dep that is only in another dep's implementation_deps doesn't
+      // reach the dependent, so it can't be left out.
+      return fmt.Errorf("transitive_reduction can't be combined with implementation_deps")
+    }
+    conf.IDE = IDE{
+      Clangd: rc.GetIde().GetClangd(),
+      VSCode: rc.GetIde().GetVscode(),
+    }
+    conf.Toolchain = Toolchain{
+      Enabled: rc.GetToolchain().GetEnabled(),
+      GCCDir: rc.GetToolchain().GetGccDir(),
+      Prefix: rc.GetToolchain().GetPrefix(),
+      BuiltinIncludeDirs: rc.GetToolchain().GetBuiltinIncludeDirs(),
+      Copts: rc.GetToolchain().GetCopts(),
+      Linkopts: rc.GetToolchain().GetLinkopts(),
+    }
+    if defaultLabel := rc.GetSdkConfig().GetDefaultLabel(); defaultLabel != "" {
+      label, err := bazel.ParseLabel(defaultLabel)
+      if err != nil {
+        return fmt.Errorf("sdk_config default_label %q: %v", defaultLabel, err)
+      }
+      conf.SDKConfig.Default = label
+    }
   }
-  remaps, err := remap.New(rc.GetRemaps(), sdkFromWorkspace)
-  if err != nil {
-    return fmt.Errorf("remap.New: %v", err)
+  conf.PreferredDirs = append(conf.PreferredDirs, makeAbs(sdkDir, rc.GetPreferredDirs())...)
+  conf.DuplicateHeaders.PreferredDirs = append(conf.DuplicateHeaders.PreferredDirs, makeAbs(sdkDir, rc.GetDuplicateHeaders().GetPreferredDirs())...)
+
+  conf.Excludes = append(conf.Excludes, makeAbs(sdkDir, rc.GetExcludes())...)
+  if err := conf.excludeFreeRTOSPorts(sdkDir, rc.GetFreertos().GetPorts()); err != nil {
+    return fmt.Errorf("freertos: %v", err)
   }
-  conf.Remaps = remaps
+  conf.Granularity.PerDirectory = append(conf.Granularity.PerDirectory, makeAbs(sdkDir, rc.GetGranularity().GetPerDirectory())...)
+  conf.Granularity.PerHeader = append(conf.Granularity.PerHeader, makeAbs(sdkDir, rc.GetGranularity().GetPerHeader())...)
 
-  conf.Excludes = makeAbs(conf.SDKDir, rc.GetExcludes())
+  for _, dir := range makeAbs(sdkDir, rc.GetIncludeDirs()) {
+    if !glob.HasMeta(dir) {
+      conf.IncludeDirs = append(conf.IncludeDirs, dir)
+      continue
+    }
+    dirs, err := conf.globDirs(dir)
+    if err != nil {
+      return fmt.Errorf("include_dirs %q: %v", dir, err)
+    }
+    if len(dirs) == 0 {
+      return fmt.Errorf("include_dirs %q: no directories match", dir)
+    }
+    conf.IncludeDirs = appendMissing(conf.IncludeDirs, dirs...)
+  }
+  for _, p := range rc.GetIncludeDirPriorities() {
+    conf.IncludeDirPriorities = append(conf.IncludeDirPriorities, &IncludeDirPriority{
+      Pattern: filepath.Join(sdkDir, p.GetDir()),
+      Priority: p.GetPriority(),
+    })
+  }
 
-  conf.IncludeDirs = makeAbs(conf.SDKDir, rc.GetIncludeDirs())
+  if conf.Layout == bazelifyrc.Layout_NCS {
+    if err := conf.addNCSDefaults(sdkDir, rc); err != nil {
+      return fmt.Errorf("%s: %v", sdkDir, err)
+    }
+  }
 
   for _, ignore := range rc.GetIgnoreHeaders() {
+    if glob.HasMeta(ignore) {
+      conf.IgnoreHeaderPatterns = append(conf.IgnoreHeaderPatterns, ignore)
+      continue
+    }
     conf.IgnoreHeaders[ignore] = true
   }
+  for _, ext := range rc.GetFilegroupExtensions() {
+    if !filegroupExtensionMatcher.MatchString(ext) {
+      return fmt.Errorf("filegroup_extensions %q: must be a . followed by letters, digits and underscores", ext)
+    }
+    if isCCFileExtension(ext) {
+      return fmt.Errorf("filegroup_extensions %q: C sources and headers are already in libraries", ext)
+    }
+    conf.FilegroupExtensions[ext] = true
+  }
+  for _, dir := range rc.GetSplitHeaderDirs() {
+    conf.SplitHeaderDirs[dir] = true
+  }
+  if rc.GetPreferOwnSdk() {
+    conf.PreferOwnSDK[sdkDir] = true
+  }
 
   for _, override := range rc.GetIncludeOverrides() {
     label, err := bazel.ParseLabel(override.GetLabel())
@@ -93,18 +400,142 @@ func readBazelifyRC(conf *Config) error {
 		}
   }
 
+  for _, m := range rc.GetMacroIncludes() {
+    if err := conf.addMacroInclude(m); err != nil {
+      return fmt.Errorf("macro_includes %q: %v", m.GetMacro(), err)
+    }
+  }
+
+  for _, override := range rc.GetSelectOverrides() {
+    selectOverride, err := conf.newSelectOverride(override)
+    if err != nil {
+      return fmt.Errorf("select_overrides %q: %v", override.GetInclude(), err)
+    }
+    conf.SelectOverrides[override.GetInclude()] = selectOverride
+  }
+
+  for _, c := range rc.GetConditionalSources() {
+    conditional, err := conf.newConditionalSources(sdkDir, c)
+    if err != nil {
+      return fmt.Errorf("conditional_sources %q: %v", c.GetConfigSetting(), err)
+    }
+    conf.ConditionalSources = append(conf.ConditionalSources, conditional)
+  }
+
+  for _, p := range rc.GetIncludePrefixes() {
+    prefix, err := newIncludePrefix(p)
+    if err != nil {
+      return fmt.Errorf("include_prefixes %q: %v", p.GetLibrary(), err)
+    }
+    if conf.IncludePrefixes[prefix.Library.String()] != nil {
+      return fmt.Errorf("include_prefixes %q: library has more than one entry", p.GetLibrary())
+    }
+    conf.IncludePrefixes[prefix.Library.String()] = prefix
+  }
+
+  for _, t := range rc.GetTargetCopts() {
+    targets, err := parseTargetPatterns(t.GetTargets())
+    if err != nil {
+      return fmt.Errorf("target_copts %q: %v", t.GetTargets(), err)
+    }
+    conf.TargetCopts = append(conf.TargetCopts, &TargetCopts{
+      Targets: targets,
+      Copts: t.GetCopts(),
+    })
+  }
+
+  if len(rc.GetAlwayslink()) > 0 {
+    targets, err := parseTargetPatterns(rc.GetAlwayslink())
+    if err != nil {
+      return fmt.Errorf("alwayslink: %v", err)
+    }
+    conf.Alwayslink = append(conf.Alwayslink, targets...)
+  }
+
+  for _, t := range rc.GetTargetVisibility() {
+    targets, err := parseTargetPatterns(t.GetTargets())
+    if err != nil {
+      return fmt.Errorf("target_visibility %q: %v", t.GetTargets(), err)
+    }
+    if len(t.GetVisibility()) == 0 {
+      return fmt.Errorf("target_visibility %q: no visibility", t.GetTargets())
+    }
+    if err := validateVisibility(t.GetVisibility()); err != nil {
+      return fmt.Errorf("target_visibility %q: %v", t.GetTargets(), err)
+    }
+    conf.TargetVisibility = append(conf.TargetVisibility, &TargetVisibility{
+      Targets: targets,
+      Visibility: t.GetVisibility(),
+    })
+  }
+
+  if len(rc.GetTestonly()) > 0 {
+    targets, err := parseTargetPatterns(rc.GetTestonly())
+    if err != nil {
+      return fmt.Errorf("testonly: %v", err)
+    }
+    conf.Testonly = append(conf.Testonly, targets...)
+  }
+
+  for _, umbrella := range rc.GetUmbrellas() {
+    label, err := bazel.ParseLabel(umbrella)
+    if err != nil {
+      return fmt.Errorf("umbrellas: %v", err)
+    }
+    conf.Umbrellas = append(conf.Umbrellas, label)
+  }
+
+  for _, d := range rc.GetDeprecations() {
+    targets, err := parseTargetPatterns(d.GetTargets())
+    if err != nil {
+      return fmt.Errorf("deprecations %q: %v", d.GetTargets(), err)
+    }
+    if d.GetMessage() == "" {
+      return fmt.Errorf("deprecations %q: no message", d.GetTargets())
+    }
+    conf.Deprecations = append(conf.Deprecations, &Deprecation{
+      Targets: targets,
+      Message: d.GetMessage(),
+    })
+  }
+
+  for _, t := range rc.GetTargetDefines() {
+    targets, err := parseTargetPatterns(t.GetTargets())
+    if err != nil {
+      return fmt.Errorf("target_defines %q: %v", t.GetTargets(), err)
+    }
+    if len(t.GetDefines()) == 0 && len(t.GetLocalDefines()) == 0 {
+      return fmt.Errorf("target_defines %q: no defines or local_defines", t.GetTargets())
+    }
+    conf.TargetDefines = append(conf.TargetDefines, &TargetDefines{
+      Targets: targets,
+      Defines: t.GetDefines(),
+      LocalDefines: t.GetLocalDefines(),
+    })
+  }
+
   for _, sourceSet := range rc.GetSourceSets() {
-    sourceSetDir := filepath.Join(conf.SDKDir, sourceSet.GetDir())
+    sourceSetDir := filepath.Join(sdkDir, sourceSet.GetDir())
     label, err := bazel.NewLabel(sourceSetDir, sourceSet.GetName(), conf.WorkspaceDir)
     if err != nil {
       return fmt.Errorf("bazel.NewLabel(%v, %v): %v", sourceSetDir, sourceSet.GetName(), err)
     }
 
-    absSrcs := makeAbs(filepath.Join(conf.SDKDir, sourceSet.GetDir()), sourceSet.GetSrcs())
-    absHdrs := makeAbs(filepath.Join(conf.SDKDir, sourceSet.GetDir()), sourceSet.GetHdrs())
+    absSrcs := makeAbs(sourceSetDir, sourceSet.GetSrcs())
+    absHdrs := makeAbs(sourceSetDir, sourceSet.GetHdrs())
+    if sourceSet.GetAllFiles() {
+      dirSrcs, dirHdrs, err := conf.sourceSetDirFiles(sourceSetDir, sourceSet.GetExcludes())
+      if err != nil {
+        return fmt.Errorf("source set %q: %v", label, err)
+      }
+      absSrcs = appendMissing(absSrcs, dirSrcs...)
+      absHdrs = appendMissing(absHdrs, dirHdrs...)
+    } else if len(sourceSet.GetExcludes()) > 0 {
+      return fmt.Errorf("source set %q: excludes are only used with all_files", label)
+    }
 
     // Add files to index by file name, and make sure the files exist.
-    files := make([]string, 0, len(sourceSet.GetSrcs()) + len(sourceSet.GetHdrs()))
+    files := make([]string, 0, len(absSrcs) + len(absHdrs))
     files = append(files, absSrcs...)
     files = append(files, absHdrs...)
     for _, file := range files {
@@ -143,19 +574,154 @@ func readBazelifyRC(conf *Config) error {
   return nil
 }
 
+// conditionLabel turns a chip or board name into its config_setting in
+// chips/BUILD, and validates config_setting labels.
+func (conf *Config) conditionLabel(condition string) (string, error) {
+  if !strings.ContainsAny(condition, ":/") {
+    conf.UsesChips = true
+    label, err := chipsLabel(conf, "is_"+condition)
+    if err != nil {
+      return "", err
+    }
+    return label.String(), nil
+  }
+  if _, err := bazel.ParseLabel(condition); err != nil {
+    return "", fmt.Errorf("config_setting %q: %v", condition, err)
+  }
+  return condition, nil
+}
+
+// SelectOverride resolves an include to a label per config_setting.
+type SelectOverride struct {
+  Cases map[string]*bazel.Label // config_setting label -> label
+  Default *bazel.Label // nil if nothing is depended on by default
+}
+
+// newSelectOverride validates a select_overrides entry.
+// Chip and board names are turned into the config_settings in chips/BUILD.
+func (conf *Config) newSelectOverride(override *bazelifyrc.SelectOverride) (*SelectOverride, error) {
+  if len(override.GetCases()) == 0 {
+    return nil, fmt.Errorf("no cases")
+  }
+  out := &SelectOverride{Cases: make(map[string]*bazel.Label)}
+  for _, c := range override.GetCases() {
+    condition, err := conf.conditionLabel(c.GetConfigSetting())
+    if err != nil {
+      return nil, err
+    }
+    label, err := bazel.ParseLabel(c.GetLabel())
+    if err != nil {
+      return nil, fmt.Errorf("label %q: %v", c.GetLabel(), err)
+    }
+    out.Cases[condition] = label
+  }
+  if override.GetDefaultLabel() != "" {
+    label, err := bazel.ParseLabel(override.GetDefaultLabel())
+    if err != nil {
+      return nil, fmt.Errorf("default_label %q: %v", override.GetDefaultLabel(), err)
+    }
+    out.Default = label
+  }
+  return out, nil
+}
+
 // BazelifyRC contains validated data from the .bazelifyrc file.
 type Config struct {
   SDKDir, WorkspaceDir string
-  Verbose bool
-  BazelifyRCProto *bazelifyrc.Configuration
+  SDKDirs []string // all SDK roots, starting with the primary SDKDir
+
+  Verbosity Verbosity
+  BazelifyRCProto *bazelifyrc.Configuration // the primary SDK's .bazelifyrc
   Remaps *remap.Remaps
   Excludes []string // file paths to exclude, converted to absolute paths
-  IncludeDirs []string // all paths converted to absolute paths
+  IncludeDirs []string // all paths converted to absolute paths, in search order
+  IncludeDirPriorities []*IncludeDirPriority // in config order
+  IncludeDirPriority map[string]int32 // include dir -> its priority, missing for 0
   IgnoreHeaders map[string]bool // header file name -> should ignore
+  IgnoreHeaderPatterns []string // ignore_headers with wildcards, like "sys/**"
+  FilegroupExtensions map[string]bool // extension, like ".ld" -> gets filegroups
   IncludeOverrides map[string]*IncludeOverride // file name -> override info
+  MacroIncludes map[string]string // macro -> the include it expands to
+  SelectOverrides map[string]*SelectOverride // file name -> select() of labels
+  ConditionalSources []*ConditionalSources
+  IncludePrefixes map[string]*IncludePrefix // library label.String() -> prefixes
+  TargetCopts []*TargetCopts
+  Defines []string // defines of every generated library
+  TargetDefines []*TargetDefines
+  Alwayslink []*TargetPattern // libraries that are linked with alwayslink
+  Testonly []*TargetPattern // libraries that are testonly
+  Umbrellas []*bazel.Label // libraries that depend on every library below them
+  Deprecations []*Deprecation
+  Tags []string // of every generated rule, or nil if they aren't tagged
+  Merge bool // keeps what # keep comments in existing BUILD files protect
+  Kept map[string]*buildfile.Kept // dir relative to WorkspaceDir -> kept from its BUILD file
+  StableLabels bool // generates aliases for labels whose headers moved
+  DefaultVisibility []string // of every generated package, or nil for public
+  TargetVisibility []*TargetVisibility
+  PackageGroups []*PackageGroup // in the primary SDK root
   SourceSetsByFile map[string]*bazel.Label // file path -> label of rule containing file
   SourceSets map[string]*CCFiles // label.String() -> files in source set
   NamedGroups map[string]map[string]string // first header -> last header -> name
+  Roots []string // targets that --prune_unreachable keeps, with their deps
+  SDKVersion string // version of the built-in preset in use, if any
+  DuplicateHeaders DuplicateHeaders
+  PreferredDirs []string // absolute paths, in order of preference
+  Layout bazelifyrc.Layout // the primary SDK's layout
+  IncludePaths bazelifyrc.IncludePaths
+  SplitHeaderDirs map[string]bool // header dir name -> sources are in a sibling src dir
+  PreferOwnSDK map[string]bool // SDK root -> ambiguous includes prefer candidates in it
+  SoftDevice string // default of the softdevice label_flag, or "" for the highest numbered
+  SDKConfig SDKConfig
+  LogBackend LogBackend
+  CMSIS CMSIS
+  Granularity Granularity
+  MergeMacroHeaders bool // merges macro header libraries into their only dependent
+  AttachOrphanSources bool // adds sources in no library to a library nearby
+  DisableAutoGroupNames bool // groups only get names from named_groups
+  TextualHeaders []string // file name patterns of headers folded into their includers
+  NrfCcLibrary NrfCcLibrary
+  DefinePruning DefinePruning
+  Toolchain Toolchain
+  Boards []*Board // known and rc boards, sorted by name
+  UsesChips bool // the rc adds boards or names chips or boards as conditions
+  Examples Examples
+  ThirdParty ThirdParty
+  SBOM bool // writes .bazelify-out/sbom.spdx.json
+  IDE IDE
+  ImplementationDeps bool // emit deps only srcs include as implementation_deps
+  TransitiveReduction bool // leaves out deps that other deps already bring in
+}
+
+// SDKConfig configures the sdk_config label_flag.
+type SDKConfig struct {
+  Disabled bool
+  Default *bazel.Label // nil for an empty library
+  DisableAppConfig bool
+}
+
+// LogBackend configures the log_backend label_flag.
+type LogBackend struct {
+  Disabled bool
+  Default string // like "uart", or "" for rtt
+}
+
+// CMSIS configures the cmsis libraries of the CMSIS core headers.
+type CMSIS struct {
+  Disabled bool
+}
+
+// Granularity configures which dirs' headers are one library.
+type Granularity struct {
+  Mode bazelifyrc.Granularity // of dirs that no pattern matches
+  PerDirectory []string // absolute dir patterns
+  PerHeader []string // absolute dir patterns, which take precedence
+}
+
+// DuplicateHeaders configures how includes with identical candidates are resolved.
+type DuplicateHeaders struct {
+  ResolveIdentical bool
+  IgnoreWhitespace bool
+  PreferredDirs []string // absolute paths, in order of preference
 }
 
 // Makes a copy of relPaths where all paths will be absolute, prefixed with sdkDir. 
@@ -167,6 +733,190 @@ func makeAbs(dir string, relPaths []string) []string {
   return out
 }
 
+// sourceSetDirFiles returns the .c and .h files in dir and the dirs below it,
+// skipping the ones that are excluded or match excludes, which are relative
+// to dir.
+func (conf *Config) sourceSetDirFiles(dir string, excludes []string) (srcs, hdrs []string, err error) {
+  if info, err := os.Stat(dir); err != nil {
+    return nil, nil, err
+  } else if !info.IsDir() {
+    return nil, nil, fmt.Errorf("%s is not a directory", dir)
+  }
+  for _, exclude := range excludes {
+    if err := glob.Validate(exclude); err != nil {
+      return nil, nil, fmt.Errorf("bad exclude %q: %v", exclude, err)
+    }
+  }
+  absExcludes := makeAbs(dir, excludes)
+  err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
+    excluded, err := conf.excluded(path)
+    if err != nil {
+      return err
+    }
+    for _, exclude := range absExcludes {
+      if excluded {
+        break
+      }
+      // Validated above.
+      excluded, _ = glob.Match(exclude, path)
+    }
+    switch {
+    case excluded && info.IsDir():
+      return filepath.SkipDir
+    case excluded || info.IsDir():
+      return nil
+    case filepath.Ext(path) == ".c":
+      srcs = append(srcs, path)
+    case filepath.Ext(path) == ".h":
+      hdrs = append(hdrs, path)
+    }
+    return nil
+  })
+  if err != nil {
+    return nil, nil, err
+  }
+  // Most likely the wrong dir.
+  if len(srcs) == 0 && len(hdrs) == 0 {
+    return nil, nil, fmt.Errorf("all_files: no .c or .h files in %s", dir)
+  }
+  return srcs, hdrs, nil
+}
+
+// IncludeDirPriority is an include_dir_priorities entry.
+type IncludeDirPriority struct {
+  Pattern string // absolute path or pattern
+  Priority int32
+}
+
+// sortIncludeDirs sorts the include dirs by priority, highest first, keeping
+// their config order within a priority.
+func (conf *Config) sortIncludeDirs() error {
+  conf.IncludeDirPriority = make(map[string]int32)
+  for _, p := range conf.IncludeDirPriorities {
+    if err := glob.Validate(p.Pattern); err != nil {
+      return fmt.Errorf("include_dir_priorities %q: %v", p.Pattern, err)
+    }
+    var matched bool
+    for _, dir := range conf.IncludeDirs {
+      if ok, _ := glob.Match(p.Pattern, dir); !ok {
+        continue
+      }
+      matched = true
+      if _, ok := conf.IncludeDirPriority[dir]; !ok {
+        conf.IncludeDirPriority[dir] = p.Priority
+      }
+    }
+    if !matched {
+      return fmt.Errorf("include_dir_priorities %q: no include_dirs match", p.Pattern)
+    }
+  }
+  sort.SliceStable(conf.IncludeDirs, func(i, j int) bool {
+    return conf.IncludeDirPriority[conf.IncludeDirs[i]] > conf.IncludeDirPriority[conf.IncludeDirs[j]]
+  })
+  return nil
+}
+
+// excluded reports whether path matches any of the excludes.
+func (conf *Config) excluded(path string) (bool, error) {
+  for _, exclude := range conf.Excludes {
+    matched, err := glob.Match(exclude, path)
+    if err != nil || matched {
+      return matched, err
+    }
+  }
+  return false, nil
+}
+
+// addMacroInclude makes includes of the macro resolve to its header, or to
+// its label. A label is added as an include override of the macro's name.
+func (conf *Config) addMacroInclude(m *bazelifyrc.MacroInclude) error {
+  if !macroMatcher.MatchString(m.GetMacro()) {
+    return fmt.Errorf("not a macro name")
+  }
+  if _, ok := conf.MacroIncludes[m.GetMacro()]; ok {
+    return fmt.Errorf("duplicate macro")
+  }
+  if (m.GetHeader() == "") == (m.GetLabel() == "") {
+    return fmt.Errorf("exactly one of header and label must be set")
+  }
+  if m.GetHeader() != "" {
+    if len(m.GetIncludeDirs()) > 0 {
+      return fmt.Errorf("include_dirs are only used with label")
+    }
+    conf.MacroIncludes[m.GetMacro()] = m.GetHeader()
+    return nil
+  }
+  label, err := bazel.ParseLabel(m.GetLabel())
+  if err != nil {
+    return err
+  }
+  conf.MacroIncludes[m.GetMacro()] = m.GetMacro()
+  conf.IncludeOverrides[m.GetMacro()] = &IncludeOverride{
+    Label: label,
+    IncludeDirs: m.GetIncludeDirs(),
+  }
+  return nil
+}
+
+// ignoreHeader returns the ignore_headers entries that match include, if any.
+func (conf *Config) ignoreHeader(include string) []string {
+  var out []string
+  if conf.IgnoreHeaders[include] {
+    out = append(out, include)
+  }
+  for _, ignore := range conf.IgnoreHeaderPatterns {
+    // A malformed ignore_headers pattern never ignores an include here;
+    // Validate reports it.
+    if matched, _ := glob.Match(ignore, include); matched {
+      out = append(out, ignore)
+    }
+  }
+  return out
+}
+
+// globDirs returns the directories that match pattern, skipping excluded ones.
+func (conf *Config) globDirs(pattern string) ([]string, error) {
+  var skipErr error
+  matches, err := glob.Glob(pattern, func(path string) bool {
+    excluded, err := conf.excluded(path)
+    if err != nil && skipErr == nil {
+      skipErr = err
+    }
+    return excluded
+  })
+  if err != nil {
+    return nil, err
+  }
+  if skipErr != nil {
+    return nil, skipErr
+  }
+  var dirs []string
+  for _, match := range matches {
+    if info, err := os.Stat(match); err == nil && info.IsDir() {
+      dirs = append(dirs, match)
+    }
+  }
+  return dirs, nil
+}
+
+// appendMissing appends the values that aren't in list yet.
+func appendMissing(list []string, values ...string) []string {
+  have := make(map[string]bool)
+  for _, v := range list {
+    have[v] = true
+  }
+  for _, v := range values {
+    if !have[v] {
+      have[v] = true
+      list = append(list, v)
+    }
+  }
+  return list
+}
+
 // makeLabels turns the absolute paths into labels.
 func makeLabels(workspaceDir string, absPaths []string) ([]*bazel.Label, error) {
   var out []*bazel.Label
@@ -183,4 +933,61 @@ func makeLabels(workspaceDir string, absPaths []string) ([]*bazel.Label, error)
     out = append(out, label)
   }
   return out, nil
-}
\ No newline at end of file
+}
+
+// Validate checks the parts of the configuration that ReadConfig doesn't need
+// to look at, like whether excludes are valid patterns and whether include_dirs
+// exist. All problems are reported together.
+func (conf *Config) Validate() error {
+  var problems []string
+  for _, exclude := range conf.Excludes {
+    if err := glob.Validate(exclude); err != nil {
+      problems = append(problems, fmt.Sprintf("excludes %q: %v", exclude, err))
+    }
+  }
+  for _, ignore := range conf.IgnoreHeaderPatterns {
+    if err := glob.Validate(ignore); err != nil {
+      problems = append(problems, fmt.Sprintf("ignore_headers %q: %v", ignore, err))
+    }
+  }
+  for _, pattern := range append(append([]string{}, conf.Granularity.PerDirectory...), conf.Granularity.PerHeader...) {
+    if err := glob.Validate(pattern); err != nil {
+      problems = append(problems, fmt.Sprintf("granularity %q: %v", pattern, err))
+    }
+  }
+  for _, pattern := range conf.TextualHeaders {
+    if err := glob.Validate(pattern); err != nil {
+      problems = append(problems, fmt.Sprintf("textual_headers %q: %v", pattern, err))
+    }
+  }
+  for _, dir := range conf.IncludeDirs {
+    if info, err := os.Stat(dir); err != nil {
+      problems = append(problems, fmt.Sprintf("include_dirs %q: %v", dir, err))
+    } else if !info.IsDir() {
+      problems = append(problems, fmt.Sprintf("include_dirs %q is not a directory", dir))
+    }
+  }
+  for include, override := range conf.IncludeOverrides {
+    if override.Label.Repo() != "" {
+      // The dirs are in the external repository, which may not be fetched.
+      continue
+    }
+    for _, dir := range override.IncludeDirs {
+      if _, err := os.Stat(filepath.Join(conf.WorkspaceDir, dir)); err != nil {
+        problems = append(problems, fmt.Sprintf("include_overrides %q include_dirs %q: %v", include, dir, err))
+      }
+    }
+  }
+  for first, byLast := range conf.NamedGroups {
+    for last, name := range byLast {
+      if name == "" {
+        problems = append(problems, fmt.Sprintf("named_groups %q..%q has an empty name", first, last))
+      }
+    }
+  }
+  if len(problems) == 0 {
+    return nil
+  }
+  sort.Strings(problems)
+  return fmt.Errorf("found %d problems in %s:\n  %s", len(problems), rcFilename, strings.Join(problems, "\n  "))
+}
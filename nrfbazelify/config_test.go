@@ -1,14 +1,542 @@
 package nrfbazelify
 
 import (
+	"flag"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestReadConfig_MissingBazelifyrc(t *testing.T) {
   workspaceDir := mustMakeAbs(t, testDataDir)
   sdkDir := filepath.Join(workspaceDir, "config_missing_bazelifyrc")
-  if _, err := ReadConfig(sdkDir, workspaceDir, true); err == nil {
+  if _, err := ReadConfig([]string{sdkDir}, workspaceDir, VerbosityPhases); err == nil {
     t.Errorf("ReadConfig: want an error")
   }
 }
+
+func TestReadConfig_RemapDefaultsUnknownHeader(t *testing.T) {
+  workspaceDir := mustMakeAbs(t, testDataDir)
+  sdkDir := filepath.Join(workspaceDir, "remap_defaults_unknown_header")
+  _, err := ReadConfig([]string{sdkDir}, workspaceDir, VerbosityPhases)
+  if err == nil || !strings.Contains(err.Error(), `"b.h" isn't remapped`) {
+    t.Errorf("ReadConfig: got %v, want an error about b.h", err)
+  }
+}
+
+func TestReadConfig_IncludeDirsGlobNoMatch(t *testing.T) {
+  workspaceDir := mustMakeAbs(t, testDataDir)
+  sdkDir := filepath.Join(workspaceDir, "include_dirs_glob_no_match")
+  _, err := ReadConfig([]string{sdkDir}, workspaceDir, VerbosityPhases)
+  if err == nil || !strings.Contains(err.Error(), "no directories match") {
+    t.Errorf("ReadConfig: got %v, want an error about include_dirs", err)
+  }
+}
+
+func TestSourceSetDirFiles(t *testing.T) {
+  workspaceDir := mustMakeAbs(t, testDataDir)
+  dir := filepath.Join(workspaceDir, "source_set_dir/drivers/uart")
+  conf := &Config{Excludes: []string{filepath.Join(dir, "include")}}
+  srcs, hdrs, err := conf.sourceSetDirFiles(dir, []string{"legacy", "src/*.c"})
+  if err != nil {
+    t.Fatalf("sourceSetDirFiles: %v", err)
+  }
+  if diff := cmp.Diff([]string{filepath.Join(dir, "nrfx_uart.c")}, srcs); diff != "" {
+    t.Errorf("srcs (-want +got):\n%s", diff)
+  }
+  if diff := cmp.Diff([]string{filepath.Join(dir, "nrfx_uart.h")}, hdrs); diff != "" {
+    t.Errorf("hdrs (-want +got):\n%s", diff)
+  }
+  if _, _, err := conf.sourceSetDirFiles(dir, []string{"**"}); err == nil || !strings.Contains(err.Error(), "no .c or .h files") {
+    t.Errorf("sourceSetDirFiles: got %v, want an error about no files", err)
+  }
+}
+
+func TestNewThirdParty_LicenseTextOutsideComponent(t *testing.T) {
+  sdkDir := filepath.Join(mustMakeAbs(t, testDataDir), "third_party")
+  for _, text := range []string{"../LICENSE", "../../app.h", "/etc/passwd"} {
+    rc := &bazelifyrc.ThirdParty{
+      Components: []*bazelifyrc.ThirdPartyComponent{{Dir: "external/fatfs", LicenseText: text}},
+    }
+    if _, err := newThirdParty(sdkDir, rc); err == nil || !strings.Contains(err.Error(), "outside the component") {
+      t.Errorf("newThirdParty(license_text %q): got %v, want an error about the license_text", text, err)
+    }
+  }
+  // Components from before the check still end, at the root.
+  c := &ThirdPartyComponent{Dir: filepath.Join(sdkDir, "external/fatfs"), LicenseText: "../../../../../../../../LICENSE"}
+  conf := &Config{WorkspaceDir: mustMakeAbs(t, testDataDir)}
+  if _, err := licenseTextLabel(conf, nil, c, "third_party/external/fatfs"); err != nil {
+    t.Errorf("licenseTextLabel: %v", err)
+  }
+}
+
+func TestSortIncludeDirs(t *testing.T) {
+  conf := &Config{
+    IncludeDirs: []string{"/sdk/a", "/sdk/b", "/sdk/c", "/sdk/d"},
+    IncludeDirPriorities: []*IncludeDirPriority{
+      {Pattern: "/sdk/{c,d}", Priority: 1},
+      // c already has a priority.
+      {Pattern: "/sdk/c", Priority: 2},
+      {Pattern: "/sdk/b", Priority: -1},
+    },
+  }
+  if err := conf.sortIncludeDirs(); err != nil {
+    t.Fatalf("sortIncludeDirs: %v", err)
+  }
+  // Ties keep their config order.
+  if diff := cmp.Diff([]string{"/sdk/c", "/sdk/d", "/sdk/a", "/sdk/b"}, conf.IncludeDirs); diff != "" {
+    t.Errorf("IncludeDirs (-want +got):\n%s", diff)
+  }
+  conf.IncludeDirPriorities = []*IncludeDirPriority{{Pattern: "/sdk/e", Priority: 1}}
+  if err := conf.sortIncludeDirs(); err == nil || !strings.Contains(err.Error(), "no include_dirs match") {
+    t.Errorf("sortIncludeDirs: got %v, want an error about /sdk/e", err)
+  }
+}
+
+func TestReadConfig_TransitiveReductionWithImplementationDeps(t *testing.T) {
+  workspaceDir := mustMakeAbs(t, testDataDir)
+  sdkDir := filepath.Join(workspaceDir, "transitive_reduction_implementation_deps")
+  _, err := ReadConfig([]string{sdkDir}, workspaceDir, VerbosityPhases)
+  if err == nil || !strings.Contains(err.Error(), "implementation_deps") {
+    t.Errorf("ReadConfig: got %v, want an error about implementation_deps", err)
+  }
+}
+
+func TestValidateConfig_Invalid(t *testing.T) {
+  workspaceDir := mustMakeAbs(t, testDataDir)
+  sdkDir := filepath.Join(workspaceDir, "config_invalid")
+  err := ValidateConfig(workspaceDir, []string{sdkDir})
+  if err == nil {
+    t.Fatalf("ValidateConfig: want an error")
+  }
+  for _, want := range []string{"excludes", "include_dirs"} {
+    if !strings.Contains(err.Error(), want) {
+      t.Errorf("ValidateConfig: got %v, want it to mention %q", err, want)
+    }
+  }
+}
+
+func TestValidateConfig_Nominal(t *testing.T) {
+  workspaceDir := mustMakeAbs(t, testDataDir)
+  sdkDir := filepath.Join(workspaceDir, "bazelifyrc_include_dirs")
+  if err := ValidateConfig(workspaceDir, []string{sdkDir}); err != nil {
+    t.Errorf("ValidateConfig: %v", err)
+  }
+}
+
+func TestReadConfig_SDKVersionPreset(t *testing.T) {
+  workspaceDir := mustMakeAbs(t, testDataDir)
+  sdkDir := filepath.Join(workspaceDir, "sdk_version")
+  tests := map[string]struct{
+    sdkVersion string
+    wantVersion string
+    wantErr bool
+  }{
+    "detected": {
+      wantVersion: "17.1",
+    },
+    "explicit": {
+      sdkVersion: "15.3",
+      wantVersion: "15.3",
+    },
+    "disabled": {
+      sdkVersion: "none",
+    },
+    "unknown": {
+      sdkVersion: "12.0",
+      wantErr: true,
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      flag.Set("sdk_version", test.sdkVersion)
+      t.Cleanup(func() { flag.Set("sdk_version", "") })
+      conf, err := ReadConfig([]string{sdkDir}, workspaceDir, VerbosityPhases)
+      if test.wantErr {
+        if err == nil {
+          t.Fatalf("ReadConfig: want an error")
+        }
+        return
+      }
+      if err != nil {
+        t.Fatalf("ReadConfig: %v", err)
+      }
+      if conf.SDKVersion != test.wantVersion {
+        t.Errorf("SDKVersion: got %q, want %q", conf.SDKVersion, test.wantVersion)
+      }
+      // The SDK's own .bazelifyrc is always used.
+      if !conf.IgnoreHeaders["custom.h"] {
+        t.Errorf("IgnoreHeaders is missing custom.h from .bazelifyrc")
+      }
+      if got, want := conf.IgnoreHeaders["stdint.h"], test.wantVersion != ""; got != want {
+        t.Errorf("IgnoreHeaders[stdint.h] from preset: got %v, want %v", got, want)
+      }
+    })
+  }
+}
+
+func TestPresetVersions(t *testing.T) {
+  want := []string{"15.3", "16.0", "17.1"}
+  if diff := cmp.Diff(want, PresetVersions()); diff != "" {
+    t.Errorf("PresetVersions (-want +got):\n%s", diff)
+  }
+  for _, version := range want {
+    flag.Set("sdk_version", version)
+    if _, _, err := sdkPreset(""); err != nil {
+      t.Errorf("sdkPreset for %s: %v", version, err)
+    }
+  }
+  flag.Set("sdk_version", "")
+}
+
+func TestWithDriverModePreset(t *testing.T) {
+  tests := map[bazelifyrc.DriverMode]struct{
+    wantExcludes, wantPreferredDirs []string
+  }{
+    bazelifyrc.DriverMode_DRIVER_MODE_UNSPECIFIED: {
+      wantExcludes: []string{"own"},
+      wantPreferredDirs: []string{"own"},
+    },
+    // The rc's preferred_dirs are preferred over the preset's.
+    bazelifyrc.DriverMode_LEGACY: {
+      wantExcludes: []string{"integration/nrfx/legacy", "own"},
+      wantPreferredDirs: []string{"own", "components/drivers_nrf"},
+    },
+    bazelifyrc.DriverMode_NRFX: {
+      wantExcludes: []string{"components/drivers_nrf", "modules/nrfx/templates", "own"},
+      wantPreferredDirs: []string{"own", "modules/nrfx", "integration/nrfx"},
+    },
+    bazelifyrc.DriverMode_INTEGRATION: {
+      wantExcludes: []string{"modules/nrfx/templates", "own"},
+      wantPreferredDirs: []string{"own", "integration/nrfx/legacy", "integration/nrfx"},
+    },
+  }
+  for mode, test := range tests {
+    t.Run(mode.String(), func(t *testing.T) {
+      rc := &bazelifyrc.Configuration{DriverMode: mode, Excludes: []string{"own"}, PreferredDirs: []string{"own"}}
+      got, err := withDriverModePreset(&Config{}, "", rc)
+      if err != nil {
+        t.Fatalf("withDriverModePreset: %v", err)
+      }
+      if diff := cmp.Diff(test.wantExcludes, got.GetExcludes()); diff != "" {
+        t.Errorf("excludes (-want +got):\n%s", diff)
+      }
+      if diff := cmp.Diff(test.wantPreferredDirs, got.GetPreferredDirs()); diff != "" {
+        t.Errorf("preferred_dirs (-want +got):\n%s", diff)
+      }
+    })
+  }
+}
+
+func TestReadConfig_NCS(t *testing.T) {
+  workspaceDir := mustMakeAbs(t, testDataDir)
+  sdkDir := filepath.Join(workspaceDir, "ncs")
+  conf, err := ReadConfig([]string{sdkDir}, workspaceDir, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("ReadConfig: %v", err)
+  }
+  wantIncludeDirs := []string{filepath.Join(sdkDir, "zephyr/include"), filepath.Join(sdkDir, "nrf/include")}
+  if diff := cmp.Diff(wantIncludeDirs, conf.IncludeDirs); diff != "" {
+    t.Errorf("IncludeDirs (-want +got):\n%s", diff)
+  }
+  // CONFIG_BT is not set, so its dirs are excluded.
+  if diff := cmp.Diff([]string{filepath.Join(sdkDir, "nrf/subsys/bluetooth")}, conf.Excludes); diff != "" {
+    t.Errorf("Excludes (-want +got):\n%s", diff)
+  }
+}
+
+func TestReadConfig_MeshPreset(t *testing.T) {
+  workspaceDir := mustMakeAbs(t, testDataDir)
+  sdkDir := filepath.Join(workspaceDir, "mesh_sdk", "nrf5_sdk")
+  meshDir := filepath.Join(workspaceDir, "mesh_sdk", "nrf5_sdk_for_mesh")
+  tests := map[string]struct{
+    flag, value string
+    wantPreset bool
+  }{
+    "default": {
+      wantPreset: true,
+    },
+    // --sdk_version only turns off the nRF5 SDK preset.
+    "sdk_version none": {
+      flag: "sdk_version",
+      value: "none",
+      wantPreset: true,
+    },
+    "mesh_preset false": {
+      flag: "mesh_preset",
+      value: "false",
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      if test.flag != "" {
+        flag.Set(test.flag, test.value)
+        defer flag.Set(test.flag, flag.Lookup(test.flag).DefValue)
+      }
+      conf, err := ReadConfig([]string{sdkDir}, workspaceDir, VerbosityPhases)
+      if err != nil {
+        t.Fatalf("ReadConfig: %v", err)
+      }
+      if got := conf.SplitHeaderDirs["api"]; got != test.wantPreset {
+        t.Errorf("SplitHeaderDirs[api]: got %v, want %v", got, test.wantPreset)
+      }
+      if got := conf.PreferOwnSDK[meshDir]; got != test.wantPreset {
+        t.Errorf("PreferOwnSDK[%s]: got %v, want %v", meshDir, got, test.wantPreset)
+      }
+      // The Mesh preset only applies to the Mesh SDK.
+      if conf.PreferOwnSDK[sdkDir] {
+        t.Errorf("PreferOwnSDK[%s]: got true, want false", sdkDir)
+      }
+    })
+  }
+}
+
+func TestNewBoards(t *testing.T) {
+  tests := map[string]struct{
+    board *bazelifyrc.Board
+    wantErr bool
+  }{
+    "custom": {
+      board: &bazelifyrc.Board{Name: "my_board", Chip: "nrf52840"},
+    },
+    "no name": {
+      board: &bazelifyrc.Board{Chip: "nrf52840"},
+      wantErr: true,
+    },
+    "unknown chip": {
+      board: &bazelifyrc.Board{Name: "my_board", Chip: "nrf51822"},
+      wantErr: true,
+    },
+    "same name as a chip": {
+      board: &bazelifyrc.Board{Name: "nrf52840", Chip: "nrf52840"},
+      wantErr: true,
+    },
+    "same name as a known board": {
+      board: &bazelifyrc.Board{Name: "pca10056", Chip: "nrf52840"},
+      wantErr: true,
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      boards, err := newBoards([]*bazelifyrc.Board{test.board})
+      if test.wantErr {
+        if err == nil {
+          t.Errorf("newBoards(%v): got nil error, want an error", test.board)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatalf("newBoards(%v): %v", test.board, err)
+      }
+      if got, want := len(boards), len(knownBoards)+1; got != want {
+        t.Errorf("newBoards(%v): got %d boards, want %d", test.board, got, want)
+      }
+    })
+  }
+}
+
+func TestNewIncludePrefix(t *testing.T) {
+  tests := map[string]struct{
+    prefix *bazelifyrc.IncludePrefix
+    wantErr bool
+  }{
+    "strip": {
+      prefix: &bazelifyrc.IncludePrefix{Library: "//a/b", StripIncludePrefix: "/a"},
+    },
+    "strip and add": {
+      prefix: &bazelifyrc.IncludePrefix{Library: "//a/b", StripIncludePrefix: "b", IncludePrefix: "c"},
+    },
+    "bad label": {
+      prefix: &bazelifyrc.IncludePrefix{Library: "a/b", StripIncludePrefix: "/a"},
+      wantErr: true,
+    },
+    "no prefixes": {
+      prefix: &bazelifyrc.IncludePrefix{Library: "//a/b"},
+      wantErr: true,
+    },
+    "absolute include_prefix": {
+      prefix: &bazelifyrc.IncludePrefix{Library: "//a/b", IncludePrefix: "/c"},
+      wantErr: true,
+    },
+    "up-level reference": {
+      prefix: &bazelifyrc.IncludePrefix{Library: "//a/b", StripIncludePrefix: "../a"},
+      wantErr: true,
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      _, err := newIncludePrefix(test.prefix)
+      if gotErr := err != nil; gotErr != test.wantErr {
+        t.Errorf("newIncludePrefix(%v): got error %v, want error: %t", test.prefix, err, test.wantErr)
+      }
+    })
+  }
+}
+
+func TestAddMacroInclude(t *testing.T) {
+  tests := map[string]struct{
+    macros []*bazelifyrc.MacroInclude
+    wantErr bool
+  }{
+    "header": {
+      macros: []*bazelifyrc.MacroInclude{{Macro: "SDK_CONFIG_FILE", Header: "sdk_config.h"}},
+    },
+    "label": {
+      macros: []*bazelifyrc.MacroInclude{{Macro: "NRF_LOG_HEADER", Label: "@log//:backend", IncludeDirs: []string{"external/log"}}},
+    },
+    "not a macro": {
+      macros: []*bazelifyrc.MacroInclude{{Macro: "sdk_config.h", Header: "sdk_config.h"}},
+      wantErr: true,
+    },
+    "header and label": {
+      macros: []*bazelifyrc.MacroInclude{{Macro: "A", Header: "a.h", Label: "//a"}},
+      wantErr: true,
+    },
+    "neither": {
+      macros: []*bazelifyrc.MacroInclude{{Macro: "A"}},
+      wantErr: true,
+    },
+    "include_dirs with header": {
+      macros: []*bazelifyrc.MacroInclude{{Macro: "A", Header: "a.h", IncludeDirs: []string{"a"}}},
+      wantErr: true,
+    },
+    "duplicate": {
+      macros: []*bazelifyrc.MacroInclude{{Macro: "A", Header: "a.h"}, {Macro: "A", Header: "b.h"}},
+      wantErr: true,
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      conf := &Config{
+        MacroIncludes: make(map[string]string),
+        IncludeOverrides: make(map[string]*IncludeOverride),
+      }
+      var err error
+      for _, m := range test.macros {
+        if err = conf.addMacroInclude(m); err != nil {
+          break
+        }
+      }
+      if gotErr := err != nil; gotErr != test.wantErr {
+        t.Errorf("addMacroInclude(%v): got error %v, want error: %t", test.macros, err, test.wantErr)
+      }
+    })
+  }
+}
+
+func TestPerDirectory(t *testing.T) {
+  conf := &Config{
+    Granularity: Granularity{
+      PerDirectory: []string{"/sdk/components/libraries/*"},
+      PerHeader: []string{"/sdk/components/libraries/util"},
+    },
+  }
+  tests := map[string]struct{
+    mode bazelifyrc.Granularity
+    dir string
+    want bool
+  }{
+    "per_directory pattern": {
+      dir: "/sdk/components/libraries/fifo",
+      want: true,
+    },
+    "per_header takes precedence": {
+      dir: "/sdk/components/libraries/util",
+    },
+    "no pattern, per_header mode": {
+      dir: "/sdk/components/ble/common",
+    },
+    "no pattern, per_directory mode": {
+      mode: bazelifyrc.Granularity_PER_DIRECTORY,
+      dir: "/sdk/components/ble/common",
+      want: true,
+    },
+    "per_header pattern in per_directory mode": {
+      mode: bazelifyrc.Granularity_PER_DIRECTORY,
+      dir: "/sdk/components/libraries/util",
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      conf.Granularity.Mode = test.mode
+      if got := conf.perDirectory(test.dir); got != test.want {
+        t.Errorf("perDirectory(%q): got %t, want %t", test.dir, got, test.want)
+      }
+    })
+  }
+}
+
+func TestValidateVisibility(t *testing.T) {
+  tests := map[string]struct{
+    visibility []string
+    wantErr bool
+  }{
+    "public": {
+      visibility: []string{"//visibility:public"},
+    },
+    "packages": {
+      visibility: []string{"//app:__subpackages__", "@other//:__pkg__"},
+    },
+    "relative": {
+      visibility: []string{":__pkg__"},
+      wantErr: true,
+    },
+    "private with others": {
+      visibility: []string{"//visibility:private", "//app:__pkg__"},
+      wantErr: true,
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      err := validateVisibility(test.visibility)
+      if gotErr := err != nil; gotErr != test.wantErr {
+        t.Errorf("validateVisibility(%q): got error %v, want error: %t", test.visibility, err, test.wantErr)
+      }
+    })
+  }
+}
+
+func TestNewPackageGroups(t *testing.T) {
+  tests := map[string]struct{
+    groups []*bazelifyrc.PackageGroup
+    wantErr bool
+  }{
+    "include": {
+      groups: []*bazelifyrc.PackageGroup{
+        {Name: "a", Packages: []string{"//app/...", "-//app/test/..."}, Includes: []string{"b"}},
+        {Name: "b", Packages: []string{"public"}, Targets: []string{"//sdk/..."}},
+      },
+    },
+    "bad name": {
+      groups: []*bazelifyrc.PackageGroup{{Name: "a-b"}},
+      wantErr: true,
+    },
+    "duplicate name": {
+      groups: []*bazelifyrc.PackageGroup{{Name: "a"}, {Name: "a"}},
+      wantErr: true,
+    },
+    "bad package": {
+      groups: []*bazelifyrc.PackageGroup{{Name: "a", Packages: []string{"app"}}},
+      wantErr: true,
+    },
+    "unknown include": {
+      groups: []*bazelifyrc.PackageGroup{{Name: "a", Includes: []string{"b"}}},
+      wantErr: true,
+    },
+    "bad target": {
+      groups: []*bazelifyrc.PackageGroup{{Name: "a", Targets: []string{"sdk"}}},
+      wantErr: true,
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      _, err := newPackageGroups(test.groups)
+      if gotErr := err != nil; gotErr != test.wantErr {
+        t.Errorf("newPackageGroups: got error %v, want error: %t", err, test.wantErr)
+      }
+    })
+  }
+}
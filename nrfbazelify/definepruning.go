@@ -0,0 +1,143 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+)
+
+// DefinePruning configures leaving out what the defines rule out.
+type DefinePruning struct {
+  Enabled bool
+  // Macro -> value, or nil if define pruning isn't enabled, so every
+  // conditional include is kept.
+  Defines map[string]string
+  Modules []*ModuleEnable
+}
+
+// ModuleEnable is a macro that enables the libraries that one of the targets
+// matches.
+type ModuleEnable struct {
+  Macro string
+  Targets []*TargetPattern
+}
+
+// newDefinePruning reads the define_pruning of the rc in sdkDir. The
+// defines of every library come first, then sdk_config.h's, then
+// define_pruning's own, and later ones replace earlier ones.
+func (conf *Config) newDefinePruning(sdkDir string, d *bazelifyrc.DefinePruning) (DefinePruning, error) {
+  if !d.GetEnabled() {
+    if d.GetSdkConfig() != "" || len(d.GetDefines()) > 0 || len(d.GetModules()) > 0 {
+      return DefinePruning{}, fmt.Errorf("sdk_config, defines or modules without enabled")
+    }
+    return DefinePruning{}, nil
+  }
+  if d.GetSdkConfig() == "" && len(d.GetDefines()) == 0 {
+    return DefinePruning{}, fmt.Errorf("no sdk_config or defines")
+  }
+  out := DefinePruning{
+    Enabled: true,
+    Defines: make(map[string]string),
+  }
+  parseDefines(out.Defines, conf.NrfCcLibrary.Defines)
+  parseDefines(out.Defines, conf.Defines)
+  if d.GetSdkConfig() != "" {
+    path := filepath.Join(sdkDir, d.GetSdkConfig())
+    defines, err := readDefines(path)
+    if err != nil {
+      return DefinePruning{}, fmt.Errorf("sdk_config: %v", err)
+    }
+    for name, value := range defines {
+      out.Defines[name] = value
+    }
+  }
+  parseDefines(out.Defines, d.GetDefines())
+  for _, m := range d.GetModules() {
+    if !macroMatcher.MatchString(m.GetMacro()) {
+      return DefinePruning{}, fmt.Errorf("modules %q: not a macro name", m.GetMacro())
+    }
+    targets, err := parseTargetPatterns(m.GetTargets())
+    if err != nil {
+      return DefinePruning{}, fmt.Errorf("modules %q: %v", m.GetMacro(), err)
+    }
+    if len(targets) == 0 {
+      return DefinePruning{}, fmt.Errorf("modules %q: no targets", m.GetMacro())
+    }
+    out.Modules = append(out.Modules, &ModuleEnable{
+      Macro: m.GetMacro(),
+      Targets: targets,
+    })
+  }
+  return out, nil
+}
+
+// moduleMacros returns the macros that enable lib: its name in upper case
+// followed by _ENABLED, and the macros of the modules entries that match it.
+func (conf *Config) moduleMacros(lib *LibraryNode) []string {
+  out := []string{strings.ToUpper(lib.Label().Name()) + "_ENABLED"}
+  for _, m := range conf.DefinePruning.Modules {
+    for _, target := range m.Targets {
+      if target.Matches(lib.Label()) {
+        out = appendMissing(out, m.Macro)
+        break
+      }
+    }
+  }
+  return out
+}
+
+// disabledModule returns the macro that disables lib, or "" if none of its
+// macros is known to be 0.
+func (conf *Config) disabledModule(lib *LibraryNode) string {
+  for _, macro := range conf.moduleMacros(lib) {
+    if evalCondition(macro, conf.DefinePruning.Defines) == isFalse {
+      return macro
+    }
+  }
+  return ""
+}
+
+// PruneDisabledModules removes the libraries of modules that the defines
+// disable, like nrf_log with NRF_LOG_ENABLED set to 0. Libraries that others
+// still depend on are kept, since their headers are still included, like
+// nrf_log.h for its empty macros. Removing a library can leave another one
+// without dependents, so it goes until no more can be removed.
+// Returns the number of removed libraries.
+func (d *DependencyGraph) PruneDisabledModules() (int, error) {
+  var pruned int
+  for {
+    nodes := d.Nodes()
+    sortNodes(nodes)
+    var removed int
+    var kept []string
+    for _, node := range nodes {
+      lib, ok := node.(*LibraryNode)
+      if !ok || lib.IsPointer {
+        continue
+      }
+      macro := d.conf.disabledModule(lib)
+      if macro == "" {
+        continue
+      }
+      if dependents := d.Dependents(lib.Label()); len(dependents) > 0 {
+        sortNodes(dependents)
+        kept = append(kept, fmt.Sprintf("Keeping %s, disabled by %s, since %s depends on it", lib.Label(), macro, dependents[0].Label()))
+        continue
+      }
+      if err := d.deleteNode(lib.Label()); err != nil {
+        return pruned, fmt.Errorf("deleteNode(%q): %v", lib.Label(), err)
+      }
+      d.conf.logf(VerbosityResolutions, "Removed %s, disabled by %s", lib.Label(), macro)
+      removed++
+    }
+    if removed == 0 {
+      for _, msg := range kept {
+        d.conf.logf(VerbosityResolutions, "%s", msg)
+      }
+      return pruned, nil
+    }
+    pruned += removed
+  }
+}
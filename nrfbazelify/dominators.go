@@ -0,0 +1,81 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"sort"
+
+	"gonum.org/v1/gonum/graph/flow"
+	"gonum.org/v1/gonum/graph/simple"
+)
+
+// Bottleneck is a target that every dependency path from the roots to some
+// other targets goes through. Stubbing or remapping it cuts those targets off.
+type Bottleneck struct {
+  Label string
+  // Number of targets that are only reachable from the roots through this one.
+  Dominated int
+}
+
+// bottlenecks finds the targets that dominate others, from the roots. Roots
+// are labels or file names, as accepted by Query. Without roots, every target
+// that nothing depends on is a root. Sorted by most dominated targets, then label.
+func bottlenecks(graph *DependencyGraph, roots []string) ([]*Bottleneck, error) {
+  // Dominators need a single root, so a virtual root depends on all the roots.
+  g := simple.NewDirectedGraph()
+  for _, node := range graph.Nodes() {
+    g.AddNode(simple.Node(node.ID()))
+  }
+  edges := graph.graph.Edges()
+  for edges.Next() {
+    edge := edges.Edge()
+    g.SetEdge(g.NewEdge(simple.Node(edge.From().ID()), simple.Node(edge.To().ID())))
+  }
+  virtualRoot := g.NewNode()
+  g.AddNode(virtualRoot)
+  if len(roots) == 0 {
+    for _, node := range graph.Nodes() {
+      if graph.graph.To(node.ID()).Len() == 0 {
+        g.SetEdge(g.NewEdge(virtualRoot, simple.Node(node.ID())))
+      }
+    }
+  }
+  for _, root := range roots {
+    node, err := graph.queryTarget(root)
+    if err != nil {
+      return nil, fmt.Errorf("root %q: %v", root, err)
+    }
+    g.SetEdge(g.NewEdge(virtualRoot, simple.Node(node.ID())))
+  }
+  tree := flow.Dominators(virtualRoot, g)
+
+  // Count the targets below each one in the dominator tree.
+  dominated := make(map[int64]int)
+  var count func(id int64) int
+  count = func(id int64) int {
+    total := 0
+    for _, child := range tree.DominatedBy(id) {
+      total += count(child.ID()) + 1
+    }
+    dominated[id] = total
+    return total
+  }
+  count(virtualRoot.ID())
+
+  var out []*Bottleneck
+  for _, node := range graph.Nodes() {
+    if dominated[node.ID()] == 0 {
+      continue
+    }
+    out = append(out, &Bottleneck{
+      Label: node.Label().String(),
+      Dominated: dominated[node.ID()],
+    })
+  }
+  sort.Slice(out, func(i, j int) bool {
+    if out[i].Dominated != out[j].Dominated {
+      return out[i].Dominated > out[j].Dominated
+    }
+    return out[i].Label < out[j].Label
+  })
+  return out, nil
+}
@@ -0,0 +1,48 @@
+package nrfbazelify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBottlenecks(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "bottlenecks")
+  graph, err := LoadGraph(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("LoadGraph(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  tests := map[string]struct{
+    roots []string
+    want []*Bottleneck
+  }{
+    "roots": {
+      roots: []string{"app.h"},
+      want: []*Bottleneck{
+        {Label: "//bottlenecks:app", Dominated: 4},
+        {Label: "//bottlenecks:z", Dominated: 1},
+      },
+    },
+    // other.h also depends on w.h, so z.h isn't a bottleneck for it.
+    "no roots": {
+      want: []*Bottleneck{
+        {Label: "//bottlenecks:app", Dominated: 3},
+      },
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      got, err := bottlenecks(graph, test.roots)
+      if err != nil {
+        t.Fatalf("bottlenecks(%v): %v", test.roots, err)
+      }
+      if diff := cmp.Diff(test.want, got); diff != "" {
+        t.Errorf("bottlenecks(%v) (-want +got):\n%s", test.roots, diff)
+      }
+    })
+  }
+  if _, err := bottlenecks(graph, []string{"missing.h"}); err == nil {
+    t.Errorf("bottlenecks(missing.h): got nil error, want an error")
+  }
+}
@@ -0,0 +1,366 @@
+package nrfbazelify
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+)
+
+const (
+  // The examples dir of the nRF5 SDK, relative to the SDK root.
+  defaultExamplesDir = "examples"
+  // The dir with an example's Makefile, under the board and variant dirs.
+  armgccDir = "armgcc"
+  // Library with the headers in an example's include folders, like
+  // sdk_config.h, named <binary>_config.
+  exampleConfigSuffix = "_config"
+)
+
+var (
+  // Matches VAR := value, and target specific VAR := value after a target.
+  makeAssignMatcher = regexp.MustCompile(`^(?:\S+:\s+)?([A-Za-z_][A-Za-z0-9_]*)\s*(:=|\+=|\?=|=)\s*(.*)$`)
+  makeVarMatcher = regexp.MustCompile(`\$\(([A-Za-z_][A-Za-z0-9_]*)\)`)
+)
+
+// Examples configures the conversion of the SDK's examples.
+type Examples struct {
+  Enabled bool
+  Dirs []string // absolute paths
+}
+
+// exampleMakefile holds the variables of an example's Makefile that describe
+// how to build it.
+type exampleMakefile struct {
+  path string
+  projDir string
+  srcFiles, incFolders, defines []string
+  linkerScript string // "" if there isn't one
+}
+
+// readExampleMakefile reads the variables of an armgcc Makefile. Paths are
+// made absolute, relative to the Makefile's dir.
+func readExampleMakefile(path string) (*exampleMakefile, error) {
+  vars, err := readMakeVars(path)
+  if err != nil {
+    return nil, err
+  }
+  dir := filepath.Dir(path)
+  abs := func(p string) string {
+    if filepath.IsAbs(p) {
+      return filepath.Clean(p)
+    }
+    return filepath.Join(dir, p)
+  }
+  out := &exampleMakefile{path: path}
+  if len(vars["PROJ_DIR"]) != 1 {
+    return nil, fmt.Errorf("%s: PROJ_DIR must be a single dir, got %q", path, vars["PROJ_DIR"])
+  }
+  out.projDir = abs(vars["PROJ_DIR"][0])
+  for _, src := range vars["SRC_FILES"] {
+    out.srcFiles = append(out.srcFiles, abs(src))
+  }
+  for _, inc := range vars["INC_FOLDERS"] {
+    out.incFolders = append(out.incFolders, abs(inc))
+  }
+  out.defines = cflagsDefines(vars["CFLAGS"])
+  if scripts := vars["LINKER_SCRIPT"]; len(scripts) == 1 {
+    out.linkerScript = abs(scripts[0])
+  }
+  return out, nil
+}
+
+// makefileDefines reads the defines of a Makefile's CFLAGS.
+func makefileDefines(path string) ([]string, error) {
+  vars, err := readMakeVars(path)
+  if err != nil {
+    return nil, err
+  }
+  return cflagsDefines(vars["CFLAGS"]), nil
+}
+
+// cflagsDefines returns the macros of the -D flags, like BOARD_PCA10056.
+func cflagsDefines(cflags []string) []string {
+  var out []string
+  for _, flag := range cflags {
+    if strings.HasPrefix(flag, "-D") && len(flag) > 2 {
+      out = append(out, strings.TrimPrefix(flag, "-D"))
+    }
+  }
+  return out
+}
+
+// readMakeVars reads the variable assignments of a Makefile, expanding
+// references to variables that were assigned before. Conditionals and
+// includes are ignored, so every assignment counts.
+func readMakeVars(path string) (map[string][]string, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+
+  vars := make(map[string][]string)
+  expand := func(value string) []string {
+    value = makeVarMatcher.ReplaceAllStringFunc(value, func(ref string) string {
+      return strings.Join(vars[makeVarMatcher.FindStringSubmatch(ref)[1]], " ")
+    })
+    return strings.Fields(value)
+  }
+  scanner := bufio.NewScanner(file)
+  var line string
+  for scanner.Scan() {
+    text := scanner.Text()
+    // Recipes are indented with a tab.
+    if strings.HasPrefix(text, "\t") && line == "" {
+      continue
+    }
+    if i := strings.Index(text, "#"); i >= 0 {
+      text = text[:i]
+    }
+    if strings.HasSuffix(strings.TrimSpace(text), "\\") {
+      line += strings.TrimSuffix(strings.TrimSpace(text), "\\") + " "
+      continue
+    }
+    line += text
+    matches := makeAssignMatcher.FindStringSubmatch(strings.TrimSpace(line))
+    line = ""
+    if matches == nil {
+      continue
+    }
+    name, op, value := matches[1], matches[2], expand(matches[3])
+    switch op {
+    case "+=":
+      vars[name] = append(vars[name], value...)
+    case "?=":
+      if _, ok := vars[name]; !ok {
+        vars[name] = value
+      }
+    default:
+      vars[name] = value
+    }
+  }
+  if err := scanner.Err(); err != nil {
+    return nil, err
+  }
+  return vars, nil
+}
+
+// findExampleMakefiles finds */armgcc/Makefile in the examples dirs.
+func findExampleMakefiles(conf *Config) ([]string, error) {
+  var out []string
+  for _, dir := range conf.Examples.Dirs {
+    if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+      if err != nil {
+        return err
+      }
+      if info.Name() == "Makefile" && filepath.Base(filepath.Dir(path)) == armgccDir {
+        out = append(out, path)
+      }
+      return nil
+    }); err != nil {
+      return nil, fmt.Errorf("filepath.Walk(%q): %v", dir, err)
+    }
+  }
+  sort.Strings(out)
+  return out, nil
+}
+
+// examplesContents generates an nrf_cc_binary for every example Makefile, in
+// the example's PROJ_DIR. The binary is named after the board and variant
+// dirs, like pca10056_blank. Headers in the example's include folders go in a
+// <binary>_config library, which sdk_config_flag can point to.
+func examplesContents(conf *Config, depGraph *DependencyGraph) ([]*buildContents, error) {
+  makefiles, err := findExampleMakefiles(conf)
+  if err != nil {
+    return nil, err
+  }
+  sdkFromWorkspace, err := filepath.Rel(conf.WorkspaceDir, conf.SDKDir)
+  if err != nil {
+    return nil, fmt.Errorf("filepath.Rel: %v", err)
+  }
+  remapBzl := fmt.Sprintf("//%s:%s", sdkFromWorkspace, bzlFilename)
+  var out []*buildContents
+  loaded := make(map[string]bool) // dirs that load nrf_cc_binary
+  for _, path := range makefiles {
+    makefile, err := readExampleMakefile(path)
+    if err != nil {
+      return nil, err
+    }
+    contents, err := exampleContents(conf, depGraph, makefile)
+    if err != nil {
+      return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    dir := contents[0].dir
+    if !loaded[dir] {
+      loaded[dir] = true
+      contents = append(contents, &buildContents{
+        dir: dir,
+        load: &buildfile.Load{Source: remapBzl, Symbols: []string{"nrf_cc_binary"}},
+      })
+      // Every other BUILD file loads nrf_cc_library instead.
+      if conf.NrfCcLibrary.Enabled {
+        contents = append(contents, &buildContents{
+          dir: dir,
+          load: &buildfile.Load{Source: "@rules_cc//cc:defs.bzl", Symbols: []string{"cc_library"}},
+        })
+      }
+    }
+    out = append(out, contents...)
+  }
+  return out, nil
+}
+
+func exampleContents(conf *Config, depGraph *DependencyGraph, makefile *exampleMakefile) ([]*buildContents, error) {
+  projDir := makefile.projDir
+  dir, err := filepath.Rel(conf.WorkspaceDir, projDir)
+  if err != nil {
+    return nil, fmt.Errorf("filepath.Rel: %v", err)
+  }
+  inProj := func(path string) (string, bool) {
+    rel, err := filepath.Rel(projDir, path)
+    if err != nil || strings.HasPrefix(rel, "..") {
+      return "", false
+    }
+    return rel, true
+  }
+  name := filepath.Base(projDir)
+  if variant, ok := inProj(filepath.Dir(filepath.Dir(makefile.path))); ok && variant != "." {
+    name = strings.ReplaceAll(variant, string(filepath.Separator), "_")
+  }
+
+  binary := &buildfile.Binary{
+    Name: name,
+    Kind: "nrf_cc_binary",
+    Defines: makefile.defines,
+  }
+  deps := make(map[string]bool)
+  var localFiles []string
+  for _, src := range makefile.srcFiles {
+    if rel, ok := inProj(src); ok {
+      binary.Srcs = append(binary.Srcs, rel)
+      localFiles = append(localFiles, src)
+      continue
+    }
+    label := libraryWithFile(conf, depGraph, src)
+    if label == nil {
+      log.Printf("%s: no library has %s", makefile.path, src)
+      continue
+    }
+    deps[label.String()] = true
+  }
+
+  // Headers in the example's own include folders.
+  config := &buildfile.Library{Name: name + exampleConfigSuffix}
+  localHeaders := make(map[string]bool)
+  for _, inc := range makefile.incFolders {
+    rel, ok := inProj(inc)
+    if !ok {
+      continue
+    }
+    hdrs, err := filepath.Glob(filepath.Join(inc, "*.h"))
+    if err != nil {
+      return nil, fmt.Errorf("filepath.Glob: %v", err)
+    }
+    if len(hdrs) == 0 {
+      continue
+    }
+    for _, hdr := range hdrs {
+      relHdr, _ := inProj(hdr)
+      config.Hdrs = append(config.Hdrs, relHdr)
+      localHeaders[filepath.Base(hdr)] = true
+      localFiles = append(localFiles, hdr)
+    }
+    config.Includes = append(config.Includes, rel)
+  }
+  if config.Hdrs != nil {
+    deps[":"+config.Name] = true
+  }
+
+  // Headers from the SDK that the example's own files include.
+  for _, file := range localFiles {
+    includes, _, err := readIncludes(file, false, conf.MacroIncludes, conf.DefinePruning.Defines)
+    if err != nil {
+      return nil, fmt.Errorf("readIncludes(%q): %v", file, err)
+    }
+    for _, include := range includes {
+      if localHeaders[filepath.Base(include)] {
+        continue
+      }
+      if label := libraryWithInclude(depGraph, include); label != nil {
+        deps[label.String()] = true
+      }
+    }
+  }
+  for dep := range deps {
+    binary.Deps = append(binary.Deps, dep)
+  }
+  sort.Strings(binary.Deps)
+  sort.Strings(binary.Srcs)
+
+  if makefile.linkerScript != "" {
+    if rel, ok := inProj(makefile.linkerScript); ok {
+      binary.LinkerScript = rel
+    }
+  }
+
+  out := []*buildContents{{dir: dir, binary: binary}}
+  if config.Hdrs != nil {
+    sort.Strings(config.Hdrs)
+    out = append(out, &buildContents{dir: dir, library: config})
+  }
+  return out, nil
+}
+
+// libraryWithFile finds the label of the library or group with the file at
+// path, or nil if there isn't one.
+func libraryWithFile(conf *Config, depGraph *DependencyGraph, path string) *bazel.Label {
+  fileLabel, err := bazel.NewLabel(filepath.Dir(path), filepath.Base(path), conf.WorkspaceDir)
+  if err != nil {
+    return nil
+  }
+  has := func(files []*bazel.Label) bool {
+    for _, f := range files {
+      if f.Equal(fileLabel) {
+        return true
+      }
+    }
+    return false
+  }
+  for _, node := range depGraph.NodesWithFile(filepath.Base(path)) {
+    var found bool
+    switch n := node.(type) {
+    case *LibraryNode:
+      found = has(n.Srcs) || has(n.Hdrs)
+      for _, srcs := range n.SrcsSelect {
+        found = found || has(srcs)
+      }
+    case *GroupNode:
+      found = has(n.Srcs) || has(n.Hdrs)
+    }
+    if found {
+      return depGraph.shiftIfIsPointer(node).Label()
+    }
+  }
+  return nil
+}
+
+// libraryWithInclude finds the label that an include resolves to, or nil if
+// it doesn't resolve to a single label. Selects are skipped.
+func libraryWithInclude(depGraph *DependencyGraph, include string) *bazel.Label {
+  nodes := depGraph.NodesWithFile(filepath.Base(include))
+  if len(nodes) != 1 {
+    return nil
+  }
+  if _, ok := nodes[0].(*SelectNode); ok {
+    return nil
+  }
+  return depGraph.shiftIfIsPointer(nodes[0]).Label()
+}
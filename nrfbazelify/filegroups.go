@@ -0,0 +1,66 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+)
+
+var (
+  // Extensions in filegroup_extensions become part of a target name.
+  filegroupExtensionMatcher = regexp.MustCompile(`^\.\w+$`)
+)
+
+// isCCFileExtension checks whether files with the extension are C sources or
+// headers, which go in libraries.
+func isCCFileExtension(ext string) bool {
+  switch ext {
+  case ".h", ".c", ".s", ".S":
+    return true
+  }
+  return false
+}
+
+// filegroupName is the name of the filegroup of files with the extension.
+func filegroupName(ext string) string {
+  return strings.TrimPrefix(ext, ".") + "_files"
+}
+
+// addFilegroupNodes adds a filegroup for each extension in
+// filegroup_extensions to every dir with files that have it. Linker scripts
+// that are already in the MDK's linker_scripts filegroup are skipped.
+func (s *SDKWalker) addFilegroupNodes() error {
+  srcsByLabel := make(map[string][]*bazel.Label)
+  labels := make(map[string]*bazel.Label)
+  for _, path := range s.filegroupFiles {
+    if s.mdkLinkerScripts[path] {
+      continue
+    }
+    dir := filepath.Dir(path)
+    label, err := bazel.NewLabel(dir, filegroupName(filepath.Ext(path)), s.conf.WorkspaceDir)
+    if err != nil {
+      return fmt.Errorf("bazel.NewLabel(%q, %q): %v", dir, filegroupName(filepath.Ext(path)), err)
+    }
+    src, err := bazel.NewLabel(dir, filepath.Base(path), s.conf.WorkspaceDir)
+    if err != nil {
+      return fmt.Errorf("bazel.NewLabel(%q): %v", path, err)
+    }
+    labels[label.String()] = label
+    srcsByLabel[label.String()] = append(srcsByLabel[label.String()], src)
+  }
+  var keys []string
+  for key := range labels {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  for _, key := range keys {
+    if err := s.graph.AddFilegroupNode(labels[key], srcsByLabel[key]); err != nil {
+      return fmt.Errorf("AddFilegroupNode(%q): %v", key, err)
+    }
+  }
+  return nil
+}
@@ -0,0 +1,96 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+  // FreeRTOS's port dirs are in this dir, under every SDK dir that matches it.
+  freeRTOSPortableGlob = "**/{freertos,FreeRTOS}/portable"
+  // The heap implementations in the portable dir, which every port uses.
+  freeRTOSMemMangDir = "MemMang"
+)
+
+// excludeFreeRTOSPorts excludes the FreeRTOS port dirs of the SDK that aren't
+// in ports, or the dirs above them. Ports are relative to the portable dir,
+// like "GCC/nrf52".
+func (conf *Config) excludeFreeRTOSPorts(sdkDir string, ports []string) error {
+  if len(ports) == 0 {
+    return nil
+  }
+  portableDirs, err := conf.globDirs(filepath.Join(sdkDir, freeRTOSPortableGlob))
+  if err != nil {
+    return err
+  }
+  if len(portableDirs) == 0 {
+    return fmt.Errorf("no FreeRTOS portable dir in %s", sdkDir)
+  }
+  keep := make(map[string]bool)
+  for _, port := range ports {
+    keep[path.Clean(port)] = true
+  }
+  found := make(map[string]bool)
+  var excludes []string
+  for _, portableDir := range portableDirs {
+    dirExcludes, err := otherFreeRTOSPorts(portableDir, "", keep, found)
+    if err != nil {
+      return err
+    }
+    excludes = append(excludes, dirExcludes...)
+  }
+  for _, port := range ports {
+    if !found[path.Clean(port)] {
+      return fmt.Errorf("port %q not found in %s", port, strings.Join(portableDirs, ", "))
+    }
+  }
+  sort.Strings(excludes)
+  conf.logf(VerbosityPhases, "Excluding %d FreeRTOS port dirs, keeping %v", len(excludes), ports)
+  conf.Excludes = append(conf.Excludes, excludes...)
+  return nil
+}
+
+// otherFreeRTOSPorts returns the dirs under dir that aren't kept, where dir is
+// rel in the portable dir. Kept dirs are added to found.
+func otherFreeRTOSPorts(dir, rel string, keep, found map[string]bool) ([]string, error) {
+  entries, err := os.ReadDir(dir)
+  if err != nil {
+    return nil, err
+  }
+  var out []string
+  for _, entry := range entries {
+    if !entry.IsDir() {
+      continue
+    }
+    entryRel := path.Join(rel, entry.Name())
+    entryDir := filepath.Join(dir, entry.Name())
+    switch {
+    case keep[entryRel]:
+      found[entryRel] = true
+    case rel == "" && entry.Name() == freeRTOSMemMangDir:
+    case keepsBelow(keep, entryRel):
+      below, err := otherFreeRTOSPorts(entryDir, entryRel, keep, found)
+      if err != nil {
+        return nil, err
+      }
+      out = append(out, below...)
+    default:
+      out = append(out, entryDir)
+    }
+  }
+  return out, nil
+}
+
+// keepsBelow reports whether a kept port is below dir.
+func keepsBelow(keep map[string]bool, dir string) bool {
+  for port := range keep {
+    if strings.HasPrefix(port, dir+"/") {
+      return true
+    }
+  }
+  return false
+}
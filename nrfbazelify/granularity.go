@@ -0,0 +1,80 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/glob"
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+)
+
+// perDirectory reports whether the headers in dir are one library, instead
+// of a library each.
+func (conf *Config) perDirectory(dir string) bool {
+  for _, pattern := range conf.Granularity.PerHeader {
+    // A malformed per_header or per_directory pattern never matches here;
+    // Config.Validate reports it as a granularity problem.
+    if matched, _ := glob.Match(pattern, dir); matched {
+      return false
+    }
+  }
+  for _, pattern := range conf.Granularity.PerDirectory {
+    if matched, _ := glob.Match(pattern, dir); matched {
+      return true
+    }
+  }
+  return conf.Granularity.Mode == bazelifyrc.Granularity_PER_DIRECTORY
+}
+
+// dirLibrary is the files of a dir with per_directory granularity.
+type dirLibrary struct {
+  srcs, hdrs []*bazel.Label
+}
+
+// addDirectoryFiles records a header of dir, and its srcs, for the library of
+// dir.
+func (s *SDKWalker) addDirectoryFiles(dir string, srcs, hdrs []*bazel.Label) {
+  lib := s.dirLibraries[dir]
+  if lib == nil {
+    lib = &dirLibrary{}
+    s.dirLibraries[dir] = lib
+  }
+  lib.srcs = append(lib.srcs, srcs...)
+  lib.hdrs = append(lib.hdrs, hdrs...)
+}
+
+// addDirectoryNodes adds a library named after the dir to every dir with
+// per_directory granularity, with all of its headers and their srcs.
+func (s *SDKWalker) addDirectoryNodes() error {
+  var dirs []string
+  for dir := range s.dirLibraries {
+    dirs = append(dirs, dir)
+  }
+  sort.Strings(dirs)
+  for _, dir := range dirs {
+    lib := s.dirLibraries[dir]
+    name := filepath.Base(dir)
+    label, err := bazel.NewLabel(dir, name, s.conf.WorkspaceDir)
+    if err != nil {
+      return fmt.Errorf("bazel.NewLabel(%q, %q): %v", dir, name, err)
+    }
+    bazel.SortLabels(lib.srcs)
+    bazel.SortLabels(lib.hdrs)
+    includes := []string{label.Dir()}
+    if s.conf.Layout == bazelifyrc.Layout_NCS {
+      includes = append(includes, s.conf.ncsIncludeRoots(dir)...)
+    }
+    if err := s.graph.AddLibraryNode(label, lib.srcs, lib.hdrs, includes); err != nil {
+      return fmt.Errorf("AddLibraryNode(%q): %v", label, err)
+    }
+    for _, hdr := range lib.hdrs {
+      s.dirLibraryHeaders[filepath.Join(dir, hdr.Name())] = label
+    }
+  }
+  if len(dirs) > 0 {
+    s.conf.logf(VerbosityPhases, "Added %d per_directory libraries", len(dirs))
+  }
+  return nil
+}
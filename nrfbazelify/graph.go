@@ -1,10 +1,11 @@
 package nrfbazelify
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/Michaelhobo/nrfbazel/internal/bazel"
 	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
@@ -23,6 +24,8 @@ func NewDependencyGraph(conf *Config, dotGraphProgressionDir string) *Dependency
     labelToID: make(map[string]int64),
     fileNameToLabel: make(map[string]*labelResolver),
     graph: simple.NewDirectedGraph(),
+    includedHeaders: make(map[string]bool),
+    includedNames: make(map[string]bool),
   }
 }
 
@@ -32,9 +35,12 @@ type DependencyGraph struct {
   dotGraphProgressionDir string
   dotGraphProgressionCount int
   nextID int64
+  mergedCycles int // number of cycles merged into groups
   labelToID map[string]int64 // label.String() -> node ID
   fileNameToLabel map[string]*labelResolver // file name (base only) -> indexed file
   graph *simple.DirectedGraph
+  includedHeaders map[string]bool // label.String() of headers that an include resolved to
+  includedNames map[string]bool // file names of includes that resolved to a target without headers
 }
 
 // OutputDOTGraph outputs the graph's contents as a DOT graph.
@@ -44,8 +50,8 @@ func (d *DependencyGraph) OutputDOTGraph(path string) error {
   if err != nil {
     return fmt.Errorf("dot.Marshal: %v", err)
   }
-  if err := os.WriteFile(path, out, 0640); err != nil {
-    return fmt.Errorf("WriteFile(%q): %v", path, err)
+  if err := writeFileAtomic(path, out, 0640); err != nil {
+    return fmt.Errorf("writeFileAtomic(%q): %v", path, err)
   }
   return nil
 }
@@ -141,15 +147,15 @@ func (d *DependencyGraph) AddRemapNode(label *bazel.Label, fileName string, labe
   }
 
   // Set it as the override
-  if d.fileNameToLabel[fileName] == nil {
-    d.fileNameToLabel[fileName] = newLabelResolver()
-  }
-  resolver := d.fileNameToLabel[fileName]
-  if resolver.override != nil {
-    return fmt.Errorf("override for %q already exists(%q), can't add remap %q", fileName, resolver.override, label)
+  if err := d.AddRemapFile(fileName, label); err != nil {
+    return err
   }
-  resolver.override = label
+  return d.AddLabelFlagNode(label, labelSetting)
+}
 
+// AddLabelFlagNode adds a remap node that no file resolves to. It only
+// generates the label setting, like a label_flag that picks a file to flash.
+func (d *DependencyGraph) AddLabelFlagNode(label *bazel.Label, labelSetting *buildfile.LabelSetting) error {
   nodeID, err := d.nodeID(label)
   if err != nil {
     return err
@@ -163,6 +169,34 @@ func (d *DependencyGraph) AddRemapNode(label *bazel.Label, fileName string, labe
   return nil
 }
 
+// AddFilegroupNode adds a node that generates a filegroup of srcs.
+// Its files aren't indexed, since nothing includes them.
+func (d *DependencyGraph) AddFilegroupNode(label *bazel.Label, srcs []*bazel.Label) error {
+  nodeID, err := d.nodeID(label)
+  if err != nil {
+    return err
+  }
+  d.graph.AddNode(&FilegroupNode{
+    id: nodeID,
+    label: label,
+    Srcs: srcs,
+  })
+  return nil
+}
+
+// AddRemapFile resolves includes of another file to the remap node with the given label.
+func (d *DependencyGraph) AddRemapFile(fileName string, label *bazel.Label) error {
+  if d.fileNameToLabel[fileName] == nil {
+    d.fileNameToLabel[fileName] = newLabelResolver()
+  }
+  resolver := d.fileNameToLabel[fileName]
+  if resolver.override != nil {
+    return fmt.Errorf("override for %q already exists(%q), can't add remap %q", fileName, resolver.override, label)
+  }
+  resolver.override = label
+  return nil
+}
+
 // AddOverrideNode adds a node that represents a target_override from bazelifyrc.
 func (d *DependencyGraph) AddOverrideNode(fileName string, override *IncludeOverride) error {
   if d.fileNameToLabel[fileName] == nil {
@@ -187,6 +221,36 @@ func (d *DependencyGraph) AddOverrideNode(fileName string, override *IncludeOver
   return nil
 }
 
+// AddSelectNode adds a node that represents a select_overrides entry.
+// The node's label is made up, since it doesn't generate a rule.
+func (d *DependencyGraph) AddSelectNode(fileName string, override *SelectOverride) error {
+  name := "select_" + strings.NewReplacer("/", "_", ".", "_").Replace(fileName)
+  label, err := bazel.NewLabel(d.conf.SDKDir, name, d.conf.WorkspaceDir)
+  if err != nil {
+    return fmt.Errorf("bazel.NewLabel: %v", err)
+  }
+  if d.fileNameToLabel[fileName] == nil {
+    d.fileNameToLabel[fileName] = newLabelResolver()
+  }
+  resolver := d.fileNameToLabel[fileName]
+  if resolver.override != nil {
+    return fmt.Errorf("override for %q already exists(%q), can't add select override", fileName, resolver.override)
+  }
+  resolver.override = label
+
+  nodeID, err := d.nodeID(label)
+  if err != nil {
+    return err
+  }
+  d.graph.AddNode(&SelectNode{
+    id: nodeID,
+    label: label,
+    Include: fileName,
+    Override: override,
+  })
+  return nil
+}
+
 // AddGroupNode adds an empty group node that represents a set of nodes.
 func (d *DependencyGraph) AddGroupNode() (*GroupNode, error) {
   label, err := bazel.NewLabel(d.conf.SDKDir, uuid.NewString(), d.conf.WorkspaceDir)
@@ -205,8 +269,12 @@ func (d *DependencyGraph) AddGroupNode() (*GroupNode, error) {
   return node, nil	
 }
 
-// AddDependency adds a dependency from src to dst
-func (d *DependencyGraph) AddDependency(src, dst *bazel.Label) error {
+// AddDependency adds a dependency from src to dst.
+// The graph isn't modified if ctx has already been cancelled.
+func (d *DependencyGraph) AddDependency(ctx context.Context, src, dst *bazel.Label) error {
+  if err := ctx.Err(); err != nil {
+    return err
+  }
   srcID := d.labelToID[src.String()]
   dstID := d.labelToID[dst.String()]
   if srcID == 0 {
@@ -222,9 +290,13 @@ func (d *DependencyGraph) AddDependency(src, dst *bazel.Label) error {
   }
   cyclicEdges := d.edgesFromTo(dstNode, srcNode)
   if len(cyclicEdges) != 0 {
+    // Include the edge that closes the cycle, so the group records it.
+    cyclicEdges = append(cyclicEdges, d.graph.NewEdge(srcNode, dstNode))
+    d.conf.logf(VerbosityResolutions, "Merging a cycle of %d dependencies through %s and %s into a group", len(cyclicEdges), src, dst)
     if err := d.mergeCycle(cyclicEdges); err != nil {
       return fmt.Errorf("mergeCycle: %v", err)
     }
+    d.mergedCycles++
     return d.outputDOTGraphProgress()
   }
   edge := d.graph.NewEdge(srcNode, dstNode)
@@ -234,8 +306,8 @@ func (d *DependencyGraph) AddDependency(src, dst *bazel.Label) error {
 
 // shiftIfIsPointer returns the Node that node points to, only if node is a pointer LibraryNode.
 func (d *DependencyGraph) shiftIfIsPointer(node Node) Node {
-  libNode := node.(*LibraryNode)
-  if libNode == nil || !libNode.IsPointer {
+  libNode, ok := node.(*LibraryNode)
+  if !ok || !libNode.IsPointer {
     return node
   }
   fromNodes := d.graph.From(node.ID())
@@ -256,6 +328,16 @@ func (d *DependencyGraph) Dependencies(label *bazel.Label) []Node {
   return out
 }
 
+// Dependents returns all nodes that depend on node.
+func (d *DependencyGraph) Dependents(label *bazel.Label) []Node {
+  var out []Node
+  nodes := d.graph.To(d.Node(label).ID())
+  for nodes.Next() {
+    out = append(out, nodes.Node().(Node))
+  }
+  return out
+}
+
 // ChangeLabel changes a node's label.
 func (d *DependencyGraph) ChangeLabel(before, after *bazel.Label) error {
   node := d.Node(before)
@@ -334,6 +416,9 @@ func (d *DependencyGraph) mergeCycle(cyclicEdges []graph.Edge) error {
     groupNode = node
     nodeIDs[groupNode.ID()] = true
   }
+  for _, edge := range cyclicEdges {
+    groupNode.CycleEdges = append(groupNode.CycleEdges, [2]Node{edge.From().(Node), edge.To().(Node)})
+  }
 
   for nodeID := range nodeIDs {
     if nodeID == groupNode.ID() {
@@ -368,23 +453,23 @@ func (d *DependencyGraph) mergeCycle(cyclicEdges []graph.Edge) error {
     }
 
     // Repoint all edges from the node to the group node.
-    fromNodes := d.graph.From(nodeID)
-    for fromNodes.Next() {
-      d.graph.RemoveEdge(nodeID, fromNodes.Node().ID())
-      if fromNodes.Node().ID() == groupNode.ID() {
+    // The graph's iterators stop early if edges are removed while iterating,
+    // so we collect the nodes before changing any edges.
+    for _, fromNode := range graphNodes(d.graph.From(nodeID)) {
+      d.graph.RemoveEdge(nodeID, fromNode.ID())
+      if fromNode.ID() == groupNode.ID() {
         continue
       }
-      d.graph.SetEdge(d.graph.NewEdge(groupNode, fromNodes.Node()))
+      d.graph.SetEdge(d.graph.NewEdge(groupNode, fromNode))
     }
 
 		if repointInboundEdges {
-			toNodes := d.graph.To(nodeID)
-			for toNodes.Next() {
-				d.graph.RemoveEdge(toNodes.Node().ID(), nodeID)
-				if toNodes.Node().ID() == groupNode.ID() {
+			for _, toNode := range graphNodes(d.graph.To(nodeID)) {
+				d.graph.RemoveEdge(toNode.ID(), nodeID)
+				if toNode.ID() == groupNode.ID() {
 					continue
 				}
-				d.graph.SetEdge(d.graph.NewEdge(toNodes.Node(), groupNode))
+				d.graph.SetEdge(d.graph.NewEdge(toNode, groupNode))
 			}
 		}
   }
@@ -406,6 +491,14 @@ func (d *DependencyGraph) mergeCycle(cyclicEdges []graph.Edge) error {
 		}
     d.graph.RemoveNode(nodeID)
     delete(nodeIDs, nodeID)
+    // Cycle edges that went through the removed group now go through the merged group.
+    for i, edge := range groupNode.CycleEdges {
+      for j, n := range edge {
+        if n.ID() == nodeID {
+          groupNode.CycleEdges[i][j] = groupNode
+        }
+      }
+    }
   }
 
   // Add edges from all nodes to the group node.
@@ -426,6 +519,15 @@ func (d *DependencyGraph) mergeCycle(cyclicEdges []graph.Edge) error {
     // TODO: Does absorbing pointer nodes work?
     // TODO: I don't think HasEdgeFromTo is what we want
 
+// graphNodes drains the iterator into a slice.
+func graphNodes(nodes graph.Nodes) []graph.Node {
+  var out []graph.Node
+  for nodes.Next() {
+    out = append(out, nodes.Node())
+  }
+  return out
+}
+
 func (d *DependencyGraph) findGroupNode(nodeIDs map[int64]bool) *GroupNode {
   for nodeID := range nodeIDs {
     switch n := d.graph.Node(nodeID).(type) {
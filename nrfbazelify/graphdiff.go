@@ -0,0 +1,200 @@
+package nrfbazelify
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// GraphSnapshot is the part of a dependency graph that we compare between runs.
+type GraphSnapshot struct {
+  // Node types, keyed by label.
+  Nodes map[string]string
+  // Members of each group, keyed by the group's label.
+  Groups map[string][]string
+  // Edges as "src -> dst" label strings.
+  Edges map[string]bool
+}
+
+func newGraphSnapshot() *GraphSnapshot {
+  return &GraphSnapshot{
+    Nodes: make(map[string]string),
+    Groups: make(map[string][]string),
+    Edges: make(map[string]bool),
+  }
+}
+
+func (g *GraphSnapshot) addNode(label, kind string, members []string) {
+  g.Nodes[label] = kind
+  if kind == "group" {
+    g.Groups[label] = members
+  }
+}
+
+func edgeString(src, dst string) string {
+  return fmt.Sprintf("%s -> %s", src, dst)
+}
+
+// Snapshot takes a snapshot of the graph for diffing.
+func (d *DependencyGraph) Snapshot() *GraphSnapshot {
+  out := newGraphSnapshot()
+  infos, edges := d.exportNodes()
+  labels := make(map[string]string) // node ID -> label
+  for _, info := range infos {
+    labels[info.id] = info.label
+    out.addNode(info.label, info.kind, info.members)
+  }
+  for _, edge := range edges {
+    out.Edges[edgeString(labels[edge[0]], labels[edge[1]])] = true
+  }
+  return out
+}
+
+// ReadGraphSnapshot reads a graph written by OutputGraphML.
+func ReadGraphSnapshot(path string) (*GraphSnapshot, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  var in graphML
+  if err := xml.Unmarshal(data, &in); err != nil {
+    return nil, fmt.Errorf("xml.Unmarshal(%q): %v", path, err)
+  }
+  out := newGraphSnapshot()
+  labels := make(map[string]string) // node ID -> label
+  for _, node := range in.Graph.Nodes {
+    values := make(map[string]string)
+    for _, data := range node.Data {
+      values[data.Key] = data.Value
+    }
+    if values["label"] == "" {
+      return nil, fmt.Errorf("%s: node %q has no label", path, node.ID)
+    }
+    labels[node.ID] = values["label"]
+    out.addNode(values["label"], values["type"], strings.Fields(values["members"]))
+  }
+  for _, edge := range in.Graph.Edges {
+    src, dst := labels[edge.Source], labels[edge.Target]
+    if src == "" || dst == "" {
+      return nil, fmt.Errorf("%s: edge %s -> %s refers to unknown nodes", path, edge.Source, edge.Target)
+    }
+    out.Edges[edgeString(src, dst)] = true
+  }
+  return out, nil
+}
+
+// GraphDiff describes the changes from one graph snapshot to another.
+type GraphDiff struct {
+  AddedNodes, RemovedNodes []string
+  AddedEdges, RemovedEdges []string
+  // Membership changes of groups that exist in both snapshots.
+  Groups []*GroupDiff
+}
+
+// GroupDiff describes how a group's members changed.
+type GroupDiff struct {
+  Label string
+  Added, Removed []string
+}
+
+// DiffGraphs compares two graph snapshots.
+func DiffGraphs(before, after *GraphSnapshot) *GraphDiff {
+  out := &GraphDiff{}
+  out.AddedNodes, out.RemovedNodes = diffKeys(before.Nodes, after.Nodes)
+  out.AddedEdges, out.RemovedEdges = diffSets(boolKeys(before.Edges), boolKeys(after.Edges))
+  for label, afterMembers := range after.Groups {
+    beforeMembers, ok := before.Groups[label]
+    if !ok {
+      continue
+    }
+    added, removed := diffSets(beforeMembers, afterMembers)
+    if len(added) > 0 || len(removed) > 0 {
+      out.Groups = append(out.Groups, &GroupDiff{Label: label, Added: added, Removed: removed})
+    }
+  }
+  sort.Slice(out.Groups, func(i, j int) bool { return out.Groups[i].Label < out.Groups[j].Label })
+  return out
+}
+
+// Empty returns whether there are no changes.
+func (g *GraphDiff) Empty() bool {
+  return len(g.AddedNodes) == 0 && len(g.RemovedNodes) == 0 && len(g.AddedEdges) == 0 && len(g.RemovedEdges) == 0 && len(g.Groups) == 0
+}
+
+// String formats the diff as a report.
+func (g *GraphDiff) String() string {
+  if g.Empty() {
+    return "No changes.\n"
+  }
+  var out strings.Builder
+  writeSection := func(title, prefix string, items []string) {
+    if len(items) == 0 {
+      return
+    }
+    fmt.Fprintf(&out, "%s (%d):\n", title, len(items))
+    for _, item := range items {
+      fmt.Fprintf(&out, "  %s %s\n", prefix, item)
+    }
+  }
+  writeSection("Added targets", "+", g.AddedNodes)
+  writeSection("Removed targets", "-", g.RemovedNodes)
+  writeSection("Added dependencies", "+", g.AddedEdges)
+  writeSection("Removed dependencies", "-", g.RemovedEdges)
+  if len(g.Groups) > 0 {
+    fmt.Fprintf(&out, "Changed groups (%d):\n", len(g.Groups))
+    for _, group := range g.Groups {
+      fmt.Fprintf(&out, "  %s\n", group.Label)
+      for _, member := range group.Added {
+        fmt.Fprintf(&out, "    + %s\n", member)
+      }
+      for _, member := range group.Removed {
+        fmt.Fprintf(&out, "    - %s\n", member)
+      }
+    }
+  }
+  return out.String()
+}
+
+func diffKeys(before, after map[string]string) (added, removed []string) {
+  var beforeKeys, afterKeys []string
+  for key := range before {
+    beforeKeys = append(beforeKeys, key)
+  }
+  for key := range after {
+    afterKeys = append(afterKeys, key)
+  }
+  return diffSets(beforeKeys, afterKeys)
+}
+
+func boolKeys(m map[string]bool) []string {
+  var out []string
+  for key := range m {
+    out = append(out, key)
+  }
+  return out
+}
+
+// diffSets returns the sorted items only in after, and only in before.
+func diffSets(before, after []string) (added, removed []string) {
+  inBefore := make(map[string]bool)
+  for _, item := range before {
+    inBefore[item] = true
+  }
+  inAfter := make(map[string]bool)
+  for _, item := range after {
+    inAfter[item] = true
+    if !inBefore[item] {
+      added = append(added, item)
+    }
+  }
+  for _, item := range before {
+    if !inAfter[item] {
+      removed = append(removed, item)
+    }
+  }
+  sort.Strings(added)
+  sort.Strings(removed)
+  return added, removed
+}
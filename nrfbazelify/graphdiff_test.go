@@ -0,0 +1,64 @@
+package nrfbazelify
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadGraphSnapshot_RoundTrip(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "cycles_nominal")
+  graph, err := LoadGraph(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("LoadGraph(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  path := filepath.Join(t.TempDir(), "graph.graphml")
+  if err := graph.OutputGraphML(path); err != nil {
+    t.Fatalf("OutputGraphML(%q): %v", path, err)
+  }
+  got, err := ReadGraphSnapshot(path)
+  if err != nil {
+    t.Fatalf("ReadGraphSnapshot(%q): %v", path, err)
+  }
+  if diff := cmp.Diff(graph.Snapshot(), got); diff != "" {
+    t.Errorf("ReadGraphSnapshot(%q) (-want +got):\n%s", path, diff)
+  }
+  if len(got.Groups) == 0 {
+    t.Error("snapshot has no groups")
+  }
+}
+
+func TestDiffGraphs(t *testing.T) {
+  before := newGraphSnapshot()
+  before.addNode("//a", "library", []string{"//a:a.h"})
+  before.addNode("//b", "library", []string{"//b:b.h"})
+  before.addNode("//g", "group", []string{"//g:x.h", "//g:y.h"})
+  before.Edges[edgeString("//a", "//b")] = true
+  before.Edges[edgeString("//a", "//g")] = true
+
+  after := newGraphSnapshot()
+  after.addNode("//a", "library", []string{"//a:a.h"})
+  after.addNode("//c", "library", []string{"//c:c.h"})
+  after.addNode("//g", "group", []string{"//g:y.h", "//g:z.h"})
+  after.Edges[edgeString("//a", "//c")] = true
+  after.Edges[edgeString("//a", "//g")] = true
+
+  got := DiffGraphs(before, after)
+  want := &GraphDiff{
+    AddedNodes: []string{"//c"},
+    RemovedNodes: []string{"//b"},
+    AddedEdges: []string{"//a -> //c"},
+    RemovedEdges: []string{"//a -> //b"},
+    Groups: []*GroupDiff{
+      {Label: "//g", Added: []string{"//g:z.h"}, Removed: []string{"//g:x.h"}},
+    },
+  }
+  if diff := cmp.Diff(want, got); diff != "" {
+    t.Errorf("DiffGraphs (-want +got):\n%s", diff)
+  }
+  if !DiffGraphs(after, after).Empty() {
+    t.Errorf("DiffGraphs(after, after) is not empty")
+  }
+}
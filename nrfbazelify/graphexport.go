@@ -0,0 +1,264 @@
+package nrfbazelify
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+)
+
+// Graph formats supported by OutputGraph.
+const (
+  graphFormatDOT = "dot"
+  graphFormatGraphML = "graphml"
+  graphFormatGEXF = "gexf"
+)
+
+// OutputGraph writes the graph to path in the given format.
+func (d *DependencyGraph) OutputGraph(path, format string) error {
+  switch format {
+  case graphFormatDOT:
+    return d.OutputDOTGraph(path)
+  case graphFormatGraphML:
+    return d.OutputGraphML(path)
+  case graphFormatGEXF:
+    return d.OutputGEXF(path)
+  default:
+    return fmt.Errorf("unknown graph format %q", format)
+  }
+}
+
+// nodeInfo holds the attributes we export for each node.
+type nodeInfo struct {
+  id string
+  label string
+  kind string // library, pointer, group, override or remap
+  pkg string
+  files int
+  members []string // srcs and hdrs of libraries and groups, sorted
+}
+
+func newNodeInfo(node Node) *nodeInfo {
+  info := &nodeInfo{
+    id: strconv.FormatInt(node.ID(), 10),
+    label: node.Label().String(),
+    pkg: node.Label().Dir(),
+  }
+  switch n := node.(type) {
+  case *LibraryNode:
+    info.kind = "library"
+    if n.IsPointer {
+      info.kind = "pointer"
+    }
+    info.files = len(n.Srcs) + len(n.Hdrs)
+    info.members = memberStrings(n.Srcs, n.Hdrs)
+  case *GroupNode:
+    info.kind = "group"
+    info.files = len(n.Srcs) + len(n.Hdrs)
+    info.members = memberStrings(n.Srcs, n.Hdrs)
+  case *OverrideNode:
+    info.kind = "override"
+  case *RemapNode:
+    info.kind = "remap"
+  case *SelectNode:
+    info.kind = "select"
+  case *FilegroupNode:
+    info.kind = "filegroup"
+    info.files = len(n.Srcs)
+    info.members = memberStrings(n.Srcs, nil)
+  }
+  return info
+}
+
+func memberStrings(srcs, hdrs []*bazel.Label) []string {
+  var out []string
+  for _, label := range append(append([]*bazel.Label{}, srcs...), hdrs...) {
+    out = append(out, label.String())
+  }
+  sort.Strings(out)
+  return out
+}
+
+// exportNodes returns info for all nodes, and all edges as pairs of node IDs,
+// both in a deterministic order.
+func (d *DependencyGraph) exportNodes() ([]*nodeInfo, [][2]string) {
+  nodes := d.Nodes()
+  sortNodes(nodes)
+  var infos []*nodeInfo
+  var edges [][2]string
+  for _, node := range nodes {
+    info := newNodeInfo(node)
+    infos = append(infos, info)
+    deps := d.Dependencies(node.Label())
+    sortNodes(deps)
+    for _, dep := range deps {
+      edges = append(edges, [2]string{info.id, strconv.FormatInt(dep.ID(), 10)})
+    }
+  }
+  return infos, edges
+}
+
+type graphML struct {
+  XMLName xml.Name `xml:"graphml"`
+  Xmlns string `xml:"xmlns,attr"`
+  Keys []graphMLKey `xml:"key"`
+  Graph graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+  ID string `xml:"id,attr"`
+  For string `xml:"for,attr"`
+  Name string `xml:"attr.name,attr"`
+  Type string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+  ID string `xml:"id,attr"`
+  EdgeDefault string `xml:"edgedefault,attr"`
+  Nodes []graphMLNode `xml:"node"`
+  Edges []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+  ID string `xml:"id,attr"`
+  Data []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+  Key string `xml:"key,attr"`
+  Value string `xml:",chardata"`
+}
+
+type graphMLEdge struct {
+  Source string `xml:"source,attr"`
+  Target string `xml:"target,attr"`
+}
+
+// OutputGraphML writes the graph as GraphML, which yEd and Gephi can read.
+// Nodes have label, type, package, files and members attributes.
+// ReadGraphSnapshot reads these files back for diffing.
+func (d *DependencyGraph) OutputGraphML(path string) error {
+  infos, edges := d.exportNodes()
+  out := graphML{
+    Xmlns: "http://graphml.graphdrawing.org/xmlns",
+    Keys: []graphMLKey{
+      {ID: "label", For: "node", Name: "label", Type: "string"},
+      {ID: "type", For: "node", Name: "type", Type: "string"},
+      {ID: "package", For: "node", Name: "package", Type: "string"},
+      {ID: "files", For: "node", Name: "files", Type: "int"},
+      {ID: "members", For: "node", Name: "members", Type: "string"},
+    },
+    Graph: graphMLGraph{
+      ID: "Dependencies",
+      EdgeDefault: "directed",
+    },
+  }
+  for _, info := range infos {
+    out.Graph.Nodes = append(out.Graph.Nodes, graphMLNode{
+      ID: info.id,
+      Data: []graphMLData{
+        {Key: "label", Value: info.label},
+        {Key: "type", Value: info.kind},
+        {Key: "package", Value: info.pkg},
+        {Key: "files", Value: strconv.Itoa(info.files)},
+        {Key: "members", Value: strings.Join(info.members, " ")},
+      },
+    })
+  }
+  for _, edge := range edges {
+    out.Graph.Edges = append(out.Graph.Edges, graphMLEdge{Source: edge[0], Target: edge[1]})
+  }
+  return writeXML(path, out)
+}
+
+type gexf struct {
+  XMLName xml.Name `xml:"gexf"`
+  Xmlns string `xml:"xmlns,attr"`
+  Version string `xml:"version,attr"`
+  Graph gexfGraph `xml:"graph"`
+}
+
+type gexfGraph struct {
+  Mode string `xml:"mode,attr"`
+  DefaultEdgeType string `xml:"defaultedgetype,attr"`
+  Attributes gexfAttributes `xml:"attributes"`
+  Nodes []gexfNode `xml:"nodes>node"`
+  Edges []gexfEdge `xml:"edges>edge"`
+}
+
+type gexfAttributes struct {
+  Class string `xml:"class,attr"`
+  Attributes []gexfAttribute `xml:"attribute"`
+}
+
+type gexfAttribute struct {
+  ID string `xml:"id,attr"`
+  Title string `xml:"title,attr"`
+  Type string `xml:"type,attr"`
+}
+
+type gexfNode struct {
+  ID string `xml:"id,attr"`
+  Label string `xml:"label,attr"`
+  Values []gexfValue `xml:"attvalues>attvalue"`
+}
+
+type gexfValue struct {
+  For string `xml:"for,attr"`
+  Value string `xml:"value,attr"`
+}
+
+type gexfEdge struct {
+  ID string `xml:"id,attr"`
+  Source string `xml:"source,attr"`
+  Target string `xml:"target,attr"`
+}
+
+// OutputGEXF writes the graph as GEXF 1.2, which Gephi can read.
+// Nodes have type, package and files attributes.
+func (d *DependencyGraph) OutputGEXF(path string) error {
+  infos, edges := d.exportNodes()
+  out := gexf{
+    Xmlns: "http://www.gexf.net/1.2draft",
+    Version: "1.2",
+    Graph: gexfGraph{
+      Mode: "static",
+      DefaultEdgeType: "directed",
+      Attributes: gexfAttributes{
+        Class: "node",
+        Attributes: []gexfAttribute{
+          {ID: "type", Title: "type", Type: "string"},
+          {ID: "package", Title: "package", Type: "string"},
+          {ID: "files", Title: "files", Type: "integer"},
+        },
+      },
+    },
+  }
+  for _, info := range infos {
+    out.Graph.Nodes = append(out.Graph.Nodes, gexfNode{
+      ID: info.id,
+      Label: info.label,
+      Values: []gexfValue{
+        {For: "type", Value: info.kind},
+        {For: "package", Value: info.pkg},
+        {For: "files", Value: strconv.Itoa(info.files)},
+      },
+    })
+  }
+  for i, edge := range edges {
+    out.Graph.Edges = append(out.Graph.Edges, gexfEdge{ID: strconv.Itoa(i), Source: edge[0], Target: edge[1]})
+  }
+  return writeXML(path, out)
+}
+
+func writeXML(path string, v interface{}) error {
+  out, err := xml.MarshalIndent(v, "", "  ")
+  if err != nil {
+    return fmt.Errorf("xml.Marshal: %v", err)
+  }
+  out = append([]byte(xml.Header), out...)
+  return writeFileAtomic(path, out, 0640)
+}
@@ -0,0 +1,88 @@
+package nrfbazelify
+
+import (
+	"context"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDependencyGraph_OutputGraphML(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "nominal")
+  graph, err := LoadGraph(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("LoadGraph(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  path := filepath.Join(t.TempDir(), "graph.graphml")
+  if err := graph.OutputGraph(path, graphFormatGraphML); err != nil {
+    t.Fatalf("OutputGraph(%q): %v", path, err)
+  }
+  data, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatalf("ReadFile(%q): %v", path, err)
+  }
+  var got graphML
+  if err := xml.Unmarshal(data, &got); err != nil {
+    t.Fatalf("xml.Unmarshal: %v", err)
+  }
+  nodes := make(map[string][]graphMLData)
+  for _, node := range got.Graph.Nodes {
+    nodes[node.Data[0].Value] = node.Data[1:]
+  }
+  want := []graphMLData{
+    {Key: "type", Value: "library"},
+    {Key: "package", Value: "nominal"},
+    {Key: "files", Value: "2"},
+    {Key: "members", Value: "//nominal:b.c //nominal:b.h"},
+  }
+  if diff := cmp.Diff(want, nodes["//nominal:b"]); diff != "" {
+    t.Errorf("//nominal:b attributes (-want +got):\n%s", diff)
+  }
+  if len(got.Graph.Nodes) != len(graph.Nodes()) {
+    t.Errorf("got %d nodes, want %d", len(got.Graph.Nodes), len(graph.Nodes()))
+  }
+  if len(got.Graph.Edges) == 0 {
+    t.Error("got no edges")
+  }
+}
+
+func TestDependencyGraph_OutputGEXF(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "nominal")
+  graph, err := LoadGraph(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("LoadGraph(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  path := filepath.Join(t.TempDir(), "graph.gexf")
+  if err := graph.OutputGraph(path, graphFormatGEXF); err != nil {
+    t.Fatalf("OutputGraph(%q): %v", path, err)
+  }
+  data, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatalf("ReadFile(%q): %v", path, err)
+  }
+  var got gexf
+  if err := xml.Unmarshal(data, &got); err != nil {
+    t.Fatalf("xml.Unmarshal: %v", err)
+  }
+  var labels []string
+  for _, node := range got.Graph.Nodes {
+    labels = append(labels, node.Label)
+  }
+  want := []string{"//nominal/dir:c", "//nominal:a", "//nominal:b"}
+  if diff := cmp.Diff(want, labels); diff != "" {
+    t.Errorf("node labels (-want +got):\n%s", diff)
+  }
+  if len(got.Graph.Edges) == 0 {
+    t.Error("got no edges")
+  }
+}
+
+func TestDependencyGraph_OutputGraphUnknownFormat(t *testing.T) {
+  graph := NewDependencyGraph(&Config{}, "")
+  if err := graph.OutputGraph(filepath.Join(t.TempDir(), "graph"), "svg"); err == nil {
+    t.Error("OutputGraph: got nil error, want error")
+  }
+}
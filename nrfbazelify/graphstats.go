@@ -2,10 +2,13 @@ package nrfbazelify
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"text/template"
+	"time"
 
 	"github.com/Michaelhobo/nrfbazel/internal/bazel"
 	"gonum.org/v1/gonum/graph/encoding/dot"
@@ -16,10 +19,92 @@ var reportTemplate = template.Must(template.New("report").Parse(`Graph stats:
   Node count: {{ .NodeCount }}
   Edge count: {{ .EdgeCount }}
   Group count: {{ .GroupCount }}
+  Orphan header count: {{ len .OrphanHeaders }}
+  Orphan source count: {{ len .OrphanSources }}
+  Header-only library count: {{ .HeaderOnly }}
+{{- if .MergedMacroHeaders }}
+  Merged macro header libraries: {{ .MergedMacroHeaders }}
+{{- end }}
+{{- if .DisabledModules }}
+  Pruned disabled module libraries: {{ .DisabledModules }}
+{{- end }}
+{{- if .MostDependedOn }}
+  Most depended on:
+{{- range .MostDependedOn }}
+    {{ .InDegree }} {{ .Label }}
+{{- end }}
+{{- end }}
+{{- if .MostDependencies }}
+  Most dependencies:
+{{- range .MostDependencies }}
+    {{ .OutDegree }} {{ .Label }}
+{{- end }}
+{{- end }}
+{{- if .TopBottlenecks }}
+  Bottlenecks, by targets only reachable through them:
+{{- range .TopBottlenecks }}
+    {{ .Dominated }} {{ .Label }}
+{{- end }}
+{{- end }}
+{{- if .AutoResolved }}
+  Automatically resolved includes:
+{{- range .AutoResolved }}
+    {{ . }}
+{{- end }}
+{{- end }}
+{{- if .DeepestChains }}
+  Deepest dependency chains:
+{{- range .DeepestChains }}
+    {{ len . }}: {{ range $i, $label := . }}{{ if $i }} -> {{ end }}{{ $label }}{{ end }}
+{{- end }}
+{{- end }}
+{{- if .OrphanSources }}
+  Sources in no library, add them to source_sets:
+{{- range .OrphanSources }}
+    {{ . }}
+{{- end }}
+{{- end }}
+{{- with .Unmatched }}
+{{- if .Len }}
+  .bazelifyrc entries that no include matched:
+{{- range .IncludeOverrides }}
+    include_overrides: {{ . }}
+{{- end }}
+{{- range .Remaps }}
+    remaps: {{ . }}
+{{- end }}
+{{- range .IgnoreHeaders }}
+    ignore_headers: {{ . }}
+{{- end }}
+{{- end }}
+{{- end }}
+`))
+
+var groupReportTemplate = template.Must(template.New("groups").Parse(`{{ len . }} groups
+{{- range . }}
+
+{{ .Label }}
+  hdrs:
+{{- range .Hdrs }}
+    {{ . }}
+{{- end }}
+{{- if .Srcs }}
+  srcs:
+{{- range .Srcs }}
+    {{ . }}
+{{- end }}
+{{- end }}
+  merged because of these dependency cycle edges:
+{{- range .CycleEdges }}
+    {{ . }}
+{{- end }}
+{{- end }}
 `))
 
 // NewGraphStats creates a new GraphStats instance from a snapshot of the current graph.
-func NewGraphStats(conf *Config, graph *DependencyGraph) (*GraphStats, error) {
+// The report lists the topN most depended on libraries, libraries with the
+// most dependencies, and deepest dependency chains.
+func NewGraphStats(conf *Config, graph *DependencyGraph, topN int) (*GraphStats, error) {
   namedGroupGraphs := make(map[string]*simple.DirectedGraph)
   for _, byLastHeader := range conf.NamedGroups {
     for _, name := range byLastHeader {
@@ -34,21 +119,129 @@ func NewGraphStats(conf *Config, graph *DependencyGraph) (*GraphStats, error) {
       namedGroupGraphs[name] = subGraph
     }
   }
+  // Groups named after their headers.
+  for _, node := range graph.Nodes() {
+    if _, ok := node.(*GroupNode); !ok || namedGroupGraphs[node.Label().Name()] != nil {
+      continue
+    }
+    subGraph, err := newSubGraph(graph, node.Label())
+    if err != nil {
+      return nil, fmt.Errorf("creating subgraph for group %q: %v", node.Label().Name(), err)
+    }
+    namedGroupGraphs[node.Label().Name()] = subGraph
+  }
+  degrees := nodeDegrees(graph)
+  allBottlenecks, err := bottlenecks(graph, conf.Roots)
+  if err != nil {
+    return nil, fmt.Errorf("bottlenecks: %v", err)
+  }
+  topBottlenecks := allBottlenecks
+  if len(topBottlenecks) > topN {
+    topBottlenecks = topBottlenecks[:topN]
+  }
+  sdkVersion, err := DetectSDKVersion(conf.SDKDir)
+  if err != nil {
+    return nil, fmt.Errorf("DetectSDKVersion: %v", err)
+  }
+  packageTargets := make(map[string]int)
+  for _, node := range graph.Nodes() {
+    packageTargets["//"+node.Label().Dir()]++
+  }
   return &GraphStats{
+    SDKVersion: sdkVersion,
     NodeCount: graph.graph.Nodes().Len(),
     EdgeCount: graph.graph.Edges().Len(),
     GroupCount: len(namedGroupGraphs),
     NamedGroupGraphs: namedGroupGraphs,
+    Degrees: degrees,
+    MostDependedOn: topDegrees(degrees, topN, func(d *NodeDegree) int { return d.InDegree }),
+    MostDependencies: topDegrees(degrees, topN, func(d *NodeDegree) int { return d.OutDegree }),
+    DeepestChains: deepestChains(graph, topN),
+    Groups: newGroupReports(graph),
+    OrphanHeaders: orphanHeaders(graph),
+    HeaderOnly: headerOnlyLibraries(graph),
+    PackageTargets: packageTargets,
+    Bottlenecks: allBottlenecks,
+    TopBottlenecks: topBottlenecks,
   }, nil
 }
 
 // GraphStats contains stats about the dependency graph.
 // It can be used to generate a report.
 type GraphStats struct {
+  SDKVersion string // "" if unknown
   NodeCount int
   EdgeCount int
   GroupCount int
   NamedGroupGraphs map[string]*simple.DirectedGraph // named group name -> subgraph
+  // In-degree and out-degree of every node, sorted by label.
+  Degrees []*NodeDegree
+  // Nodes with the highest in-degree and out-degree.
+  MostDependedOn, MostDependencies []*NodeDegree
+  // The longest dependency chains, as labels from the dependent to the deepest dependency.
+  DeepestChains [][]string
+  // Members of every group, and the cycles that formed it, sorted by label.
+  Groups []*GroupReport
+  // Headers that no other library includes, sorted.
+  OrphanHeaders []string
+  // .c files that no library has as srcs, sorted.
+  OrphanSources []string
+  // Number of libraries and groups without srcs.
+  HeaderOnly int
+  // Number of macro header libraries merged into their only dependent.
+  MergedMacroHeaders int
+  // Number of libraries of disabled modules that define_pruning removed.
+  DisabledModules int
+  // Ambiguous includes that were resolved automatically.
+  AutoResolved []*AutoResolution
+  // Targets that dominate others from the roots, most dominated first, and
+  // the first of them.
+  Bottlenecks, TopBottlenecks []*Bottleneck
+  // Number of targets in each package, like "//sdk/components/libraries/log".
+  PackageTargets map[string]int
+  // Number of includes resolved by each method, like "search_paths".
+  ResolutionMethods map[string]int
+  // How long each phase of generation took, like "resolve".
+  Timings map[string]time.Duration
+  // Entries of the .bazelifyrc that no include matched, or nil.
+  Unmatched *UnmatchedEntries
+}
+
+// statsJSON is the machine-readable summary of GraphStats, for tracking
+// generation across SDK versions.
+type statsJSON struct {
+  Version string `json:"version"`
+  SDKVersion string `json:"sdk_version,omitempty"`
+  Nodes int `json:"nodes"`
+  Edges int `json:"edges"`
+  Groups int `json:"groups"`
+  OrphanHeaders int `json:"orphan_headers"`
+  OrphanSources int `json:"orphan_sources"`
+  HeaderOnly int `json:"header_only_libraries"`
+  MergedMacroHeaders int `json:"merged_macro_headers"`
+  DisabledModules int `json:"disabled_modules"`
+  AutoResolved int `json:"auto_resolved"`
+  Bottlenecks []*bottleneckJSON `json:"bottlenecks"`
+  PackageTargets map[string]int `json:"package_targets"`
+  ResolutionMethods map[string]int `json:"resolution_methods"`
+  TimingsMillis map[string]int64 `json:"timings_ms"`
+}
+
+// GroupReport explains what is in a group, and why.
+type GroupReport struct {
+  Label string
+  Hdrs, Srcs []string
+  // Edges of the dependency cycles that were merged into the group, like "//a:b -> //a:c".
+  CycleEdges []string
+}
+
+// NodeDegree counts the edges to and from a node.
+type NodeDegree struct {
+  Label string
+  // Number of nodes that depend on this node.
+  InDegree int
+  // Number of nodes this node depends on.
+  OutDegree int
 }
 
 // Generates a human-readable report of the graph stats.
@@ -58,6 +251,104 @@ func (g *GraphStats) GenerateReport() string {
   return out.String()
 }
 
+type bottleneckJSON struct {
+  Label string `json:"label"`
+  Dominated int `json:"dominated"`
+}
+
+// GenerateJSON generates the counts of the stats as JSON. Maps are written
+// with sorted keys, so runs on the same SDK only differ in their timings.
+func (g *GraphStats) GenerateJSON() ([]byte, error) {
+  out := &statsJSON{
+    Version: version(),
+    SDKVersion: g.SDKVersion,
+    Nodes: g.NodeCount,
+    Edges: g.EdgeCount,
+    Groups: len(g.Groups),
+    OrphanHeaders: len(g.OrphanHeaders),
+    OrphanSources: len(g.OrphanSources),
+    HeaderOnly: g.HeaderOnly,
+    MergedMacroHeaders: g.MergedMacroHeaders,
+    DisabledModules: g.DisabledModules,
+    AutoResolved: len(g.AutoResolved),
+    PackageTargets: g.PackageTargets,
+    ResolutionMethods: g.ResolutionMethods,
+    Bottlenecks: []*bottleneckJSON{},
+    TimingsMillis: make(map[string]int64),
+  }
+  for _, b := range g.TopBottlenecks {
+    out.Bottlenecks = append(out.Bottlenecks, &bottleneckJSON{Label: b.Label, Dominated: b.Dominated})
+  }
+  for phase, d := range g.Timings {
+    out.TimingsMillis[phase] = d.Milliseconds()
+  }
+  data, err := json.MarshalIndent(out, "", "  ")
+  if err != nil {
+    return nil, fmt.Errorf("json.MarshalIndent: %v", err)
+  }
+  return append(data, '\n'), nil
+}
+
+// WriteReport writes the report, its JSON summary, the degree of every node,
+// the bottlenecks, the group report and the orphan headers and sources to dir.
+func (g *GraphStats) WriteReport(dir string) error {
+  reportPath := filepath.Join(dir, "graph_stats.txt")
+  if err := writeFileAtomic(reportPath, []byte(g.GenerateReport()), 0644); err != nil {
+    return fmt.Errorf("writeFileAtomic(%q): %v", reportPath, err)
+  }
+  statsJSON, err := g.GenerateJSON()
+  if err != nil {
+    return err
+  }
+  jsonPath := filepath.Join(dir, "graph_stats.json")
+  if err := writeFileAtomic(jsonPath, statsJSON, 0644); err != nil {
+    return fmt.Errorf("writeFileAtomic(%q): %v", jsonPath, err)
+  }
+  var degrees bytes.Buffer
+  degrees.WriteString("label\tin_degree\tout_degree\n")
+  for _, d := range g.Degrees {
+    fmt.Fprintf(&degrees, "%s\t%d\t%d\n", d.Label, d.InDegree, d.OutDegree)
+  }
+  degreesPath := filepath.Join(dir, "node_degrees.tsv")
+  if err := writeFileAtomic(degreesPath, degrees.Bytes(), 0644); err != nil {
+    return fmt.Errorf("writeFileAtomic(%q): %v", degreesPath, err)
+  }
+  var bottlenecks bytes.Buffer
+  bottlenecks.WriteString("label\tdominated\n")
+  for _, b := range g.Bottlenecks {
+    fmt.Fprintf(&bottlenecks, "%s\t%d\n", b.Label, b.Dominated)
+  }
+  bottlenecksPath := filepath.Join(dir, "bottlenecks.tsv")
+  if err := writeFileAtomic(bottlenecksPath, bottlenecks.Bytes(), 0644); err != nil {
+    return fmt.Errorf("writeFileAtomic(%q): %v", bottlenecksPath, err)
+  }
+  var groups bytes.Buffer
+  if err := groupReportTemplate.Execute(&groups, g.Groups); err != nil {
+    return fmt.Errorf("executing the groups template: %v", err)
+  }
+  groupsPath := filepath.Join(dir, "groups.txt")
+  if err := writeFileAtomic(groupsPath, groups.Bytes(), 0644); err != nil {
+    return fmt.Errorf("writeFileAtomic(%q): %v", groupsPath, err)
+  }
+  var orphans bytes.Buffer
+  for _, hdr := range g.OrphanHeaders {
+    fmt.Fprintln(&orphans, hdr)
+  }
+  orphansPath := filepath.Join(dir, "orphan_headers.txt")
+  if err := writeFileAtomic(orphansPath, orphans.Bytes(), 0644); err != nil {
+    return fmt.Errorf("writeFileAtomic(%q): %v", orphansPath, err)
+  }
+  var orphanSources bytes.Buffer
+  for _, src := range g.OrphanSources {
+    fmt.Fprintln(&orphanSources, src)
+  }
+  orphanSourcesPath := filepath.Join(dir, "orphan_sources.txt")
+  if err := writeFileAtomic(orphanSourcesPath, orphanSources.Bytes(), 0644); err != nil {
+    return fmt.Errorf("writeFileAtomic(%q): %v", orphanSourcesPath, err)
+  }
+  return nil
+}
+
 // WriteNamedGroupGraphs writes subgraphs of all named groups as DOT graphs to the given directory.
 func (g *GraphStats) WriteNamedGroupGraphs(dir string) error {
   for name, graph := range g.NamedGroupGraphs {
@@ -95,4 +386,158 @@ func newSubGraph(graph *DependencyGraph, label *bazel.Label) (*simple.DirectedGr
     out.SetEdge(out.NewEdge(toNode, node))
   }
   return out, nil
-}
\ No newline at end of file
+}
+
+func nodeDegrees(graph *DependencyGraph) []*NodeDegree {
+  var out []*NodeDegree
+  nodes := graph.Nodes()
+  sortNodes(nodes)
+  for _, node := range nodes {
+    out = append(out, &NodeDegree{
+      Label: node.Label().String(),
+      InDegree: graph.graph.To(node.ID()).Len(),
+      OutDegree: graph.graph.From(node.ID()).Len(),
+    })
+  }
+  return out
+}
+
+// topDegrees returns up to n nodes with the highest non-zero degree.
+// Ties are broken by label.
+func topDegrees(degrees []*NodeDegree, n int, degree func(*NodeDegree) int) []*NodeDegree {
+  var out []*NodeDegree
+  for _, d := range degrees {
+    if degree(d) > 0 {
+      out = append(out, d)
+    }
+  }
+  sort.SliceStable(out, func(i, j int) bool { return degree(out[i]) > degree(out[j]) })
+  if len(out) > n {
+    out = out[:n]
+  }
+  return out
+}
+
+// deepestChains returns up to n of the longest dependency chains, each
+// starting at a different node. Chains with a single node are skipped.
+func deepestChains(graph *DependencyGraph, n int) [][]string {
+  // Length of the longest chain starting at each node, and the next node in it.
+  depth := make(map[int64]int)
+  next := make(map[int64]Node)
+  var visit func(node Node) int
+  visit = func(node Node) int {
+    if d, ok := depth[node.ID()]; ok {
+      return d
+    }
+    // Guard against cycles, which should have been merged into groups.
+    depth[node.ID()] = 1
+    deps := graph.Dependencies(node.Label())
+    sortNodes(deps)
+    best := 1
+    for _, dep := range deps {
+      if d := visit(dep) + 1; d > best {
+        best = d
+        next[node.ID()] = dep
+      }
+    }
+    depth[node.ID()] = best
+    return best
+  }
+  nodes := graph.Nodes()
+  sortNodes(nodes)
+  for _, node := range nodes {
+    visit(node)
+  }
+  sort.SliceStable(nodes, func(i, j int) bool { return depth[nodes[i].ID()] > depth[nodes[j].ID()] })
+  var out [][]string
+  for _, node := range nodes {
+    if len(out) >= n || depth[node.ID()] < 2 {
+      break
+    }
+    var chain []string
+    for cur := node; cur != nil; cur = next[cur.ID()] {
+      chain = append(chain, cur.Label().String())
+    }
+    out = append(out, chain)
+  }
+  return out
+}
+
+func newGroupReports(graph *DependencyGraph) []*GroupReport {
+  var out []*GroupReport
+  nodes := graph.Nodes()
+  sortNodes(nodes)
+  for _, node := range nodes {
+    group, ok := node.(*GroupNode)
+    if !ok {
+      continue
+    }
+    report := &GroupReport{Label: group.Label().String()}
+    for _, hdr := range group.Hdrs {
+      report.Hdrs = append(report.Hdrs, hdr.String())
+    }
+    for _, src := range group.Srcs {
+      report.Srcs = append(report.Srcs, src.String())
+    }
+    seen := make(map[string]bool)
+    for _, edge := range group.CycleEdges {
+      if edge[0].ID() == edge[1].ID() {
+        continue
+      }
+      e := edgeString(edge[0].Label().String(), edge[1].Label().String())
+      if !seen[e] {
+        seen[e] = true
+        report.CycleEdges = append(report.CycleEdges, e)
+      }
+    }
+    sort.Strings(report.Hdrs)
+    sort.Strings(report.Srcs)
+    sort.Strings(report.CycleEdges)
+    out = append(out, report)
+  }
+  return out
+}
+
+// orphanHeaders finds the headers that no include resolved to. Includes that
+// resolved to a target without headers, like a label_flag, count for every
+// header with their file name.
+func orphanHeaders(graph *DependencyGraph) []string {
+  var out []string
+  for _, node := range graph.Nodes() {
+    var hdrs []*bazel.Label
+    switch n := node.(type) {
+    case *LibraryNode:
+      if n.IsPointer {
+        continue
+      }
+      hdrs = n.Hdrs
+    case *GroupNode:
+      hdrs = n.Hdrs
+    }
+    for _, hdr := range hdrs {
+      if !graph.includedHeaders[hdr.String()] && !graph.includedNames[hdr.Name()] {
+        out = append(out, hdr.String())
+      }
+    }
+  }
+  sort.Strings(out)
+  return out
+}
+
+// markIncluded records that include resolved to node, for orphanHeaders.
+func (d *DependencyGraph) markIncluded(node Node, include string) {
+  var hdrs []*bazel.Label
+  switch n := d.shiftIfIsPointer(node).(type) {
+  case *LibraryNode:
+    hdrs = n.Hdrs
+  case *GroupNode:
+    hdrs = n.Hdrs
+  }
+  for _, hdr := range hdrs {
+    if hdr.Name() == filepath.Base(include) {
+      d.includedHeaders[hdr.String()] = true
+      return
+    }
+  }
+  d.includedNames[filepath.Base(include)] = true
+}
@@ -0,0 +1,168 @@
+package nrfbazelify
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestNewGraphStats(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "nominal")
+  graph, err := LoadGraph(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("LoadGraph(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  stats, err := NewGraphStats(graph.conf, graph, 1)
+  if err != nil {
+    t.Fatalf("NewGraphStats: %v", err)
+  }
+  wantDegrees := []*NodeDegree{
+    {Label: "//nominal/dir:c", InDegree: 1},
+    {Label: "//nominal:a", OutDegree: 1},
+    {Label: "//nominal:b", InDegree: 1, OutDegree: 1},
+  }
+  if diff := cmp.Diff(wantDegrees, stats.Degrees); diff != "" {
+    t.Errorf("Degrees (-want +got):\n%s", diff)
+  }
+  if diff := cmp.Diff(wantDegrees[:1], stats.MostDependedOn); diff != "" {
+    t.Errorf("MostDependedOn (-want +got):\n%s", diff)
+  }
+  if diff := cmp.Diff(wantDegrees[1:2], stats.MostDependencies); diff != "" {
+    t.Errorf("MostDependencies (-want +got):\n%s", diff)
+  }
+  if diff := cmp.Diff([]string{"//nominal:a.h"}, stats.OrphanHeaders); diff != "" {
+    t.Errorf("OrphanHeaders (-want +got):\n%s", diff)
+  }
+  wantChains := [][]string{{"//nominal:a", "//nominal:b", "//nominal/dir:c"}}
+  if diff := cmp.Diff(wantChains, stats.DeepestChains); diff != "" {
+    t.Errorf("DeepestChains (-want +got):\n%s", diff)
+  }
+
+  dir := t.TempDir()
+  if err := stats.WriteReport(dir); err != nil {
+    t.Fatalf("WriteReport: %v", err)
+  }
+  report, err := os.ReadFile(filepath.Join(dir, "graph_stats.txt"))
+  if err != nil {
+    t.Fatalf("ReadFile: %v", err)
+  }
+  if want := "3: //nominal:a -> //nominal:b -> //nominal/dir:c"; !strings.Contains(string(report), want) {
+    t.Errorf("report missing %q:\n%s", want, report)
+  }
+  orphans, err := os.ReadFile(filepath.Join(dir, "orphan_headers.txt"))
+  if err != nil {
+    t.Fatalf("ReadFile: %v", err)
+  }
+  if diff := cmp.Diff("//nominal:a.h\n", string(orphans)); diff != "" {
+    t.Errorf("orphan_headers.txt (-want +got):\n%s", diff)
+  }
+  degrees, err := os.ReadFile(filepath.Join(dir, "node_degrees.tsv"))
+  if err != nil {
+    t.Fatalf("ReadFile: %v", err)
+  }
+  if want := "//nominal:b\t1\t1\n"; !strings.Contains(string(degrees), want) {
+    t.Errorf("node_degrees.tsv missing %q:\n%s", want, degrees)
+  }
+}
+
+func TestNewGraphStats_OrphanHeadersPerHeader(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "granularity")
+  graph, err := LoadGraph(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("LoadGraph(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  stats, err := NewGraphStats(graph.conf, graph, 1)
+  if err != nil {
+    t.Fatalf("NewGraphStats: %v", err)
+  }
+  // app.h includes fifo's library through app_fifo.h, and app_fifo.c includes
+  // app_fifo_internal.h, but nothing includes app_fifo_unused.h.
+  want := []string{
+    "//granularity/app:app.h",
+    "//granularity/fifo:app_fifo_unused.h",
+    "//granularity/util:app_error.h",
+  }
+  if diff := cmp.Diff(want, stats.OrphanHeaders); diff != "" {
+    t.Errorf("OrphanHeaders (-want +got):\n%s", diff)
+  }
+}
+
+func TestGenerateBuildFiles_StatsJSON(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "nominal")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  data, err := os.ReadFile(filepath.Join(sdkDir, bazelifyOutDirname, "graph_stats.json"))
+  if err != nil {
+    t.Fatalf("ReadFile: %v", err)
+  }
+  var got statsJSON
+  if err := json.Unmarshal(data, &got); err != nil {
+    t.Fatalf("json.Unmarshal: %v", err)
+  }
+  for _, phase := range []string{"resolve", "output", "total"} {
+    if _, ok := got.TimingsMillis[phase]; !ok {
+      t.Errorf("timings_ms has no %q:\n%s", phase, data)
+    }
+  }
+  want := statsJSON{
+    Version: version(),
+    Nodes: 3,
+    Edges: 2,
+    OrphanHeaders: 1,
+    HeaderOnly: 1,
+    Bottlenecks: []*bottleneckJSON{
+      {Label: "//nominal:a", Dominated: 2},
+      {Label: "//nominal:b", Dominated: 1},
+    },
+    PackageTargets: map[string]int{
+      "//nominal": 2,
+      "//nominal/dir": 1,
+    },
+    ResolutionMethods: map[string]int{
+      resolvedByOnlyCandidate: 1,
+      resolvedBySearchPath: 1,
+    },
+  }
+  if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(statsJSON{}, "TimingsMillis")); diff != "" {
+    t.Errorf("graph_stats.json (-want +got):\n%s", diff)
+  }
+}
+
+func TestNewGraphStats_Groups(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "cycles_nominal")
+  graph, err := LoadGraph(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("LoadGraph(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  stats, err := NewGraphStats(graph.conf, graph, 10)
+  if err != nil {
+    t.Fatalf("NewGraphStats: %v", err)
+  }
+  want := []*GroupReport{
+    {
+      Label: "//cycles_nominal:abcd",
+      Hdrs: []string{
+        "//cycles_nominal/dir2:d.h",
+        "//cycles_nominal/dir:c.h",
+        "//cycles_nominal:a.h",
+        "//cycles_nominal:b.h",
+      },
+      CycleEdges: []string{
+        "//cycles_nominal/dir2:d -> //cycles_nominal:a",
+        "//cycles_nominal/dir:c -> //cycles_nominal/dir2:d",
+        "//cycles_nominal:a -> //cycles_nominal:b",
+        "//cycles_nominal:b -> //cycles_nominal/dir:c",
+      },
+    },
+  }
+  if diff := cmp.Diff(want, stats.Groups); diff != "" {
+    t.Errorf("Groups (-want +got):\n%s", diff)
+  }
+}
@@ -4,13 +4,15 @@ import (
   "fmt"
   "path/filepath"
   "sort"
+  "strings"
 
   "github.com/Michaelhobo/nrfbazel/internal/bazel"
 )
 
 // NameGroups sets the name of all GroupNodes in the graph, and returns any nodes that haven't been named.
+// Groups in named_groups are named first, so automatic names can't take their names.
 func NameGroups(conf *Config, depGraph *DependencyGraph) ([]*GroupNode, error) {
-  var out []*GroupNode
+  var unnamed []*GroupNode
   for _, node := range depGraph.Nodes() {
     groupNode, isGroupNode := node.(*GroupNode)
     if !isGroupNode {
@@ -19,7 +21,7 @@ func NameGroups(conf *Config, depGraph *DependencyGraph) ([]*GroupNode, error) {
     if len(groupNode.Hdrs) < 2 {
       return nil, fmt.Errorf("len(%q Hdrs)=%d, must be at least 2", groupNode.Label(), len(groupNode.Hdrs))
     }
-    
+
     // Look up this group in the named groups by first and last header.
     var hdrs []string
     for _, hdr := range groupNode.Hdrs {
@@ -27,7 +29,7 @@ func NameGroups(conf *Config, depGraph *DependencyGraph) ([]*GroupNode, error) {
     }
     sort.Strings(hdrs)
     if conf.NamedGroups[hdrs[0]] == nil || conf.NamedGroups[hdrs[0]][hdrs[len(hdrs) - 1]] == "" {
-      out = append(out, groupNode)
+      unnamed = append(unnamed, groupNode)
       continue
     }
 
@@ -38,7 +40,89 @@ func NameGroups(conf *Config, depGraph *DependencyGraph) ([]*GroupNode, error) {
     if err != nil {
       return nil, fmt.Errorf("bazel.NewLabel(%q, %q): %v", dir, name, err)
     }
+    conf.logf(VerbosityResolutions, "Renaming group %s to %s", groupNode.Label(), newLabel)
+    depGraph.ChangeLabel(groupNode.Label(), newLabel)
+  }
+  if conf.DisableAutoGroupNames || len(unnamed) == 0 {
+    return unnamed, nil
+  }
+
+  // Name the rest after their headers, in a stable order, so when two groups
+  // get the same name, the same one keeps it every run.
+  sort.Slice(unnamed, func(i, j int) bool {
+    return firstHdr(unnamed[i]) < firstHdr(unnamed[j])
+  })
+  var out []*GroupNode
+  var autoNamed int
+  for _, groupNode := range unnamed {
+    name := autoGroupName(groupNode)
+    if name == "" {
+      out = append(out, groupNode)
+      continue
+    }
+    dir := filepath.Join(conf.WorkspaceDir, groupNode.Label().Dir())
+    newLabel, err := bazel.NewLabel(dir, name, conf.WorkspaceDir)
+    if err != nil || depGraph.Node(newLabel) != nil {
+      conf.logf(VerbosityResolutions, "Not naming group %s %q, the name is taken or invalid", groupNode.Label(), name)
+      out = append(out, groupNode)
+      continue
+    }
+    conf.logf(VerbosityResolutions, "Renaming group %s to %s, after its headers", groupNode.Label(), newLabel)
     depGraph.ChangeLabel(groupNode.Label(), newLabel)
+    autoNamed++
+  }
+  if autoNamed > 0 {
+    conf.logf(VerbosityPhases, "Named %d groups after their headers", autoNamed)
   }
   return out, nil
 }
+
+// firstHdr returns the first of the group's headers, as a label.
+func firstHdr(groupNode *GroupNode) string {
+  var hdrs []string
+  for _, hdr := range groupNode.Hdrs {
+    hdrs = append(hdrs, hdr.String())
+  }
+  sort.Strings(hdrs)
+  return hdrs[0]
+}
+
+// autoGroupName names a group after the words before "_" that its headers'
+// names start with, if they are one of the names or at least two words, like
+// nrf_sdh for nrf_sdh.h and nrf_sdh_ble.h. Otherwise, it's named after its
+// headers' dir if they are all in one that isn't the group's. Returns "" if
+// neither gives a clear name.
+func autoGroupName(groupNode *GroupNode) string {
+  var common []string
+  dirs := make(map[string]bool)
+  for i, hdr := range groupNode.Hdrs {
+    dirs[hdr.Dir()] = true
+    words := strings.Split(strings.TrimSuffix(hdr.Name(), ".h"), "_")
+    if i == 0 {
+      common = words
+      continue
+    }
+    n := 0
+    for n < len(common) && n < len(words) && common[n] == words[n] {
+      n++
+    }
+    common = common[:n]
+  }
+  prefix := strings.Join(common, "_")
+  isName := false
+  for _, hdr := range groupNode.Hdrs {
+    if strings.TrimSuffix(hdr.Name(), ".h") == prefix {
+      isName = true
+    }
+  }
+  if prefix != "" && (isName || len(common) >= 2) {
+    return prefix
+  }
+  if len(dirs) == 1 {
+    dir := groupNode.Hdrs[0].Dir()
+    if dir != groupNode.Label().Dir() && dir != "" {
+      return filepath.Base(dir)
+    }
+  }
+  return ""
+}
@@ -0,0 +1,58 @@
+package nrfbazelify
+
+import (
+	"testing"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+)
+
+func TestAutoGroupName(t *testing.T) {
+  tests := map[string]struct{
+    hdrs []string
+    want string
+  }{
+    "prefix is a header name": {
+      hdrs: []string{"//sdk/sdh:nrf_sdh.h", "//sdk/sdh:nrf_sdh_ble.h", "//sdk/sdh:nrf_sdh_soc.h"},
+      want: "nrf_sdh",
+    },
+    "two word prefix": {
+      hdrs: []string{"//sdk/a:ble_gatt_db.h", "//sdk/b:ble_gatt_queue.h"},
+      want: "ble_gatt",
+    },
+    "one word prefix, same dir": {
+      hdrs: []string{"//sdk/fifo:app_fifo.h", "//sdk/fifo:app_util.h"},
+      want: "fifo",
+    },
+    "part of a word isn't a prefix": {
+      hdrs: []string{"//sdk/fifo:fifo.h", "//sdk/fifo:fifos.h"},
+      want: "fifo",
+    },
+    "one word prefix, different dirs": {
+      hdrs: []string{"//sdk/a:ble_advdata.h", "//sdk/b:ble_srv_common.h"},
+      want: "",
+    },
+    "in the group's dir": {
+      hdrs: []string{"//sdk:a.h", "//sdk:b.h"},
+      want: "",
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      label, err := bazel.ParseLabel("//sdk:group")
+      if err != nil {
+        t.Fatalf("bazel.ParseLabel: %v", err)
+      }
+      group := &GroupNode{label: label}
+      for _, hdr := range test.hdrs {
+        hdrLabel, err := bazel.ParseLabel(hdr)
+        if err != nil {
+          t.Fatalf("bazel.ParseLabel(%q): %v", hdr, err)
+        }
+        group.Hdrs = append(group.Hdrs, hdrLabel)
+      }
+      if got := autoGroupName(group); got != test.want {
+        t.Errorf("autoGroupName(%v) = %q, want %q", test.hdrs, got, test.want)
+      }
+    })
+  }
+}
@@ -0,0 +1,185 @@
+package nrfbazelify
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+)
+
+// isHeaderOnly reports whether node is a library or group without srcs.
+func isHeaderOnly(node Node) bool {
+  switch n := node.(type) {
+  case *LibraryNode:
+    return !n.IsPointer && len(n.Srcs) == 0 && len(n.SrcsSelect) == 0
+  case *GroupNode:
+    return len(n.Srcs) == 0
+  }
+  return false
+}
+
+// headerOnlyLibraries counts the libraries and groups without srcs.
+func headerOnlyLibraries(graph *DependencyGraph) int {
+  var out int
+  for _, node := range graph.Nodes() {
+    if isHeaderOnly(node) {
+      out++
+    }
+  }
+  return out
+}
+
+// isMacroHeader reports whether the file only has preprocessor directives and
+// comments, like a header of #defines.
+func isMacroHeader(path string) (bool, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return false, err
+  }
+  defer f.Close()
+  scanner := bufio.NewScanner(f)
+  inComment, continued := false, false
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+    wasContinued := continued
+    continued = strings.HasSuffix(line, "\\")
+    if wasContinued {
+      continue
+    }
+    // Strip comments, so only code is left.
+    var code strings.Builder
+    for len(line) > 0 {
+      if inComment {
+        end := strings.Index(line, "*/")
+        if end < 0 {
+          line = ""
+          break
+        }
+        inComment = false
+        line = line[end+2:]
+        continue
+      }
+      if strings.HasPrefix(line, "//") {
+        break
+      }
+      if strings.HasPrefix(line, "/*") {
+        inComment = true
+        line = line[2:]
+        continue
+      }
+      code.WriteByte(line[0])
+      line = line[1:]
+    }
+    text := strings.TrimSpace(code.String())
+    if text != "" && !strings.HasPrefix(text, "#") {
+      return false, nil
+    }
+  }
+  return true, scanner.Err()
+}
+
+// MergeMacroHeaders merges header-only libraries whose headers only have
+// preprocessor directives into their only dependent, if it's a library or
+// group in the same package. The dependent gets their headers and deps.
+// Returns the number of merged libraries.
+func (d *DependencyGraph) MergeMacroHeaders() (int, error) {
+  var merged int
+  for {
+    n, err := d.mergeMacroHeadersOnce()
+    if err != nil {
+      return merged, err
+    }
+    if n == 0 {
+      return merged, nil
+    }
+    merged += n
+  }
+}
+
+func (d *DependencyGraph) mergeMacroHeadersOnce() (int, error) {
+  nodes := d.Nodes()
+  sortNodes(nodes)
+  var merged int
+  for _, node := range nodes {
+    lib, ok := node.(*LibraryNode)
+    if !ok || !isHeaderOnly(lib) || lib.ExportIncludes || d.Node(lib.Label()) == nil {
+      continue
+    }
+    dependents := d.Dependents(lib.Label())
+    if len(dependents) != 1 || dependents[0].Label().Dir() != lib.Label().Dir() {
+      continue
+    }
+    consumer := dependents[0]
+    switch c := consumer.(type) {
+    case *LibraryNode:
+      if c.IsPointer {
+        continue
+      }
+    case *GroupNode:
+    default:
+      continue
+    }
+    macros, err := d.allMacroHeaders(lib)
+    if err != nil {
+      return merged, err
+    }
+    if !macros {
+      continue
+    }
+    if err := d.mergeInto(lib, consumer); err != nil {
+      return merged, fmt.Errorf("merging %s into %s: %v", lib.Label(), consumer.Label(), err)
+    }
+    d.conf.logf(VerbosityResolutions, "Merged macro header library %s into %s", lib.Label(), consumer.Label())
+    merged++
+  }
+  return merged, nil
+}
+
+// allMacroHeaders reports whether all headers of lib are macro headers.
+func (d *DependencyGraph) allMacroHeaders(lib *LibraryNode) (bool, error) {
+  for _, hdr := range lib.Hdrs {
+    path := filepath.Join(d.conf.WorkspaceDir, hdr.Dir(), hdr.Name())
+    macros, err := isMacroHeader(path)
+    if err != nil {
+      return false, fmt.Errorf("isMacroHeader(%q): %v", path, err)
+    }
+    if !macros {
+      return false, nil
+    }
+  }
+  return true, nil
+}
+
+// mergeInto moves the headers and deps of lib to consumer, its only
+// dependent, and removes lib. lib's deps can't depend on consumer, or they
+// would be in a group together.
+func (d *DependencyGraph) mergeInto(lib *LibraryNode, consumer Node) error {
+  var fileNames []string
+  for _, hdr := range lib.Hdrs {
+    fileNames = append(fileNames, hdr.Name())
+  }
+  for _, dep := range d.Dependencies(lib.Label()) {
+    if dep.ID() != consumer.ID() {
+      d.graph.SetEdge(d.graph.NewEdge(consumer, dep))
+    }
+  }
+  if err := d.deleteNode(lib.Label()); err != nil {
+    return err
+  }
+  switch c := consumer.(type) {
+  case *LibraryNode:
+    c.Hdrs = appendMissingLabels(c.Hdrs, lib.Hdrs...)
+    c.TextualHdrs = appendMissingLabels(c.TextualHdrs, lib.TextualHdrs...)
+    bazel.SortLabels(c.Hdrs)
+    bazel.SortLabels(c.TextualHdrs)
+  case *GroupNode:
+    if err := c.Absorb(lib); err != nil {
+      return err
+    }
+  }
+  d.indexFiles(consumer.Label(), fileNames)
+  return nil
+}
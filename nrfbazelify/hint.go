@@ -16,11 +16,13 @@ import (
 // WriteUnresolvedDepsHint writes a new bazelifyrc hint file that contains hints for unresolved dependencies.
 func WriteUnresolvedDepsHint(conf *Config, unresolved []*unresolvedDep) error {
   hint := unresolvedDepsHint(conf, unresolved)
+  conf.logf(VerbosityPhases, "Writing hints for %d unresolved includes", len(unresolved))
 	return writeHintFileErrorf(conf, hint, "found unresolved targets.")
 }
 
 func WriteUnnamedGroupsHint(conf *Config, unnamed []*GroupNode) error {
 	hint := unnamedGroupsHint(conf, unnamed)
+  conf.logf(VerbosityPhases, "Writing hints for %d unnamed groups", len(unnamed))
 	return writeHintFileErrorf(conf, hint, "found grouped rules that haven't been named.")
 }
 
@@ -39,7 +41,7 @@ func writeHintFileErrorf(conf *Config, hint []byte, msg string) error {
   rcPath := filepath.Join(conf.SDKDir, rcFilename)
   rcHintPath := rcPath + ".hint"
   verboseText := ""
-  if conf.Verbose {
+  if conf.Verbosity >= VerbosityPhases {
     verboseText = fmt.Sprintf("\n.bazelifyrc.hint contents:\n%s", string(hint))
   }
   if err := os.WriteFile(rcHintPath, []byte(hint), 0640); err != nil {
@@ -63,6 +65,7 @@ func unresolvedDepsHint(conf *Config, unresolved []*unresolvedDep) []byte {
       pleaseResolve = append(pleaseResolve, label.String())
     }
     possibilities := fmt.Sprintf("INCLUDED BY %s PLEASE RESOLVE: %s", strings.Join(includedBy, ","), strings.Join(pleaseResolve, "|"))
+    conf.logf(VerbosityCandidates, "Hint for %s: %s", dep.dstFileName, possibilities)
     rc.IncludeOverrides = append(rc.IncludeOverrides, &bazelifyrc.IncludeOverride{
 			Include: dep.dstFileName,
 			Label: possibilities,
@@ -74,9 +77,119 @@ func unresolvedDepsHint(conf *Config, unresolved []*unresolvedDep) []byte {
   if err != nil {
     log.Fatalf("prototext.Marshal bazelifyrc hint: %v", err)
   }
+  return append(excludeSuggestionsComment(conf, unresolved), out...)
+}
+
+const (
+  // A dir is only suggested as an exclude if it has all the includers of at
+  // least this many unresolved includes.
+  minExcludeSuggestionCount = 3
+  // A dir is only suggested as an exclude if the unresolved includes whose
+  // includers are all in it are at least 1/minExcludeSuggestionShare of all
+  // the unresolved includes.
+  minExcludeSuggestionShare = 4
+)
+
+// excludeSuggestion is a dir of the primary SDK that the unresolved includes
+// mostly come from.
+type excludeSuggestion struct {
+  dir string // relative to the SDK root
+  count int // unresolved includes with all their includers in dir
+}
+
+// excludeSuggestions finds the dirs of the primary SDK, like examples, that a
+// large share of the unresolved includes only come from. Excluding the dir is
+// usually the fix, rather than an override for each include. Only the deepest
+// of nested dirs is suggested.
+func excludeSuggestions(conf *Config, unresolved []*unresolvedDep) []*excludeSuggestion {
+  sdkRel, err := filepath.Rel(conf.WorkspaceDir, conf.SDKDir)
+  if err != nil {
+    return nil
+  }
+  prefix := filepath.ToSlash(sdkRel) + "/"
+  if sdkRel == "." {
+    prefix = ""
+  }
+  counts := make(map[string]int)
+  for _, dep := range unresolved {
+    // The dir that all includers are in.
+    common, ok := "", false
+    for i, label := range dep.includedBy {
+      dir := label.Dir()
+      if label.Repo() != "" || dir == "" || !strings.HasPrefix(dir, prefix) {
+        ok = false
+        break
+      }
+      dir = strings.TrimPrefix(dir, prefix)
+      if i == 0 {
+        common, ok = dir, true
+        continue
+      }
+      for common != "" && dir != common && !strings.HasPrefix(dir, common + "/") {
+        common = parentDir(common)
+      }
+    }
+    for ok && common != "" {
+      counts[common]++
+      common = parentDir(common)
+    }
+  }
+  var candidates []*excludeSuggestion
+  for dir, count := range counts {
+    if count >= minExcludeSuggestionCount && count * minExcludeSuggestionShare >= len(unresolved) {
+      candidates = append(candidates, &excludeSuggestion{dir: dir, count: count})
+    }
+  }
+  var out []*excludeSuggestion
+  for _, c := range candidates {
+    deepest := true
+    for _, other := range candidates {
+      if strings.HasPrefix(other.dir, c.dir + "/") {
+        deepest = false
+        break
+      }
+    }
+    if deepest {
+      out = append(out, c)
+    }
+  }
+  sort.Slice(out, func(i, j int) bool {
+    if out[i].count != out[j].count {
+      return out[i].count > out[j].count
+    }
+    return out[i].dir < out[j].dir
+  })
   return out
 }
 
+// parentDir returns the parent of a slash-separated relative dir, or "" for
+// a top level dir.
+func parentDir(dir string) string {
+  i := strings.LastIndex(dir, "/")
+  if i < 0 {
+    return ""
+  }
+  return dir[:i]
+}
+
+// excludeSuggestionsComment suggests the excludeSuggestions as a comment for
+// the top of the hint, so they aren't applied without being looked at.
+func excludeSuggestionsComment(conf *Config, unresolved []*unresolvedDep) []byte {
+  suggestions := excludeSuggestions(conf, unresolved)
+  if len(suggestions) == 0 {
+    return nil
+  }
+  var b strings.Builder
+  fmt.Fprintln(&b, "# Most unresolved includes come from these dirs. Excluding them is usually")
+  fmt.Fprintln(&b, "# the fix, instead of an include_overrides entry for each include:")
+  for _, suggestion := range suggestions {
+    fmt.Fprintf(&b, "#   excludes: %q  # %d of %d unresolved includes\n", suggestion.dir, suggestion.count, len(unresolved))
+    conf.logf(VerbosityPhases, "%d of %d unresolved includes come from %s, consider excluding it", suggestion.count, len(unresolved), suggestion.dir)
+  }
+  fmt.Fprintln(&b)
+  return []byte(b.String())
+}
+
 func unnamedGroupsHint(conf *Config, unnamed []*GroupNode) []byte {
   rc := proto.Clone(conf.BazelifyRCProto).(*bazelifyrc.Configuration)
   if rc == nil {
@@ -0,0 +1,294 @@
+package nrfbazelify
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"html"
+	"html/template"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+)
+
+const (
+  // The HTML report is written to this file in .bazelify-out.
+  htmlReportFilename = "report.html"
+  // Graphs with more nodes than this aren't drawn in the HTML report.
+  maxReportGraphNodes = 150
+  // Size of the nodes in the report's graphs, in pixels.
+  reportNodeWidth = 240
+  reportNodeHeight = 20
+  reportColumnWidth = 300
+  reportRowHeight = 28
+)
+
+//go:embed static/report.html
+var reportHTML string
+
+var htmlReportTemplate = template.Must(template.New("report").Parse(reportHTML))
+
+// htmlReport is everything in the HTML report. Stats are nil if generation
+// stopped because of unresolved includes or unnamed groups.
+type htmlReport struct {
+  Version string
+  SDKs []string
+  HintPath string // "" if there are no issues
+  Stats *GraphStats
+  Unresolved []*htmlUnresolved
+  Unnamed [][]string // headers of each unnamed group
+  Groups []*htmlGroup
+  IncludeOverrides [][2]string // include, label
+  SelectOverrides [][2]string // include, cases
+  Unmatched *UnmatchedEntries
+  PackageGraph template.HTML
+  Packages int
+  MaxGraphNodes int
+}
+
+type htmlUnresolved struct {
+  Include string
+  IncludedBy, Possible []string
+}
+
+type htmlGroup struct {
+  *GroupReport
+  Graph template.HTML
+}
+
+// newHTMLReport collects the report for the graph. res and stats may be nil.
+func newHTMLReport(conf *Config, graph *DependencyGraph, res *resolution, stats *GraphStats) (*htmlReport, error) {
+  out := &htmlReport{
+    Version: version(),
+    Stats: stats,
+    MaxGraphNodes: maxReportGraphNodes,
+  }
+  for _, sdkDir := range conf.SDKDirs {
+    rel, err := filepath.Rel(conf.WorkspaceDir, sdkDir)
+    if err != nil {
+      return nil, fmt.Errorf("filepath.Rel: %v", err)
+    }
+    out.SDKs = append(out.SDKs, filepath.ToSlash(rel))
+  }
+  if res != nil {
+    out.Unmatched = res.unmatched
+    for _, dep := range res.unresolved {
+      out.Unresolved = append(out.Unresolved, &htmlUnresolved{
+        Include: dep.dstFileName,
+        IncludedBy: labelsToStrings(dep.includedBy),
+        Possible: labelsToStrings(dep.possible),
+      })
+    }
+    sort.Slice(out.Unresolved, func(i, j int) bool {
+      return out.Unresolved[i].Include < out.Unresolved[j].Include
+    })
+    for _, group := range res.unnamed {
+      hdrs := labelsToStrings(group.Hdrs)
+      sort.Strings(hdrs)
+      out.Unnamed = append(out.Unnamed, hdrs)
+    }
+  }
+  if len(out.Unresolved) > 0 || len(out.Unnamed) > 0 {
+    out.HintPath = filepath.Join(conf.SDKDir, rcFilename+".hint")
+  }
+
+  groups := newGroupReports(graph)
+  if stats != nil {
+    groups = stats.Groups
+  }
+  for _, group := range groups {
+    var edges [][2]string
+    for _, edge := range group.CycleEdges {
+      if parts := strings.SplitN(edge, " -> ", 2); len(parts) == 2 {
+        edges = append(edges, [2]string{parts[0], parts[1]})
+      }
+    }
+    out.Groups = append(out.Groups, &htmlGroup{
+      GroupReport: group,
+      Graph: renderGraphSVG(edges),
+    })
+  }
+
+  for include, override := range conf.IncludeOverrides {
+    out.IncludeOverrides = append(out.IncludeOverrides, [2]string{include, override.Label.String()})
+  }
+  sort.Slice(out.IncludeOverrides, func(i, j int) bool {
+    return out.IncludeOverrides[i][0] < out.IncludeOverrides[j][0]
+  })
+  for include, override := range conf.SelectOverrides {
+    var cases []string
+    for setting, label := range override.Cases {
+      cases = append(cases, fmt.Sprintf("%s: %s", setting, label))
+    }
+    sort.Strings(cases)
+    if override.Default != nil {
+      cases = append(cases, fmt.Sprintf("default: %s", override.Default))
+    }
+    out.SelectOverrides = append(out.SelectOverrides, [2]string{include, strings.Join(cases, ", ")})
+  }
+  sort.Slice(out.SelectOverrides, func(i, j int) bool {
+    return out.SelectOverrides[i][0] < out.SelectOverrides[j][0]
+  })
+
+  edges, packages := packageEdges(graph)
+  out.Packages = packages
+  if packages <= maxReportGraphNodes {
+    out.PackageGraph = renderGraphSVG(edges)
+  }
+  return out, nil
+}
+
+// labelsToStrings converts the labels to strings, in the same order.
+func labelsToStrings(labels []*bazel.Label) []string {
+  var out []string
+  for _, label := range labels {
+    out = append(out, label.String())
+  }
+  return out
+}
+
+// packageEdges returns the dependencies between packages, sorted, and the
+// number of packages.
+func packageEdges(graph *DependencyGraph) ([][2]string, int) {
+  packages := make(map[string]bool)
+  seen := make(map[[2]string]bool)
+  var out [][2]string
+  for _, node := range graph.Nodes() {
+    pkg := "//" + node.Label().Dir()
+    packages[pkg] = true
+    for _, dep := range graph.Dependencies(node.Label()) {
+      edge := [2]string{pkg, "//" + dep.Label().Dir()}
+      if edge[0] == edge[1] || seen[edge] {
+        continue
+      }
+      seen[edge] = true
+      out = append(out, edge)
+    }
+  }
+  sort.Slice(out, func(i, j int) bool {
+    if out[i][0] != out[j][0] {
+      return out[i][0] < out[j][0]
+    }
+    return out[i][1] < out[j][1]
+  })
+  return out, len(packages)
+}
+
+// renderGraphSVG draws the edges as an SVG, with each node in the column of
+// its distance from the nodes nothing depends on. In cycles, where every node
+// has a dependent, the distance is from the first node.
+func renderGraphSVG(edges [][2]string) template.HTML {
+  deps := make(map[string][]string)
+  dependents := make(map[string]int)
+  var nodes []string
+  addNode := func(n string) {
+    if _, ok := deps[n]; !ok {
+      deps[n] = nil
+      nodes = append(nodes, n)
+    }
+  }
+  for _, edge := range edges {
+    addNode(edge[0])
+    addNode(edge[1])
+    deps[edge[0]] = append(deps[edge[0]], edge[1])
+    dependents[edge[1]]++
+  }
+  if len(nodes) == 0 || len(nodes) > maxReportGraphNodes {
+    return ""
+  }
+  sort.Strings(nodes)
+
+  column := make(map[string]int)
+  var frontier []string
+  for _, n := range nodes {
+    if dependents[n] == 0 {
+      column[n] = 0
+      frontier = append(frontier, n)
+    }
+  }
+  for _, start := range nodes {
+    if _, ok := column[start]; !ok && len(frontier) == 0 {
+      column[start] = 0
+      frontier = append(frontier, start)
+    }
+    for len(frontier) > 0 {
+      var next []string
+      for _, n := range frontier {
+        for _, dep := range deps[n] {
+          if _, ok := column[dep]; !ok {
+            column[dep] = column[n] + 1
+            next = append(next, dep)
+          }
+        }
+      }
+      frontier = next
+    }
+  }
+
+  rows := make(map[int]int) // column -> number of nodes in it
+  type point struct{ x, y int }
+  pos := make(map[string]point)
+  width, height := 0, 0
+  for _, n := range nodes {
+    c := column[n]
+    pos[n] = point{c*reportColumnWidth + 10, rows[c]*reportRowHeight + 10}
+    rows[c]++
+    if w := pos[n].x + reportNodeWidth + 10; w > width {
+      width = w
+    }
+    if h := pos[n].y + reportNodeHeight + 10; h > height {
+      height = h
+    }
+  }
+
+  // Back edges in cycles are drawn as arcs below the nodes, so they make room.
+  for _, edge := range edges {
+    if pos[edge[1]].x <= pos[edge[0]].x {
+      height += 2 * reportRowHeight
+      break
+    }
+  }
+
+  var out bytes.Buffer
+  fmt.Fprintf(&out, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`, width, height)
+  out.WriteString(`<defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="6" markerHeight="6" orient="auto"><path d="M0,0 L10,5 L0,10 z" fill="#999"/></marker></defs>`)
+  for _, edge := range edges {
+    from, to := pos[edge[0]], pos[edge[1]]
+    if to.x > from.x {
+      fmt.Fprintf(&out, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#999" marker-end="url(#arrow)"/>`, from.x+reportNodeWidth, from.y+reportNodeHeight/2, to.x, to.y+reportNodeHeight/2)
+      continue
+    }
+    bottom := from.y
+    if to.y > bottom {
+      bottom = to.y
+    }
+    fmt.Fprintf(&out, `<path d="M%d,%d Q%d,%d %d,%d" fill="none" stroke="#999" marker-end="url(#arrow)"/>`, from.x+reportNodeWidth/2, from.y+reportNodeHeight, (from.x+to.x+reportNodeWidth)/2, bottom+reportNodeHeight+3*reportRowHeight, to.x+reportNodeWidth/2, to.y+reportNodeHeight)
+  }
+  for _, n := range nodes {
+    p := pos[n]
+    name := html.EscapeString(n)
+    fmt.Fprintf(&out, `<g><title>%s</title><rect x="%d" y="%d" width="%d" height="%d" fill="#eef" stroke="#333"/>`, name, p.x, p.y, reportNodeWidth, reportNodeHeight)
+    fmt.Fprintf(&out, `<text x="%d" y="%d" font-size="11">%s</text></g>`, p.x+5, p.y+14, name)
+  }
+  out.WriteString(`</svg>`)
+  return template.HTML(out.String())
+}
+
+// writeHTMLReport writes the HTML report to dir.
+func writeHTMLReport(conf *Config, graph *DependencyGraph, res *resolution, stats *GraphStats, dir string) error {
+  report, err := newHTMLReport(conf, graph, res, stats)
+  if err != nil {
+    return err
+  }
+  var out bytes.Buffer
+  if err := htmlReportTemplate.Execute(&out, report); err != nil {
+    return fmt.Errorf("executing the report template: %v", err)
+  }
+  path := filepath.Join(dir, htmlReportFilename)
+  if err := writeFileAtomic(path, out.Bytes(), 0644); err != nil {
+    return fmt.Errorf("writeFileAtomic(%q): %v", path, err)
+  }
+  return nil
+}
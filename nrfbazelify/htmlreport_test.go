@@ -0,0 +1,67 @@
+package nrfbazelify
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateBuildFiles_HTMLReport(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "cycles_nominal")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  report, err := os.ReadFile(filepath.Join(sdkDir, bazelifyOutDirname, htmlReportFilename))
+  if err != nil {
+    t.Fatalf("ReadFile: %v", err)
+  }
+  for _, want := range []string{
+    "<tr><th>Targets</th><td>7</td></tr>",
+    "<summary>//cycles_nominal:abcd (4 hdrs, 0 srcs)</summary>",
+    "<title>//cycles_nominal/dir2:d</title>",
+    "<title>//cycles_nominal/dir2</title>",
+  } {
+    if !strings.Contains(string(report), want) {
+      t.Errorf("report.html doesn't have %q:\n%s", want, report)
+    }
+  }
+  // The report is self-contained.
+  for _, dontWant := range []string{"<script", "<link", "src="} {
+    if strings.Contains(string(report), dontWant) {
+      t.Errorf("report.html has %q, want no external resources", dontWant)
+    }
+  }
+}
+
+func TestGenerateBuildFiles_HTMLReportUnresolved(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "include_does_not_exist")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err == nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): got nil error, want an error", workspaceDir, sdkDir)
+  }
+  t.Cleanup(func() {
+    os.Remove(filepath.Join(sdkDir, rcFilename+".hint"))
+  })
+  report, err := os.ReadFile(filepath.Join(sdkDir, bazelifyOutDirname, htmlReportFilename))
+  if err != nil {
+    t.Fatalf("ReadFile: %v", err)
+  }
+  for _, want := range []string{"1 unresolved includes", "<td>doesnotexist.h</td>", rcFilename + ".hint"} {
+    if !strings.Contains(string(report), want) {
+      t.Errorf("report.html doesn't have %q:\n%s", want, report)
+    }
+  }
+}
+
+func TestRenderGraphSVG(t *testing.T) {
+  got := string(renderGraphSVG([][2]string{{"//a:<b>", "//c:d"}, {"//c:d", "//a:<b>"}}))
+  for _, want := range []string{"<title>//a:&lt;b&gt;</title>", "<line ", "<path d="} {
+    if !strings.Contains(got, want) {
+      t.Errorf("renderGraphSVG doesn't have %q:\n%s", want, got)
+    }
+  }
+  if got := renderGraphSVG(nil); got != "" {
+    t.Errorf("renderGraphSVG(nil) = %q, want empty", got)
+  }
+}
@@ -0,0 +1,105 @@
+package nrfbazelify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+const (
+  clangdFilename = ".clangd"
+  vscodeDir = ".vscode"
+  vscodePropertiesFilename = "c_cpp_properties.json"
+)
+
+var clangdTemplate = template.Must(template.New("clangd").Parse(`# Generated by nrfbazelify.
+CompileFlags:
+  CompilationDatabase: {{ .CompilationDatabase }}
+`))
+
+// IDE configures which IDE configs are generated.
+type IDE struct {
+  Clangd, VSCode bool
+}
+
+// vscodeProperties is the contents of .vscode/c_cpp_properties.json.
+type vscodeProperties struct {
+  Configurations []*vscodeConfiguration `json:"configurations"`
+  Version int `json:"version"`
+}
+
+type vscodeConfiguration struct {
+  Name string `json:"name"`
+  IncludePath []string `json:"includePath"`
+  Defines []string `json:"defines"`
+  CompilerPath string `json:"compilerPath"`
+  CompileCommands string `json:"compileCommands"`
+  IntelliSenseMode string `json:"intelliSenseMode"`
+}
+
+// ideFiles generates the enabled IDE configs in the primary SDK root, by path
+// relative to the workspace. .clangd points clangd at the compilation
+// database. c_cpp_properties.json also lists every include dir and define of
+// the compile commands, for headers that aren't in the database.
+func ideFiles(conf *Config, commands []*compileCommand) (map[string][]byte, error) {
+  sdkFromWorkspace, err := filepath.Rel(conf.WorkspaceDir, conf.SDKDir)
+  if err != nil {
+    return nil, fmt.Errorf("filepath.Rel: %v", err)
+  }
+  out := make(map[string][]byte)
+  if conf.IDE.Clangd {
+    var clangd bytes.Buffer
+    // clangd resolves the database relative to the .clangd file.
+    if err := clangdTemplate.Execute(&clangd, map[string]string{
+      "CompilationDatabase": bazelifyOutDirname,
+    }); err != nil {
+      return nil, fmt.Errorf("clangdTemplate.Execute: %v", err)
+    }
+    out[filepath.Join(sdkFromWorkspace, clangdFilename)] = clangd.Bytes()
+  }
+  if conf.IDE.VSCode {
+    includeSet := make(map[string]bool)
+    defineSet := make(map[string]bool)
+    for _, command := range commands {
+      for _, arg := range command.Arguments {
+        switch {
+        case strings.HasPrefix(arg, "-I"):
+          includeSet[filepath.Join(command.Directory, strings.TrimPrefix(arg, "-I"))] = true
+        case strings.HasPrefix(arg, "-D"):
+          defineSet[strings.TrimPrefix(arg, "-D")] = true
+        }
+      }
+    }
+    vscode := &vscodeConfiguration{
+      Name: "nrfbazelify",
+      IncludePath: sortedKeys(includeSet),
+      Defines: sortedKeys(defineSet),
+      CompilerPath: compilerPath(conf),
+      CompileCommands: filepath.Join(conf.SDKDir, bazelifyOutDirname, compileCommandsFilename),
+      IntelliSenseMode: "gcc-arm",
+    }
+    contents, err := json.MarshalIndent(&vscodeProperties{
+      Configurations: []*vscodeConfiguration{vscode},
+      Version: 4,
+    }, "", "  ")
+    if err != nil {
+      return nil, fmt.Errorf("json.MarshalIndent: %v", err)
+    }
+    out[filepath.Join(sdkFromWorkspace, vscodeDir, vscodePropertiesFilename)] = append(contents, '\n')
+  }
+  return out, nil
+}
+
+// sortedKeys returns the keys of set, sorted.
+func sortedKeys(set map[string]bool) []string {
+  out := []string{}
+  for key := range set {
+    out = append(out, key)
+  }
+  sort.Strings(out)
+  return out
+}
@@ -0,0 +1,376 @@
+package nrfbazelify
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+	"google.golang.org/protobuf/encoding/prototext"
+)
+
+// Characters that can't be in a generated source set name.
+var sourceSetNameReplacer = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// importedProject is what an IDE project says about how to build it.
+// Paths are absolute.
+type importedProject struct {
+  path string
+  name string
+  files []string
+  includeDirs []string
+  defines []string
+}
+
+// ImportProject reads a Segger Embedded Studio, Keil uVision or IAR Embedded
+// Workbench project, and converts it to the contents of a .bazelifyrc for
+// sdkDir. The project's own files become a source set, its include dirs
+// become include_dirs, and its preprocessor definitions become nrf_cc_library
+// defines.
+func ImportProject(sdkDir, projectPath string) ([]byte, error) {
+  var project *importedProject
+  var err error
+  switch ext := filepath.Ext(projectPath); ext {
+  case ".emProject":
+    project, err = readSESProject(projectPath)
+  case ".uvprojx":
+    project, err = readKeilProject(projectPath)
+  case ".ewp":
+    project, err = readIARProject(projectPath)
+  default:
+    return nil, fmt.Errorf("%s: unknown project type %q", projectPath, ext)
+  }
+  if err != nil {
+    return nil, err
+  }
+  rc, err := importedRC(sdkDir, project)
+  if err != nil {
+    return nil, err
+  }
+  out, err := (&prototext.MarshalOptions{Multiline: true}).Marshal(rc)
+  if err != nil {
+    return nil, fmt.Errorf("prototext.Marshal: %v", err)
+  }
+  return out, nil
+}
+
+// sesSolution is the root of a Segger Embedded Studio .emProject file.
+type sesSolution struct {
+  Projects []*sesProject `xml:"project"`
+  Configurations []*sesConfiguration `xml:"configuration"`
+}
+
+type sesProject struct {
+  Name string `xml:"Name,attr"`
+  Configurations []*sesConfiguration `xml:"configuration"`
+  Folders []*sesFolder `xml:"folder"`
+}
+
+type sesConfiguration struct {
+  Name string `xml:"Name,attr"`
+  Defines string `xml:"c_preprocessor_definitions,attr"`
+  IncludeDirs string `xml:"c_user_include_directories,attr"`
+}
+
+type sesFolder struct {
+  Folders []*sesFolder `xml:"folder"`
+  Files []*sesFile `xml:"file"`
+}
+
+type sesFile struct {
+  FileName string `xml:"file_name,attr"`
+}
+
+// readSESProject reads the first project of a Segger Embedded Studio
+// solution. Only the Common configurations are read, since the others, like
+// Debug and Release, are per build.
+func readSESProject(path string) (*importedProject, error) {
+  contents, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  var solution sesSolution
+  if err := xml.Unmarshal(contents, &solution); err != nil {
+    return nil, fmt.Errorf("%s: %v", path, err)
+  }
+  if len(solution.Projects) == 0 {
+    return nil, fmt.Errorf("%s: no projects", path)
+  }
+  project := solution.Projects[0]
+  out := &importedProject{path: path, name: project.Name}
+  abs := func(p string) string {
+    return projectFilePath(path, p)
+  }
+  for _, conf := range append(solution.Configurations, project.Configurations...) {
+    if conf.Name != "Common" {
+      continue
+    }
+    for _, inc := range splitList(conf.IncludeDirs) {
+      out.includeDirs = append(out.includeDirs, abs(inc))
+    }
+    out.defines = append(out.defines, splitList(conf.Defines)...)
+  }
+  var addFolder func(folder *sesFolder)
+  addFolder = func(folder *sesFolder) {
+    for _, file := range folder.Files {
+      out.files = append(out.files, abs(file.FileName))
+    }
+    for _, sub := range folder.Folders {
+      addFolder(sub)
+    }
+  }
+  for _, folder := range project.Folders {
+    addFolder(folder)
+  }
+  return out, nil
+}
+
+// keilProject is the root of a Keil uVision .uvprojx file.
+type keilProject struct {
+  Targets []*keilTarget `xml:"Targets>Target"`
+}
+
+type keilTarget struct {
+  Defines string `xml:"TargetOption>TargetArmAds>Cads>VariousControls>Define"`
+  IncludePath string `xml:"TargetOption>TargetArmAds>Cads>VariousControls>IncludePath"`
+  Files []string `xml:"Groups>Group>Files>File>FilePath"`
+}
+
+// readKeilProject reads the first target of a Keil uVision project.
+func readKeilProject(path string) (*importedProject, error) {
+  contents, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  var project keilProject
+  if err := xml.Unmarshal(contents, &project); err != nil {
+    return nil, fmt.Errorf("%s: %v", path, err)
+  }
+  if len(project.Targets) == 0 {
+    return nil, fmt.Errorf("%s: no targets", path)
+  }
+  target := project.Targets[0]
+  out := &importedProject{
+    path: path,
+    name: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+    // Keil separates defines with spaces or commas.
+    defines: strings.FieldsFunc(target.Defines, func(r rune) bool { return r == ',' || r == ' ' }),
+  }
+  for _, inc := range splitList(target.IncludePath) {
+    out.includeDirs = append(out.includeDirs, projectFilePath(path, inc))
+  }
+  for _, file := range target.Files {
+    out.files = append(out.files, projectFilePath(path, file))
+  }
+  return out, nil
+}
+
+// iarProject is the root of an IAR Embedded Workbench .ewp file.
+type iarProject struct {
+  Configurations []*iarConfiguration `xml:"configuration"`
+  Groups []*iarGroup `xml:"group"`
+}
+
+type iarConfiguration struct {
+  Name string `xml:"name"`
+  Settings []*iarSettings `xml:"settings"`
+}
+
+type iarSettings struct {
+  Name string `xml:"name"`
+  Options []*iarOption `xml:"data>option"`
+}
+
+type iarOption struct {
+  Name string `xml:"name"`
+  States []string `xml:"state"`
+}
+
+type iarGroup struct {
+  Groups []*iarGroup `xml:"group"`
+  Files []string `xml:"file>name"`
+}
+
+// readIARProject reads the compiler options of the first configuration of an
+// IAR Embedded Workbench project, and the files of every group.
+func readIARProject(path string) (*importedProject, error) {
+  contents, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  var project iarProject
+  decoder := xml.NewDecoder(bytes.NewReader(contents))
+  decoder.CharsetReader = latin1Reader
+  if err := decoder.Decode(&project); err != nil {
+    return nil, fmt.Errorf("%s: %v", path, err)
+  }
+  if len(project.Configurations) == 0 {
+    return nil, fmt.Errorf("%s: no configurations", path)
+  }
+  out := &importedProject{
+    path: path,
+    name: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+  }
+  for _, settings := range project.Configurations[0].Settings {
+    // ICCARM is the C compiler.
+    if settings.Name != "ICCARM" {
+      continue
+    }
+    for _, option := range settings.Options {
+      switch option.Name {
+      case "CCDefines":
+        for _, define := range option.States {
+          if define = strings.TrimSpace(define); define != "" {
+            out.defines = append(out.defines, define)
+          }
+        }
+      case "CCIncludePath2":
+        for _, inc := range option.States {
+          if inc = strings.TrimSpace(inc); inc != "" {
+            out.includeDirs = append(out.includeDirs, projectFilePath(path, inc))
+          }
+        }
+      }
+    }
+  }
+  var addGroup func(group *iarGroup)
+  addGroup = func(group *iarGroup) {
+    for _, file := range group.Files {
+      out.files = append(out.files, projectFilePath(path, file))
+    }
+    for _, sub := range group.Groups {
+      addGroup(sub)
+    }
+  }
+  for _, group := range project.Groups {
+    addGroup(group)
+  }
+  return out, nil
+}
+
+// latin1Reader decodes ISO-8859-1, which IAR declares its projects to be in.
+func latin1Reader(charset string, input io.Reader) (io.Reader, error) {
+  if !strings.EqualFold(charset, "iso-8859-1") {
+    return nil, fmt.Errorf("unsupported charset %q", charset)
+  }
+  in, err := io.ReadAll(input)
+  if err != nil {
+    return nil, err
+  }
+  // Every byte is the code point of the same value.
+  out := make([]rune, len(in))
+  for i, b := range in {
+    out[i] = rune(b)
+  }
+  return strings.NewReader(string(out)), nil
+}
+
+// projectFilePath makes a path in an IDE project absolute. Relative paths are
+// relative to the project file's dir, which the project may also refer to as
+// $(ProjectDir) (SES) or $PROJ_DIR$ (IAR). Keil and IAR use backslashes.
+func projectFilePath(projectPath, p string) string {
+  p = strings.ReplaceAll(strings.TrimSpace(p), "\\", "/")
+  for _, prefix := range []string{"$(ProjectDir)/", "$PROJ_DIR$/"} {
+    p = strings.TrimPrefix(p, prefix)
+  }
+  if filepath.IsAbs(p) {
+    return filepath.Clean(p)
+  }
+  return filepath.Join(filepath.Dir(projectPath), filepath.FromSlash(p))
+}
+
+// splitList splits a ;-separated list of an IDE project, skipping empty entries.
+func splitList(list string) []string {
+  var out []string
+  for _, v := range strings.Split(list, ";") {
+    if v = strings.TrimSpace(v); v != "" {
+      out = append(out, v)
+    }
+  }
+  return out
+}
+
+// importedRC converts a project into a bazelifyrc for sdkDir.
+func importedRC(sdkDir string, project *importedProject) (*bazelifyrc.Configuration, error) {
+  rc := &bazelifyrc.Configuration{}
+  seen := make(map[string]bool)
+  for _, dir := range project.includeDirs {
+    rel, err := filepath.Rel(sdkDir, dir)
+    if err != nil {
+      return nil, fmt.Errorf("filepath.Rel(%q, %q): %v", sdkDir, dir, err)
+    }
+    if !seen[rel] {
+      seen[rel] = true
+      rc.IncludeDirs = append(rc.IncludeDirs, filepath.ToSlash(rel))
+    }
+  }
+  if len(project.defines) > 0 {
+    rc.NrfCcLibrary = &bazelifyrc.NrfCcLibrary{
+      Enabled: true,
+      Defines: project.defines,
+    }
+  }
+  sourceSet, err := projectSourceSet(sdkDir, project)
+  if err != nil {
+    return nil, err
+  }
+  if sourceSet != nil {
+    rc.SourceSets = append(rc.SourceSets, sourceSet)
+  }
+  return rc, nil
+}
+
+// projectSourceSet makes a source set of the project's own files. The
+// project's own dir is the closest dir to the project file, among it and its
+// parents, that directly has one of the project's files, like an example's
+// main.c. The own files are the ones in that dir and its subdirs.
+func projectSourceSet(sdkDir string, project *importedProject) (*bazelifyrc.SourceSet, error) {
+  fileDirs := make(map[string]bool)
+  for _, file := range project.files {
+    fileDirs[filepath.Dir(file)] = true
+  }
+  ownDir := ""
+  for dir := filepath.Dir(project.path); ; dir = filepath.Dir(dir) {
+    if fileDirs[dir] {
+      ownDir = dir
+      break
+    }
+    if dir == filepath.Dir(dir) {
+      break
+    }
+  }
+  if ownDir == "" {
+    return nil, nil
+  }
+  dir, err := filepath.Rel(sdkDir, ownDir)
+  if err != nil || strings.HasPrefix(dir, "..") {
+    log.Printf("Not importing the files of %s: %s is not in %s", project.path, ownDir, sdkDir)
+    return nil, nil
+  }
+  out := &bazelifyrc.SourceSet{
+    Name: strings.ToLower(strings.Trim(sourceSetNameReplacer.ReplaceAllString(project.name, "_"), "_")),
+    Dir: filepath.ToSlash(dir),
+  }
+  if out.Name == "" {
+    out.Name = filepath.Base(ownDir)
+  }
+  for _, file := range project.files {
+    rel, err := filepath.Rel(ownDir, file)
+    if err != nil || strings.HasPrefix(rel, "..") {
+      continue
+    }
+    switch filepath.Ext(file) {
+    case ".h":
+      out.Hdrs = append(out.Hdrs, filepath.ToSlash(rel))
+    case ".c", ".S", ".s":
+      out.Srcs = append(out.Srcs, filepath.ToSlash(rel))
+    }
+  }
+  return out, nil
+}
@@ -0,0 +1,60 @@
+package nrfbazelify
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func TestImportProject(t *testing.T) {
+  sdkDir := filepath.Join(mustMakeAbs(t, testDataDir), "import_project")
+  // The same project, for every IDE.
+  want := &bazelifyrc.Configuration{
+    IncludeDirs: []string{"app/pca10056/config", "components/libraries/util"},
+    NrfCcLibrary: &bazelifyrc.NrfCcLibrary{
+      Enabled: true,
+      Defines: []string{"BOARD_PCA10056", "BSP_DEFINES_ONLY", "CONFIG_GPIO_AS_PINRESET", "NRF52840_XXAA"},
+    },
+    // app/ is the closest parent of the project with one of its files.
+    SourceSets: []*bazelifyrc.SourceSet{{
+      Name: "blinky_pca10056",
+      Dir: "app",
+      Srcs: []string{"main.c"},
+      Hdrs: []string{"pca10056/config/sdk_config.h"},
+    }},
+  }
+  tests := map[string]string{
+    // Only the Common configuration's defines are read, not Debug or Release.
+    "SES": "app/pca10056/ses/blinky_pca10056.emProject",
+    "Keil": "app/pca10056/arm5_no_packs/blinky_pca10056.uvprojx",
+    // Only the C compiler's defines are read.
+    "IAR": "app/pca10056/iar/blinky_pca10056.ewp",
+  }
+  for name, path := range tests {
+    t.Run(name, func(t *testing.T) {
+      project := filepath.Join(sdkDir, path)
+      out, err := ImportProject(sdkDir, project)
+      if err != nil {
+        t.Fatalf("ImportProject(%q, %q): %v", sdkDir, project, err)
+      }
+      var got bazelifyrc.Configuration
+      if err := prototext.Unmarshal(out, &got); err != nil {
+        t.Fatalf("prototext.Unmarshal(%s): %v", out, err)
+      }
+      if diff := cmp.Diff(want, &got, protocmp.Transform()); diff != "" {
+        t.Errorf("ImportProject(%q, %q) (-want +got):\n%s", sdkDir, project, diff)
+      }
+    })
+  }
+}
+
+func TestImportProject_UnknownType(t *testing.T) {
+  sdkDir := filepath.Join(mustMakeAbs(t, testDataDir), "import_project")
+  if _, err := ImportProject(sdkDir, filepath.Join(sdkDir, "app/main.c")); err == nil {
+    t.Errorf("ImportProject: got nil error, want an error")
+  }
+}
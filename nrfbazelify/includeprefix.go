@@ -0,0 +1,66 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+)
+
+// IncludePrefix sets the paths that dependents include a library's hdrs with.
+type IncludePrefix struct {
+  Library *bazel.Label
+  StripIncludePrefix, IncludePrefix string
+}
+
+// newIncludePrefix validates an include_prefixes entry of the rc.
+func newIncludePrefix(p *bazelifyrc.IncludePrefix) (*IncludePrefix, error) {
+  label, err := bazel.ParseLabel(p.GetLibrary())
+  if err != nil {
+    return nil, err
+  }
+  if p.GetStripIncludePrefix() == "" && p.GetIncludePrefix() == "" {
+    return nil, fmt.Errorf("no strip_include_prefix or include_prefix")
+  }
+  // Bazel rejects absolute include_prefixes, and any with up-level references.
+  if strings.HasPrefix(p.GetIncludePrefix(), "/") {
+    return nil, fmt.Errorf("include_prefix %q must be relative", p.GetIncludePrefix())
+  }
+  for _, prefix := range []string{p.GetStripIncludePrefix(), p.GetIncludePrefix()} {
+    for _, part := range strings.Split(prefix, "/") {
+      if part == ".." {
+        return nil, fmt.Errorf("%q has an up-level reference", prefix)
+      }
+    }
+  }
+  return &IncludePrefix{
+    Library: label,
+    StripIncludePrefix: p.GetStripIncludePrefix(),
+    IncludePrefix: p.GetIncludePrefix(),
+  }, nil
+}
+
+// applyIncludePrefixes sets the strip_include_prefix and include_prefix of
+// the libraries in include_prefixes.
+func applyIncludePrefixes(conf *Config, files map[string]*buildfile.File) error {
+  for _, prefix := range conf.IncludePrefixes {
+    file := files[prefix.Library.Dir()]
+    found := false
+    if file != nil {
+      file.EachLibrary(func(lib *buildfile.Library) {
+        if lib.Name != prefix.Library.Name() {
+          return
+        }
+        found = true
+        lib.StripIncludePrefix = prefix.StripIncludePrefix
+        lib.IncludePrefix = prefix.IncludePrefix
+      })
+    }
+    if !found {
+      return fmt.Errorf("library %q is not generated", prefix.Library)
+    }
+  }
+  return nil
+}
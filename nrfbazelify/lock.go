@@ -0,0 +1,131 @@
+package nrfbazelify
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+)
+
+const (
+  // Automatic resolutions of ambiguous includes are locked in this file, at
+  // the root of the primary SDK. It is meant to be checked in.
+  lockFilename = "bazelify.lock.json"
+)
+
+// LockFile records how ambiguous includes were resolved, so later runs
+// resolve them the same way even if the heuristics change.
+type LockFile struct {
+  Resolutions []*LockedResolution `json:"resolutions"`
+
+  index map[string]string // include + package -> label
+}
+
+// LockedResolution is a single locked decision.
+type LockedResolution struct {
+  // The include string, like "app_util.h".
+  Include string `json:"include"`
+  // The package of the library that includes it, relative to the workspace.
+  Package string `json:"package"`
+  // The label the include resolves to.
+  Label string `json:"label"`
+}
+
+func lockPath(sdkDir string) string {
+  return filepath.Join(sdkDir, lockFilename)
+}
+
+func lockKey(include, pkg string) string {
+  return include + " " + pkg
+}
+
+// ReadLockFile reads the lock file in sdkDir.
+// A missing lock file is treated as an empty one.
+func ReadLockFile(sdkDir string) (*LockFile, error) {
+  path := lockPath(sdkDir)
+  data, err := os.ReadFile(path)
+  if os.IsNotExist(err) {
+    return &LockFile{}, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  var out LockFile
+  if err := json.Unmarshal(data, &out); err != nil {
+    return nil, fmt.Errorf("json.Unmarshal(%q): %v", path, err)
+  }
+  return &out, nil
+}
+
+// newLockFile locks the given resolutions, for every package that used them.
+func newLockFile(resolutions []*AutoResolution) *LockFile {
+  seen := make(map[string]bool)
+  out := &LockFile{}
+  for _, res := range resolutions {
+    for _, includedBy := range res.IncludedBy {
+      key := lockKey(res.Include, includedBy.Dir())
+      if seen[key] {
+        continue
+      }
+      seen[key] = true
+      out.Resolutions = append(out.Resolutions, &LockedResolution{
+        Include: res.Include,
+        Package: includedBy.Dir(),
+        Label: res.Chosen.String(),
+      })
+    }
+  }
+  sort.Slice(out.Resolutions, func(i, j int) bool {
+    a, b := out.Resolutions[i], out.Resolutions[j]
+    if a.Include != b.Include {
+      return a.Include < b.Include
+    }
+    return a.Package < b.Package
+  })
+  return out
+}
+
+// lookup returns the locked label for the include in the package,
+// or "" if it isn't locked.
+func (l *LockFile) lookup(include, pkg string) string {
+  if l.index == nil {
+    l.index = make(map[string]string)
+    for _, res := range l.Resolutions {
+      l.index[lockKey(res.Include, res.Package)] = res.Label
+    }
+  }
+  return l.index[lockKey(include, pkg)]
+}
+
+// staleLock warns that the label locked for the include of the library with
+// label is no longer one of the candidates, so the include is resolved again.
+// With --strict, it is an error instead.
+func staleLock(label *bazel.Label, include, locked string) error {
+  msg := fmt.Sprintf("%s: %q is locked to %s in %s, which no longer has it", label, include, locked, lockFilename)
+  if *strict {
+    return fmt.Errorf("%s (--strict)", msg)
+  }
+  log.Printf("Warning: %s", msg)
+  return nil
+}
+
+// Write writes the lock file to sdkDir.
+// If there is nothing to lock, any existing lock file is removed.
+func (l *LockFile) Write(sdkDir string) error {
+  path := lockPath(sdkDir)
+  if len(l.Resolutions) == 0 {
+    if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+      return err
+    }
+    return nil
+  }
+  data, err := json.MarshalIndent(l, "", "  ")
+  if err != nil {
+    return fmt.Errorf("json.Marshal: %v", err)
+  }
+  return writeFileAtomic(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,112 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+)
+
+const (
+  // The label_flag that picks the nrf_log backend, next to the backend headers.
+  logBackendFlagName = "log_backend"
+  // The backend log_backend points to if the .bazelifyrc doesn't pick one.
+  defaultLogBackend = "rtt"
+)
+
+var (
+  // Matches nrf_log backend headers, like nrf_log_backend_rtt.h.
+  logBackendHeaderMatcher = regexp.MustCompile(`^nrf_log_backend_(\w+)\.h$`)
+  // Headers that match logBackendHeaderMatcher, but are shared by every backend.
+  notLogBackends = map[string]bool{
+    "interface": true,
+    "serial": true,
+  }
+)
+
+// logBackendName returns the backend of an nrf_log backend header, like "rtt"
+// for nrf_log_backend_rtt.h, or "" if it isn't one.
+func logBackendName(fileName string) string {
+  capture := logBackendHeaderMatcher.FindStringSubmatch(fileName)
+  if capture == nil || notLogBackends[capture[1]] {
+    return ""
+  }
+  return capture[1]
+}
+
+// addLogBackend records the library of an nrf_log backend header in dir, if
+// hdr is one.
+func (s *SDKWalker) addLogBackend(dir string, label, hdr *bazel.Label) {
+  if s.conf.Layout != bazelifyrc.Layout_NRF5_SDK || s.conf.LogBackend.Disabled {
+    return
+  }
+  name := logBackendName(hdr.Name())
+  if name == "" || s.conf.isConfigured(hdr.Name()) {
+    return
+  }
+  s.logBackends[name] = &logBackend{dir: dir, library: label, header: hdr.Name()}
+}
+
+// logBackend is the library of an nrf_log backend.
+type logBackend struct {
+  dir string // absolute path of the header's dir
+  library *bazel.Label
+  header string
+}
+
+// addLogBackendNodes adds the log_backend label_flag next to the default
+// backend's header. Includes of any backend header resolve to it, and it
+// points to the default backend.
+func (s *SDKWalker) addLogBackendNodes() error {
+  if len(s.logBackends) == 0 {
+    return nil
+  }
+  var names []string
+  for name := range s.logBackends {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  defaultName := s.conf.LogBackend.Default
+  if defaultName == "" {
+    defaultName = defaultLogBackend
+    if s.logBackends[defaultName] == nil {
+      defaultName = names[0]
+    }
+  }
+  defaultBackend := s.logBackends[defaultName]
+  if defaultBackend == nil {
+    return fmt.Errorf("log_backend %q not found, found %v", defaultName, names)
+  }
+
+  flagLabel, err := bazel.NewLabel(defaultBackend.dir, logBackendFlagName, s.conf.WorkspaceDir)
+  if err != nil {
+    return fmt.Errorf("bazel.NewLabel(%q, %q): %v", defaultBackend.dir, logBackendFlagName, err)
+  }
+  flag := &buildfile.LabelSetting{
+    Name: logBackendFlagName,
+    BuildSettingDefault: defaultBackend.library.String(),
+    Flag: true,
+  }
+  if err := s.graph.AddRemapNode(flagLabel, s.logBackends[names[0]].header, flag); err != nil {
+    return fmt.Errorf("AddRemapNode(%q): %v", flagLabel, err)
+  }
+  for _, name := range names {
+    backend := s.logBackends[name]
+    if name != names[0] {
+      if err := s.graph.AddRemapFile(backend.header, flagLabel); err != nil {
+        return err
+      }
+    }
+    // Dependents only see the label_flag, so they can't add these includes themselves.
+    if lib, ok := s.graph.Node(backend.library).(*LibraryNode); ok {
+      lib.ExportIncludes = true
+    }
+    // The label_flag depends on every backend, so they are all generated.
+    s.extraDeps = append(s.extraDeps, &resolvedDep{src: flagLabel, dst: backend.library})
+  }
+  s.conf.logf(VerbosityPhases, "Added %s for nrf_log backends %v, defaulting to %s", flagLabel, names, defaultName)
+  return nil
+}
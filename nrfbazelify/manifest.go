@@ -0,0 +1,228 @@
+package nrfbazelify
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+  // The manifest lives in .bazelify-out of the primary SDK.
+  manifestFilename = "manifest.json"
+)
+
+// Manifest records every file nrfbazelify generated, so they can be removed
+// later without touching files written by anyone else.
+type Manifest struct {
+  // Files maps the path of a generated file, relative to the workspace,
+  // to the sha256 of its contents when it was written.
+  Files map[string]string `json:"files"`
+  // SDKDirs are the SDK roots the files were generated for, relative to the
+  // workspace, starting with the primary SDK.
+  SDKDirs []string `json:"sdk_dirs,omitempty"`
+}
+
+func newManifest() *Manifest {
+  return &Manifest{
+    Files: make(map[string]string),
+  }
+}
+
+// manifestPath returns the path to the manifest for the SDK.
+func manifestPath(sdkDir string) string {
+  return filepath.Join(sdkDir, bazelifyOutDirname, manifestFilename)
+}
+
+// Add records a generated file at the absolute path with the given contents.
+func (m *Manifest) Add(workspaceDir, path string, contents []byte) error {
+  rel, err := filepath.Rel(workspaceDir, path)
+  if err != nil {
+    return fmt.Errorf("filepath.Rel(%q, %q): %v", workspaceDir, path, err)
+  }
+  m.Files[rel] = hashContents(contents)
+  return nil
+}
+
+// AddSDKDir records an SDK root, given as an absolute path, that files are
+// generated for.
+func (m *Manifest) AddSDKDir(workspaceDir, sdkDir string) error {
+  rel, err := filepath.Rel(workspaceDir, sdkDir)
+  if err != nil {
+    return fmt.Errorf("filepath.Rel(%q, %q): %v", workspaceDir, sdkDir, err)
+  }
+  m.SDKDirs = append(m.SDKDirs, rel)
+  return nil
+}
+
+// Write writes the manifest to the .bazelify-out directory of the SDK.
+func (m *Manifest) Write(sdkDir string) error {
+  path := manifestPath(sdkDir)
+  if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+    return fmt.Errorf("MkdirAll(%q): %v", filepath.Dir(path), err)
+  }
+  out, err := json.MarshalIndent(m, "", "  ")
+  if err != nil {
+    return fmt.Errorf("json.Marshal: %v", err)
+  }
+  return writeFileAtomic(path, out, 0644)
+}
+
+// ReadManifest reads the manifest written by the last run in the SDK.
+// If no manifest exists, an empty manifest is returned.
+func ReadManifest(sdkDir string) (*Manifest, error) {
+  data, err := os.ReadFile(manifestPath(sdkDir))
+  if os.IsNotExist(err) {
+    return newManifest(), nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  m := newManifest()
+  if err := json.Unmarshal(data, m); err != nil {
+    return nil, fmt.Errorf("json.Unmarshal(%s): %v", manifestPath(sdkDir), err)
+  }
+  return m, nil
+}
+
+// Paths returns the sorted paths of all files in the manifest.
+func (m *Manifest) Paths() []string {
+  var out []string
+  for path := range m.Files {
+    out = append(out, path)
+  }
+  sort.Strings(out)
+  return out
+}
+
+// Unchanged checks whether the file at path, relative to workspaceDir,
+// still has the contents it had when it was generated.
+func (m *Manifest) Unchanged(workspaceDir, path string) (bool, error) {
+  contents, err := os.ReadFile(filepath.Join(workspaceDir, path))
+  if err != nil {
+    return false, err
+  }
+  return m.Files[path] == hashContents(contents), nil
+}
+
+// unrecognizedBuildFiles returns the BUILD files, relative to the workspace,
+// that nrfbazelify didn't generate: they aren't in the manifest with their
+// current contents, and don't start with the banner. In merge mode, files
+// with # keep comments are recognized too, since what they keep isn't lost.
+func unrecognizedBuildFiles(conf *Config, buildFiles []string) ([]string, error) {
+  manifest, err := ReadManifest(conf.SDKDir)
+  if err != nil {
+    return nil, fmt.Errorf("ReadManifest: %v", err)
+  }
+  var out []string
+  for _, path := range buildFiles {
+    rel, err := filepath.Rel(conf.WorkspaceDir, path)
+    if err != nil {
+      return nil, fmt.Errorf("filepath.Rel(%q, %q): %v", conf.WorkspaceDir, path, err)
+    }
+    if conf.Kept[filepath.Dir(rel)] != nil {
+      continue
+    }
+    unchanged, err := manifest.Unchanged(conf.WorkspaceDir, rel)
+    if err != nil {
+      return nil, fmt.Errorf("reading %s: %v", rel, err)
+    }
+    if unchanged {
+      continue
+    }
+    generated, err := hasBanner(path)
+    if err != nil {
+      return nil, err
+    }
+    if !generated {
+      out = append(out, rel)
+    }
+  }
+  sort.Strings(out)
+  return out, nil
+}
+
+// hasBanner checks whether the file at path starts with the banner of
+// generated files.
+func hasBanner(path string) (bool, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return false, err
+  }
+  defer f.Close()
+  scanner := bufio.NewScanner(f)
+  if !scanner.Scan() {
+    return false, scanner.Err()
+  }
+  return strings.HasPrefix(scanner.Text(), "# "+bannerPrefix), nil
+}
+
+func hashContents(contents []byte) string {
+  sum := sha256.Sum256(contents)
+  return hex.EncodeToString(sum[:])
+}
+
+// CleanGeneratedFiles removes everything nrfbazelify generated for the SDKs:
+// generated BUILD and .bzl files listed in the manifest, the hint file,
+// and the .bazelify-out directory.
+// Files that were edited since they were generated are left alone.
+func CleanGeneratedFiles(workspaceDir string, sdkDirs []string) error {
+  if err := checkDirs(workspaceDir, sdkDirs); err != nil {
+    return err
+  }
+  sdkDir := sdkDirs[0]
+  manifest, err := ReadManifest(sdkDir)
+  if err != nil {
+    return fmt.Errorf("ReadManifest: %v", err)
+  }
+  if len(manifest.Files) == 0 {
+    log.Printf("No generated files recorded in %s", manifestPath(sdkDir))
+  }
+  for _, path := range manifest.Paths() {
+    unchanged, err := manifest.Unchanged(workspaceDir, path)
+    if os.IsNotExist(err) {
+      continue
+    }
+    if err != nil {
+      return fmt.Errorf("reading %s: %v", path, err)
+    }
+    if !unchanged {
+      log.Printf("Keeping %s: it was modified after it was generated", path)
+      continue
+    }
+    if err := os.Remove(filepath.Join(workspaceDir, path)); err != nil {
+      return fmt.Errorf("os.Remove(%s): %v", path, err)
+    }
+  }
+  // The chips, toolchain and .vscode dirs only hold generated files, so remove
+  // them if they're empty.
+  for _, dir := range []string{chipsDir, toolchainDir, vscodeDir} {
+    path := filepath.Join(sdkDir, dir)
+    if entries, err := os.ReadDir(path); err == nil && len(entries) == 0 {
+      if err := os.Remove(path); err != nil {
+        return fmt.Errorf("os.Remove(%q): %v", path, err)
+      }
+    }
+  }
+  // Hints are removed from every SDK root, including the ones the rc added.
+  hintDirs := append([]string{}, sdkDirs...)
+  for _, dir := range manifest.SDKDirs {
+    hintDirs = append(hintDirs, filepath.Join(workspaceDir, dir))
+  }
+  for _, dir := range hintDirs {
+    if err := RemoveStaleHint(dir); err != nil {
+      return fmt.Errorf("RemoveStaleHint(%q): %v", dir, err)
+    }
+  }
+  outDir := filepath.Join(sdkDir, bazelifyOutDirname)
+  if err := os.RemoveAll(outDir); err != nil {
+    return fmt.Errorf("os.RemoveAll(%q): %v", outDir, err)
+  }
+  return nil
+}
@@ -0,0 +1,135 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+)
+
+const (
+  // The library with the chip's system and startup files, in the MDK dir.
+  startupLibraryName = "startup"
+  // The filegroup with the SDK's linker scripts, in the MDK dir.
+  linkerScriptsName = "linker_scripts"
+)
+
+var (
+  // Matches the system headers of the MDK, like system_nrf52840.h.
+  // Every chip's system_*.c defines SystemInit, so they can't be linked together.
+  mdkSystemHeaderMatcher = regexp.MustCompile(`^system_nrf52\d*\.h$`)
+)
+
+// isMDKSystemHeader checks whether the file name is an MDK system header.
+func isMDKSystemHeader(name string) bool {
+  return mdkSystemHeaderMatcher.MatchString(name)
+}
+
+// addMDKNodes adds a startup library to every MDK dir found while walking.
+// Its srcs are the system_*.c and gcc_startup_*.S files of every known chip,
+// and are selected by chip in the BUILD file. Startup files can be next to
+// the system files, or in a gcc subdir, like in nRF5 SDKs before 15.0.
+func (s *SDKWalker) addMDKNodes() error {
+  var dirs []string
+  for dir := range s.mdkDirs {
+    dirs = append(dirs, dir)
+  }
+  sort.Strings(dirs)
+  for _, dir := range dirs {
+    label, err := bazel.NewLabel(dir, startupLibraryName, s.conf.WorkspaceDir)
+    if err != nil {
+      return fmt.Errorf("bazel.NewLabel(%q, %q): %v", dir, startupLibraryName, err)
+    }
+    srcsByChip := make(map[string][]*bazel.Label)
+    var srcs []*bazel.Label
+    for _, chip := range knownChips {
+      condition, err := chipsLabel(s.conf, chip.ConfigSetting())
+      if err != nil {
+        return err
+      }
+      files := []string{
+        filepath.Join(dir, fmt.Sprintf("system_%s.c", chip.MDK)),
+        filepath.Join(dir, fmt.Sprintf("gcc_startup_%s.S", chip.MDK)),
+        filepath.Join(dir, "gcc", fmt.Sprintf("gcc_startup_%s.S", chip.MDK)),
+      }
+      for _, file := range files {
+        if _, err := os.Stat(file); err != nil {
+          continue
+        }
+        src, err := bazel.NewLabel(filepath.Dir(file), filepath.Base(file), s.conf.WorkspaceDir)
+        if err != nil {
+          return fmt.Errorf("bazel.NewLabel(%q): %v", file, err)
+        }
+        srcsByChip[condition.String()] = append(srcsByChip[condition.String()], src)
+        srcs = append(srcs, src)
+      }
+    }
+    if err := s.addLinkerScriptsNode(dir); err != nil {
+      return err
+    }
+    if len(srcs) == 0 {
+      continue
+    }
+    if err := s.graph.AddLibraryNode(label, srcs, nil, []string{label.Dir()}); err != nil {
+      return fmt.Errorf("AddLibraryNode(%q): %v", label, err)
+    }
+    s.graph.Node(label).(*LibraryNode).SrcsSelect = srcsByChip
+  }
+  return nil
+}
+
+// addLinkerScriptsNode adds a filegroup with the linker scripts in the MDK
+// dir, or its gcc subdir, like nrf_common.ld. Application linker scripts
+// include them, so nrf_cc_binary adds them to the linker inputs.
+func (s *SDKWalker) addLinkerScriptsNode(dir string) error {
+  var srcs []*bazel.Label
+  for _, path := range s.linkerScripts {
+    if ldDir := filepath.Dir(path); ldDir != dir && ldDir != filepath.Join(dir, "gcc") {
+      continue
+    }
+    src, err := bazel.NewLabel(filepath.Dir(path), filepath.Base(path), s.conf.WorkspaceDir)
+    if err != nil {
+      return fmt.Errorf("bazel.NewLabel(%q): %v", path, err)
+    }
+    srcs = append(srcs, src)
+    s.mdkLinkerScripts[path] = true
+  }
+  if len(srcs) == 0 {
+    return nil
+  }
+  label, err := bazel.NewLabel(dir, linkerScriptsName, s.conf.WorkspaceDir)
+  if err != nil {
+    return fmt.Errorf("bazel.NewLabel(%q, %q): %v", dir, linkerScriptsName, err)
+  }
+  if err := s.graph.AddFilegroupNode(label, srcs); err != nil {
+    return fmt.Errorf("AddFilegroupNode(%q): %v", label, err)
+  }
+  return nil
+}
+
+// linkerScripts finds the filegroup of the SDK's linker scripts, and the dirs
+// to search for them. Returns nil if there is none.
+func linkerScripts(depGraph *DependencyGraph) (*bazel.Label, []string) {
+  nodes := depGraph.Nodes()
+  sortNodes(nodes)
+  for _, node := range nodes {
+    filegroup, ok := node.(*FilegroupNode)
+    if !ok || filegroup.Label().Name() != linkerScriptsName {
+      continue
+    }
+    dirsSet := make(map[string]bool)
+    for _, src := range filegroup.Srcs {
+      dirsSet[src.Dir()] = true
+    }
+    var dirs []string
+    for dir := range dirsSet {
+      dirs = append(dirs, dir)
+    }
+    sort.Strings(dirs)
+    return filegroup.Label(), dirs
+  }
+  return nil, nil
+}
@@ -0,0 +1,41 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+)
+
+// readKept reads what the # keep comments of the existing BUILD files protect,
+// before they're replaced. Files without # keep comments are skipped.
+func readKept(conf *Config, buildFiles []string) (map[string]*buildfile.Kept, error) {
+  out := make(map[string]*buildfile.Kept)
+  for _, path := range buildFiles {
+    kept, err := buildfile.ReadKept(path)
+    if err != nil {
+      return nil, fmt.Errorf("buildfile.ReadKept(%q): %v", path, err)
+    }
+    if kept.Empty() {
+      continue
+    }
+    dir, err := filepath.Rel(conf.WorkspaceDir, filepath.Dir(path))
+    if err != nil {
+      return nil, fmt.Errorf("filepath.Rel(%q, %q): %v", conf.WorkspaceDir, path, err)
+    }
+    out[dir] = kept
+  }
+  return out, nil
+}
+
+// applyKept keeps what the existing BUILD files protect with # keep in the
+// generated files. BUILD files that only have kept rules are generated with
+// just those.
+func applyKept(conf *Config, files map[string]*buildfile.File) {
+  for dir, kept := range conf.Kept {
+    if files[dir] == nil {
+      files[dir] = buildfile.New(filepath.Join(conf.WorkspaceDir, dir))
+    }
+    files[dir].Keep(kept)
+  }
+}
@@ -0,0 +1,99 @@
+package nrfbazelify
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+)
+
+var (
+  // These include dirs, relative to the SDK root, are added for the NCS layout
+  // if they exist.
+  ncsIncludeDirs = []string{
+    "zephyr/include",
+    "nrf/include",
+  }
+)
+
+// addNCSDefaults adds the include dirs and Kconfig excludes of an NCS layout.
+func (conf *Config) addNCSDefaults(sdkDir string, rc *bazelifyrc.Configuration) error {
+  for _, dir := range makeAbs(sdkDir, ncsIncludeDirs) {
+    if info, err := os.Stat(dir); err == nil && info.IsDir() {
+      conf.IncludeDirs = append(conf.IncludeDirs, dir)
+    }
+  }
+  if len(rc.GetKconfigGates()) == 0 {
+    return nil
+  }
+  if rc.GetKconfig() == "" {
+    return fmt.Errorf("kconfig_gates require kconfig to be set")
+  }
+  kconfigPath := filepath.Join(sdkDir, rc.GetKconfig())
+  enabled, err := readKconfig(kconfigPath)
+  if err != nil {
+    return fmt.Errorf("readKconfig(%q): %v", kconfigPath, err)
+  }
+  for _, gate := range rc.GetKconfigGates() {
+    symbol := gate.GetSymbol()
+    if !strings.HasPrefix(symbol, "CONFIG_") {
+      symbol = "CONFIG_" + symbol
+    }
+    if enabled[symbol] {
+      continue
+    }
+    conf.Excludes = append(conf.Excludes, makeAbs(sdkDir, gate.GetDirs())...)
+  }
+  return nil
+}
+
+// ncsIncludeRoots finds the include dirs that contain dir, relative to the
+// workspace. Headers under them are included with path-prefixed forms, like
+// <zephyr/kernel.h>, so dependents need the include dir itself.
+func (conf *Config) ncsIncludeRoots(dir string) []string {
+  var out []string
+  for _, includeDir := range conf.IncludeDirs {
+    // The library's own dir is already an include.
+    if !strings.HasPrefix(dir, includeDir+string(filepath.Separator)) {
+      continue
+    }
+    rel, err := filepath.Rel(conf.WorkspaceDir, includeDir)
+    if err != nil {
+      continue
+    }
+    out = append(out, rel)
+  }
+  return out
+}
+
+// readKconfig reads the enabled symbols in a Kconfig .config file.
+// Symbols set to y or m are enabled.
+func readKconfig(path string) (map[string]bool, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  out := make(map[string]bool)
+  scanner := bufio.NewScanner(file)
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+    if strings.HasPrefix(line, "#") {
+      continue
+    }
+    parts := strings.SplitN(line, "=", 2)
+    if len(parts) != 2 {
+      continue
+    }
+    if parts[1] == "y" || parts[1] == "m" {
+      out[parts[0]] = true
+    }
+  }
+  if err := scanner.Err(); err != nil {
+    return nil, err
+  }
+  return out, nil
+}
@@ -19,7 +19,15 @@ type LibraryNode struct {
   id int64
   label *bazel.Label
   Srcs, Hdrs []*bazel.Label
+  // Headers that are folded into this library, instead of their own.
+  TextualHdrs []*bazel.Label
+  // If set, srcs are selected from these by config_setting label in the BUILD
+  // file, instead of using all Srcs.
+  SrcsSelect map[string][]*bazel.Label
   Includes []string
+  // If set, Includes are generated as the includes attribute instead of
+  // dependents' copts, so they reach dependents through a label_flag.
+  ExportIncludes bool
   // Library nodes that have been merged into group nodes become pointer nodes.
   // Pointer nodes just point to a single group node as a dependency.
   IsPointer bool
@@ -45,7 +53,9 @@ func (l *LibraryNode) ChangeLabel(label *bazel.Label) {
 type GroupNode struct {
   id int64
   label *bazel.Label
-  Srcs, Hdrs []*bazel.Label
+  Srcs, Hdrs, TextualHdrs []*bazel.Label
+  // The edges of the dependency cycles that were merged into this group.
+  CycleEdges [][2]Node
 }
 
 func (g *GroupNode) ID() int64 {
@@ -71,13 +81,19 @@ func (g *GroupNode) Absorb(node Node) error {
   case *GroupNode:
     g.Srcs = append(g.Srcs, n.Srcs...)
     g.Hdrs = append(g.Hdrs, n.Hdrs...)
+    g.TextualHdrs = appendMissingLabels(g.TextualHdrs, n.TextualHdrs...)
+    g.CycleEdges = append(g.CycleEdges, n.CycleEdges...)
     n.Srcs = nil
     n.Hdrs = nil
+    n.TextualHdrs = nil
+    n.CycleEdges = nil
   case *LibraryNode:
     g.Srcs = append(g.Srcs, n.Srcs...)
     g.Hdrs = append(g.Hdrs, n.Hdrs...)
+    g.TextualHdrs = appendMissingLabels(g.TextualHdrs, n.TextualHdrs...)
     n.Srcs = nil
     n.Hdrs = nil
+    n.TextualHdrs = nil
     n.IsPointer = true
   default:
     return fmt.Errorf("node %q not supported", node.Label())
@@ -110,7 +126,46 @@ func (o *OverrideNode) ChangeLabel(label *bazel.Label) {
   o.label = label
 }
 
-// RemapNode is a node generated by remaps.
+// SelectNode is a node generated by select_overrides.
+// It doesn't generate a BUILD rule. Libraries that depend on it get a select()
+// of its labels in their deps. It depends on the nodes of its labels.
+type SelectNode struct {
+  id int64
+  label *bazel.Label
+  Include string
+  Override *SelectOverride
+}
+
+func (s *SelectNode) ID() int64 {
+  return s.id
+}
+
+func (s *SelectNode) DOTID() string {
+  return s.Label().String()
+}
+
+func (s *SelectNode) Label() *bazel.Label {
+  return s.label
+}
+
+func (s *SelectNode) ChangeLabel(label *bazel.Label) {
+  s.label = label
+}
+
+// Labels returns the labels of all cases, and the default, if any.
+func (s *SelectNode) Labels() []*bazel.Label {
+  var out []*bazel.Label
+  for _, label := range s.Override.Cases {
+    out = append(out, label)
+  }
+  if s.Override.Default != nil {
+    out = append(out, s.Override.Default)
+  }
+  bazel.SortLabels(out)
+  return out
+}
+
+// RemapNode is a node generated by remaps, or a label_flag like sdk_config_flag.
 // It generates label settings used to map remap files like the sdk_config per binary.
 type RemapNode struct {
   id int64
@@ -133,3 +188,27 @@ func (r *RemapNode) Label() *bazel.Label {
 func (r *RemapNode) ChangeLabel(label *bazel.Label) {
   r.label = label
 }
+
+// FilegroupNode is a node for files that aren't C sources or headers, like
+// SoftDevice hex files. It generates a filegroup, and nothing includes it.
+type FilegroupNode struct {
+  id int64
+  label *bazel.Label
+  Srcs []*bazel.Label
+}
+
+func (f *FilegroupNode) ID() int64 {
+  return f.id
+}
+
+func (f *FilegroupNode) DOTID() string {
+  return f.Label().String()
+}
+
+func (f *FilegroupNode) Label() *bazel.Label {
+  return f.label
+}
+
+func (f *FilegroupNode) ChangeLabel(label *bazel.Label) {
+  f.label = label
+}
@@ -4,46 +4,74 @@
 package nrfbazelify
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+)
+
+const (
+  // Debugging and analysis outputs are written to this directory in the
+  // primary SDK.
+  bazelifyOutDirname = ".bazelify-out"
 )
 
 var (
   fullGraph = flag.Bool("full_graph", false, "Whether to create a DOT graph of the full graph.")
   progressionGraphs = flag.Bool("progression_graphs", false, "Whether to create a DOT graph for each change in the graph.")
   namedGroupGraphs = flag.Bool("named_group_graphs", false, "Whether to create a DOT graph for each named group.")
+  dotScope = flag.String("dot_scope", "", "If set, create a DOT graph of the subgraph rooted at this directory or target.")
+  dotScopeDepth = flag.Int("dot_scope_depth", -1, "How many levels of dependencies to include in the --dot_scope graph. Negative means all.")
+  statsTopN = flag.Int("stats_top_n", 10, "How many libraries and dependency chains to list in each section of the graph stats report.")
+  pruneUnreachable = flag.Bool("prune_unreachable", false, "Only generate BUILD rules for libraries reachable from the roots in .bazelifyrc.")
+  resolveByProximity = flag.Bool("resolve_by_proximity", false, "Resolve ambiguous includes to the candidate nearest to the including file, if there is only one. Each decision is logged.")
+  strict = flag.Bool("strict", false, "Fail instead of warning when an include is in more than one include_dirs search path, or is locked to a label that no longer has it.")
+  force = flag.Bool("force", false, "Delete existing BUILD files in the SDKs, even if nrfbazelify didn't generate them.")
+  relock = flag.Bool("relock", false, "Ignore "+lockFilename+", and lock the resolutions from this run instead.")
+  selfCheck = flag.Bool("self_check", false, "After generating, read the BUILD files back and fail if they don't match the dependency graph.")
+  fullGraphFormats = flag.String("full_graph_formats", graphFormatDOT, "Comma-separated formats to write the full graph in. Supported: dot, graphml, gexf.")
+  smokeTest = flag.Bool("smoke_test", false, "After generating, run Bazel on the generated files and fail if it can't load or build them.")
+  smokeTestTargets = flag.String("smoke_test_targets", "", "Comma-separated targets or target patterns that --smoke_test builds. If empty, it queries every target in the SDKs instead, which finds loading errors without building.")
+  bazelPath = flag.String("bazel", "bazel", "The Bazel binary that --smoke_test runs.")
 )
 
-// GenerateBuildFiles generates BUILD files for an nRF5 SDK.
-func GenerateBuildFiles(workspaceDir, sdkDir string, verbose bool) error {
-  if !filepath.IsAbs(workspaceDir) {
-    return errors.New("workspace must be an absolute path")
-  }
-  if !filepath.IsAbs(sdkDir) {
-    return errors.New("sdk_dir must be an absolute path")
+// GenerateBuildFiles generates BUILD files for one or more nRF5 SDKs.
+// The first SDK in sdkDirs is the primary SDK, which holds the .bazelifyrc,
+// remap.bzl and .bazelify-out. All SDKs are resolved in a single graph.
+// If ctx is cancelled, generation stops at the next safe point and the error
+// from ctx is returned.
+func GenerateBuildFiles(ctx context.Context, workspaceDir string, sdkDirs []string, verbosity Verbosity) error {
+  start := time.Now()
+  if err := checkDirs(workspaceDir, sdkDirs); err != nil {
+    return err
   }
-  if !strings.HasPrefix(sdkDir, workspaceDir) {
-    return fmt.Errorf("sdk_dir is not inside workspace_dir:\nsdk_dir=%s\nworkspace_dir=%s", sdkDir, workspaceDir)
+  if err := ctx.Err(); err != nil {
+    return err
   }
-  conf, err := ReadConfig(sdkDir, workspaceDir, verbose)
+  conf, err := ReadConfig(sdkDirs, workspaceDir, verbosity)
   if err != nil {
     return fmt.Errorf("ReadBazelifyRC: %v", err)
   }
+  sdkDir := conf.SDKDir
 
   // Setup .bazelify-out directory.
-  bazelifyOutDOTDir := filepath.Join(sdkDir, ".bazelify-out", "dot")
+  bazelifyOutDOTDir := filepath.Join(sdkDir, bazelifyOutDirname, "dot")
 
   fullGraphDir := filepath.Join(bazelifyOutDOTDir, "full_graph")
   progressionGraphsDir := filepath.Join(bazelifyOutDOTDir, "progression_graphs")
   namedGroupGraphsDir := filepath.Join(bazelifyOutDOTDir, "named_group_graphs")
+  scopedGraphDir := filepath.Join(bazelifyOutDOTDir, "scoped_graph")
 
   // Remove all outputs from .bazelify-out file.
-  for _, dir := range []string{fullGraphDir, progressionGraphsDir, namedGroupGraphsDir} {
+  for _, dir := range []string{fullGraphDir, progressionGraphsDir, namedGroupGraphsDir, scopedGraphDir} {
     if err := os.RemoveAll(dir); err != nil {
       return fmt.Errorf("os.RemoveAll(%q): %v", dir, err)
     }
@@ -60,53 +88,171 @@ func GenerateBuildFiles(workspaceDir, sdkDir string, verbose bool) error {
 
   graph := NewDependencyGraph(conf, progGraphDir)
 
-  // Set up output of the full DOT graph.
+  // Set up output of the full graph.
   if *fullGraph {
+    formats := strings.Split(*fullGraphFormats, ",")
+    for _, format := range formats {
+      switch format {
+      case graphFormatDOT, graphFormatGraphML, graphFormatGEXF:
+      default:
+        return fmt.Errorf("unknown --full_graph_formats format %q", format)
+      }
+    }
     if err := os.MkdirAll(fullGraphDir, 0755); err != nil {
       return fmt.Errorf("MkdirAll(%q): %v", fullGraphDir, err)
     }
     defer func() {
+      // Don't write a partial graph if we were interrupted.
+      if ctx.Err() != nil {
+        return
+      }
       log.Printf("Saving dependency graph to %s", fullGraphDir)
-      if err := graph.OutputDOTGraph(filepath.Join(fullGraphDir, "full_graph.dot")); err != nil {
-        log.Printf("OutputDOTGraph(%q): %v", fullGraphDir, err)
+      for _, format := range formats {
+        path := filepath.Join(fullGraphDir, "full_graph."+format)
+        if err := graph.OutputGraph(path, format); err != nil {
+          log.Printf("OutputGraph(%q): %v", path, err)
+        }
       }
     }()
   }
 
-  walker, err := NewSDKWalker(conf, graph)
-  if err != nil {
-    return fmt.Errorf("NewSDKWalker: %v", err)
+  // Set up output of the scoped DOT graph.
+  if *dotScope != "" {
+    if err := os.MkdirAll(scopedGraphDir, 0755); err != nil {
+      return fmt.Errorf("MkdirAll(%q): %v", scopedGraphDir, err)
+    }
+    defer func() {
+      if ctx.Err() != nil {
+        return
+      }
+      path := filepath.Join(scopedGraphDir, "scoped_graph.dot")
+      log.Printf("Saving dependency graph of %s to %s", *dotScope, path)
+      if err := graph.OutputScopedDOTGraph(path, *dotScope, *dotScopeDepth); err != nil {
+        log.Printf("OutputScopedDOTGraph(%q): %v", path, err)
+      }
+    }()
   }
 
-  unresolvedDeps, err := walker.PopulateGraph()
+  resolveStart := time.Now()
+  res, err := resolve(ctx, conf, graph)
   if err != nil {
-    return fmt.Errorf("SDKWalker.PopulateGraph: %v", err)
+    return err
   }
-  if len(unresolvedDeps) > 0 {
-    return WriteUnresolvedDepsHint(conf, unresolvedDeps)
+  resolveTime := time.Since(resolveStart)
+  bazelifyOutDir := filepath.Join(sdkDir, bazelifyOutDirname)
+  if len(res.unresolved) > 0 || len(res.unnamed) > 0 {
+    // Report the issues, so they can be reviewed along with the hint.
+    if err := os.MkdirAll(bazelifyOutDir, 0755); err != nil {
+      return fmt.Errorf("MkdirAll(%q): %v", bazelifyOutDir, err)
+    }
+    if err := writeHTMLReport(conf, graph, res, nil, bazelifyOutDir); err != nil {
+      return fmt.Errorf("writeHTMLReport: %v", err)
+    }
+  }
+  if len(res.unresolved) > 0 {
+    return WriteUnresolvedDepsHint(conf, res.unresolved)
+  }
+  if len(res.unnamed) > 0 {
+    return WriteUnnamedGroupsHint(conf, res.unnamed)
   }
 
-  unnamedGroups, err := NameGroups(conf, graph)
+  if *pruneUnreachable {
+    pruned, err := graph.PruneUnreachable(conf.Roots)
+    if err != nil {
+      return fmt.Errorf("PruneUnreachable: %v", err)
+    }
+    log.Printf("Pruned %d libraries that are unreachable from the roots", pruned)
+  }
+
+  var disabledModules int
+  if conf.DefinePruning.Enabled {
+    if disabledModules, err = graph.PruneDisabledModules(); err != nil {
+      return fmt.Errorf("PruneDisabledModules: %v", err)
+    }
+    log.Printf("Pruned %d libraries of modules that the defines disable", disabledModules)
+  }
+
+  var mergedMacroHeaders int
+  if conf.MergeMacroHeaders {
+    if mergedMacroHeaders, err = graph.MergeMacroHeaders(); err != nil {
+      return fmt.Errorf("MergeMacroHeaders: %v", err)
+    }
+    log.Printf("Merged %d macro header libraries into their only dependents", mergedMacroHeaders)
+  }
+
+  // In merge mode, read what the old BUILD files keep before they're removed.
+  if conf.Merge {
+    kept, err := readKept(conf, res.buildFiles)
+    if err != nil {
+      return err
+    }
+    conf.Kept = kept
+  }
+
+  // Remove the old BUILD files now that we know we can replace them.
+  // BUILD files that someone else wrote are only removed with --force.
+  unrecognized, err := unrecognizedBuildFiles(conf, res.buildFiles)
   if err != nil {
-    return fmt.Errorf("NameGroups: %v", err)
+    return err
   }
-  if len(unnamedGroups) > 0 {
-    return WriteUnnamedGroupsHint(conf, unnamedGroups)
+  if len(unrecognized) > 0 && !*force {
+    return fmt.Errorf("found %d BUILD files that nrfbazelify didn't generate, pass --force to replace them:\n  %s", len(unrecognized), strings.Join(unrecognized, "\n  "))
+  }
+  for _, path := range res.buildFiles {
+    if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+      return fmt.Errorf("os.Remove(%s): %v", path, err)
+    }
   }
 
-  if err := OutputBuildFiles(conf, graph); err != nil {
+  outputStart := time.Now()
+  if err := OutputBuildFiles(ctx, conf, graph); err != nil {
     return fmt.Errorf("OutputBuildFiles: %v", err)
   }
+  outputTime := time.Since(outputStart)
+  if *selfCheck {
+    if err := SelfCheck(conf, graph); err != nil {
+      return fmt.Errorf("SelfCheck: %v", err)
+    }
+    log.Print("Self check passed, the BUILD files match the dependency graph")
+  }
+
+  if err := newLockFile(res.autoResolved).Write(sdkDir); err != nil {
+    return fmt.Errorf("writing %s: %v", lockFilename, err)
+  }
 
   if err := RemoveStaleHint(sdkDir); err != nil {
     return fmt.Errorf("removeStaleHintFile: %v", err)
   }
 
-  stats, err := NewGraphStats(conf, graph)
+  stats, err := NewGraphStats(conf, graph, *statsTopN)
   if err != nil {
     return fmt.Errorf("NewGraphStats: %v", err)
   }
+  stats.AutoResolved = res.autoResolved
+  stats.ResolutionMethods = res.resolutionMethods
+  stats.Unmatched = res.unmatched
+  stats.OrphanSources = res.orphanSources
+  stats.MergedMacroHeaders = mergedMacroHeaders
+  stats.DisabledModules = disabledModules
+  stats.Timings = map[string]time.Duration{
+    "resolve": resolveTime,
+    "output": outputTime,
+    "total": time.Since(start),
+  }
   log.Print(stats.GenerateReport())
+  if err := os.MkdirAll(bazelifyOutDir, 0755); err != nil {
+    return fmt.Errorf("MkdirAll(%q): %v", bazelifyOutDir, err)
+  }
+  if err := stats.WriteReport(bazelifyOutDir); err != nil {
+    return fmt.Errorf("WriteReport: %v", err)
+  }
+  if err := writeHTMLReport(conf, graph, res, stats, bazelifyOutDir); err != nil {
+    return fmt.Errorf("writeHTMLReport: %v", err)
+  }
+  if err := writeProvenance(graph, res.provenance, bazelifyOutDir); err != nil {
+    return fmt.Errorf("writeProvenance: %v", err)
+  }
+  log.Printf("Wrote graph stats and group membership report to %s", bazelifyOutDir)
 
   // Now that the graph is complete, write out all named groups for visualization.
   if *namedGroupGraphs {
@@ -118,5 +264,172 @@ func GenerateBuildFiles(workspaceDir, sdkDir string, verbose bool) error {
     }
   }
 
+  // Most output bugs only show when Bazel loads the files.
+  if *smokeTest {
+    if err := runSmokeTest(ctx, conf); err != nil {
+      return fmt.Errorf("smoke test: %v", err)
+    }
+    log.Print("Smoke test passed")
+  }
+
+  return nil
+}
+
+// CheckBuildFiles resolves all dependencies the same way GenerateBuildFiles
+// does, but doesn't write or delete any files.
+// It returns an error describing everything that still needs to be resolved.
+func CheckBuildFiles(ctx context.Context, workspaceDir string, sdkDirs []string, verbosity Verbosity) error {
+  _, err := LoadGraph(ctx, workspaceDir, sdkDirs, verbosity)
+  return err
+}
+
+// LoadGraph resolves the dependency graph for the SDKs without writing or
+// deleting any files. The graph is only returned if it is fully resolved,
+// otherwise the error describes everything that still needs to be resolved.
+func LoadGraph(ctx context.Context, workspaceDir string, sdkDirs []string, verbosity Verbosity) (*DependencyGraph, error) {
+  if err := checkDirs(workspaceDir, sdkDirs); err != nil {
+    return nil, err
+  }
+  conf, err := ReadConfig(sdkDirs, workspaceDir, verbosity)
+  if err != nil {
+    return nil, fmt.Errorf("ReadBazelifyRC: %v", err)
+  }
+  graph := NewDependencyGraph(conf, "")
+  res, err := resolve(ctx, conf, graph)
+  if err != nil {
+    return nil, err
+  }
+  if len(res.unresolved) > 0 {
+    var lines []string
+    for _, dep := range res.unresolved {
+      lines = append(lines, fmt.Sprintf("  %s included by %s, possible: [%s]", dep.dstFileName, bazel.JoinLabelStrings(dep.includedBy, ","), bazel.JoinLabelStrings(dep.possible, "|")))
+    }
+    sort.Strings(lines)
+    return nil, fmt.Errorf("found %d unresolved dependencies:\n%s", len(lines), strings.Join(lines, "\n"))
+  }
+  if len(res.unnamed) > 0 {
+    var lines []string
+    for _, group := range res.unnamed {
+      var hdrs []string
+      for _, hdr := range group.Hdrs {
+        hdrs = append(hdrs, hdr.String())
+      }
+      sort.Strings(hdrs)
+      lines = append(lines, fmt.Sprintf("  group of %s", strings.Join(hdrs, ",")))
+    }
+    sort.Strings(lines)
+    return nil, fmt.Errorf("found %d unnamed groups:\n%s", len(lines), strings.Join(lines, "\n"))
+  }
+  return graph, nil
+}
+
+// ValidateConfig reads and validates the .bazelifyrc files of the given SDKs,
+// without walking the SDKs.
+func ValidateConfig(workspaceDir string, sdkDirs []string) error {
+  if err := checkDirs(workspaceDir, sdkDirs); err != nil {
+    return err
+  }
+  conf, err := ReadConfig(sdkDirs, workspaceDir, VerbosityQuiet)
+  if err != nil {
+    return fmt.Errorf("ReadBazelifyRC: %v", err)
+  }
+  return conf.Validate()
+}
+
+// checkDirs makes sure the workspace and SDK directories are usable.
+func checkDirs(workspaceDir string, sdkDirs []string) error {
+  if !filepath.IsAbs(workspaceDir) {
+    return errors.New("workspace must be an absolute path")
+  }
+  if len(sdkDirs) == 0 {
+    return errors.New("at least one sdk_dir is required")
+  }
+  for _, sdkDir := range sdkDirs {
+    if !filepath.IsAbs(sdkDir) {
+      return errors.New("sdk_dir must be an absolute path")
+    }
+    if !strings.HasPrefix(sdkDir, workspaceDir) {
+      return fmt.Errorf("sdk_dir is not inside workspace_dir:\nsdk_dir=%s\nworkspace_dir=%s", sdkDir, workspaceDir)
+    }
+  }
   return nil
 }
+
+// resolution holds the results of resolving the dependency graph.
+type resolution struct {
+  unresolved []*unresolvedDep
+  unnamed []*GroupNode
+  buildFiles []string // existing BUILD files in the SDKs
+  autoResolved []*AutoResolution
+  resolutionMethods map[string]int
+  unmatched *UnmatchedEntries
+  orphanSources []string // labels of .c files in no library
+  provenance []*depResolution
+}
+
+// resolve populates graph from the SDKs, and names all groups.
+// Groups are only named if all dependencies could be resolved.
+func resolve(ctx context.Context, conf *Config, graph *DependencyGraph) (*resolution, error) {
+  walker, err := NewSDKWalker(conf, graph)
+  if err != nil {
+    return nil, fmt.Errorf("NewSDKWalker: %v", err)
+  }
+  if !*relock {
+    lock, err := ReadLockFile(conf.SDKDir)
+    if err != nil {
+      return nil, fmt.Errorf("ReadLockFile: %v", err)
+    }
+    walker.lock = lock
+  }
+
+  unresolvedDeps, err := walker.PopulateGraph(ctx)
+  if err != nil {
+    return nil, fmt.Errorf("SDKWalker.PopulateGraph: %v", err)
+  }
+  res := &resolution{
+    unresolved: unresolvedDeps,
+    buildFiles: walker.BuildFiles(),
+    autoResolved: walker.AutoResolved(),
+    resolutionMethods: walker.ResolutionMethods(),
+    unmatched: walker.Unmatched(),
+    orphanSources: walker.OrphanSources(),
+    provenance: walker.Provenance(),
+  }
+  conf.logf(VerbosityPhases, "Merged %d dependency cycles into groups", graph.mergedCycles)
+  if len(unresolvedDeps) > 0 {
+    return res, nil
+  }
+
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
+
+  unnamedGroups, err := NameGroups(conf, graph)
+  if err != nil {
+    return nil, fmt.Errorf("NameGroups: %v", err)
+  }
+  conf.logf(VerbosityPhases, "Named groups, %d groups still need a name", len(unnamedGroups))
+  res.unnamed = unnamedGroups
+  return res, nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so an interrupted write never leaves a truncated file behind.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+  tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(tmp.Name())
+  if _, err := tmp.Write(data); err != nil {
+    tmp.Close()
+    return err
+  }
+  if err := tmp.Close(); err != nil {
+    return err
+  }
+  if err := os.Chmod(tmp.Name(), perm); err != nil {
+    return err
+  }
+  return os.Rename(tmp.Name(), path)
+}
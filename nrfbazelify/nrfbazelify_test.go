@@ -1,8 +1,13 @@
 package nrfbazelify
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -12,6 +17,7 @@ import (
 	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
 	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/testing/protocmp"
 )
@@ -40,6 +46,15 @@ func setup(t *testing.T, sdkFromWorkspace string) (workspaceDir, sdkDir string)
   sdkDir = filepath.Join(workspaceDir, sdkFromWorkspace)
   t.Cleanup(func() {
     removeAllBuildFiles(t, sdkDir)
+    if err := os.Remove(lockPath(sdkDir)); err != nil && !os.IsNotExist(err) {
+      t.Errorf("os.Remove(%q): %v", lockPath(sdkDir), err)
+    }
+    // A chips dir with files is the SDK's own.
+    if entries, err := os.ReadDir(filepath.Join(sdkDir, chipsDir)); err == nil && len(entries) == 0 {
+      if err := os.Remove(filepath.Join(sdkDir, chipsDir)); err != nil {
+        t.Errorf("os.Remove(%q): %v", chipsDir, err)
+      }
+    }
   })
   return
 }
@@ -50,6 +65,7 @@ func newBuildFile(dir string, libs []*buildfile.Library, labelSettings []*buildf
     Source: "@rules_cc//cc:defs.bzl",
     Symbols: []string{"cc_library"},
   })
+  out.SetTags([]string{defaultTag})
   for _, lib := range libs {
     out.AddLibrary(lib)
   }
@@ -90,15 +106,28 @@ func checkBuildFiles(t *testing.T, files ...*buildfile.File) {
       continue
     }
     want := file.Generate()
-    if diff := cmp.Diff(want, string(got)); diff != "" {
+    if diff := cmp.Diff(want, stripBanner(string(got))); diff != "" {
       t.Errorf("%s (-want +got):\n%s", file.Path, diff)
     }
   }
 }
 
+// stripBanner removes the comment at the top of a generated file, which
+// TestGenerateBuildFiles_Banner checks.
+func stripBanner(contents string) string {
+  for strings.HasPrefix(contents, "#") {
+    i := strings.Index(contents, "\n")
+    if i < 0 {
+      return ""
+    }
+    contents = contents[i+1:]
+  }
+  return strings.TrimPrefix(contents, "\n")
+}
+
 func TestGenerateBuildFiles_Nominal(t *testing.T) {
   workspaceDir, sdkDir := setup(t, "nominal")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err != nil {
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
     t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
   checkBuildFiles(t,
@@ -127,195 +156,318 @@ func TestGenerateBuildFiles_Nominal(t *testing.T) {
   )
 }
 
-func TestGenerateBuildFiles_NameMatchesDir(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "name_matches_dir")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err != nil {
+func TestGenerateBuildFiles_CompileCommands(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "nominal")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
     t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
-  checkBuildFiles(t, 
-    newBuildFile(sdkDir, []*buildfile.Library{
-      {
-        Name:     "uses_dir",
-        Hdrs:     []string{"uses_dir.h"},
-        Deps:     []string{"//name_matches_dir/dir"},
-        Copts: []string{"-Iname_matches_dir/dir"},
-      },
-    }, nil, nil),
-    newBuildFile(filepath.Join(sdkDir, "dir"), []*buildfile.Library{
-      {
-        Name:     "dir",
-        Hdrs:     []string{"dir.h"},
-      },
-    }, nil, nil),
-  )
+  path := filepath.Join(sdkDir, bazelifyOutDirname, compileCommandsFilename)
+  contents, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatalf("os.ReadFile(%q): %v", path, err)
+  }
+  var got []*compileCommand
+  if err := json.Unmarshal(contents, &got); err != nil {
+    t.Fatalf("json.Unmarshal(%s): %v", contents, err)
+  }
+  command := func(file string, args ...string) *compileCommand {
+    abs := filepath.Join(sdkDir, file)
+    out := &compileCommand{Directory: workspaceDir, File: abs}
+    out.Arguments = append([]string{"arm-none-eabi-gcc"}, defaultToolchainCopts...)
+    out.Arguments = append(out.Arguments, args...)
+    out.Arguments = append(out.Arguments, "-c", abs)
+    return out
+  }
+  want := []*compileCommand{
+    // b's -I copt is also the header dir of its dependency c.
+    command("b.c", "-Inominal/dir"),
+    command("dir/c.c"),
+  }
+  if diff := cmp.Diff(want, got); diff != "" {
+    t.Errorf("%s (-want +got):\n%s", compileCommandsFilename, diff)
+  }
 }
 
-func TestGenerateBuildFiles_RelativeIncludes(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "relative_includes")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err != nil {
+func TestGenerateBuildFiles_IDE(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "ide")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
     t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
-  checkBuildFiles(t,
-    newBuildFile(filepath.Join(sdkDir, "up_one"), []*buildfile.Library{
-      {
-        Name:     "a",
-        Hdrs:     []string{"a.h"},
-        Srcs: 		[]string{"a.c"},
-        Deps:     []string{"//relative_includes/back_and_around:b"},
-        Copts: []string{"-Irelative_includes/back_and_around"},
-      },
-    }, nil, nil),
-    newBuildFile(filepath.Join(sdkDir, "back_and_around"), []*buildfile.Library{
-      {
-        Name:     "b",
-        Hdrs:     []string{"b.h"},
-        Srcs: 		[]string{"b.c"},
-      },
-    }, nil, nil),
-  )
+  t.Cleanup(func() {
+    if err := CleanGeneratedFiles(workspaceDir, []string{sdkDir}); err != nil {
+      t.Errorf("CleanGeneratedFiles: %v", err)
+    }
+  })
+  wantPhrases := map[string][]string{
+    clangdFilename: {"CompilationDatabase: .bazelify-out"},
+    filepath.Join(vscodeDir, vscodePropertiesFilename): {
+      fmt.Sprintf(`"compileCommands": %q`, filepath.Join(sdkDir, bazelifyOutDirname, compileCommandsFilename)),
+      // app depends on lib, so app.c is compiled with lib's header dir.
+      fmt.Sprintf(`"includePath": [
+        %q
+      ]`, filepath.Join(sdkDir, "lib")),
+      `"compilerPath": "arm-none-eabi-gcc"`,
+    },
+  }
+  for name, phrases := range wantPhrases {
+    contents, err := os.ReadFile(filepath.Join(sdkDir, name))
+    if err != nil {
+      t.Fatalf("os.ReadFile(%q): %v", name, err)
+    }
+    for _, want := range phrases {
+      if !strings.Contains(string(contents), want) {
+        t.Errorf("%s doesn't contain %q:\n%s", name, want, contents)
+      }
+    }
+  }
 }
 
-func TestGenerateBuildFiles_BuildFileExists(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "build_file_exists")
-  garbageBuild := filepath.Join(sdkDir, "BUILD")
-  if err := os.WriteFile(garbageBuild, []byte(garbageText), 0644); err != nil {
-    t.Fatalf("os.WriteFile(%s, %s): %v", garbageBuild, garbageText, err)
+func TestGenerateBuildFiles_Cancelled(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "nominal")
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  if err := GenerateBuildFiles(ctx, workspaceDir, []string{sdkDir}, VerbosityPhases); !errors.Is(err, context.Canceled) {
+    t.Fatalf("GenerateBuildFiles(%s, %s): got %v, want %v", workspaceDir, sdkDir, err, context.Canceled)
   }
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err != nil {
-    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  buildPath := filepath.Join(sdkDir, "BUILD")
+  if _, err := os.Stat(buildPath); err == nil {
+    t.Errorf("%s written after cancellation", buildPath)
+  }
+}
+
+func TestCheckBuildFiles_Nominal(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "nominal")
+  if err := CheckBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("CheckBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
-  checkBuildFiles(t,
-    newBuildFile(sdkDir, []*buildfile.Library{
-      {
-        Name:     "a",
-        Hdrs:     []string{"a.h"},
-      },
-    }, nil, nil),
-  )
   buildPath := filepath.Join(sdkDir, "BUILD")
-  contents, err := os.ReadFile(buildPath)
-  if err != nil {
-    t.Fatalf("os.ReadFile(%s): %v", buildPath, err)
+  if _, err := os.Stat(buildPath); err == nil {
+    t.Errorf("%s written by CheckBuildFiles", buildPath)
   }
-  if got, dontWant := string(contents), "garbage to remove"; strings.Contains(got, dontWant) {
-    t.Errorf("strings.Contains(%s, %s): got true, want false", got, dontWant)
+}
+
+func TestCheckBuildFiles_Unresolved(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "include_does_not_exist")
+  err := CheckBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err == nil {
+    t.Fatalf("CheckBuildFiles(%s, %s): got nil error, want an error", workspaceDir, sdkDir)
+  }
+  if !strings.Contains(err.Error(), "doesnotexist.h") {
+    t.Errorf("CheckBuildFiles(%s, %s): got %v, want it to mention doesnotexist.h", workspaceDir, sdkDir, err)
   }
 }
 
-func TestGenerateBuildFiles_WorkspaceMatchesSDKDir(t *testing.T) {
-  _, workspaceAndSDKDir := setup(t, "workspace_matches_sdk_dir")
-  if err := GenerateBuildFiles(workspaceAndSDKDir, workspaceAndSDKDir, true); err != nil {
-    t.Fatalf("GenerateBuildFiles(%s, %s): %v", testDataDir, workspaceAndSDKDir, err)
+func TestCheckBuildFiles_Verbosity(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "cycles_nominal")
+  t.Cleanup(func() {
+    log.SetOutput(os.Stderr)
+  })
+  tests := map[Verbosity]struct{
+    want, notWant []string
+  }{
+    VerbosityQuiet: {
+      notWant: []string{"Added", "resolved a.h", "candidates for"},
+    },
+    VerbosityPhases: {
+      want: []string{"nodes to the graph", "Merged 1 dependency cycles into groups"},
+      notWant: []string{"resolved a.h", "candidates for"},
+    },
+    VerbosityResolutions: {
+      want: []string{"nodes to the graph", "resolved b.h to //cycles_nominal:b: found in the search paths", "Merging a cycle"},
+      notWant: []string{"candidates for"},
+    },
+    VerbosityCandidates: {
+      want: []string{"nodes to the graph", "resolved a.h", "candidates for b.h in the search paths: [//cycles_nominal:b]", "candidates for a.h in the graph: [//cycles_nominal:a]"},
+    },
   }
-  checkBuildFiles(t, 
-    newBuildFile(workspaceAndSDKDir, []*buildfile.Library{
+  for verbosity, test := range tests {
+    var logs bytes.Buffer
+    log.SetOutput(&logs)
+    if err := CheckBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, verbosity); err != nil {
+      t.Fatalf("CheckBuildFiles(%s, %s, %d): %v", workspaceDir, sdkDir, verbosity, err)
+    }
+    for _, want := range test.want {
+      if !strings.Contains(logs.String(), want) {
+        t.Errorf("CheckBuildFiles(%d) logs don't mention %q:\n%s", verbosity, want, logs.String())
+      }
+    }
+    for _, notWant := range test.notWant {
+      if strings.Contains(logs.String(), notWant) {
+        t.Errorf("CheckBuildFiles(%d) logs mention %q:\n%s", verbosity, notWant, logs.String())
+      }
+    }
+  }
+}
+
+func TestGenerateBuildFiles_MultipleSDKs(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, filepath.Join("multiple_sdks", "sdk"))
+  meshDir := filepath.Join(workspaceDir, "multiple_sdks", "mesh")
+  t.Cleanup(func() {
+    removeAllBuildFiles(t, meshDir)
+  })
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
       {
         Name:     "a",
         Hdrs:     []string{"a.h"},
-        Deps:     []string{":workspace_matches_sdk_dir"},
-        Copts: []string{"-I."},
+        Deps:     []string{"//multiple_sdks/mesh"},
+        Copts:    []string{"-Imultiple_sdks/mesh"},
       },
+    }, nil, nil),
+    // Both SDKs have an apply_old_config.h, and each library folds its own
+    // SDK's.
+    newBuildFile(filepath.Join(sdkDir, "dir"), []*buildfile.Library{
       {
-        Name:     "workspace_matches_sdk_dir",
-        Srcs:     []string{"workspace_matches_sdk_dir.c"},
-        Hdrs:     []string{"workspace_matches_sdk_dir.h"},
+        Name:     "c",
+        Hdrs:     []string{"c.h"},
+        TextualHdrs: []string{"apply_old_config.h"},
+      },
+    }, nil, nil),
+    newBuildFile(meshDir, []*buildfile.Library{
+      {
+        Name:     "mesh",
+        Hdrs:     []string{"mesh.h"},
+        TextualHdrs: []string{"apply_old_config.h"},
+        Deps:     []string{"//multiple_sdks/sdk/dir:c"},
+        Copts:    []string{"-Imultiple_sdks/sdk/dir"},
       },
     }, nil, nil),
   )
+  // The mesh SDK's .bazelifyrc excludes are relative to the mesh SDK.
+  excludedBuild := filepath.Join(meshDir, "excluded", "BUILD")
+  if _, err := os.Stat(excludedBuild); err == nil {
+    t.Errorf("%s created, but should have been excluded", excludedBuild)
+  }
 }
 
-func TestGenerateBuildFiles_IncludeDoesNotExist(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "include_does_not_exist")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err == nil {
-    t.Errorf("GenerateBuildFiles(%s, %s): got nil error, want an error", workspaceDir, sdkDir)
+func TestCleanGeneratedFiles(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "bazelifyrc_remap")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  // Files written by a user must survive, even if they look generated.
+  userFile := filepath.Join(sdkDir, "user", "BUILD")
+  if err := os.MkdirAll(filepath.Dir(userFile), 0755); err != nil {
+    t.Fatalf("os.MkdirAll(%s): %v", filepath.Dir(userFile), err)
+  }
+  t.Cleanup(func() { os.RemoveAll(filepath.Dir(userFile)) })
+  if err := os.WriteFile(userFile, []byte(garbageText), 0644); err != nil {
+    t.Fatalf("os.WriteFile(%s): %v", userFile, err)
+  }
+
+  if err := CleanGeneratedFiles(workspaceDir, []string{sdkDir}); err != nil {
+    t.Fatalf("CleanGeneratedFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  for _, removed := range []string{"BUILD", "remap.bzl", ".bazelify-out"} {
+    if _, err := os.Stat(filepath.Join(sdkDir, removed)); err == nil {
+      t.Errorf("%s not removed by CleanGeneratedFiles", removed)
+    }
+  }
+  if _, err := os.Stat(userFile); err != nil {
+    t.Errorf("os.Stat(%s): %v, want user file to be kept", userFile, err)
   }
 }
 
-func TestGenerateBuildFiles_BazelifyRCHint(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "bazelifyrc_hint")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err == nil {
-    t.Fatalf("GenerateBuildFiles(%s, %s): got nil error, want an error", workspaceDir, sdkDir)
+func TestCleanGeneratedFiles_MultipleSDKs(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, filepath.Join("multiple_sdks", "sdk"))
+  meshDir := filepath.Join(workspaceDir, "multiple_sdks", "mesh")
+  t.Cleanup(func() {
+    removeAllBuildFiles(t, meshDir)
+  })
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
-  hintPath := filepath.Join(sdkDir, ".bazelifyrc.hint")
-  hintText, err := os.ReadFile(hintPath)
-  if err != nil {
-    t.Fatalf("os.ReadFile(%s): %v", hintPath, err)
+  // A hint left in an SDK root that only the rc adds.
+  meshHint := filepath.Join(meshDir, rcFilename + ".hint")
+  if err := os.WriteFile(meshHint, []byte(garbageText), 0644); err != nil {
+    t.Fatalf("os.WriteFile(%s): %v", meshHint, err)
   }
-  var hint bazelifyrc.Configuration 
-  if err := prototext.Unmarshal(hintText, &hint); err != nil {
-    t.Fatalf("proto.UnmarshalText(%s): %v", string(hintText), err)
+  t.Cleanup(func() { os.Remove(meshHint) })
+
+  if err := CleanGeneratedFiles(workspaceDir, []string{sdkDir}); err != nil {
+    t.Fatalf("CleanGeneratedFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
-  if diff := cmp.Diff(&bazelifyrc.Configuration{
-    IncludeOverrides: []*bazelifyrc.IncludeOverride{
-      {
-				Include: "doesnotexist.h",
-				Label: "INCLUDED BY //bazelifyrc_hint:exists PLEASE RESOLVE: ",
-			},
-    },
-  }, hint, protocmp.Transform()); diff != "" {
-    t.Fatalf("bazelifyrc hint (-want +got): %s", diff)
+  if _, err := os.Stat(meshHint); err == nil {
+    t.Errorf("%s not removed by CleanGeneratedFiles", meshHint)
+  }
+  if _, err := os.Stat(filepath.Join(meshDir, "BUILD")); err == nil {
+    t.Errorf("mesh BUILD not removed by CleanGeneratedFiles")
   }
 }
 
-func TestGenerateBuildFiles_BazelifyRCHintKeepOverride(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "bazelifyrc_hint_keep_override")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err == nil {
-    t.Fatalf("GenerateBuildFiles(%s, %s): got nil error, want an error", workspaceDir, sdkDir)
+func TestCleanGeneratedFiles_KeepsEditedFiles(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "nominal")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
-  hintPath := filepath.Join(sdkDir, ".bazelifyrc.hint")
-  hintText, err := os.ReadFile(hintPath)
+  edited := filepath.Join(sdkDir, "dir", "BUILD")
+  f, err := os.OpenFile(edited, os.O_APPEND|os.O_WRONLY, 0644)
   if err != nil {
-    t.Fatalf("os.ReadFile(%s): %v", hintPath, err)
+    t.Fatalf("os.OpenFile(%s): %v", edited, err)
   }
-  var hint bazelifyrc.Configuration 
-  if err := prototext.Unmarshal(hintText, &hint); err != nil {
-    t.Fatalf("proto.UnmarshalText(%s): %v", string(hintText), err)
+  if _, err := f.WriteString("# manual edit\n"); err != nil {
+    t.Fatalf("WriteString(%s): %v", edited, err)
   }
-  if diff := cmp.Diff(&bazelifyrc.Configuration{
-    IncludeOverrides: []*bazelifyrc.IncludeOverride{
-      {
-				Include: "overridden.h",
-				Label: "//something",
-			},
-      {
-				Include: "doesnotexist.h",
-				Label: "INCLUDED BY //bazelifyrc_hint_keep_override:exists PLEASE RESOLVE: ",
-			},
-    },
-  }, hint, protocmp.Transform()); diff != "" {
-    t.Fatalf("bazelifyrc hint (-want +got): %s", diff)
+  f.Close()
+
+  if err := CleanGeneratedFiles(workspaceDir, []string{sdkDir}); err != nil {
+    t.Fatalf("CleanGeneratedFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  if _, err := os.Stat(filepath.Join(sdkDir, "BUILD")); err == nil {
+    t.Errorf("generated BUILD not removed by CleanGeneratedFiles")
+  }
+  if _, err := os.Stat(edited); err != nil {
+    t.Errorf("os.Stat(%s): %v, want edited file to be kept", edited, err)
   }
 }
 
-func TestGenerateBuildFiles_IncludeOverrides(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, filepath.Join("include_overrides", "sdkdir"))
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err != nil {
+func TestGenerateBuildFiles_NameMatchesDir(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "name_matches_dir")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
     t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
   checkBuildFiles(t, 
     newBuildFile(sdkDir, []*buildfile.Library{
       {
-        Name:     "a",
-        Hdrs:     []string{"a.h"},
-        Copts: []string{
-					"-Iinclude_overrides/outsidesdkdir",
-					"-Iinclude_overrides/sdkdir/b",
-					"-Iinclude_overrides/sdkdir/c",
-				},
-        Deps: []string{
-          "//include_overrides/outsidesdkdir:d",
-          "//include_overrides/sdkdir/b",
-          "//include_overrides/sdkdir/c",
-        },
+        Name:     "uses_dir",
+        Hdrs:     []string{"uses_dir.h"},
+        Deps:     []string{"//name_matches_dir/dir"},
+        Copts: []string{"-Iname_matches_dir/dir"},
       },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "dir"), []*buildfile.Library{
       {
-        Name:     "c",
-        Hdrs:     []string{"c.h"},
+        Name:     "dir",
+        Hdrs:     []string{"dir.h"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_ImplementationDeps(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "implementation_deps")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    // Only a.c includes b.h, but a.h includes c.h.
+    newBuildFile(filepath.Join(sdkDir, "a"), []*buildfile.Library{
+      {
+        Name:     "a",
+        Srcs:     []string{"a.c"},
+        Hdrs:     []string{"a.h"},
+        Deps:     []string{"//implementation_deps/c"},
+        ImplementationDeps: []string{"//implementation_deps/b"},
+        Copts: []string{"-Iimplementation_deps/b", "-Iimplementation_deps/c"},
       },
     }, nil, nil),
     newBuildFile(filepath.Join(sdkDir, "b"), []*buildfile.Library{
       {
         Name:     "b",
+        Srcs:     []string{"b.c"},
         Hdrs:     []string{"b.h"},
       },
     }, nil, nil),
@@ -328,421 +480,3210 @@ func TestGenerateBuildFiles_IncludeOverrides(t *testing.T) {
   )
 }
 
-func TestGenerateBuildFiles_BazelifyRCExistsButEmpty(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "bazelifyrc_exists_but_empty")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err != nil {
+func TestGenerateBuildFiles_IncludePrefixes(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "include_prefix")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
     t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
   checkBuildFiles(t,
-    newBuildFile(sdkDir, []*buildfile.Library{
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
       {
-        Name:     "a",
-        Hdrs:     []string{"a.h"},
+        Name:     "app",
+        Hdrs:     []string{"app.h"},
+        Deps:     []string{"//include_prefix/modules/nrfx/hal:nrf_gpio"},
+        Copts: []string{"-Iinclude_prefix/modules", "-Iinclude_prefix/modules/nrfx/hal"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "modules/nrfx/hal"), []*buildfile.Library{
+      {
+        Name:     "nrf_gpio",
+        Hdrs:     []string{"nrf_gpio.h"},
+        StripIncludePrefix: "/include_prefix/modules",
       },
     }, nil, nil),
   )
 }
 
-func TestGenerateBuildFiles_StrangeInclude(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "strange_includes")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err != nil {
+func TestGenerateBuildFiles_IncludePathsIncludes(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "include_paths_includes")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
     t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
   checkBuildFiles(t,
-    newBuildFile(sdkDir, []*buildfile.Library{
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
       {
-        Name:     "a",
-        Hdrs:     []string{"a.h"},
-        Copts: []string{"-Istrange_includes"},
-        Deps:     []string{":b", ":d"},
+        Name:     "app",
+        Srcs:     []string{"app.c"},
+        Hdrs:     []string{"app.h"},
+        Deps:     []string{"//include_paths_includes/c", "//include_paths_includes/inc/sub:b"},
+        Includes: []string{"."},
       },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "c"), []*buildfile.Library{
       {
-        Name:     "b",
-        Hdrs:     []string{"b.h"},
+        Name:     "c",
+        Hdrs:     []string{"c.h"},
+        Includes: []string{"."},
       },
+    }, nil, nil),
+    // app.h includes "sub/b.h".
+    newBuildFile(filepath.Join(sdkDir, "inc/sub"), []*buildfile.Library{
       {
-        Name:     "d",
-        Hdrs:     []string{"d.h"},
+        Name:     "b",
+        Hdrs:     []string{"b.h"},
+        Includes: []string{".", ".."},
       },
     }, nil, nil),
   )
 }
 
-func TestGenerateBuildFiles_BazelifyRCExcludes(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "bazelifyrc_excludes")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err != nil {
+func TestGenerateBuildFiles_IncludePathsHybrid(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "include_paths_hybrid")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
     t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
   checkBuildFiles(t,
-    newBuildFile(sdkDir, []*buildfile.Library{
-      {
-        Name:     "a",
-        Hdrs:     []string{"a.h"},
-        Copts: []string{
-					"-Ibazelifyrc_excludes/included",
-					"-Ibazelifyrc_excludes/included/e",
-				},
-        Deps: []string{
-          "//bazelifyrc_excludes/included/e",
-          "//bazelifyrc_excludes/included:d",
-        },
-      },
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
       {
-        Name:     "b",
-        Hdrs:     []string{"b.h"},
-        Copts: []string{"-Ibazelifyrc_excludes"},
-        Deps:     []string{":a"},
+        Name:     "app",
+        Srcs:     []string{"app.c"},
+        Hdrs:     []string{"app.h"},
+        Deps:     []string{"//include_paths_hybrid/c", "//include_paths_hybrid/inc/sub:b"},
+        Copts:    []string{"-Iinclude_paths_hybrid/c", "-Iinclude_paths_hybrid/inc/sub"},
       },
     }, nil, nil),
-    newBuildFile(filepath.Join(sdkDir, "included"), []*buildfile.Library{
+    newBuildFile(filepath.Join(sdkDir, "c"), []*buildfile.Library{
       {
-        Name:     "d",
-        Hdrs:     []string{"d.h"},
+        Name:     "c",
+        Hdrs:     []string{"c.h"},
       },
     }, nil, nil),
-    newBuildFile(filepath.Join(sdkDir, "included", "e"), []*buildfile.Library{
+    // Only the dir that "sub/b.h" is relative to is exported.
+    newBuildFile(filepath.Join(sdkDir, "inc/sub"), []*buildfile.Library{
       {
-        Name:     "e",
-        Hdrs:     []string{"e.h"},
+        Name:     "b",
+        Hdrs:     []string{"b.h"},
+        Includes: []string{".."},
       },
     }, nil, nil),
   )
-  // Make sure BUILD files aren't created for excluded directories
-  buildShouldNotExist := []string{
-    "excluded",
-    "included/star_excluded",
-    "included/star_excluded/e",
-  }
-  for _, dir := range buildShouldNotExist {
-    path := filepath.Join(sdkDir, dir, "BUILD")
-    if _, err := os.Stat(path); err == nil {
-      t.Errorf("BUILD file in %s created, but should not have been created", dir)
-    }
-  }
 }
 
-func TestGenerateBuildFiles_BazelifyRCIgnoreHeaders(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "bazelifyrc_ignore_headers")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err != nil {
+func TestGenerateBuildFiles_PathPrefixedIncludes(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "path_prefixed_includes")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
     t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
+  // In the nRF5 SDK layout too, "sub/b.h" only matches sub's b.h, not other's.
   checkBuildFiles(t,
-    newBuildFile(sdkDir, []*buildfile.Library{
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
       {
-        Name:     "a",
-        Hdrs:     []string{"a.h"},
+        Name:     "app",
+        Hdrs:     []string{"app.h"},
+        Deps:     []string{"//path_prefixed_includes/sub:b"},
+        Copts:    []string{"-Ipath_prefixed_includes", "-Ipath_prefixed_includes/sub"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "other"), []*buildfile.Library{
+      {
+        Name:     "b",
+        Hdrs:     []string{"b.h"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "sub"), []*buildfile.Library{
+      {
+        Name:     "b",
+        Hdrs:     []string{"b.h"},
       },
     }, nil, nil),
   )
 }
 
-func TestGenerateBuildFiles_BazelifyRCIncludeDirs(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "bazelifyrc_include_dirs")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err != nil {
+func TestCheckBuildFiles_PathPrefixedIncludeNoMatch(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "path_prefixed_includes_no_match")
+  // The only b.h isn't under a sub dir, so "sub/b.h" stays unresolved.
+  err := CheckBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err == nil {
+    t.Fatalf("CheckBuildFiles(%s, %s): got nil error, want unresolved sub/b.h", workspaceDir, sdkDir)
+  }
+}
+
+func TestGenerateBuildFiles_TargetCopts(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "target_copts")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
     t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
   checkBuildFiles(t,
-    newBuildFile(sdkDir, []*buildfile.Library{
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
       {
-        Name:     "a",
-        Hdrs:     []string{"a.h"},
-        Copts: []string{
-					"-Ibazelifyrc_include_dirs",
-					"-Ibazelifyrc_include_dirs/external",
-					"-Ibazelifyrc_include_dirs/external/b",
-				},
-        Deps: []string{
-          "//bazelifyrc_include_dirs/external/b",
-          "//bazelifyrc_include_dirs/external:d",
-          ":c",
-        },
+        Name:     "app",
+        Hdrs:     []string{"app.h"},
+        Deps:     []string{"//target_copts/external/foo", "//target_copts/modules/nrfx/drivers:nrfx_spi"},
+        Copts: []string{"-Itarget_copts/external/foo", "-Itarget_copts/modules/nrfx/drivers", "-Wno-unused-parameter", "-Wno-sign-compare"},
       },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "external/foo"), []*buildfile.Library{
       {
-        Name:     "c",
-        Hdrs:     []string{"c.h"},
+        Name:     "foo",
+        Srcs:     []string{"foo.c"},
+        Hdrs:     []string{"foo.h"},
+        Copts: []string{"-Wno-unused-parameter", "-Wno-sign-compare"},
       },
     }, nil, nil),
-    newBuildFile(filepath.Join(sdkDir, "external"), []*buildfile.Library{
+    newBuildFile(filepath.Join(sdkDir, "modules/nrfx/drivers"), []*buildfile.Library{
       {
-        Name:     "d",
-        Hdrs:     []string{"d.h"},
+        Name:     "nrfx_spi",
+        Srcs:     []string{"nrfx_spi.c"},
+        Hdrs:     []string{"nrfx_spi.h"},
+        Deps:     []string{":nrfx_twi"},
+        Copts: []string{"-Itarget_copts/modules/nrfx/drivers", "-fno-strict-aliasing"},
+      },
+      {
+        Name:     "nrfx_twi",
+        Srcs:     []string{"nrfx_twi.c"},
+        Hdrs:     []string{"nrfx_twi.h"},
+        Copts: []string{"-fno-strict-aliasing"},
       },
     }, nil, nil),
-    newBuildFile(filepath.Join(sdkDir, "external", "b"), []*buildfile.Library{
+  )
+}
+
+func TestGenerateBuildFiles_Defines(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "defines")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
       {
-        Name:     "b",
-        Hdrs:     []string{"b.h"},
+        Name:     "app",
+        Hdrs:     []string{"app.h"},
+        Deps:     []string{"//defines/external/foo"},
+        Copts: []string{"-Idefines/external/foo"},
+        Defines: []string{"USE_FOO"},
       },
     }, nil, nil),
-    newBuildFile(filepath.Join(sdkDir, "shouldskipthese"), []*buildfile.Library{
+    newBuildFile(filepath.Join(sdkDir, "external/foo"), []*buildfile.Library{
       {
-        Name:     "d",
-        Hdrs:     []string{"d.h"},
+        Name:     "foo",
+        Srcs:     []string{"foo.c"},
+        Hdrs:     []string{"foo.h"},
+        Defines: []string{"USE_FOO", "FOO_EXPORTED"},
+        LocalDefines: []string{"FOO_INTERNAL=1"},
       },
     }, nil, nil),
-    newBuildFile(filepath.Join(sdkDir, "shouldskipthese", "b"), []*buildfile.Library{
+  )
+}
+
+func TestGenerateBuildFiles_Alwayslink(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "alwayslink")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
       {
-        Name:     "b",
-        Hdrs:     []string{"b.h"},
+        Name:     "app",
+        Hdrs:     []string{"app.h"},
+        Deps:     []string{"//alwayslink/components/libraries/log:nrf_log", "//alwayslink/components/libraries/log:nrf_log_backend_uart"},
+        Copts: []string{"-Ialwayslink/components/libraries/log"},
       },
     }, nil, nil),
-    newBuildFile(filepath.Join(sdkDir, "shouldskipthese", "shouldalsoskipthese"), []*buildfile.Library{
+    newBuildFile(filepath.Join(sdkDir, "components/libraries/log"), []*buildfile.Library{
       {
-        Name:     "d",
-        Hdrs:     []string{"d.h"},
+        Name:     "nrf_log",
+        Srcs:     []string{"nrf_log.c"},
+        Hdrs:     []string{"nrf_log.h"},
+      },
+      {
+        Name:     "nrf_log_backend_uart",
+        Srcs:     []string{"nrf_log_backend_uart.c"},
+        Hdrs:     []string{"nrf_log_backend_uart.h"},
+        Alwayslink: true,
       },
     }, nil, nil),
   )
 }
 
-func TestGenerateBuildFiles_BazelifyRCMalformed(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "bazelifyrc_malformed")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err == nil {
-    t.Fatalf("GenerateBuildFiles(%s, %s): nil error, want an error", workspaceDir, sdkDir)
+func TestGenerateBuildFiles_Filegroups(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "filegroups")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
-  hintPath := filepath.Join(sdkDir, ".bazelifyrc.hint")
-  if _, err := os.Stat(hintPath); err == nil {
-    t.Fatalf("os.Stat(%s): nil error, want an error", hintPath)
+  ldFile := newBuildFile(filepath.Join(sdkDir, "config/armgcc"), nil, nil, nil)
+  ldFile.AddFilegroup(&buildfile.Filegroup{
+    Name: "ld_files",
+    Srcs: []string{"app.ld", "app_bootloader.ld"},
+  })
+  pyFile := newBuildFile(filepath.Join(sdkDir, "scripts"), nil, nil, nil)
+  pyFile.AddFilegroup(&buildfile.Filegroup{
+    Name: "py_files",
+    Srcs: []string{"gen.py"},
+  })
+  // The MDK's linker scripts are only in linker_scripts.
+  mdkFile := newBuildFile(filepath.Join(sdkDir, "modules/nrfx/mdk"), []*buildfile.Library{
+    {
+      Name:     "startup",
+      SrcsSelect: map[string][]string{
+        "//filegroups/chips:is_nrf52840": {"system_nrf52840.c"},
+      },
+      Alwayslink: true,
+    },
+    {
+      Name:     "system_nrf52840",
+      Hdrs:     []string{"system_nrf52840.h"},
+    },
+  }, nil, nil)
+  mdkFile.AddFilegroup(&buildfile.Filegroup{
+    Name: "linker_scripts",
+    Srcs: []string{"nrf_common.ld"},
+  })
+  checkBuildFiles(t, ldFile, pyFile, mdkFile)
+}
+
+func TestGenerateBuildFiles_Visibility(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "layered")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  sdkVisibility := []string{"//layered:__subpackages__"}
+  appFile := newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
+    {
+      Name:     "app",
+      Hdrs:     []string{"app.h"},
+      Deps:     []string{"//layered/drivers:spi"},
+      Copts: []string{"-Ilayered/drivers"},
+      Visibility: []string{"//apps:__subpackages__", "//layered:__subpackages__"},
+    },
+  }, nil, nil)
+  appFile.SetPackageVisibility(sdkVisibility)
+  driversFile := newBuildFile(filepath.Join(sdkDir, "drivers"), []*buildfile.Library{
+    {
+      Name:     "spi",
+      Hdrs:     []string{"spi.h"},
+      Deps:     []string{"//layered/glue"},
+      Copts: []string{"-Ilayered/glue"},
+      Visibility: []string{"//visibility:public"},
+    },
+  }, nil, nil)
+  driversFile.SetPackageVisibility(sdkVisibility)
+  glueFile := newBuildFile(filepath.Join(sdkDir, "glue"), []*buildfile.Library{
+    {
+      Name:     "glue",
+      Hdrs:     []string{"glue.h"},
+    },
+  }, nil, nil)
+  glueFile.SetPackageVisibility(sdkVisibility)
+  checkBuildFiles(t, appFile, driversFile, glueFile)
+  chips, err := os.ReadFile(filepath.Join(sdkDir, "chips/BUILD"))
+  if err != nil {
+    t.Fatalf("read chips/BUILD: %v", err)
+  }
+  if want := `package(default_visibility = ["//visibility:public"])`; !strings.Contains(string(chips), want) {
+    t.Errorf("chips/BUILD doesn't contain %s:\n%s", want, chips)
   }
 }
 
-func TestGenerateBuildFiles_BazelifyRCRemap(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "bazelifyrc_remap")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err != nil {
+func TestGenerateBuildFiles_PackageGroups(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "package_groups")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
     t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
+  rootFile := newBuildFile(sdkDir, nil, nil, nil)
+  rootFile.AddPackageGroup(&buildfile.PackageGroup{
+    Name: "sdk_internal",
+    Packages: []string{"//package_groups/..."},
+    Includes: []string{"//package_groups:sdk_public"},
+  })
+  rootFile.AddPackageGroup(&buildfile.PackageGroup{
+    Name: "sdk_public",
+    Packages: []string{"//app/..."},
+  })
   checkBuildFiles(t,
-    newBuildFile(sdkDir, []*buildfile.Library{
-      {
-        Name: "nrfbazelify_empty_remap",
-      },
+    rootFile,
+    newBuildFile(filepath.Join(sdkDir, "drivers"), []*buildfile.Library{
       {
-        Name:     "a",
-        Hdrs:     []string{"a.h"},
+        Name:     "spi",
+        Hdrs:     []string{"spi.h"},
+        Deps:     []string{"//package_groups/glue"},
+        Copts: []string{"-Ipackage_groups/glue"},
+        Visibility: []string{"//package_groups:sdk_public", "//package_groups:__subpackages__"},
       },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "glue"), []*buildfile.Library{
       {
-        Name:     "b",
-        Hdrs:     []string{"b.h"},
+        Name:     "glue",
+        Hdrs:     []string{"glue.h"},
       },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_Testonly(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "testonly")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "legacy"), []*buildfile.Library{
       {
-        Name:     "c",
-        Hdrs:     []string{"c.h"},
-        Deps:     []string{
-          ":a_remap",
-          ":b_remap",
-        },
+        Name:     "nrf_drv_spi",
+        Hdrs:     []string{"nrf_drv_spi.h"},
+        Deprecation: "Use the nrfx drivers instead",
       },
-    }, []*buildfile.LabelSetting{
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "mocks"), []*buildfile.Library{
       {
-        Name: "a_remap",
-        BuildSettingDefault: "//bazelifyrc_remap:nrfbazelify_empty_remap",
+        Name:     "mock_spi",
+        Hdrs:     []string{"mock_spi.h"},
+        Deps:     []string{"//testonly/legacy:nrf_drv_spi"},
+        Copts: []string{"-Itestonly/legacy"},
+        Testonly: true,
       },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "tests"), []*buildfile.Library{
       {
-        Name: "b_remap",
-        BuildSettingDefault: "//bazelifyrc_remap:nrfbazelify_empty_remap",
+        Name:     "test_spi",
+        Hdrs:     []string{"test_spi.h"},
+        Deps:     []string{"//testonly/mocks:mock_spi"},
+        Copts: []string{"-Itestonly/mocks"},
+        Testonly: true,
       },
-    }, nil),
+    }, nil, nil),
   )
-
-  remapBzl, err := os.ReadFile(filepath.Join(sdkDir, "remap.bzl"))
-  if err != nil {
-    t.Fatalf("read remap.bzl: %v", err)
-  }
-  t.Logf("remap.bzl contents:\n%s", string(remapBzl))
-  searchPhrases := map[string]string{
-    "remapTransitionReturnsA": "\"//bazelifyrc_remap:a_remap\": attr.a,",
-    "remapTransitionReturnsB": "\"//bazelifyrc_remap:b_remap\": attr.b,",
-    "remapTransitionOutputsA": "\"//bazelifyrc_remap:a_remap\",",
-    "remapTransitionOutputsB": "\"//bazelifyrc_remap:b_remap\",",
-  }
-  for name, phrase := range searchPhrases {
-    t.Run(name, func(t *testing.T) {
-      match, err := regexp.MatchString(phrase, string(remapBzl))
-      if err != nil {
-        t.Errorf("regexp.MatchString: %v", err)
-        return
-      }
-      if !match {
-        t.Errorf("phrase not found:\n%s", phrase)
-      }
-    })
-  }
 }
 
-func TestGenerateBuildFiles_RemovesStaleHint(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "removes_stale_hint")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err != nil {
-    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+func TestGenerateBuildFiles_TestonlyDependent(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "testonly_dependent")
+  err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err == nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): got nil error, want an error", workspaceDir, sdkDir)
   }
-  hintFile := filepath.Join(sdkDir, ".bazelifyrc.hint")
-  if _, err := os.Stat(hintFile); err == nil {
-    t.Errorf("hint file %q not removed after successful run", hintFile)
+  if want := "//testonly_dependent/app depends on //testonly_dependent/mocks:mock_spi"; !strings.Contains(err.Error(), want) {
+    t.Errorf("GenerateBuildFiles(%s, %s): got %v, want it to mention %q", workspaceDir, sdkDir, err, want)
   }
 }
 
-func TestGeneratedBuildFiles_SourceSets(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "source_sets")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err != nil {
+func TestGenerateBuildFiles_Umbrellas(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "umbrellas")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
     t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
   checkBuildFiles(t,
-    newBuildFile(sdkDir, []*buildfile.Library{
+    // components/ble has no headers, so its BUILD file only has the umbrella.
+    newBuildFile(filepath.Join(sdkDir, "components/ble"), []*buildfile.Library{
       {
-        Name:     "ab",
-        Hdrs:     []string{"a.h", "b.h"},
-        Srcs:     []string{"b.c"},
-        Copts: []string{"-Isource_sets/dir"},
-        Deps: []string{
-          "//source_sets/dir:c",
+        Name:     "all_ble",
+        Deps:     []string{
+          "//umbrellas/components/ble/ble_advertising",
+          "//umbrellas/components/ble/common:ble_srv_common",
         },
       },
     }, nil, nil),
-    newBuildFile(filepath.Join(sdkDir, "dir"), []*buildfile.Library{
+    // The testonly mock is left out.
+    newBuildFile(filepath.Join(sdkDir, "components/libraries"), []*buildfile.Library{
       {
-        Name:     "c",
-        Hdrs:     []string{"c.h"},
+        Name:     "all",
+        Deps:     []string{"//umbrellas/components/libraries/util:app_util"},
       },
     }, nil, nil),
   )
 }
 
-func TestGenerateBuildFiles_CyclesNominal(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "cycles_nominal")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err != nil {
+func TestGenerateBuildFiles_Granularity(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "granularity")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
     t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
   checkBuildFiles(t,
-    newBuildFile(sdkDir, []*buildfile.Library{
+    // app.h's include is found in include_dirs, in fifo's library.
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
       {
-        Name: "a",
-        Deps: []string{":abcd"},
+        Name:     "app",
+        Hdrs:     []string{"app.h"},
+        Deps:     []string{"//granularity/fifo"},
+        Copts:    []string{"-Igranularity/fifo"},
       },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "fifo"), []*buildfile.Library{
       {
-        Name: "abcd",
-        Hdrs: []string{
-          "//cycles_nominal/dir2:d.h",
-          "//cycles_nominal/dir:c.h",
-          "a.h",
-          "b.h",
-        },
-        Copts: []string{
-					"-Icycles_nominal",
-					"-Icycles_nominal/dir",
-					"-Icycles_nominal/dir2",
-				},
-        Deps: []string{"//cycles_nominal/dir2:used_by_cyclic"},
+        Name:     "fifo",
+        Srcs:     []string{"app_fifo.c"},
+        Hdrs:     []string{"app_fifo.h", "app_fifo_internal.h", "app_fifo_unused.h"},
+        Deps:     []string{"//granularity/util:app_util"},
+        Copts:    []string{"-Igranularity/util"},
       },
+    }, nil, nil),
+    // per_header takes precedence over the mode.
+    newBuildFile(filepath.Join(sdkDir, "util"), []*buildfile.Library{
       {
-        Name: "b",
-        Deps: []string{":abcd"},
+        Name:     "app_error",
+        Hdrs:     []string{"app_error.h"},
+        Deps:     []string{":app_util"},
+        Copts:    []string{"-Igranularity/util"},
       },
-    }, nil, nil),
-    newBuildFile(filepath.Join(sdkDir, "dir"), []*buildfile.Library{
       {
-        Name: "uses_cyclic",
-        Hdrs: []string{"uses_cyclic.h"},
-        Copts: []string{"-Icycles_nominal/dir"},
-        Deps: []string{":c"},
+        Name:     "app_util",
+        Hdrs:     []string{"app_util.h"},
       },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_MergeMacroHeaders(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "macro_headers")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  // app_fifo_config.h only has macros, and only app_fifo includes it.
+  // app_fifo_types.h has a typedef, and shared_macros.h has two dependents.
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "fifo"), []*buildfile.Library{
       {
-        Name: "c",
-        Deps: []string{"//cycles_nominal:abcd"},
+        Name:     "app_fifo",
+        Srcs:     []string{"app_fifo.c"},
+        Hdrs:     []string{"app_fifo.h", "app_fifo_config.h"},
+        Deps:     []string{":app_fifo_types", ":shared_macros", "//macro_headers/util:app_util"},
+        Copts:    []string{"-Imacro_headers/fifo", "-Imacro_headers/util"},
       },
-    }, nil, []string{"c.h"}),
-    newBuildFile(filepath.Join(sdkDir, "dir2"), []*buildfile.Library{
       {
-        Name: "used_by_cyclic",
-        Hdrs: []string{"used_by_cyclic.h"},
+        Name:     "app_fifo_types",
+        Hdrs:     []string{"app_fifo_types.h"},
       },
       {
-        Name: "d",
-        Deps: []string{"//cycles_nominal:abcd"},
+        Name:     "shared_macros",
+        Hdrs:     []string{"shared_macros.h"},
       },
-    }, nil, []string{"d.h"}),
+    }, nil, nil),
   )
 }
 
-func TestGenerateBuildFiles_CyclesMultipleGroups(t *testing.T) {
-  workspaceDir, sdkDir := setup(t, "cycles_multiple_groups")
-  if err := GenerateBuildFiles(workspaceDir, sdkDir, true); err != nil {
+func TestGenerateBuildFiles_OrphanSources(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "orphan_sources")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  // src/nrf_log_frontend.c is named after nrf_log.h in the parent dir, and
+  // ringbuf_impl.c only includes nrf_ringbuf.h. retarget.c has neither.
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "components/libraries/log"), []*buildfile.Library{
+      {
+        Name:     "nrf_log",
+        Srcs:     []string{"//orphan_sources/components/libraries/log/src:nrf_log_frontend.c"},
+        Hdrs:     []string{"nrf_log.h"},
+        Copts:    []string{"-Iorphan_sources/components/libraries/log"},
+      },
+      {
+        Name:     "nrf_ringbuf",
+        Srcs:     []string{"ringbuf_impl.c"},
+        Hdrs:     []string{"nrf_ringbuf.h"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "components/libraries/log/src"), nil, nil, []string{"nrf_log_frontend.c"}),
+  )
+  orphans, err := os.ReadFile(filepath.Join(sdkDir, ".bazelify-out/orphan_sources.txt"))
+  if err != nil {
+    t.Fatalf("read orphan_sources.txt: %v", err)
+  }
+  if diff := cmp.Diff("//orphan_sources/components/libraries/log:retarget.c\n", string(orphans)); diff != "" {
+    t.Errorf("orphan_sources.txt (-want +got):\n%s", diff)
+  }
+}
+
+func TestGenerateBuildFiles_DefinePruning(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "define_pruning")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  // sdk_config.h disables nrf_log, so app.h's include of nrf_log.h is
+  // skipped, and so is no_timer.h in the #else of APP_TIMER_ENABLED. nrf_cli
+  // is disabled too, but app.h includes it anyway. sdk_config.h's own include
+  // guard doesn't rule out its app_config.h include.
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "config"), []*buildfile.Library{
+      {
+        Name:     "sdk_config",
+        Hdrs:     []string{"sdk_config.h"},
+        Deps:     []string{"//define_pruning:app_config_flag"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
+      {
+        Name:     "app",
+        Hdrs:     []string{"app.h"},
+        Deps:     []string{
+          "//define_pruning:sdk_config_flag",
+          "//define_pruning/cli:nrf_cli",
+          "//define_pruning/timer:app_timer",
+        },
+        Copts: []string{"-Idefine_pruning/cli", "-Idefine_pruning/timer"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "cli"), []*buildfile.Library{
+      {
+        Name:     "nrf_cli",
+        Hdrs:     []string{"nrf_cli.h"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "timer"), []*buildfile.Library{
+      {
+        Name:     "app_timer",
+        Srcs:     []string{"app_timer.c"},
+        Hdrs:     []string{"app_timer.h"},
+      },
+    }, nil, nil),
+  )
+  // nrf_log_ctrl is disabled by the modules entry, once nrf_log is gone.
+  if _, err := os.Stat(filepath.Join(sdkDir, "log", "BUILD")); err == nil {
+    t.Errorf("BUILD file in log created, but its libraries are disabled")
+  }
+}
+
+func TestGenerateBuildFiles_Tags(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "tags")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  tags := []string{"sdk", "manual"}
+  aFile := newBuildFile(filepath.Join(sdkDir, "a"), []*buildfile.Library{
+    {
+      Name:     "a",
+      Hdrs:     []string{"a.h"},
+    },
+  }, nil, nil)
+  aFile.SetTags(tags)
+  checkBuildFiles(t, aFile)
+  chips, err := os.ReadFile(filepath.Join(sdkDir, "chips/BUILD"))
+  if err != nil {
+    t.Fatalf("read chips/BUILD: %v", err)
+  }
+  want := `platform(
+    name = "pca10056_platform",
+    constraint_values = [
+        "@platforms//cpu:armv7e-m",
+        "@platforms//os:none",
+        ":nrf52840",
+        ":pca10056",
+    ],
+    tags = [
+        "manual",
+        "sdk",
+    ],
+)`
+  if !strings.Contains(string(chips), want) {
+    t.Errorf("chips/BUILD doesn't contain %s:\n%s", want, chips)
+  }
+}
+
+func TestGenerateBuildFiles_Banner(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "chips_nrf")
+  flag.Set("sdk_version", "none")
+  t.Cleanup(func() { flag.Set("sdk_version", "") })
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  want := `# Generated by nrfbazelify devel. DO NOT EDIT.
+# SDKs, relative to the workspace: chips_nrf
+# Flags: --sdk_version=none
+# Changes are lost when the SDKs are regenerated, configure them in
+# .bazelifyrc instead.
+`
+  for _, name := range []string{"app/BUILD", filepath.Join(chipsDir, "BUILD"), bzlFilename} {
+    contents, err := os.ReadFile(filepath.Join(sdkDir, name))
+    if err != nil {
+      t.Fatalf("os.ReadFile(%q): %v", name, err)
+    }
+    if !strings.HasPrefix(string(contents), want) {
+      t.Errorf("%s doesn't start with the banner:\n%s", name, contents)
+    }
+  }
+}
+
+func TestGenerateBuildFiles_Merge(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "merge")
+  existing := `cc_library(
+    name = "a",
+    hdrs = ["a.h"],
+    copts = ["-O3"],  # keep
+    deps = [
+        "//third_party:log",  # keep
+        ":stale",
+    ],
+)
+
+cc_library(name = "b", srcs = ["b.c"], hdrs = ["b.h"], deps = [":a", ":manual"])  # keep
+
+# keep: not in the SDK
+cc_library(
+    name = "manual",
+    srcs = ["manual.c"],
+)
+
+cc_library(
+    name = "stale",
+    hdrs = ["stale.h"],
+)
+`
+  buildPath := filepath.Join(sdkDir, "BUILD")
+  if err := os.WriteFile(buildPath, []byte(existing), 0644); err != nil {
+    t.Fatalf("os.WriteFile(%s): %v", buildPath, err)
+  }
+  want := `load("@rules_cc//cc:defs.bzl", "cc_library")
+
+package(default_visibility = ["//visibility:public"])
+
+cc_library(
+    name = "a",
+    hdrs = ["a.h"],
+    tags = ["nrfbazelify-generated"],
+    copts = ["-O3"],  # keep
+    deps = [
+        "//third_party:log",  # keep
+    ],
+)
+
+# keep
+cc_library(
+    name = "b",
+    srcs = ["b.c"],
+    hdrs = ["b.h"],
+    deps = [
+        ":a",
+        ":manual",
+    ],
+)
+
+# keep: not in the SDK
+cc_library(
+    name = "manual",
+    srcs = ["manual.c"],
+)
+`
+  // Regenerating keeps the same things again.
+  for i := 0; i < 2; i++ {
+    if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+      t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+    }
+    got, err := os.ReadFile(buildPath)
+    if err != nil {
+      t.Fatalf("os.ReadFile(%s): %v", buildPath, err)
+    }
+    if diff := cmp.Diff(want, stripBanner(string(got))); diff != "" {
+      t.Errorf("generation %d: %s diff (-want +got):\n%s", i+1, buildPath, diff)
+    }
+  }
+}
+
+func TestGenerateBuildFiles_StableLabels(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "stable_labels")
+  oldDir := filepath.Join(sdkDir, "old")
+  t.Cleanup(func() {
+    if err := os.RemoveAll(oldDir); err != nil {
+      t.Errorf("os.RemoveAll(%q): %v", oldDir, err)
+    }
+    if err := os.Remove(labelsPath(sdkDir)); err != nil && !os.IsNotExist(err) {
+      t.Errorf("os.Remove(%q): %v", labelsPath(sdkDir), err)
+    }
+  })
+  // The last run put a.h in //stable_labels/old:a, and b.h where it still is.
+  last := &LabelsFile{
+    Headers: map[string]string{
+      "stable_labels/a.h": "//stable_labels/old:a",
+      "stable_labels/b.h": "//stable_labels:b",
+    },
+  }
+  if err := last.Write(sdkDir); err != nil {
+    t.Fatalf("LabelsFile.Write: %v", err)
+  }
+  wantLabels := &LabelsFile{
+    Headers: map[string]string{
+      "stable_labels/a.h": "//stable_labels:a",
+      "stable_labels/b.h": "//stable_labels:b",
+    },
+    Aliases: map[string]string{
+      "//stable_labels/old:a": "stable_labels/a.h",
+    },
+  }
+  // Only aliases are in the old package, so cc_library isn't loaded.
+  oldFile := buildfile.New(oldDir)
+  oldFile.SetTags([]string{defaultTag})
+  oldFile.AddRule(buildfile.NewAlias("a", "//stable_labels:a", "//stable_labels/old:a moved to //stable_labels:a"))
+  // The alias stays on the next run, even though a.h didn't move again.
+  for i := 0; i < 2; i++ {
+    if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+      t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+    }
+    checkBuildFiles(t,
+      newBuildFile(sdkDir, []*buildfile.Library{
+        {
+          Name: "a",
+          Hdrs: []string{"a.h"},
+        },
+        {
+          Name: "b",
+          Hdrs: []string{"b.h"},
+          Deps: []string{":a"},
+          Copts: []string{"-Istable_labels"},
+        },
+      }, nil, nil),
+      oldFile,
+    )
+    labels, err := ReadLabelsFile(sdkDir)
+    if err != nil {
+      t.Fatalf("ReadLabelsFile: %v", err)
+    }
+    if diff := cmp.Diff(wantLabels, labels); diff != "" {
+      t.Errorf("run %d: %s diff (-want +got):\n%s", i+1, labelsFilename, diff)
+    }
+  }
+}
+
+func TestGenerateBuildFiles_ExternalIncludeOverrides(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "external_include_overrides")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name: "a",
+        Hdrs: []string{"a.h"},
+        Copts: []string{"-Iexternal/cmsis/CMSIS/Core/Include"},
+        Deps: []string{"@cmsis//CMSIS/Core:core"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_MacroIncludes(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "macro_includes")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name: "a",
+        Hdrs: []string{"a.h"},
+        Copts: []string{
+          "-Iexternal/log/include",
+          "-Imacro_includes",
+        },
+        Deps: []string{
+          ":app_config",
+          "@log//:backend",
+        },
+      },
+      {
+        Name: "app_config",
+        Hdrs: []string{"app_config.h"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_RemapTemplate(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "remap_template")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  remapBzl, err := os.ReadFile(filepath.Join(sdkDir, "remap.bzl"))
+  if err != nil {
+    t.Fatalf("read remap.bzl: %v", err)
+  }
+  // The template overrides the allowlist and adds a macro, and the rest of
+  // remap.bzl stays the same.
+  for _, want := range []string{
+    `default = "//tools/allowlists:function_transition",`,
+    "# Added by remap.bzl.tmpl, with 1 remap.\ndef nrf_cc_test(name, **kwargs):",
+    `a = remap.get("a.h", "//remap_template:nrfbazelify_empty_remap"),`,
+    "def nrf_flash(",
+  } {
+    if !strings.Contains(string(remapBzl), want) {
+      t.Errorf("remap.bzl doesn't contain %q:\n%s", want, remapBzl)
+    }
+  }
+  if strings.Contains(string(remapBzl), "function_transition_whitelist") {
+    t.Errorf("remap.bzl has the default allowlist:\n%s", remapBzl)
+  }
+}
+
+func TestGenerateBuildFiles_StringListRemaps(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "string_list_remaps")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  rootFile := newBuildFile(sdkDir, []*buildfile.Library{
+    {
+      Name: "a",
+      Hdrs: []string{"a.h"},
+      Deps: []string{":nrf_defines_defines"},
+    },
+  }, nil, nil)
+  rootFile.AddLoad(&buildfile.Load{
+    Source: "//string_list_remaps:remap.bzl",
+    Symbols: []string{"string_list_defines"},
+  })
+  rootFile.AddFlag(&buildfile.Flag{
+    Kind: buildfile.StringListSetting,
+    Name: "nrf_defines",
+    BuildSettingDefault: buildfile.StringList([]string{"NRF_LOG_ENABLED=0"}),
+  })
+  rootFile.AddFlag(&buildfile.Flag{
+    Kind: buildfile.StringListSetting,
+    Name: "nrf_features",
+    BuildSettingDefault: buildfile.StringList(nil),
+  })
+  rootFile.AddRule(buildfile.NewRule("string_list_defines", "nrf_defines_defines").SetAttr("setting", buildfile.String(":nrf_defines")))
+  checkBuildFiles(t,
+    rootFile,
+    newBuildFile(filepath.Join(sdkDir, "sub"), []*buildfile.Library{
+      {
+        Name: "b",
+        Hdrs: []string{"b.h"},
+        Copts: []string{"-Istring_list_remaps"},
+        Deps: []string{
+          "//string_list_remaps:a",
+          "//string_list_remaps:nrf_defines_defines",
+        },
+      },
+    }, nil, nil),
+  )
+  remapBzl, err := os.ReadFile(filepath.Join(sdkDir, "remap.bzl"))
+  if err != nil {
+    t.Fatalf("read remap.bzl: %v", err)
+  }
+  // nrf_cc_binary transitions the settings to its attributes, and
+  // string_list_defines turns them into defines.
+  for _, want := range []string{
+    `load("@bazel_skylib//rules:common_settings.bzl", "BuildSettingInfo")`,
+    `"//string_list_remaps:nrf_defines": attr.nrf_defines,`,
+    `"nrf_features": attr.string_list(),`,
+    `nrf_defines = kwargs.pop("nrf_defines", ["NRF_LOG_ENABLED=0"])`,
+    `nrf_features = kwargs.pop("nrf_features", [])`,
+    "nrf_defines = nrf_defines,",
+    "string_list_defines = rule(",
+  } {
+    if !strings.Contains(string(remapBzl), want) {
+      t.Errorf("remap.bzl doesn't contain %q:\n%s", want, remapBzl)
+    }
+  }
+}
+
+func TestGenerateBuildFiles_RemapLabelFlags(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "remap_label_flags")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  rootFile := newBuildFile(sdkDir, []*buildfile.Library{
+    {
+      Name: "b",
+      Hdrs: []string{"b.h"},
+      Deps: []string{":a_remap", ":nrf_defines_defines"},
+    },
+    {
+      Name: "nrfbazelify_empty_remap",
+      Deps: []string{":nrf_defines_defines"},
+    },
+  }, []*buildfile.LabelSetting{
+    {
+      Name: "a_remap",
+      BuildSettingDefault: "//remap_label_flags:nrfbazelify_empty_remap",
+      Flag: true,
+    },
+  }, nil)
+  rootFile.AddLoad(&buildfile.Load{
+    Source: "//remap_label_flags:remap.bzl",
+    Symbols: []string{"string_list_defines"},
+  })
+  rootFile.AddFlag(&buildfile.Flag{
+    Kind: buildfile.StringListFlag,
+    Name: "nrf_defines",
+    BuildSettingDefault: buildfile.StringList(nil),
+  })
+  rootFile.AddRule(buildfile.NewRule("string_list_defines", "nrf_defines_defines").SetAttr("setting", buildfile.String(":nrf_defines")))
+  checkBuildFiles(t, rootFile)
+  remapBzl, err := os.ReadFile(filepath.Join(sdkDir, "remap.bzl"))
+  if err != nil {
+    t.Fatalf("read remap.bzl: %v", err)
+  }
+  // There's no transition, and nrf_cc_binary refuses to remap.
+  for _, want := range []string{
+    "#   a.h: //remap_label_flags:a_remap",
+    "#   nrf_defines: //remap_label_flags:nrf_defines",
+    `  if remap or "nrf_defines" in kwargs:`,
+    "  cc_binary(\n    name = name,\n",
+  } {
+    if !strings.Contains(string(remapBzl), want) {
+      t.Errorf("remap.bzl doesn't contain %q:\n%s", want, remapBzl)
+    }
+  }
+  for _, unwanted := range []string{"transition(", "_remap_rule(", "function_transition_whitelist"} {
+    if strings.Contains(string(remapBzl), unwanted) {
+      t.Errorf("remap.bzl contains %q:\n%s", unwanted, remapBzl)
+    }
+  }
+}
+
+func TestGenerateBuildFiles_RemapDefaults(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "remap_defaults")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name: "b",
+        Hdrs: []string{"b.h"},
+        Deps: []string{":a_remap", ":c_remap"},
+      },
+      {
+        Name: "nrfbazelify_empty_remap",
+      },
+    }, []*buildfile.LabelSetting{
+      {
+        Name: "a_remap",
+        BuildSettingDefault: "//remap_defaults/impl:a_impl",
+      },
+      {
+        Name: "c_remap",
+        BuildSettingDefault: "//remap_defaults:nrfbazelify_empty_remap",
+      },
+    }, nil),
+    newBuildFile(filepath.Join(sdkDir, "impl"), []*buildfile.Library{
+      {
+        Name: "a_impl",
+        Hdrs: []string{"a_impl.h"},
+      },
+    }, nil, nil),
+  )
+  remapBzl, err := os.ReadFile(filepath.Join(sdkDir, "remap.bzl"))
+  if err != nil {
+    t.Fatalf("read remap.bzl: %v", err)
+  }
+  // Binaries that don't set the remap get the default too.
+  for _, want := range []string{
+    `a = remap.get("a.h", "//remap_defaults/impl:a_impl"),`,
+    `c = remap.get("c.h", "//remap_defaults:nrfbazelify_empty_remap"),`,
+  } {
+    if !strings.Contains(string(remapBzl), want) {
+      t.Errorf("remap.bzl doesn't contain %q:\n%s", want, remapBzl)
+    }
+  }
+}
+
+func TestGenerateBuildFiles_ThirdParty(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "third_party")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  licenseRoot := func(dir string, rule *buildfile.Rule, libs []*buildfile.Library) *buildfile.File {
+    f := newBuildFile(filepath.Join(sdkDir, dir), libs, nil, nil)
+    f.AddLoad(&buildfile.Load{
+      Source: "@rules_license//rules:license.bzl",
+      Symbols: []string{"license"},
+    })
+    f.SetPackageLicenses([]string{":license"})
+    f.AddRule(rule)
+    return f
+  }
+  fatfs := licenseRoot("external/fatfs", buildfile.NewRule("license", "license").
+    SetAttr("license_kinds", buildfile.StringList([]string{"@rules_license//licenses/generic:notice"})).
+    SetAttr("license_text", buildfile.String("//third_party/external/fatfs/src:00readme.txt")).
+    SetAttr("package_name", buildfile.String("fatfs")).
+    SetAttr("package_version", buildfile.String("R0.13c")), nil)
+  fatfsSrc := newBuildFile(filepath.Join(sdkDir, "external", "fatfs", "src"), []*buildfile.Library{
+    {
+      Name: "ff",
+      Hdrs: []string{"ff.h"},
+    },
+  }, nil, []string{"00readme.txt"})
+  fatfsSrc.SetPackageLicenses([]string{"//third_party/external/fatfs:license"})
+  freertos := licenseRoot("external/freertos", buildfile.NewRule("license", "license").
+    SetAttr("license_kinds", buildfile.StringList([]string{"@rules_license//licenses/spdx:MIT"})).
+    SetAttr("license_text", buildfile.String("LICENSE")).
+    SetAttr("package_name", buildfile.String("freertos")), nil)
+  freertosInclude := newBuildFile(filepath.Join(sdkDir, "external", "freertos", "source", "include"), []*buildfile.Library{
+    {
+      Name: "FreeRTOS",
+      Hdrs: []string{"FreeRTOS.h"},
+    },
+  }, nil, nil)
+  freertosInclude.SetPackageLicenses([]string{"//third_party/external/freertos:license"})
+  microECC := licenseRoot("external/micro-ecc", buildfile.NewRule("license", "license").
+    SetAttr("license_kinds", buildfile.StringList([]string{"@rules_license//licenses/spdx:BSD-2-Clause"})).
+    SetAttr("license_text", buildfile.String("LICENSE.txt")).
+    SetAttr("package_name", buildfile.String("micro-ecc")), []*buildfile.Library{
+    {
+      Name: "uECC",
+      Hdrs: []string{"uECC.h"},
+    },
+  })
+  checkBuildFiles(t, fatfs, fatfsSrc, freertos, freertosInclude, microECC)
+  if _, err := os.Stat(filepath.Join(sdkDir, "external", "empty", "BUILD")); err == nil {
+    t.Errorf("BUILD file in external/empty created, but it has no code")
+  }
+
+  report, err := os.ReadFile(filepath.Join(sdkDir, bazelifyOutDirname, thirdPartyReportFilename))
+  if err != nil {
+    t.Fatalf("ReadFile(%s): %v", thirdPartyReportFilename, err)
+  }
+  want := `dir	package_name	package_version	license_kinds	license_text	packages
+external/empty	empty		unknown	unknown	0
+external/fatfs	fatfs	R0.13c	@rules_license//licenses/generic:notice	src/00readme.txt	1
+external/freertos	freertos		@rules_license//licenses/spdx:MIT	LICENSE	1
+external/micro-ecc	micro-ecc		@rules_license//licenses/spdx:BSD-2-Clause	LICENSE.txt	1
+`
+  if diff := cmp.Diff(want, string(report)); diff != "" {
+    t.Errorf("%s (-want +got):\n%s", thirdPartyReportFilename, diff)
+  }
+}
+
+func TestGenerateBuildFiles_SBOM(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "third_party")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  data, err := os.ReadFile(filepath.Join(sdkDir, bazelifyOutDirname, sbomFilename))
+  if err != nil {
+    t.Fatalf("ReadFile(%s): %v", sbomFilename, err)
+  }
+  var doc spdxDocument
+  if err := json.Unmarshal(data, &doc); err != nil {
+    t.Fatalf("json.Unmarshal: %v", err)
+  }
+  if doc.SPDXVersion != "SPDX-2.3" || !strings.HasPrefix(doc.DocumentNamespace, sbomNamespacePrefix) {
+    t.Errorf("SBOM header = %q, %q, want SPDX-2.3 in %s", doc.SPDXVersion, doc.DocumentNamespace, sbomNamespacePrefix)
+  }
+  type pkg struct {
+    name, version, license string
+  }
+  packages := make(map[string]pkg)
+  for _, p := range doc.Packages {
+    packages[p.SPDXID] = pkg{p.Name, p.VersionInfo, p.LicenseDeclared}
+  }
+  for id, want := range map[string]pkg{
+    "SPDXRef-SDK-third-party": {"nRF5 SDK", "17.1", spdxNoAssertion},
+    "SPDXRef-Component-third-party-external-fatfs": {"fatfs", "R0.13c", spdxNoAssertion},
+    "SPDXRef-Component-third-party-external-freertos": {"freertos", spdxNoAssertion, "MIT"},
+    "SPDXRef-Package-third-party": {"//third_party", "17.1", spdxNoAssertion},
+    "SPDXRef-Package-third-party-external-fatfs-src": {"//third_party/external/fatfs/src", "R0.13c", spdxNoAssertion},
+    "SPDXRef-Package-third-party-external-freertos-source-include": {"//third_party/external/freertos/source/include", spdxNoAssertion, "MIT"},
+  } {
+    if got, ok := packages[id]; !ok || got != want {
+      t.Errorf("package %s = %+v, want %+v", id, got, want)
+    }
+  }
+  if _, ok := packages["SPDXRef-Component-third-party-external-empty"]; ok {
+    t.Errorf("external/empty is in the SBOM, but has no generated packages")
+  }
+  relationships := make(map[string]bool)
+  for _, r := range doc.Relationships {
+    relationships[r.SPDXElementID+" "+r.RelationshipType+" "+r.RelatedSPDXElement] = true
+  }
+  for _, want := range []string{
+    "SPDXRef-DOCUMENT DESCRIBES SPDXRef-SDK-third-party",
+    "SPDXRef-SDK-third-party CONTAINS SPDXRef-Component-third-party-external-freertos",
+    "SPDXRef-SDK-third-party CONTAINS SPDXRef-Package-third-party",
+    "SPDXRef-Component-third-party-external-freertos CONTAINS SPDXRef-Package-third-party-external-freertos-source-include",
+  } {
+    if !relationships[want] {
+      t.Errorf("SBOM is missing relationship %q", want)
+    }
+  }
+}
+
+func TestGenerateBuildFiles_TransitiveReduction(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "transitive_reduction")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    // b already depends on c, so a only depends on b, but keeps c's include dir.
+    newBuildFile(filepath.Join(sdkDir, "a"), []*buildfile.Library{
+      {
+        Name: "a",
+        Hdrs: []string{"a.h"},
+        Copts: []string{
+          "-Itransitive_reduction/b",
+          "-Itransitive_reduction/c",
+        },
+        Deps: []string{"//transitive_reduction/b"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "b"), []*buildfile.Library{
+      {
+        Name: "b",
+        Hdrs: []string{"b.h"},
+        Copts: []string{"-Itransitive_reduction/c"},
+        Deps: []string{"//transitive_reduction/c"},
+      },
+    }, nil, nil),
+  )
+  data, err := os.ReadFile(filepath.Join(sdkDir, ".bazelify-out", provenanceFilename))
+  if err != nil {
+    t.Fatalf("read %s: %v", provenanceFilename, err)
+  }
+  var got struct {
+    Deps []*DepProvenance `json:"deps"`
+  }
+  if err := json.Unmarshal(data, &got); err != nil {
+    t.Fatalf("json.Unmarshal: %v", err)
+  }
+  // a's dep on c isn't in its BUILD file, so it isn't in provenance.json.
+  want := []*DepProvenance{
+    {From: "//transitive_reduction/a", To: "//transitive_reduction/b", Method: "only_candidate", Include: "b.h"},
+    {From: "//transitive_reduction/b", To: "//transitive_reduction/c", Method: "only_candidate", Include: "c.h"},
+  }
+  if diff := cmp.Diff(want, got.Deps); diff != "" {
+    t.Errorf("%s (-want +got):\n%s", provenanceFilename, diff)
+  }
+}
+
+func TestGenerateBuildFiles_ShadowedIncludeDirs(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "shadowed_include_dirs")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  // x comes first in include_dirs, so its cfg.h shadows y's.
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
+      {
+        Name: "app",
+        Hdrs: []string{"app.h"},
+        Copts: []string{"-Ishadowed_include_dirs/x"},
+        Deps: []string{"//shadowed_include_dirs/x:cfg"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_ShadowedIncludeDirsStrict(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "shadowed_include_dirs")
+  flag.Set("strict", "true")
+  t.Cleanup(func() { flag.Set("strict", "false") })
+  err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err == nil || !strings.Contains(err.Error(), "//shadowed_include_dirs/y:cfg") {
+    t.Errorf("GenerateBuildFiles: got %v, want an error about the shadowed //shadowed_include_dirs/y:cfg", err)
+  }
+}
+
+func TestGenerateBuildFiles_IncludeDirPriorities(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "include_dir_priorities")
+  // y's cfg.h wins by priority, so it isn't a tie even with --strict.
+  flag.Set("strict", "true")
+  t.Cleanup(func() { flag.Set("strict", "false") })
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
+      {
+        Name: "app",
+        Hdrs: []string{"app.h"},
+        Copts: []string{"-Iinclude_dir_priorities/y"},
+        Deps: []string{"//include_dir_priorities/y:cfg"},
+      },
+    }, nil, nil),
+  )
+  data, err := os.ReadFile(filepath.Join(sdkDir, ".bazelify-out", provenanceFilename))
+  if err != nil {
+    t.Fatalf("read %s: %v", provenanceFilename, err)
+  }
+  var got struct {
+    Deps []*DepProvenance `json:"deps"`
+  }
+  if err := json.Unmarshal(data, &got); err != nil {
+    t.Fatalf("json.Unmarshal: %v", err)
+  }
+  priority := int32(1)
+  want := []*DepProvenance{
+    {
+      From: "//include_dir_priorities/app",
+      To: "//include_dir_priorities/y:cfg",
+      Method: "include_dirs",
+      Include: "cfg.h",
+      IncludeDir: "include_dir_priorities/y",
+      Priority: &priority,
+    },
+  }
+  if diff := cmp.Diff(want, got.Deps); diff != "" {
+    t.Errorf("%s (-want +got):\n%s", provenanceFilename, diff)
+  }
+}
+
+func TestGenerateBuildFiles_RelativeIncludes(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "relative_includes")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "up_one"), []*buildfile.Library{
+      {
+        Name:     "a",
+        Hdrs:     []string{"a.h"},
+        Srcs: 		[]string{"a.c"},
+        Deps:     []string{"//relative_includes/back_and_around:b"},
+        Copts: []string{"-Irelative_includes/back_and_around"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "back_and_around"), []*buildfile.Library{
+      {
+        Name:     "b",
+        Hdrs:     []string{"b.h"},
+        Srcs: 		[]string{"b.c"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_BuildFileExists(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "build_file_exists")
+  garbageBuild := filepath.Join(sdkDir, "BUILD")
+  if err := os.WriteFile(garbageBuild, []byte(garbageText), 0644); err != nil {
+    t.Fatalf("os.WriteFile(%s, %s): %v", garbageBuild, garbageText, err)
+  }
+  err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err == nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): got nil error, want an error", workspaceDir, sdkDir)
+  }
+  if want := "build_file_exists/BUILD"; !strings.Contains(err.Error(), want) || !strings.Contains(err.Error(), "--force") {
+    t.Errorf("GenerateBuildFiles(%s, %s): got %v, want it to mention %q and --force", workspaceDir, sdkDir, err, want)
+  }
+  contents, err := os.ReadFile(garbageBuild)
+  if err != nil {
+    t.Fatalf("os.ReadFile(%s): %v", garbageBuild, err)
+  }
+  if got := string(contents); got != garbageText {
+    t.Errorf("%s = %q, want it left alone", garbageBuild, got)
+  }
+}
+
+func TestGenerateBuildFiles_BuildFileExistsForce(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "build_file_exists")
+  flag.Set("force", "true")
+  t.Cleanup(func() { flag.Set("force", "false") })
+  garbageBuild := filepath.Join(sdkDir, "BUILD")
+  if err := os.WriteFile(garbageBuild, []byte(garbageText), 0644); err != nil {
+    t.Fatalf("os.WriteFile(%s, %s): %v", garbageBuild, garbageText, err)
+  }
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name:     "a",
+        Hdrs:     []string{"a.h"},
+      },
+    }, nil, nil),
+  )
+  buildPath := filepath.Join(sdkDir, "BUILD")
+  contents, err := os.ReadFile(buildPath)
+  if err != nil {
+    t.Fatalf("os.ReadFile(%s): %v", buildPath, err)
+  }
+  if got, dontWant := string(contents), "garbage to remove"; strings.Contains(got, dontWant) {
+    t.Errorf("strings.Contains(%s, %s): got true, want false", got, dontWant)
+  }
+}
+
+func TestGenerateBuildFiles_ReplacesGeneratedBuildFiles(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "build_file_exists")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  // Edited files are recognized by their banner, even without the manifest.
+  buildPath := filepath.Join(sdkDir, "BUILD")
+  contents, err := os.ReadFile(buildPath)
+  if err != nil {
+    t.Fatalf("os.ReadFile(%s): %v", buildPath, err)
+  }
+  if err := os.WriteFile(buildPath, append(contents, garbageText...), 0644); err != nil {
+    t.Fatalf("os.WriteFile(%s): %v", buildPath, err)
+  }
+  if err := os.RemoveAll(filepath.Join(sdkDir, bazelifyOutDirname)); err != nil {
+    t.Fatalf("os.RemoveAll: %v", err)
+  }
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s) again: %v", workspaceDir, sdkDir, err)
+  }
+  contents, err = os.ReadFile(buildPath)
+  if err != nil {
+    t.Fatalf("os.ReadFile(%s): %v", buildPath, err)
+  }
+  if strings.Contains(string(contents), garbageText) {
+    t.Errorf("%s wasn't replaced:\n%s", buildPath, contents)
+  }
+}
+
+func TestGenerateBuildFiles_WorkspaceMatchesSDKDir(t *testing.T) {
+  _, workspaceAndSDKDir := setup(t, "workspace_matches_sdk_dir")
+  if err := GenerateBuildFiles(context.Background(), workspaceAndSDKDir, []string{workspaceAndSDKDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", testDataDir, workspaceAndSDKDir, err)
+  }
+  checkBuildFiles(t, 
+    newBuildFile(workspaceAndSDKDir, []*buildfile.Library{
+      {
+        Name:     "a",
+        Hdrs:     []string{"a.h"},
+        Deps:     []string{":workspace_matches_sdk_dir"},
+        Copts: []string{"-I."},
+      },
+      {
+        Name:     "workspace_matches_sdk_dir",
+        Srcs:     []string{"workspace_matches_sdk_dir.c"},
+        Hdrs:     []string{"workspace_matches_sdk_dir.h"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_IncludeDoesNotExist(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "include_does_not_exist")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err == nil {
+    t.Errorf("GenerateBuildFiles(%s, %s): got nil error, want an error", workspaceDir, sdkDir)
+  }
+}
+
+func TestGenerateBuildFiles_BazelifyRCHint(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "bazelifyrc_hint")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err == nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): got nil error, want an error", workspaceDir, sdkDir)
+  }
+  hintPath := filepath.Join(sdkDir, ".bazelifyrc.hint")
+  hintText, err := os.ReadFile(hintPath)
+  if err != nil {
+    t.Fatalf("os.ReadFile(%s): %v", hintPath, err)
+  }
+  var hint bazelifyrc.Configuration 
+  if err := prototext.Unmarshal(hintText, &hint); err != nil {
+    t.Fatalf("proto.UnmarshalText(%s): %v", string(hintText), err)
+  }
+  if diff := cmp.Diff(&bazelifyrc.Configuration{
+    IncludeOverrides: []*bazelifyrc.IncludeOverride{
+      {
+				Include: "doesnotexist.h",
+				Label: "INCLUDED BY //bazelifyrc_hint:exists PLEASE RESOLVE: ",
+			},
+    },
+  }, &hint, protocmp.Transform()); diff != "" {
+    t.Fatalf("bazelifyrc hint (-want +got): %s", diff)
+  }
+}
+
+func TestGenerateBuildFiles_BazelifyRCHintExcludes(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "hint_excludes")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err == nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): got nil error, want an error", workspaceDir, sdkDir)
+  }
+  hintPath := filepath.Join(sdkDir, ".bazelifyrc.hint")
+  hintText, err := os.ReadFile(hintPath)
+  if err != nil {
+    t.Fatalf("os.ReadFile(%s): %v", hintPath, err)
+  }
+  // 3 of the 5 unresolved includes are only from examples/ble. examples has
+  // 4, but examples/ble is deeper.
+  want := `#   excludes: "examples/ble"  # 3 of 5 unresolved includes`
+  if !strings.Contains(string(hintText), want) || strings.Contains(string(hintText), `excludes: "examples"`) {
+    t.Errorf("hint:\n%s\nwant only the suggestion %q", hintText, want)
+  }
+  // The suggestion is a comment, so it isn't applied.
+  var hint bazelifyrc.Configuration
+  if err := prototext.Unmarshal(hintText, &hint); err != nil {
+    t.Fatalf("proto.UnmarshalText(%s): %v", string(hintText), err)
+  }
+  if len(hint.GetExcludes()) != 0 || len(hint.GetIncludeOverrides()) != 5 {
+    t.Errorf("hint has excludes %q and %d include_overrides, want none and 5", hint.GetExcludes(), len(hint.GetIncludeOverrides()))
+  }
+}
+
+func TestGenerateBuildFiles_BazelifyRCHintKeepOverride(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "bazelifyrc_hint_keep_override")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err == nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): got nil error, want an error", workspaceDir, sdkDir)
+  }
+  hintPath := filepath.Join(sdkDir, ".bazelifyrc.hint")
+  hintText, err := os.ReadFile(hintPath)
+  if err != nil {
+    t.Fatalf("os.ReadFile(%s): %v", hintPath, err)
+  }
+  var hint bazelifyrc.Configuration 
+  if err := prototext.Unmarshal(hintText, &hint); err != nil {
+    t.Fatalf("proto.UnmarshalText(%s): %v", string(hintText), err)
+  }
+  if diff := cmp.Diff(&bazelifyrc.Configuration{
+    IncludeOverrides: []*bazelifyrc.IncludeOverride{
+      {
+				Include: "overridden.h",
+				Label: "//something",
+			},
+      {
+				Include: "doesnotexist.h",
+				Label: "INCLUDED BY //bazelifyrc_hint_keep_override:exists PLEASE RESOLVE: ",
+			},
+    },
+  }, &hint, protocmp.Transform()); diff != "" {
+    t.Fatalf("bazelifyrc hint (-want +got): %s", diff)
+  }
+}
+
+func TestGenerateBuildFiles_IncludeOverrides(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, filepath.Join("include_overrides", "sdkdir"))
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t, 
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name:     "a",
+        Hdrs:     []string{"a.h"},
+        Copts: []string{
+					"-Iinclude_overrides/outsidesdkdir",
+					"-Iinclude_overrides/sdkdir/b",
+					"-Iinclude_overrides/sdkdir/c",
+				},
+        Deps: []string{
+          "//include_overrides/outsidesdkdir:d",
+          "//include_overrides/sdkdir/b",
+          "//include_overrides/sdkdir/c",
+        },
+      },
+      {
+        Name:     "c",
+        Hdrs:     []string{"c.h"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "b"), []*buildfile.Library{
+      {
+        Name:     "b",
+        Hdrs:     []string{"b.h"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "c"), []*buildfile.Library{
+      {
+        Name:     "c",
+        Hdrs:     []string{"c.h"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_BazelifyRCExistsButEmpty(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "bazelifyrc_exists_but_empty")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name:     "a",
+        Hdrs:     []string{"a.h"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_StrangeInclude(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "strange_includes")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name:     "a",
+        Hdrs:     []string{"a.h"},
+        Copts: []string{"-Istrange_includes"},
+        Deps:     []string{":b", ":d"},
+      },
+      {
+        Name:     "b",
+        Hdrs:     []string{"b.h"},
+      },
+      {
+        Name:     "d",
+        Hdrs:     []string{"d.h"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_BazelifyRCExcludes(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "bazelifyrc_excludes")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name:     "a",
+        Hdrs:     []string{"a.h"},
+        Copts: []string{
+					"-Ibazelifyrc_excludes/included",
+					"-Ibazelifyrc_excludes/included/e",
+				},
+        Deps: []string{
+          "//bazelifyrc_excludes/included/e",
+          "//bazelifyrc_excludes/included:d",
+        },
+      },
+      {
+        Name:     "b",
+        Hdrs:     []string{"b.h"},
+        Copts: []string{"-Ibazelifyrc_excludes"},
+        Deps:     []string{":a"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "included"), []*buildfile.Library{
+      {
+        Name:     "d",
+        Hdrs:     []string{"d.h"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "included", "e"), []*buildfile.Library{
+      {
+        Name:     "e",
+        Hdrs:     []string{"e.h"},
+      },
+    }, nil, nil),
+  )
+  // Make sure BUILD files aren't created for excluded directories
+  buildShouldNotExist := []string{
+    "excluded",
+    "included/star_excluded",
+    "included/star_excluded/e",
+  }
+  for _, dir := range buildShouldNotExist {
+    path := filepath.Join(sdkDir, dir, "BUILD")
+    if _, err := os.Stat(path); err == nil {
+      t.Errorf("BUILD file in %s created, but should not have been created", dir)
+    }
+  }
+}
+
+func TestGenerateBuildFiles_BazelifyRCGlobPatterns(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "bazelifyrc_glob_patterns")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name:     "main",
+        Hdrs:     []string{"main.h"},
+        Copts:    []string{"-Ibazelifyrc_glob_patterns/components/x/include"},
+        Deps:     []string{"//bazelifyrc_glob_patterns/components/x/include:a"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "components", "x", "include"), []*buildfile.Library{
+      {
+        Name:     "a",
+        Hdrs:     []string{"a.h"},
+      },
+    }, nil, nil),
+  )
+  // "**/iar" excludes iar dirs at any depth, so components/y/iar/include
+  // isn't an include dir either.
+  buildShouldNotExist := []string{
+    "components/x/iar",
+    "components/y/iar/include",
+    "docs",
+  }
+  for _, dir := range buildShouldNotExist {
+    path := filepath.Join(sdkDir, dir, "BUILD")
+    if _, err := os.Stat(path); err == nil {
+      t.Errorf("BUILD file in %s created, but should not have been created", dir)
+    }
+  }
+}
+
+func TestGenerateBuildFiles_FreeRTOSPorts(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "freertos_ports")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  // portmacro.h is only left in the GCC nrf52 port.
+  portable := filepath.Join(sdkDir, "external/freertos/portable")
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "external/freertos/source/include"), []*buildfile.Library{
+      {
+        Name:     "FreeRTOS",
+        Hdrs:     []string{"FreeRTOS.h"},
+        Copts:    []string{
+          "-Ifreertos_ports/external/freertos/portable/CMSIS/nrf52",
+          "-Ifreertos_ports/external/freertos/portable/GCC/nrf52",
+        },
+        Deps:     []string{
+          "//freertos_ports/external/freertos/portable/CMSIS/nrf52:portmacro_cmsis",
+          "//freertos_ports/external/freertos/portable/GCC/nrf52:portmacro",
+        },
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(portable, "GCC/nrf52"), []*buildfile.Library{
+      {
+        Name:     "portmacro",
+        Hdrs:     []string{"portmacro.h"},
+      },
+    }, nil, nil),
+  )
+  // Sources in no library are only reported by default.
+  orphans, err := os.ReadFile(filepath.Join(sdkDir, ".bazelify-out/orphan_sources.txt"))
+  if err != nil {
+    t.Fatalf("read orphan_sources.txt: %v", err)
+  }
+  want := "//freertos_ports/external/freertos/portable/GCC/nrf52:port.c\n//freertos_ports/external/freertos/portable/MemMang:heap_4.c\n"
+  if diff := cmp.Diff(want, string(orphans)); diff != "" {
+    t.Errorf("orphan_sources.txt (-want +got):\n%s", diff)
+  }
+  for _, dir := range []string{"GCC/nrf51", "IAR"} {
+    if _, err := os.Stat(filepath.Join(portable, dir, "BUILD")); !os.IsNotExist(err) {
+      t.Errorf("%s/BUILD: got error %v, want it to not exist", dir, err)
+    }
+  }
+}
+
+func TestReadConfig_FreeRTOSPortNotFound(t *testing.T) {
+  workspaceDir := mustMakeAbs(t, testDataDir)
+  conf := &Config{}
+  sdkDir := filepath.Join(workspaceDir, "freertos_ports")
+  if err := conf.excludeFreeRTOSPorts(sdkDir, []string{"GCC/nrf53"}); err == nil {
+    t.Errorf("excludeFreeRTOSPorts: got nil error, want port not found")
+  }
+}
+
+func TestGenerateBuildFiles_ExcludeNonGCC(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "exclude_non_gcc")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  portDir := filepath.Join("external", "freertos", "portable", "GCC")
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name:     "app",
+        Hdrs:     []string{"app.h"},
+        Copts:    []string{"-Iexclude_non_gcc/external/freertos/portable/GCC"},
+        Deps:     []string{"//exclude_non_gcc/external/freertos/portable/GCC:port"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, portDir), []*buildfile.Library{
+      {
+        Name:     "port",
+        Hdrs:     []string{"port.h"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "toolchain", "gcc"), []*buildfile.Library{
+      {
+        Name:     "gcc",
+        Hdrs:     []string{"gcc.h"},
+      },
+    }, nil, nil),
+  )
+  buildShouldNotExist := []string{
+    "documentation",
+    "external/freertos/portable/IAR",
+    "toolchain/iar",
+  }
+  for _, dir := range buildShouldNotExist {
+    path := filepath.Join(sdkDir, dir, "BUILD")
+    if _, err := os.Stat(path); err == nil {
+      t.Errorf("BUILD file in %s created, but should not have been created", dir)
+    }
+  }
+}
+
+func TestGenerateBuildFiles_BazelifyRCIgnoreHeaders(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "bazelifyrc_ignore_headers")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name:     "a",
+        Hdrs:     []string{"a.h"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_BazelifyRCIncludeDirs(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "bazelifyrc_include_dirs")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name:     "a",
+        Hdrs:     []string{"a.h"},
+        Copts: []string{
+					"-Ibazelifyrc_include_dirs",
+					"-Ibazelifyrc_include_dirs/external",
+					"-Ibazelifyrc_include_dirs/external/b",
+				},
+        Deps: []string{
+          "//bazelifyrc_include_dirs/external/b",
+          "//bazelifyrc_include_dirs/external:d",
+          ":c",
+        },
+      },
+      {
+        Name:     "c",
+        Hdrs:     []string{"c.h"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "external"), []*buildfile.Library{
+      {
+        Name:     "d",
+        Hdrs:     []string{"d.h"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "external", "b"), []*buildfile.Library{
+      {
+        Name:     "b",
+        Hdrs:     []string{"b.h"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "shouldskipthese"), []*buildfile.Library{
+      {
+        Name:     "d",
+        Hdrs:     []string{"d.h"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "shouldskipthese", "b"), []*buildfile.Library{
+      {
+        Name:     "b",
+        Hdrs:     []string{"b.h"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "shouldskipthese", "shouldalsoskipthese"), []*buildfile.Library{
+      {
+        Name:     "d",
+        Hdrs:     []string{"d.h"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_BazelifyRCMalformed(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "bazelifyrc_malformed")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err == nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): nil error, want an error", workspaceDir, sdkDir)
+  }
+  hintPath := filepath.Join(sdkDir, ".bazelifyrc.hint")
+  if _, err := os.Stat(hintPath); err == nil {
+    t.Fatalf("os.Stat(%s): nil error, want an error", hintPath)
+  }
+}
+
+func TestGenerateBuildFiles_BazelifyRCRemap(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "bazelifyrc_remap")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name: "nrfbazelify_empty_remap",
+      },
+      {
+        Name:     "a",
+        Hdrs:     []string{"a.h"},
+      },
+      {
+        Name:     "b",
+        Hdrs:     []string{"b.h"},
+      },
+      {
+        Name:     "c",
+        Hdrs:     []string{"c.h"},
+        Deps:     []string{
+          ":a_remap",
+          ":b_remap",
+        },
+      },
+    }, []*buildfile.LabelSetting{
+      {
+        Name: "a_remap",
+        BuildSettingDefault: "//bazelifyrc_remap:nrfbazelify_empty_remap",
+      },
+      {
+        Name: "b_remap",
+        BuildSettingDefault: "//bazelifyrc_remap:nrfbazelify_empty_remap",
+      },
+    }, nil),
+  )
+
+  remapBzl, err := os.ReadFile(filepath.Join(sdkDir, "remap.bzl"))
+  if err != nil {
+    t.Fatalf("read remap.bzl: %v", err)
+  }
+  t.Logf("remap.bzl contents:\n%s", string(remapBzl))
+  searchPhrases := map[string]string{
+    "remapTransitionReturnsA": "\"//bazelifyrc_remap:a_remap\": attr.a,",
+    "remapTransitionReturnsB": "\"//bazelifyrc_remap:b_remap\": attr.b,",
+    "remapTransitionOutputsA": "\"//bazelifyrc_remap:a_remap\",",
+    "remapTransitionOutputsB": "\"//bazelifyrc_remap:b_remap\",",
+    "nrfFlashMacro": "def nrf_flash\\(name, hex = None, elf = None",
+    "dfuKeyFile": "key_file = \"//keys:dfu.pem\",",
+    "dfuHWVersion": "hw_version = 52,",
+    "dfuSDReq": "sd_req = \\[\"0x0100\", \"0x0101\"\\],",
+    // The rc's strings are escaped, like the backslashes of a Windows path.
+    "dfuNrfutil": `nrfutil = "C:\\\\nrfutil\\\\nrfutil\.exe",`,
+  }
+  for name, phrase := range searchPhrases {
+    t.Run(name, func(t *testing.T) {
+      match, err := regexp.MatchString(phrase, string(remapBzl))
+      if err != nil {
+        t.Errorf("regexp.MatchString: %v", err)
+        return
+      }
+      if !match {
+        t.Errorf("phrase not found:\n%s", phrase)
+      }
+    })
+  }
+}
+
+func TestGenerateBuildFiles_RemovesStaleHint(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "removes_stale_hint")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  hintFile := filepath.Join(sdkDir, ".bazelifyrc.hint")
+  if _, err := os.Stat(hintFile); err == nil {
+    t.Errorf("hint file %q not removed after successful run", hintFile)
+  }
+}
+
+func TestGeneratedBuildFiles_SourceSets(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "source_sets")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name:     "ab",
+        Hdrs:     []string{"a.h", "b.h"},
+        Srcs:     []string{"b.c"},
+        Copts: []string{"-Isource_sets/dir"},
+        Deps: []string{
+          "//source_sets/dir:c",
+        },
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "dir"), []*buildfile.Library{
+      {
+        Name:     "c",
+        Hdrs:     []string{"c.h"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_SourceSetAllFiles(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "source_set_dir")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  // The files below drivers/uart are in nrfx_uart, except the legacy dir.
+  uartDir := filepath.Join(sdkDir, "drivers/uart")
+  checkBuildFiles(t,
+    newBuildFile(uartDir, []*buildfile.Library{
+      {
+        Name:     "nrfx_uart",
+        Srcs:     []string{"nrfx_uart.c", "//source_set_dir/drivers/uart/src:uart_impl.c"},
+        Hdrs:     []string{"nrfx_uart.h", "//source_set_dir/drivers/uart/include:uart_types.h"},
+        Copts:    []string{"-Isource_set_dir/drivers/uart", "-Isource_set_dir/drivers/uart/include"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(uartDir, "src"), nil, nil, []string{"uart_impl.c"}),
+    newBuildFile(filepath.Join(uartDir, "include"), nil, nil, []string{"uart_types.h"}),
+    newBuildFile(filepath.Join(uartDir, "legacy"), []*buildfile.Library{
+      {
+        Name:     "old_uart",
+        Srcs:     []string{"old_uart.c"},
+        Hdrs:     []string{"old_uart.h"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
+      {
+        Name:     "app",
+        Hdrs:     []string{"app.h"},
+        Copts:    []string{"-Isource_set_dir/drivers/uart"},
+        Deps:     []string{"//source_set_dir/drivers/uart:nrfx_uart"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_SelfCheck(t *testing.T) {
+  flag.Set("self_check", "true")
+  t.Cleanup(func() { flag.Set("self_check", "false") })
+  workspaceDir, sdkDir := setup(t, "cycles_nominal")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+
+  // Break the BUILD files like an output bug would, and check against the
+  // graph again.
+  conf, err := ReadConfig([]string{sdkDir}, workspaceDir, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("ReadConfig: %v", err)
+  }
+  graph := NewDependencyGraph(conf, "")
+  if _, err := resolve(context.Background(), conf, graph); err != nil {
+    t.Fatalf("resolve: %v", err)
+  }
+  if err := SelfCheck(conf, graph); err != nil {
+    t.Fatalf("SelfCheck before breaking the BUILD files: %v", err)
+  }
+  for path, replace := range map[string][2]string{
+    filepath.Join(sdkDir, "BUILD"): {`"//cycles_nominal/dir2:used_by_cyclic"`, `"//cycles_nominal/dir:uses_cyclic"`},
+    filepath.Join(sdkDir, "dir", "BUILD"): {`exports_files(["c.h"])`, ""},
+    filepath.Join(sdkDir, "dir2", "BUILD"): {`name = "used_by_cyclic"`, `name = "used_by_cycle"`},
+  } {
+    data, err := os.ReadFile(path)
+    if err != nil {
+      t.Fatalf("ReadFile: %v", err)
+    }
+    if !strings.Contains(string(data), replace[0]) {
+      t.Fatalf("%s doesn't have %s", path, replace[0])
+    }
+    if err := os.WriteFile(path, []byte(strings.Replace(string(data), replace[0], replace[1], 1)), 0644); err != nil {
+      t.Fatalf("WriteFile: %v", err)
+    }
+  }
+  err = SelfCheck(conf, graph)
+  if err == nil {
+    t.Fatalf("SelfCheck after breaking the BUILD files: want an error")
+  }
+  for _, want := range []string{
+    "//cycles_nominal:abcd: deps are missing //cycles_nominal/dir2:used_by_cyclic",
+    "//cycles_nominal:abcd: deps have //cycles_nominal/dir:uses_cyclic, which isn't a dependency in the graph",
+    "//cycles_nominal:abcd: //cycles_nominal/dir:c.h isn't exported",
+    `//cycles_nominal/dir2:used_by_cyclic: no rule named "used_by_cyclic"`,
+  } {
+    if !strings.Contains(err.Error(), want) {
+      t.Errorf("SelfCheck: got %v, want %q", err, want)
+    }
+  }
+}
+
+func TestGenerateBuildFiles_SmokeTest(t *testing.T) {
+  // A fake bazel, that records its args and fails like Bazel does when a
+  // generated BUILD file has a bad dep.
+  dir := t.TempDir()
+  argsPath := filepath.Join(dir, "args")
+  script := `#!/bin/sh
+echo "$@" > ` + argsPath + `
+if [ "$1" = query ]; then
+  exit 0
+fi
+echo "Loading: 1 packages loaded"
+echo "ERROR: $(pwd)/nominal/BUILD:12:11: no such target '//nominal:missing'"
+echo "ERROR: /elsewhere/BUILD:1:1: not in the SDK"
+exit 1
+`
+  bazel := filepath.Join(dir, "bazel")
+  if err := os.WriteFile(bazel, []byte(script), 0755); err != nil {
+    t.Fatalf("WriteFile: %v", err)
+  }
+  flag.Set("smoke_test", "true")
+  flag.Set("bazel", bazel)
+  t.Cleanup(func() {
+    flag.Set("smoke_test", "false")
+    flag.Set("bazel", "bazel")
+    flag.Set("smoke_test_targets", "")
+  })
+  readArgs := func() string {
+    data, err := os.ReadFile(argsPath)
+    if err != nil {
+      t.Fatalf("ReadFile: %v", err)
+    }
+    return strings.TrimSpace(string(data))
+  }
+
+  workspaceDir, sdkDir := setup(t, "nominal")
+  // Without targets, every target in the SDK is queried.
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  if got, want := readArgs(), "query --keep_going //nominal/..."; got != want {
+    t.Errorf("bazel args = %q, want %q", got, want)
+  }
+
+  flag.Set("smoke_test_targets", "//nominal:a, //nominal/dir:d")
+  err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if got, want := readArgs(), "build --keep_going //nominal:a //nominal/dir:d"; got != want {
+    t.Errorf("bazel args = %q, want %q", got, want)
+  }
+  if err == nil || !strings.Contains(err.Error(), "nominal/BUILD:12: no such target '//nominal:missing'") {
+    t.Fatalf("GenerateBuildFiles: got %v, want the error in nominal/BUILD", err)
+  }
+  if strings.Contains(err.Error(), "elsewhere") {
+    t.Errorf("GenerateBuildFiles: got %v, want only errors in the SDK", err)
+  }
+}
+
+func TestGenerateBuildFiles_CyclesNominal(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "cycles_nominal")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name: "a",
+        Deps: []string{":abcd"},
+      },
+      {
+        Name: "abcd",
+        Hdrs: []string{
+          "//cycles_nominal/dir2:d.h",
+          "//cycles_nominal/dir:c.h",
+          "a.h",
+          "b.h",
+        },
+        Copts: []string{
+					"-Icycles_nominal",
+					"-Icycles_nominal/dir",
+					"-Icycles_nominal/dir2",
+				},
+        Deps: []string{"//cycles_nominal/dir2:used_by_cyclic"},
+      },
+      {
+        Name: "b",
+        Deps: []string{":abcd"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "dir"), []*buildfile.Library{
+      {
+        Name: "uses_cyclic",
+        Hdrs: []string{"uses_cyclic.h"},
+        Copts: []string{"-Icycles_nominal/dir"},
+        Deps: []string{":c"},
+      },
+      {
+        Name: "c",
+        Deps: []string{"//cycles_nominal:abcd"},
+      },
+    }, nil, []string{"c.h"}),
+    newBuildFile(filepath.Join(sdkDir, "dir2"), []*buildfile.Library{
+      {
+        Name: "used_by_cyclic",
+        Hdrs: []string{"used_by_cyclic.h"},
+      },
+      {
+        Name: "d",
+        Deps: []string{"//cycles_nominal:abcd"},
+      },
+    }, nil, []string{"d.h"}),
+  )
+}
+
+func TestGenerateBuildFiles_AutoGroupNames(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "auto_group_names")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  // The sdh headers share the nrf_sdh prefix, and the fifo headers only
+  // share their dir.
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name: "fifo",
+        Hdrs: []string{
+          "//auto_group_names/fifo:app_fifo.h",
+          "//auto_group_names/fifo:queue.h",
+        },
+      },
+      {
+        Name: "nrf_sdh",
+        Hdrs: []string{
+          "//auto_group_names/sdh:nrf_sdh.h",
+          "//auto_group_names/sdh:nrf_sdh_ble.h",
+        },
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "fifo"), []*buildfile.Library{
+      {
+        Name: "app_fifo",
+        Deps: []string{"//auto_group_names:fifo"},
+      },
+      {
+        Name: "queue",
+        Deps: []string{"//auto_group_names:fifo"},
+      },
+    }, nil, []string{"app_fifo.h", "queue.h"}),
+    newBuildFile(filepath.Join(sdkDir, "sdh"), []*buildfile.Library{
+      {
+        Name: "nrf_sdh",
+        Deps: []string{"//auto_group_names:nrf_sdh"},
+      },
+      {
+        Name: "nrf_sdh_ble",
+        Deps: []string{"//auto_group_names:nrf_sdh"},
+      },
+    }, nil, []string{"nrf_sdh.h", "nrf_sdh_ble.h"}),
+  )
+}
+
+func TestGenerateBuildFiles_Provenance(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "cycles_nominal")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  data, err := os.ReadFile(filepath.Join(sdkDir, ".bazelify-out", provenanceFilename))
+  if err != nil {
+    t.Fatalf("read %s: %v", provenanceFilename, err)
+  }
+  var got struct {
+    Deps []*DepProvenance `json:"deps"`
+  }
+  if err := json.Unmarshal(data, &got); err != nil {
+    t.Fatalf("json.Unmarshal: %v", err)
+  }
+  // abcd has the include of d, which is in the group.
+  want := []*DepProvenance{
+    {From: "//cycles_nominal/dir2:d", To: "//cycles_nominal:abcd", Method: "group_merge"},
+    {From: "//cycles_nominal/dir:c", To: "//cycles_nominal:abcd", Method: "group_merge"},
+    {From: "//cycles_nominal/dir:uses_cyclic", To: "//cycles_nominal/dir:c", Method: "same_dir", Include: "c.h"},
+    {From: "//cycles_nominal:a", To: "//cycles_nominal:abcd", Method: "group_merge"},
+    {From: "//cycles_nominal:abcd", To: "//cycles_nominal/dir2:used_by_cyclic", Method: "same_dir", Include: "used_by_cyclic.h", Via: "//cycles_nominal/dir2:d"},
+    {From: "//cycles_nominal:b", To: "//cycles_nominal:abcd", Method: "group_merge"},
+  }
+  if diff := cmp.Diff(want, got.Deps); diff != "" {
+    t.Errorf("%s (-want +got):\n%s", provenanceFilename, diff)
+  }
+}
+
+func TestGenerateBuildFiles_CyclesMultipleGroups(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "cycles_multiple_groups")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name: "big_group",
+        Hdrs: []string{
+          "//cycles_multiple_groups/group1:a.h",
+          "//cycles_multiple_groups/group1:b.h",
+          "//cycles_multiple_groups/group1:c.h",
+          "//cycles_multiple_groups/group2:d.h",
+          "//cycles_multiple_groups/group2:e.h",
+          "//cycles_multiple_groups/group2:f.h",
+          "middle1.h",
+          "middle2.h",
+          "middle3.h",
+          "middle4.h",
+          "middle5.h",
+          "middle6.h",
+        },
+        Copts: []string{
+          "-Icycles_multiple_groups",
+          "-Icycles_multiple_groups/group1",
+          "-Icycles_multiple_groups/group2",
+        },
+      },
+      {
+        Name: "middle1",
+        Deps: []string{":big_group"},
+      },
+      {
+        Name: "middle2",
+        Deps: []string{":big_group"},
+      },
+      {
+        Name: "middle3",
+        Deps: []string{":big_group"},
+      },
+      {
+        Name: "middle4",
+        Deps: []string{":big_group"},
+      },
+      {
+        Name: "middle5",
+        Deps: []string{":big_group"},
+      },
+      {
+        Name: "middle6",
+        Deps: []string{":big_group"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "group1"), []*buildfile.Library{
+      {
+        Name: "a",
+        Deps: []string{"//cycles_multiple_groups:big_group"},
+      },
+      {
+        Name: "b",
+        Deps: []string{"//cycles_multiple_groups:big_group"},
+      },
+      {
+        Name: "c",
+        Deps: []string{"//cycles_multiple_groups:big_group"},
+      },
+    }, nil, []string{"a.h", "b.h", "c.h"}),
+    newBuildFile(filepath.Join(sdkDir, "group2"), []*buildfile.Library{
+      {
+        Name: "d",
+        Deps: []string{"//cycles_multiple_groups:big_group"},
+      },
+      {
+        Name: "e",
+        Deps: []string{"//cycles_multiple_groups:big_group"},
+      },
+      {
+        Name: "f",
+        Deps: []string{"//cycles_multiple_groups:big_group"},
+      },
+    }, nil, []string{"d.h", "e.h", "f.h"}),
+  )
+}
+
+func TestGenerateBuildFiles_PruneUnreachable(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "prune_unreachable")
+  flag.Set("prune_unreachable", "true")
+  t.Cleanup(func() { flag.Set("prune_unreachable", "false") })
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
     t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
   }
   checkBuildFiles(t,
     newBuildFile(sdkDir, []*buildfile.Library{
       {
-        Name: "big_group",
-        Hdrs: []string{
-          "//cycles_multiple_groups/group1:a.h",
-          "//cycles_multiple_groups/group1:b.h",
-          "//cycles_multiple_groups/group1:c.h",
-          "//cycles_multiple_groups/group2:d.h",
-          "//cycles_multiple_groups/group2:e.h",
-          "//cycles_multiple_groups/group2:f.h",
-          "middle1.h",
-          "middle2.h",
-          "middle3.h",
-          "middle4.h",
-          "middle5.h",
-          "middle6.h",
+        Name:     "a",
+        Hdrs:     []string{"a.h"},
+        Deps:     []string{":b"},
+        Copts:    []string{"-Iprune_unreachable"},
+      },
+      {
+        Name:     "b",
+        Hdrs:     []string{"b.h"},
+      },
+    }, nil, nil),
+  )
+  unreachableBuild := filepath.Join(sdkDir, "dir", "BUILD")
+  if _, err := os.Stat(unreachableBuild); err == nil {
+    t.Errorf("%s created, but nothing in it is reachable from the roots", unreachableBuild)
+  }
+}
+
+func TestGenerateBuildFiles_PruneUnreachableNoRoots(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "nominal")
+  flag.Set("prune_unreachable", "true")
+  t.Cleanup(func() { flag.Set("prune_unreachable", "false") })
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err == nil {
+    t.Errorf("GenerateBuildFiles(%s, %s): got nil error, want error for missing roots", workspaceDir, sdkDir)
+  }
+}
+
+func TestGenerateBuildFiles_DuplicateHeaders(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "duplicate_headers")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  // duplicate_headers' preferred_dirs pick the identical copies, not the
+  // top-level ones.
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name:     "a",
+        Hdrs:     []string{"a.h"},
+        Deps:     []string{"//duplicate_headers/components:util", "//duplicate_headers/components:ws"},
+        Copts:    []string{"-Iduplicate_headers/components"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestCheckBuildFiles_DuplicateHeadersDiffer(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "duplicate_headers_differ")
+  err := CheckBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err == nil || !strings.Contains(err.Error(), "util.h") {
+    t.Errorf("CheckBuildFiles(%s, %s): got %v, want unresolved util.h", workspaceDir, sdkDir, err)
+  }
+}
+
+func TestGenerateBuildFiles_PreferredDirs(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "preferred_dirs")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  // The headers differ, so the top-level preferred_dirs pick them, not
+  // duplicate_headers' ones.
+  checkBuildFiles(t,
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {
+        Name:     "a",
+        Hdrs:     []string{"a.h"},
+        Deps:     []string{"//preferred_dirs/components:util", "//preferred_dirs/legacy:other"},
+        Copts:    []string{"-Ipreferred_dirs/components", "-Ipreferred_dirs/legacy"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_ResolveByProximity(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "proximity")
+  flag.Set("resolve_by_proximity", "true")
+  t.Cleanup(func() { flag.Set("resolve_by_proximity", "false") })
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "drivers/spi"), []*buildfile.Library{
+      {
+        Name:     "spi",
+        Hdrs:     []string{"spi.h"},
+        Deps:     []string{"//proximity/drivers/common"},
+        Copts:    []string{"-Iproximity/drivers/common"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestCheckBuildFiles_ProximityIsOptIn(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "proximity")
+  if err := CheckBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err == nil {
+    t.Errorf("CheckBuildFiles(%s, %s): got nil error, want unresolved common.h", workspaceDir, sdkDir)
+  }
+}
+
+func TestGenerateBuildFiles_LockFile(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "proximity")
+  flag.Set("resolve_by_proximity", "true")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    flag.Set("resolve_by_proximity", "false")
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  flag.Set("resolve_by_proximity", "false")
+
+  lock, err := ReadLockFile(sdkDir)
+  if err != nil {
+    t.Fatalf("ReadLockFile(%s): %v", sdkDir, err)
+  }
+  want := []*LockedResolution{
+    {Include: "common.h", Package: "proximity/drivers/spi", Label: "//proximity/drivers/common"},
+  }
+  if diff := cmp.Diff(want, lock.Resolutions, cmpopts.IgnoreUnexported(LockFile{})); diff != "" {
+    t.Errorf("lock file (-want +got):\n%s", diff)
+  }
+
+  // The lock keeps resolving the include, even without the heuristic.
+  if err := CheckBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Errorf("CheckBuildFiles with lock file: %v", err)
+  }
+
+  // With --relock, the lock file is ignored.
+  flag.Set("relock", "true")
+  t.Cleanup(func() { flag.Set("relock", "false") })
+  if err := CheckBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err == nil {
+    t.Errorf("CheckBuildFiles with --relock: got nil error, want unresolved common.h")
+  }
+}
+
+func TestGenerateBuildFiles_StaleLockFile(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "proximity")
+  stale := &LockFile{Resolutions: []*LockedResolution{
+    {Include: "common.h", Package: "proximity/drivers/spi", Label: "//proximity/drivers/gone"},
+  }}
+  if err := stale.Write(sdkDir); err != nil {
+    t.Fatalf("Write(%s): %v", sdkDir, err)
+  }
+
+  // The include is resolved again, with a warning.
+  flag.Set("resolve_by_proximity", "true")
+  t.Cleanup(func() { flag.Set("resolve_by_proximity", "false") })
+  if err := CheckBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Errorf("CheckBuildFiles with a stale lock file: %v", err)
+  }
+
+  flag.Set("strict", "true")
+  t.Cleanup(func() { flag.Set("strict", "false") })
+  err := CheckBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err == nil || !strings.Contains(err.Error(), "//proximity/drivers/gone") {
+    t.Errorf("CheckBuildFiles with --strict: got %v, want an error about the stale //proximity/drivers/gone", err)
+  }
+}
+
+func TestGenerateBuildFiles_NCS(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "ncs")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
+      {
+        Name:     "main",
+        Hdrs:     []string{"main.h"},
+        Deps:     []string{"//ncs/modules/hal/nordic/nrfx/hal:nrf_gpio", "//ncs/nrf/include:dk_buttons_and_leds", "//ncs/zephyr/include/zephyr/sys:util"},
+        Copts:    []string{"-Incs/modules/hal/nordic/nrfx", "-Incs/modules/hal/nordic/nrfx/hal", "-Incs/nrf/include", "-Incs/zephyr/include", "-Incs/zephyr/include/zephyr/sys"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "modules/hal/nordic/nrfx/drivers"), []*buildfile.Library{
+      {
+        Name:     "nrf_gpio",
+        Hdrs:     []string{"nrf_gpio.h"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "modules/hal/nordic/nrfx/hal"), []*buildfile.Library{
+      {
+        Name:     "nrf_gpio",
+        Hdrs:     []string{"nrf_gpio.h"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "nrf/include"), []*buildfile.Library{
+      {
+        Name:     "dk_buttons_and_leds",
+        Hdrs:     []string{"dk_buttons_and_leds.h"},
+        Deps:     []string{"//ncs/zephyr/include/zephyr:kernel"},
+        Copts:    []string{"-Incs/zephyr/include", "-Incs/zephyr/include/zephyr"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "nrf/include/sys"), []*buildfile.Library{
+      {
+        Name:     "util",
+        Hdrs:     []string{"util.h"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "zephyr/include/zephyr"), []*buildfile.Library{
+      {
+        Name:     "kernel",
+        Hdrs:     []string{"kernel.h"},
+        Deps:     []string{"//ncs/zephyr/include/zephyr/sys:util"},
+        Copts:    []string{"-Incs/zephyr/include", "-Incs/zephyr/include/zephyr/sys"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "zephyr/include/zephyr/sys"), []*buildfile.Library{
+      {
+        Name:     "util",
+        Hdrs:     []string{"util.h"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_MeshSDK(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, filepath.Join("mesh_sdk", "nrf5_sdk"))
+  meshDir := filepath.Join(workspaceDir, "mesh_sdk", "nrf5_sdk_for_mesh")
+  t.Cleanup(func() {
+    removeAllBuildFiles(t, meshDir)
+  })
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(meshDir, "mesh/core/api"), []*buildfile.Library{
+      {
+        Name:     "nrf_mesh",
+        Srcs:     []string{"//mesh_sdk/nrf5_sdk_for_mesh/mesh/core/src:nrf_mesh.c"},
+        Hdrs:     []string{"nrf_mesh.h"},
+        // queue.h is also in the nRF5 SDK, but the Mesh SDK prefers its own.
+        Deps:     []string{"//mesh_sdk/nrf5_sdk/components/libraries/util:app_error", "//mesh_sdk/nrf5_sdk_for_mesh/mesh/core/include:queue"},
+        Copts:    []string{"-Imesh_sdk/nrf5_sdk/components/libraries/util", "-Imesh_sdk/nrf5_sdk_for_mesh/mesh/core/api", "-Imesh_sdk/nrf5_sdk_for_mesh/mesh/core/include"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(meshDir, "mesh/core/include"), []*buildfile.Library{
+      {
+        Name:     "queue",
+        Srcs:     []string{"//mesh_sdk/nrf5_sdk_for_mesh/mesh/core/src:queue.c"},
+        Hdrs:     []string{"queue.h"},
+        Copts:    []string{"-Imesh_sdk/nrf5_sdk_for_mesh/mesh/core/include"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(meshDir, "mesh/core/src"), nil, nil, []string{"nrf_mesh.c", "queue.c"}),
+    newBuildFile(filepath.Join(meshDir, "models/foundation/config/api"), []*buildfile.Library{
+      {
+        Name:     "config_server",
+        Srcs:     []string{"//mesh_sdk/nrf5_sdk_for_mesh/models/foundation/config/src:config_server.c"},
+        Hdrs:     []string{"config_server.h"},
+        Deps:     []string{"//mesh_sdk/nrf5_sdk_for_mesh/mesh/core/api:nrf_mesh"},
+        Copts:    []string{"-Imesh_sdk/nrf5_sdk_for_mesh/mesh/core/api", "-Imesh_sdk/nrf5_sdk_for_mesh/models/foundation/config/api"},
+      },
+    }, nil, nil),
+  )
+  // The Mesh preset excludes tests and examples.
+  for _, dir := range []string{"mesh/core/test", "examples/light_switch/include"} {
+    excludedBuild := filepath.Join(meshDir, dir, "BUILD")
+    if _, err := os.Stat(excludedBuild); err == nil {
+      t.Errorf("%s created, but should have been excluded", excludedBuild)
+    }
+  }
+}
+
+func TestGenerateBuildFiles_Chips(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "chips_nrf")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  chips := newBuildFile(filepath.Join(sdkDir, "chips"), []*buildfile.Library{
+    {
+      Name:     "chip",
+      DefinesSelect: map[string][]string{
+        ":is_nrf52810": {"NRF52810_XXAA"},
+        ":is_nrf52832": {"NRF52832_XXAA"},
+        ":is_nrf52833": {"NRF52833_XXAA"},
+        ":is_nrf52840": {"NRF52840_XXAA"},
+      },
+    },
+  }, nil, nil)
+  chips.AddConstraintSetting(&buildfile.ConstraintSetting{Name: "chip"})
+  for _, chip := range []string{"nrf52810", "nrf52832", "nrf52833", "nrf52840"} {
+    chips.AddConstraintValue(&buildfile.ConstraintValue{Name: chip, ConstraintSetting: ":chip"})
+    chips.AddConfigSetting(&buildfile.ConfigSetting{Name: "is_" + chip, ConstraintValues: []string{":" + chip}})
+  }
+  chips.AddLibrary(&buildfile.Library{
+    Name:     "board",
+    DefinesSelect: map[string][]string{
+      ":is_my_board": {"BOARD_MY_BOARD"},
+      ":is_pca10040": {"BOARD_PCA10040"},
+      ":is_pca10040e": {"BOARD_PCA10040"},
+      ":is_pca10056": {"BOARD_PCA10056"},
+      ":is_pca10059": {"BOARD_PCA10059"},
+      ":is_pca10100": {"BOARD_PCA10100"},
+    },
+  })
+  chips.AddConstraintSetting(&buildfile.ConstraintSetting{Name: "board"})
+  for board, chip := range map[string]string{
+    "my_board": "nrf52833",
+    "pca10040": "nrf52832",
+    "pca10040e": "nrf52810",
+    "pca10056": "nrf52840",
+    "pca10059": "nrf52840",
+    "pca10100": "nrf52833",
+  } {
+    chips.AddConstraintValue(&buildfile.ConstraintValue{Name: board, ConstraintSetting: ":board"})
+    chips.AddConfigSetting(&buildfile.ConfigSetting{Name: "is_" + board, ConstraintValues: []string{":" + board}})
+    chips.AddPlatform(&buildfile.Platform{
+      Name: board + "_platform",
+      ConstraintValues: []string{"@platforms//cpu:armv7e-m", "@platforms//os:none", ":" + chip, ":" + board},
+    })
+  }
+  checkBuildFiles(t,
+    chips,
+    newBuildFile(filepath.Join(sdkDir, "components/boards"), []*buildfile.Library{
+      {
+        Name:     "boards",
+        Hdrs:     []string{"boards.h"},
+        Deps:     []string{"//chips_nrf/chips:board"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "components/device"), []*buildfile.Library{
+      {
+        Name:     "nrf",
+        Hdrs:     []string{"nrf.h"},
+        Deps:     []string{"//chips_nrf/chips:chip", ":nrf52832", ":nrf52840"},
+        Copts:    []string{"-Ichips_nrf/components/device"},
+      },
+      {
+        Name:     "nrf52832",
+        Hdrs:     []string{"nrf52832.h"},
+      },
+      {
+        Name:     "nrf52840",
+        Hdrs:     []string{"nrf52840.h"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_NoChipHeaders(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "nominal")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  // Nothing has nrf.h or boards.h, or uses the chips.
+  if _, err := os.Stat(filepath.Join(sdkDir, chipsDir)); err == nil {
+    t.Errorf("%s created, but nothing uses the chips", chipsDir)
+  }
+}
+
+func TestGenerateBuildFiles_ChipsDirOfTheSDK(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "chips_own_dir")
+  // The SDK's chips dir has a library, which chips/BUILD would replace.
+  err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err == nil || !strings.Contains(err.Error(), "chips_own_dir/chips") {
+    t.Errorf("GenerateBuildFiles: got %v, want an error about chips_own_dir/chips", err)
+  }
+  if _, err := os.Stat(filepath.Join(sdkDir, chipsDir, "BUILD")); err == nil {
+    t.Errorf("chips/BUILD written in the SDK's own chips dir")
+  }
+}
+
+func TestGenerateBuildFiles_ConditionalSources(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "conditional_sources")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "lib"), []*buildfile.Library{
+      {
+        Name:     "radio",
+        Hdrs:     []string{"radio.h"},
+        SrcsSelect: map[string][]string{
+          // The board name is short for the config_setting in chips/BUILD.
+          "//conditional_sources/chips:is_pca10059": {"radio.c"},
         },
-        Copts: []string{
-          "-Icycles_multiple_groups",
-          "-Icycles_multiple_groups/group1",
-          "-Icycles_multiple_groups/group2",
+        DefinesSelect: map[string][]string{
+          "//app:is_debug": {"RADIO_DEBUG"},
+          "//conditional_sources/chips:is_pca10059": {"RADIO_PA"},
         },
       },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_Examples(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "examples")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  blinky := newBuildFile(filepath.Join(sdkDir, "examples/peripheral/blinky"), []*buildfile.Library{
+    {
+      Name:     "pca10056_blank_config",
+      Hdrs:     []string{"pca10056/blank/config/sdk_config.h"},
+      Includes: []string{"pca10056/blank/config"},
+    },
+  }, nil, nil)
+  blinky.AddLoad(&buildfile.Load{
+    Source: "//examples:remap.bzl",
+    Symbols: []string{"nrf_cc_binary"},
+  })
+  blinky.AddBinary(&buildfile.Binary{
+    Name: "pca10056_blank",
+    Kind: "nrf_cc_binary",
+    Srcs: []string{"main.c"},
+    Defines: []string{"BOARD_PCA10056", "BSP_DEFINES_ONLY"},
+    LinkerScript: "pca10056/blank/armgcc/blinky_gcc_nrf52.ld",
+    Deps: []string{
+      // nrf_delay.h is only in INC_FOLDERS, and found through main.c's includes.
+      "//examples/components/libraries/delay:nrf_delay",
+      "//examples/components/libraries/util:app_error",
+      ":pca10056_blank_config",
+    },
+  })
+  checkBuildFiles(t, blinky)
+}
+
+func TestReadMakeVars(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "Makefile")
+  if err := os.WriteFile(path, []byte(`ROOT := ../..
+DIR = $(ROOT)/dir # comment
+FILES += \
+  $(DIR)/a.c \
+  b.c \
+
+FILES += c.c
+FILES ?= ignored
+OUT ?= out
+target: \
+  SCRIPT := a.ld
+rule:
+	FILES += recipe.c
+`), 0644); err != nil {
+    t.Fatalf("os.WriteFile(%q): %v", path, err)
+  }
+  got, err := readMakeVars(path)
+  if err != nil {
+    t.Fatalf("readMakeVars(%q): %v", path, err)
+  }
+  want := map[string][]string{
+    "ROOT": {"../.."},
+    "DIR": {"../../dir"},
+    "FILES": {"../../dir/a.c", "b.c", "c.c"},
+    "OUT": {"out"},
+    "SCRIPT": {"a.ld"},
+  }
+  if diff := cmp.Diff(want, got); diff != "" {
+    t.Errorf("readMakeVars(%q) (-want +got):\n%s", path, diff)
+  }
+}
+
+func TestGenerateBuildFiles_SelectOverrides(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "select_overrides")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
+      {
+        Name:     "app",
+        Hdrs:     []string{"app.h"},
+        Deps:     []string{"//select_overrides/components/device:nrf_peripherals"},
+        Copts:    []string{"-Iselect_overrides/components/device"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "components/device"), []*buildfile.Library{
       {
-        Name: "middle1",
-        Deps: []string{":big_group"},
+        Name:     "nrf52832_peripherals",
+        Hdrs:     []string{"nrf52832_peripherals.h"},
       },
       {
-        Name: "middle2",
-        Deps: []string{":big_group"},
+        Name:     "nrf52840_peripherals",
+        Hdrs:     []string{"nrf52840_peripherals.h"},
       },
       {
-        Name: "middle3",
-        Deps: []string{":big_group"},
+        Name:     "nrf_peripherals",
+        Hdrs:     []string{"nrf_peripherals.h"},
+        Copts:    []string{"-Iselect_overrides/components/device"},
+        DepsSelects: []map[string][]string{
+          {"//select_overrides/chips:is_nrf52832": {":nrf52832_peripherals"}},
+          // The chip name is short for the config_setting in chips/BUILD.
+          {"//select_overrides/chips:is_nrf52840": {":nrf52840_peripherals"}},
+        },
+      },
+    }, nil, nil),
+  )
+}
+
+func TestGenerateBuildFiles_MDKStartup(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "mdk")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  mdkFile := newBuildFile(filepath.Join(sdkDir, "modules/nrfx/mdk"), []*buildfile.Library{
+    {
+      Name:     "nrf",
+      Hdrs:     []string{"nrf.h"},
+      Deps:     []string{"//mdk/chips:chip"},
+    },
+    {
+      Name:     "startup",
+      SrcsSelect: map[string][]string{
+        "//mdk/chips:is_nrf52832": {"gcc_startup_nrf52.S", "system_nrf52.c"},
+        "//mdk/chips:is_nrf52840": {"gcc_startup_nrf52840.S", "system_nrf52840.c"},
+      },
+      Deps:     []string{":nrf", ":system_nrf52", ":system_nrf52840"},
+      Copts:    []string{"-Imdk/modules/nrfx/mdk"},
+      Alwayslink: true,
+    },
+    // System sources are only in the startup library.
+    {
+      Name:     "system_nrf52",
+      Hdrs:     []string{"system_nrf52.h"},
+    },
+    {
+      Name:     "system_nrf52840",
+      Hdrs:     []string{"system_nrf52840.h"},
+    },
+  }, nil, nil)
+  mdkFile.AddFilegroup(&buildfile.Filegroup{
+    Name: "linker_scripts",
+    Srcs: []string{"nrf52840_xxaa.ld", "nrf_common.ld"},
+  })
+  checkBuildFiles(t, mdkFile)
+  remapBzl, err := os.ReadFile(filepath.Join(sdkDir, "remap.bzl"))
+  if err != nil {
+    t.Fatalf("read remap.bzl: %v", err)
+  }
+  // nrf_cc_binary links with the SDK's linker scripts, and nrf_debug picks the chip's J-Link device.
+  for _, want := range []string{
+    `"//mdk/modules/nrfx/mdk:linker_scripts",`,
+    `"-Lmdk/modules/nrfx/mdk",`,
+    `"//mdk/chips:is_nrf52840": "nRF52840_xxAA",`,
+  } {
+    if !strings.Contains(string(remapBzl), want) {
+      t.Errorf("remap.bzl doesn't contain %q:\n%s", want, remapBzl)
+    }
+  }
+}
+
+func TestGenerateBuildFiles_SoftDevice(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "softdevice")
+  bzlPath := filepath.Join(sdkDir, "components/softdevice", softDeviceBzlFilename)
+  t.Cleanup(func() { os.Remove(bzlPath) })
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  softDeviceLib := func(name string) *buildfile.Library {
+    return &buildfile.Library{
+      Name:     name,
+      Hdrs:     []string{fmt.Sprintf("//softdevice/components/softdevice/%s/headers/nrf52:nrf_mbr.h", name), "ble.h", "nrf_sdm.h", "nrf_svc.h"},
+      Includes: []string{".", "nrf52"},
+    }
+  }
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
+      {
+        Name:     "app",
+        Srcs:     []string{"app.c"},
+        Hdrs:     []string{"app.h"},
+        Deps:     []string{"//softdevice/components/softdevice"},
       },
+    }, nil, nil),
+    // The highest numbered SoftDevice is the default.
+    newBuildFile(filepath.Join(sdkDir, "components/softdevice"), nil, []*buildfile.LabelSetting{
       {
-        Name: "middle4",
-        Deps: []string{":big_group"},
+        Name: "softdevice",
+        BuildSettingDefault: "//softdevice/components/softdevice/s140/headers:s140",
+        Flag: true,
       },
       {
-        Name: "middle5",
-        Deps: []string{":big_group"},
+        Name: "softdevice_hex",
+        BuildSettingDefault: "//softdevice/components/softdevice/s140/hex",
+        Flag: true,
       },
+    }, nil),
+    newBuildFile(filepath.Join(sdkDir, "components/softdevice/s132/headers"), []*buildfile.Library{softDeviceLib("s132")}, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "components/softdevice/s140/headers"), []*buildfile.Library{softDeviceLib("s140")}, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "components/softdevice/s140/headers/nrf52"), nil, nil, []string{"nrf_mbr.h"}),
+  )
+  hexFile := newBuildFile(filepath.Join(sdkDir, "components/softdevice/s132/hex"), nil, nil, nil)
+  hexFile.AddFilegroup(&buildfile.Filegroup{
+    Name: "hex",
+    Srcs: []string{"s132_nrf52_7.2.0_softdevice.hex"},
+  })
+  checkBuildFiles(t, hexFile)
+  bzl, err := os.ReadFile(bzlPath)
+  if err != nil {
+    t.Fatalf("os.ReadFile(%q): %v", bzlPath, err)
+  }
+  if want := `softdevice_hex = "//softdevice/components/softdevice:softdevice_hex"`; !strings.Contains(string(bzl), want) {
+    t.Errorf("%s doesn't contain %q:\n%s", softDeviceBzlFilename, want, bzl)
+  }
+}
+
+func TestGenerateBuildFiles_DriverMode(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "driver_mode")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  // nrf_drv_uart.h resolves to the legacy driver API, and radio_config.h,
+  // which only the old drivers have, to the old driver.
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
       {
-        Name: "middle6",
-        Deps: []string{":big_group"},
+        Name:     "app",
+        Hdrs:     []string{"app.h"},
+        Deps:     []string{
+          "//driver_mode/components/drivers_nrf/radio_config",
+          "//driver_mode/integration/nrfx/legacy:nrf_drv_uart",
+        },
+        Copts:    []string{
+          "-Idriver_mode/components/drivers_nrf/radio_config",
+          "-Idriver_mode/integration/nrfx/legacy",
+        },
       },
     }, nil, nil),
-    newBuildFile(filepath.Join(sdkDir, "group1"), []*buildfile.Library{
+  )
+}
+
+func TestGenerateBuildFiles_TextualHeaders(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "textual_headers")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  // apply_old_config.h is folded by default, and nrfx_glue.h because the
+  // .bazelifyrc lists it. Their includes become nrfx's own.
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "modules/nrfx"), []*buildfile.Library{
       {
-        Name: "a",
-        Deps: []string{"//cycles_multiple_groups:big_group"},
+        Name:     "nrfx",
+        Hdrs:     []string{"nrfx.h"},
+        TextualHdrs: []string{
+          "//textual_headers/integration/nrfx/legacy:apply_old_config.h",
+          "//textual_headers/integration/nrfx:nrfx_glue.h",
+        },
+        Copts:    []string{
+          "-Itextual_headers/components/libraries/util",
+          "-Itextual_headers/config",
+        },
+        Includes: []string{
+          "../../integration/nrfx",
+          "../../integration/nrfx/legacy",
+        },
+        Deps:     []string{
+          "//textual_headers/components/libraries/util:nrf_assert",
+          "//textual_headers/config",
+        },
       },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "integration/nrfx"), nil, nil, []string{"nrfx_glue.h"}),
+    newBuildFile(filepath.Join(sdkDir, "integration/nrfx/legacy"), nil, nil, []string{"apply_old_config.h"}),
+  )
+}
+
+func TestGenerateBuildFiles_LogBackend(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "log_backend")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  backendLib := func(name string) *buildfile.Library {
+    return &buildfile.Library{
+      Name:     name,
+      Srcs:     []string{name + ".c"},
+      Hdrs:     []string{name + ".h"},
+      Includes: []string{"."},
+      Deps:     []string{":nrf_log_backend_interface", ":nrf_log_backend_serial"},
+    }
+  }
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "app"), []*buildfile.Library{
       {
-        Name: "b",
-        Deps: []string{"//cycles_multiple_groups:big_group"},
+        Name:     "app",
+        Hdrs:     []string{"app.h"},
+        Deps:     []string{"//log_backend/components/libraries/log:nrf_log_default_backends"},
+        Copts:    []string{"-Ilog_backend/components/libraries/log"},
       },
+    }, nil, nil),
+    // The default backends depend on the label_flag, which defaults to RTT.
+    newBuildFile(filepath.Join(sdkDir, "components/libraries/log"), []*buildfile.Library{
       {
-        Name: "c",
-        Deps: []string{"//cycles_multiple_groups:big_group"},
+        Name:     "nrf_log_backend_interface",
+        Hdrs:     []string{"nrf_log_backend_interface.h"},
       },
-    }, nil, []string{"a.h", "b.h", "c.h"}),
-    newBuildFile(filepath.Join(sdkDir, "group2"), []*buildfile.Library{
+      backendLib("nrf_log_backend_rtt"),
       {
-        Name: "d",
-        Deps: []string{"//cycles_multiple_groups:big_group"},
+        Name:     "nrf_log_backend_serial",
+        Hdrs:     []string{"nrf_log_backend_serial.h"},
       },
+      backendLib("nrf_log_backend_uart"),
       {
-        Name: "e",
-        Deps: []string{"//cycles_multiple_groups:big_group"},
+        Name:     "nrf_log_default_backends",
+        Srcs:     []string{"nrf_log_default_backends.c"},
+        Hdrs:     []string{"nrf_log_default_backends.h"},
+        Deps:     []string{":log_backend"},
       },
+    }, []*buildfile.LabelSetting{
       {
-        Name: "f",
-        Deps: []string{"//cycles_multiple_groups:big_group"},
+        Name: "log_backend",
+        BuildSettingDefault: "//log_backend/components/libraries/log:nrf_log_backend_rtt",
+        Flag: true,
       },
-    }, nil, []string{"d.h", "e.h", "f.h"}),
+    }, nil),
+  )
+}
+
+func TestGenerateBuildFiles_CMSIS(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "cmsis")
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    newBuildFile(filepath.Join(sdkDir, "components/toolchain/cmsis/include"), []*buildfile.Library{
+      {
+        Name:     "cmsis",
+        Hdrs:     []string{"cmsis_compiler.h", "cmsis_gcc.h", "cmsis_version.h", "core_cm4.h"},
+        Includes: []string{"."},
+      },
+    }, nil, nil),
+    // The other copy of core_cm4.h doesn't make its includes ambiguous.
+    newBuildFile(filepath.Join(sdkDir, "external/dsp/include"), []*buildfile.Library{
+      {
+        Name:     "cmsis",
+        Hdrs:     []string{"core_cm4.h"},
+        Includes: []string{"."},
+      },
+    }, nil, nil),
+    // cmsis_os.h is the CMSIS-RTOS API, not a CMSIS core header.
+    newBuildFile(filepath.Join(sdkDir, "external/freertos"), []*buildfile.Library{
+      {
+        Name:     "cmsis_os",
+        Hdrs:     []string{"cmsis_os.h"},
+      },
+      {
+        Name:     "task",
+        Hdrs:     []string{"task.h"},
+        Deps:     []string{":cmsis_os"},
+        Copts:    []string{"-Icmsis/external/freertos"},
+      },
+    }, nil, nil),
+    newBuildFile(filepath.Join(sdkDir, "modules/nrfx/mdk"), []*buildfile.Library{
+      {
+        Name:     "nrf52",
+        Hdrs:     []string{"nrf52.h"},
+        Deps:     []string{"//cmsis/components/toolchain/cmsis/include:cmsis"},
+      },
+    }, nil, nil),
+  )
+}
+
+func TestResolve_LogBackendNotFound(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "log_backend")
+  conf, err := ReadConfig([]string{sdkDir}, workspaceDir, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("ReadConfig: %v", err)
+  }
+  conf.LogBackend.Default = "flash"
+  if _, err := resolve(context.Background(), conf, NewDependencyGraph(conf, "")); err == nil || !strings.Contains(err.Error(), `log_backend "flash" not found`) {
+    t.Errorf("resolve: got error %v, want log_backend not found", err)
+  }
+}
+
+func TestGenerateBuildFiles_SDKConfigFlag(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "sdk_config")
+  bzlPath := filepath.Join(sdkDir, appConfigBzlFilename)
+  t.Cleanup(func() { os.Remove(bzlPath) })
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  checkBuildFiles(t,
+    // Libraries that include sdk_config.h see app_config.h through the
+    // library that sdk_config_flag points to.
+    newBuildFile(sdkDir, []*buildfile.Library{
+      {Name: "empty_app_config"},
+      {
+        Name: "empty_sdk_config",
+        Deps: []string{":app_config_flag"},
+      },
+    }, []*buildfile.LabelSetting{
+      {
+        Name: "app_config_flag",
+        BuildSettingDefault: "//sdk_config:empty_app_config",
+        Flag: true,
+      },
+      {
+        Name: "sdk_config_flag",
+        BuildSettingDefault: "//sdk_config:empty_sdk_config",
+        Flag: true,
+      },
+    }, nil),
+    // The SDK's sdk_config.h gets app_config.h from the application too.
+    newBuildFile(filepath.Join(sdkDir, "config/nrf52840/config"), []*buildfile.Library{
+      {
+        Name:     "sdk_config",
+        Hdrs:     []string{"sdk_config.h"},
+        Deps:     []string{"//sdk_config:app_config_flag"},
+      },
+    }, nil, nil),
+    // The SDK's copy of sdk_config.h isn't used.
+    newBuildFile(filepath.Join(sdkDir, "lib"), []*buildfile.Library{
+      {
+        Name:     "a",
+        Srcs:     []string{"a.c"},
+        Hdrs:     []string{"a.h"},
+        Deps:     []string{"//sdk_config:sdk_config_flag"},
+      },
+    }, nil, nil),
+  )
+  bzl, err := os.ReadFile(bzlPath)
+  if err != nil {
+    t.Fatalf("os.ReadFile(%q): %v", bzlPath, err)
+  }
+  if !strings.HasPrefix(string(bzl), "# "+bannerPrefix) {
+    t.Errorf("%s doesn't start with the banner:\n%s", appConfigBzlFilename, bzl)
+  }
+  for _, want := range []string{
+    `defines = ["USE_APP_CONFIG"]`,
+    // An application's own sdk_config.h library sees app_config.h too.
+    `deps = deps + ["//sdk_config:app_config_flag"]`,
+    "Set //sdk_config:sdk_config_flag to it",
+  } {
+    if !strings.Contains(string(bzl), want) {
+      t.Errorf("%s doesn't contain %q:\n%s", appConfigBzlFilename, want, bzl)
+    }
+  }
+}
+
+func TestGenerateBuildFiles_NrfCcLibrary(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "nrf_cc_library")
+  bzlPaths := []string{filepath.Join(sdkDir, sdkBzlFilename), filepath.Join(sdkDir, appConfigBzlFilename)}
+  t.Cleanup(func() {
+    for _, path := range bzlPaths {
+      os.Remove(path)
+    }
+  })
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  newNrfBuildFile := func(dir string, lib *buildfile.Library) *buildfile.File {
+    out := buildfile.New(dir)
+    out.AddLoad(&buildfile.Load{
+      Source: "//nrf_cc_library:sdk.bzl",
+      Symbols: []string{"nrf_cc_library"},
+    })
+    out.SetTags([]string{defaultTag})
+    lib.Kind = "nrf_cc_library"
+    out.AddLibrary(lib)
+    return out
+  }
+  checkBuildFiles(t,
+    // nrf_cc_library adds the sdk_config_flag dep.
+    newNrfBuildFile(filepath.Join(sdkDir, "lib"), &buildfile.Library{
+      Name:     "a",
+      Srcs:     []string{"a.c"},
+      Hdrs:     []string{"a.h"},
+    }),
+    // sdk_config_flag points to this library, so it can't depend on it.
+    newNrfBuildFile(filepath.Join(sdkDir, "config/nrf52840/config"), &buildfile.Library{
+      Name:     "sdk_config",
+      Hdrs:     []string{"sdk_config.h"},
+      Deps:     []string{"//nrf_cc_library:app_config_flag"},
+      NoSDKConfig: true,
+    }),
   )
-}
\ No newline at end of file
+  bzl, err := os.ReadFile(bzlPaths[0])
+  if err != nil {
+    t.Fatalf("os.ReadFile(%q): %v", bzlPaths[0], err)
+  }
+  for _, want := range []string{
+    `NRF_COPTS = ["-Wall"]`,
+    // NRF52840_XXAA is in the rc and the Makefile, and is only added once.
+    `NRF_DEFINES = ["NRF52840_XXAA", "BOARD_PCA10056", "SOFTDEVICE_PRESENT"]`,
+    `SDK_CONFIG = "//nrf_cc_library:sdk_config_flag"`,
+  } {
+    if !strings.Contains(string(bzl), want) {
+      t.Errorf("%s doesn't contain %q:\n%s", sdkBzlFilename, want, bzl)
+    }
+  }
+}
+
+func TestGenerateBuildFiles_Toolchain(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "toolchain")
+  dir := filepath.Join(sdkDir, toolchainDir)
+  t.Cleanup(func() { os.RemoveAll(dir) })
+  if err := GenerateBuildFiles(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases); err != nil {
+    t.Fatalf("GenerateBuildFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  wantPhrases := map[string][]string{
+    "BUILD": {
+      `load(":toolchain.bzl", "arm_none_eabi_toolchain_config")`,
+      `name = "arm_none_eabi_toolchain",`,
+      `toolchain_type = "@bazel_tools//tools/cpp:toolchain_type",`,
+      // The nRF52810 has no FPU.
+      `"//toolchain/chips:is_nrf52810": ["-mfloat-abi=soft"],`,
+      `"//conditions:default": ["-mfloat-abi=hard", "-mfpu=fpv4-sp-d16"],`,
+    },
+    toolchainBzlFilename: {
+      `GCC_DIR = "/opt/gcc-arm-none-eabi"`,
+      `PREFIX = "arm-none-eabi-"`,
+      `"/opt/gcc-arm-none-eabi/arm-none-eabi/include"`,
+      `flags = COPTS + ctx.attr.float_flags`,
+    },
+    toolchainBazelrcFilename: {
+      "import %workspace%/toolchain/toolchain/bazelrc",
+      "build:nrf52 --extra_toolchains=//toolchain/toolchain:arm_none_eabi_toolchain",
+      "build:nrf52 --platforms=//toolchain/toolchain:nrf52",
+    },
+  }
+  for name, phrases := range wantPhrases {
+    contents, err := os.ReadFile(filepath.Join(dir, name))
+    if err != nil {
+      t.Fatalf("os.ReadFile(%q): %v", name, err)
+    }
+    if !strings.HasPrefix(string(contents), "# "+bannerPrefix) {
+      t.Errorf("%s doesn't start with the banner:\n%s", name, contents)
+    }
+    for _, want := range phrases {
+      if !strings.Contains(string(contents), want) {
+        t.Errorf("%s doesn't contain %q:\n%s", name, want, contents)
+      }
+    }
+  }
+  // The float flags select on the chips, so chips/BUILD is generated without
+  // nrf.h.
+  if _, err := os.Stat(filepath.Join(sdkDir, chipsDir, "BUILD")); err != nil {
+    t.Errorf("chips/BUILD not generated with the toolchain: %v", err)
+  }
+  if err := CleanGeneratedFiles(workspaceDir, []string{sdkDir}); err != nil {
+    t.Fatalf("CleanGeneratedFiles(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  if _, err := os.Stat(dir); err == nil {
+    t.Errorf("%s not removed by CleanGeneratedFiles", dir)
+  }
+}
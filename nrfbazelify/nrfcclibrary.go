@@ -0,0 +1,166 @@
+package nrfbazelify
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+)
+
+const (
+  nrfCcLibraryKind = "nrf_cc_library"
+  // Holds the nrf_cc_library macro, in the SDK root.
+  sdkBzlFilename = "sdk.bzl"
+)
+
+var sdkBzlTemplate = template.Must(template.New("sdkBzl").Parse(`"""Wraps cc_library with the policy shared by every library in the SDK."""
+
+load("@rules_cc//cc:defs.bzl", "cc_library")
+
+NRF_COPTS = {{ .Copts }}
+
+NRF_DEFINES = {{ .Defines }}
+
+SDK_CONFIG = {{ .SDKConfig }}
+
+def nrf_cc_library(name, copts = [], defines = [], deps = [], sdk_config = True, **kwargs):
+    """A cc_library with the SDK's common copts and defines, that depends on SDK_CONFIG.
+
+    Args:
+      name: string name of the library.
+      copts: copts added after NRF_COPTS.
+      defines: defines added after NRF_DEFINES.
+      deps: deps of the library.
+      sdk_config: whether to depend on SDK_CONFIG. Libraries that SDK_CONFIG
+        depends on set this to False.
+      **kwargs: args passed to the underlying cc_library rule
+    """
+    if sdk_config and SDK_CONFIG:
+        deps = deps + [SDK_CONFIG]
+    cc_library(
+        name = name,
+        copts = NRF_COPTS + copts,
+        defines = NRF_DEFINES + defines,
+        deps = deps,
+        **kwargs
+    )
+`))
+
+// NrfCcLibrary configures the nrf_cc_library macro.
+type NrfCcLibrary struct {
+  Enabled bool
+  Copts, Defines []string
+}
+
+// useNrfCcLibrary turns every library in files into an nrf_cc_library.
+// Libraries don't list sdk_config_flag in their deps, since the macro adds it,
+// except for libraries that the flag's default depends on.
+// Returns the contents of sdk.bzl.
+func useNrfCcLibrary(conf *Config, depGraph *DependencyGraph, files map[string]*buildfile.File) ([]byte, error) {
+  sdkLabel, err := bazel.NewLabel(conf.SDKDir, sdkBzlFilename, conf.WorkspaceDir)
+  if err != nil {
+    return nil, fmt.Errorf("bazel.NewLabel(%q): %v", sdkBzlFilename, err)
+  }
+  flagLabel, err := bazel.NewLabel(conf.SDKDir, sdkConfigFlagName, conf.WorkspaceDir)
+  if err != nil {
+    return nil, fmt.Errorf("bazel.NewLabel(%q): %v", sdkConfigFlagName, err)
+  }
+  flag, ok := depGraph.Node(flagLabel).(*RemapNode)
+  if !ok {
+    flagLabel = nil
+  }
+  // Libraries that the flag's default depends on would depend on themselves.
+  noSDKConfig := make(map[string]bool)
+  if flag != nil {
+    var err error
+    if noSDKConfig, err = flagDefaultDeps(depGraph, flag); err != nil {
+      return nil, err
+    }
+  }
+
+  for dir, file := range files {
+    var libErr error
+    file.EachLibrary(func(lib *buildfile.Library) {
+      label, err := bazel.NewLabel(filepath.Join(conf.WorkspaceDir, dir), lib.Name, conf.WorkspaceDir)
+      if err != nil {
+        libErr = fmt.Errorf("bazel.NewLabel(%q, %q): %v", dir, lib.Name, err)
+        return
+      }
+      lib.Kind = nrfCcLibraryKind
+      if flagLabel == nil {
+        return
+      }
+      if noSDKConfig[label.String()] {
+        lib.NoSDKConfig = true
+        return
+      }
+      lib.Deps, _ = removeString(lib.Deps, flagLabel.RelativeTo(label))
+      lib.ImplementationDeps, _ = removeString(lib.ImplementationDeps, flagLabel.RelativeTo(label))
+    })
+    if libErr != nil {
+      return nil, libErr
+    }
+    file.AddLoad(&buildfile.Load{
+      Source: sdkLabel.String(),
+      Symbols: []string{nrfCcLibraryKind},
+    })
+  }
+
+  sdkConfig := "None"
+  if flagLabel != nil {
+    sdkConfig = fmt.Sprintf("%q", flagLabel.String())
+  }
+  var out bytes.Buffer
+  if err := sdkBzlTemplate.Execute(&out, struct{ Copts, Defines, SDKConfig string }{
+    Copts: starlarkList(conf.NrfCcLibrary.Copts),
+    Defines: starlarkList(conf.NrfCcLibrary.Defines),
+    SDKConfig: sdkConfig,
+  }); err != nil {
+    return nil, fmt.Errorf("sdkBzlTemplate.Execute: %v", err)
+  }
+  return out.Bytes(), nil
+}
+
+// flagDefaultDeps finds the labels of everything the flag's default depends
+// on, including the default itself. Dependencies on other label_flags follow
+// their defaults, like sdk_config.h including app_config.h.
+func flagDefaultDeps(depGraph *DependencyGraph, flag *RemapNode) (map[string]bool, error) {
+  out := make(map[string]bool)
+  var visit func(defaultLabel string) error
+  visit = func(defaultLabel string) error {
+    label, err := bazel.ParseLabel(defaultLabel)
+    if err != nil {
+      return fmt.Errorf("bazel.ParseLabel(%q): %v", defaultLabel, err)
+    }
+    node := depGraph.Node(label)
+    if node == nil {
+      return nil
+    }
+    for _, n := range depGraph.reachable(node, -1, depGraph.Dependencies) {
+      if out[n.Label().String()] {
+        continue
+      }
+      out[n.Label().String()] = true
+      if remap, ok := n.(*RemapNode); ok {
+        if err := visit(remap.LabelSetting.BuildSettingDefault); err != nil {
+          return err
+        }
+      }
+    }
+    return nil
+  }
+  return out, visit(flag.LabelSetting.BuildSettingDefault)
+}
+
+// starlarkList formats values as a Starlark list of strings.
+func starlarkList(values []string) string {
+  var quoted []string
+  for _, v := range values {
+    quoted = append(quoted, fmt.Sprintf("%q", v))
+  }
+  return "[" + strings.Join(quoted, ", ") + "]"
+}
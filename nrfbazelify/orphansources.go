@@ -0,0 +1,142 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+)
+
+// attachOrphanSources finds the .c files that no library has as srcs. They
+// are orphans, and need a source_sets entry, unless attach_orphan_sources is
+// set. Then they are added to a library in the same dir, or in the parent of
+// a src dir, like src/nrf_log_frontend.c to the library of nrf_log.h. A
+// source goes to the library of the longest header name that its name starts
+// with followed by "_", or else to the only library with headers that it
+// includes. Sources that neither finds a library for are still orphans.
+func (s *SDKWalker) attachOrphanSources() error {
+  claimed := make(map[string]bool)
+  libsByDir := make(map[string][]*LibraryNode)
+  for _, node := range s.graph.Nodes() {
+    lib, ok := node.(*LibraryNode)
+    if !ok {
+      continue
+    }
+    for _, src := range lib.Srcs {
+      claimed[src.String()] = true
+    }
+    for _, srcs := range lib.SrcsSelect {
+      for _, src := range srcs {
+        claimed[src.String()] = true
+      }
+    }
+    libsByDir[lib.Label().Dir()] = append(libsByDir[lib.Label().Dir()], lib)
+  }
+  for _, libs := range libsByDir {
+    sortLibraryNodes(libs)
+  }
+  for _, path := range s.sourceFiles {
+    src, err := bazel.NewLabel(filepath.Dir(path), filepath.Base(path), s.conf.WorkspaceDir)
+    if err != nil {
+      return fmt.Errorf("bazel.NewLabel(%q): %v", path, err)
+    }
+    if claimed[src.String()] {
+      continue
+    }
+    if !s.conf.AttachOrphanSources {
+      s.orphanSources = append(s.orphanSources, src.String())
+      continue
+    }
+    libs := libsByDir[src.Dir()]
+    if filepath.Base(src.Dir()) == "src" {
+      // Like log/src/nrf_log_frontend.c, for log/nrf_log.h.
+      libs = append(libs[:len(libs):len(libs)], libsByDir[filepath.Dir(src.Dir())]...)
+    }
+    lib := libraryByPrefix(libs, src.Name())
+    how := "its name"
+    if lib == nil {
+      if lib, err = s.libraryByIncludes(libs, path); err != nil {
+        return err
+      }
+      how = "its includes"
+    }
+    if lib == nil {
+      s.orphanSources = append(s.orphanSources, src.String())
+      continue
+    }
+    lib.Srcs = append(lib.Srcs, src)
+    bazel.SortLabels(lib.Srcs)
+    s.graph.indexFiles(lib.Label(), []string{src.Name()})
+    s.conf.logf(VerbosityResolutions, "Added %s to the srcs of %s, by %s", src, lib.Label(), how)
+  }
+  sort.Strings(s.orphanSources)
+  if len(s.orphanSources) > 0 {
+    s.conf.logf(VerbosityPhases, "%d sources are in no library, add them to source_sets", len(s.orphanSources))
+  }
+  return nil
+}
+
+// libraryByPrefix finds the library in libs with the longest header name
+// that name starts with, followed by "_". Returns nil if there is none, or
+// more than one library has it.
+func libraryByPrefix(libs []*LibraryNode, name string) *LibraryNode {
+  var found *LibraryNode
+  longest, ambiguous := 0, false
+  for _, lib := range libs {
+    for _, hdr := range lib.Hdrs {
+      prefix := strings.TrimSuffix(hdr.Name(), ".h") + "_"
+      if !strings.HasPrefix(name, prefix) || len(prefix) < longest {
+        continue
+      }
+      if len(prefix) == longest && found != lib {
+        ambiguous = true
+        continue
+      }
+      found, longest, ambiguous = lib, len(prefix), false
+    }
+  }
+  if ambiguous {
+    return nil
+  }
+  return found
+}
+
+// libraryByIncludes finds the only library in libs with headers that the
+// source at path includes. Returns nil if there is none, or more than one.
+func (s *SDKWalker) libraryByIncludes(libs []*LibraryNode, path string) (*LibraryNode, error) {
+  includes, _, err := readIncludes(path, false, s.conf.MacroIncludes, s.conf.DefinePruning.Defines)
+  if err != nil {
+    return nil, fmt.Errorf("readIncludes(%q): %v", s.prettySDKPath(path), err)
+  }
+  included := make(map[string]bool)
+  for _, include := range includes {
+    included[include] = true
+  }
+  var found *LibraryNode
+  for _, lib := range libs {
+    for _, hdr := range lib.Hdrs {
+      if !included[hdr.Name()] {
+        continue
+      }
+      if found != nil && found != lib {
+        return nil, nil
+      }
+      found = lib
+    }
+  }
+  return found, nil
+}
+
+func sortLibraryNodes(libs []*LibraryNode) {
+  sort.Slice(libs, func(i, j int) bool {
+    return libs[i].Label().Less(libs[j].Label())
+  })
+}
+
+// OrphanSources returns the .c files that no library has as srcs, as
+// labels. Only valid after PopulateGraph.
+func (s *SDKWalker) OrphanSources() []string {
+  return s.orphanSources
+}
@@ -1,22 +1,47 @@
 package nrfbazelify
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 
 	"github.com/Michaelhobo/nrfbazel/internal/bazel"
 	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
 )
 
 const (
   // We write the contents of our remap features to this file.
   bzlFilename = "remap.bzl"
+  // The tag of every generated rule, unless the rc sets others.
+  defaultTag = "nrfbazelify-generated"
 )
 
-func OutputBuildFiles(conf *Config, depGraph *DependencyGraph) error {
+// OutputBuildFiles writes BUILD files for every node in depGraph.
+// If ctx is cancelled, no more files are written.
+// Every file written is recorded in the manifest, even if writing stops early.
+func OutputBuildFiles(ctx context.Context, conf *Config, depGraph *DependencyGraph) (err error) {
+  manifest := newManifest()
+  defer func() {
+    if writeErr := manifest.Write(conf.SDKDir); writeErr != nil && err == nil {
+      err = fmt.Errorf("writing manifest: %v", writeErr)
+    }
+  }()
+  for _, sdkDir := range conf.SDKDirs {
+    if err := manifest.AddSDKDir(conf.WorkspaceDir, sdkDir); err != nil {
+      return err
+    }
+  }
+
   files := make(map[string]*buildfile.File)
+  // Files that aren't built with buildfile, like .bzl files.
+  bzlFiles := make(map[string][]byte) // path relative to workspaceDir -> contents
 
   // Convert depGraph nodes into BUILD files.
   nodes := depGraph.Nodes()
@@ -26,57 +51,399 @@ func OutputBuildFiles(conf *Config, depGraph *DependencyGraph) error {
       return err
     }
     for _, c := range contents {
+      if c.bzl != nil {
+        bzlFiles[filepath.Join(c.dir, c.bzl.name)] = c.bzl.contents
+        continue
+      }
       if files[c.dir] == nil {
         files[c.dir] = buildfile.New(filepath.Join(conf.WorkspaceDir, c.dir))
       }
-      file := files[c.dir]
-      if c.library != nil {
-        file.AddLibrary(c.library)
-      }
-      if c.labelSetting != nil {
-        file.AddLabelSetting(c.labelSetting)
-      }
-      if c.load != nil {
-        file.AddLoad(c.load)
+      addBuildContents(files[c.dir], c)
+    }
+  }
+
+  // Add the chip and board constraints, and wire the libraries with nrf.h and
+  // boards.h to the chip's and board's defines.
+  var chips bool
+  if conf.Layout == bazelifyrc.Layout_NRF5_SDK {
+    if chips, err = wantsChips(conf, files); err != nil {
+      return err
+    }
+  }
+  if chips {
+    chipLabel, err := chipsLabel(conf, chipLibraryName)
+    if err != nil {
+      return err
+    }
+    boardLabel, err := chipsLabel(conf, boardLibraryName)
+    if err != nil {
+      return err
+    }
+    for _, file := range files {
+      file.EachLibrary(func(lib *buildfile.Library) {
+        if hasHeader(lib, chipHeader) {
+          lib.Deps = append(lib.Deps, chipLabel.String())
+          sort.Strings(lib.Deps)
+        }
+        if hasHeader(lib, boardHeader) {
+          lib.Deps = append(lib.Deps, boardLabel.String())
+          sort.Strings(lib.Deps)
+        }
+      })
+    }
+    contents, err := chipsContents(conf)
+    if err != nil {
+      return err
+    }
+    // A chips dir of the SDK's own keeps its libraries.
+    if dir := chipLabel.Dir(); files[dir] != nil {
+      return fmt.Errorf("%s has libraries of the SDK, so chips/BUILD can't be generated there", dir)
+    }
+    if err := os.MkdirAll(filepath.Join(conf.SDKDir, chipsDir), 0755); err != nil {
+      return fmt.Errorf("os.MkdirAll(%q): %v", chipsDir, err)
+    }
+    for _, c := range contents {
+      if files[c.dir] == nil {
+        files[c.dir] = buildfile.New(filepath.Join(conf.WorkspaceDir, c.dir))
       }
-      for _, export := range c.exportFiles {
-        file.ExportFile(export)
+      addBuildContents(files[c.dir], c)
+    }
+  }
+
+  if err := applyConditionalSources(conf, files); err != nil {
+    return fmt.Errorf("conditional_sources: %v", err)
+  }
+  if err := applyIncludePrefixes(conf, files); err != nil {
+    return fmt.Errorf("include_prefixes: %v", err)
+  }
+  if err := applyTargetCopts(conf, files); err != nil {
+    return fmt.Errorf("target_copts: %v", err)
+  }
+  if err := applyDefines(conf, files); err != nil {
+    return fmt.Errorf("target_defines: %v", err)
+  }
+  if err := applyAlwayslink(conf, files); err != nil {
+    return fmt.Errorf("alwayslink: %v", err)
+  }
+  if err := applyTestonly(conf, files); err != nil {
+    return fmt.Errorf("testonly: %v", err)
+  }
+  if err := applyDeprecations(conf, files); err != nil {
+    return fmt.Errorf("deprecations: %v", err)
+  }
+  if err := applyVisibility(conf, files); err != nil {
+    return fmt.Errorf("visibility: %v", err)
+  }
+  if err := applyUmbrellas(conf, files); err != nil {
+    return fmt.Errorf("umbrellas: %v", err)
+  }
+  if err := applyStringLists(conf, files); err != nil {
+    return fmt.Errorf("string_list_remaps: %v", err)
+  }
+  thirdParty, err := applyThirdPartyLicenses(conf, files)
+  if err != nil {
+    return fmt.Errorf("third_party: %v", err)
+  }
+
+  if conf.NrfCcLibrary.Enabled {
+    contents, err := useNrfCcLibrary(conf, depGraph, files)
+    if err != nil {
+      return fmt.Errorf("useNrfCcLibrary: %v", err)
+    }
+    sdkFromWorkspace, err := filepath.Rel(conf.WorkspaceDir, conf.SDKDir)
+    if err != nil {
+      return fmt.Errorf("filepath.Rel: %v", err)
+    }
+    bzlFiles[filepath.Join(sdkFromWorkspace, sdkBzlFilename)] = contents
+  }
+
+  // Examples are added after nrf_cc_library, since their config libraries
+  // are what sdk_config_flag points to.
+  if conf.Examples.Enabled {
+    contents, err := examplesContents(conf, depGraph)
+    if err != nil {
+      return fmt.Errorf("examplesContents: %v", err)
+    }
+    for _, c := range contents {
+      if files[c.dir] == nil {
+        files[c.dir] = buildfile.New(filepath.Join(conf.WorkspaceDir, c.dir))
       }
+      addBuildContents(files[c.dir], c)
     }
   }
 
-  // Make sure we load cc_library in each BUILD file.
+  if conf.Toolchain.Enabled {
+    contents, err := toolchainFiles(conf)
+    if err != nil {
+      return fmt.Errorf("toolchainFiles: %v", err)
+    }
+    if err := os.MkdirAll(filepath.Join(conf.SDKDir, toolchainDir), 0755); err != nil {
+      return fmt.Errorf("os.MkdirAll(%q): %v", toolchainDir, err)
+    }
+    for path, c := range contents {
+      bzlFiles[path] = c
+    }
+  }
+
+  // Make sure we load cc_library in each BUILD file, unless nrf_cc_library is loaded instead.
   for _, file := range files {
+    if conf.NrfCcLibrary.Enabled {
+      break
+    }
     file.AddLoad(&buildfile.Load{
       Source: "@rules_cc//cc:defs.bzl",
       Symbols: []string{"cc_library"},
     })
   }
 
+  applyKept(conf, files)
+
+  var labels *LabelsFile
+  if conf.StableLabels {
+    if labels, err = addAliases(conf, files); err != nil {
+      return fmt.Errorf("stable_labels: %v", err)
+    }
+  }
+
+  // Tag every generated rule, so tools can tell them from hand-written ones,
+  // and say where the file came from at the top.
+  bannerLines, err := banner(conf)
+  if err != nil {
+    return err
+  }
+  for _, file := range files {
+    file.SetTags(conf.Tags)
+    for _, line := range bannerLines {
+      file.AddComment(line)
+    }
+  }
+
+  // The compilation database is an analysis output, so it isn't in the manifest.
+  commands, err := compileCommands(conf, files)
+  if err != nil {
+    return fmt.Errorf("compileCommands: %v", err)
+  }
+  compileCommandsJSON, err := json.MarshalIndent(commands, "", "  ")
+  if err != nil {
+    return fmt.Errorf("json.MarshalIndent: %v", err)
+  }
+  bazelifyOutDir := filepath.Join(conf.SDKDir, bazelifyOutDirname)
+  if err := os.MkdirAll(bazelifyOutDir, 0755); err != nil {
+    return fmt.Errorf("MkdirAll(%q): %v", bazelifyOutDir, err)
+  }
+  compileCommandsPath := filepath.Join(bazelifyOutDir, compileCommandsFilename)
+  if err := writeFileAtomic(compileCommandsPath, compileCommandsJSON, 0644); err != nil {
+    return fmt.Errorf("writeFileAtomic(%q): %v", compileCommandsPath, err)
+  }
+  if conf.ThirdParty.Enabled {
+    if err := writeThirdPartyReport(conf, bazelifyOutDir, thirdParty); err != nil {
+      return err
+    }
+  }
+  if conf.SBOM {
+    if err := writeSBOM(conf, files, bazelifyOutDir); err != nil {
+      return fmt.Errorf("writeSBOM: %v", err)
+    }
+  }
+  if conf.IDE.Clangd || conf.IDE.VSCode {
+    contents, err := ideFiles(conf, commands)
+    if err != nil {
+      return fmt.Errorf("ideFiles: %v", err)
+    }
+    for path, c := range contents {
+      if err := os.MkdirAll(filepath.Dir(filepath.Join(conf.WorkspaceDir, path)), 0755); err != nil {
+        return fmt.Errorf("os.MkdirAll(%q): %v", filepath.Dir(path), err)
+      }
+      bzlFiles[path] = c
+    }
+  }
+
   // Write BUILD file contents.
   for _, file := range files {
+    if err := ctx.Err(); err != nil {
+      return err
+    }
     if err := file.Write(); err != nil {
       return err
     }
+    if err := manifest.Add(conf.WorkspaceDir, file.Path, []byte(file.Generate())); err != nil {
+      return err
+    }
+  }
+
+  if labels != nil {
+    if err := labels.Write(conf.SDKDir); err != nil {
+      return fmt.Errorf("writing %s: %v", labelsFilename, err)
+    }
+  }
+
+  for path, contents := range bzlFiles {
+    if takesBanner(path) {
+      contents = append(bannerComment(bannerLines), contents...)
+    }
+    bzlPath := filepath.Join(conf.WorkspaceDir, path)
+    if err := writeFileAtomic(bzlPath, contents, 0644); err != nil {
+      return fmt.Errorf("writeFileAtomic(%q): %v", bzlPath, err)
+    }
+    if err := manifest.Add(conf.WorkspaceDir, bzlPath, contents); err != nil {
+      return err
+    }
   }
 
   if conf.Remaps != nil {
+    if label, dirs := linkerScripts(depGraph); label != nil {
+      if err := conf.Remaps.SetLinkerScripts(label.String(), dirs); err != nil {
+        return fmt.Errorf("SetLinkerScripts: %v", err)
+      }
+    }
+    if chips {
+      devices, err := jlinkDevices(conf)
+      if err != nil {
+        return err
+      }
+      if err := conf.Remaps.SetJLinkDevices(devices); err != nil {
+        return fmt.Errorf("SetJLinkDevices: %v", err)
+      }
+    }
     // Write remaps .bzl contents.
+    remapBzl := append(bannerComment(bannerLines), conf.Remaps.BzlContents()...)
     remapBzlPath := filepath.Join(conf.SDKDir, bzlFilename)
-    if err := os.WriteFile(remapBzlPath, conf.Remaps.BzlContents(), 0644); err != nil {
-      return fmt.Errorf("WriteFile(%q): %v", remapBzlPath, err)
+    if err := writeFileAtomic(remapBzlPath, remapBzl, 0644); err != nil {
+      return fmt.Errorf("writeFileAtomic(%q): %v", remapBzlPath, err)
+    }
+    if err := manifest.Add(conf.WorkspaceDir, remapBzlPath, remapBzl); err != nil {
+      return err
     }
   }
 
   return nil
 }
 
+// bannerPrefix starts the first line of the banner, so generated files can be
+// recognized even without a manifest.
+const bannerPrefix = "Generated by nrfbazelify"
+
+// banner is the comment at the top of every generated BUILD and .bzl file.
+// It has the SDKs and the flags that nrfbazelify ran with, but no timestamps,
+// and paths in the workspace are relative to it, so generating the same SDKs
+// the same way always gives the same files.
+func banner(conf *Config) ([]string, error) {
+  var sdks []string
+  for _, sdkDir := range conf.SDKDirs {
+    rel, err := filepath.Rel(conf.WorkspaceDir, sdkDir)
+    if err != nil {
+      return nil, fmt.Errorf("filepath.Rel: %v", err)
+    }
+    sdks = append(sdks, filepath.ToSlash(rel))
+  }
+  flags := "none"
+  if set := invocationFlags(conf); len(set) > 0 {
+    flags = strings.Join(set, " ")
+  }
+  return []string{
+    fmt.Sprintf("%s %s. DO NOT EDIT.", bannerPrefix, version()),
+    fmt.Sprintf("SDKs, relative to the workspace: %s", strings.Join(sdks, ", ")),
+    fmt.Sprintf("Flags: %s", flags),
+    "Changes are lost when the SDKs are regenerated, configure them in",
+    fmt.Sprintf("%s instead.", rcFilename),
+  }, nil
+}
+
+// invocationFlags returns the flags that aren't at their defaults, like
+// --sdk_version=17.1, sorted by name.
+func invocationFlags(conf *Config) []string {
+  var out []string
+  flag.VisitAll(func(f *flag.Flag) {
+    value := f.Value.String()
+    if value == f.DefValue || strings.HasPrefix(f.Name, "test.") {
+      return
+    }
+    if filepath.IsAbs(value) {
+      if rel, err := filepath.Rel(conf.WorkspaceDir, value); err == nil && !strings.HasPrefix(rel, "..") {
+        value = filepath.ToSlash(rel)
+      }
+    }
+    out = append(out, fmt.Sprintf("--%s=%s", f.Name, value))
+  })
+  return out
+}
+
+// bannerComment returns the banner as # comments, for files that aren't
+// built with buildfile.
+func bannerComment(lines []string) []byte {
+  var out []byte
+  for _, line := range lines {
+    out = append(out, strings.TrimRight("# "+line, " ")+"\n"...)
+  }
+  return out
+}
+
+// takesBanner returns whether the generated file at path gets the banner:
+// BUILD files, .bzl files and bazelrc, but not the IDE's JSON and YAML files.
+func takesBanner(path string) bool {
+  name := filepath.Base(path)
+  return name == "BUILD" || name == toolchainBazelrcFilename || filepath.Ext(name) == ".bzl"
+}
+
 type buildContents struct {
   dir string // The directory of this BUILD file, relative to workspaceDir.
   library *buildfile.Library
+  binary *buildfile.Binary
   labelSetting *buildfile.LabelSetting
   load *buildfile.Load
   exportFiles []string
+  constraintSetting *buildfile.ConstraintSetting
+  constraintValue *buildfile.ConstraintValue
+  configSetting *buildfile.ConfigSetting
+  platform *buildfile.Platform
+  filegroup *buildfile.Filegroup
+  bzl *bzlFile
+}
+
+// bzlFile is a generated .bzl file next to a BUILD file.
+type bzlFile struct {
+  name string
+  contents []byte
+}
+
+// Macros that come with a label_flag, generated next to it, by label_flag name.
+var labelFlagBzls = map[string]func(flagLabel *bazel.Label) (*bzlFile, error){
+  softDeviceHexFlagName: softDeviceBzl,
+  appConfigFlagName: appConfigBzl,
+}
+
+// addBuildContents adds everything in c to file.
+func addBuildContents(file *buildfile.File, c *buildContents) {
+  if c.library != nil {
+    file.AddLibrary(c.library)
+  }
+  if c.binary != nil {
+    file.AddBinary(c.binary)
+  }
+  if c.labelSetting != nil {
+    file.AddLabelSetting(c.labelSetting)
+  }
+  if c.load != nil {
+    file.AddLoad(c.load)
+  }
+  for _, export := range c.exportFiles {
+    file.ExportFile(export)
+  }
+  if c.constraintSetting != nil {
+    file.AddConstraintSetting(c.constraintSetting)
+  }
+  if c.constraintValue != nil {
+    file.AddConstraintValue(c.constraintValue)
+  }
+  if c.configSetting != nil {
+    file.AddConfigSetting(c.configSetting)
+  }
+  if c.filegroup != nil {
+    file.AddFilegroup(c.filegroup)
+  }
+  if c.platform != nil {
+    file.AddPlatform(c.platform)
+  }
 }
 
 func extractBuildContents(node Node, depGraph *DependencyGraph) ([]*buildContents, error) {
@@ -86,48 +453,132 @@ func extractBuildContents(node Node, depGraph *DependencyGraph) ([]*buildContent
   case *GroupNode:
     return groupContents(n, depGraph), nil
   case *RemapNode:
-    return remapContents(n, depGraph), nil
+    return remapContents(n, depGraph)
   case *OverrideNode:
     // Override nodes are ignored, they just represent a label,
     // and don't need any rules written.
     return nil, nil
+  case *SelectNode:
+    // Select nodes become a select() in the deps of their dependents.
+    return nil, nil
+  case *FilegroupNode:
+    return filegroupContents(n), nil
   default:
     return nil, fmt.Errorf("unknown node type for node %q", n.Label())
   }
 }
 
 func libraryContents(node *LibraryNode, depGraph *DependencyGraph) []*buildContents {
-  return []*buildContents{{
+  lib := makeLibrary(node.Label(), node.Srcs, node.Hdrs, depGraph)
+  if node.SrcsSelect != nil {
+    lib.Srcs = nil
+    lib.SrcsSelect = make(map[string][]string)
+    for condition, srcs := range node.SrcsSelect {
+      for _, src := range srcs {
+        lib.SrcsSelect[condition] = append(lib.SrcsSelect[condition], src.FileRelativeTo(node.Label().Dir()))
+      }
+      sort.Strings(lib.SrcsSelect[condition])
+    }
+    // Selected srcs, like startup files, aren't referenced by anything.
+    lib.Alwayslink = true
+  }
+  if exported := exportedIncludes(node, depGraph.conf); exported != nil {
+    ownIncludes := make(map[string]bool)
+    for _, include := range exported {
+      ownIncludes["-I"+include] = true
+      rel, err := filepath.Rel(node.Label().Dir(), include)
+      if err != nil {
+        rel = include
+      }
+      lib.Includes = appendMissing(lib.Includes, rel)
+    }
+    var copts []string
+    for _, copt := range lib.Copts {
+      if !ownIncludes[copt] {
+        copts = append(copts, copt)
+      }
+    }
+    lib.Copts = copts
+  }
+  addTextualHdrs(lib, node.Label(), node.TextualHdrs)
+  out := []*buildContents{{
     dir: node.Label().Dir(),
-    library: makeLibrary(node.Label(), node.Srcs, node.Hdrs, depGraph),
+    library: lib,
   }}
+  // Sources in a sibling src dir, and textual headers in other dirs, need exporting.
+  return append(out, exportFilesContents(node.Label(), node.Srcs, node.Hdrs, node.TextualHdrs)...)
+}
+
+// exportedIncludes returns the Includes of node that are generated as its
+// includes attribute, instead of in its dependents' copts.
+func exportedIncludes(node *LibraryNode, conf *Config) []string {
+  if node.ExportIncludes {
+    return node.Includes
+  }
+  switch conf.IncludePaths {
+  case bazelifyrc.IncludePaths_INCLUDES:
+    return node.Includes
+  case bazelifyrc.IncludePaths_HYBRID:
+    var out []string
+    for _, include := range node.Includes {
+      if include != node.Label().Dir() {
+        out = append(out, include)
+      }
+    }
+    return out
+  }
+  return nil
+}
+
+// unexportedIncludes returns the Includes of node that its dependents add to
+// their copts.
+func unexportedIncludes(node *LibraryNode, conf *Config) []string {
+  exported := make(map[string]bool)
+  for _, include := range exportedIncludes(node, conf) {
+    exported[include] = true
+  }
+  var out []string
+  for _, include := range node.Includes {
+    if !exported[include] {
+      out = append(out, include)
+    }
+  }
+  return out
 }
 
 func groupContents(node *GroupNode, depGraph *DependencyGraph) []*buildContents {
+  lib := makeLibrary(node.Label(), node.Srcs, node.Hdrs, depGraph)
+  addTextualHdrs(lib, node.Label(), node.TextualHdrs)
   out := []*buildContents{{
     dir: node.Label().Dir(),
-    library: makeLibrary(node.Label(), node.Srcs, node.Hdrs, depGraph),
+    library: lib,
   }}
+  return append(out, exportFilesContents(node.Label(), node.Srcs, node.Hdrs, node.TextualHdrs)...)
+}
 
-  // Add build contents for each file that needs exporting.
+// exportFilesContents adds build contents for each file that is used by the
+// rule with the given label, but is in a different directory.
+func exportFilesContents(label *bazel.Label, files ...[]*bazel.Label) []*buildContents {
   var labels []*bazel.Label
-  labels = append(labels, node.Srcs...)
-  labels = append(labels, node.Hdrs...)
-  exportFilesContents := make(map[string]*buildContents)
+  for _, f := range files {
+    labels = append(labels, f...)
+  }
+  byDir := make(map[string]*buildContents)
   for _, l := range labels {
     // We don't need to export files that are in the same directory.
-    if l.Dir() == node.Label().Dir() {
+    if l.Dir() == label.Dir() {
       continue
     }
-    if exportFilesContents[l.Dir()] == nil {
-      exportFilesContents[l.Dir()] = &buildContents{
+    if byDir[l.Dir()] == nil {
+      byDir[l.Dir()] = &buildContents{
         dir: l.Dir(),
       }
     }
-    exportFilesContents[l.Dir()].exportFiles = append(exportFilesContents[l.Dir()].exportFiles, l.Name())
+    byDir[l.Dir()].exportFiles = append(byDir[l.Dir()].exportFiles, l.Name())
   }
 
-  for _, c := range exportFilesContents {
+  var out []*buildContents
+  for _, c := range byDir {
     out = append(out, c)
   }
 
@@ -136,9 +587,36 @@ func groupContents(node *GroupNode, depGraph *DependencyGraph) []*buildContents
 
 // makeLibrary creates a deterministic buildfile.Library by sorting all fields.
 func makeLibrary(label *bazel.Label, srcs, hdrs []*bazel.Label, depGraph *DependencyGraph) *buildfile.Library {
-  var deps []string
+  // Dependencies that the hdrs include, if the others become implementation_deps.
+  var hdrDeps map[string]bool
+  if depGraph.conf.ImplementationDeps && len(srcs) > 0 {
+    var err error
+    if hdrDeps, err = headerDependencies(hdrs, depGraph); err != nil {
+      // Keeping every dep in deps is always correct.
+      log.Printf("Not emitting implementation_deps of %s: %v", label, err)
+    }
+  }
+  // Dependencies that other dependencies already bring in.
+  var redundant map[int64]bool
+  if depGraph.conf.TransitiveReduction {
+    redundant = depGraph.redundantDependencies(label)
+  }
+  var deps, implDeps []string
+  var depsSelects []map[string][]string
   depNodes := depGraph.Dependencies(label)
+  sortNodes(depNodes)
   for _, d := range depNodes {
+    if redundant[d.ID()] {
+      continue
+    }
+    if sel, ok := d.(*SelectNode); ok {
+      depsSelects = append(depsSelects, depsSelect(label, sel))
+      continue
+    }
+    if hdrDeps != nil && !hdrDeps[d.Label().String()] {
+      implDeps = append(implDeps, d.Label().RelativeTo(label))
+      continue
+    }
     deps = append(deps, d.Label().RelativeTo(label))
   }
 
@@ -152,12 +630,35 @@ func makeLibrary(label *bazel.Label, srcs, hdrs []*bazel.Label, depGraph *Depend
   }
 
 	// Add -I<include path> to copts for all dependencies.
-	copts = append(copts, includesAsCopts(label, hdrs, depGraph)...)
+	copts = append(copts, includesAsCopts(label, srcs, hdrs, depGraph)...)
+  var includes []string
+  if depGraph.conf.IncludePaths == bazelifyrc.IncludePaths_INCLUDES {
+    // Header dirs are exported too, since dependents need them.
+    hdrCopts := make(map[string]bool)
+    for _, hdr := range hdrs {
+      hdrCopts["-I"+hdr.Dir()] = true
+    }
+    var depCopts []string
+    for _, copt := range copts {
+      if !hdrCopts[copt] {
+        depCopts = append(depCopts, copt)
+        continue
+      }
+      rel, err := filepath.Rel(label.Dir(), strings.TrimPrefix(copt, "-I"))
+      if err != nil {
+        rel = strings.TrimPrefix(copt, "-I")
+      }
+      includes = append(includes, rel)
+    }
+    copts = depCopts
+    sort.Strings(includes)
+  }
 
   // Sort the srcs, hdrs, copts, and deps so output has a deterministic order.
   sort.Strings(outSrcs)
   sort.Strings(outHdrs)
   sort.Strings(deps)
+  sort.Strings(implDeps)
   sort.Strings(copts)
 
 	return &buildfile.Library{
@@ -165,16 +666,55 @@ func makeLibrary(label *bazel.Label, srcs, hdrs []*bazel.Label, depGraph *Depend
 		Srcs: outSrcs,
 		Hdrs: outHdrs,
 		Deps: deps,
+		DepsSelects: depsSelects,
+		ImplementationDeps: implDeps,
 		Copts: copts,
+		Includes: includes,
 	}
 }
 
+// headerDependencies returns the labels of the nodes that the includes of hdrs
+// can resolve to. It may return more labels than the includes were resolved
+// to, which only keeps more deps out of implementation_deps.
+func headerDependencies(hdrs []*bazel.Label, depGraph *DependencyGraph) (map[string]bool, error) {
+  conf := depGraph.conf
+  followAngled := conf.Layout == bazelifyrc.Layout_NCS
+  out := make(map[string]bool)
+  for _, hdr := range hdrs {
+    path := filepath.Join(conf.WorkspaceDir, hdr.Dir(), hdr.Name())
+    includes, angled, err := readIncludes(path, followAngled, conf.MacroIncludes, conf.DefinePruning.Defines)
+    if err != nil {
+      return nil, fmt.Errorf("readIncludes(%q): %v", path, err)
+    }
+    for _, include := range append(includes, angled...) {
+      for _, node := range depGraph.NodesWithFile(filepath.Base(include)) {
+        out[node.Label().String()] = true
+        out[depGraph.shiftIfIsPointer(node).Label().String()] = true
+      }
+    }
+  }
+  return out, nil
+}
+
+// depsSelect turns a select node into the cases of a select() in the deps of
+// the library with the given label.
+func depsSelect(label *bazel.Label, node *SelectNode) map[string][]string {
+  out := make(map[string][]string)
+  for condition, l := range node.Override.Cases {
+    out[condition] = []string{l.RelativeTo(label)}
+  }
+  if node.Override.Default != nil {
+    out[buildfile.DefaultCondition] = []string{node.Override.Default.RelativeTo(label)}
+  }
+  return out
+}
+
 // includesAsCopts finds all includes of all dependencies and headers of a node.
 // Dependencies get all their include dirs added.
 // If headers are in more than 1 directory, all header directories also get added.
 // All includes are returned in the form -I<include path>,
 // which is suitable for passing into a cc_library's copts field.
-func includesAsCopts(label *bazel.Label, hdrs []*bazel.Label, depGraph *DependencyGraph) []string {
+func includesAsCopts(label *bazel.Label, srcs, hdrs []*bazel.Label, depGraph *DependencyGraph) []string {
 	// Prevent duplicates by using a set.
 	includesSet := make(map[string]bool)
 
@@ -184,9 +724,16 @@ func includesAsCopts(label *bazel.Label, hdrs []*bazel.Label, depGraph *Dependen
 		var includes []string
 		switch d := dep.(type) {
 		case *LibraryNode:
-			includes = d.Includes
+			includes = unexportedIncludes(d, depGraph.conf)
 		case *OverrideNode:
 			includes = d.Includes
+		case *SelectNode:
+			// Any of the labels can be selected, so add all their includes.
+			for _, selected := range depGraph.Dependencies(d.Label()) {
+				if lib, ok := selected.(*LibraryNode); ok {
+					includes = append(includes, unexportedIncludes(lib, depGraph.conf)...)
+				}
+			}
 		default:
 			continue
 		}
@@ -195,13 +742,19 @@ func includesAsCopts(label *bazel.Label, hdrs []*bazel.Label, depGraph *Dependen
 		}
 	}
 
-	// If headers are part of more than 1 directory,
-	// add all their directories to the includes.
+	// If headers are part of more than 1 directory, or sources are in a
+	// directory without headers, add all header directories to the includes.
 	hdrDirsSet := make(map[string]bool)
 	for _, hdr := range hdrs {
 		hdrDirsSet[hdr.Dir()] = true
 	}
-	if len(hdrDirsSet) > 1 {
+	splitSrcs := false
+	for _, src := range srcs {
+		if !hdrDirsSet[src.Dir()] {
+			splitSrcs = true
+		}
+	}
+	if len(hdrDirsSet) > 1 || splitSrcs {
 		for hdrDir := range hdrDirsSet {
 			includesSet[hdrDir] = true
 		}
@@ -215,9 +768,35 @@ func includesAsCopts(label *bazel.Label, hdrs []*bazel.Label, depGraph *Dependen
 	return out
 }
 
-func remapContents(node *RemapNode, depGraph *DependencyGraph) []*buildContents {
-  return []*buildContents{{
+func remapContents(node *RemapNode, depGraph *DependencyGraph) ([]*buildContents, error) {
+  out := []*buildContents{{
     dir: node.Label().Dir(),
     labelSetting: node.LabelSetting,
   }}
+  if genBzl := labelFlagBzls[node.LabelSetting.Name]; genBzl != nil && node.LabelSetting.Flag {
+    bzl, err := genBzl(node.Label())
+    if err != nil {
+      return nil, fmt.Errorf("%s: %v", node.Label(), err)
+    }
+    out = append(out, &buildContents{
+      dir: node.Label().Dir(),
+      bzl: bzl,
+    })
+  }
+  return out, nil
+}
+
+func filegroupContents(node *FilegroupNode) []*buildContents {
+  var srcs []string
+  for _, src := range node.Srcs {
+    srcs = append(srcs, src.FileRelativeTo(node.Label().Dir()))
+  }
+  sort.Strings(srcs)
+  return []*buildContents{{
+    dir: node.Label().Dir(),
+    filegroup: &buildfile.Filegroup{
+      Name: node.Label().Name(),
+      Srcs: srcs,
+    },
+  }}
 }
\ No newline at end of file
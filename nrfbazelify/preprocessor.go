@@ -0,0 +1,491 @@
+package nrfbazelify
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+  defineMatcher = regexp.MustCompile(`^\s*#\s*define\s+([A-Za-z_][A-Za-z0-9_]*)(?:\s+(.*))?$`)
+  conditionalMatcher = regexp.MustCompile(`^\s*#\s*(if|ifdef|ifndef|elif|else|endif)\b(.*)$`)
+  ppTokenMatcher = regexp.MustCompile(`^(?:[A-Za-z_][A-Za-z0-9_]*|[0-9][A-Za-z0-9_]*|\|\||&&|==|!=|<=|>=|[<>!()+\-*/%,?:])`)
+)
+
+// maxMacroDepth limits how deep macros that expand to other macros are
+// followed, so macros defined in terms of each other stay unknown.
+const maxMacroDepth = 16
+
+// readDefines reads the object-like #defines of the file at path, like the
+// ones in sdk_config.h, as macro -> value. The first #define of a macro is
+// kept, since sdk_config.h only defines each macro once, in #ifndef.
+// Defines without a value, like the include guard SDK_CONFIG_H, are skipped,
+// or #ifndef SDK_CONFIG_H would rule out the whole file when it is read.
+func readDefines(path string) (map[string]string, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  out := make(map[string]string)
+  scanner := bufio.NewScanner(file)
+  for scanner.Scan() {
+    matches := defineMatcher.FindStringSubmatch(scanner.Text())
+    if matches == nil {
+      continue
+    }
+    value := stripComments(matches[2])
+    if _, ok := out[matches[1]]; ok || value == "" {
+      continue
+    }
+    out[matches[1]] = value
+  }
+  return out, scanner.Err()
+}
+
+// parseDefines adds defines like "NRF_LOG_ENABLED=0", or "DEBUG" for
+// "DEBUG=1", to out, replacing earlier values.
+func parseDefines(out map[string]string, defines []string) {
+  for _, define := range defines {
+    name, value := define, "1"
+    if i := strings.Index(define, "="); i >= 0 {
+      name, value = define[:i], define[i+1:]
+    }
+    out[strings.TrimSpace(name)] = strings.TrimSpace(value)
+  }
+}
+
+// stripComments removes the comments from a line of a directive. A comment
+// that doesn't end on the line takes the rest of it.
+func stripComments(line string) string {
+  var out strings.Builder
+  for len(line) > 0 {
+    if strings.HasPrefix(line, "//") {
+      break
+    }
+    if strings.HasPrefix(line, "/*") {
+      end := strings.Index(line[2:], "*/")
+      if end < 0 {
+        break
+      }
+      out.WriteByte(' ')
+      line = line[end+4:]
+      continue
+    }
+    out.WriteByte(line[0])
+    line = line[1:]
+  }
+  return strings.TrimSpace(out.String())
+}
+
+// tristate is the value of a condition that may depend on macros without a
+// known value.
+type tristate int
+
+const (
+  unknown tristate = iota
+  isFalse
+  isTrue
+)
+
+// ppValue is the value of a preprocessor expression, if it's known.
+type ppValue struct {
+  n int64
+  known bool
+}
+
+func (v ppValue) truth() tristate {
+  switch {
+  case !v.known:
+    return unknown
+  case v.n == 0:
+    return isFalse
+  }
+  return isTrue
+}
+
+func knownValue(n int64) ppValue {
+  return ppValue{n: n, known: true}
+}
+
+func boolValue(b bool) ppValue {
+  if b {
+    return knownValue(1)
+  }
+  return knownValue(0)
+}
+
+// evalCondition evaluates the expression of an #if or #elif with the
+// defines. Macros that aren't defined are unknown instead of 0, since the
+// defines are only some of the ones a build has, and so is anything that
+// depends on them. So is any expression that can't be parsed.
+func evalCondition(expr string, defines map[string]string) tristate {
+  return evalExpr(expr, defines, 0).truth()
+}
+
+func evalExpr(expr string, defines map[string]string, depth int) ppValue {
+  if depth > maxMacroDepth {
+    return ppValue{}
+  }
+  tokens, ok := tokenize(stripComments(expr))
+  if !ok || len(tokens) == 0 {
+    return ppValue{}
+  }
+  p := &ppParser{tokens: tokens, defines: defines, depth: depth}
+  v := p.or()
+  if p.failed || p.pos != len(p.tokens) {
+    return ppValue{}
+  }
+  return v
+}
+
+func tokenize(expr string) ([]string, bool) {
+  var out []string
+  for {
+    expr = strings.TrimSpace(expr)
+    if expr == "" {
+      return out, true
+    }
+    token := ppTokenMatcher.FindString(expr)
+    if token == "" {
+      return nil, false
+    }
+    out = append(out, token)
+    expr = expr[len(token):]
+  }
+}
+
+// ppParser is a recursive descent parser of #if expressions, that evaluates
+// them as it goes. It stops at operators it doesn't support, like ?:.
+type ppParser struct {
+  tokens []string
+  pos int
+  defines map[string]string
+  depth int
+  failed bool
+}
+
+func (p *ppParser) peek() string {
+  if p.pos >= len(p.tokens) {
+    return ""
+  }
+  return p.tokens[p.pos]
+}
+
+func (p *ppParser) next() string {
+  token := p.peek()
+  if token == "" {
+    p.failed = true
+    return ""
+  }
+  p.pos++
+  return token
+}
+
+func (p *ppParser) expect(token string) {
+  if p.next() != token {
+    p.failed = true
+  }
+}
+
+func (p *ppParser) or() ppValue {
+  v := p.and()
+  for !p.failed && p.peek() == "||" {
+    p.next()
+    w := p.and()
+    switch {
+    case v.truth() == isTrue || w.truth() == isTrue:
+      v = knownValue(1)
+    case v.known && w.known:
+      v = knownValue(0)
+    default:
+      v = ppValue{}
+    }
+  }
+  return v
+}
+
+func (p *ppParser) and() ppValue {
+  v := p.equality()
+  for !p.failed && p.peek() == "&&" {
+    p.next()
+    w := p.equality()
+    switch {
+    case v.truth() == isFalse || w.truth() == isFalse:
+      v = knownValue(0)
+    case v.known && w.known:
+      v = knownValue(1)
+    default:
+      v = ppValue{}
+    }
+  }
+  return v
+}
+
+func (p *ppParser) equality() ppValue {
+  v := p.relational()
+  for !p.failed && (p.peek() == "==" || p.peek() == "!=") {
+    op := p.next()
+    w := p.relational()
+    if !v.known || !w.known {
+      v = ppValue{}
+      continue
+    }
+    v = boolValue((v.n == w.n) == (op == "=="))
+  }
+  return v
+}
+
+func (p *ppParser) relational() ppValue {
+  v := p.additive()
+  for !p.failed {
+    op := p.peek()
+    if op != "<" && op != ">" && op != "<=" && op != ">=" {
+      return v
+    }
+    p.next()
+    w := p.additive()
+    if !v.known || !w.known {
+      v = ppValue{}
+      continue
+    }
+    switch op {
+    case "<":
+      v = boolValue(v.n < w.n)
+    case ">":
+      v = boolValue(v.n > w.n)
+    case "<=":
+      v = boolValue(v.n <= w.n)
+    default:
+      v = boolValue(v.n >= w.n)
+    }
+  }
+  return v
+}
+
+func (p *ppParser) additive() ppValue {
+  v := p.multiplicative()
+  for !p.failed && (p.peek() == "+" || p.peek() == "-") {
+    op := p.next()
+    w := p.multiplicative()
+    if !v.known || !w.known {
+      v = ppValue{}
+      continue
+    }
+    if op == "+" {
+      v = knownValue(v.n + w.n)
+    } else {
+      v = knownValue(v.n - w.n)
+    }
+  }
+  return v
+}
+
+func (p *ppParser) multiplicative() ppValue {
+  v := p.unary()
+  for !p.failed && (p.peek() == "*" || p.peek() == "/" || p.peek() == "%") {
+    op := p.next()
+    w := p.unary()
+    if !v.known || !w.known || (op != "*" && w.n == 0) {
+      v = ppValue{}
+      continue
+    }
+    switch op {
+    case "*":
+      v = knownValue(v.n * w.n)
+    case "/":
+      v = knownValue(v.n / w.n)
+    default:
+      v = knownValue(v.n % w.n)
+    }
+  }
+  return v
+}
+
+func (p *ppParser) unary() ppValue {
+  switch p.peek() {
+  case "!":
+    p.next()
+    v := p.unary()
+    if !v.known {
+      return v
+    }
+    return boolValue(v.n == 0)
+  case "-":
+    p.next()
+    v := p.unary()
+    if !v.known {
+      return v
+    }
+    return knownValue(-v.n)
+  case "+":
+    p.next()
+    return p.unary()
+  }
+  return p.primary()
+}
+
+func (p *ppParser) primary() ppValue {
+  token := p.next()
+  switch {
+  case p.failed:
+    return ppValue{}
+  case token == "(":
+    v := p.or()
+    p.expect(")")
+    return v
+  case token[0] >= '0' && token[0] <= '9':
+    n, err := strconv.ParseInt(strings.TrimRight(token, "uUlL"), 0, 64)
+    if err != nil {
+      return ppValue{}
+    }
+    return knownValue(n)
+  case token == "defined":
+    parens := p.peek() == "("
+    if parens {
+      p.next()
+    }
+    name := p.next()
+    if parens {
+      p.expect(")")
+    }
+    return p.defined(name)
+  case token == "NRF_MODULE_ENABLED" && p.peek() == "(":
+    // The SDK's NRF_MODULE_ENABLED(X) is defined(X_ENABLED) && X_ENABLED.
+    p.next()
+    module := p.next()
+    p.expect(")")
+    return p.macro(module + "_ENABLED")
+  case isIdentifier(token) && p.peek() == "(":
+    // Other function-like macros are unknown, with their arguments.
+    p.skipArgs()
+    return ppValue{}
+  case isIdentifier(token):
+    return p.macro(token)
+  }
+  p.failed = true
+  return ppValue{}
+}
+
+// defined is the value of defined(name). Macros that aren't in the defines
+// could be defined elsewhere, so they are unknown instead of 0.
+func (p *ppParser) defined(name string) ppValue {
+  if _, ok := p.defines[name]; ok {
+    return knownValue(1)
+  }
+  return ppValue{}
+}
+
+// macro is the value of the macro name, by expanding its define.
+func (p *ppParser) macro(name string) ppValue {
+  value, ok := p.defines[name]
+  if !ok {
+    return ppValue{}
+  }
+  return evalExpr(value, p.defines, p.depth+1)
+}
+
+func (p *ppParser) skipArgs() {
+  p.expect("(")
+  for open := 1; open > 0 && !p.failed; {
+    switch p.next() {
+    case "(":
+      open++
+    case ")":
+      open--
+    }
+  }
+}
+
+func isIdentifier(token string) bool {
+  c := token[0]
+  return c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+// conditionals tracks the #if blocks around a line of a file, to tell
+// whether the defines rule it out.
+type conditionals struct {
+  defines map[string]string
+  blocks []*conditionalBlock
+}
+
+// conditionalBlock is an #if block, from #if, #ifdef or #ifndef to #endif.
+type conditionalBlock struct {
+  state tristate // of the current branch
+  anyTrue bool // one of the branches so far is true
+  allFalse bool // all of the branches so far are false
+}
+
+// directive updates the blocks with the line, if it's a conditional
+// directive. Returns whether it was one.
+func (c *conditionals) directive(line string) bool {
+  matches := conditionalMatcher.FindStringSubmatch(line)
+  if matches == nil {
+    return false
+  }
+  arg := stripComments(matches[2])
+  switch matches[1] {
+  case "if":
+    c.push(evalCondition(arg, c.defines))
+  case "ifdef":
+    c.push(c.ifdef(arg))
+  case "ifndef":
+    state := c.ifdef(arg)
+    if state == isTrue {
+      state = isFalse
+    }
+    c.push(state)
+  case "elif", "else":
+    if len(c.blocks) == 0 {
+      return true
+    }
+    block := c.blocks[len(c.blocks)-1]
+    state := isTrue
+    if matches[1] == "elif" {
+      state = evalCondition(arg, c.defines)
+    }
+    switch {
+    case block.anyTrue:
+      state = isFalse
+    case !block.allFalse && state != isFalse:
+      state = unknown
+    }
+    block.state = state
+    block.anyTrue = block.anyTrue || state == isTrue
+    block.allFalse = block.allFalse && state == isFalse
+  case "endif":
+    if len(c.blocks) > 0 {
+      c.blocks = c.blocks[:len(c.blocks)-1]
+    }
+  }
+  return true
+}
+
+// ifdef is the state of #ifdef name, which is only known if name is defined.
+func (c *conditionals) ifdef(name string) tristate {
+  if _, ok := c.defines[name]; ok {
+    return isTrue
+  }
+  return unknown
+}
+
+func (c *conditionals) push(state tristate) {
+  c.blocks = append(c.blocks, &conditionalBlock{
+    state: state,
+    anyTrue: state == isTrue,
+    allFalse: state == isFalse,
+  })
+}
+
+// skipped reports whether lines here are ruled out, because a branch around
+// them is false.
+func (c *conditionals) skipped() bool {
+  for _, block := range c.blocks {
+    if block.state == isFalse {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,121 @@
+package nrfbazelify
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEvalCondition(t *testing.T) {
+  defines := map[string]string{
+    "NRF_LOG_ENABLED": "0",
+    "APP_TIMER_ENABLED": "1",
+    "NRF_LOG_DEFAULT_LEVEL": "3",
+    "NRF_LOG_USES_TIMESTAMP": "APP_TIMER_ENABLED",
+    "LOOP": "LOOP",
+  }
+  tests := map[string]tristate{
+    "0": isFalse,
+    "1": isTrue,
+    "0x10 > 8U": isTrue,
+    "NRF_LOG_ENABLED": isFalse,
+    "APP_TIMER_ENABLED": isTrue,
+    "!NRF_LOG_ENABLED": isTrue,
+    "NRF_LOG_DEFAULT_LEVEL >= 4": isFalse,
+    "NRF_LOG_USES_TIMESTAMP": isTrue,
+    "NRF_MODULE_ENABLED(NRF_LOG)": isFalse,
+    "NRF_MODULE_ENABLED(APP_TIMER)": isTrue,
+    "defined(APP_TIMER_ENABLED) && APP_TIMER_ENABLED": isTrue,
+    "defined NRF_LOG_ENABLED": isTrue,
+    // Macros without a value could be defined anywhere.
+    "UNKNOWN": unknown,
+    "defined(UNKNOWN)": unknown,
+    "!UNKNOWN": unknown,
+    "UNKNOWN || APP_TIMER_ENABLED": isTrue,
+    "UNKNOWN && NRF_LOG_ENABLED": isFalse,
+    "UNKNOWN && APP_TIMER_ENABLED": unknown,
+    "OTHER_MACRO(1)": unknown,
+    "LOOP": unknown,
+    "APP_TIMER_ENABLED ? 1 : 0": unknown,
+    "(APP_TIMER_ENABLED": unknown,
+    "APP_TIMER_ENABLED // comment": isTrue,
+  }
+  for expr, want := range tests {
+    if got := evalCondition(expr, defines); got != want {
+      t.Errorf("evalCondition(%q) = %v, want %v", expr, got, want)
+    }
+  }
+}
+
+func TestReadDefines(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "sdk_config.h")
+  text := `#ifndef SDK_CONFIG_H
+#define SDK_CONFIG_H
+#ifndef NRF_LOG_ENABLED
+#define NRF_LOG_ENABLED 0 // comment
+#endif
+#define NRF_LOG_ENABLED 1
+#endif
+`
+  if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+    t.Fatalf("WriteFile: %v", err)
+  }
+  got, err := readDefines(path)
+  if err != nil {
+    t.Fatalf("readDefines: %v", err)
+  }
+  // The include guard has no value, so it's left out.
+  want := map[string]string{"NRF_LOG_ENABLED": "0"}
+  if diff := cmp.Diff(want, got); diff != "" {
+    t.Errorf("readDefines (-want +got):\n%s", diff)
+  }
+}
+
+func TestReadIncludesDefines(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "a.h")
+  text := `#ifndef A_H
+#define A_H
+#include "always.h"
+#if NRF_MODULE_ENABLED(NRF_LOG)
+#include "nrf_log.h"
+#elif APP_TIMER_ENABLED
+#include "app_timer.h"
+#else
+#include "neither.h"
+#endif
+#ifdef UNKNOWN
+#include "maybe.h"
+#else
+#include "maybe_not.h"
+#endif
+#if defined(APP_TIMER_ENABLED) && \
+    APP_TIMER_ENABLED == 0
+#include "continued.h"
+#endif
+#endif // A_H
+`
+  if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+    t.Fatalf("WriteFile: %v", err)
+  }
+  defines := map[string]string{"NRF_LOG_ENABLED": "0", "APP_TIMER_ENABLED": "1"}
+  got, _, err := readIncludes(path, false, nil, defines)
+  if err != nil {
+    t.Fatalf("readIncludes: %v", err)
+  }
+  want := []string{"always.h", "app_timer.h", "maybe.h", "maybe_not.h"}
+  if diff := cmp.Diff(want, got); diff != "" {
+    t.Errorf("readIncludes with defines (-want +got):\n%s", diff)
+  }
+
+  // Without defines, every include is read.
+  got, _, err = readIncludes(path, false, nil, nil)
+  if err != nil {
+    t.Fatalf("readIncludes: %v", err)
+  }
+  want = []string{"always.h", "nrf_log.h", "app_timer.h", "neither.h", "maybe.h", "maybe_not.h", "continued.h"}
+  if diff := cmp.Diff(want, got); diff != "" {
+    t.Errorf("readIncludes without defines (-want +got):\n%s", diff)
+  }
+}
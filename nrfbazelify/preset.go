@@ -0,0 +1,188 @@
+package nrfbazelify
+
+import (
+	"embed"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+  // Disables the nRF5 SDK preset when passed to --sdk_version.
+  sdkVersionNone = "none"
+  // The SDK version is read from this file, relative to the SDK root.
+  releaseNotesPath = "documentation/release_notes.txt"
+  // SDK roots containing this dir are nRF5 SDKs for Mesh.
+  meshCoreDir = "mesh/core"
+  // The built-in preset for the nRF5 SDK for Mesh.
+  meshPresetPath = "presets/mesh" + rcFilename
+  // The built-in preset for exclude_non_gcc.
+  nonGCCPresetPath = "presets/non_gcc" + rcFilename
+  // The built-in presets for driver_mode are named like driver_nrfx.bazelifyrc.
+  driverPresetPrefix = "presets/driver_"
+  // The built-in preset for the nRF5 SDK versions in presetVersions.
+  sdkPresetPath = "presets/nrf5_sdk" + rcFilename
+)
+
+var (
+  sdkVersion = flag.String("sdk_version", "", "The nRF5 SDK version, like 17.1, used to pick a built-in .bazelifyrc preset. Detected from the SDK's release notes if empty. Use \"none\" to disable the nRF5 SDK preset.")
+  meshPreset = flag.Bool("mesh_preset", true, "Merge the built-in .bazelifyrc preset into nRF5 SDKs for Mesh.")
+
+  // Matches the version in release notes, like "nRF5 SDK v17.1.0".
+  releaseNotesVersion = regexp.MustCompile(`nRF5 SDK v?(\d+)\.(\d+)`)
+
+  //go:embed presets/*.bazelifyrc
+  presetFS embed.FS
+
+  // The nRF5 SDK versions that sdkPresetPath is for, sorted. They share one
+  // preset, since the excludes and ignore_headers are the same in all of them.
+  // Nothing in it is version specific, and it resolves no ambiguities.
+  presetVersions = []string{"15.3", "16.0", "17.1"}
+)
+
+// DetectSDKVersion reads the SDK's major.minor version from its release notes.
+// Returns "" if the version can't be found.
+func DetectSDKVersion(sdkDir string) (string, error) {
+  data, err := os.ReadFile(filepath.Join(sdkDir, releaseNotesPath))
+  if os.IsNotExist(err) {
+    return "", nil
+  }
+  if err != nil {
+    return "", err
+  }
+  capture := releaseNotesVersion.FindSubmatch(data)
+  if capture == nil {
+    return "", nil
+  }
+  return fmt.Sprintf("%s.%s", capture[1], capture[2]), nil
+}
+
+// PresetVersions lists the SDK versions that have a built-in preset.
+func PresetVersions() []string {
+  return append([]string(nil), presetVersions...)
+}
+
+// sdkPreset returns the built-in preset for the SDK, and its version.
+// The version comes from --sdk_version, or is detected from the SDK.
+// Returns a nil preset if presets are disabled, or there is no preset for
+// a detected version.
+func sdkPreset(sdkDir string) (*bazelifyrc.Configuration, string, error) {
+  version := *sdkVersion
+  if version == sdkVersionNone {
+    return nil, "", nil
+  }
+  explicit := version != ""
+  if !explicit {
+    detected, err := DetectSDKVersion(sdkDir)
+    if err != nil {
+      return nil, "", fmt.Errorf("DetectSDKVersion: %v", err)
+    }
+    if detected == "" {
+      return nil, "", nil
+    }
+    version = detected
+  }
+  if !hasPreset(version) {
+    if explicit {
+      return nil, "", fmt.Errorf("no preset for --sdk_version=%s, available: %s", version, strings.Join(PresetVersions(), ", "))
+    }
+    log.Printf("Detected nRF5 SDK %s, which has no built-in preset. Available: %s", version, strings.Join(PresetVersions(), ", "))
+    return nil, "", nil
+  }
+  data, err := presetFS.ReadFile(sdkPresetPath)
+  if err != nil {
+    return nil, "", fmt.Errorf("ReadFile(%q): %v", sdkPresetPath, err)
+  }
+  var preset bazelifyrc.Configuration
+  if err := prototext.Unmarshal(data, &preset); err != nil {
+    return nil, "", fmt.Errorf("preset %s: %v", version, err)
+  }
+  return &preset, version, nil
+}
+
+func hasPreset(version string) bool {
+  for _, v := range presetVersions {
+    if v == version {
+      return true
+    }
+  }
+  return false
+}
+
+// IsMeshSDK checks whether sdkDir is the root of an nRF5 SDK for Mesh.
+func IsMeshSDK(sdkDir string) bool {
+  info, err := os.Stat(filepath.Join(sdkDir, meshCoreDir))
+  return err == nil && info.IsDir()
+}
+
+// withMeshPreset merges the built-in Mesh preset into rc, if sdkDir is an
+// nRF5 SDK for Mesh and presets aren't disabled.
+func withMeshPreset(conf *Config, sdkDir string, rc *bazelifyrc.Configuration) (*bazelifyrc.Configuration, error) {
+  if !*meshPreset || !IsMeshSDK(sdkDir) {
+    return rc, nil
+  }
+  conf.logf(VerbosityPhases, "Using built-in preset for nRF5 SDK for Mesh in %s", sdkDir)
+  return mergePreset(conf, meshPresetPath, rc)
+}
+
+// withNonGCCPreset merges the built-in preset that excludes non-GCC toolchain
+// files into rc, if rc sets exclude_non_gcc.
+func withNonGCCPreset(conf *Config, sdkDir string, rc *bazelifyrc.Configuration) (*bazelifyrc.Configuration, error) {
+  if !rc.GetExcludeNonGcc() {
+    return rc, nil
+  }
+  conf.logf(VerbosityPhases, "Excluding non-GCC toolchain files in %s", sdkDir)
+  return mergePreset(conf, nonGCCPresetPath, rc)
+}
+
+// withDriverModePreset merges the built-in preset for rc's driver_mode into
+// rc, if it sets one.
+func withDriverModePreset(conf *Config, sdkDir string, rc *bazelifyrc.Configuration) (*bazelifyrc.Configuration, error) {
+  mode := rc.GetDriverMode()
+  if mode == bazelifyrc.DriverMode_DRIVER_MODE_UNSPECIFIED {
+    return rc, nil
+  }
+  path := driverPresetPrefix + strings.ToLower(mode.String()) + rcFilename
+  merged, err := mergePreset(conf, path, rc)
+  if err != nil {
+    return nil, fmt.Errorf("driver_mode %s: %v", mode, err)
+  }
+  conf.logf(VerbosityPhases, "Using %s drivers in %s", strings.ToLower(mode.String()), sdkDir)
+  return merged, nil
+}
+
+// mergePreset merges rc into the built-in preset at path, so rc's fields
+// take precedence.
+func mergePreset(conf *Config, path string, rc *bazelifyrc.Configuration) (*bazelifyrc.Configuration, error) {
+  data, err := presetFS.ReadFile(path)
+  if err != nil {
+    return nil, fmt.Errorf("ReadFile(%q): %v", path, err)
+  }
+  var preset bazelifyrc.Configuration
+  if err := prototext.Unmarshal(data, &preset); err != nil {
+    return nil, fmt.Errorf("preset %s: %v", path, err)
+  }
+  conf.logf(VerbosityResolutions, "Merging .bazelifyrc into built-in preset %s", path)
+  return withPreset(&preset, rc), nil
+}
+
+// withPreset returns rc merged into a copy of preset. Repeated fields are
+// appended to the preset's, except that preferred_dirs are in order of
+// preference, so rc's come first.
+func withPreset(preset, rc *bazelifyrc.Configuration) *bazelifyrc.Configuration {
+  out := proto.Clone(preset).(*bazelifyrc.Configuration)
+  proto.Merge(out, rc)
+  out.PreferredDirs = append(append([]string(nil), rc.GetPreferredDirs()...), preset.GetPreferredDirs()...)
+  if out.DuplicateHeaders != nil {
+    out.DuplicateHeaders.PreferredDirs = append(append([]string(nil), rc.GetDuplicateHeaders().GetPreferredDirs()...), preset.GetDuplicateHeaders().GetPreferredDirs()...)
+  }
+  return out
+}
@@ -0,0 +1,170 @@
+package nrfbazelify
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+const (
+  // How a dependency was resolved, in provenance.json. Includes resolved
+  // from the graph use resolvedByOnlyCandidate and resolvedAutomatically.
+  provenanceSameDir = "same_dir"
+  provenanceIncludeDirs = "include_dirs"
+  provenanceIncludeOverride = "include_overrides"
+  provenanceRemap = "remaps"
+  provenanceSelectOverride = "select_overrides"
+  provenanceBuiltin = "builtin_override"
+  provenanceGroupMerge = "group_merge"
+  provenanceGenerated = "generated"
+
+  provenanceFilename = "provenance.json"
+)
+
+// depResolution is how an include of src was resolved to dst. The nodes are
+// kept instead of labels, because groups are renamed after resolving.
+type depResolution struct {
+  src, dst Node
+  include string
+  method string
+  includeDir string // relative to the workspace, for include_dirs
+  priority int32
+}
+
+// overrideProvenance returns the method of an include resolved to dst, an
+// override, by where the override is from.
+func overrideProvenance(conf *Config, include string, dst Node) string {
+  if conf.IncludeOverrides[include] != nil {
+    return provenanceIncludeOverride
+  }
+  if conf.SelectOverrides[include] != nil {
+    return provenanceSelectOverride
+  }
+  if _, ok := dst.(*RemapNode); ok {
+    return provenanceRemap
+  }
+  // Headers that nrfbazelify resolves to a library itself, like the CMSIS
+  // core headers.
+  return provenanceBuiltin
+}
+
+// DepProvenance is how a dependency in the generated BUILD files came to be.
+type DepProvenance struct {
+  From string `json:"from"`
+  To string `json:"to"`
+  Method string `json:"method"`
+  // The include that resolved to To, if the dependency is from an include.
+  Include string `json:"include,omitempty"`
+  // The library in From's group that has the include, if From is a group.
+  Via string `json:"via,omitempty"`
+  // For include_dirs, the include dir that the include was found in, relative
+  // to the workspace, and its priority.
+  IncludeDir string `json:"include_dir,omitempty"`
+  Priority *int32 `json:"priority,omitempty"`
+}
+
+// depProvenance returns the provenance of every dependency in the graph, an
+// entry for each include that resolved to it. Libraries in a group depend on
+// it by group_merge, and the group has their includes. Dependencies that no
+// include resolved to, like sdk_config's, are generated. Dependencies that
+// transitive_reduction leaves out of the BUILD files are left out too.
+func depProvenance(graph *DependencyGraph, resolutions []*depResolution) []*DepProvenance {
+  groupOf := make(map[int64]Node)
+  for _, node := range graph.Nodes() {
+    lib, ok := node.(*LibraryNode)
+    if !ok || !lib.IsPointer {
+      continue
+    }
+    for _, dep := range graph.Dependencies(lib.Label()) {
+      if _, ok := dep.(*GroupNode); ok {
+        groupOf[lib.ID()] = dep
+      }
+    }
+  }
+  byEdge := make(map[[2]int64][]*depResolution)
+  for _, r := range resolutions {
+    // Pruned and merged nodes are gone.
+    if graph.graph.Node(r.src.ID()) == nil || graph.graph.Node(r.dst.ID()) == nil {
+      continue
+    }
+    from := r.src.ID()
+    if group := groupOf[from]; group != nil {
+      from = group.ID()
+    }
+    edge := [2]int64{from, r.dst.ID()}
+    byEdge[edge] = append(byEdge[edge], r)
+  }
+  var out []*DepProvenance
+  for _, node := range graph.Nodes() {
+    var redundant map[int64]bool
+    if graph.conf.TransitiveReduction {
+      redundant = graph.redundantDependencies(node.Label())
+    }
+    for _, dep := range graph.Dependencies(node.Label()) {
+      if redundant[dep.ID()] {
+        continue
+      }
+      resolutions := byEdge[[2]int64{node.ID(), dep.ID()}]
+      if len(resolutions) == 0 {
+        method := provenanceGenerated
+        if groupOf[node.ID()] != nil && groupOf[node.ID()].ID() == dep.ID() {
+          method = provenanceGroupMerge
+        }
+        out = append(out, &DepProvenance{
+          From: node.Label().String(),
+          To: dep.Label().String(),
+          Method: method,
+        })
+        continue
+      }
+      for _, r := range resolutions {
+        p := &DepProvenance{
+          From: node.Label().String(),
+          To: dep.Label().String(),
+          Method: r.method,
+          Include: r.include,
+        }
+        if r.src.ID() != node.ID() {
+          p.Via = r.src.Label().String()
+        }
+        if r.includeDir != "" {
+          priority := r.priority
+          p.IncludeDir, p.Priority = r.includeDir, &priority
+        }
+        out = append(out, p)
+      }
+    }
+  }
+  sort.Slice(out, func(i, j int) bool {
+    if out[i].From != out[j].From {
+      return out[i].From < out[j].From
+    }
+    if out[i].To != out[j].To {
+      return out[i].To < out[j].To
+    }
+    if out[i].Include != out[j].Include {
+      return out[i].Include < out[j].Include
+    }
+    return out[i].Via < out[j].Via
+  })
+  return out
+}
+
+// writeProvenance writes the provenance of every dependency in the graph to
+// provenance.json in dir.
+func writeProvenance(graph *DependencyGraph, resolutions []*depResolution, dir string) error {
+  data, err := json.MarshalIndent(struct {
+    Deps []*DepProvenance `json:"deps"`
+  }{
+    Deps: depProvenance(graph, resolutions),
+  }, "", "  ")
+  if err != nil {
+    return fmt.Errorf("json.MarshalIndent: %v", err)
+  }
+  path := filepath.Join(dir, provenanceFilename)
+  if err := writeFileAtomic(path, append(data, '\n'), 0644); err != nil {
+    return fmt.Errorf("writeFileAtomic(%q): %v", path, err)
+  }
+  return nil
+}
@@ -0,0 +1,42 @@
+package nrfbazelify
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PruneUnreachable removes all libraries and groups that aren't transitively
+// reachable from roots, so no BUILD rules are generated for them.
+// Each root is a label or a file name, as accepted by Query.
+// Remap, override and select nodes are always kept. Returns the number of removed nodes.
+func (d *DependencyGraph) PruneUnreachable(roots []string) (int, error) {
+  if len(roots) == 0 {
+    return 0, errors.New("no roots in .bazelifyrc")
+  }
+  reachable := make(map[int64]bool)
+  for _, root := range roots {
+    node, err := d.queryTarget(root)
+    if err != nil {
+      return 0, fmt.Errorf("root %q: %v", root, err)
+    }
+    for _, n := range d.reachable(node, -1, d.Dependencies) {
+      reachable[n.ID()] = true
+    }
+  }
+  var pruned int
+  for _, node := range d.Nodes() {
+    if reachable[node.ID()] {
+      continue
+    }
+    switch node.(type) {
+    case *LibraryNode, *GroupNode:
+    default:
+      continue
+    }
+    if err := d.deleteNode(node.Label()); err != nil {
+      return pruned, fmt.Errorf("deleteNode(%q): %v", node.Label(), err)
+    }
+    pruned++
+  }
+  return pruned, nil
+}
@@ -0,0 +1,242 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+)
+
+const (
+  // allpaths stops after this many paths, because SDK graphs can have
+  // an enormous number of paths between two targets.
+  maxQueryPaths = 100
+)
+
+var (
+  // Matches query expressions like deps(//a:b), rdeps(b.h), deps(//a:b, 2)
+  // and somepath(//a:b, c.h).
+  queryMatcher = regexp.MustCompile(`^\s*(\w+)\(\s*([^,\s()]+)\s*(?:,\s*([^,\s()]+)\s*)?\)\s*$`)
+)
+
+// QueryResult holds the result of a query.
+// Depending on the query, it contains either a set of nodes or a set of paths.
+type QueryResult struct {
+  // Nodes matched by deps and rdeps queries, sorted by label.
+  Nodes []Node
+  // Paths matched by somepath and allpaths queries.
+  // Each path starts at the first target and ends at the second target.
+  Paths [][]Node
+  // Truncated is set if there were more paths than we were willing to find.
+  Truncated bool
+}
+
+// String formats the result for printing.
+// Nodes are printed one per line, and paths are printed as dependency chains.
+func (q *QueryResult) String() string {
+  var out strings.Builder
+  for _, node := range q.Nodes {
+    fmt.Fprintf(&out, "%s\n", node.Label())
+  }
+  for i, path := range q.Paths {
+    if i > 0 {
+      out.WriteString("\n")
+    }
+    for j, node := range path {
+      if j == 0 {
+        fmt.Fprintf(&out, "%s\n", node.Label())
+        continue
+      }
+      fmt.Fprintf(&out, "  -> %s\n", node.Label())
+    }
+  }
+  if q.Truncated {
+    fmt.Fprintf(&out, "\n(stopped after %d paths)\n", maxQueryPaths)
+  }
+  return out.String()
+}
+
+// Query evaluates a query expression against the graph.
+// Supported expressions are:
+//   deps(<target>[, <depth>]): target and everything it depends on.
+//   rdeps(<target>[, <depth>]): target and everything that depends on it.
+//   somepath(<from>, <to>): a shortest dependency chain from one target to another.
+//   allpaths(<from>, <to>): all dependency chains from one target to another.
+// A target is either a label like //components/libraries/fifo:app_fifo,
+// or the name of a file in the graph like app_fifo.h.
+// Without a depth, deps and rdeps follow dependencies transitively.
+func (d *DependencyGraph) Query(expr string) (*QueryResult, error) {
+  capture := queryMatcher.FindStringSubmatch(expr)
+  if capture == nil {
+    return nil, fmt.Errorf("invalid query %q, want deps(<target>[, <depth>]), rdeps(<target>[, <depth>]), somepath(<from>, <to>) or allpaths(<from>, <to>)", expr)
+  }
+  function, arg := capture[1], capture[3]
+  start, err := d.queryTarget(capture[2])
+  if err != nil {
+    return nil, err
+  }
+  switch function {
+  case "deps", "rdeps":
+    depth := -1
+    if arg != "" {
+      if depth, err = strconv.Atoi(arg); err != nil {
+        return nil, fmt.Errorf("invalid depth %q: %v", arg, err)
+      }
+    }
+    next := d.Dependencies
+    if function == "rdeps" {
+      next = d.Dependents
+    }
+    return &QueryResult{Nodes: d.reachable(start, depth, next)}, nil
+  case "somepath", "allpaths":
+    if arg == "" {
+      return nil, fmt.Errorf("%s requires two targets", function)
+    }
+    end, err := d.queryTarget(arg)
+    if err != nil {
+      return nil, err
+    }
+    if function == "somepath" {
+      path := d.shortestPath(start, end)
+      if path == nil {
+        return &QueryResult{}, nil
+      }
+      return &QueryResult{Paths: [][]Node{path}}, nil
+    }
+    paths, truncated := d.allPaths(start, end)
+    return &QueryResult{Paths: paths, Truncated: truncated}, nil
+  default:
+    return nil, fmt.Errorf("unknown query function %q", function)
+  }
+}
+
+// queryTarget finds the node for a target in a query expression.
+func (d *DependencyGraph) queryTarget(target string) (Node, error) {
+  if strings.HasPrefix(target, "@") || strings.Contains(target, "//") {
+    label, err := bazel.ParseLabel(target)
+    if err != nil {
+      return nil, err
+    }
+    node := d.Node(label)
+    if node == nil {
+      return nil, fmt.Errorf("%q not in graph", target)
+    }
+    return node, nil
+  }
+  nodes := d.NodesWithFile(target)
+  switch len(nodes) {
+  case 0:
+    return nil, fmt.Errorf("no target contains %q", target)
+  case 1:
+    return nodes[0], nil
+  default:
+    var labels []*bazel.Label
+    for _, n := range nodes {
+      labels = append(labels, n.Label())
+    }
+    return nil, fmt.Errorf("%q is in multiple targets: %s", target, bazel.JoinLabelStrings(labels, ", "))
+  }
+}
+
+// reachable does a breadth first search from start, following next.
+// A negative maxDepth searches the whole graph.
+func (d *DependencyGraph) reachable(start Node, maxDepth int, next func(*bazel.Label) []Node) []Node {
+  seen := map[int64]bool{start.ID(): true}
+  out := []Node{start}
+  frontier := []Node{start}
+  for depth := 0; len(frontier) > 0 && (maxDepth < 0 || depth < maxDepth); depth++ {
+    var nextFrontier []Node
+    for _, node := range frontier {
+      for _, n := range next(node.Label()) {
+        if seen[n.ID()] {
+          continue
+        }
+        seen[n.ID()] = true
+        out = append(out, n)
+        nextFrontier = append(nextFrontier, n)
+      }
+    }
+    frontier = nextFrontier
+  }
+  sortNodes(out)
+  return out
+}
+
+// shortestPath finds a shortest dependency chain from start to end.
+// Returns nil if end isn't a dependency of start.
+func (d *DependencyGraph) shortestPath(start, end Node) []Node {
+  parents := map[int64]Node{start.ID(): nil}
+  frontier := []Node{start}
+  for len(frontier) > 0 && parents[end.ID()] == nil && start.ID() != end.ID() {
+    var nextFrontier []Node
+    for _, node := range frontier {
+      deps := d.Dependencies(node.Label())
+      // Sort so the chosen path is deterministic.
+      sortNodes(deps)
+      for _, dep := range deps {
+        if _, seen := parents[dep.ID()]; seen {
+          continue
+        }
+        parents[dep.ID()] = node
+        nextFrontier = append(nextFrontier, dep)
+      }
+    }
+    frontier = nextFrontier
+  }
+  if _, found := parents[end.ID()]; !found {
+    return nil
+  }
+  var path []Node
+  for node := end; node != nil; node = parents[node.ID()] {
+    path = append([]Node{node}, path...)
+  }
+  return path
+}
+
+// allPaths finds every dependency chain from start to end, up to maxQueryPaths.
+// The graph is acyclic because cycles are merged into groups.
+func (d *DependencyGraph) allPaths(start, end Node) ([][]Node, bool) {
+  // Only nodes that can reach end can be part of a path.
+  canReach := make(map[int64]bool)
+  for _, n := range d.reachable(end, -1, d.Dependents) {
+    canReach[n.ID()] = true
+  }
+  var paths [][]Node
+  truncated := false
+  var visit func(path []Node)
+  visit = func(path []Node) {
+    if truncated {
+      return
+    }
+    last := path[len(path)-1]
+    if last.ID() == end.ID() {
+      if len(paths) == maxQueryPaths {
+        truncated = true
+        return
+      }
+      paths = append(paths, append([]Node(nil), path...))
+      return
+    }
+    deps := d.Dependencies(last.Label())
+    sortNodes(deps)
+    for _, dep := range deps {
+      if canReach[dep.ID()] {
+        visit(append(path, dep))
+      }
+    }
+  }
+  if canReach[start.ID()] {
+    visit([]Node{start})
+  }
+  return paths, truncated
+}
+
+// sortNodes sorts nodes by their label.
+func sortNodes(nodes []Node) {
+  sort.Slice(nodes, func(i, j int) bool {
+    return nodes[i].Label().Less(nodes[j].Label())
+  })
+}
@@ -0,0 +1,135 @@
+package nrfbazelify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDependencyGraph_Query(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "nominal")
+  graph, err := LoadGraph(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("LoadGraph(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  tests := map[string]struct{
+    expr string
+    want []string
+    wantErr bool
+  }{
+    "deps of label": {
+      expr: "deps(//nominal:a)",
+      want: []string{"//nominal/dir:c", "//nominal:a", "//nominal:b"},
+    },
+    "deps with depth": {
+      expr: "deps(//nominal:a, 1)",
+      want: []string{"//nominal:a", "//nominal:b"},
+    },
+    "rdeps of header": {
+      expr: "rdeps(c.h)",
+      want: []string{"//nominal/dir:c", "//nominal:a", "//nominal:b"},
+    },
+    "rdeps of source file": {
+      expr: " rdeps( b.c ) ",
+      want: []string{"//nominal:a", "//nominal:b"},
+    },
+    "unknown function": {
+      expr: "somepath(//nominal:a)",
+      wantErr: true,
+    },
+    "unknown target": {
+      expr: "deps(//nominal:doesnotexist)",
+      wantErr: true,
+    },
+    "malformed": {
+      expr: "deps //nominal:a",
+      wantErr: true,
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      result, err := graph.Query(test.expr)
+      if test.wantErr {
+        if err == nil {
+          t.Errorf("Query(%q): got nil error, want an error", test.expr)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatalf("Query(%q): %v", test.expr, err)
+      }
+      var got []string
+      for _, n := range result.Nodes {
+        got = append(got, n.Label().String())
+      }
+      if diff := cmp.Diff(test.want, got); diff != "" {
+        t.Errorf("Query(%q) (-want +got):\n%s", test.expr, diff)
+      }
+    })
+  }
+}
+
+func TestDependencyGraph_QueryExternalLabel(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "external_include_overrides")
+  graph, err := LoadGraph(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("LoadGraph(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  expr := "rdeps(@cmsis//CMSIS/Core:core)"
+  result, err := graph.Query(expr)
+  if err != nil {
+    t.Fatalf("Query(%q): %v", expr, err)
+  }
+  var got []string
+  for _, n := range result.Nodes {
+    got = append(got, n.Label().String())
+  }
+  want := []string{"//external_include_overrides:a", "@cmsis//CMSIS/Core:core"}
+  if diff := cmp.Diff(want, got); diff != "" {
+    t.Errorf("Query(%q) (-want +got):\n%s", expr, diff)
+  }
+}
+
+func TestDependencyGraph_QueryPaths(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "cycles_nominal")
+  graph, err := LoadGraph(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("LoadGraph(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  tests := map[string]struct{
+    expr string
+    want string
+  }{
+    "somepath": {
+      expr: "somepath(uses_cyclic.h, used_by_cyclic.h)",
+      want: `//cycles_nominal/dir:uses_cyclic
+  -> //cycles_nominal/dir:c
+  -> //cycles_nominal:abcd
+  -> //cycles_nominal/dir2:used_by_cyclic
+`,
+    },
+    "allpaths": {
+      expr: "allpaths(//cycles_nominal:a, //cycles_nominal/dir2:used_by_cyclic)",
+      want: `//cycles_nominal:a
+  -> //cycles_nominal:abcd
+  -> //cycles_nominal/dir2:used_by_cyclic
+`,
+    },
+    "no path": {
+      expr: "somepath(used_by_cyclic.h, uses_cyclic.h)",
+      want: "",
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      result, err := graph.Query(test.expr)
+      if err != nil {
+        t.Fatalf("Query(%q): %v", test.expr, err)
+      }
+      if diff := cmp.Diff(test.want, result.String()); diff != "" {
+        t.Errorf("Query(%q) (-want +got):\n%s", test.expr, diff)
+      }
+    })
+  }
+}
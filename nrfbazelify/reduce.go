@@ -0,0 +1,39 @@
+package nrfbazelify
+
+import (
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+)
+
+// redundantDependencies returns the IDs of the dependencies of the node with
+// label that another of its dependencies already depends on, directly or
+// transitively. Only libraries and groups are followed, since their deps are
+// always in the dependents' deps.
+func (d *DependencyGraph) redundantDependencies(label *bazel.Label) map[int64]bool {
+  direct := d.Dependencies(label)
+  reached := make(map[int64]bool)
+  var visit func(node Node)
+  visit = func(node Node) {
+    switch node.(type) {
+    case *LibraryNode, *GroupNode:
+    default:
+      return
+    }
+    for _, dep := range d.Dependencies(node.Label()) {
+      if reached[dep.ID()] {
+        continue
+      }
+      reached[dep.ID()] = true
+      visit(dep)
+    }
+  }
+  for _, dep := range direct {
+    visit(dep)
+  }
+  out := make(map[int64]bool)
+  for _, dep := range direct {
+    if reached[dep.ID()] {
+      out[dep.ID()] = true
+    }
+  }
+  return out
+}
@@ -0,0 +1,269 @@
+package nrfbazelify
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+	"github.com/google/uuid"
+)
+
+const (
+  // The SBOM is written to this file in .bazelify-out.
+  sbomFilename = "sbom.spdx.json"
+  // SPDX's value for unknown fields.
+  spdxNoAssertion = "NOASSERTION"
+  // Every SBOM gets a unique namespace under this URL.
+  sbomNamespacePrefix = "https://github.com/Michaelhobo/nrfbazel/sbom/"
+)
+
+var (
+  // Characters that aren't allowed in SPDX identifiers.
+  spdxIDInvalid = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+)
+
+// spdxDocument is an SPDX 2.3 document, in its JSON format. See
+// https://spdx.github.io/spdx-spec/v2.3/.
+type spdxDocument struct {
+  SPDXVersion string `json:"spdxVersion"`
+  DataLicense string `json:"dataLicense"`
+  SPDXID string `json:"SPDXID"`
+  Name string `json:"name"`
+  DocumentNamespace string `json:"documentNamespace"`
+  CreationInfo spdxCreationInfo `json:"creationInfo"`
+  Packages []*spdxPackage `json:"packages"`
+  Relationships []*spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+  Created string `json:"created"`
+  Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+  SPDXID string `json:"SPDXID"`
+  Name string `json:"name"`
+  VersionInfo string `json:"versionInfo,omitempty"`
+  PackageFileName string `json:"packageFileName,omitempty"`
+  DownloadLocation string `json:"downloadLocation"`
+  FilesAnalyzed bool `json:"filesAnalyzed"`
+  LicenseConcluded string `json:"licenseConcluded"`
+  LicenseDeclared string `json:"licenseDeclared"`
+  CopyrightText string `json:"copyrightText"`
+}
+
+type spdxRelationship struct {
+  SPDXElementID string `json:"spdxElementId"`
+  RelationshipType string `json:"relationshipType"`
+  RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+func newSPDXPackage(id, name, version, license string) *spdxPackage {
+  if version == "" {
+    version = spdxNoAssertion
+  }
+  return &spdxPackage{
+    SPDXID: id,
+    Name: name,
+    VersionInfo: version,
+    DownloadLocation: spdxNoAssertion,
+    LicenseConcluded: spdxNoAssertion,
+    LicenseDeclared: license,
+    CopyrightText: spdxNoAssertion,
+  }
+}
+
+// spdxIDs makes unique SPDX identifiers. Names that only differ in characters
+// that aren't allowed, like "a_b" and "a-b", get a counter suffix.
+type spdxIDs map[string]bool
+
+// id makes an SPDX identifier from the kind and name, like
+// SPDXRef-Package-nrf-sdk-components-libraries-fifo.
+func (ids spdxIDs) id(kind, name string) string {
+  name = strings.Trim(spdxIDInvalid.ReplaceAllString(name, "-"), "-")
+  if name == "" {
+    name = "root"
+  }
+  base := fmt.Sprintf("SPDXRef-%s-%s", kind, name)
+  id := base
+  for n := 2; ids[id]; n++ {
+    id = fmt.Sprintf("%s-%d", base, n)
+  }
+  ids[id] = true
+  return id
+}
+
+// spdxLicense returns the SPDX expression of the license kinds, or
+// NOASSERTION if any of them isn't an SPDX license in rules_license.
+func spdxLicense(kinds []string) string {
+  if len(kinds) == 0 {
+    return spdxNoAssertion
+  }
+  var ids []string
+  for _, kind := range kinds {
+    if !strings.HasPrefix(kind, spdxLicenseKindPrefix) {
+      return spdxNoAssertion
+    }
+    ids = append(ids, strings.TrimPrefix(kind, spdxLicenseKindPrefix))
+  }
+  return strings.Join(ids, " AND ")
+}
+
+// sdkName is the name of the SDK in sdkDir in the SBOM.
+func sdkName(conf *Config, sdkDir string) string {
+  switch {
+  case conf.Layout == bazelifyrc.Layout_NCS:
+    return "nRF Connect SDK"
+  case IsMeshSDK(sdkDir):
+    return "nRF5 SDK for Mesh"
+  default:
+    return "nRF5 SDK"
+  }
+}
+
+// generateSBOM describes the generated packages as an SPDX document. Every
+// SDK root is a package that contains its generated packages, through the
+// third-party component they're in, if any. Generated packages get the
+// version and license of their component, or the SDK's version.
+func generateSBOM(conf *Config, files map[string]*buildfile.File, created time.Time) (*spdxDocument, error) {
+  doc := &spdxDocument{
+    SPDXVersion: "SPDX-2.3",
+    DataLicense: "CC0-1.0",
+    SPDXID: "SPDXRef-DOCUMENT",
+    DocumentNamespace: sbomNamespacePrefix + uuid.NewString(),
+    CreationInfo: spdxCreationInfo{
+      Created: created.UTC().Format(time.RFC3339),
+      Creators: []string{"Tool: nrfbazelify-" + version()},
+    },
+  }
+  ids := make(spdxIDs)
+  sdkFromWorkspace, err := filepath.Rel(conf.WorkspaceDir, conf.SDKDir)
+  if err != nil {
+    return nil, fmt.Errorf("filepath.Rel: %v", err)
+  }
+  doc.Name = "nrfbazelify-" + filepath.ToSlash(sdkFromWorkspace)
+
+  // The SDK roots and third-party components that contain generated
+  // packages, by dir relative to the workspace.
+  type owner struct {
+    dir, id, version, license string
+  }
+  var owners []*owner
+  for _, sdkDir := range conf.SDKDirs {
+    rel, err := filepath.Rel(conf.WorkspaceDir, sdkDir)
+    if err != nil {
+      return nil, fmt.Errorf("filepath.Rel: %v", err)
+    }
+    version, err := DetectSDKVersion(sdkDir)
+    if err != nil {
+      return nil, fmt.Errorf("DetectSDKVersion(%q): %v", sdkDir, err)
+    }
+    pkg := newSPDXPackage(ids.id("SDK", rel), sdkName(conf, sdkDir), version, spdxNoAssertion)
+    pkg.PackageFileName = filepath.ToSlash(rel)
+    doc.Packages = append(doc.Packages, pkg)
+    doc.Relationships = append(doc.Relationships, &spdxRelationship{
+      SPDXElementID: doc.SPDXID,
+      RelationshipType: "DESCRIBES",
+      RelatedSPDXElement: pkg.SPDXID,
+    })
+    owners = append(owners, &owner{dir: rel, id: pkg.SPDXID, version: version, license: spdxNoAssertion})
+  }
+  components, err := findThirdParty(conf)
+  if err != nil {
+    return nil, err
+  }
+  for _, c := range components {
+    rel, err := filepath.Rel(conf.WorkspaceDir, c.Dir)
+    if err != nil {
+      return nil, fmt.Errorf("filepath.Rel: %v", err)
+    }
+    if !hasPackageIn(files, rel) {
+      continue
+    }
+    license := spdxLicense(c.LicenseKinds)
+    pkg := newSPDXPackage(ids.id("Component", rel), c.PackageName, c.PackageVersion, license)
+    pkg.PackageFileName = filepath.ToSlash(rel)
+    owners = append(owners, &owner{dir: rel, id: pkg.SPDXID, version: c.PackageVersion, license: license})
+    doc.Packages = append(doc.Packages, pkg)
+  }
+  // The longest dir that contains a package owns it.
+  sort.SliceStable(owners, func(i, j int) bool {
+    return len(owners[i].dir) > len(owners[j].dir)
+  })
+  ownerOf := func(dir string) *owner {
+    for _, o := range owners {
+      if o.dir == "." || dir == o.dir || strings.HasPrefix(dir, o.dir+string(filepath.Separator)) {
+        return o
+      }
+    }
+    return nil
+  }
+  for _, o := range owners {
+    if parent := ownerOf(filepath.Dir(o.dir)); parent != nil && !strings.HasPrefix(o.id, "SPDXRef-SDK-") {
+      doc.Relationships = append(doc.Relationships, &spdxRelationship{
+        SPDXElementID: parent.id,
+        RelationshipType: "CONTAINS",
+        RelatedSPDXElement: o.id,
+      })
+    }
+  }
+
+  var dirs []string
+  for dir := range files {
+    dirs = append(dirs, dir)
+  }
+  sort.Strings(dirs)
+  for _, dir := range dirs {
+    o := ownerOf(dir)
+    if o == nil {
+      continue
+    }
+    name := "//" + filepath.ToSlash(dir)
+    if dir == "." {
+      name = "//"
+    }
+    pkg := newSPDXPackage(ids.id("Package", dir), name, o.version, o.license)
+    pkg.PackageFileName = filepath.ToSlash(dir)
+    doc.Packages = append(doc.Packages, pkg)
+    doc.Relationships = append(doc.Relationships, &spdxRelationship{
+      SPDXElementID: o.id,
+      RelationshipType: "CONTAINS",
+      RelatedSPDXElement: pkg.SPDXID,
+    })
+  }
+  return doc, nil
+}
+
+// hasPackageIn checks whether any of the files is in dir, relative to the
+// workspace.
+func hasPackageIn(files map[string]*buildfile.File, dir string) bool {
+  for fileDir := range files {
+    if fileDir == dir || strings.HasPrefix(fileDir, dir+string(filepath.Separator)) {
+      return true
+    }
+  }
+  return false
+}
+
+// writeSBOM writes the SBOM of the generated packages to dir.
+func writeSBOM(conf *Config, files map[string]*buildfile.File, dir string) error {
+  doc, err := generateSBOM(conf, files, time.Now())
+  if err != nil {
+    return err
+  }
+  data, err := json.MarshalIndent(doc, "", "  ")
+  if err != nil {
+    return fmt.Errorf("json.MarshalIndent: %v", err)
+  }
+  path := filepath.Join(dir, sbomFilename)
+  if err := writeFileAtomic(path, append(data, '\n'), 0644); err != nil {
+    return fmt.Errorf("writeFileAtomic(%q): %v", path, err)
+  }
+  return nil
+}
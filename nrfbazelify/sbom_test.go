@@ -0,0 +1,25 @@
+package nrfbazelify
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSPDXIDs(t *testing.T) {
+  ids := make(spdxIDs)
+  var got []string
+  for _, name := range []string{"a_b", "a-b", "a/b", "a-b-2", ""} {
+    got = append(got, ids.id("Package", name))
+  }
+  want := []string{
+    "SPDXRef-Package-a-b",
+    "SPDXRef-Package-a-b-2",
+    "SPDXRef-Package-a-b-3",
+    "SPDXRef-Package-a-b-2-2",
+    "SPDXRef-Package-root",
+  }
+  if diff := cmp.Diff(want, got); diff != "" {
+    t.Errorf("ids (-want +got):\n%s", diff)
+  }
+}
@@ -0,0 +1,83 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gonum.org/v1/gonum/graph/encoding/dot"
+	"gonum.org/v1/gonum/graph/simple"
+)
+
+// ScopeRoots finds the nodes a scope refers to.
+// A scope is either a target as accepted by Query, like //a:b or b.h,
+// or a directory, either absolute or relative to the workspace.
+// A directory scope refers to all nodes in that directory and below.
+// Only .h and .c files are targets, so dirs like nrf5_sdk_17.1 are dirs.
+func (d *DependencyGraph) ScopeRoots(scope string) ([]Node, error) {
+  if ext := filepath.Ext(scope); strings.HasPrefix(scope, "//") || ext == ".h" || ext == ".c" {
+    node, err := d.queryTarget(scope)
+    if err != nil {
+      return nil, err
+    }
+    return []Node{node}, nil
+  }
+  dir := scope
+  if filepath.IsAbs(dir) {
+    rel, err := filepath.Rel(d.conf.WorkspaceDir, dir)
+    if err != nil {
+      return nil, fmt.Errorf("filepath.Rel(%q, %q): %v", d.conf.WorkspaceDir, dir, err)
+    }
+    dir = rel
+  }
+  dir = filepath.Clean(dir)
+  if dir == ".." || strings.HasPrefix(dir, "../") {
+    return nil, fmt.Errorf("scope %q is not inside the workspace", scope)
+  }
+  var out []Node
+  for _, node := range d.Nodes() {
+    nodeDir := node.Label().Dir()
+    if dir == "." || nodeDir == dir || strings.HasPrefix(nodeDir, dir+"/") {
+      out = append(out, node)
+    }
+  }
+  if len(out) == 0 {
+    return nil, fmt.Errorf("no targets in %q", scope)
+  }
+  sortNodes(out)
+  return out, nil
+}
+
+// OutputScopedDOTGraph outputs the subgraph rooted at scope as a DOT graph.
+// The subgraph contains the scope's roots and their dependencies, up to depth
+// edges away. A negative depth includes all transitive dependencies.
+func (d *DependencyGraph) OutputScopedDOTGraph(path, scope string, depth int) error {
+  roots, err := d.ScopeRoots(scope)
+  if err != nil {
+    return fmt.Errorf("ScopeRoots(%q): %v", scope, err)
+  }
+  sub := simple.NewDirectedGraph()
+  for _, root := range roots {
+    for _, node := range d.reachable(root, depth, d.Dependencies) {
+      if sub.Node(node.ID()) == nil {
+        sub.AddNode(node)
+      }
+    }
+  }
+  for _, n := range graphNodes(sub.Nodes()) {
+    node := n.(Node)
+    for _, dep := range d.Dependencies(node.Label()) {
+      if sub.Node(dep.ID()) != nil {
+        sub.SetEdge(sub.NewEdge(node, dep))
+      }
+    }
+  }
+  out, err := dot.Marshal(sub, "Dependencies", "", "")
+  if err != nil {
+    return fmt.Errorf("dot.Marshal: %v", err)
+  }
+  if err := writeFileAtomic(path, out, 0640); err != nil {
+    return fmt.Errorf("writeFileAtomic(%q): %v", path, err)
+  }
+  return nil
+}
@@ -0,0 +1,115 @@
+package nrfbazelify
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDependencyGraph_ScopeRoots(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "nominal")
+  graph, err := LoadGraph(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("LoadGraph(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  tests := map[string]struct{
+    scope string
+    want []string
+    wantErr bool
+  }{
+    "label": {
+      scope: "//nominal:a",
+      want: []string{"//nominal:a"},
+    },
+    "file": {
+      scope: "c.h",
+      want: []string{"//nominal/dir:c"},
+    },
+    "relative dir": {
+      scope: "nominal/dir",
+      want: []string{"//nominal/dir:c"},
+    },
+    "absolute dir includes subdirs": {
+      scope: sdkDir,
+      want: []string{"//nominal/dir:c", "//nominal:a", "//nominal:b"},
+    },
+    "empty dir": {
+      scope: "nominal/missing",
+      wantErr: true,
+    },
+    "outside workspace": {
+      scope: "../nominal",
+      wantErr: true,
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      nodes, err := graph.ScopeRoots(test.scope)
+      if test.wantErr {
+        if err == nil {
+          t.Fatalf("ScopeRoots(%q): got nil error, want error", test.scope)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatalf("ScopeRoots(%q): %v", test.scope, err)
+      }
+      var got []string
+      for _, node := range nodes {
+        got = append(got, node.Label().String())
+      }
+      if diff := cmp.Diff(test.want, got); diff != "" {
+        t.Errorf("ScopeRoots(%q) (-want +got):\n%s", test.scope, diff)
+      }
+    })
+  }
+}
+
+func TestDependencyGraph_ScopeRoots_DottedDir(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "dotted_dir")
+  graph, err := LoadGraph(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("LoadGraph(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  // v1.2 has an extension, but is a dir.
+  nodes, err := graph.ScopeRoots("dotted_dir/v1.2")
+  if err != nil {
+    t.Fatalf("ScopeRoots(%q): %v", "dotted_dir/v1.2", err)
+  }
+  var got []string
+  for _, node := range nodes {
+    got = append(got, node.Label().String())
+  }
+  if diff := cmp.Diff([]string{"//dotted_dir/v1.2:a"}, got); diff != "" {
+    t.Errorf("ScopeRoots(%q) (-want +got):\n%s", "dotted_dir/v1.2", diff)
+  }
+}
+
+func TestDependencyGraph_OutputScopedDOTGraph(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "nominal")
+  graph, err := LoadGraph(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("LoadGraph(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  path := filepath.Join(t.TempDir(), "scoped.dot")
+  if err := graph.OutputScopedDOTGraph(path, "//nominal:a", 1); err != nil {
+    t.Fatalf("OutputScopedDOTGraph: %v", err)
+  }
+  data, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatalf("ReadFile(%q): %v", path, err)
+  }
+  got := string(data)
+  for _, want := range []string{`"//nominal:a" -> "//nominal:b"`} {
+    if !strings.Contains(got, want) {
+      t.Errorf("scoped graph missing %s:\n%s", want, got)
+    }
+  }
+  if strings.Contains(got, "//nominal/dir:c") {
+    t.Errorf("scoped graph with depth 1 contains //nominal/dir:c:\n%s", got)
+  }
+}
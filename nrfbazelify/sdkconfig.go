@@ -0,0 +1,196 @@
+package nrfbazelify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/template"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+)
+
+const (
+  sdkConfigHeader = "sdk_config.h"
+  // The label_flag that includes of sdk_config.h resolve to, in the SDK root.
+  sdkConfigFlagName = "sdk_config_flag"
+  // The label_flag's default if there is no default_label, in the SDK root.
+  emptySDKConfigName = "empty_sdk_config"
+
+  // sdk_config.h includes app_config.h if USE_APP_CONFIG is defined.
+  appConfigHeader = "app_config.h"
+  appConfigDefine = "USE_APP_CONFIG"
+  // The label_flag that includes of app_config.h resolve to, in the SDK root.
+  appConfigFlagName = "app_config_flag"
+  // The app_config_flag's default, in the SDK root.
+  emptyAppConfigName = "empty_app_config"
+  // Holds the nrf_app_config macro, in the SDK root.
+  appConfigBzlFilename = "app_config.bzl"
+)
+
+var appConfigBzlTemplate = template.Must(template.New("appConfigBzl").Parse(`"""Layers an application's app_config.h on top of sdk_config.h."""
+
+load("@rules_cc//cc:defs.bzl", "cc_library")
+
+def nrf_app_config(name, hdrs = ["{{ .Header }}"], **kwargs):
+    """A library with app_config.h, which defines {{ .Define }} for everything that uses sdk_config.h.
+
+    Set {{ .Flag }} to it.
+
+    Args:
+      name: string name of the library.
+      hdrs: the app_config.h header, in this package.
+      **kwargs: args passed to the underlying cc_library rule
+    """
+    cc_library(
+        name = name,
+        hdrs = hdrs,
+        defines = ["{{ .Define }}"],
+        includes = ["."],
+        **kwargs
+    )
+
+def nrf_sdk_config(name, hdrs = ["sdk_config.h"], deps = [], **kwargs):
+    """A library with the application's sdk_config.h, which sees app_config.h.
+
+    Set {{ .SDKFlag }} to it, so everything that includes sdk_config.h depends on {{ .Flag }}.
+
+    Args:
+      name: string name of the library.
+      hdrs: the sdk_config.h header, in this package.
+      deps: additional dependencies of the library.
+      **kwargs: args passed to the underlying cc_library rule
+    """
+    cc_library(
+        name = name,
+        hdrs = hdrs,
+        deps = deps + ["{{ .Flag }}"],
+        includes = ["."],
+        **kwargs
+    )
+`))
+
+// isConfigured returns whether the include is configured in remaps,
+// include_overrides or select_overrides.
+func (conf *Config) isConfigured(include string) bool {
+  if conf.Remaps != nil && conf.Remaps.LabelSettings()[include] != nil {
+    return true
+  }
+  return conf.IncludeOverrides[include] != nil || conf.SelectOverrides[include] != nil
+}
+
+// wantsSDKConfigFlag returns whether includes of sdk_config.h should resolve to
+// the sdk_config label_flag. found is whether the walk found an sdk_config.h.
+func (conf *Config) wantsSDKConfigFlag(found bool) bool {
+  if !found || conf.Layout != bazelifyrc.Layout_NRF5_SDK || conf.SDKConfig.Disabled {
+    return false
+  }
+  // Configuring sdk_config.h explicitly takes precedence.
+  return !conf.isConfigured(sdkConfigHeader)
+}
+
+// wantsAppConfigFlag returns whether includes of app_config.h should resolve
+// to the app_config label_flag. found is whether the walk found an sdk_config.h.
+func (conf *Config) wantsAppConfigFlag(found bool) bool {
+  if !found || conf.Layout != bazelifyrc.Layout_NRF5_SDK || conf.SDKConfig.DisableAppConfig {
+    return false
+  }
+  return !conf.isConfigured(appConfigHeader)
+}
+
+// addSDKConfigNodes adds the sdk_config and app_config label_flags in the SDK
+// root, so the application provides sdk_config.h and app_config.h instead of
+// a copy in the SDK.
+func (s *SDKWalker) addSDKConfigNodes() error {
+  if s.conf.wantsSDKConfigFlag(s.sdkConfigFound) {
+    if err := s.addConfigFlag(sdkConfigHeader, sdkConfigFlagName, emptySDKConfigName, s.conf.SDKConfig.Default); err != nil {
+      return err
+    }
+  }
+  if s.conf.wantsAppConfigFlag(s.sdkConfigFound) {
+    if err := s.addConfigFlag(appConfigHeader, appConfigFlagName, emptyAppConfigName, nil); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// addConfigFlag adds a label_flag in the SDK root that includes of header
+// resolve to. If defaultLabel is nil, it points to an empty library named emptyName.
+func (s *SDKWalker) addConfigFlag(header, flagName, emptyName string, defaultLabel *bazel.Label) error {
+  if defaultLabel == nil {
+    label, err := bazel.NewLabel(s.conf.SDKDir, emptyName, s.conf.WorkspaceDir)
+    if err != nil {
+      return fmt.Errorf("bazel.NewLabel(%q): %v", emptyName, err)
+    }
+    if err := s.graph.AddLibraryNode(label, nil, nil, nil); err != nil {
+      return fmt.Errorf("AddLibraryNode(%q): %v", label, err)
+    }
+    defaultLabel = label
+  }
+  flagLabel, err := bazel.NewLabel(s.conf.SDKDir, flagName, s.conf.WorkspaceDir)
+  if err != nil {
+    return fmt.Errorf("bazel.NewLabel(%q): %v", flagName, err)
+  }
+  flag := &buildfile.LabelSetting{
+    Name: flagName,
+    BuildSettingDefault: defaultLabel.String(),
+    Flag: true,
+  }
+  if err := s.graph.AddRemapNode(flagLabel, header, flag); err != nil {
+    return fmt.Errorf("AddRemapNode(%q): %v", flagLabel, err)
+  }
+  return nil
+}
+
+// addAppConfigDep makes the library that sdk_config_flag points to by default
+// depend on app_config_flag, so everything that includes sdk_config.h sees
+// app_config.h and its USE_APP_CONFIG define.
+func (s *SDKWalker) addAppConfigDep(ctx context.Context) error {
+  if !s.conf.wantsSDKConfigFlag(s.sdkConfigFound) || !s.conf.wantsAppConfigFlag(s.sdkConfigFound) {
+    return nil
+  }
+  sdkConfig := s.conf.SDKConfig.Default
+  if sdkConfig == nil {
+    label, err := bazel.NewLabel(s.conf.SDKDir, emptySDKConfigName, s.conf.WorkspaceDir)
+    if err != nil {
+      return fmt.Errorf("bazel.NewLabel(%q): %v", emptySDKConfigName, err)
+    }
+    sdkConfig = label
+  }
+  if s.graph.Node(sdkConfig) == nil {
+    // The default isn't generated, so its deps are up to its BUILD file.
+    return nil
+  }
+  flagLabel, err := bazel.NewLabel(s.conf.SDKDir, appConfigFlagName, s.conf.WorkspaceDir)
+  if err != nil {
+    return fmt.Errorf("bazel.NewLabel(%q): %v", appConfigFlagName, err)
+  }
+  if err := s.graph.AddDependency(ctx, sdkConfig, flagLabel); err != nil {
+    return fmt.Errorf("AddDependency(%q, %q): %v", sdkConfig, flagLabel, err)
+  }
+  return nil
+}
+
+// appConfigBzl generates the macros for the libraries that app_config_flag and
+// sdk_config_flag are set to.
+func appConfigBzl(flagLabel *bazel.Label) (*bzlFile, error) {
+  sdkFlagLabel, err := bazel.ParseRelativeLabel(flagLabel, ":"+sdkConfigFlagName)
+  if err != nil {
+    return nil, fmt.Errorf("bazel.ParseRelativeLabel(%q): %v", sdkConfigFlagName, err)
+  }
+  var out bytes.Buffer
+  if err := appConfigBzlTemplate.Execute(&out, struct{ Header, Define, Flag, SDKFlag string }{
+    Header: appConfigHeader,
+    Define: appConfigDefine,
+    Flag: flagLabel.String(),
+    SDKFlag: sdkFlagLabel.String(),
+  }); err != nil {
+    return nil, fmt.Errorf("appConfigBzlTemplate.Execute: %v", err)
+  }
+  return &bzlFile{
+    name: appConfigBzlFilename,
+    contents: out.Bytes(),
+  }, nil
+}
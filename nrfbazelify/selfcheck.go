@@ -0,0 +1,238 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// SelfCheck reads the BUILD files that OutputBuildFiles wrote, and checks
+// that they have the graph: a rule for every library, group, remap and
+// filegroup, with the files and deps of its node, and exports of the files it
+// has from other packages. It catches output bugs, like a group generated
+// under its old name, before Bazel does. Deps that the output adds on
+// purpose, like the chip library, aren't nodes, so they aren't checked, and
+// neither are deps that nrf_cc_library or transitive_reduction leave out.
+func SelfCheck(conf *Config, depGraph *DependencyGraph) error {
+  c := &selfChecker{
+    conf: conf,
+    graph: depGraph,
+    files: make(map[string]*buildfile.File),
+  }
+  if conf.NrfCcLibrary.Enabled {
+    flagLabel, err := bazel.NewLabel(conf.SDKDir, sdkConfigFlagName, conf.WorkspaceDir)
+    if err != nil {
+      return fmt.Errorf("bazel.NewLabel(%q): %v", sdkConfigFlagName, err)
+    }
+    c.implicitDep = flagLabel.String()
+  }
+  nodes := depGraph.Nodes()
+  sortNodes(nodes)
+  for _, node := range nodes {
+    if err := c.check(node); err != nil {
+      return err
+    }
+  }
+  if len(c.mismatches) == 0 {
+    return nil
+  }
+  return fmt.Errorf("%d mismatches between the BUILD files and the dependency graph:\n  %s", len(c.mismatches), strings.Join(c.mismatches, "\n  "))
+}
+
+type selfChecker struct {
+  conf *Config
+  graph *DependencyGraph
+  files map[string]*buildfile.File // dir -> parsed BUILD file, nil if there is none
+  implicitDep string // a dep that every library may leave out, or ""
+  mismatches []string
+}
+
+func (c *selfChecker) mismatch(format string, args ...interface{}) {
+  c.mismatches = append(c.mismatches, fmt.Sprintf(format, args...))
+}
+
+// file parses the BUILD file in dir, relative to the workspace, once.
+func (c *selfChecker) file(dir string) (*buildfile.File, error) {
+  if f, ok := c.files[dir]; ok {
+    return f, nil
+  }
+  path := filepath.Join(c.conf.WorkspaceDir, dir, "BUILD")
+  f, err := buildfile.Parse(path)
+  if os.IsNotExist(err) {
+    f, err = nil, nil
+  }
+  if err != nil {
+    return nil, fmt.Errorf("buildfile.Parse: %v", err)
+  }
+  c.files[dir] = f
+  return f, nil
+}
+
+func (c *selfChecker) check(node Node) error {
+  var srcs, hdrs, textualHdrs []*bazel.Label
+  switch n := node.(type) {
+  case *LibraryNode:
+    hdrs, textualHdrs = n.Hdrs, n.TextualHdrs
+    if n.SrcsSelect == nil {
+      srcs = n.Srcs
+    }
+  case *GroupNode:
+    srcs, hdrs, textualHdrs = n.Srcs, n.Hdrs, n.TextualHdrs
+  case *RemapNode, *FilegroupNode:
+  default:
+    // Overrides and selects don't have rules.
+    return nil
+  }
+  label := node.Label()
+  f, err := c.file(label.Dir())
+  if err != nil {
+    return err
+  }
+  if f == nil {
+    c.mismatch("%s: no BUILD file in //%s", label, label.Dir())
+    return nil
+  }
+  rule := f.Rule(label.Name())
+  if rule == nil {
+    c.mismatch("%s: no rule named %q", label, label.Name())
+    return nil
+  }
+  if _, ok := node.(*RemapNode); ok {
+    return nil
+  }
+  if _, ok := node.(*FilegroupNode); ok {
+    return nil
+  }
+  for attr, files := range map[string][]*bazel.Label{"srcs": srcs, "hdrs": hdrs, "textual_hdrs": textualHdrs} {
+    have := make(map[string]bool)
+    for _, s := range attrStrings(rule.Attr(attr)) {
+      have[s] = true
+    }
+    for _, file := range files {
+      if !have[file.FileRelativeTo(label.Dir())] {
+        c.mismatch("%s: %s is missing %s", label, attr, file)
+      }
+    }
+  }
+  if err := c.checkExports(label, srcs, hdrs, textualHdrs); err != nil {
+    return err
+  }
+  c.checkDeps(label, rule)
+  return nil
+}
+
+// checkExports checks that the files of the rule with label that are in
+// other packages are exported by them.
+func (c *selfChecker) checkExports(label *bazel.Label, files ...[]*bazel.Label) error {
+  for _, labels := range files {
+    for _, file := range labels {
+      if file.Dir() == label.Dir() {
+        continue
+      }
+      f, err := c.file(file.Dir())
+      if err != nil {
+        return err
+      }
+      if f == nil || !f.Exported(file.Name()) {
+        c.mismatch("%s: %s isn't exported", label, file)
+      }
+    }
+  }
+  return nil
+}
+
+// checkDeps checks that the deps and implementation_deps of the rule are the
+// dependencies of the node with label. Selects are a select() of their
+// cases.
+func (c *selfChecker) checkDeps(label *bazel.Label, rule *buildfile.Rule) {
+  want := make(map[string]bool) // dep -> required
+  var redundant map[int64]bool
+  if c.conf.TransitiveReduction {
+    redundant = c.graph.redundantDependencies(label)
+  }
+  for _, dep := range c.graph.Dependencies(label) {
+    required := !redundant[dep.ID()] && dep.Label().String() != c.implicitDep
+    if sel, ok := dep.(*SelectNode); ok {
+      for _, l := range sel.Override.Cases {
+        want[l.String()] = want[l.String()] || required
+      }
+      if sel.Override.Default != nil {
+        want[sel.Override.Default.String()] = want[sel.Override.Default.String()] || required
+      }
+      continue
+    }
+    want[dep.Label().String()] = want[dep.Label().String()] || required
+  }
+  have := make(map[string]bool)
+  for _, attr := range []string{"deps", "implementation_deps"} {
+    for _, s := range attrStrings(rule.Attr(attr)) {
+      dep, err := bazel.ParseRelativeLabel(label, s)
+      if err != nil {
+        c.mismatch("%s: %s has %q, which isn't a label: %v", label, attr, s, err)
+        continue
+      }
+      have[dep.String()] = true
+    }
+  }
+  var missing, extra []string
+  for dep, required := range want {
+    if required && !have[dep] {
+      missing = append(missing, dep)
+    }
+  }
+  for dep := range have {
+    // Deps that aren't nodes, like the chip library, are added by the output.
+    // Kept deps are the user's.
+    if _, ok := want[dep]; ok || c.conf.Merge {
+      continue
+    }
+    if parsed, err := bazel.ParseLabel(dep); err == nil && c.graph.Node(parsed) != nil {
+      extra = append(extra, dep)
+    }
+  }
+  sort.Strings(missing)
+  sort.Strings(extra)
+  for _, dep := range missing {
+    c.mismatch("%s: deps are missing %s", label, dep)
+  }
+  for _, dep := range extra {
+    c.mismatch("%s: deps have %s, which isn't a dependency in the graph", label, dep)
+  }
+}
+
+// attrStrings returns the strings in the value of an attribute, in lists,
+// the values of select()s, and their concatenations.
+func attrStrings(x build.Expr) []string {
+  switch e := x.(type) {
+  case *build.StringExpr:
+    return []string{e.Value}
+  case *build.ListExpr:
+    var out []string
+    for _, elem := range e.List {
+      out = append(out, attrStrings(elem)...)
+    }
+    return out
+  case *build.BinaryExpr:
+    return append(attrStrings(e.X), attrStrings(e.Y)...)
+  case *build.CallExpr:
+    if fn, ok := e.X.(*build.Ident); !ok || fn.Name != "select" {
+      return nil
+    }
+    var out []string
+    for _, arg := range e.List {
+      if dict, ok := arg.(*build.DictExpr); ok {
+        for _, kv := range dict.List {
+          out = append(out, attrStrings(kv.Value)...)
+        }
+      }
+    }
+    return out
+  }
+  return nil
+}
@@ -0,0 +1,189 @@
+package nrfbazelify
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+)
+
+const (
+  // The most results returned by a search.
+  maxSearchResults = 50
+)
+
+//go:embed static/index.html
+var indexHTML []byte
+
+// NewGraphHandler serves an interactive view of the graph.
+// The page at / uses these JSON endpoints:
+//   /api/search?q=<text>: targets whose label or files contain text.
+//   /api/node?label=<label>: a target with its members, deps and rdeps.
+//   /api/graph?label=<label>&depth=<n>: the deps and rdeps of a target, up to depth.
+func NewGraphHandler(graph *DependencyGraph) http.Handler {
+  h := &graphHandler{graph: graph}
+  mux := http.NewServeMux()
+  mux.HandleFunc("/", h.index)
+  mux.HandleFunc("/api/search", h.search)
+  mux.HandleFunc("/api/node", h.node)
+  mux.HandleFunc("/api/graph", h.subgraph)
+  return mux
+}
+
+type graphHandler struct {
+  graph *DependencyGraph
+}
+
+// nodeJSON is a node as returned by the API.
+type nodeJSON struct {
+  Label string `json:"label"`
+  Type string `json:"type"`
+  Package string `json:"package"`
+  Members []string `json:"members,omitempty"`
+  Deps []string `json:"deps,omitempty"`
+  Rdeps []string `json:"rdeps,omitempty"`
+}
+
+// graphJSON is a subgraph as returned by the API.
+type graphJSON struct {
+  Nodes []*nodeJSON `json:"nodes"`
+  Edges [][2]string `json:"edges"`
+}
+
+func (h *graphHandler) index(w http.ResponseWriter, r *http.Request) {
+  if r.URL.Path != "/" {
+    http.NotFound(w, r)
+    return
+  }
+  w.Header().Set("Content-Type", "text/html; charset=utf-8")
+  w.Write(indexHTML)
+}
+
+func (h *graphHandler) search(w http.ResponseWriter, r *http.Request) {
+  q := strings.TrimSpace(r.URL.Query().Get("q"))
+  if q == "" {
+    http.Error(w, "q is required", http.StatusBadRequest)
+    return
+  }
+  nodes := h.graph.Nodes()
+  sortNodes(nodes)
+  out := []*nodeJSON{}
+  for _, node := range nodes {
+    info := newNodeInfo(node)
+    if !matchesSearch(info, q) {
+      continue
+    }
+    out = append(out, &nodeJSON{Label: info.label, Type: info.kind, Package: info.pkg})
+    if len(out) >= maxSearchResults {
+      break
+    }
+  }
+  writeJSON(w, out)
+}
+
+// matchesSearch returns whether the node's label or any of its files contain q.
+func matchesSearch(info *nodeInfo, q string) bool {
+  if strings.Contains(info.label, q) {
+    return true
+  }
+  for _, member := range info.members {
+    if strings.Contains(member, q) {
+      return true
+    }
+  }
+  return false
+}
+
+func (h *graphHandler) node(w http.ResponseWriter, r *http.Request) {
+  node, err := h.lookup(r)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusNotFound)
+    return
+  }
+  writeJSON(w, h.nodeJSON(node))
+}
+
+func (h *graphHandler) subgraph(w http.ResponseWriter, r *http.Request) {
+  node, err := h.lookup(r)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusNotFound)
+    return
+  }
+  depth := 1
+  if d := r.URL.Query().Get("depth"); d != "" {
+    if depth, err = strconv.Atoi(d); err != nil || depth < 0 {
+      http.Error(w, fmt.Sprintf("invalid depth %q", d), http.StatusBadRequest)
+      return
+    }
+  }
+  inGraph := make(map[int64]bool)
+  out := &graphJSON{}
+  for _, next := range []func(*bazel.Label) []Node{h.graph.Dependencies, h.graph.Dependents} {
+    for _, n := range h.graph.reachable(node, depth, next) {
+      if inGraph[n.ID()] {
+        continue
+      }
+      inGraph[n.ID()] = true
+      info := newNodeInfo(n)
+      out.Nodes = append(out.Nodes, &nodeJSON{Label: info.label, Type: info.kind, Package: info.pkg})
+    }
+  }
+  for _, n := range out.Nodes {
+    label, err := bazel.ParseLabel(n.Label)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    deps := h.graph.Dependencies(label)
+    sortNodes(deps)
+    for _, dep := range deps {
+      if inGraph[dep.ID()] {
+        out.Edges = append(out.Edges, [2]string{n.Label, dep.Label().String()})
+      }
+    }
+  }
+  writeJSON(w, out)
+}
+
+// lookup finds the node for the label parameter.
+func (h *graphHandler) lookup(r *http.Request) (Node, error) {
+  target := r.URL.Query().Get("label")
+  if target == "" {
+    return nil, fmt.Errorf("label is required")
+  }
+  return h.graph.queryTarget(target)
+}
+
+func (h *graphHandler) nodeJSON(node Node) *nodeJSON {
+  info := newNodeInfo(node)
+  out := &nodeJSON{
+    Label: info.label,
+    Type: info.kind,
+    Package: info.pkg,
+    Members: info.members,
+    Deps: labelStrings(h.graph.Dependencies(node.Label())),
+    Rdeps: labelStrings(h.graph.Dependents(node.Label())),
+  }
+  return out
+}
+
+func labelStrings(nodes []Node) []string {
+  sortNodes(nodes)
+  var out []string
+  for _, node := range nodes {
+    out = append(out, node.Label().String())
+  }
+  return out
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(v); err != nil {
+    log.Printf("json.Encode: %v", err)
+  }
+}
@@ -0,0 +1,97 @@
+package nrfbazelify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGraphHandler(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "nominal")
+  graph, err := LoadGraph(context.Background(), workspaceDir, []string{sdkDir}, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("LoadGraph(%s, %s): %v", workspaceDir, sdkDir, err)
+  }
+  server := httptest.NewServer(NewGraphHandler(graph))
+  defer server.Close()
+
+  get := func(path string, out interface{}) int {
+    resp, err := http.Get(server.URL + path)
+    if err != nil {
+      t.Fatalf("Get(%q): %v", path, err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode == http.StatusOK && out != nil {
+      if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+        t.Fatalf("Decode(%q): %v", path, err)
+      }
+    }
+    return resp.StatusCode
+  }
+
+  t.Run("index", func(t *testing.T) {
+    if code := get("/", nil); code != http.StatusOK {
+      t.Errorf("Get(/): got status %d, want %d", code, http.StatusOK)
+    }
+    if code := get("/missing", nil); code != http.StatusNotFound {
+      t.Errorf("Get(/missing): got status %d, want %d", code, http.StatusNotFound)
+    }
+  })
+
+  t.Run("search by header", func(t *testing.T) {
+    var got []*nodeJSON
+    get("/api/search?q=b.h", &got)
+    want := []*nodeJSON{{Label: "//nominal:b", Type: "library", Package: "nominal"}}
+    if diff := cmp.Diff(want, got); diff != "" {
+      t.Errorf("search (-want +got):\n%s", diff)
+    }
+  })
+
+  t.Run("node", func(t *testing.T) {
+    var got nodeJSON
+    get("/api/node?label="+url.QueryEscape("//nominal:b"), &got)
+    want := nodeJSON{
+      Label: "//nominal:b",
+      Type: "library",
+      Package: "nominal",
+      Members: []string{"//nominal:b.c", "//nominal:b.h"},
+      Deps: []string{"//nominal/dir:c"},
+      Rdeps: []string{"//nominal:a"},
+    }
+    if diff := cmp.Diff(want, got); diff != "" {
+      t.Errorf("node (-want +got):\n%s", diff)
+    }
+  })
+
+  t.Run("unknown node", func(t *testing.T) {
+    if code := get("/api/node?label="+url.QueryEscape("//nominal:missing"), nil); code != http.StatusNotFound {
+      t.Errorf("got status %d, want %d", code, http.StatusNotFound)
+    }
+  })
+
+  t.Run("graph", func(t *testing.T) {
+    var got graphJSON
+    get("/api/graph?label=b.h&depth=1", &got)
+    var labels []string
+    for _, node := range got.Nodes {
+      labels = append(labels, node.Label)
+    }
+    var edges []string
+    for _, edge := range got.Edges {
+      edges = append(edges, strings.Join(edge[:], " -> "))
+    }
+    if diff := cmp.Diff([]string{"//nominal/dir:c", "//nominal:b", "//nominal:a"}, labels); diff != "" {
+      t.Errorf("graph nodes (-want +got):\n%s", diff)
+    }
+    want := []string{"//nominal:b -> //nominal/dir:c", "//nominal:a -> //nominal:b"}
+    if diff := cmp.Diff(want, edges); diff != "" {
+      t.Errorf("graph edges (-want +got):\n%s", diff)
+    }
+  })
+}
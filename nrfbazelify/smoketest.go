@@ -0,0 +1,99 @@
+package nrfbazelify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+  // Matches errors that Bazel reports at a line of a file, like
+  // "ERROR: /ws/sdk/a/BUILD:12:11: no such target '//sdk/b:b'".
+  bazelErrorMatcher = regexp.MustCompile(`^ERROR: (\S+?):(\d+)(?::\d+)?: (.*)$`)
+)
+
+// smokeTestLines is how many lines of Bazel's output are in the error when
+// no error is in a generated file.
+const smokeTestLines = 20
+
+// runSmokeTest runs bazel in the workspace on the generated targets: bazel
+// build on --smoke_test_targets, or bazel query on every target in the SDKs.
+// If Bazel fails, the error lists Bazel's errors in the SDKs' files, which are
+// the generated ones, or the end of its output if there are none.
+func runSmokeTest(ctx context.Context, conf *Config) error {
+  args := []string{"build", "--keep_going"}
+  for _, target := range strings.Split(*smokeTestTargets, ",") {
+    if target = strings.TrimSpace(target); target != "" {
+      args = append(args, target)
+    }
+  }
+  if len(args) == 2 {
+    var patterns []string
+    for _, sdkDir := range conf.SDKDirs {
+      rel, err := filepath.Rel(conf.WorkspaceDir, sdkDir)
+      if err != nil {
+        return fmt.Errorf("filepath.Rel: %v", err)
+      }
+      if rel == "." {
+        patterns = append(patterns, "//...")
+        continue
+      }
+      patterns = append(patterns, "//"+filepath.ToSlash(rel)+"/...")
+    }
+    args = []string{"query", "--keep_going", strings.Join(patterns, " + ")}
+  }
+  log.Printf("Smoke testing the generated files with %s %s", *bazelPath, strings.Join(args, " "))
+  cmd := exec.CommandContext(ctx, *bazelPath, args...)
+  cmd.Dir = conf.WorkspaceDir
+  out, err := cmd.CombinedOutput()
+  if err == nil {
+    return nil
+  }
+  if _, ok := err.(*exec.ExitError); !ok {
+    return fmt.Errorf("running %s: %v", *bazelPath, err)
+  }
+  if errs := generatedFileErrors(conf, string(out)); len(errs) > 0 {
+    return fmt.Errorf("bazel %s failed, with %d errors in generated files:\n  %s", args[0], len(errs), strings.Join(errs, "\n  "))
+  }
+  lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+  if len(lines) > smokeTestLines {
+    lines = lines[len(lines)-smokeTestLines:]
+  }
+  return fmt.Errorf("bazel %s failed: %v\n  %s", args[0], err, strings.Join(lines, "\n  "))
+}
+
+// generatedFileErrors returns Bazel's errors in files in the SDKs, like
+// "sdk/a/BUILD:12: no such target '//sdk/b:b'", with paths relative to the
+// workspace.
+func generatedFileErrors(conf *Config, output string) []string {
+  var out []string
+  for _, line := range strings.Split(output, "\n") {
+    matches := bazelErrorMatcher.FindStringSubmatch(strings.TrimSpace(line))
+    if matches == nil {
+      continue
+    }
+    path := matches[1]
+    if !filepath.IsAbs(path) {
+      path = filepath.Join(conf.WorkspaceDir, path)
+    }
+    inSDK := false
+    for _, sdkDir := range conf.SDKDirs {
+      if strings.HasPrefix(path, sdkDir+string(filepath.Separator)) {
+        inSDK = true
+      }
+    }
+    if !inSDK {
+      continue
+    }
+    rel, err := filepath.Rel(conf.WorkspaceDir, path)
+    if err != nil {
+      continue
+    }
+    out = append(out, fmt.Sprintf("%s:%s: %s", rel, matches[2], matches[3]))
+  }
+  return out
+}
@@ -0,0 +1,264 @@
+package nrfbazelify
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"text/template"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+)
+
+const (
+  // The label_flag that picks the SoftDevice, in the softdevice dir.
+  softDeviceFlagName = "softdevice"
+  // The label_flag that picks the SoftDevice hex, in the softdevice dir.
+  softDeviceHexFlagName = "softdevice_hex"
+  // The filegroup with a SoftDevice's hex, in its hex dir.
+  softDeviceHexName = "hex"
+  // Holds the merge_softdevice macro, in the softdevice dir.
+  softDeviceBzlFilename = "softdevice.bzl"
+)
+
+var (
+  // Matches dirs of a SoftDevice, like components/softdevice/s140/headers/nrf52.
+  // The groups are the softdevice dir, the SoftDevice, and headers or hex.
+  softDeviceDirMatcher = regexp.MustCompile(`^(.*` + regexp.QuoteMeta(string(filepath.Separator)) + `softdevice)` +
+    regexp.QuoteMeta(string(filepath.Separator)) + `(s\d{3})` +
+    regexp.QuoteMeta(string(filepath.Separator)) + `(headers|hex)(` + regexp.QuoteMeta(string(filepath.Separator)) + `.*)?$`)
+
+  softDeviceBzlTemplate = template.Must(template.New("softDeviceBzl").Parse(`"""Merges an application hex with the SoftDevice hex, so there is a single
+file to flash.
+"""
+
+def merge_softdevice(name, hex, softdevice_hex = "{{ . }}", mergehex = "mergehex", **kwargs):
+    """Merges hex and the SoftDevice hex into <name>.hex with mergehex.
+
+    Args:
+      name: string name of the merged hex target.
+      hex: label of the application hex.
+      softdevice_hex: label of the SoftDevice hex, the softdevice_hex label_flag by default.
+      mergehex: the mergehex command, from the nRF Command Line Tools.
+      **kwargs: args passed to the underlying genrule
+    """
+    native.genrule(
+        name = name,
+        srcs = [hex, softdevice_hex],
+        outs = [name + ".hex"],
+        cmd = "{} --merge $(location {}) $(location {}) --output $@".format(mergehex, hex, softdevice_hex),
+        **kwargs
+    )
+`))
+)
+
+// softDevice holds the files of a SoftDevice.
+type softDevice struct {
+  headers []string
+  hexes []string
+}
+
+// softDevices collects SoftDevice files while walking.
+type softDevices map[string]map[string]*softDevice // softdevice dir -> SoftDevice -> files
+
+// add records the header or hex file if it belongs to a SoftDevice.
+// Returns false if it doesn't.
+func (sd softDevices) add(path string) bool {
+  capture := softDeviceDirMatcher.FindStringSubmatch(filepath.Dir(path))
+  if capture == nil {
+    return false
+  }
+  dir, name, kind, subdir := capture[1], capture[2], capture[3], capture[4]
+  ext := filepath.Ext(path)
+  isHeader := kind == "headers" && ext == ".h"
+  isHex := kind == "hex" && subdir == "" && ext == ".hex"
+  if !isHeader && !isHex {
+    return false
+  }
+  if sd[dir] == nil {
+    sd[dir] = make(map[string]*softDevice)
+  }
+  if sd[dir][name] == nil {
+    sd[dir][name] = &softDevice{}
+  }
+  if isHeader {
+    sd[dir][name].headers = append(sd[dir][name].headers, path)
+  } else {
+    sd[dir][name].hexes = append(sd[dir][name].hexes, path)
+  }
+  return true
+}
+
+// addSoftDeviceNodes adds a header library for every SoftDevice, and a
+// softdevice label_flag that points to one of them. Includes of any
+// SoftDevice header resolve to the label_flag.
+// SoftDevice hex files get a filegroup, picked by the softdevice_hex label_flag.
+func (s *SDKWalker) addSoftDeviceNodes() error {
+  var dirs []string
+  for dir := range s.softDevices {
+    dirs = append(dirs, dir)
+  }
+  sort.Strings(dirs)
+  for _, dir := range dirs {
+    var names []string
+    for name, sd := range s.softDevices[dir] {
+      if len(sd.headers) > 0 {
+        names = append(names, name)
+      }
+    }
+    if len(names) == 0 {
+      continue
+    }
+    sort.Strings(names)
+    defaultName := names[len(names)-1]
+    if want := s.conf.SoftDevice; want != "" {
+      if sd := s.softDevices[dir][want]; sd == nil || len(sd.headers) == 0 {
+        return fmt.Errorf("softdevice %q not found in %s, found %v", want, s.prettySDKPath(dir), names)
+      }
+      defaultName = want
+    }
+    if err := s.addSoftDeviceHeaderNodes(dir, names, defaultName); err != nil {
+      return err
+    }
+    if err := s.addSoftDeviceHexNodes(dir, names, defaultName); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (s *SDKWalker) addSoftDeviceHeaderNodes(dir string, names []string, defaultName string) error {
+  fileNames := make(map[string]bool)
+  var libLabels []*bazel.Label
+  var defaultLabel *bazel.Label
+  for _, name := range names {
+    headersDir := filepath.Join(dir, name, "headers")
+    label, err := bazel.NewLabel(headersDir, name, s.conf.WorkspaceDir)
+    if err != nil {
+      return fmt.Errorf("bazel.NewLabel(%q, %q): %v", headersDir, name, err)
+    }
+    var hdrs []*bazel.Label
+    includeDirs := make(map[string]bool)
+    for _, path := range s.softDevices[dir][name].headers {
+      hdr, err := bazel.NewLabel(filepath.Dir(path), filepath.Base(path), s.conf.WorkspaceDir)
+      if err != nil {
+        return fmt.Errorf("bazel.NewLabel(%q): %v", path, err)
+      }
+      hdrs = append(hdrs, hdr)
+      includeDirs[hdr.Dir()] = true
+      fileNames[hdr.Name()] = true
+    }
+    var includes []string
+    for includeDir := range includeDirs {
+      includes = append(includes, includeDir)
+    }
+    sort.Strings(includes)
+    if err := s.graph.AddLibraryNode(label, nil, hdrs, includes); err != nil {
+      return fmt.Errorf("AddLibraryNode(%q): %v", label, err)
+    }
+    // Dependents only see the label_flag, so they can't add these includes themselves.
+    s.graph.Node(label).(*LibraryNode).ExportIncludes = true
+    libLabels = append(libLabels, label)
+    if name == defaultName {
+      defaultLabel = label
+    }
+  }
+
+  flagLabel, err := bazel.NewLabel(dir, softDeviceFlagName, s.conf.WorkspaceDir)
+  if err != nil {
+    return fmt.Errorf("bazel.NewLabel(%q, %q): %v", dir, softDeviceFlagName, err)
+  }
+  var sortedFileNames []string
+  for fileName := range fileNames {
+    sortedFileNames = append(sortedFileNames, fileName)
+  }
+  sort.Strings(sortedFileNames)
+  flag := &buildfile.LabelSetting{
+    Name: softDeviceFlagName,
+    BuildSettingDefault: defaultLabel.String(),
+    Flag: true,
+  }
+  if err := s.graph.AddRemapNode(flagLabel, sortedFileNames[0], flag); err != nil {
+    return fmt.Errorf("AddRemapNode(%q): %v", flagLabel, err)
+  }
+  for _, fileName := range sortedFileNames[1:] {
+    if err := s.graph.AddRemapFile(fileName, flagLabel); err != nil {
+      return err
+    }
+  }
+  // The label_flag depends on every SoftDevice, so they are all generated.
+  for _, libLabel := range libLabels {
+    s.extraDeps = append(s.extraDeps, &resolvedDep{src: flagLabel, dst: libLabel})
+  }
+  return nil
+}
+
+func (s *SDKWalker) addSoftDeviceHexNodes(dir string, names []string, defaultName string) error {
+  var hexLabels []*bazel.Label
+  var defaultLabel *bazel.Label
+  for _, name := range names {
+    hexes := s.softDevices[dir][name].hexes
+    if len(hexes) == 0 {
+      continue
+    }
+    hexDir := filepath.Join(dir, name, "hex")
+    label, err := bazel.NewLabel(hexDir, softDeviceHexName, s.conf.WorkspaceDir)
+    if err != nil {
+      return fmt.Errorf("bazel.NewLabel(%q, %q): %v", hexDir, softDeviceHexName, err)
+    }
+    var srcs []*bazel.Label
+    for _, path := range hexes {
+      src, err := bazel.NewLabel(filepath.Dir(path), filepath.Base(path), s.conf.WorkspaceDir)
+      if err != nil {
+        return fmt.Errorf("bazel.NewLabel(%q): %v", path, err)
+      }
+      srcs = append(srcs, src)
+    }
+    if err := s.graph.AddFilegroupNode(label, srcs); err != nil {
+      return fmt.Errorf("AddFilegroupNode(%q): %v", label, err)
+    }
+    hexLabels = append(hexLabels, label)
+    if name == defaultName {
+      defaultLabel = label
+    }
+  }
+  if len(hexLabels) == 0 {
+    return nil
+  }
+  if defaultLabel == nil {
+    log.Printf("No hex for SoftDevice %s in %s, not generating %s", defaultName, s.prettySDKPath(dir), softDeviceHexFlagName)
+    return nil
+  }
+  flagLabel, err := bazel.NewLabel(dir, softDeviceHexFlagName, s.conf.WorkspaceDir)
+  if err != nil {
+    return fmt.Errorf("bazel.NewLabel(%q, %q): %v", dir, softDeviceHexFlagName, err)
+  }
+  flag := &buildfile.LabelSetting{
+    Name: softDeviceHexFlagName,
+    BuildSettingDefault: defaultLabel.String(),
+    Flag: true,
+  }
+  if err := s.graph.AddLabelFlagNode(flagLabel, flag); err != nil {
+    return fmt.Errorf("AddLabelFlagNode(%q): %v", flagLabel, err)
+  }
+  for _, hexLabel := range hexLabels {
+    s.extraDeps = append(s.extraDeps, &resolvedDep{src: flagLabel, dst: hexLabel})
+  }
+  return nil
+}
+
+// softDeviceBzl generates the macro that merges an application hex with the
+// SoftDevice hex picked by flagLabel.
+func softDeviceBzl(flagLabel *bazel.Label) (*bzlFile, error) {
+  var out bytes.Buffer
+  if err := softDeviceBzlTemplate.Execute(&out, flagLabel.String()); err != nil {
+    return nil, fmt.Errorf("softDeviceBzlTemplate.Execute: %v", err)
+  }
+  return &bzlFile{
+    name: softDeviceBzlFilename,
+    contents: out.Bytes(),
+  }, nil
+}
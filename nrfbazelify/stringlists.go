@@ -0,0 +1,77 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+)
+
+// applyStringLists adds the string_list_settings of string_list_remaps to
+// the BUILD file of the SDK root, or string_list_flags with remap_backend
+// LABEL_FLAG. The ones with defines get a
+// string_list_defines, which every generated library depends on.
+func applyStringLists(conf *Config, files map[string]*buildfile.File) error {
+  if conf.Remaps == nil || len(conf.Remaps.StringLists()) == 0 {
+    return nil
+  }
+  sdkFromWorkspace, err := filepath.Rel(conf.WorkspaceDir, conf.SDKDir)
+  if err != nil {
+    return fmt.Errorf("filepath.Rel: %v", err)
+  }
+  if files[sdkFromWorkspace] == nil {
+    files[sdkFromWorkspace] = buildfile.New(conf.SDKDir)
+  }
+  root := files[sdkFromWorkspace]
+  bzlLabel, err := bazel.NewLabel(conf.SDKDir, bzlFilename, conf.WorkspaceDir)
+  if err != nil {
+    return fmt.Errorf("bazel.NewLabel(%q): %v", bzlFilename, err)
+  }
+  kind := buildfile.StringListSetting
+  if conf.Remaps.LabelFlags() {
+    kind = buildfile.StringListFlag
+  }
+  var definesLabels []*bazel.Label
+  for _, list := range conf.Remaps.StringLists() {
+    root.AddFlag(&buildfile.Flag{
+      Kind: kind,
+      Name: list.Name,
+      BuildSettingDefault: buildfile.StringList(list.Defaults),
+    })
+    if !list.Defines {
+      continue
+    }
+    root.AddRule(buildfile.NewRule("string_list_defines", list.DefinesName()).
+      SetAttr("setting", buildfile.String(":"+list.Name)))
+    label, err := bazel.NewLabel(conf.SDKDir, list.DefinesName(), conf.WorkspaceDir)
+    if err != nil {
+      return fmt.Errorf("bazel.NewLabel(%q): %v", list.DefinesName(), err)
+    }
+    definesLabels = append(definesLabels, label)
+  }
+  if len(definesLabels) == 0 {
+    return nil
+  }
+  root.AddLoad(&buildfile.Load{
+    Source: bzlLabel.String(),
+    Symbols: []string{"string_list_defines"},
+  })
+  for dir, file := range files {
+    var libErr error
+    file.EachLibrary(func(lib *buildfile.Library) {
+      label, err := bazel.NewLabel(filepath.Join(conf.WorkspaceDir, dir), lib.Name, conf.WorkspaceDir)
+      if err != nil {
+        libErr = fmt.Errorf("bazel.NewLabel(%q, %q): %v", dir, lib.Name, err)
+        return
+      }
+      for _, definesLabel := range definesLabels {
+        lib.Deps = append(lib.Deps, definesLabel.RelativeTo(label))
+      }
+    })
+    if libErr != nil {
+      return libErr
+    }
+  }
+  return nil
+}
@@ -0,0 +1,264 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+)
+
+// TargetPattern matches the labels of generated libraries, like Bazel's
+// target patterns. "//a/b:c" is a single target, "//a/b:all" or "//a/b:*" is
+// every target in the package, and "//a/..." is every target under a. The
+// dir and name can also have filepath.Match wildcards, like "//a/*:b_*".
+type TargetPattern struct {
+  pattern string
+  dir string
+  recursive bool
+  name string
+}
+
+// ParseTargetPattern parses a target pattern.
+func ParseTargetPattern(pattern string) (*TargetPattern, error) {
+  if !strings.HasPrefix(pattern, "//") {
+    return nil, fmt.Errorf("target pattern %q must start with //", pattern)
+  }
+  out := &TargetPattern{pattern: pattern}
+  dir := strings.TrimPrefix(pattern, "//")
+  if i := strings.LastIndex(dir, ":"); i >= 0 {
+    dir, out.name = dir[:i], dir[i+1:]
+    if out.name == "" {
+      return nil, fmt.Errorf("target pattern %q has an empty name", pattern)
+    }
+  }
+  if dir == "..." || strings.HasSuffix(dir, "/...") {
+    out.recursive = true
+    dir = strings.TrimSuffix(strings.TrimSuffix(dir, "..."), "/")
+  }
+  out.dir = dir
+  switch {
+  case out.name == "all":
+    out.name = "*"
+  case out.name == "" && out.recursive:
+    out.name = "*"
+  case out.name == "":
+    // Like labels, //a/b is //a/b:b.
+    out.name = path.Base(dir)
+  }
+  for _, p := range []string{out.dir, out.name} {
+    if _, err := path.Match(p, ""); err != nil {
+      return nil, fmt.Errorf("target pattern %q: %v", pattern, err)
+    }
+  }
+  return out, nil
+}
+
+// String returns the pattern as it was parsed.
+func (p *TargetPattern) String() string {
+  return p.pattern
+}
+
+// Matches reports whether the label matches the pattern.
+func (p *TargetPattern) Matches(label *bazel.Label) bool {
+  if nameMatch, _ := path.Match(p.name, label.Name()); !nameMatch {
+    return false
+  }
+  if !p.recursive {
+    dirMatch, _ := path.Match(p.dir, label.Dir())
+    return dirMatch
+  }
+  if p.dir == "" {
+    return true
+  }
+  // Every dir under the pattern's dir, which can have wildcards too.
+  parts := strings.Split(label.Dir(), "/")
+  depth := len(strings.Split(p.dir, "/"))
+  if len(parts) < depth {
+    return false
+  }
+  dirMatch, _ := path.Match(p.dir, strings.Join(parts[:depth], "/"))
+  return dirMatch
+}
+
+// parseTargetPatterns parses all the patterns.
+func parseTargetPatterns(patterns []string) ([]*TargetPattern, error) {
+  if len(patterns) == 0 {
+    return nil, fmt.Errorf("no targets")
+  }
+  var out []*TargetPattern
+  for _, pattern := range patterns {
+    p, err := ParseTargetPattern(pattern)
+    if err != nil {
+      return nil, err
+    }
+    out = append(out, p)
+  }
+  return out, nil
+}
+
+// TargetCopts are copts added to every generated library that one of the
+// targets matches.
+type TargetCopts struct {
+  Targets []*TargetPattern
+  Copts []string
+}
+
+// eachMatchingLibrary calls fn with every library in files that one of the
+// patterns matches. It returns an error if no library matches, since that's
+// most likely a typo.
+func eachMatchingLibrary(conf *Config, files map[string]*buildfile.File, patterns []*TargetPattern, fn func(lib *buildfile.Library)) error {
+  found := false
+  for dir, file := range files {
+    file.EachLibrary(func(lib *buildfile.Library) {
+      label, err := bazel.NewLabel(path.Join(conf.WorkspaceDir, dir), lib.Name, conf.WorkspaceDir)
+      if err != nil {
+        return
+      }
+      for _, p := range patterns {
+        if p.Matches(label) {
+          found = true
+          fn(lib)
+          return
+        }
+      }
+    })
+  }
+  if !found {
+    var all []string
+    for _, p := range patterns {
+      all = append(all, p.String())
+    }
+    return fmt.Errorf("no generated library matches %s", strings.Join(all, ", "))
+  }
+  return nil
+}
+
+// applyTargetCopts adds the copts of target_copts to the libraries they match,
+// after the generated copts.
+func applyTargetCopts(conf *Config, files map[string]*buildfile.File) error {
+  for _, t := range conf.TargetCopts {
+    if err := eachMatchingLibrary(conf, files, t.Targets, func(lib *buildfile.Library) {
+      lib.Copts = append(lib.Copts, t.Copts...)
+    }); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// TargetDefines are defines and local_defines added to every generated library
+// that one of the targets matches.
+type TargetDefines struct {
+  Targets []*TargetPattern
+  Defines []string
+  LocalDefines []string
+}
+
+// applyDefines adds the global defines to every generated library, and the
+// defines of target_defines to the libraries they match, after them.
+func applyDefines(conf *Config, files map[string]*buildfile.File) error {
+  if len(conf.Defines) > 0 {
+    for _, file := range files {
+      file.EachLibrary(func(lib *buildfile.Library) {
+        lib.Defines = append(lib.Defines, conf.Defines...)
+      })
+    }
+  }
+  for _, t := range conf.TargetDefines {
+    if err := eachMatchingLibrary(conf, files, t.Targets, func(lib *buildfile.Library) {
+      lib.Defines = append(lib.Defines, t.Defines...)
+      lib.LocalDefines = append(lib.LocalDefines, t.LocalDefines...)
+    }); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// applyAlwayslink sets alwayslink on the libraries that alwayslink matches.
+// Each pattern has to match a library.
+func applyAlwayslink(conf *Config, files map[string]*buildfile.File) error {
+  for _, p := range conf.Alwayslink {
+    if err := eachMatchingLibrary(conf, files, []*TargetPattern{p}, func(lib *buildfile.Library) {
+      lib.Alwayslink = true
+    }); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Deprecation is the deprecation message of every generated library that one
+// of the targets matches.
+type Deprecation struct {
+  Targets []*TargetPattern
+  Message string
+}
+
+// applyDeprecations sets the deprecation of the libraries that deprecations
+// match. Later entries override earlier ones.
+func applyDeprecations(conf *Config, files map[string]*buildfile.File) error {
+  for _, d := range conf.Deprecations {
+    if err := eachMatchingLibrary(conf, files, d.Targets, func(lib *buildfile.Library) {
+      lib.Deprecation = d.Message
+    }); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// applyTestonly marks the libraries that testonly matches as testonly. Bazel
+// rejects targets that depend on testonly targets without being testonly
+// themselves, so it's an error if a generated library does.
+func applyTestonly(conf *Config, files map[string]*buildfile.File) error {
+  if len(conf.Testonly) == 0 {
+    return nil
+  }
+  for _, p := range conf.Testonly {
+    if err := eachMatchingLibrary(conf, files, []*TargetPattern{p}, func(lib *buildfile.Library) {
+      lib.Testonly = true
+    }); err != nil {
+      return err
+    }
+  }
+  libs := make(map[string]*generatedLibrary)
+  for dir, file := range files {
+    file.EachLibrary(func(lib *buildfile.Library) {
+      label, err := bazel.NewLabel(path.Join(conf.WorkspaceDir, dir), lib.Name, conf.WorkspaceDir)
+      if err != nil {
+        return
+      }
+      libs[label.String()] = &generatedLibrary{label: label, lib: lib}
+    })
+  }
+  var errs []string
+  for _, gen := range libs {
+    if gen.lib.Testonly {
+      continue
+    }
+    deps := append(append([]string{}, gen.lib.Deps...), gen.lib.ImplementationDeps...)
+    for _, cases := range gen.lib.DepsSelects {
+      for _, selected := range cases {
+        deps = append(deps, selected...)
+      }
+    }
+    for _, dep := range deps {
+      label, err := bazel.ParseRelativeLabel(gen.label, dep)
+      if err != nil {
+        continue
+      }
+      if depGen := libs[label.String()]; depGen != nil && depGen.lib.Testonly {
+        errs = append(errs, fmt.Sprintf("%s depends on %s", gen.label, label))
+      }
+    }
+  }
+  if len(errs) > 0 {
+    sort.Strings(errs)
+    return fmt.Errorf("libraries that depend on testonly libraries have to be testonly too: %s", strings.Join(errs, ", "))
+  }
+  return nil
+}
@@ -0,0 +1,81 @@
+package nrfbazelify
+
+import (
+	"testing"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+)
+
+func TestTargetPatternMatches(t *testing.T) {
+  tests := map[string]struct{
+    pattern string
+    matches []string
+    notMatches []string
+  }{
+    "single target": {
+      pattern: "//a/b:c",
+      matches: []string{"//a/b:c"},
+      notMatches: []string{"//a/b:d", "//a/b/c:c"},
+    },
+    "default name": {
+      pattern: "//a/b",
+      matches: []string{"//a/b:b"},
+      notMatches: []string{"//a/b:c"},
+    },
+    "all": {
+      pattern: "//a/b:all",
+      matches: []string{"//a/b:b", "//a/b:c"},
+      notMatches: []string{"//a/b/c:c", "//a:a"},
+    },
+    "recursive": {
+      pattern: "//a/...",
+      matches: []string{"//a:a", "//a/b:c", "//a/b/c:d"},
+      notMatches: []string{"//ab:c", "//b/a:a"},
+    },
+    "recursive name": {
+      pattern: "//a/...:nrfx_*",
+      matches: []string{"//a/b:nrfx_spi"},
+      notMatches: []string{"//a/b:nrf_gpio"},
+    },
+    "everything": {
+      pattern: "//...",
+      matches: []string{"//a:a", "//a/b:c"},
+    },
+    "wildcard dir": {
+      pattern: "//a/*:c",
+      matches: []string{"//a/b:c", "//a/d:c"},
+      notMatches: []string{"//a/b/d:c", "//a:c"},
+    },
+  }
+  for name, test := range tests {
+    t.Run(name, func(t *testing.T) {
+      p, err := ParseTargetPattern(test.pattern)
+      if err != nil {
+        t.Fatalf("ParseTargetPattern(%q): %v", test.pattern, err)
+      }
+      for _, want := range []bool{true, false} {
+        labels := test.matches
+        if !want {
+          labels = test.notMatches
+        }
+        for _, l := range labels {
+          label, err := bazel.ParseLabel(l)
+          if err != nil {
+            t.Fatalf("bazel.ParseLabel(%q): %v", l, err)
+          }
+          if got := p.Matches(label); got != want {
+            t.Errorf("%q.Matches(%q): got %t, want %t", test.pattern, l, got, want)
+          }
+        }
+      }
+    })
+  }
+}
+
+func TestParseTargetPattern_Errors(t *testing.T) {
+  for _, pattern := range []string{"a/b", "//a:", "//a/[:b"} {
+    if _, err := ParseTargetPattern(pattern); err == nil {
+      t.Errorf("ParseTargetPattern(%q): got no error, want error", pattern)
+    }
+  }
+}
@@ -0,0 +1,2 @@
+#include "nrf_log.h"
+#include "nrf_log_backend_uart.h"
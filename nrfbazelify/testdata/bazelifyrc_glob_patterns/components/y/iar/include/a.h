@@ -0,0 +1 @@
+#include "missing.h"
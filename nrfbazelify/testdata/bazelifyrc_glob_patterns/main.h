@@ -0,0 +1,3 @@
+#include "a.h"
+#include "sys/types.h"
+#include "core_iar.h"
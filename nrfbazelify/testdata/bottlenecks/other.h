@@ -0,0 +1 @@
+#include "w.h"
@@ -0,0 +1 @@
+#include "z.h"
@@ -0,0 +1,2 @@
+#include "nrf.h"
+#include "boards.h"
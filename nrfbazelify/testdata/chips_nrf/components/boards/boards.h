@@ -0,0 +1,3 @@
+#ifndef BOARDS_H
+#define BOARDS_H
+#endif
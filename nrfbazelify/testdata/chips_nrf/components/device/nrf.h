@@ -0,0 +1,5 @@
+#if defined(NRF52832_XXAA)
+#include "nrf52832.h"
+#elif defined(NRF52840_XXAA)
+#include "nrf52840.h"
+#endif
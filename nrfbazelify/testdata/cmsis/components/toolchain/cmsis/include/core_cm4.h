@@ -0,0 +1,2 @@
+#include "cmsis_version.h"
+#include "cmsis_compiler.h"
@@ -0,0 +1 @@
+#include "cmsis_os.h"
@@ -0,0 +1 @@
+#include "radio.h"
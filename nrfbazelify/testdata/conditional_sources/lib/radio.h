@@ -0,0 +1,3 @@
+#ifndef RADIO_H
+#define RADIO_H
+#endif
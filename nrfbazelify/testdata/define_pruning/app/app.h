@@ -0,0 +1,17 @@
+#ifndef APP_H
+#define APP_H
+
+#include "sdk_config.h"
+#include "nrf_cli.h"
+
+#if NRF_MODULE_ENABLED(NRF_LOG)
+#include "nrf_log.h"
+#endif
+
+#if APP_TIMER_ENABLED
+#include "app_timer.h"
+#else
+#include "no_timer.h"
+#endif
+
+#endif // APP_H
@@ -0,0 +1,4 @@
+#ifndef NRF_CLI_H
+#define NRF_CLI_H
+
+#endif // NRF_CLI_H
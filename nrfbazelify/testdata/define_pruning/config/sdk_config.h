@@ -0,0 +1,23 @@
+#ifndef SDK_CONFIG_H
+#define SDK_CONFIG_H
+
+#ifdef USE_APP_CONFIG
+#include "app_config.h"
+#endif
+
+// <e> NRF_LOG_ENABLED - nrf_log - Logger
+#ifndef NRF_LOG_ENABLED
+#define NRF_LOG_ENABLED 0
+#endif
+
+// <q> APP_TIMER_ENABLED - app_timer - Application timer functionality
+#ifndef APP_TIMER_ENABLED
+#define APP_TIMER_ENABLED 1
+#endif
+
+// <e> NRF_CLI_ENABLED - nrf_cli - Command line interface
+#ifndef NRF_CLI_ENABLED
+#define NRF_CLI_ENABLED 0
+#endif
+
+#endif // SDK_CONFIG_H
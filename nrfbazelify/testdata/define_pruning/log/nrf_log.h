@@ -0,0 +1,6 @@
+#ifndef NRF_LOG_H
+#define NRF_LOG_H
+
+#include "nrf_log_ctrl.h"
+
+#endif // NRF_LOG_H
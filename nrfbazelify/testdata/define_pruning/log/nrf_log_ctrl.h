@@ -0,0 +1,4 @@
+#ifndef NRF_LOG_CTRL_H
+#define NRF_LOG_CTRL_H
+
+#endif // NRF_LOG_CTRL_H
@@ -0,0 +1 @@
+#include "app_timer.h"
@@ -0,0 +1,4 @@
+#ifndef APP_TIMER_H
+#define APP_TIMER_H
+
+#endif // APP_TIMER_H
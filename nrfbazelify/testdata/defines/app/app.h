@@ -0,0 +1 @@
+#include "foo.h"
@@ -0,0 +1,4 @@
+#ifndef A_H__
+#define A_H__
+
+#endif
@@ -0,0 +1,2 @@
+#include "nrf_drv_uart.h"
+#include "radio_config.h"
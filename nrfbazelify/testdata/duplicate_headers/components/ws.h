@@ -0,0 +1 @@
+#define WS 1
@@ -0,0 +1,2 @@
+#define  WS   1
+
@@ -0,0 +1 @@
+#include "util.h"
@@ -0,0 +1,3 @@
+#ifndef NRF_DELAY_H
+#define NRF_DELAY_H
+#endif
@@ -0,0 +1,4 @@
+#ifndef APP_ERROR_H
+#define APP_ERROR_H
+#include "sdk_config.h"
+#endif
@@ -0,0 +1,5 @@
+#include "nrf_delay.h"
+#include "app_error.h"
+#include "sdk_config.h"
+
+int main(void) { return 0; }
@@ -0,0 +1 @@
+#include "port.h"
@@ -0,0 +1,3 @@
+#ifndef GCC_H
+#define GCC_H
+#endif
@@ -0,0 +1 @@
+#include "core_cm4.h"
@@ -0,0 +1 @@
+#include "portmacro.h"
@@ -0,0 +1,2 @@
+#include "portmacro.h"
+#include "portmacro_cmsis.h"
@@ -0,0 +1 @@
+#include "app_fifo.h"
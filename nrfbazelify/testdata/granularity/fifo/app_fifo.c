@@ -0,0 +1,2 @@
+#include "app_fifo.h"
+#include "app_util.h"
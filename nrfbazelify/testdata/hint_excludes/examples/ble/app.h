@@ -0,0 +1,2 @@
+#include "missing1.h"
+#include "missing2.h"
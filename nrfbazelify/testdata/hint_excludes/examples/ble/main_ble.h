@@ -0,0 +1 @@
+#include "missing3.h"
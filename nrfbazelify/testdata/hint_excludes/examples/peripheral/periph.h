@@ -0,0 +1 @@
+#include "missing4.h"
@@ -0,0 +1 @@
+#include "missing5.h"
@@ -0,0 +1 @@
+#include "lib.h"
@@ -0,0 +1,3 @@
+#ifndef SDK_CONFIG_H
+#define SDK_CONFIG_H
+#endif
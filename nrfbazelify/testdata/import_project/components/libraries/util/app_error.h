@@ -0,0 +1,3 @@
+#ifndef APP_ERROR_H
+#define APP_ERROR_H
+#endif
@@ -0,0 +1,2 @@
+#include "c.h"
+#include "sub/b.h"
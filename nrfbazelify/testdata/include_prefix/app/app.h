@@ -0,0 +1 @@
+#include "nrfx/hal/nrf_gpio.h"
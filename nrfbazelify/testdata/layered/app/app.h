@@ -0,0 +1 @@
+#include "spi.h"
@@ -0,0 +1 @@
+#include "nrf_log_default_backends.h"
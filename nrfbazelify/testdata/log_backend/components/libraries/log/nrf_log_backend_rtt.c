@@ -0,0 +1,2 @@
+#include "nrf_log_backend_rtt.h"
+#include "nrf_log_backend_serial.h"
@@ -0,0 +1 @@
+#include "nrf_log_backend_interface.h"
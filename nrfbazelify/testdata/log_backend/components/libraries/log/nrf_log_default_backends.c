@@ -0,0 +1,7 @@
+#include "nrf_log_default_backends.h"
+#if NRF_LOG_BACKEND_RTT_ENABLED
+#include "nrf_log_backend_rtt.h"
+#endif
+#if NRF_LOG_BACKEND_UART_ENABLED
+#include "nrf_log_backend_uart.h"
+#endif
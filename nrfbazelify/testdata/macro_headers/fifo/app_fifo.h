@@ -0,0 +1,3 @@
+#include "app_fifo_config.h"
+#include "app_fifo_types.h"
+#include "shared_macros.h"
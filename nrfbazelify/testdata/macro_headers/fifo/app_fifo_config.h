@@ -0,0 +1,12 @@
+/**
+ * Configuration of app_fifo.
+ */
+#ifndef APP_FIFO_CONFIG_H__
+#define APP_FIFO_CONFIG_H__
+
+#include "app_util.h" // For IS_POWER_OF_TWO.
+
+#define APP_FIFO_SIZE(n) \
+  (IS_POWER_OF_TWO(n) ? (n) : 0)
+
+#endif /* APP_FIFO_CONFIG_H__ */
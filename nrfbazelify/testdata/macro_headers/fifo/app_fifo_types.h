@@ -0,0 +1,8 @@
+#ifndef APP_FIFO_TYPES_H__
+#define APP_FIFO_TYPES_H__
+
+typedef struct {
+  int size;
+} app_fifo_t;
+
+#endif
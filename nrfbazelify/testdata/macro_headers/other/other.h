@@ -0,0 +1 @@
+#include "../fifo/shared_macros.h"
@@ -0,0 +1 @@
+#define IS_POWER_OF_TWO(n) (((n) & ((n) - 1)) == 0)
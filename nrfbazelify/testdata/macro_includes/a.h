@@ -0,0 +1,3 @@
+#include SDK_CONFIG_FILE
+#include NRF_LOG_HEADER // the log backend
+#include UNKNOWN_HEADER
@@ -0,0 +1 @@
+#include <stdint.h>
@@ -0,0 +1,2 @@
+#include "nrf.h"
+#include "system_nrf52840.h"
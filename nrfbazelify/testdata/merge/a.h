@@ -0,0 +1,3 @@
+#ifndef A_H_
+#define A_H_
+#endif
@@ -0,0 +1 @@
+#include "nrf_error.h"
@@ -0,0 +1,3 @@
+#include "nrf_mesh.h"
+#include "queue.h"
+#include "app_error.h"
@@ -0,0 +1 @@
+#include "queue.h"
@@ -0,0 +1 @@
+#include "config_server.h"
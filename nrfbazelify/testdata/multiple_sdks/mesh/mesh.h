@@ -0,0 +1,2 @@
+#include "c.h"
+#include "apply_old_config.h"
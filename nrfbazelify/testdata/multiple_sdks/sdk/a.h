@@ -0,0 +1 @@
+#include "mesh.h"
@@ -0,0 +1 @@
+#include "apply_old_config.h"
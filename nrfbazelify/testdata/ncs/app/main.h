@@ -0,0 +1,3 @@
+#include <dk_buttons_and_leds.h>
+#include <hal/nrf_gpio.h>
+#include "zephyr/sys/util.h"
@@ -0,0 +1 @@
+#include <zephyr/kernel.h>
@@ -0,0 +1 @@
+#include "does_not_exist.h"
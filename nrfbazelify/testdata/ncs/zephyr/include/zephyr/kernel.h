@@ -0,0 +1,2 @@
+#include <stdint.h>
+#include <zephyr/sys/util.h>
@@ -0,0 +1,4 @@
+#ifdef USE_APP_CONFIG
+#include "app_config.h"
+#endif
+#define NRF_LOG_ENABLED 0
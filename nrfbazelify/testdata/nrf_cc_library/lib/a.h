@@ -0,0 +1 @@
+#include "sdk_config.h"
@@ -0,0 +1,6 @@
+#ifndef NRF_LOG_H__
+#define NRF_LOG_H__
+
+void nrf_log_frontend_init(void);
+
+#endif
@@ -0,0 +1,6 @@
+#ifndef NRF_RINGBUF_H__
+#define NRF_RINGBUF_H__
+
+void nrf_ringbuf_init(void);
+
+#endif
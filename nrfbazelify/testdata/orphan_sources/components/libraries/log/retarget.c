@@ -0,0 +1,3 @@
+#include <stdio.h>
+
+int _write(int fd, const char *buf, int len) { return len; }
@@ -0,0 +1,3 @@
+#include "nrf_log.h"
+
+void nrf_log_frontend_init(void) {}
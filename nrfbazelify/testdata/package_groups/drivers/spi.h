@@ -0,0 +1 @@
+#include "glue.h"
@@ -0,0 +1 @@
+#include "sub/b.h"
@@ -0,0 +1,2 @@
+#include "util.h"
+#include "other.h"
@@ -0,0 +1 @@
+#define UTIL 1
@@ -0,0 +1 @@
+#define OTHER 1
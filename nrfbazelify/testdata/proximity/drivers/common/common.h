@@ -0,0 +1 @@
+#define DRIVERS_COMMON 1
@@ -0,0 +1 @@
+#include "common.h"
@@ -0,0 +1 @@
+#define LIBRARIES_COMMON 1
@@ -0,0 +1 @@
+#include "a.h"
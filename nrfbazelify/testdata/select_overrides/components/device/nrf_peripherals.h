@@ -0,0 +1,5 @@
+#if defined(NRF52832_XXAA)
+#include "nrf52832_peripherals.h"
+#elif defined(NRF52840_XXAA)
+#include "nrf52840_peripherals.h"
+#endif
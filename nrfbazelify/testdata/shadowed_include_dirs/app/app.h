@@ -0,0 +1 @@
+#include "cfg.h"
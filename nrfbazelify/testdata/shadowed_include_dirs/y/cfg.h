@@ -0,0 +1,3 @@
+#ifndef CFG_H
+#define CFG_H
+#endif
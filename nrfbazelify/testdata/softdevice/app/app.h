@@ -0,0 +1,2 @@
+#include "ble.h"
+#include "nrf_sdm.h"
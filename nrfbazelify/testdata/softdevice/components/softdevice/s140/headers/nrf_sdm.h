@@ -0,0 +1,2 @@
+#include "nrf_svc.h"
+#include "nrf_mbr.h"
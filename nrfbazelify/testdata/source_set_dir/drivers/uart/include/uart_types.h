@@ -0,0 +1 @@
+typedef int uart_t;
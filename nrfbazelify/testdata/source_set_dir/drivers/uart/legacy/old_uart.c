@@ -0,0 +1,3 @@
+#include "old_uart.h"
+
+void old_uart_init(void) {}
@@ -0,0 +1 @@
+void old_uart_init(void);
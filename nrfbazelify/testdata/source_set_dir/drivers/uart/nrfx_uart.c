@@ -0,0 +1,3 @@
+#include "nrfx_uart.h"
+
+void nrfx_uart_init(void) {}
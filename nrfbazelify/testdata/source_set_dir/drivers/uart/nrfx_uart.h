@@ -0,0 +1,3 @@
+#include "uart_types.h"
+
+void nrfx_uart_init(void);
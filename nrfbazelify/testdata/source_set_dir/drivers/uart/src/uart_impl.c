@@ -0,0 +1,3 @@
+#include "uart_types.h"
+
+void uart_impl(void) {}
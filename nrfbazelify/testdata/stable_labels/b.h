@@ -0,0 +1,4 @@
+#ifndef B_H_
+#define B_H_
+#include "a.h"
+#endif
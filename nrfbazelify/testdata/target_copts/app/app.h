@@ -0,0 +1,2 @@
+#include "nrfx_spi.h"
+#include "foo.h"
@@ -0,0 +1 @@
+#include "nrfx_twi.h"
@@ -0,0 +1 @@
+#include "nrf_drv_spi.h"
@@ -0,0 +1 @@
+#include "mock_spi.h"
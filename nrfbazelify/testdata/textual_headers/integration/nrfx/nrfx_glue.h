@@ -0,0 +1,2 @@
+#include "apply_old_config.h"
+#include "nrf_assert.h"
@@ -0,0 +1 @@
+#include "nrfx_glue.h"
@@ -0,0 +1,3 @@
+#include "FreeRTOS.h"
+#include "ff.h"
+#include "uECC.h"
@@ -0,0 +1,3 @@
+#ifndef FF_H
+#define FF_H
+#endif
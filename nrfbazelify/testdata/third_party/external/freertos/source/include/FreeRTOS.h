@@ -0,0 +1,3 @@
+#ifndef FREERTOS_H
+#define FREERTOS_H
+#endif
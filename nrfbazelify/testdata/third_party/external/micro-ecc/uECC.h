@@ -0,0 +1,3 @@
+#ifndef UECC_H
+#define UECC_H
+#endif
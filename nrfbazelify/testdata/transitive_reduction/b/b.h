@@ -0,0 +1 @@
+#include "c.h"
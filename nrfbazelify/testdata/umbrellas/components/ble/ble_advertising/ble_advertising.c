@@ -0,0 +1 @@
+#include "ble_advertising.h"
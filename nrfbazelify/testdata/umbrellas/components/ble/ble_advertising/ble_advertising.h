@@ -0,0 +1 @@
+#include "ble_srv_common.h"
@@ -0,0 +1,3 @@
+#include "core_cm4.h"
+#include "sdk_config.h"
+#include "string.h"
@@ -0,0 +1,137 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+	"github.com/Michaelhobo/nrfbazel/internal/glob"
+)
+
+// In the nRF5 SDK, glue headers like apply_old_config.h are folded into the
+// libraries that include them, unless textual_headers disables it.
+const builtinTextualHeaders = "apply_*.h"
+
+// isTextualHeader reports whether the header with the given file name is
+// folded into the libraries that include it.
+func (conf *Config) isTextualHeader(fileName string) bool {
+  for _, pattern := range conf.TextualHeaders {
+    // A malformed textual_headers pattern never matches a file name here;
+    // Config.Validate reports it.
+    if matched, _ := glob.Match(pattern, fileName); matched {
+      return true
+    }
+  }
+  return false
+}
+
+// addTextualHeader records hdr as a textual header, if it is one.
+// Returns false if it isn't.
+func (s *SDKWalker) addTextualHeader(hdr *bazel.Label) bool {
+  if !s.conf.isTextualHeader(hdr.Name()) {
+    return false
+  }
+  s.textualHeaders[hdr.String()] = hdr
+  return true
+}
+
+// textualHeader finds the textual header that node's include names, or nil
+// if it isn't one. If several SDKs have it, the one in node's SDK is used.
+func (s *SDKWalker) textualHeader(node *LibraryNode, include string) (*bazel.Label, error) {
+  var matches []*bazel.Label
+  for _, hdr := range s.textualHeaders {
+    if hdr.Name() == filepath.Base(include) {
+      matches = append(matches, hdr)
+    }
+  }
+  switch len(matches) {
+  case 0:
+    return nil, nil
+  case 1:
+    return matches[0], nil
+  }
+  sdkDir := s.sdkDirOf(filepath.Join(s.conf.WorkspaceDir, node.Label().Dir()))
+  var own []*bazel.Label
+  for _, hdr := range matches {
+    if s.sdkDirOf(filepath.Join(s.conf.WorkspaceDir, hdr.Dir())) == sdkDir {
+      own = append(own, hdr)
+    }
+  }
+  if len(own) != 1 {
+    bazel.SortLabels(matches)
+    return nil, fmt.Errorf("%s: textual header %q is ambiguous: %s", node.Label(), include, bazel.JoinLabelStrings(matches, ", "))
+  }
+  return own[0], nil
+}
+
+// foldTextualHeaders replaces the includes of textual headers in deps with
+// the includes of the textual headers, and adds them to the node's TextualHdrs.
+func (s *SDKWalker) foldTextualHeaders(node *LibraryNode, deps map[string]bool) error {
+  if len(s.textualHeaders) == 0 {
+    return nil
+  }
+  var queue []string
+  for dep := range deps {
+    queue = append(queue, dep)
+  }
+  for len(queue) > 0 {
+    dep := queue[0]
+    queue = queue[1:]
+    hdr, err := s.textualHeader(node, dep)
+    if err != nil {
+      return err
+    }
+    if hdr == nil {
+      continue
+    }
+    delete(deps, dep)
+    if containsLabel(node.TextualHdrs, hdr) {
+      continue
+    }
+    node.TextualHdrs = append(node.TextualHdrs, hdr)
+    path := filepath.Join(s.conf.WorkspaceDir, hdr.Dir(), hdr.Name())
+    includes, _, err := readIncludes(path, false, s.conf.MacroIncludes, s.conf.DefinePruning.Defines)
+    if err != nil {
+      return fmt.Errorf("readIncludes(%q): %v", s.prettySDKPath(path), err)
+    }
+    for _, include := range includes {
+      if !deps[include] {
+        deps[include] = true
+        queue = append(queue, include)
+      }
+    }
+  }
+  bazel.SortLabels(node.TextualHdrs)
+  return nil
+}
+
+// addTextualHdrs adds the textual headers to lib, which has the given label.
+// Textual headers in other dirs are added to its includes, so they are found
+// by the library and its dependents, whose headers may include them too.
+func addTextualHdrs(lib *buildfile.Library, label *bazel.Label, textualHdrs []*bazel.Label) {
+  for _, hdr := range textualHdrs {
+    lib.TextualHdrs = append(lib.TextualHdrs, hdr.FileRelativeTo(label.Dir()))
+    if hdr.Dir() == label.Dir() {
+      continue
+    }
+    rel, err := filepath.Rel(label.Dir(), hdr.Dir())
+    if err != nil {
+      rel = hdr.Dir()
+    }
+    lib.Includes = appendMissing(lib.Includes, rel)
+  }
+  sort.Strings(lib.TextualHdrs)
+  sort.Strings(lib.Includes)
+}
+
+// appendMissingLabels appends the labels that aren't in list yet.
+func appendMissingLabels(list []*bazel.Label, labels ...*bazel.Label) []*bazel.Label {
+  for _, label := range labels {
+    if !containsLabel(list, label) {
+      list = append(list, label)
+    }
+  }
+  return list
+}
@@ -0,0 +1,304 @@
+package nrfbazelify
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+)
+
+const (
+  // Subdirectories of this dir, relative to the SDK root, are third-party
+  // components, unless third_party sets dirs.
+  defaultThirdPartyDir = "external"
+  // The name of the license rule in a component's root package.
+  licenseRuleName = "license"
+  // The components are listed in this file in .bazelify-out.
+  thirdPartyReportFilename = "third_party.tsv"
+  // License kinds are labels in rules_license, like
+  // @rules_license//licenses/spdx:MIT.
+  spdxLicenseKindPrefix = "@rules_license//licenses/spdx:"
+)
+
+var (
+  // SPDX license identifiers of the components that the nRF5 SDK vendors in
+  // external/, by dir name. Components that aren't here are reported with
+  // unknown licenses, until third_party sets their license_kinds.
+  knownThirdPartyLicenses = map[string]string{
+    "cifra_AES128-EAX": "CC0-1.0",
+    "freertos": "MIT",
+    "lwip": "BSD-3-Clause",
+    "mbedtls": "Apache-2.0",
+    "micro-ecc": "BSD-2-Clause",
+    "nano-pb": "Zlib",
+  }
+)
+
+// ThirdParty holds the third_party settings of the primary SDK.
+type ThirdParty struct {
+  Enabled bool
+  Dirs []string // absolute paths
+  Components map[string]*ThirdPartyComponent // absolute dir -> configured component
+}
+
+// ThirdPartyComponent is a vendored component and its license.
+type ThirdPartyComponent struct {
+  Dir string // absolute path
+  LicenseKinds []string // labels
+  LicenseText string // relative to Dir
+  PackageName string
+  PackageVersion string
+  Packages int // number of generated packages under Dir
+}
+
+// newThirdParty validates the third_party settings of the rc.
+func newThirdParty(sdkDir string, rc *bazelifyrc.ThirdParty) (ThirdParty, error) {
+  out := ThirdParty{
+    Enabled: rc.GetEnabled(),
+    Dirs: makeAbs(sdkDir, rc.GetDirs()),
+    Components: make(map[string]*ThirdPartyComponent),
+  }
+  if len(out.Dirs) == 0 {
+    out.Dirs = []string{filepath.Join(sdkDir, defaultThirdPartyDir)}
+  }
+  for _, c := range rc.GetComponents() {
+    dir := filepath.Join(sdkDir, c.GetDir())
+    if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+      return ThirdParty{}, fmt.Errorf("components %q: not a directory in the SDK", c.GetDir())
+    }
+    if out.Components[dir] != nil {
+      return ThirdParty{}, fmt.Errorf("components %q: has more than one entry", c.GetDir())
+    }
+    for _, kind := range c.GetLicenseKinds() {
+      if _, err := bazel.ParseLabel(kind); err != nil {
+        return ThirdParty{}, fmt.Errorf("components %q: license_kinds %q: %v", c.GetDir(), kind, err)
+      }
+    }
+    if text := c.GetLicenseText(); text != "" {
+      if clean := filepath.Clean(text); filepath.IsAbs(text) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+        return ThirdParty{}, fmt.Errorf("components %q: license_text %q is outside the component", c.GetDir(), text)
+      }
+      if _, err := os.Stat(filepath.Join(dir, text)); err != nil {
+        return ThirdParty{}, fmt.Errorf("components %q: license_text: %v", c.GetDir(), err)
+      }
+    }
+    out.Components[dir] = &ThirdPartyComponent{
+      Dir: dir,
+      LicenseKinds: c.GetLicenseKinds(),
+      LicenseText: c.GetLicenseText(),
+      PackageName: c.GetPackageName(),
+      PackageVersion: c.GetPackageVersion(),
+    }
+  }
+  return out, nil
+}
+
+// findThirdParty returns the configured components, and the subdirectories
+// of the third_party dirs that aren't excluded, sorted by dir.
+// Licenses and package names that aren't configured are detected.
+func findThirdParty(conf *Config) ([]*ThirdPartyComponent, error) {
+  byDir := make(map[string]*ThirdPartyComponent)
+  for dir, c := range conf.ThirdParty.Components {
+    copied := *c
+    byDir[dir] = &copied
+  }
+  for _, dir := range conf.ThirdParty.Dirs {
+    entries, err := os.ReadDir(dir)
+    if os.IsNotExist(err) {
+      continue
+    }
+    if err != nil {
+      return nil, fmt.Errorf("os.ReadDir(%q): %v", dir, err)
+    }
+    for _, entry := range entries {
+      path := filepath.Join(dir, entry.Name())
+      if !entry.IsDir() || byDir[path] != nil {
+        continue
+      }
+      excluded, err := conf.excluded(path)
+      if err != nil {
+        return nil, err
+      }
+      if !excluded {
+        byDir[path] = &ThirdPartyComponent{Dir: path}
+      }
+    }
+  }
+  var out []*ThirdPartyComponent
+  for _, c := range byDir {
+    name := filepath.Base(c.Dir)
+    if c.PackageName == "" {
+      c.PackageName = name
+    }
+    if len(c.LicenseKinds) == 0 && knownThirdPartyLicenses[name] != "" {
+      c.LicenseKinds = []string{spdxLicenseKindPrefix + knownThirdPartyLicenses[name]}
+    }
+    if c.LicenseText == "" {
+      text, err := findLicenseText(c.Dir)
+      if err != nil {
+        return nil, err
+      }
+      c.LicenseText = text
+    }
+    out = append(out, c)
+  }
+  sort.Slice(out, func(i, j int) bool {
+    return out[i].Dir < out[j].Dir
+  })
+  return out, nil
+}
+
+// findLicenseText returns the name of the license file in dir, like LICENSE
+// or COPYING.txt. Returns "" if there isn't exactly one.
+func findLicenseText(dir string) (string, error) {
+  entries, err := os.ReadDir(dir)
+  if err != nil {
+    return "", fmt.Errorf("os.ReadDir(%q): %v", dir, err)
+  }
+  var found []string
+  for _, entry := range entries {
+    lower := strings.ToLower(entry.Name())
+    if !entry.IsDir() && (strings.HasPrefix(lower, "license") || strings.HasPrefix(lower, "copying")) {
+      found = append(found, entry.Name())
+    }
+  }
+  if len(found) != 1 {
+    return "", nil
+  }
+  return found[0], nil
+}
+
+// applyThirdPartyLicenses adds a license rule to the root package of every
+// third-party component with generated packages, and sets the
+// default_applicable_licenses of those packages. Returns the components, with
+// the number of their packages.
+func applyThirdPartyLicenses(conf *Config, files map[string]*buildfile.File) ([]*ThirdPartyComponent, error) {
+  if !conf.ThirdParty.Enabled {
+    return nil, nil
+  }
+  components, err := findThirdParty(conf)
+  if err != nil {
+    return nil, err
+  }
+  // Nested components get their own license, so longer dirs match first.
+  byLength := append([]*ThirdPartyComponent{}, components...)
+  sort.SliceStable(byLength, func(i, j int) bool {
+    return len(byLength[i].Dir) > len(byLength[j].Dir)
+  })
+  componentDirs := make(map[*ThirdPartyComponent]string)
+  for _, c := range byLength {
+    rel, err := filepath.Rel(conf.WorkspaceDir, c.Dir)
+    if err != nil {
+      return nil, fmt.Errorf("filepath.Rel: %v", err)
+    }
+    componentDirs[c] = rel
+  }
+  packages := make(map[*ThirdPartyComponent][]string)
+  for dir := range files {
+    for _, c := range byLength {
+      rel := componentDirs[c]
+      if dir == rel || strings.HasPrefix(dir, rel+string(filepath.Separator)) {
+        packages[c] = append(packages[c], dir)
+        break
+      }
+    }
+  }
+  for _, c := range components {
+    if len(packages[c]) == 0 {
+      continue
+    }
+    c.Packages = len(packages[c])
+    rel := componentDirs[c]
+    if files[rel] == nil {
+      files[rel] = buildfile.New(c.Dir)
+    }
+    root := files[rel]
+    root.AddLoad(&buildfile.Load{
+      Source: "@rules_license//rules:license.bzl",
+      Symbols: []string{"license"},
+    })
+    rule := buildfile.NewRule("license", licenseRuleName)
+    if len(c.LicenseKinds) > 0 {
+      rule.SetAttr("license_kinds", buildfile.StringList(c.LicenseKinds))
+    }
+    if c.LicenseText != "" {
+      text, err := licenseTextLabel(conf, files, c, rel)
+      if err != nil {
+        return nil, err
+      }
+      rule.SetAttr("license_text", buildfile.String(text))
+    }
+    rule.SetAttr("package_name", buildfile.String(c.PackageName))
+    if c.PackageVersion != "" {
+      rule.SetAttr("package_version", buildfile.String(c.PackageVersion))
+    }
+    root.AddRule(rule)
+    license, err := bazel.NewLabel(c.Dir, licenseRuleName, conf.WorkspaceDir)
+    if err != nil {
+      return nil, fmt.Errorf("bazel.NewLabel(%q): %v", c.Dir, err)
+    }
+    root.SetPackageLicenses([]string{":" + licenseRuleName})
+    for _, dir := range packages[c] {
+      if dir != rel {
+        files[dir].SetPackageLicenses([]string{license.String()})
+      }
+    }
+  }
+  return components, nil
+}
+
+// licenseTextLabel returns the label of the component's license_text, relative
+// to the component's root package at rel. If a generated package under the
+// root has the file, the file is exported from it.
+func licenseTextLabel(conf *Config, files map[string]*buildfile.File, c *ThirdPartyComponent, rel string) (string, error) {
+  path := filepath.Join(c.Dir, c.LicenseText)
+  for dir := filepath.Dir(path); dir != c.Dir && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+    pkg, err := filepath.Rel(conf.WorkspaceDir, dir)
+    if err != nil {
+      return "", fmt.Errorf("filepath.Rel: %v", err)
+    }
+    if files[pkg] == nil {
+      continue
+    }
+    label, err := bazel.NewFileLabel(dir, path, conf.WorkspaceDir)
+    if err != nil {
+      return "", fmt.Errorf("bazel.NewFileLabel(%q): %v", path, err)
+    }
+    files[pkg].ExportFile(label.Name())
+    return label.String(), nil
+  }
+  return filepath.ToSlash(c.LicenseText), nil
+}
+
+// writeThirdPartyReport lists the components in dir, with their licenses and
+// how many generated packages they have.
+func writeThirdPartyReport(conf *Config, dir string, components []*ThirdPartyComponent) error {
+  var out bytes.Buffer
+  out.WriteString("dir\tpackage_name\tpackage_version\tlicense_kinds\tlicense_text\tpackages\n")
+  for _, c := range components {
+    rel, err := filepath.Rel(conf.SDKDir, c.Dir)
+    if err != nil {
+      return fmt.Errorf("filepath.Rel: %v", err)
+    }
+    kinds := "unknown"
+    if len(c.LicenseKinds) > 0 {
+      kinds = strings.Join(c.LicenseKinds, ",")
+    }
+    text := c.LicenseText
+    if text == "" {
+      text = "unknown"
+    }
+    fmt.Fprintf(&out, "%s\t%s\t%s\t%s\t%s\t%d\n", filepath.ToSlash(rel), c.PackageName, c.PackageVersion, kinds, text, c.Packages)
+  }
+  path := filepath.Join(dir, thirdPartyReportFilename)
+  if err := writeFileAtomic(path, out.Bytes(), 0644); err != nil {
+    return fmt.Errorf("writeFileAtomic(%q): %v", path, err)
+  }
+  return nil
+}
@@ -0,0 +1,295 @@
+package nrfbazelify
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+)
+
+const (
+  // toolchain/ is generated in the primary SDK root, like chips/.
+  toolchainDir = "toolchain"
+  toolchainBzlFilename = "toolchain.bzl"
+  // Lines to import from the workspace's .bazelrc.
+  toolchainBazelrcFilename = "bazelrc"
+  // The toolchain() that --extra_toolchains registers.
+  toolchainName = "arm_none_eabi_toolchain"
+  // The platform that --platforms picks, and the name of the --config.
+  toolchainPlatformName = "nrf52"
+)
+
+var (
+  // The float flags are picked per chip, see hardFloatFlags.
+  defaultToolchainCopts = []string{
+    "-mcpu=cortex-m4",
+    "-mthumb",
+    "-mabi=aapcs",
+    "-ffunction-sections",
+    "-fdata-sections",
+    "-fno-strict-aliasing",
+    "-fno-builtin",
+    "-fshort-enums",
+  }
+  defaultToolchainLinkopts = []string{
+    "-mcpu=cortex-m4",
+    "-mthumb",
+    "-mabi=aapcs",
+    "-Wl,--gc-sections",
+    "--specs=nano.specs",
+    "-lc",
+    "-lnosys",
+    "-lm",
+  }
+  // Float flags of every compile and link, for chips with an FPU and for
+  // chips without one, like the nRF52810.
+  hardFloatFlags = []string{"-mfloat-abi=hard", "-mfpu=fpv4-sp-d16"}
+  softFloatFlags = []string{"-mfloat-abi=soft"}
+)
+
+var toolchainBzlTemplate = template.Must(template.New("toolchainBzl").Parse(`"""An arm-none-eabi-gcc toolchain config for nRF52 chips."""
+
+load("@bazel_tools//tools/build_defs/cc:action_names.bzl", "ACTION_NAMES")
+load("@bazel_tools//tools/cpp:cc_toolchain_config_lib.bzl", "feature", "flag_group", "flag_set", "tool_path")
+
+GCC_DIR = "{{ .GCCDir }}"
+
+PREFIX = "{{ .Prefix }}"
+
+BUILTIN_INCLUDE_DIRS = {{ .BuiltinIncludeDirs }}
+
+COPTS = {{ .Copts }}
+
+LINKOPTS = {{ .Linkopts }}
+
+_TOOLS = ["ar", "cpp", "gcc", "gcov", "ld", "nm", "objcopy", "objdump", "strip"]
+
+_COMPILE_ACTIONS = [
+    ACTION_NAMES.assemble,
+    ACTION_NAMES.preprocess_assemble,
+    ACTION_NAMES.c_compile,
+    ACTION_NAMES.cpp_compile,
+]
+
+_LINK_ACTIONS = [
+    ACTION_NAMES.cpp_link_executable,
+]
+
+def _arm_none_eabi_toolchain_config_impl(ctx):
+    return cc_common.create_cc_toolchain_config_info(
+        ctx = ctx,
+        toolchain_identifier = "arm-none-eabi",
+        host_system_name = "local",
+        target_system_name = "arm-none-eabi",
+        target_cpu = "armv7e-m",
+        target_libc = "newlib",
+        compiler = "gcc",
+        abi_version = "eabi",
+        abi_libc_version = "newlib",
+        tool_paths = [
+            tool_path(name = tool, path = "{}/bin/{}{}".format(GCC_DIR, PREFIX, tool))
+            for tool in _TOOLS
+        ],
+        features = [
+            feature(
+                name = "default_compile_flags",
+                enabled = True,
+                flag_sets = [flag_set(actions = _COMPILE_ACTIONS, flag_groups = [flag_group(flags = COPTS + ctx.attr.float_flags)])],
+            ),
+            feature(
+                name = "default_link_flags",
+                enabled = True,
+                flag_sets = [flag_set(actions = _LINK_ACTIONS, flag_groups = [flag_group(flags = LINKOPTS + ctx.attr.float_flags)])],
+            ),
+        ],
+        cxx_builtin_include_directories = BUILTIN_INCLUDE_DIRS,
+    )
+
+arm_none_eabi_toolchain_config = rule(
+    implementation = _arm_none_eabi_toolchain_config_impl,
+    attrs = {
+        # -mfloat-abi and -mfpu for the target chip.
+        "float_flags": attr.string_list(),
+    },
+    provides = [CcToolchainConfigInfo],
+)
+`))
+
+var toolchainBuildTemplate = template.Must(template.New("toolchainBuild").Parse(`load(":{{ .Bzl }}", "arm_none_eabi_toolchain_config")
+
+package(default_visibility = ["//visibility:public"])
+
+filegroup(name = "empty")
+
+arm_none_eabi_toolchain_config(
+    name = "arm_none_eabi_config",
+{{- if .FloatFlags }}
+    float_flags = select({
+{{- range .FloatFlags }}
+        "{{ .Condition }}": {{ .Flags }},
+{{- end }}
+    }),
+{{- end }}
+)
+
+cc_toolchain(
+    name = "arm_none_eabi_cc_toolchain",
+    all_files = ":empty",
+    compiler_files = ":empty",
+    dwp_files = ":empty",
+    linker_files = ":empty",
+    objcopy_files = ":empty",
+    strip_files = ":empty",
+    supports_param_files = 0,
+    toolchain_config = ":arm_none_eabi_config",
+)
+
+toolchain(
+    name = "{{ .Toolchain }}",
+    target_compatible_with = [
+        "@platforms//cpu:armv7e-m",
+        "@platforms//os:none",
+    ],
+    toolchain = ":arm_none_eabi_cc_toolchain",
+    toolchain_type = "@bazel_tools//tools/cpp:toolchain_type",
+)
+
+platform(
+    name = "{{ .Platform }}",
+    constraint_values = [
+        "@platforms//cpu:armv7e-m",
+        "@platforms//os:none",
+    ],
+)
+`))
+
+var toolchainBazelrcTemplate = template.Must(template.New("toolchainBazelrc").Parse(`# Use it by adding this line to your .bazelrc:
+#   import %workspace%/{{ .Path }}
+# and build with --config={{ .Config }}.
+build:{{ .Config }} --incompatible_enable_cc_toolchain_resolution
+build:{{ .Config }} --extra_toolchains={{ .Toolchain }}
+build:{{ .Config }} --platforms={{ .Platform }}
+`))
+
+// Toolchain configures the generated arm-none-eabi-gcc toolchain.
+type Toolchain struct {
+  Enabled bool
+  GCCDir, Prefix string
+  BuiltinIncludeDirs []string
+  Copts, Linkopts []string
+}
+
+// floatFlagsCase is a branch of the float_flags select() in toolchain/BUILD.
+type floatFlagsCase struct {
+  Condition, Flags string
+}
+
+// floatFlags returns the branches of the float_flags select(): soft-float
+// for the chips without an FPU, and hard-float for the rest. Returns nil if
+// copts or linkopts set -mfloat-abi themselves.
+func floatFlags(conf *Config, tc Toolchain) ([]*floatFlagsCase, error) {
+  for _, opt := range append(append([]string(nil), tc.Copts...), tc.Linkopts...) {
+    if strings.HasPrefix(opt, "-mfloat-abi") {
+      return nil, nil
+    }
+  }
+  var out []*floatFlagsCase
+  for _, chip := range knownChips {
+    if !chip.NoFPU {
+      continue
+    }
+    label, err := chipsLabel(conf, chip.ConfigSetting())
+    if err != nil {
+      return nil, err
+    }
+    out = append(out, &floatFlagsCase{Condition: label.String(), Flags: starlarkList(softFloatFlags)})
+  }
+  return append(out, &floatFlagsCase{Condition: "//conditions:default", Flags: starlarkList(hardFloatFlags)}), nil
+}
+
+// withDefaults fills in the unset fields of t.
+func (t Toolchain) withDefaults() Toolchain {
+  if t.GCCDir == "" {
+    t.GCCDir = "/usr"
+  }
+  t.GCCDir = strings.TrimSuffix(t.GCCDir, "/")
+  if t.Prefix == "" {
+    t.Prefix = "arm-none-eabi-"
+  }
+  if len(t.BuiltinIncludeDirs) == 0 {
+    target := strings.TrimSuffix(t.Prefix, "-")
+    t.BuiltinIncludeDirs = []string{
+      filepath.Join(t.GCCDir, "lib", "gcc", target),
+      filepath.Join(t.GCCDir, target, "include"),
+      // Debian's gcc-arm-none-eabi puts newlib here.
+      filepath.Join(t.GCCDir, "include", "newlib"),
+    }
+  }
+  if len(t.Copts) == 0 {
+    t.Copts = defaultToolchainCopts
+  }
+  if len(t.Linkopts) == 0 {
+    t.Linkopts = defaultToolchainLinkopts
+  }
+  return t
+}
+
+// toolchainFiles generates toolchain/BUILD, toolchain/toolchain.bzl and
+// toolchain/bazelrc, by path relative to the workspace.
+func toolchainFiles(conf *Config) (map[string][]byte, error) {
+  dir := filepath.Join(conf.SDKDir, toolchainDir)
+  toolchainLabel, err := bazel.NewLabel(dir, toolchainName, conf.WorkspaceDir)
+  if err != nil {
+    return nil, fmt.Errorf("bazel.NewLabel(%q, %q): %v", dir, toolchainName, err)
+  }
+  platformLabel, err := bazel.NewLabel(dir, toolchainPlatformName, conf.WorkspaceDir)
+  if err != nil {
+    return nil, fmt.Errorf("bazel.NewLabel(%q, %q): %v", dir, toolchainPlatformName, err)
+  }
+  relDir := toolchainLabel.Dir()
+  tc := conf.Toolchain.withDefaults()
+
+  out := make(map[string][]byte)
+  var bzl bytes.Buffer
+  if err := toolchainBzlTemplate.Execute(&bzl, map[string]string{
+    "GCCDir": tc.GCCDir,
+    "Prefix": tc.Prefix,
+    "BuiltinIncludeDirs": starlarkList(tc.BuiltinIncludeDirs),
+    "Copts": starlarkList(tc.Copts),
+    "Linkopts": starlarkList(tc.Linkopts),
+  }); err != nil {
+    return nil, fmt.Errorf("toolchainBzlTemplate.Execute: %v", err)
+  }
+  out[filepath.Join(relDir, toolchainBzlFilename)] = bzl.Bytes()
+
+  floats, err := floatFlags(conf, tc)
+  if err != nil {
+    return nil, fmt.Errorf("floatFlags: %v", err)
+  }
+  var build bytes.Buffer
+  if err := toolchainBuildTemplate.Execute(&build, map[string]interface{}{
+    "Bzl": toolchainBzlFilename,
+    "Toolchain": toolchainName,
+    "Platform": toolchainPlatformName,
+    "FloatFlags": floats,
+  }); err != nil {
+    return nil, fmt.Errorf("toolchainBuildTemplate.Execute: %v", err)
+  }
+  out[filepath.Join(relDir, "BUILD")] = build.Bytes()
+
+  bazelrcPath := filepath.Join(relDir, toolchainBazelrcFilename)
+  var bazelrc bytes.Buffer
+  if err := toolchainBazelrcTemplate.Execute(&bazelrc, map[string]string{
+    "Path": bazelrcPath,
+    "Config": toolchainPlatformName,
+    "Toolchain": toolchainLabel.String(),
+    "Platform": platformLabel.String(),
+  }); err != nil {
+    return nil, fmt.Errorf("toolchainBazelrcTemplate.Execute: %v", err)
+  }
+  out[bazelrcPath] = bazelrc.Bytes()
+  return out, nil
+}
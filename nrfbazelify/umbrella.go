@@ -0,0 +1,80 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+)
+
+// applyUmbrellas adds the umbrellas, libraries that depend on every generated
+// library in their package and the packages below it. Testonly libraries are
+// left out, so the umbrellas don't have to be testonly.
+func applyUmbrellas(conf *Config, files map[string]*buildfile.File) error {
+  if len(conf.Umbrellas) == 0 {
+    return nil
+  }
+  var labels []*bazel.Label
+  for dir, file := range files {
+    file.EachLibrary(func(lib *buildfile.Library) {
+      if lib.Testonly {
+        return
+      }
+      label, err := bazel.NewLabel(filepath.Join(conf.WorkspaceDir, dir), lib.Name, conf.WorkspaceDir)
+      if err != nil {
+        return
+      }
+      labels = append(labels, label)
+    })
+  }
+  bazel.SortLabels(labels)
+  for _, umbrella := range conf.Umbrellas {
+    if err := checkUmbrellaDir(conf, umbrella); err != nil {
+      return err
+    }
+    var deps []string
+    for _, label := range labels {
+      if umbrella.Dir() == "" || label.Dir() == umbrella.Dir() || strings.HasPrefix(label.Dir(), umbrella.Dir() + "/") {
+        deps = append(deps, label.RelativeTo(umbrella))
+      }
+    }
+    // Most likely a typo, like with target patterns.
+    if len(deps) == 0 {
+      return fmt.Errorf("%s: no generated libraries in or below %s", umbrella, umbrella.Dir())
+    }
+    sort.Strings(deps)
+    dir := filepath.FromSlash(umbrella.Dir())
+    if files[dir] == nil {
+      files[dir] = buildfile.New(filepath.Join(conf.WorkspaceDir, dir))
+    }
+    if files[dir].HasRule(umbrella.Name()) {
+      return fmt.Errorf("%s: a generated target has the same name", umbrella)
+    }
+    files[dir].AddLibrary(&buildfile.Library{
+      Name: umbrella.Name(),
+      Deps: deps,
+      // It has no srcs, and the sdk_config dep of nrf_cc_library would be a
+      // cycle if the flag's default is below it.
+      NoSDKConfig: conf.NrfCcLibrary.Enabled,
+    })
+  }
+  return nil
+}
+
+// checkUmbrellaDir checks that the umbrella is in one of the SDKs, so its
+// BUILD file doesn't replace a hand-written one.
+func checkUmbrellaDir(conf *Config, umbrella *bazel.Label) error {
+  if umbrella.Repo() != "" {
+    return fmt.Errorf("%s: umbrellas can't be in external repositories", umbrella)
+  }
+  dir := filepath.Join(conf.WorkspaceDir, filepath.FromSlash(umbrella.Dir()))
+  for _, sdkDir := range conf.SDKDirs {
+    if dir == sdkDir || strings.HasPrefix(dir, sdkDir + string(filepath.Separator)) {
+      return nil
+    }
+  }
+  return fmt.Errorf("%s: not in any of the SDKs", umbrella)
+}
@@ -0,0 +1,48 @@
+package nrfbazelify
+
+import (
+	"sort"
+)
+
+// UnmatchedEntries are the entries in the primary SDK's .bazelifyrc that no
+// include matched while resolving, like include_overrides for headers that
+// were deleted from the SDK. Entries from presets aren't reported.
+type UnmatchedEntries struct {
+  IncludeOverrides []string
+  Remaps []string
+  IgnoreHeaders []string
+}
+
+// Len returns the number of unmatched entries.
+func (u *UnmatchedEntries) Len() int {
+  if u == nil {
+    return 0
+  }
+  return len(u.IncludeOverrides) + len(u.Remaps) + len(u.IgnoreHeaders)
+}
+
+// Unmatched returns the entries of the primary SDK's .bazelifyrc that no
+// include matched. Only valid after PopulateGraph.
+func (s *SDKWalker) Unmatched() *UnmatchedEntries {
+  rc := s.conf.BazelifyRCProto
+  out := &UnmatchedEntries{}
+  for _, override := range rc.GetIncludeOverrides() {
+    if !s.matchedOverrides[override.GetInclude()] {
+      out.IncludeOverrides = append(out.IncludeOverrides, override.GetInclude())
+    }
+  }
+  for _, header := range rc.GetRemaps() {
+    if !s.matchedOverrides[header] {
+      out.Remaps = append(out.Remaps, header)
+    }
+  }
+  for _, ignore := range rc.GetIgnoreHeaders() {
+    if !s.matchedIgnores[ignore] {
+      out.IgnoreHeaders = append(out.IgnoreHeaders, ignore)
+    }
+  }
+  sort.Strings(out.IncludeOverrides)
+  sort.Strings(out.Remaps)
+  sort.Strings(out.IgnoreHeaders)
+  return out
+}
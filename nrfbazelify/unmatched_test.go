@@ -0,0 +1,28 @@
+package nrfbazelify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResolve_Unmatched(t *testing.T) {
+  workspaceDir, sdkDir := setup(t, "unmatched_entries")
+  conf, err := ReadConfig([]string{sdkDir}, workspaceDir, VerbosityPhases)
+  if err != nil {
+    t.Fatalf("ReadConfig: %v", err)
+  }
+  res, err := resolve(context.Background(), conf, NewDependencyGraph(conf, ""))
+  if err != nil {
+    t.Fatalf("resolve: %v", err)
+  }
+  want := &UnmatchedEntries{
+    IncludeOverrides: []string{"nrf_deleted.h"},
+    Remaps: []string{"app_config.h"},
+    IgnoreHeaders: []string{"*_iar.h", "stdio.h"},
+  }
+  if diff := cmp.Diff(want, res.unmatched); diff != "" {
+    t.Errorf("unmatched (-want +got):\n%s", diff)
+  }
+}
@@ -0,0 +1,30 @@
+package nrfbazelify
+
+import (
+	"log"
+)
+
+// Verbosity is how much nrfbazelify logs about what it's doing. Each level
+// logs everything the levels below it do.
+type Verbosity int
+
+const (
+  // VerbosityQuiet only logs warnings and results.
+  VerbosityQuiet Verbosity = iota
+  // VerbosityPhases logs a summary of each phase, like how many nodes were
+  // added to the graph, and the presets that were used.
+  VerbosityPhases
+  // VerbosityResolutions logs how every include of every file was resolved.
+  VerbosityResolutions
+  // VerbosityCandidates logs the candidates for every include, before one
+  // is chosen.
+  VerbosityCandidates
+)
+
+// logf logs the message if the verbosity is at least v.
+func (c *Config) logf(v Verbosity, format string, args ...interface{}) {
+  if c == nil || c.Verbosity < v {
+    return
+  }
+  log.Printf(format, args...)
+}
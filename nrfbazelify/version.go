@@ -0,0 +1,23 @@
+package nrfbazelify
+
+import (
+	"runtime/debug"
+)
+
+// Version is the version of nrfbazelify in the banner of generated files. It
+// can be set when building, with
+//   -ldflags "-X github.com/Michaelhobo/nrfbazel/nrfbazelify.Version=v1.2.3"
+// and defaults to the module version, which go install sets.
+var Version string
+
+// version returns Version, or the module version, or "devel" for local
+// builds.
+func version() string {
+  if Version != "" {
+    return Version
+  }
+  if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+    return info.Main.Version
+  }
+  return "devel"
+}
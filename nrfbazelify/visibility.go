@@ -0,0 +1,199 @@
+package nrfbazelify
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Michaelhobo/nrfbazel/internal/buildfile"
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+)
+
+const (
+  publicVisibility = "//visibility:public"
+  privateVisibility = "//visibility:private"
+)
+
+var (
+  packageGroupNameMatcher = regexp.MustCompile(`^\w+$`)
+)
+
+// TargetVisibility is the visibility of every generated library that one of
+// the targets matches.
+type TargetVisibility struct {
+  Targets []*TargetPattern
+  Visibility []string
+}
+
+// validateVisibility checks that every entry of a visibility is a label.
+func validateVisibility(visibility []string) error {
+  for _, v := range visibility {
+    if !strings.HasPrefix(v, "//") && !strings.HasPrefix(v, "@") {
+      return fmt.Errorf("%q is not an absolute label", v)
+    }
+    if v == privateVisibility && len(visibility) > 1 {
+      return fmt.Errorf("%s can't be combined with other labels", privateVisibility)
+    }
+  }
+  return nil
+}
+
+// PackageGroup is a package_group generated in the primary SDK root.
+type PackageGroup struct {
+  Name string
+  Packages []string
+  Includes []string // names of other package groups
+  Targets []*TargetPattern // libraries that are visible to the group
+}
+
+// newPackageGroups validates the package_groups of the rc.
+func newPackageGroups(groups []*bazelifyrc.PackageGroup) ([]*PackageGroup, error) {
+  names := make(map[string]bool)
+  for _, g := range groups {
+    if !packageGroupNameMatcher.MatchString(g.GetName()) {
+      return nil, fmt.Errorf("invalid name %q", g.GetName())
+    }
+    if names[g.GetName()] {
+      return nil, fmt.Errorf("%q has more than one entry", g.GetName())
+    }
+    names[g.GetName()] = true
+  }
+  var out []*PackageGroup
+  for _, g := range groups {
+    for _, pkg := range g.GetPackages() {
+      if pkg != "public" && pkg != "private" && !strings.HasPrefix(strings.TrimPrefix(pkg, "-"), "//") {
+        return nil, fmt.Errorf("%q: invalid package specification %q", g.GetName(), pkg)
+      }
+    }
+    for _, include := range g.GetIncludes() {
+      if !names[include] {
+        return nil, fmt.Errorf("%q: includes unknown package group %q", g.GetName(), include)
+      }
+    }
+    group := &PackageGroup{
+      Name: g.GetName(),
+      Packages: g.GetPackages(),
+      Includes: g.GetIncludes(),
+    }
+    if len(g.GetTargets()) > 0 {
+      targets, err := parseTargetPatterns(g.GetTargets())
+      if err != nil {
+        return nil, fmt.Errorf("%q: %v", g.GetName(), err)
+      }
+      group.Targets = targets
+    }
+    out = append(out, group)
+  }
+  return out, nil
+}
+
+// sdkVisibility adds the packages of every SDK to visibility, unless it's
+// public, so generated libraries can still depend on each other.
+func sdkVisibility(conf *Config, visibility []string) ([]string, error) {
+  var out []string
+  for _, v := range visibility {
+    if v == publicVisibility {
+      return visibility, nil
+    }
+    // Bazel rejects private combined with anything else.
+    if v != privateVisibility {
+      out = append(out, v)
+    }
+  }
+  for _, sdkDir := range conf.SDKDirs {
+    rel, err := filepath.Rel(conf.WorkspaceDir, sdkDir)
+    if err != nil {
+      return nil, fmt.Errorf("filepath.Rel: %v", err)
+    }
+    if rel == "." {
+      rel = ""
+    }
+    out = appendMissing(out, fmt.Sprintf("//%s:__subpackages__", filepath.ToSlash(rel)))
+  }
+  return out, nil
+}
+
+// applyVisibility sets the default_visibility of every generated package but
+// chips, and the visibility of the libraries that package_groups and
+// target_visibility match, in that order.
+func applyVisibility(conf *Config, files map[string]*buildfile.File) error {
+  if conf.DefaultVisibility != nil {
+    visibility, err := sdkVisibility(conf, conf.DefaultVisibility)
+    if err != nil {
+      return err
+    }
+    sdkFromWorkspace, err := filepath.Rel(conf.WorkspaceDir, conf.SDKDir)
+    if err != nil {
+      return fmt.Errorf("filepath.Rel: %v", err)
+    }
+    for dir, file := range files {
+      // Applications select() on the chips' config_settings, and build for
+      // their platforms.
+      if dir == filepath.Join(sdkFromWorkspace, chipsDir) {
+        continue
+      }
+      file.SetPackageVisibility(visibility)
+    }
+  }
+  if err := applyPackageGroups(conf, files); err != nil {
+    return err
+  }
+  for _, t := range conf.TargetVisibility {
+    visibility, err := sdkVisibility(conf, t.Visibility)
+    if err != nil {
+      return err
+    }
+    if err := eachMatchingLibrary(conf, files, t.Targets, func(lib *buildfile.Library) {
+      lib.Visibility = visibility
+    }); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// applyPackageGroups adds the package_groups to the BUILD file of the SDK
+// root, and makes the libraries they match only visible to them.
+func applyPackageGroups(conf *Config, files map[string]*buildfile.File) error {
+  if len(conf.PackageGroups) == 0 {
+    return nil
+  }
+  sdkFromWorkspace, err := filepath.Rel(conf.WorkspaceDir, conf.SDKDir)
+  if err != nil {
+    return fmt.Errorf("filepath.Rel: %v", err)
+  }
+  if files[sdkFromWorkspace] == nil {
+    files[sdkFromWorkspace] = buildfile.New(conf.SDKDir)
+  }
+  groupLabel := func(name string) string {
+    if sdkFromWorkspace == "." {
+      return "//:" + name
+    }
+    return fmt.Sprintf("//%s:%s", filepath.ToSlash(sdkFromWorkspace), name)
+  }
+  for _, group := range conf.PackageGroups {
+    var includes []string
+    for _, include := range group.Includes {
+      includes = append(includes, groupLabel(include))
+    }
+    files[sdkFromWorkspace].AddPackageGroup(&buildfile.PackageGroup{
+      Name: group.Name,
+      Packages: group.Packages,
+      Includes: includes,
+    })
+    if group.Targets == nil {
+      continue
+    }
+    visibility, err := sdkVisibility(conf, []string{groupLabel(group.Name)})
+    if err != nil {
+      return err
+    }
+    if err := eachMatchingLibrary(conf, files, group.Targets, func(lib *buildfile.Library) {
+      lib.Visibility = visibility
+    }); err != nil {
+      return fmt.Errorf("package_groups %q: %v", group.Name, err)
+    }
+  }
+  return nil
+}
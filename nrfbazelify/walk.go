@@ -2,6 +2,7 @@ package nrfbazelify
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -10,31 +11,127 @@ import (
 	"strings"
 
 	"github.com/Michaelhobo/nrfbazel/internal/bazel"
+	"github.com/Michaelhobo/nrfbazel/proto/bazelifyrc"
+)
+
+const (
+  // How includes are resolved, in the stats.
+  resolvedByOverride = "include_overrides"
+  resolvedBySearchPath = "search_paths"
+  resolvedByOnlyCandidate = "only_candidate"
+  resolvedAutomatically = "automatic"
+  notResolvedAngled = "angled_not_in_sdk"
+  unresolvedInclude = "unresolved"
 )
 
 var (
   includeMatcher = regexp.MustCompile("^\\s*#include\\s+\"(.+)\".*$")
+  angleIncludeMatcher = regexp.MustCompile("^\\s*#include\\s+<(.+)>.*$")
+  macroIncludeMatcher = regexp.MustCompile("^\\s*#include\\s+([A-Za-z_][A-Za-z0-9_]*)\\s*(?:(?://|/\\*).*)?$")
+  macroMatcher = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
 )
 
 func NewSDKWalker(conf *Config, graph *DependencyGraph) (*SDKWalker, error) {
   return &SDKWalker{
     conf: conf,
     graph: graph,
+    autoResolved: make(autoResolutions),
+    resolutionMethods: make(map[string]int),
+    matchedOverrides: make(map[string]bool),
+    matchedIgnores: make(map[string]bool),
+    mdkDirs: make(map[string]bool),
+    mdkLinkerScripts: make(map[string]bool),
+    softDevices: make(softDevices),
+    logBackends: make(map[string]*logBackend),
+    textualHeaders: make(map[string]*bazel.Label),
+    cmsisHeaders: make(map[string][]*bazel.Label),
+    dirLibraries: make(map[string]*dirLibrary),
+    dirLibraryHeaders: make(map[string]*bazel.Label),
   }, nil
 }
 
 type SDKWalker struct {
   conf *Config
   graph *DependencyGraph
+  buildFiles []string
+  autoResolved autoResolutions
+  resolutionMethods map[string]int // how includes were resolved -> count
+  matchedOverrides map[string]bool // include_overrides and remaps that an include matched
+  matchedIgnores map[string]bool // ignore_headers entries that an include matched
+  lock *LockFile // previous resolutions to honor, or nil
+  mdkDirs map[string]bool // dirs with MDK system files
+  softDevices softDevices
+  logBackends map[string]*logBackend // nrf_log backend, like "rtt" -> its library
+  textualHeaders map[string]*bazel.Label // label.String() -> textual header
+  cmsisHeaders map[string][]*bazel.Label // dir -> CMSIS core headers in it
+  dirLibraries map[string]*dirLibrary // dir -> its files, with per_directory granularity
+  dirLibraryHeaders map[string]*bazel.Label // header path -> its dir's library
+  sdkConfigFound bool // whether any sdk_config.h was walked
+  linkerScripts []string // paths of .ld files
+  mdkLinkerScripts map[string]bool // paths of .ld files in an MDK's linker_scripts
+  filegroupFiles []string // paths of files with a filegroup_extensions extension
+  sourceFiles []string // paths of .c files, for attachOrphanSources
+  orphanSources []string // labels of .c files in no library
+  provenance []*depResolution // how each resolved include was resolved
+  // Dependencies of generated nodes, added after includes are resolved.
+  extraDeps []*resolvedDep
+}
+
+// AutoResolved returns the ambiguous includes that were resolved automatically.
+func (s *SDKWalker) AutoResolved() []*AutoResolution {
+  return s.autoResolved.sorted()
+}
+
+// ResolutionMethods counts how many includes were resolved by each method,
+// like "search_paths", and how many weren't.
+func (s *SDKWalker) ResolutionMethods() map[string]int {
+  return s.resolutionMethods
 }
 
-func (s *SDKWalker) PopulateGraph() ([]*unresolvedDep, error) {
+// Provenance returns how each resolved include was resolved. Only valid
+// after PopulateGraph.
+func (s *SDKWalker) Provenance() []*depResolution {
+  return s.provenance
+}
+
+// BuildFiles returns the paths of all existing BUILD files found in the SDKs.
+// These are replaced when new BUILD files are generated.
+func (s *SDKWalker) BuildFiles() []string {
+  return s.buildFiles
+}
+
+// PopulateGraph walks the SDK and fills the graph with nodes and dependencies.
+// It returns the dependencies that couldn't be resolved.
+func (s *SDKWalker) PopulateGraph(ctx context.Context) ([]*unresolvedDep, error) {
   if err := s.addSourceSetFiles(); err != nil {
     return nil, fmt.Errorf("addSourceSetFiles: %v", err)
   }
   // Add nodes to graph and add dependencies to resolvedDeps/unresolvedDeps
-  if err := filepath.Walk(s.conf.SDKDir, s.addFilesAsNodes); err != nil {
-    return nil, fmt.Errorf("filepath.Walk: %v", err)
+  walkFn := func(path string, info os.FileInfo, err error) error {
+    if ctxErr := ctx.Err(); ctxErr != nil {
+      return ctxErr
+    }
+    return s.addFilesAsNodes(path, info, err)
+  }
+  for _, sdkDir := range s.conf.SDKDirs {
+    if err := filepath.Walk(sdkDir, walkFn); err != nil {
+      return nil, fmt.Errorf("filepath.Walk(%q): %v", sdkDir, err)
+    }
+  }
+  if err := s.addSoftDeviceNodes(); err != nil {
+    return nil, fmt.Errorf("addSoftDeviceNodes: %v", err)
+  }
+  if err := s.addMDKNodes(); err != nil {
+    return nil, fmt.Errorf("addMDKNodes: %v", err)
+  }
+  if err := s.addCMSISNodes(); err != nil {
+    return nil, fmt.Errorf("addCMSISNodes: %v", err)
+  }
+  if err := s.addDirectoryNodes(); err != nil {
+    return nil, fmt.Errorf("addDirectoryNodes: %v", err)
+  }
+  if err := s.addFilegroupNodes(); err != nil {
+    return nil, fmt.Errorf("addFilegroupNodes: %v", err)
   }
   if err := s.addOverrideNodes(); err != nil {
     return nil, fmt.Errorf("addOverrideNodes: %v", err)
@@ -42,10 +139,34 @@ func (s *SDKWalker) PopulateGraph() ([]*unresolvedDep, error) {
   if err := s.addRemapNodes(); err != nil {
     return nil, fmt.Errorf("addRemapNodes: %v", err)
   }
-  unresolved, err := s.addDepsAsEdges()
+  if err := s.addSelectNodes(); err != nil {
+    return nil, fmt.Errorf("addSelectNodes: %v", err)
+  }
+  if err := s.addSDKConfigNodes(); err != nil {
+    return nil, fmt.Errorf("addSDKConfigNodes: %v", err)
+  }
+  if err := s.addLogBackendNodes(); err != nil {
+    return nil, fmt.Errorf("addLogBackendNodes: %v", err)
+  }
+  if err := s.attachOrphanSources(); err != nil {
+    return nil, fmt.Errorf("attachOrphanSources: %v", err)
+  }
+  s.conf.logf(VerbosityPhases, "Added %d nodes to the graph from %d SDK roots", len(s.graph.Nodes()), len(s.conf.SDKDirs))
+  unresolved, err := s.addDepsAsEdges(ctx)
   if err != nil {
     return nil, fmt.Errorf("addDepsAsEdges: %v", err)
   }
+  if err := s.addSelectEdges(ctx); err != nil {
+    return nil, fmt.Errorf("addSelectEdges: %v", err)
+  }
+  if err := s.addAppConfigDep(ctx); err != nil {
+    return nil, fmt.Errorf("addAppConfigDep: %v", err)
+  }
+  for _, dep := range s.extraDeps {
+    if err := s.graph.AddDependency(ctx, dep.src, dep.dst); err != nil {
+      return nil, fmt.Errorf("AddDependency(%q, %q): %v", dep.src, dep.dst, err)
+    }
+  }
   return unresolved, nil
 }
 
@@ -67,17 +188,15 @@ func (s *SDKWalker) addFilesAsNodes(path string, info os.FileInfo, err error) er
     return fmt.Errorf("%s: %v", path, err)
   }
   // Check to see if path is excluded.
-  for _, exclude := range s.conf.Excludes {
-    matched, err := filepath.Match(exclude, path)
-    if err != nil {
-      return err
-    }
-    if matched && info.IsDir() {
-      return filepath.SkipDir
-    }
-    if matched {
-      return nil
-    }
+  excluded, err := s.conf.excluded(path)
+  if err != nil {
+    return err
+  }
+  if excluded && info.IsDir() {
+    return filepath.SkipDir
+  }
+  if excluded {
+    return nil
   }
 
   // We don't care about directories
@@ -85,17 +204,39 @@ func (s *SDKWalker) addFilesAsNodes(path string, info os.FileInfo, err error) er
     return nil
   }
 
-  // Remove all BUILD files
+  // Keep track of all BUILD files, so they can be replaced.
   if info.Name() == "BUILD" {
-    if err := os.Remove(path); err != nil {
-      return fmt.Errorf("os.Remove(%s): %v", path, err)
-    }
+    s.buildFiles = append(s.buildFiles, path)
+  }
+
+  // SoftDevice headers and hex files are added to the SoftDevice's targets later.
+  if s.conf.Layout == bazelifyrc.Layout_NRF5_SDK && s.conf.SourceSetsByFile[path] == nil && s.softDevices.add(path) {
+    return nil
+  }
+
+  // Files in filegroup_extensions are added to filegroups later.
+  if s.conf.FilegroupExtensions[filepath.Ext(path)] {
+    s.filegroupFiles = append(s.filegroupFiles, path)
+  }
+
+  // Linker scripts are added to the MDK later.
+  if s.conf.Layout == bazelifyrc.Layout_NRF5_SDK && filepath.Ext(path) == ".ld" {
+    s.linkerScripts = append(s.linkerScripts, path)
+    return nil
+  }
+
+  // Sources that no header claims are attached to libraries later.
+  if s.conf.Layout == bazelifyrc.Layout_NRF5_SDK && filepath.Ext(path) == ".c" && s.conf.SourceSetsByFile[path] == nil {
+    s.sourceFiles = append(s.sourceFiles, path)
   }
 
   // We only want to deal with .h files
   if filepath.Ext(path) != ".h" {
     return nil
   }
+  if info.Name() == sdkConfigHeader {
+    s.sdkConfigFound = true
+  }
 
   // Source set files have already been added, so skip them here.
   if s.conf.SourceSetsByFile[path] != nil {
@@ -117,17 +258,46 @@ func (s *SDKWalker) addFilesAsNodes(path string, info os.FileInfo, err error) er
   hdrs := []*bazel.Label{hdrLabel}
   var srcs []*bazel.Label
   srcFileName := fmt.Sprintf("%s.c", name)
-  if _, err := os.Stat(filepath.Join(dir, srcFileName)); err == nil {
-    srcLabel, err := bazel.NewLabel(dir, srcFileName, s.conf.WorkspaceDir)
+  srcDir := dir
+  if _, err := os.Stat(filepath.Join(dir, srcFileName)); err != nil && s.conf.SplitHeaderDirs[filepath.Base(dir)] {
+    // Look for the source in a sibling src dir, like api/a.h and src/a.c.
+    srcDir = filepath.Join(filepath.Dir(dir), "src")
+  }
+  if s.conf.Layout == bazelifyrc.Layout_NRF5_SDK && isMDKSystemHeader(info.Name()) {
+    // The system source goes in the startup library instead.
+    s.mdkDirs[dir] = true
+  } else if _, err := os.Stat(filepath.Join(srcDir, srcFileName)); err == nil {
+    srcLabel, err := bazel.NewLabel(srcDir, srcFileName, s.conf.WorkspaceDir)
     if err != nil {
-      return fmt.Errorf("bazel.NewLabel(%q, %q): %v", dir, srcFileName, err)
+      return fmt.Errorf("bazel.NewLabel(%q, %q): %v", srcDir, srcFileName, err)
     }
     srcs = append(srcs, srcLabel)
   }
 
-  if err := s.graph.AddLibraryNode(label, srcs, hdrs, []string{label.Dir()}); err != nil {
+  // CMSIS core headers are added to their dir's cmsis library later.
+  if len(srcs) == 0 && s.addCMSISHeader(dir, hdrLabel) {
+    return nil
+  }
+
+  // Textual headers are folded into the libraries that include them later.
+  if len(srcs) == 0 && s.addTextualHeader(hdrLabel) {
+    return nil
+  }
+
+  // With per_directory granularity, the dir's library is added later.
+  if s.conf.perDirectory(dir) {
+    s.addDirectoryFiles(dir, srcs, hdrs)
+    return nil
+  }
+
+  includes := []string{label.Dir()}
+  if s.conf.Layout == bazelifyrc.Layout_NCS {
+    includes = append(includes, s.conf.ncsIncludeRoots(dir)...)
+  }
+  if err := s.graph.AddLibraryNode(label, srcs, hdrs, includes); err != nil {
     return fmt.Errorf("graph.AddLibraryNode(%q, %v, %v): %v", label, srcs, hdrs, err)
   }
+  s.addLogBackend(dir, label, hdrLabel)
   return nil
 }
 
@@ -140,6 +310,41 @@ func (s *SDKWalker) addOverrideNodes() error {
   return nil
 }
 
+func (s *SDKWalker) addSelectNodes() error {
+  for name, override := range s.conf.SelectOverrides {
+    if err := s.graph.AddSelectNode(name, override); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// addSelectEdges makes select nodes depend on the nodes of their labels,
+// so they are generated, and kept by --prune_unreachable.
+func (s *SDKWalker) addSelectEdges(ctx context.Context) error {
+  for _, node := range s.graph.Nodes() {
+    sel, ok := node.(*SelectNode)
+    if !ok {
+      continue
+    }
+    for _, label := range sel.Labels() {
+      dst := s.graph.Node(label)
+      if dst == nil {
+        continue
+      }
+      // Select nodes can't be merged into groups.
+      if len(s.graph.edgesFromTo(dst, sel)) != 0 {
+        log.Printf("Not adding dependency of select_overrides %q on %s: it would create a dependency cycle", sel.Include, label)
+        continue
+      }
+      if err := s.graph.AddDependency(ctx, sel.Label(), label); err != nil {
+        return err
+      }
+    }
+  }
+  return nil
+}
+
 func (s *SDKWalker) addRemapNodes() error {
   if s.conf.Remaps == nil {
     return nil
@@ -189,9 +394,13 @@ type unresolvedDep struct {
 
 type resolvedDep struct {
   src, dst *bazel.Label
+  include string // the include that resolved to dst, "" for generated deps
+  method string // a provenance method
+  includeDir string // the include dir it was found in, for include_dirs
+  priority int32 // includeDir's priority
 }
 
-func (s *SDKWalker) addDepsAsEdges() ([]*unresolvedDep, error) {
+func (s *SDKWalker) addDepsAsEdges(ctx context.Context) ([]*unresolvedDep, error) {
   allUnresolved := make(map[string]*unresolvedDep) // maps dstFileName -> unresolvedDep
   var allResolved []*resolvedDep
 
@@ -201,6 +410,9 @@ func (s *SDKWalker) addDepsAsEdges() ([]*unresolvedDep, error) {
   // in case we mess with the graph. So, we collect all the resolved deps and add them
   // at the end.
   for _, n := range s.graph.Nodes() {
+    if err := ctx.Err(); err != nil {
+      return nil, err
+    }
     node, ok := n.(*LibraryNode)
     if !ok {
       // Skip non-Library nodes, because all other node types are resolved differently.
@@ -222,11 +434,24 @@ func (s *SDKWalker) addDepsAsEdges() ([]*unresolvedDep, error) {
     }
   }
 
+  s.conf.logf(VerbosityPhases, "Resolved %d includes, %d headers are unresolved", len(allResolved), len(allUnresolved))
+
   // Add all resolved dependencies to the graph.
   for _, dep := range allResolved {
-    if err := s.graph.AddDependency(dep.src, dep.dst); err != nil {
+    if dep.include != "" {
+      s.graph.markIncluded(s.graph.Node(dep.dst), dep.include)
+    }
+    if err := s.graph.AddDependency(ctx, dep.src, dep.dst); err != nil {
       return nil, err
     }
+    s.provenance = append(s.provenance, &depResolution{
+      src: s.graph.Node(dep.src),
+      dst: s.graph.Node(dep.dst),
+      include: dep.include,
+      method: dep.method,
+      includeDir: dep.includeDir,
+      priority: dep.priority,
+    })
   }
 
   // Convert unresolvedDep back into a slice.
@@ -247,34 +472,65 @@ func (s *SDKWalker) readDepsOnce(node *LibraryNode) ([]*resolvedDep, []*unresolv
   }
 
   // Read includes for srcs and hdrs
+  // Angle bracket includes are only followed in the NCS layout.
+  followAngled := s.conf.Layout == bazelifyrc.Layout_NCS
   deps := make(map[string]bool)
+  angledOnly := make(map[string]bool) // includes that only appear as #include <...>
   for _, fileLabel := range srcsHdrs {
     filePath := filepath.Join(s.conf.WorkspaceDir, fileLabel.Dir(), fileLabel.Name())
-    includes, err := readIncludes(filePath)
+    includes, angled, err := readIncludes(filePath, followAngled, s.conf.MacroIncludes, s.conf.DefinePruning.Defines)
     if err != nil {
       return nil, nil, fmt.Errorf("readIncludes(%q): %v", s.prettySDKPath(filePath), err)
     }
     for _, include := range includes {
       deps[include] = true
+      delete(angledOnly, include)
+    }
+    for _, include := range angled {
+      if !deps[include] {
+        angledOnly[include] = true
+      }
+      deps[include] = true
     }
   }
 
+  if err := s.foldTextualHeaders(node, deps); err != nil {
+    return nil, nil, err
+  }
+
   // Filter the deps that should be ignored.
   for dep := range deps {
-    if s.conf.IgnoreHeaders[dep] {
+    ignores := s.conf.ignoreHeader(dep)
+    for _, ignore := range ignores {
+      s.matchedIgnores[ignore] = true
+    }
+    if len(ignores) > 0 {
       delete(deps, dep)
     }
   }
 
-  // Filter the deps that match up with files in the srcs/hdrs of this node.
+  // Filter the deps that match up with files in the srcs/hdrs of this node,
+  // relative to the node's dir, or any of its header dirs.
+  ownDirs := map[string]bool{node.Label().Dir(): true}
+  for _, hdr := range node.Hdrs {
+    ownDirs[hdr.Dir()] = true
+  }
   for dep := range deps {
-    dir := filepath.Join(s.conf.WorkspaceDir, node.Label().Dir())
-    depLabel, err := bazel.NewLabel(dir, dep, s.conf.WorkspaceDir)
-    if err != nil {
-      return nil, nil, fmt.Errorf("bazel.NewLabel(%q, %q): %v", dir, dep, err)
-    }
-    if srcsHdrs[depLabel.String()] != nil {
-      delete(deps, dep)
+    for ownDir := range ownDirs {
+      // Includes like "../a.h" are labels of files in other dirs.
+      path := filepath.Join(s.conf.WorkspaceDir, ownDir, dep)
+      if !strings.HasPrefix(path, s.conf.WorkspaceDir + string(filepath.Separator)) {
+        continue
+      }
+      depLabel, err := bazel.NewLabel(filepath.Dir(path), filepath.Base(path), s.conf.WorkspaceDir)
+      if err != nil {
+        return nil, nil, fmt.Errorf("bazel.NewLabel(%q): %v", path, err)
+      }
+      if srcsHdrs[depLabel.String()] != nil {
+        // Its own headers aren't orphans.
+        s.graph.includedHeaders[depLabel.String()] = true
+        delete(deps, dep)
+      }
     }
   }
   
@@ -286,11 +542,17 @@ func (s *SDKWalker) readDepsOnce(node *LibraryNode) ([]*resolvedDep, []*unresolv
     if !s.graph.IsFileOverridden(dep) {
       continue
     }
+    s.matchedOverrides[dep] = true
+    // If the file is overridden, we're guaranteed to have exactly 1 returned Node.
+    dst := s.graph.NodesWithFile(dep)[0]
     resolved = append(resolved, &resolvedDep{
       src: node.Label(),
-      // If the file is overridden, we're guaranteed to have exactly 1 returned Node.
-      dst: s.graph.NodesWithFile(dep)[0].Label(),
+      dst: dst.Label(),
+      include: dep,
+      method: overrideProvenance(s.conf, dep, dst),
     })
+    s.conf.logf(VerbosityResolutions, "%s: resolved %s to %s: include_overrides", node.Label(), dep, dst.Label())
+    s.resolutionMethods[resolvedByOverride]++
     delete(deps, dep)
   }
 
@@ -300,9 +562,12 @@ func (s *SDKWalker) readDepsOnce(node *LibraryNode) ([]*resolvedDep, []*unresolv
   searchPaths = append(searchPaths, filepath.Join(s.conf.WorkspaceDir, node.Label().Dir()))
   searchPaths = append(searchPaths, s.conf.IncludeDirs...)
   for dep := range deps {
-    // Stat all instances of the include. If we find a relative include that matches,
-    // format the target and resolve it.
-    for _, searchPath := range searchPaths {
+    // Stat all instances of the include. The first search path with a
+    // matching target wins, like the compiler's search.
+    var found []*bazel.Label
+    var foundIn []int // index of the first search path with each of found
+    method := provenanceSameDir
+    for i, searchPath := range searchPaths {
       search := filepath.Clean(filepath.Join(searchPath, dep))
       info, err := os.Stat(search)
       if err != nil {
@@ -315,22 +580,79 @@ func (s *SDKWalker) readDepsOnce(node *LibraryNode) ([]*resolvedDep, []*unresolv
       if err != nil {
         return nil, nil, fmt.Errorf("bazel.NewLabel(%q, %q, %q): %v", searchPath, strings.TrimSuffix(dep, ".h"), s.conf.WorkspaceDir, err)
       }
+      // Headers of per_directory dirs are in their dir's library.
+      if lib := s.dirLibraryHeaders[search]; lib != nil {
+        depLabel = lib
+      }
       // Make sure the node is part of the graph.
       if depNode := s.graph.Node(depLabel); depNode == nil {
         continue
       }
-      resolved = append(resolved, &resolvedDep{
-        src: node.Label(),
-        dst: depLabel,
-      })
-      delete(deps, dep)
-      break
+      if len(found) == 0 && i > 0 {
+        method = provenanceIncludeDirs
+      }
+      if !containsLabel(found, depLabel) {
+        found = append(found, depLabel)
+        foundIn = append(foundIn, i)
+      }
+    }
+    if len(found) > 0 {
+      s.conf.logf(VerbosityCandidates, "%s: candidates for %s in the search paths: [%s]", node.Label(), dep, bazel.JoinLabelStrings(found, ", "))
+    }
+    if len(found) == 0 {
+      continue
+    }
+    if len(found) > 1 && s.includeDirTie(searchPaths, foundIn) {
+      if err := shadowedInclude(node.Label(), dep, found); err != nil {
+        return nil, nil, err
+      }
+    } else if len(found) > 1 {
+      s.conf.logf(VerbosityResolutions, "%s: %s shadows %s by include_dir_priorities", node.Label(), found[0], bazel.JoinLabelStrings(found[1:], ", "))
+    }
+    r := &resolvedDep{
+      src: node.Label(),
+      dst: found[0],
+      include: dep,
+      method: method,
+    }
+    if method == provenanceIncludeDirs {
+      searchPath := searchPaths[foundIn[0]]
+      r.includeDir = strings.TrimPrefix(searchPath, s.conf.WorkspaceDir + string(filepath.Separator))
+      r.priority = s.conf.IncludeDirPriority[searchPath]
     }
+    resolved = append(resolved, r)
+    s.conf.logf(VerbosityResolutions, "%s: resolved %s to %s: found in the search paths", node.Label(), dep, found[0])
+    s.resolutionMethods[resolvedBySearchPath]++
+    delete(deps, dep)
   }
 
   // Look through remaining deps and see if we can find nodes that contain the file.
   for dep := range deps {
-    nodes := s.graph.NodesWithFile(dep)
+    nodes := s.nodesWithInclude(dep)
+    if len(nodes) == 0 && angledOnly[dep] {
+      // Toolchain headers, and headers generated at build time.
+      s.conf.logf(VerbosityResolutions, "%s: not resolving <%s>: no library has it", node.Label(), dep)
+      s.resolutionMethods[notResolvedAngled]++
+      continue
+    }
+    if s.conf.Verbosity >= VerbosityCandidates {
+      var candidates []*bazel.Label
+      for _, n := range nodes {
+        candidates = append(candidates, n.Label())
+      }
+      s.conf.logf(VerbosityCandidates, "%s: candidates for %s in the graph: [%s]", node.Label(), dep, bazel.JoinLabelStrings(candidates, ", "))
+    }
+    reason, method := "only library with the header", resolvedByOnlyCandidate
+    if len(nodes) > 1 {
+      chosen, err := s.autoResolve(node, dep, nodes)
+      if err != nil {
+        return nil, nil, fmt.Errorf("autoResolve(%q): %v", dep, err)
+      }
+      if chosen != nil {
+        nodes = []Node{chosen}
+        reason, method = "resolved automatically", resolvedAutomatically
+      }
+    }
     if len(nodes) != 1 {
       var possible []*bazel.Label
       for _, n := range nodes {
@@ -341,28 +663,106 @@ func (s *SDKWalker) readDepsOnce(node *LibraryNode) ([]*resolvedDep, []*unresolv
         dstFileName: dep,
         possible: possible,
       })
+      s.conf.logf(VerbosityResolutions, "%s: could not resolve %s: %d candidates", node.Label(), dep, len(possible))
+      s.resolutionMethods[unresolvedInclude]++
     } else {
+      s.addIncludeRoot(nodes[0], dep)
       resolved = append(resolved, &resolvedDep{
         src: node.Label(),
         dst: nodes[0].Label(),
+        include: dep,
+        method: method,
       })
+      s.conf.logf(VerbosityResolutions, "%s: resolved %s to %s: %s", node.Label(), dep, nodes[0].Label(), reason)
+      s.resolutionMethods[method]++
     }
   }
 
   return resolved, unresolved, nil
 }
 
-func readIncludes(path string) ([]string, error) {
+// nodesWithInclude finds all nodes with a header matching the include.
+// Path-prefixed includes like "drivers/gpio.h" only match headers whose path
+// ends with the include.
+func (s *SDKWalker) nodesWithInclude(include string) []Node {
+  if !strings.Contains(include, "/") {
+    return s.graph.NodesWithFile(include)
+  }
+  var out []Node
+  for _, node := range s.graph.NodesWithFile(filepath.Base(include)) {
+    if strings.HasSuffix(s.headerPath(node, include), string(filepath.Separator)+filepath.FromSlash(include)) {
+      out = append(out, node)
+    }
+  }
+  return out
+}
+
+// addIncludeRoot adds the dir that a path-prefixed include is relative to,
+// to the includes of the library that has the header.
+func (s *SDKWalker) addIncludeRoot(node Node, include string) {
+  lib, ok := node.(*LibraryNode)
+  if !ok || !strings.Contains(include, "/") {
+    return
+  }
+  path := s.headerPath(node, include)
+  root := strings.TrimSuffix(path, string(filepath.Separator)+filepath.FromSlash(include))
+  if root == path {
+    return
+  }
+  rel, err := filepath.Rel(s.conf.WorkspaceDir, root)
+  if err != nil {
+    return
+  }
+  for _, existing := range lib.Includes {
+    if existing == rel {
+      return
+    }
+  }
+  lib.Includes = append(lib.Includes, rel)
+}
+
+// readIncludes reads the #include "..." lines of a file.
+// If angled is set, #include <...> lines are read too, and returned separately.
+// Includes of macros in macros, like #include NRF_LOG_HEADER, are returned as
+// the include they expand to. Other macro includes are skipped.
+// If defines isn't nil, includes in #if branches that the defines make false
+// are skipped too.
+func readIncludes(path string, angled bool, macros, defines map[string]string) ([]string, []string, error) {
   file, err := os.Open(path)
   if err != nil {
-    return nil, err
+    return nil, nil, err
   }
   defer file.Close()
 
   scanner := bufio.NewScanner(file)
-  var out []string
+  var out, outAngled []string
+  conds := &conditionals{defines: defines}
+  var continued string
   for scanner.Scan() {
     line := scanner.Text()
+    if defines != nil {
+      // Conditions can go on over several lines.
+      if strings.HasSuffix(line, "\\") {
+        continued += strings.TrimSuffix(line, "\\") + " "
+        continue
+      }
+      line, continued = continued + line, ""
+      if conds.directive(line) || conds.skipped() {
+        continue
+      }
+    }
+    if angled {
+      if matches := angleIncludeMatcher.FindStringSubmatch(line); len(matches) == 2 {
+        outAngled = append(outAngled, matches[1])
+        continue
+      }
+    }
+    if matches := macroIncludeMatcher.FindStringSubmatch(line); len(matches) == 2 {
+      if include, ok := macros[matches[1]]; ok {
+        out = append(out, include)
+      }
+      continue
+    }
     matches := includeMatcher.FindStringSubmatch(line)
     if len(matches) != 2 {
       if matches != nil {
@@ -372,12 +772,56 @@ func readIncludes(path string) ([]string, error) {
     }
     out = append(out, matches[1])
   }
-  return out, nil
+  return out, outAngled, nil
 }
 
 func (s *SDKWalker) prettySDKPath(path string) string {
-  if !strings.HasPrefix(path, s.conf.SDKDir) {
-    return fmt.Sprintf("<WARNING: not in SDK %q>", s.conf.SDKDir)
+  for i, sdkDir := range s.conf.SDKDirs {
+    if !strings.HasPrefix(path, sdkDir) {
+      continue
+    }
+    if i == 0 {
+      return "<SDK>" + strings.TrimPrefix(path, sdkDir)
+    }
+    return fmt.Sprintf("<SDK %s>", filepath.Base(sdkDir)) + strings.TrimPrefix(path, sdkDir)
+  }
+  return fmt.Sprintf("<WARNING: not in SDKs %q>", s.conf.SDKDirs)
+}
+
+// includeDirTie reports whether the first search path that an include was
+// found in only wins by order: it's the library's own dir, or another one has
+// the same include_dir_priorities priority. foundIn has the indexes of the
+// search paths with the include, in order.
+func (s *SDKWalker) includeDirTie(searchPaths []string, foundIn []int) bool {
+  if foundIn[0] == 0 {
+    return true
+  }
+  priority := s.conf.IncludeDirPriority[searchPaths[foundIn[0]]]
+  for _, i := range foundIn[1:] {
+    if s.conf.IncludeDirPriority[searchPaths[i]] >= priority {
+      return true
+    }
+  }
+  return false
+}
+
+// shadowedInclude warns that the include of the library with label matched
+// more than one search path, so found[0] shadows the rest. With --strict, it
+// is an error instead.
+func shadowedInclude(label *bazel.Label, include string, found []*bazel.Label) error {
+  msg := fmt.Sprintf("%s: %q is in more than one search path, using %s and not %s", label, include, found[0], bazel.JoinLabelStrings(found[1:], ", "))
+  if *strict {
+    return fmt.Errorf("%s (--strict)", msg)
+  }
+  log.Printf("Warning: %s", msg)
+  return nil
+}
+
+func containsLabel(labels []*bazel.Label, label *bazel.Label) bool {
+  for _, l := range labels {
+    if l.Equal(label) {
+      return true
+    }
   }
-  return "<SDK>" + strings.TrimPrefix(path, s.conf.SDKDir)
-}
\ No newline at end of file
+  return false
+}